@@ -20,6 +20,9 @@
 // Run with:
 //
 //	go test -v -parallel 4
+//
+// The allocators are coordinated (ports.AllocatorConfig.Coordinated), so
+// tests allocating at the same moment never race for the same ports.
 package parallel_testing
 
 import (
@@ -30,15 +33,24 @@ import (
 	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
 )
 
+// newAllocator returns an allocator that coordinates with the other tests
+// in this process.
+func newAllocator() *ports.Allocator {
+	config := ports.DefaultAllocatorConfig()
+	config.Coordinated = true
+	return ports.NewAllocator(config)
+}
+
 // TestParallelService1 demonstrates parallel test isolation.
 func TestParallelService1(t *testing.T) {
 	t.Parallel()
 
-	allocator := ports.NewAllocator(nil)
+	allocator := newAllocator()
 	basePort, err := allocator.AllocateRange(2)
 	if err != nil {
 		t.Fatal("Failed to allocate ports:", err)
 	}
+	defer allocator.Release(basePort, 2)
 
 	t.Logf("Test 1: Allocated ports %d-%d", basePort, basePort+1)
 
@@ -59,11 +71,12 @@ func TestParallelService1(t *testing.T) {
 func TestParallelService2(t *testing.T) {
 	t.Parallel()
 
-	allocator := ports.NewAllocator(nil)
+	allocator := newAllocator()
 	basePort, err := allocator.AllocateRange(2)
 	if err != nil {
 		t.Fatal("Failed to allocate ports:", err)
 	}
+	defer allocator.Release(basePort, 2)
 
 	t.Logf("Test 2: Allocated ports %d-%d", basePort, basePort+1)
 
@@ -83,11 +96,12 @@ func TestParallelService2(t *testing.T) {
 func TestParallelService3(t *testing.T) {
 	t.Parallel()
 
-	allocator := ports.NewAllocator(nil)
+	allocator := newAllocator()
 	basePort, err := allocator.AllocateRange(3)
 	if err != nil {
 		t.Fatal("Failed to allocate ports:", err)
 	}
+	defer allocator.Release(basePort, 3)
 
 	t.Logf("Test 3: Allocated ports %d-%d", basePort, basePort+2)
 
@@ -111,11 +125,12 @@ func TestParallelService3(t *testing.T) {
 func TestParallelService4(t *testing.T) {
 	t.Parallel()
 
-	allocator := ports.NewAllocator(nil)
+	allocator := newAllocator()
 	basePort, err := allocator.AllocateRange(4)
 	if err != nil {
 		t.Fatal("Failed to allocate ports:", err)
 	}
+	defer allocator.Release(basePort, 4)
 
 	// Assign semantic names to ports
 	apiPort := basePort
@@ -0,0 +1,258 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/spf13/cobra"
+)
+
+var (
+	benchPorts       int
+	benchIterations  int
+	benchConcurrency int
+	benchRange       string
+	benchMaxRetries  int
+	benchRetryDelay  time.Duration
+	benchCoordinated bool
+	benchScanCache   time.Duration
+	benchFormat      string
+)
+
+var benchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "Measure port allocation latency and failure rate on this host",
+	Long: `Bench allocates ranges repeatedly from concurrent workers, the way parallel
+test runners do, and reports the latency distribution and failure rate.
+
+Each worker binds the ports it was given and releases them before its next
+allocation, so workers compete for ports like real runners. An allocation
+fails when the allocator exhausts its retries; it collides when another
+worker bound one of its ports first.
+
+Use the allocator flags to try an AllocatorConfig before adopting it; the
+report ends with a recommendation.`,
+	Example: `  # Measure the defaults with 8 concurrent runners
+  go-portalloc bench --ports 5 --iterations 100 --concurrency 8
+
+  # Try coordinated allocation in a narrower range
+  go-portalloc bench --range 40000-41000 --coordinated`,
+	Args: cobra.NoArgs,
+	RunE: runBench,
+}
+
+func init() {
+	defaults := ports.DefaultAllocatorConfig()
+	benchCmd.Flags().IntVarP(&benchPorts, "ports", "p", defaultPorts, "Number of consecutive ports per allocation")
+	benchCmd.Flags().IntVar(&benchIterations, "iterations", 100, "Total number of allocations")
+	benchCmd.Flags().IntVar(&benchConcurrency, "concurrency", 8, "Number of concurrent workers")
+	benchCmd.Flags().StringVar(&benchRange, "range", defaultScanRange(), "Port range as START-END (END exclusive)")
+	benchCmd.Flags().IntVar(&benchMaxRetries, "max-retries", defaults.MaxRetries, "AllocatorConfig.MaxRetries")
+	benchCmd.Flags().DurationVar(&benchRetryDelay, "retry-delay", defaults.RetryDelay, "AllocatorConfig.RetryDelay")
+	benchCmd.Flags().BoolVar(&benchCoordinated, "coordinated", false, "AllocatorConfig.Coordinated")
+	benchCmd.Flags().DurationVar(&benchScanCache, "scan-cache-ttl", 0, "AllocatorConfig.ScanCacheTTL")
+	benchCmd.Flags().StringVar(&benchFormat, "format", "table", "Output format (table, json)")
+}
+
+// benchReport is the 'bench --format json' output.
+type benchReport struct {
+	Ports       int     `json:"ports"`
+	Iterations  int     `json:"iterations"`
+	Concurrency int     `json:"concurrency"`
+	StartPort   int     `json:"start_port"`
+	EndPort     int     `json:"end_port"`
+	Succeeded   int     `json:"succeeded"`
+	Failed      int     `json:"failed"`
+	Collisions  int     `json:"collisions"`
+	FailureRate float64 `json:"failure_rate"`
+	// Latencies are of successful allocations, in milliseconds.
+	P50            float64 `json:"p50_ms"`
+	P95            float64 `json:"p95_ms"`
+	P99            float64 `json:"p99_ms"`
+	Max            float64 `json:"max_ms"`
+	Throughput     float64 `json:"allocations_per_second"`
+	Recommendation string  `json:"recommendation"`
+}
+
+func runBench(cmd *cobra.Command, args []string) error {
+	if benchFormat != "table" && benchFormat != "json" {
+		return usageErrorf("unknown format: %s", benchFormat)
+	}
+	if benchPorts <= 0 || benchIterations <= 0 || benchConcurrency <= 0 {
+		return usageErrorf("--ports, --iterations, and --concurrency must be positive")
+	}
+	start, end, err := parsePortRange(benchRange)
+	if err != nil {
+		return &usageError{err: err}
+	}
+
+	config := ports.DefaultAllocatorConfig()
+	config.StartPort = start
+	config.EndPort = end
+	config.MaxRetries = benchMaxRetries
+	config.RetryDelay = benchRetryDelay
+	config.Coordinated = benchCoordinated
+	config.ScanCacheTTL = benchScanCache
+	config.Logger = logger
+	allocator := ports.NewAllocator(config)
+
+	report := &benchReport{
+		Ports:       benchPorts,
+		Iterations:  benchIterations,
+		Concurrency: benchConcurrency,
+		StartPort:   start,
+		EndPort:     end,
+	}
+	if benchFormat == "table" {
+		fmt.Printf(emoji("⏱️  %d allocations of %d ports, concurrency %d, range %d-%d\n"),
+			benchIterations, benchPorts, benchConcurrency, start, end)
+	}
+
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		wg        sync.WaitGroup
+	)
+	jobs := make(chan struct{}, benchIterations)
+	for i := 0; i < benchIterations; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+
+	began := time.Now()
+	for w := 0; w < benchConcurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				latency, err := benchAllocation(allocator, benchPorts)
+
+				mu.Lock()
+				switch {
+				case errors.Is(err, errBenchCollision):
+					report.Collisions++
+				case err != nil:
+					report.Failed++
+				default:
+					report.Succeeded++
+					latencies = append(latencies, latency)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(began)
+
+	report.FailureRate = float64(report.Failed+report.Collisions) / float64(benchIterations)
+	report.Throughput = float64(benchIterations) / elapsed.Seconds()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	report.P50 = milliseconds(percentile(latencies, 50))
+	report.P95 = milliseconds(percentile(latencies, 95))
+	report.P99 = milliseconds(percentile(latencies, 99))
+	report.Max = milliseconds(percentile(latencies, 100))
+	report.Recommendation = benchRecommendation(report, config)
+
+	if benchFormat == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+
+	fmt.Println()
+	fmt.Printf("  Succeeded:  %d\n", report.Succeeded)
+	fmt.Printf("  Failed:     %d (retries exhausted)\n", report.Failed)
+	fmt.Printf("  Collisions: %d (ports bound by another worker first)\n", report.Collisions)
+	fmt.Printf("  Latency:    p50 %.2fms  p95 %.2fms  p99 %.2fms  max %.2fms\n", report.P50, report.P95, report.P99, report.Max)
+	fmt.Printf("  Throughput: %.0f allocations/s\n", report.Throughput)
+	fmt.Println()
+	fmt.Printf(emoji("💡 %s\n"), report.Recommendation)
+	return nil
+}
+
+// errBenchCollision is a bench allocation whose ports were bound by another
+// worker between probe and bind.
+var errBenchCollision = errors.New("allocated port already bound")
+
+// benchAllocation times one allocation of count ports, then binds and
+// releases them like a test runner would, including the allocator's claim
+// on them so coordinated runs do not exhaust the range.
+func benchAllocation(allocator *ports.Allocator, count int) (time.Duration, error) {
+	began := time.Now()
+	basePort, err := allocator.AllocateRange(count)
+	latency := time.Since(began)
+	if err != nil {
+		return latency, err
+	}
+	defer allocator.Release(basePort, count)
+
+	listeners := make([]net.Listener, 0, count)
+	defer func() {
+		for _, l := range listeners {
+			_ = l.Close()
+		}
+	}()
+	for i := 0; i < count; i++ {
+		l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", basePort+i))
+		if err != nil {
+			return latency, errBenchCollision
+		}
+		listeners = append(listeners, l)
+	}
+	return latency, nil
+}
+
+// percentile returns the p-th percentile (nearest rank) of sorted, or 0.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank, 1)-1]
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// benchRecommendation suggests the AllocatorConfig change that addresses
+// the worst problem in report.
+func benchRecommendation(report *benchReport, config *ports.AllocatorConfig) string {
+	width := config.EndPort - config.StartPort
+	switch {
+	case report.Failed > 0:
+		return fmt.Sprintf("%d allocation(s) exhausted %d retries: widen the range (%s, currently %d ports) or raise MaxRetries",
+			report.Failed, config.MaxRetries, ports.PortRangeEnv, width)
+	case report.Collisions > 0 && !config.Coordinated:
+		return fmt.Sprintf("%d allocation(s) raced another allocator for the same ports: enable Coordinated allocation (--coordinated)",
+			report.Collisions)
+	case report.Collisions > 0:
+		return fmt.Sprintf("%d allocation(s) lost ports to processes outside go-portalloc: move the range away from busy ports (see 'go-portalloc scan')",
+			report.Collisions)
+	case report.P99 >= milliseconds(config.RetryDelay) && config.RetryDelay > 0:
+		return "Retries dominate tail latency: widen the range, or enable ScanCacheTTL (--scan-cache-ttl) to pick windows from a cached scan"
+	default:
+		return "The allocator configuration suits this host; no change needed"
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPercentile(t *testing.T) {
+	assert.Zero(t, percentile(nil, 50))
+
+	sorted := make([]time.Duration, 100)
+	for i := range sorted {
+		sorted[i] = time.Duration(i+1) * time.Millisecond
+	}
+	assert.Equal(t, 50*time.Millisecond, percentile(sorted, 50))
+	assert.Equal(t, 95*time.Millisecond, percentile(sorted, 95))
+	assert.Equal(t, 100*time.Millisecond, percentile(sorted, 100))
+	assert.Equal(t, time.Millisecond, percentile(sorted[:1], 99))
+}
+
+func TestBenchRecommendation(t *testing.T) {
+	config := ports.DefaultAllocatorConfig()
+
+	assert.Contains(t, benchRecommendation(&benchReport{Failed: 2}, config), "widen the range")
+	assert.Contains(t, benchRecommendation(&benchReport{Collisions: 1}, config), "--coordinated")
+	assert.Contains(t, benchRecommendation(&benchReport{P99: 1500}, config), "ScanCacheTTL")
+	assert.Contains(t, benchRecommendation(&benchReport{P99: 1}, config), "no change needed")
+
+	config.Coordinated = true
+	assert.Contains(t, benchRecommendation(&benchReport{Collisions: 1}, config), "outside go-portalloc")
+}
+
+func TestBenchAllocation_ReleasesPorts(t *testing.T) {
+	config := ports.DefaultAllocatorConfig()
+	config.StartPort = 47300
+	config.EndPort = 47305
+	config.Coordinated = true
+	config.RetryDelay = time.Millisecond
+	allocator := ports.NewAllocator(config)
+
+	// More allocations than the range holds only succeed if each is released
+	for i := 0; i < 3*(config.EndPort-config.StartPort); i++ {
+		_, err := benchAllocation(allocator, 1)
+		require.NoError(t, err, "allocation %d", i)
+	}
+}
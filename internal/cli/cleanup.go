@@ -15,9 +15,12 @@
 package cli
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
@@ -28,10 +31,16 @@ import (
 
 var (
 	cleanupID        string
+	cleanupName      string
 	cleanupAll       bool
 	cleanupStale     bool
 	cleanupOlderThan string
 	cleanupWorktree  string
+	cleanupOrphans   bool
+	cleanupAllProj   bool
+	cleanupYes       bool
+	cleanupParallel  int
+	cleanupKeep      bool
 )
 
 var cleanupCmd = &cobra.Command{
@@ -40,34 +49,68 @@ var cleanupCmd = &cobra.Command{
 	Long: `Cleanup removes all resources associated with an isolated test environment.
 
 This command:
-  1. Removes the temporary directory
-  2. Removes the environment variable file
-  3. Releases the lock file
+  1. Runs .portalloc/hooks/pre-cleanup, if present (failure skips the environment)
+  2. Removes the temporary directory
+  3. Removes the environment variable file
+  4. Releases the lock file
+
+Without flags, cleanup removes the environments recorded for the current
+worktree after asking for confirmation (--yes skips the prompt).
+
+--all and --stale only touch environments of the current project (see
+--project) unless --all-projects is given.
+
+--all and --stale remove up to --parallel environments at once, so
+pre-cleanup hooks of different environments may run concurrently; use
+--parallel 1 to remove them one by one.
+
+--keep-record soft-deletes: the resources are removed all the same, but
+the state keeps each environment's record, marked with the time it was
+cleaned, so that undo-cleanup can recreate it.
 
 All cleanup operations are safe and idempotent.`,
-	Example: `  # Cleanup specific environment by ID
+	Example: `  # Cleanup the environments of the current worktree
+  go-portalloc cleanup --yes
+
+  # Cleanup specific environment by ID
   go-portalloc cleanup --id abc123def456
 
   # Cleanup all environments in current worktree
   go-portalloc cleanup --all
 
   # Cleanup all environments in specific worktree
-  go-portalloc cleanup --all --worktree /path/to/project`,
+  go-portalloc cleanup --all --worktree /path/to/project
+
+  # Cleanup every environment on this machine, whatever its project
+  go-portalloc cleanup --all --all-projects
+
+  # Cleanup everything, keeping the records for undo-cleanup
+  go-portalloc cleanup --all --keep-record
+
+  # Remove temp directories left behind without a lock or state entry
+  go-portalloc cleanup --orphans`,
 	RunE: runCleanup,
 }
 
 func init() {
 	cleanupCmd.Flags().StringVar(&cleanupID, "id", "", "Isolation ID to cleanup")
+	cleanupCmd.Flags().StringVar(&cleanupName, "name", "", "Environment name (instead of --id)")
 	cleanupCmd.Flags().BoolVar(&cleanupAll, "all", false, "Cleanup all environments")
 	cleanupCmd.Flags().BoolVar(&cleanupStale, "stale", false, "Cleanup only stale environments (dead processes)")
 	cleanupCmd.Flags().StringVar(&cleanupOlderThan, "older-than", "", "Cleanup environments older than duration (e.g., 2h, 30m)")
 	cleanupCmd.Flags().StringVarP(&cleanupWorktree, "worktree", "w", "", "Working directory path (current directory if not provided)")
-	cleanupCmd.MarkFlagsMutuallyExclusive("id", "all", "stale")
+	cleanupCmd.Flags().BoolVar(&cleanupOrphans, "orphans", false, "Remove orphaned temp directories (no lock file or state entry)")
+	cleanupCmd.Flags().BoolVar(&cleanupAllProj, "all-projects", false, "With --all or --stale, include environments of every project")
+	cleanupCmd.Flags().BoolVarP(&cleanupYes, "yes", "y", false, "Without --id or --all, clean up the current worktree's environments without asking")
+	cleanupCmd.Flags().IntVar(&cleanupParallel, "parallel", 8, "With --all or --stale, maximum number of environments removed at once")
+	cleanupCmd.Flags().BoolVar(&cleanupKeep, "keep-record", false, "Keep the state records of removed environments for undo-cleanup")
+	cleanupCmd.Flags().BoolVar(&noHooks, "no-hooks", false, "Do not run hooks from "+HooksDir)
+	cleanupCmd.MarkFlagsMutuallyExclusive("id", "name", "all", "stale", "orphans")
 }
 
 func runCleanup(cmd *cobra.Command, args []string) error {
-	if cleanupID == "" && !cleanupAll && !cleanupStale {
-		return fmt.Errorf("either --id, --all, or --stale must be specified")
+	if err := resolveEnvironmentFlag(&cleanupID, cleanupName); err != nil {
+		return err
 	}
 
 	// Prepare configuration
@@ -82,57 +125,153 @@ func runCleanup(cmd *cobra.Command, args []string) error {
 
 	config := &isolation.Config{
 		WorktreePath: worktree,
-		LockDir:      filepath.Join(os.TempDir(), "go-portalloc-locks"),
+		LockDir:      defaultLockDir,
 	}
 
 	idGen := isolation.NewIDGenerator(config)
 	manager := isolation.NewEnvironmentManager(idGen, nil)
 
+	if cleanupParallel < 1 {
+		return usageErrorf("--parallel must be at least 1, got %d", cleanupParallel)
+	}
+
+	if cleanupOrphans {
+		if cleanupKeep {
+			return usageErrorf("--keep-record cannot be used with --orphans")
+		}
+		return cleanupOrphanedDirs(config.LockDir)
+	}
+
+	// An empty project selects every project
+	project := ""
+	if !cleanupAllProj {
+		var err error
+		if project, err = currentProject(worktree); err != nil {
+			return err
+		}
+	}
+
 	if cleanupStale {
-		return cleanupStaleEnvironments(manager, config.LockDir)
+		return cleanupStaleEnvironments(manager, config.LockDir, project)
 	}
 
 	if cleanupAll {
-		return cleanupAllEnvironments(manager, config.LockDir)
+		return cleanupAllEnvironments(manager, config.LockDir, project)
+	}
+
+	if cleanupID == "" {
+		return cleanupWorktreeEnvironments(cmd, manager, config)
 	}
 
 	return cleanupSingleEnvironment(manager, cleanupID, config)
 }
 
+// cleanupWorktreeEnvironments removes the recorded environments whose
+// worktree contains the current one, after confirmation.
+func cleanupWorktreeEnvironments(cmd *cobra.Command, manager *isolation.EnvironmentManager, config *isolation.Config) error {
+	stateMgr, err := newStateManager()
+	if err != nil {
+		return fmt.Errorf("failed to create state manager: %w", err)
+	}
+	envs, err := stateMgr.ListEnvironments()
+	if err != nil {
+		return fmt.Errorf("failed to list environments: %w", err)
+	}
+
+	var matched []*state.EnvironmentState
+	for _, env := range envs {
+		if withinWorktree(config.WorktreePath, env.WorktreePath) {
+			matched = append(matched, env)
+		}
+	}
+	if len(matched) == 0 {
+		fmt.Printf("No environments recorded for %s (use --id, --name, --all, --stale, or --orphans)\n", config.WorktreePath)
+		return nil
+	}
+
+	fmt.Printf("Environments of %s:\n", config.WorktreePath)
+	for _, env := range matched {
+		fmt.Printf("  %s (%s, created %s)\n", env.ID, state.GetEnvironmentStatus(env), formatTimeAgo(env.CreatedAt))
+	}
+	if !cleanupYes && !confirm(cmd.InOrStdin(), fmt.Sprintf("Clean up %d environment(s)?", len(matched))) {
+		return fmt.Errorf("cleanup not confirmed (use --yes to skip the prompt)")
+	}
+
+	var failed int
+	for _, env := range matched {
+		if err := cleanupSingleEnvironment(manager, env.ID, config); err != nil {
+			fmt.Printf(emoji("⚠️  %s: %v\n"), env.ID, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to clean up %d of %d environment(s)", failed, len(matched))
+	}
+	return nil
+}
+
+// withinWorktree reports whether dir is worktree or one of its subdirectories.
+func withinWorktree(dir, worktree string) bool {
+	if worktree == "" {
+		return false
+	}
+	rel, err := filepath.Rel(worktree, dir)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
 func cleanupSingleEnvironment(manager *isolation.EnvironmentManager, isolationID string, config *isolation.Config) error {
-	// Reconstruct environment from ID
-	lockFile := filepath.Join(config.LockDir, fmt.Sprintf("env-%s.lock", isolationID))
-	tmpDir := filepath.Join(os.TempDir(), fmt.Sprintf("aigis-test-%s", isolationID))
-	envFile := filepath.Join(config.WorktreePath, ".env.isolation")
+	start := time.Now()
+	env, err := loadEnvironment(isolationID, config)
+	if err != nil {
+		return err
+	}
 
-	env := &isolation.Environment{
-		ID:           isolationID,
-		WorktreePath: config.WorktreePath,
-		TempDir:      tmpDir,
-		LockFile:     lockFile,
-		EnvFile:      envFile,
-		Ports:        &ports.PortRange{BasePort: 0, Count: 0},
+	// Capture the recorded entry before it is removed so webhooks see it
+	removed := state.NewEnvironmentState(env)
+	stateMgr, stateErr := newStateManager()
+	if err := strictError(stateErr); err != nil {
+		return err
+	}
+	if stateErr != nil && cleanupKeep {
+		return fmt.Errorf("failed to create state manager: %w", stateErr)
+	}
+	if stateErr == nil {
+		if recorded, err := stateMgr.GetEnvironment(isolationID); err == nil {
+			removed = recorded
+		}
 	}
 
-	if err := manager.Cleanup(env); err != nil {
+	if err := runHook(context.Background(), hookPreCleanup, env); err != nil {
+		return fmt.Errorf("cleanup aborted: %w (use --no-hooks to skip)", err)
+	}
+
+	if err := cleanupEnvironment(manager, env); err != nil {
 		return fmt.Errorf("cleanup failed: %w", err)
 	}
 
-	// Remove from state file (best effort)
-	stateMgr, err := state.NewManager()
-	if err == nil {
-		_ = stateMgr.RemoveEnvironment(isolationID)
+	// Remove from state file (best effort unless --strict)
+	if stateErr == nil {
+		if err := forgetCleaned(stateMgr, removed); err != nil {
+			return err
+		}
 	}
 
-	fmt.Printf("✅ Environment %s cleaned up successfully\n", isolationID)
+	logEnvironment("environment removed", removed, start)
+	notifyEvent(state.EventRemoved, removed)
+
+	fmt.Printf(emoji("✅ Environment %s cleaned up successfully\n"), isolationID)
 	return nil
 }
 
-func cleanupAllEnvironments(manager *isolation.EnvironmentManager, lockDir string) error {
-	// Find all lock files
-	lockFiles, err := filepath.Glob(filepath.Join(lockDir, "env-*.lock"))
-	if err != nil {
-		return fmt.Errorf("failed to find lock files: %w", err)
+func cleanupAllEnvironments(manager *isolation.EnvironmentManager, lockDir, project string) error {
+	// Find all lock files, including legacy ones under the portalloc naming
+	var lockFiles []string
+	for _, dir := range isolation.LockDirs(lockDir) {
+		matches, err := filepath.Glob(filepath.Join(dir, "env-*.lock"))
+		if err != nil {
+			return fmt.Errorf("failed to find lock files: %w", err)
+		}
+		lockFiles = append(lockFiles, matches...)
 	}
 
 	if len(lockFiles) == 0 {
@@ -141,56 +280,66 @@ func cleanupAllEnvironments(manager *isolation.EnvironmentManager, lockDir strin
 	}
 
 	// Create state manager
-	stateMgr, err := state.NewManager()
+	stateMgr, err := newStateManager()
 	if err != nil {
-		// Continue without state management
+		// Continue without state management, unless --strict or
+		// --keep-record
+		if cleanupKeep {
+			return fmt.Errorf("failed to create state manager: %w", err)
+		}
+		if err := strictError(err); err != nil {
+			return err
+		}
 		stateMgr = nil
 	}
 
-	cleaned := 0
-	failed := 0
+	// Prefer recorded paths over reconstructed ones
+	recordedEnvs := make(map[string]*state.EnvironmentState)
+	if stateMgr != nil {
+		envs, err := stateMgr.ListEnvironments()
+		if err := strictError(err); err != nil {
+			return err
+		}
+		for _, env := range envs {
+			recordedEnvs[env.ID] = env
+		}
+	}
 
+	var jobs []cleanupJob
 	for _, lockFile := range lockFiles {
 		// Extract isolation ID from lock file name
 		base := filepath.Base(lockFile)
 		isolationID := base[4 : len(base)-5] // Remove "env-" prefix and ".lock" suffix
 
-		tmpDir := filepath.Join(os.TempDir(), fmt.Sprintf("aigis-test-%s", isolationID))
-		envFile := filepath.Join(cleanupWorktree, ".env.isolation")
-
 		env := &isolation.Environment{
 			ID:           isolationID,
 			WorktreePath: cleanupWorktree,
-			TempDir:      tmpDir,
+			TempDir:      isolation.FindTempDir(isolationID),
 			LockFile:     lockFile,
-			EnvFile:      envFile,
+			EnvFile:      isolation.FindEnvFile(cleanupWorktree, isolationID),
 			Ports:        &ports.PortRange{BasePort: 0, Count: 0},
 		}
-
-		if err := manager.Cleanup(env); err != nil {
-			fmt.Printf("⚠️  Failed to cleanup %s: %v\n", isolationID, err)
-			failed++
-		} else {
-			// Remove from state
-			if stateMgr != nil {
-				_ = stateMgr.RemoveEnvironment(isolationID)
-			}
-			cleaned++
+		removed := state.NewEnvironmentState(env)
+		if recorded, ok := recordedEnvs[isolationID]; ok {
+			env = recorded.Environment()
+			removed = recorded
+		} else if info, err := isolation.ReadLockInfo(lockFile); err == nil {
+			env.Project = info.Project
+			removed.Project = info.Project
 		}
+		if project != "" && removed.Project != project {
+			continue
+		}
+		jobs = append(jobs, cleanupJob{env: env, removed: removed})
 	}
 
-	fmt.Printf("\n✅ Cleaned up %d environment(s)", cleaned)
-	if failed > 0 {
-		fmt.Printf(" (%d failed)", failed)
-	}
-	fmt.Println()
-
+	runCleanupJobs(manager, stateMgr, jobs)
 	return nil
 }
 
-func cleanupStaleEnvironments(manager *isolation.EnvironmentManager, lockDir string) error {
+func cleanupStaleEnvironments(manager *isolation.EnvironmentManager, lockDir, project string) error {
 	// Create state manager
-	stateMgr, err := state.NewManager()
+	stateMgr, err := newStateManager()
 	if err != nil {
 		return fmt.Errorf("failed to create state manager: %w", err)
 	}
@@ -205,6 +354,9 @@ func cleanupStaleEnvironments(manager *isolation.EnvironmentManager, lockDir str
 	if err != nil {
 		return fmt.Errorf("failed to list environments: %w", err)
 	}
+	if project != "" {
+		envs, _ = filterProject(envs, project)
+	}
 
 	if len(envs) == 0 {
 		fmt.Println("No environments to cleanup")
@@ -216,17 +368,21 @@ func cleanupStaleEnvironments(manager *isolation.EnvironmentManager, lockDir str
 	if cleanupOlderThan != "" {
 		olderThan, err = time.ParseDuration(cleanupOlderThan)
 		if err != nil {
-			return fmt.Errorf("invalid --older-than duration: %w", err)
+			return usageErrorf("invalid --older-than duration: %w", err)
 		}
 	}
 
 	// Filter stale environments
 	var toCleanup []*state.EnvironmentState
+	var staleEnvs []*state.EnvironmentState
 	for _, env := range envs {
 		status := state.GetEnvironmentStatus(env)
 
 		// Check if stale (process not running)
 		isStale := status == state.StatusStale
+		if isStale {
+			staleEnvs = append(staleEnvs, env)
+		}
 
 		// Check if older than threshold
 		isOld := false
@@ -248,43 +404,155 @@ func cleanupStaleEnvironments(manager *isolation.EnvironmentManager, lockDir str
 		}
 	}
 
+	// Announce leaked environments before they disappear
+	notifyStale(stateMgr, staleEnvs)
+
 	if len(toCleanup) == 0 {
 		fmt.Println("No stale environments to cleanup")
 		return nil
 	}
 
-	fmt.Printf("🧹 Found %d stale environment(s)\n", len(toCleanup))
-
-	cleaned := 0
-	failed := 0
+	fmt.Printf(emoji("🧹 Found %d stale environment(s)\n"), len(toCleanup))
 
-	for _, env := range toCleanup {
-		isoEnv := &isolation.Environment{
-			ID:           env.ID,
-			WorktreePath: env.WorktreePath,
-			TempDir:      env.TempDir,
-			LockFile:     env.LockFile,
-			EnvFile:      env.EnvFile,
-			Ports:        &ports.PortRange{BasePort: env.Ports.BasePort, Count: env.Ports.Count},
+	reason := "process not found"
+	jobs := make([]cleanupJob, len(toCleanup))
+	for i, env := range toCleanup {
+		if cleanupOlderThan != "" {
+			reason = fmt.Sprintf("created %s ago", time.Since(env.CreatedAt).Round(time.Minute))
 		}
+		jobs[i] = cleanupJob{env: env.Environment(), removed: env, reason: reason}
+	}
 
-		if err := manager.Cleanup(isoEnv); err != nil {
-			fmt.Printf("⚠️  Failed to cleanup %s: %v\n", env.ID, err)
-			failed++
-		} else {
-			reason := "process not found"
-			if cleanupOlderThan != "" {
-				reason = fmt.Sprintf("created %s ago", time.Since(env.CreatedAt).Round(time.Minute))
+	runCleanupJobs(manager, stateMgr, jobs)
+	return nil
+}
+
+// cleanupJob is one environment removed by --all or --stale.
+type cleanupJob struct {
+	env *isolation.Environment
+	// removed is the entry reported to webhooks.
+	removed *state.EnvironmentState
+	// reason is printed for each cleaned environment when set.
+	reason string
+}
+
+// runCleanupJobs removes the environments of jobs with up to
+// cleanupParallel workers. Each environment is reported as it finishes,
+// so failures are listed per environment, followed by a summary with the
+// elapsed time. Without stateMgr, the state file is left alone.
+func runCleanupJobs(manager *isolation.EnvironmentManager, stateMgr *state.Manager, jobs []cleanupJob) {
+	start := time.Now()
+	workers := max(1, min(cleanupParallel, len(jobs)))
+
+	var (
+		mu              sync.Mutex
+		cleaned, failed int
+	)
+	queue := make(chan cleanupJob)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				jobStart := time.Now()
+				err := runHook(context.Background(), hookPreCleanup, job.env)
+				if err == nil {
+					err = cleanupEnvironment(manager, job.env)
+				}
+				var stateErr error
+				if err == nil && stateMgr != nil {
+					stateErr = forgetCleaned(stateMgr, job.removed)
+				}
+
+				mu.Lock()
+				switch {
+				case err != nil:
+					fmt.Printf(emoji("⚠️  Failed to cleanup %s: %v\n"), job.env.ID, err)
+					failed++
+				default:
+					if job.reason != "" {
+						fmt.Printf(emoji("✅ Cleaned: %s (%s)\n"), job.env.ID, job.reason)
+					}
+					cleaned++
+					if stateErr != nil {
+						fmt.Printf(emoji("⚠️  %v\n"), stateErr)
+						failed++
+					}
+				}
+				mu.Unlock()
+
+				if err == nil {
+					args := []any{"workers", workers}
+					if job.reason != "" {
+						args = append(args, "reason", job.reason)
+					}
+					logEnvironment("environment removed", job.removed, jobStart, args...)
+					notifyEvent(state.EventRemoved, job.removed)
+				}
 			}
-			fmt.Printf("✅ Cleaned: %s (%s)\n", env.ID, reason)
-			cleaned++
+		}()
+	}
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+
+	fmt.Printf(emoji("\n✅ Cleaned up %d environment(s)"), cleaned)
+	if failed > 0 {
+		fmt.Printf(" (%d failed)", failed)
+	}
+	fmt.Printf(" in %s", time.Since(start).Round(time.Millisecond))
+	if workers > 1 {
+		fmt.Printf(" with %d workers", workers)
+	}
+	fmt.Println()
+}
+
+// forgetCleaned removes a cleaned up environment from the state, or with
+// --keep-record moves its record to the cleaned ones. The user asked for
+// the record, so failing to keep it is always an error.
+func forgetCleaned(stateMgr *state.Manager, removed *state.EnvironmentState) error {
+	if !cleanupKeep {
+		return forgetEnvironment(stateMgr, removed.ID)
+	}
+	if err := stateMgr.SoftRemoveEnvironment(removed, time.Now()); err != nil {
+		return fmt.Errorf("failed to keep the record of %s: %w", removed.ID, err)
+	}
+	return nil
+}
+
+func cleanupOrphanedDirs(lockDir string) error {
+	stateMgr, err := newStateManager()
+	if err != nil {
+		return fmt.Errorf("failed to create state manager: %w", err)
+	}
+
+	orphans, err := stateMgr.FindOrphanedTempDirs(os.TempDir(), lockDir)
+	if err != nil {
+		return fmt.Errorf("failed to find orphaned directories: %w", err)
+	}
 
-			// Remove from state
-			_ = stateMgr.RemoveEnvironment(env.ID)
+	if len(orphans) == 0 {
+		fmt.Println("No orphaned directories to cleanup")
+		return nil
+	}
+
+	cleaned := 0
+	failed := 0
+
+	for _, orphan := range orphans {
+		if err := os.RemoveAll(orphan.Path); err != nil {
+			fmt.Printf(emoji("⚠️  Failed to remove %s: %v\n"), orphan.Path, err)
+			failed++
+			continue
 		}
+		fmt.Printf(emoji("✅ Removed: %s\n"), orphan.Path)
+		cleaned++
 	}
 
-	fmt.Printf("\n✅ Cleaned up %d environment(s)", cleaned)
+	fmt.Printf(emoji("\n✅ Removed %d orphaned directories"), cleaned)
 	if failed > 0 {
 		fmt.Printf(" (%d failed)", failed)
 	}
@@ -0,0 +1,155 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithinWorktree(t *testing.T) {
+	assert.True(t, withinWorktree("/src/app", "/src/app"))
+	assert.True(t, withinWorktree("/src/app/pkg/api", "/src/app"))
+	assert.False(t, withinWorktree("/src/application", "/src/app"))
+	assert.False(t, withinWorktree("/src", "/src/app"))
+	assert.False(t, withinWorktree("/src/app", ""))
+}
+
+func TestCleanupIntegration(t *testing.T) {
+	buildCLI(t)
+
+	t.Run("bare cleanup removes the current worktree's environments", func(t *testing.T) {
+		lockDir := t.TempDir()
+		env := append(os.Environ(), "HOME="+t.TempDir(), "PORTALLOC_STATE_DIR="+t.TempDir(), "PORTALLOC_LOCK_DIR="+lockDir)
+		create := func(dir string) string {
+			stdout, stderr, err := runCLI(t, dir, env, "create", "--json")
+			require.NoError(t, err, stderr)
+			var created createOutput
+			require.NoError(t, json.Unmarshal([]byte(stdout), &created))
+			return filepath.Join(lockDir, "env-"+created.IsolationID+".lock")
+		}
+
+		mine, other := t.TempDir(), t.TempDir()
+		mineLock, otherLock := create(mine), create(other)
+		sub := filepath.Join(mine, "pkg")
+		require.NoError(t, os.Mkdir(sub, 0o750))
+
+		// stdin is empty, so the prompt is declined
+		stdout, stderr, err := runCLI(t, sub, env, "cleanup")
+		require.Error(t, err, stderr)
+		assert.Contains(t, stdout, "Clean up 1 environment(s)?")
+		assert.FileExists(t, mineLock)
+
+		_, stderr, err = runCLI(t, sub, env, "cleanup", "--yes")
+		require.NoError(t, err, stderr)
+		assert.NoFileExists(t, mineLock)
+		assert.FileExists(t, otherLock)
+
+		stdout, stderr, err = runCLI(t, mine, env, "cleanup")
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stdout, "No environments recorded")
+
+		_, stderr, err = runCLI(t, other, env, "cleanup", "--yes")
+		require.NoError(t, err, stderr)
+		assert.NoFileExists(t, otherLock)
+	})
+
+	t.Run("cleanup --all removes environments in parallel and reports each failure", func(t *testing.T) {
+		lockDir := t.TempDir()
+		env := append(os.Environ(), "HOME="+t.TempDir(), "PORTALLOC_STATE_DIR="+t.TempDir(), "PORTALLOC_LOCK_DIR="+lockDir)
+
+		// Environments of a worktree whose pre-cleanup hook fails stay
+		good, bad := t.TempDir(), t.TempDir()
+		hooksDir := filepath.Join(bad, ".portalloc", "hooks")
+		require.NoError(t, os.MkdirAll(hooksDir, 0o750))
+		require.NoError(t, os.WriteFile(filepath.Join(hooksDir, "pre-cleanup"), []byte("#!/bin/sh\nexit 3\n"), 0o700))
+
+		var badIDs []string
+		for i := 0; i < 6; i++ {
+			_, stderr, err := runCLI(t, good, env, "create", "--ports", "1", "--id-only", "--no-env-file")
+			require.NoError(t, err, stderr)
+		}
+		for i := 0; i < 2; i++ {
+			stdout, stderr, err := runCLI(t, bad, env, "create", "--ports", "1", "--id-only", "--no-env-file")
+			require.NoError(t, err, stderr)
+			badIDs = append(badIDs, strings.TrimSpace(stdout))
+		}
+
+		_, _, err := runCLI(t, good, env, "cleanup", "--all", "--all-projects", "--parallel", "0")
+		assert.Error(t, err)
+
+		stdout, stderr, err := runCLI(t, good, env, "cleanup", "--all", "--all-projects", "--parallel", "4")
+		require.NoError(t, err, stderr)
+		assert.Regexp(t, `Cleaned up 6 environment\(s\) \(2 failed\) in \S+ with 4 workers`, stdout)
+		for _, id := range badIDs {
+			assert.Contains(t, stdout, "Failed to cleanup "+id+": pre-cleanup hook failed")
+		}
+		matches, err := filepath.Glob(filepath.Join(lockDir, "env-*.lock"))
+		require.NoError(t, err)
+		assert.Len(t, matches, 2)
+
+		stdout, stderr, err = runCLI(t, good, env, "cleanup", "--all", "--all-projects", "--no-hooks")
+		require.NoError(t, err, stderr)
+		assert.Regexp(t, `Cleaned up 2 environment\(s\) in \S+ with 2 workers`, stdout)
+	})
+
+	t.Run("cleanup --keep-record can be undone", func(t *testing.T) {
+		lockDir := t.TempDir()
+		env := append(os.Environ(), "HOME="+t.TempDir(), "PORTALLOC_STATE_DIR="+t.TempDir(), "PORTALLOC_LOCK_DIR="+lockDir)
+		worktree := t.TempDir()
+
+		stdout, stderr, err := runCLI(t, worktree, env, "create", "--ports", "2", "--name", "api", "--json")
+		require.NoError(t, err, stderr)
+		var created createOutput
+		require.NoError(t, json.Unmarshal([]byte(stdout), &created), stdout)
+
+		_, stderr, err = runCLI(t, worktree, env, "cleanup", "--all", "--keep-record", "--no-hooks")
+		require.NoError(t, err, stderr)
+		assert.NoFileExists(t, created.EnvFile)
+		assert.NoDirExists(t, created.TempDir)
+
+		stdout, stderr, err = runCLI(t, worktree, env, "undo-cleanup")
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stdout, created.IsolationID+" (api), ports ")
+
+		stdout, stderr, err = runCLI(t, worktree, env, "undo-cleanup", "--name", "api")
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stdout, "Environment "+created.IsolationID+" recreated")
+		assert.FileExists(t, created.EnvFile)
+		assert.DirExists(t, created.TempDir)
+		assert.FileExists(t, filepath.Join(lockDir, "env-"+created.IsolationID+".lock"))
+
+		stdout, stderr, err = runCLI(t, worktree, env, "inspect", "--name", "api")
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stdout, created.IsolationID)
+
+		_, stderr, err = runCLI(t, worktree, env, "undo-cleanup", "--id", created.IsolationID)
+		assert.Error(t, err)
+		assert.Contains(t, stderr, "no cleaned record for "+created.IsolationID)
+
+		// Without --keep-record nothing is kept
+		_, stderr, err = runCLI(t, worktree, env, "cleanup", "--id", created.IsolationID, "--no-hooks")
+		require.NoError(t, err, stderr)
+		stdout, stderr, err = runCLI(t, worktree, env, "undo-cleanup")
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stdout, "No cleaned environments recorded")
+	})
+}
@@ -0,0 +1,263 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/internal/config"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+)
+
+// configPath is set by the global --config flag (default: ~/.go-portalloc/config.json).
+var configPath string
+
+// defaultLockDir is the lock directory shared by all commands and the
+// portalloc package, overridable with $PORTALLOC_LOCK_DIR.
+var defaultLockDir = isolation.LockDirFromEnv(filepath.Join(os.TempDir(), "go-portalloc-locks"))
+
+// defaultPorts is the default --ports, overridable with $PORTALLOC_DEFAULT_PORTS.
+var defaultPorts = isolation.DefaultPorts(5)
+
+// projectFlag is set by the global --project flag.
+var projectFlag string
+
+// currentProject returns the project key for worktree: --project, then the
+// config file's project, then the git repository name.
+func currentProject(worktree string) (string, error) {
+	if projectFlag != "" {
+		return projectFlag, nil
+	}
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return "", err
+	}
+	if cfg.Project != "" {
+		return cfg.Project, nil
+	}
+	if worktree == "" {
+		if worktree, err = os.Getwd(); err != nil {
+			return "", fmt.Errorf("failed to get working directory: %w", err)
+		}
+	}
+	return isolation.ProjectKey(worktree), nil
+}
+
+// composePrefixFlag is set by the global --compose-prefix flag.
+var composePrefixFlag string
+
+// loadComposePrefix returns the compose project name prefix: --compose-prefix,
+// then the config file's compose_prefix. Empty means the default.
+func loadComposePrefix() (string, error) {
+	prefix := composePrefixFlag
+	if prefix == "" {
+		cfg, err := config.Load(configPath)
+		if err != nil {
+			return "", err
+		}
+		prefix = cfg.ComposePrefix
+	}
+	if err := isolation.ValidateComposePrefix(prefix); err != nil {
+		return "", usageErrorf("%v", err)
+	}
+	return prefix, nil
+}
+
+// loadGitIgnore returns where the config file asks generated env files to be
+// registered as ignored.
+func loadGitIgnore() (isolation.GitIgnore, error) {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return "", err
+	}
+	return cfg.GitIgnoreMode()
+}
+
+// loadReservedPorts returns the ports the allocator must skip: those of
+// path when set, else those of the config file's reserved_file.
+func loadReservedPorts(path string) (*ports.ReservedPorts, error) {
+	if path != "" {
+		return ports.LoadReservedPorts(path)
+	}
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.ReservedPorts()
+}
+
+// applyNaming applies the config file's naming scheme. An invalid value is
+// ignored here so doctor can still report and repair it.
+func applyNaming() {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return
+	}
+	if naming, err := isolation.ParseNaming(cfg.Naming); err == nil {
+		isolation.SetNaming(naming)
+	}
+}
+
+// loadProfile returns the named profile from the config file, or nil if name is empty.
+func loadProfile(name string) (*isolation.Profile, error) {
+	if name == "" {
+		return nil, nil
+	}
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.Profile(name)
+}
+
+// newStateManager returns a state manager for the local state file, mirrored
+// to the shared store configured as state_backend, if any.
+func newStateManager() (*state.Manager, error) {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return nil, err
+	}
+	store, err := cfg.Store()
+	if err != nil {
+		return nil, err
+	}
+
+	mgr, err := state.NewManager()
+	if err != nil {
+		return nil, err
+	}
+	if reason := mgr.Degraded(); reason != nil {
+		if strictMode {
+			return nil, fmt.Errorf("state directory unavailable: %w (strict mode)", reason)
+		}
+		degradedWarning.Do(func() {
+			fmt.Fprintf(os.Stderr, emoji("⚠️  State directory unavailable (%v); using %s\n"), reason, mgr.Path())
+		})
+	}
+	mgr.SetStore(store)
+	return mgr, nil
+}
+
+// forgetReclaimed removes the state file entry of an expired environment
+// whose lock was reclaimed for a new one; see isolation.Config.OnReclaim.
+func forgetReclaimed(isolationID string) {
+	mgr, err := newStateManager()
+	if err == nil {
+		err = mgr.RemoveEnvironment(isolationID)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, emoji("⚠️  Failed to forget reclaimed environment %s: %v\n"), isolationID, err)
+	}
+}
+
+// degradedWarning prints the degraded state warning once per process.
+var degradedWarning sync.Once
+
+// strictEnv enables strict mode like --strict when set to a true value.
+const strictEnv = "PORTALLOC_STRICT"
+
+// strictMode is --strict: steps that are otherwise best effort, such as
+// recording environments in the state file, fail the command instead.
+var strictMode bool
+
+// strictError returns err in strict mode and nil otherwise, for steps
+// whose failure is otherwise ignored.
+func strictError(err error) error {
+	if err == nil || !strictMode {
+		return nil
+	}
+	return fmt.Errorf("%w (strict mode)", err)
+}
+
+// forgetEnvironment removes a cleaned up environment from the state file.
+// A failure leaves a stale entry behind until the next reconcile, so it is
+// only an error in strict mode.
+func forgetEnvironment(stateMgr *state.Manager, isolationID string) error {
+	if err := stateMgr.RemoveEnvironment(isolationID); err != nil {
+		return strictError(fmt.Errorf("failed to remove %s from state: %w", isolationID, err))
+	}
+	return nil
+}
+
+// stateSkipped handles a failure to record an environment. The environment
+// still works, but list and inspect cannot show it, so this is a warning on
+// stderr, or an error in strict mode.
+func stateSkipped(err error) error {
+	if strictMode {
+		return fmt.Errorf("failed to record environment in state: %w (strict mode)", err)
+	}
+	fmt.Fprintf(os.Stderr, emoji("⚠️  State recording skipped: %v\n"), err)
+	return nil
+}
+
+// loadMaxLockAge returns the lock expiry age from the config file.
+func loadMaxLockAge() (time.Duration, error) {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return 0, err
+	}
+	return cfg.LockAge()
+}
+
+// loadListThresholds returns the thresholds past which 'list' flags
+// environments: maxAge and maxIdle when set, else the config file's.
+func loadListThresholds(maxAge, maxIdle time.Duration) (listThresholds, error) {
+	if maxAge < 0 || maxIdle < 0 {
+		return listThresholds{}, usageErrorf("--max-age and --max-idle must not be negative")
+	}
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return listThresholds{}, err
+	}
+	cfgAge, cfgIdle, err := cfg.ListThresholds.Durations()
+	if err != nil {
+		return listThresholds{}, err
+	}
+	if maxAge == 0 {
+		maxAge = cfgAge
+	}
+	if maxIdle == 0 {
+		maxIdle = cfgIdle
+	}
+	return listThresholds{maxAge: maxAge, maxIdle: maxIdle}, nil
+}
+
+// loadRetention returns the retention policy from the config file, or nil
+// if none is configured.
+func loadRetention() (*config.Retention, error) {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.RetentionPolicy()
+}
+
+// filterProject returns the environments recorded for project and how many
+// were left out. Environments recorded before projects existed belong to none.
+func filterProject(envs []*state.EnvironmentState, project string) ([]*state.EnvironmentState, int) {
+	kept := make([]*state.EnvironmentState, 0, len(envs))
+	for _, env := range envs {
+		if env.Project == project {
+			kept = append(kept, env)
+		}
+	}
+	return kept, len(envs) - len(kept)
+}
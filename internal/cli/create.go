@@ -15,10 +15,17 @@
 package cli
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
 	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
@@ -28,10 +35,34 @@ import (
 
 var (
 	createPortsCount  int
+	createCount       int
 	createInstanceID  string
+	createName        string
 	createWorktree    string
 	createOutputJSON  bool
 	createOutputShell bool
+	createOutputFile  string
+	createIDOnly      bool
+	createPortOnly    bool
+	createWithTrap    bool
+	createEnvrc       bool
+	createEnvFiles    []string
+	createNoEnvFile   bool
+	createLayout      bool
+	createProxies     []string
+	createReserve     bool
+	createProfile     string
+	createPreset      string
+	createPartition   string
+	createBlockSize   int
+	createSpacing     int
+	createReserved    string
+	createNetwork     bool
+	createIdempotency string
+	createMaxUtil     float64
+	createUtilAction  string
+	// createReused is set when --idempotency-key found an environment.
+	createReused bool
 )
 
 var createCmd = &cobra.Command{
@@ -44,32 +75,163 @@ This command:
   2. Allocates the specified number of consecutive available ports
   3. Creates a temporary directory for the environment
   4. Generates an atomic lock file
-  5. Creates an environment variable file (.env.isolation)
+  5. Creates an environment variable file (.env.isolation.<id>) and points
+     the .env.isolation symlink at it
+  6. Runs .portalloc/hooks/post-create, if present (failure aborts creation)
 
-The environment is guaranteed to be isolated from other concurrent environments.`,
+The environment is guaranteed to be isolated from other concurrent environments.
+
+With --max-utilization (or utilization.max_percent in the config file),
+create first checks how much of the port range is busy or registered and,
+over the limit, warns or, with --utilization-action refuse, fails with exit
+code 3 before allocating.`,
 	Example: `  # Create environment with 5 ports
   go-portalloc create --ports 5
 
+  # Name the environment, then refer to it by name
+  go-portalloc create --ports 5 --name payments-it
+  go-portalloc inspect --name payments-it
+
   # Create with custom instance ID
   go-portalloc create --ports 3 --instance-id ci-build-123
 
+  # Create a 3-node cluster topology as a unit (node-1, node-2, node-3)
+  go-portalloc create --ports 2 --count 3 --name node --json
+
   # Output as JSON for programmatic use
   go-portalloc create --ports 5 --json
 
   # Output as shell eval format
-  go-portalloc create --ports 5 --shell`,
+  go-portalloc create --ports 5 --shell
+
+  # Capture just the ID or base port in a Makefile or script
+  ID=$(go-portalloc create --ports 5 --id-only)
+  PORT=$(go-portalloc create --ports 5 --port-only)
+
+  # Write the JSON to a file for later CI stages instead of stdout
+  go-portalloc create --ports 5 --json --output env.json
+
+  # Output as shell eval format with automatic cleanup on exit
+  eval "$(go-portalloc create --ports 5 --shell --with-trap)"
+
+  # Write one env file per service directory in a monorepo
+  go-portalloc create --ports 5 --env-file services/api/.env.test --env-file services/web/.env.test
+
+  # Only print JSON; don't write anything into the worktree
+  go-portalloc create --ports 5 --json --no-env-file
+
+  # Create standard data/, logs/, tmp/, sockets/ subdirectories
+  go-portalloc create --ports 5 --layout
+
+  # Use the "kafka" profile from ~/.go-portalloc/config.json
+  go-portalloc create --profile kafka
+
+  # Use a built-in preset (LOCALSTACK_PORT, AWS_ENDPOINT_URL, ...)
+  go-portalloc create --preset localstack
+
+  # Deterministic, coordination-free ports per Go package (go test -p N)
+  go-portalloc create --ports 3 --partition github.com/acme/app/store
+
+  # Start the range on a fresh 100-port block, leaving the rest unallocated
+  go-portalloc create --ports 5 --spacing 100
+
+  # Refuse to allocate once 80% of the port range is taken
+  go-portalloc create --ports 5 --max-utilization 80 --utilization-action refuse
+
+  # Serve the API port on localhost:8080 for tools with hardcoded ports
+  go-portalloc create --ports 5 --proxy 8080=api
+
+  # Also export the variables through direnv's .envrc
+  go-portalloc create --ports 5 --envrc`,
 	RunE: runCreate,
 }
 
 func init() {
-	createCmd.Flags().IntVarP(&createPortsCount, "ports", "p", 5, "Number of ports to allocate")
+	createCmd.Flags().IntVarP(&createPortsCount, "ports", "p", defaultPorts, "Number of ports to allocate")
+	createCmd.Flags().IntVar(&createCount, "count", 1, "Create this many environments as a unit; if any fails, all are rolled back")
 	createCmd.Flags().StringVarP(&createInstanceID, "instance-id", "i", "", "Custom instance ID (auto-generated if not provided)")
+	createCmd.Flags().StringVar(&createIdempotency, "idempotency-key", "", "Return the environment created with this key (e.g. $CI_JOB_ID) if it still exists instead of creating another")
+	createCmd.Flags().StringVar(&createName, "name", "", "Human-friendly name, unique among active environments (usable in place of --id)")
 	createCmd.Flags().StringVarP(&createWorktree, "worktree", "w", "", "Working directory path (current directory if not provided)")
 	createCmd.Flags().BoolVar(&createOutputJSON, "json", false, "Output environment details as JSON")
 	createCmd.Flags().BoolVar(&createOutputShell, "shell", false, "Output as shell eval format (eval \"$(go-portalloc create --shell)\")")
+	createCmd.Flags().BoolVar(&createIDOnly, "id-only", false, "Print only the isolation ID, on a single line")
+	createCmd.Flags().BoolVar(&createPortOnly, "port-only", false, "Print only the base port, on a single line")
+	createCmd.Flags().StringVarP(&createOutputFile, "output", "o", "", "With --json or --shell, write the output atomically to this file instead of stdout")
+	createCmd.Flags().StringArrayVar(&createEnvFiles, "env-file", nil, "Env file path, relative to the worktree (repeatable; default .env.isolation.<id>, linked from .env.isolation)")
+	createCmd.Flags().BoolVar(&createNoEnvFile, "no-env-file", false, "Do not write an env file into the worktree")
+	createCmd.Flags().StringVar(&createProfile, "profile", "", "Apply a profile from the config file (named ports and extra variables)")
+	createCmd.Flags().StringVar(&createPreset, "preset", "", "Apply a built-in profile: "+strings.Join(isolation.PresetNames(), ", "))
+	createCmd.Flags().StringVar(&createPartition, "partition", "", "Allocate from the port block this key hashes to (e.g. the Go package path)")
+	createCmd.Flags().IntVar(&createBlockSize, "block-size", ports.DefaultBlockSize, "Block size for --partition")
+	createCmd.Flags().IntVar(&createSpacing, "spacing", 0, "Start the range on a fresh block of this many ports, keeping the rest of the block free (0 disables)")
+	createCmd.Flags().StringVar(&createReserved, "reserved-file", "", "Never allocate the ports listed in this file, one port or range per line (overrides reserved_file in the config file)")
+	createCmd.Flags().Float64Var(&createMaxUtil, "max-utilization", 0, "Warn or refuse when more than this percentage of the port range is busy or registered (default: config utilization.max_percent)")
+	createCmd.Flags().StringVar(&createUtilAction, "utilization-action", "", "What to do over --max-utilization: warn or refuse (default: config utilization.action, else warn)")
+	createCmd.Flags().StringArrayVar(&createProxies, "proxy", nil, "Forward a stable local port to a service port, as PORT=SERVICE (repeatable, e.g. 8080=api)")
+	createCmd.Flags().BoolVar(&createReserve, "reserve", false, "Hold the allocated ports in the background until each is released with release-port")
+	createCmd.Flags().BoolVar(&createNetwork, "docker-network", false, "Create the docker network named by DOCKER_NETWORK; cleanup removes it")
+	createCmd.Flags().BoolVar(&createLayout, "layout", false, "Create data/, logs/, tmp/, and sockets/ under the temp directory")
+	createCmd.Flags().BoolVar(&createEnvrc, "envrc", false, "Write the allocated variables into a managed block of .envrc (direnv)")
+	createCmd.Flags().BoolVar(&noHooks, "no-hooks", false, "Do not run hooks from "+HooksDir)
+	createCmd.Flags().BoolVar(&createWithTrap, "with-trap", false, "With --shell, also emit an EXIT trap that cleans up the environment")
+	createCmd.MarkFlagsMutuallyExclusive("no-env-file", "env-file")
+	createCmd.MarkFlagsMutuallyExclusive("partition", "spacing")
+	createCmd.MarkFlagsMutuallyExclusive("profile", "preset")
+	createCmd.MarkFlagsMutuallyExclusive("json", "shell", "id-only", "port-only")
 }
 
 func runCreate(cmd *cobra.Command, args []string) error {
+	start := time.Now()
+
+	if createWithTrap && !createOutputShell {
+		return usageErrorf("--with-trap requires --shell")
+	}
+	if createOutputFile != "" && !createOutputJSON && !createOutputShell {
+		return usageErrorf("--output requires --json or --shell")
+	}
+
+	if err := checkCreateCount(cmd); err != nil {
+		return err
+	}
+
+	// Validate the names, proxy specs, and profile before allocating anything
+	names := createNames(createName, createCount)
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if err := isolation.ValidateName(name); err != nil {
+			return err
+		}
+	}
+	if _, err := resolveProxySpecs(nil, createProxies); err != nil {
+		return err
+	}
+	// Presets are profiles too; a config profile of the same name wins
+	profileName := createProfile
+	if createPreset != "" {
+		profileName = createPreset
+	}
+	profile, err := loadProfile(profileName)
+	if err != nil {
+		return err
+	}
+
+	// A preset allocates exactly its named ports unless --ports is given;
+	// config profiles get at least theirs, as CreateEnvironment ensures
+	portsCount := createPortsCount
+	if createPreset != "" && profile != nil && len(profile.Ports) > 0 && !cmd.Flags().Changed("ports") {
+		portsCount = len(profile.Ports)
+	}
+	if createSpacing < 0 || (createSpacing > 0 && portsCount > createSpacing) {
+		return usageErrorf("--spacing must be at least --ports (%d), got %d", portsCount, createSpacing)
+	}
+	maxLockAge, err := loadMaxLockAge()
+	if err != nil {
+		return err
+	}
+
 	// Prepare configuration
 	worktree := createWorktree
 	if worktree == "" {
@@ -79,99 +241,574 @@ func runCreate(cmd *cobra.Command, args []string) error {
 		}
 		worktree = wd
 	}
+	project, err := currentProject(worktree)
+	if err != nil {
+		return err
+	}
+	composePrefix, err := loadComposePrefix()
+	if err != nil {
+		return err
+	}
+	gitIgnore, err := loadGitIgnore()
+	if err != nil {
+		return err
+	}
 
 	config := &isolation.Config{
-		WorktreePath: worktree,
-		InstanceID:   createInstanceID,
-		LockDir:      filepath.Join(os.TempDir(), "go-portalloc-locks"),
-		MaxRetries:   999,
+		WorktreePath:  worktree,
+		InstanceID:    createInstanceID,
+		Name:          createName,
+		Project:       project,
+		ComposePrefix: composePrefix,
+		GitIgnore:     gitIgnore,
+		LockDir:       defaultLockDir,
+		MaxRetries:    999,
+		MaxLockAge:    maxLockAge,
+		Envrc:         createEnvrc,
+		NoEnvFile:     createNoEnvFile,
+		TempLayout:    createLayout,
+		Strict:        strictMode,
+		OnReclaim:     forgetReclaimed,
+	}
+	if profile != nil {
+		config.Apply(isolation.WithProfile(profile))
+	}
+	if len(createEnvFiles) > 0 {
+		config.EnvFilePath = createEnvFiles[0]
+		config.ExtraEnvFiles = createEnvFiles[1:]
+	}
+
+	// Each environment of a --count set gets its own name and env files
+	specs := make([]isolation.Spec, createCount)
+	for i := range specs {
+		specs[i] = isolation.Spec{Ports: portsCount, Name: names[i]}
+		if createCount > 1 && len(createEnvFiles) > 0 {
+			specs[i].EnvFiles = numberedEnvFiles(createEnvFiles, i+1)
+		}
 	}
 
+	utilLimit, err := loadUtilizationLimit(createMaxUtil, createUtilAction)
+	if err != nil {
+		return err
+	}
+
+	// A retried job gets the environment its first attempt created
+	if createIdempotency != "" {
+		env, err := findIdempotentEnvironment(createIdempotency, config.LockDir, portsCount)
+		if err != nil {
+			return err
+		}
+		if env != nil {
+			fmt.Fprintf(os.Stderr, emoji("🔄 Reusing environment %s for idempotency key %s\n"), env.ID, createIdempotency)
+			createReused = true
+			return writeCreated([]*isolation.Environment{env}, nil)
+		}
+	}
+
+	// Make room per the retention policy once the quota is reached
+	reapForQuota(cmd.Context(), config.LockDir, "create")
+
 	// Create components
 	idGen := isolation.NewIDGenerator(config)
-	portAlloc := ports.NewAllocator(nil)
+	allocConfig, err := newAllocatorConfig(createReserved)
+	if err != nil {
+		return err
+	}
+	if err := checkUtilization(allocConfig, utilLimit); err != nil {
+		recordAllocation(worktree, portsCount, nil, err)
+		return err
+	}
+	var portAlloc isolation.PortAllocator
+	if createPartition != "" {
+		portAlloc = ports.NewAllocator(allocConfig).Partitioned(createPartition, createBlockSize)
+	} else {
+		allocConfig.Spacing = createSpacing
+		portAlloc = ports.NewAllocator(allocConfig)
+	}
 	manager := isolation.NewEnvironmentManager(idGen, portAlloc)
 
-	// Create environment
-	env, err := manager.CreateEnvironment(createPortsCount)
+	// Until the output is printed, SIGINT/SIGTERM roll back instead of
+	// leaking a lock nobody knows the ID of
+	ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Create the environments; with --count they are created as a unit
+	var envs []*isolation.Environment
+	if createCount == 1 {
+		env, err := manager.CreateEnvironment(portsCount)
+		recordAllocation(worktree, portsCount, env, err)
+		if err != nil {
+			return fmt.Errorf("failed to create environment: %w", err)
+		}
+		envs = []*isolation.Environment{env}
+	} else {
+		envs, err = manager.CreateEnvironments(specs)
+		if err != nil {
+			recordAllocation(worktree, portsCount, nil, err)
+			return fmt.Errorf("failed to create environments: %w", err)
+		}
+		for _, env := range envs {
+			recordAllocation(worktree, portsCount, env, nil)
+		}
+	}
+	env := envs[0]
+
+	// Created before recording, so the state knows to remove them
+	if createNetwork {
+		for _, env := range envs {
+			if err := createDockerNetwork(ctx, env); err != nil {
+				for _, env := range envs {
+					_ = cleanupEnvironment(manager, env)
+				}
+				if ctx.Err() != nil {
+					return errCreateInterrupted
+				}
+				return err
+			}
+		}
+	}
+
+	// Record environments in state file; a concurrent retry with the same
+	// idempotency key that recorded first wins
+	var winner *state.EnvironmentState
+	stateMgr, err := newStateManager()
+	for _, env := range envs {
+		env.IdempotencyKey = createIdempotency
+		if err != nil {
+			break
+		}
+		if createIdempotency != "" {
+			winner, err = stateMgr.RecordIdempotent(env)
+		} else {
+			err = stateMgr.RecordEnvironment(env)
+		}
+	}
+
+	// abort releases the environments when a later step fails
+	abort := func() {
+		for _, env := range envs {
+			_ = cleanupEnvironment(manager, env)
+			if stateMgr != nil && winner == nil {
+				_ = stateMgr.RemoveEnvironment(env.ID)
+			}
+		}
+	}
+
 	if err != nil {
-		return fmt.Errorf("failed to create environment: %w", err)
+		// Best effort unless --strict
+		if err := stateSkipped(err); err != nil {
+			abort()
+			return err
+		}
+	}
+
+	if winner != nil {
+		abort()
+		reused, err := reuseIdempotentEnvironment(winner, createIdempotency, config.LockDir, portsCount)
+		if err != nil {
+			return err
+		}
+		if reused == nil {
+			return fmt.Errorf("environment %s for idempotency key %s disappeared while creating another", winner.ID, createIdempotency)
+		}
+		fmt.Fprintf(os.Stderr, emoji("🔄 Reusing environment %s for idempotency key %s\n"), reused.ID, createIdempotency)
+		createReused = true
+		return writeCreated([]*isolation.Environment{reused}, nil)
+	}
+
+	if ctx.Err() != nil {
+		abort()
+		return errCreateInterrupted
+	}
+
+	var proxies []resolvedProxy
+	if len(createProxies) > 0 {
+		if proxies, err = resolveProxySpecs(env, createProxies); err == nil {
+			err = startProxyDaemon(env, proxies)
+		}
+		if err != nil {
+			abort()
+			if ctx.Err() != nil {
+				return errCreateInterrupted
+			}
+			return fmt.Errorf("failed to start proxy: %w", err)
+		}
+	}
+
+	// Held before hooks run, so hooks that start services release their ports
+	if createReserve {
+		for _, env := range envs {
+			if err := startReserveDaemon(env); err != nil {
+				abort()
+				if ctx.Err() != nil {
+					return errCreateInterrupted
+				}
+				return fmt.Errorf("failed to reserve ports: %w", err)
+			}
+		}
+	}
+
+	for _, env := range envs {
+		if err := runHook(ctx, hookPostCreate, env); err != nil {
+			abort()
+			if ctx.Err() != nil {
+				return errCreateInterrupted
+			}
+			return err
+		}
+	}
+
+	if ctx.Err() != nil {
+		abort()
+		return errCreateInterrupted
+	}
+
+	if err := writeCreated(envs, proxies); err != nil {
+		abort()
+		return fmt.Errorf("failed to write output: %w", err)
 	}
 
-	// Record environment in state file
-	stateMgr, err := state.NewManager()
-	if err == nil {
-		// Best effort - don't fail if state recording fails
-		_ = stateMgr.RecordEnvironment(env)
+	for _, env := range envs {
+		created := state.NewEnvironmentState(env)
+		logEnvironment("environment created", created, start)
+		notifyEvent(state.EventCreated, created)
 	}
 
-	// Output based on format
+	return nil
+}
+
+// writeCreated prints envs in the format selected by the output flags.
+func writeCreated(envs []*isolation.Environment, proxies []resolvedProxy) error {
+	env := envs[0]
 	switch {
+	case createOutputFile != "":
+		return writeCreateOutputFile(createOutputFile, envs, proxies)
 	case createOutputJSON:
-		return outputJSON(env)
+		return writeCreateOutput(os.Stdout, envs, proxies)
+	case createIDOnly:
+		_, err := fmt.Fprintln(os.Stdout, env.ID)
+		return err
+	case createPortOnly:
+		_, err := fmt.Fprintln(os.Stdout, env.Ports.BasePort)
+		return err
 	case createOutputShell:
-		return outputShell(env)
+		return outputShell(os.Stdout, env)
+	case len(envs) > 1:
+		return outputHumanList(os.Stdout, envs)
 	default:
-		return outputHuman(env)
-	}
-}
-
-func outputJSON(env *isolation.Environment) error {
-	output := map[string]interface{}{
-		"isolation_id":         env.ID,
-		"compose_project_name": fmt.Sprintf("portalloc-%s", env.ID),
-		"worktree_path":        env.WorktreePath,
-		"temp_dir":             env.TempDir,
-		"lock_file":            env.LockFile,
-		"env_file":             env.EnvFile,
-		"ports": map[string]interface{}{
-			"base_port": env.Ports.BasePort,
-			"count":     env.Ports.Count,
-			"ports":     env.Ports.Ports(),
-		},
+		return outputHuman(os.Stdout, env, proxies)
+	}
+}
+
+// createCountConflicts lists the create flags that only make sense for a
+// single environment.
+var createCountConflicts = []string{"instance-id", "idempotency-key", "shell", "id-only", "port-only", "proxy", "envrc", "partition"}
+
+// checkCreateCount rejects an invalid --count and flags it conflicts with.
+func checkCreateCount(cmd *cobra.Command) error {
+	if createCount < 1 {
+		return usageErrorf("--count must be at least 1, got %d", createCount)
+	}
+	if createCount == 1 {
+		return nil
 	}
+	for _, name := range createCountConflicts {
+		if cmd.Flags().Changed(name) {
+			return usageErrorf("--%s cannot be used with --count", name)
+		}
+	}
+	return nil
+}
 
-	encoder := json.NewEncoder(os.Stdout)
+// createNames returns the names of count environments: name itself for a
+// single environment, otherwise name-1 through name-count. Without a name
+// every entry is empty.
+func createNames(name string, count int) []string {
+	names := make([]string, count)
+	if name == "" || count == 1 {
+		names[0] = name
+		return names
+	}
+	for i := range names {
+		names[i] = fmt.Sprintf("%s-%d", name, i+1)
+	}
+	return names
+}
+
+// numberedEnvFiles returns the configured env file paths with a ".n"
+// suffix so the environments of a --count set don't overwrite each
+// other's files. The default env file is already named per environment.
+func numberedEnvFiles(paths []string, n int) []string {
+	numbered := make([]string, len(paths))
+	for i, p := range paths {
+		numbered[i] = fmt.Sprintf("%s.%d", p, n)
+	}
+	return numbered
+}
+
+// errCreateInterrupted is returned when create is interrupted and rolled back.
+var errCreateInterrupted = errors.New("create interrupted; environment rolled back")
+
+// createOutput is the document printed by 'create --json'.
+type createOutput struct {
+	IsolationID        string              `json:"isolation_id"`
+	Name               string              `json:"name,omitempty"`
+	ComposeProjectName string              `json:"compose_project_name"`
+	DockerNetwork      string              `json:"docker_network"`
+	NetworkCreated     bool                `json:"docker_network_created,omitempty"`
+	WorktreePath       string              `json:"worktree_path"`
+	TempDir            string              `json:"temp_dir"`
+	LockFile           string              `json:"lock_file"`
+	EnvFile            string              `json:"env_file"`
+	EnvFiles           []string            `json:"env_files,omitempty"`
+	ServicesFile       string              `json:"services_file"`
+	GitBranch          string              `json:"git_branch,omitempty"`
+	GitCommit          string              `json:"git_commit,omitempty"`
+	DataDir            string              `json:"data_dir,omitempty"`
+	LogsDir            string              `json:"logs_dir,omitempty"`
+	TmpDir             string              `json:"tmp_dir,omitempty"`
+	SocketsDir         string              `json:"sockets_dir,omitempty"`
+	Proxies            []createOutputProxy `json:"proxies,omitempty"`
+	Reserved           bool                `json:"reserved,omitempty"`
+	IdempotencyKey     string              `json:"idempotency_key,omitempty"`
+	Reused             bool                `json:"reused,omitempty"`
+	Ports              createOutputPorts   `json:"ports"`
+}
+
+// createOutputProxy describes one 'create --proxy' forwarding rule.
+type createOutputProxy struct {
+	ListenPort int    `json:"listen_port"`
+	Service    string `json:"service"`
+	TargetPort int    `json:"target_port"`
+}
+
+// createOutputPorts is the port section of createOutput.
+type createOutputPorts struct {
+	BasePort int   `json:"base_port"`
+	Count    int   `json:"count"`
+	Ports    []int `json:"ports"`
+}
+
+func outputJSON(w io.Writer, env *isolation.Environment, proxies []resolvedProxy) error {
+	encoder := json.NewEncoder(w)
 	encoder.SetIndent("", "  ")
+	output := newCreateOutput(env, proxies)
+	output.Reserved = createReserve
 	return encoder.Encode(output)
 }
 
-func outputShell(env *isolation.Environment) error {
-	fmt.Printf("export ISOLATION_ID=%s\n", env.ID)
-	fmt.Printf("export COMPOSE_PROJECT_NAME=portalloc-%s\n", env.ID)
-	fmt.Printf("export TEMP_DIR=%s\n", env.TempDir)
-	fmt.Printf("export PORT_BASE=%d\n", env.Ports.BasePort)
-	fmt.Printf("export PORT_COUNT=%d\n", env.Ports.Count)
+// writeCreateOutput writes the 'create --json' output for envs: a single
+// document, or an array of them for a --count set.
+func writeCreateOutput(w io.Writer, envs []*isolation.Environment, proxies []resolvedProxy) error {
+	if len(envs) == 1 {
+		return outputJSON(w, envs[0], proxies)
+	}
 
-	portNames := []string{"FIRESTORE_PORT", "AUTH_PORT", "API_PORT", "METRICS_PORT", "DEBUG_PORT"}
-	for i := 0; i < env.Ports.Count && i < len(portNames); i++ {
-		port, err := env.Ports.GetPort(i)
-		if err != nil {
+	outputs := make([]createOutput, len(envs))
+	for i, env := range envs {
+		outputs[i] = newCreateOutput(env, nil)
+		outputs[i].Reserved = createReserve
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(outputs)
+}
+
+// newCreateOutput builds the 'create --json' document for env.
+func newCreateOutput(env *isolation.Environment, proxies []resolvedProxy) createOutput {
+	output := createOutput{
+		IsolationID:        env.ID,
+		Name:               env.Name,
+		ComposeProjectName: env.ComposeProjectName(),
+		DockerNetwork:      env.DockerNetworkName(),
+		NetworkCreated:     env.DockerNetwork != "",
+		WorktreePath:       env.WorktreePath,
+		TempDir:            env.TempDir,
+		LockFile:           env.LockFile,
+		EnvFile:            env.EnvFile,
+		EnvFiles:           env.EnvFiles,
+		ServicesFile:       env.ServicesFile(),
+		GitBranch:          env.GitBranch,
+		GitCommit:          env.GitCommit,
+		IdempotencyKey:     createIdempotency,
+		Reused:             createReused,
+		Ports: createOutputPorts{
+			BasePort: env.Ports.BasePort,
+			Count:    env.Ports.Count,
+			Ports:    env.Ports.Ports(),
+		},
+	}
+
+	if env.Layout {
+		output.DataDir = env.DataDir()
+		output.LogsDir = env.LogsDir()
+		output.TmpDir = env.TmpDir()
+		output.SocketsDir = env.SocketsDir()
+	}
+
+	for _, p := range proxies {
+		output.Proxies = append(output.Proxies, createOutputProxy{
+			ListenPort: p.spec.ListenPort,
+			Service:    p.spec.Service,
+			TargetPort: p.targetPort,
+		})
+	}
+
+	return output
+}
+
+func outputShell(w io.Writer, env *isolation.Environment) error {
+	out := &errWriter{w: w}
+	out.printf("export ISOLATION_ID=%s\n", env.ID)
+
+	// Same variables, in the same order, as the env file
+	vars := env.Vars()
+	for _, name := range env.VarNames() {
+		if name == "ISOLATION_ID" {
 			continue
 		}
-		fmt.Printf("export %s=%d\n", portNames[i], port)
+		out.printf("export %s=%s\n", name, isolation.ShellQuote(vars[name]))
 	}
 
-	return nil
+	if createWithTrap {
+		out.printf("trap 'go-portalloc cleanup --id %s' EXIT\n", env.ID)
+	}
+
+	return out.err
 }
 
-func outputHuman(env *isolation.Environment) error {
-	fmt.Println("✅ Environment created successfully!")
-	fmt.Println()
-	fmt.Printf("  Isolation ID:  %s\n", env.ID)
-	fmt.Printf("  Temp Directory: %s\n", env.TempDir)
-	fmt.Printf("  Lock File:      %s\n", env.LockFile)
-	fmt.Printf("  Env File:       %s\n", env.EnvFile)
-	fmt.Println()
-	fmt.Printf("  Base Port:      %d\n", env.Ports.BasePort)
-	fmt.Printf("  Port Count:     %d\n", env.Ports.Count)
-	fmt.Printf("  Allocated Ports: %v\n", env.Ports.Ports())
-	fmt.Println()
-	fmt.Println("To use this environment:")
-	fmt.Printf("  source %s\n", env.EnvFile)
-	fmt.Println()
-	fmt.Println("To cleanup:")
-	fmt.Printf("  go-portalloc cleanup --id %s\n", env.ID)
+// writeCreateOutputFile writes the --json or --shell output to path through
+// a temporary file in the same directory, so readers never see a partial file.
+func writeCreateOutputFile(path string, envs []*isolation.Environment, proxies []resolvedProxy) error {
+	var buf bytes.Buffer
+	var err error
+	if createOutputJSON {
+		err = writeCreateOutput(&buf, envs, proxies)
+	} else {
+		err = outputShell(&buf, envs[0])
+	}
+	if err != nil {
+		return err
+	}
 
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	// Flush before the rename, so a crash cannot leave an empty file behind
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	// #nosec G302 - the output holds paths and ports, nothing secret
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return fmt.Errorf("failed to set permissions: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	fmt.Fprintf(os.Stderr, emoji("✅ Wrote %s\n"), path)
 	return nil
 }
+
+func outputHuman(w io.Writer, env *isolation.Environment, proxies []resolvedProxy) error {
+	out := &errWriter{w: w}
+	if createReused {
+		out.printf(emoji("✅ Environment reused (idempotency key %s)\n"), createIdempotency)
+	} else {
+		out.println(emoji("✅ Environment created successfully!"))
+	}
+	out.println("")
+	out.printf("  Isolation ID:  %s\n", env.ID)
+	if env.Name != "" {
+		out.printf("  Name:           %s\n", env.Name)
+	}
+	out.printf("  Temp Directory: %s\n", env.TempDir)
+	out.printf("  Lock File:      %s\n", env.LockFile)
+	if env.EnvFile != "" {
+		out.printf("  Env File:       %s\n", env.EnvFile)
+	} else {
+		out.println("  Env File:       (none)")
+	}
+	if env.GitBranch != "" || env.GitCommit != "" {
+		out.printf("  Git:            %s\n", formatGit(env.GitBranch, env.GitCommit))
+	}
+	if env.DockerNetwork != "" {
+		out.printf("  Docker Network: %s\n", env.DockerNetwork)
+	}
+	out.println("")
+	out.printf("  Base Port:      %d\n", env.Ports.BasePort)
+	out.printf("  Port Count:     %d\n", env.Ports.Count)
+	out.printf("  Allocated Ports: %v\n", env.Ports.Ports())
+	for _, p := range proxies {
+		out.printf("  Proxy:          %s -> %d (%s)\n", p.spec.ListenAddr(), p.targetPort, p.spec.Service)
+	}
+	if createReserve {
+		out.printf("  Reserved:       until go-portalloc release-port --id %s --service <service>\n", env.ID)
+	}
+	out.println("")
+	if env.EnvFile != "" {
+		out.println("To use this environment:")
+		out.printf("  source %s\n", env.EnvFile)
+		out.println("")
+	}
+	out.println("To cleanup:")
+	if env.Name != "" {
+		out.printf("  go-portalloc cleanup --name %s\n", env.Name)
+	} else {
+		out.printf("  go-portalloc cleanup --id %s\n", env.ID)
+	}
+
+	return out.err
+}
+
+// outputHumanList prints a summary of the environments of a --count set.
+func outputHumanList(w io.Writer, envs []*isolation.Environment) error {
+	out := &errWriter{w: w}
+	out.printf(emoji("✅ %d environments created successfully!\n"), len(envs))
+	for _, env := range envs {
+		out.println("")
+		out.printf("  Isolation ID:  %s\n", env.ID)
+		if env.Name != "" {
+			out.printf("  Name:           %s\n", env.Name)
+		}
+		if env.EnvFile != "" {
+			out.printf("  Env File:       %s\n", env.EnvFile)
+		}
+		out.printf("  Allocated Ports: %v\n", env.Ports.Ports())
+	}
+	out.println("")
+	out.println("To cleanup:")
+	for _, env := range envs {
+		out.printf("  go-portalloc cleanup --id %s\n", env.ID)
+	}
+
+	return out.err
+}
+
+// errWriter writes formatted output to w and keeps the first write error,
+// so the output functions can report a closed or full stdout.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (e *errWriter) printf(format string, args ...any) {
+	if e.err == nil {
+		_, e.err = fmt.Fprintf(e.w, format, args...)
+	}
+}
+
+func (e *errWriter) println(line string) {
+	e.printf("%s\n", line)
+}
@@ -15,27 +15,81 @@
 package cli
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/pigeonworks-llc/go-portalloc/internal/snapshot"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/webhook"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+// cliBinary is the CLI binary the integration tests run; see buildCLI.
+const cliBinary = "/tmp/go-portalloc-test"
+
+var (
+	buildCLIOnce sync.Once
+	buildCLIErr  error
+)
+
+// buildCLI builds cliBinary once for every integration test of the package.
+func buildCLI(t *testing.T) {
+	t.Helper()
+	buildCLIOnce.Do(func() {
+		buildCLIErr = exec.Command("go", "build", "-o", cliBinary, "../../cmd/go-portalloc").Run()
+	})
+	require.NoError(t, buildCLIErr, "Failed to build CLI")
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	_ = os.Remove(cliBinary)
+	os.Exit(code)
+}
+
+// runCLI runs cliBinary with args in dir, or in a new temporary directory if
+// dir is empty, with environment env (nil inherits the test's), and returns
+// its stdout and stderr.
+func runCLI(t *testing.T, dir string, env []string, args ...string) (string, string, error) {
+	t.Helper()
+	if dir == "" {
+		dir = t.TempDir()
+	}
+	cmd := exec.Command(cliBinary, args...)
+	cmd.Dir, cmd.Env = dir, env
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	return stdout.String(), stderr.String(), err
+}
+
 // Integration tests using actual CLI binary
 func TestCLIIntegration(t *testing.T) {
-	// Build CLI binary for testing
-	buildCmd := exec.Command("go", "build", "-o", "/tmp/go-portalloc-test", "../../cmd/go-portalloc")
-	require.NoError(t, buildCmd.Run(), "Failed to build CLI")
-	defer os.Remove("/tmp/go-portalloc-test")
+	buildCLI(t)
 
 	t.Run("create command with JSON output", func(t *testing.T) {
 		tmpDir := t.TempDir()
 
-		cmd := exec.Command("/tmp/go-portalloc-test", "create", "--json")
+		cmd := exec.Command(cliBinary, "create", "--json")
 		cmd.Dir = tmpDir
 		output, err := cmd.CombinedOutput()
 
@@ -51,7 +105,7 @@ func TestCLIIntegration(t *testing.T) {
 
 		// Cleanup
 		isolationID := result["isolation_id"].(string)
-		cleanupCmd := exec.Command("/tmp/go-portalloc-test", "cleanup", "--id", isolationID)
+		cleanupCmd := exec.Command(cliBinary, "cleanup", "--id", isolationID)
 		cleanupCmd.Dir = tmpDir
 		_ = cleanupCmd.Run()
 	})
@@ -59,7 +113,7 @@ func TestCLIIntegration(t *testing.T) {
 	t.Run("create command with custom port count", func(t *testing.T) {
 		tmpDir := t.TempDir()
 
-		cmd := exec.Command("/tmp/go-portalloc-test", "create", "--ports", "15", "--json")
+		cmd := exec.Command(cliBinary, "create", "--ports", "15", "--json")
 		cmd.Dir = tmpDir
 		output, err := cmd.CombinedOutput()
 
@@ -74,7 +128,7 @@ func TestCLIIntegration(t *testing.T) {
 
 		// Cleanup
 		isolationID := result["isolation_id"].(string)
-		cleanupCmd := exec.Command("/tmp/go-portalloc-test", "cleanup", "--id", isolationID)
+		cleanupCmd := exec.Command(cliBinary, "cleanup", "--id", isolationID)
 		cleanupCmd.Dir = tmpDir
 		_ = cleanupCmd.Run()
 	})
@@ -83,7 +137,7 @@ func TestCLIIntegration(t *testing.T) {
 		tmpDir := t.TempDir()
 
 		// Create
-		createCmd := exec.Command("/tmp/go-portalloc-test", "create", "--json")
+		createCmd := exec.Command(cliBinary, "create", "--json")
 		createCmd.Dir = tmpDir
 		createOutput, err := createCmd.CombinedOutput()
 		require.NoError(t, err)
@@ -93,14 +147,14 @@ func TestCLIIntegration(t *testing.T) {
 		isolationID := createResult["isolation_id"].(string)
 
 		// Validate
-		validateCmd := exec.Command("/tmp/go-portalloc-test", "validate", "--id", isolationID)
+		validateCmd := exec.Command(cliBinary, "validate", "--id", isolationID)
 		validateCmd.Dir = tmpDir
 		validateOutput, err := validateCmd.CombinedOutput()
 		require.NoError(t, err)
 		assert.Contains(t, string(validateOutput), "valid")
 
 		// Cleanup
-		cleanupCmd := exec.Command("/tmp/go-portalloc-test", "cleanup", "--id", isolationID)
+		cleanupCmd := exec.Command(cliBinary, "cleanup", "--id", isolationID)
 		cleanupCmd.Dir = tmpDir
 		cleanupOutput, err := cleanupCmd.CombinedOutput()
 		require.NoError(t, err)
@@ -110,7 +164,7 @@ func TestCLIIntegration(t *testing.T) {
 	t.Run("shell output format", func(t *testing.T) {
 		tmpDir := t.TempDir()
 
-		cmd := exec.Command("/tmp/go-portalloc-test", "create", "--shell")
+		cmd := exec.Command(cliBinary, "create", "--shell")
 		cmd.Dir = tmpDir
 		output, err := cmd.CombinedOutput()
 
@@ -133,16 +187,77 @@ func TestCLIIntegration(t *testing.T) {
 		}
 
 		if isolationID != "" {
-			cleanupCmd := exec.Command("/tmp/go-portalloc-test", "cleanup", "--id", isolationID)
+			cleanupCmd := exec.Command(cliBinary, "cleanup", "--id", isolationID)
 			cleanupCmd.Dir = tmpDir
 			_ = cleanupCmd.Run()
 		}
 	})
 
+	t.Run("shell output with trap", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		cmd := exec.Command(cliBinary, "create", "--shell", "--with-trap")
+		cmd.Dir = tmpDir
+		output, err := cmd.CombinedOutput()
+
+		require.NoError(t, err)
+
+		var isolationID string
+		for _, line := range strings.Split(string(output), "\n") {
+			if strings.HasPrefix(line, "export ISOLATION_ID=") {
+				isolationID = strings.TrimPrefix(line, "export ISOLATION_ID=")
+				break
+			}
+		}
+		require.NotEmpty(t, isolationID)
+		assert.Contains(t, string(output), "trap 'go-portalloc cleanup --id "+isolationID+"' EXIT")
+
+		cleanupCmd := exec.Command(cliBinary, "cleanup", "--id", isolationID)
+		cleanupCmd.Dir = tmpDir
+		_ = cleanupCmd.Run()
+	})
+
+	t.Run("with-trap requires shell", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		cmd := exec.Command(cliBinary, "create", "--with-trap")
+		cmd.Dir = tmpDir
+		_, err := cmd.CombinedOutput()
+
+		assert.Error(t, err)
+	})
+
+	t.Run("create --no-env-file leaves worktree untouched", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		cmd := exec.Command(cliBinary, "create", "--json", "--no-env-file")
+		cmd.Dir = tmpDir
+		output, err := cmd.Output()
+		require.NoError(t, err)
+
+		var result map[string]interface{}
+		require.NoError(t, json.Unmarshal(output, &result))
+		assert.Equal(t, "", result["env_file"])
+
+		entries, err := os.ReadDir(tmpDir)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+
+		isolationID := result["isolation_id"].(string)
+		validateCmd := exec.Command(cliBinary, "validate", "--id", isolationID)
+		validateCmd.Dir = tmpDir
+		validateOutput, err := validateCmd.CombinedOutput()
+		require.NoError(t, err, string(validateOutput))
+
+		cleanupCmd := exec.Command(cliBinary, "cleanup", "--id", isolationID)
+		cleanupCmd.Dir = tmpDir
+		_ = cleanupCmd.Run()
+	})
+
 	t.Run("cleanup is idempotent", func(t *testing.T) {
 		tmpDir := t.TempDir()
 
-		cmd := exec.Command("/tmp/go-portalloc-test", "cleanup", "--id", "nonexistent-id")
+		cmd := exec.Command(cliBinary, "cleanup", "--id", "nonexistent-id")
 		cmd.Dir = tmpDir
 		_, err := cmd.CombinedOutput()
 
@@ -154,7 +269,7 @@ func TestCLIIntegration(t *testing.T) {
 		tmpDir := t.TempDir()
 
 		// Create an environment
-		createCmd := exec.Command("/tmp/go-portalloc-test", "create", "--json")
+		createCmd := exec.Command(cliBinary, "create", "--json")
 		createCmd.Dir = tmpDir
 		createOutput, err := createCmd.CombinedOutput()
 		require.NoError(t, err)
@@ -164,7 +279,7 @@ func TestCLIIntegration(t *testing.T) {
 		isolationID := createResult["isolation_id"].(string)
 
 		// List environments (table format)
-		listCmd := exec.Command("/tmp/go-portalloc-test", "list")
+		listCmd := exec.Command(cliBinary, "list")
 		listCmd.Dir = tmpDir
 		listOutput, err := listCmd.CombinedOutput()
 		require.NoError(t, err)
@@ -174,7 +289,7 @@ func TestCLIIntegration(t *testing.T) {
 		assert.Contains(t, outputStr, "STATUS")
 
 		// List environments (JSON format)
-		listJSONCmd := exec.Command("/tmp/go-portalloc-test", "list", "--format", "json")
+		listJSONCmd := exec.Command(cliBinary, "list", "--format", "json")
 		listJSONCmd.Dir = tmpDir
 		listJSONOutput, err := listJSONCmd.CombinedOutput()
 		require.NoError(t, err)
@@ -196,7 +311,7 @@ func TestCLIIntegration(t *testing.T) {
 		assert.True(t, found, "environment not found in list")
 
 		// Cleanup
-		cleanupCmd := exec.Command("/tmp/go-portalloc-test", "cleanup", "--id", isolationID)
+		cleanupCmd := exec.Command(cliBinary, "cleanup", "--id", isolationID)
 		cleanupCmd.Dir = tmpDir
 		_ = cleanupCmd.Run()
 	})
@@ -205,7 +320,7 @@ func TestCLIIntegration(t *testing.T) {
 		tmpDir := t.TempDir()
 
 		// Create an environment
-		createCmd := exec.Command("/tmp/go-portalloc-test", "create", "--json")
+		createCmd := exec.Command(cliBinary, "create", "--json")
 		createCmd.Dir = tmpDir
 		createOutput, err := createCmd.CombinedOutput()
 		require.NoError(t, err)
@@ -215,7 +330,7 @@ func TestCLIIntegration(t *testing.T) {
 		isolationID := createResult["isolation_id"].(string)
 
 		// Run reconcile
-		reconcileCmd := exec.Command("/tmp/go-portalloc-test", "reconcile")
+		reconcileCmd := exec.Command(cliBinary, "reconcile")
 		reconcileCmd.Dir = tmpDir
 		reconcileOutput, err := reconcileCmd.CombinedOutput()
 		require.NoError(t, err)
@@ -225,7 +340,7 @@ func TestCLIIntegration(t *testing.T) {
 		assert.Contains(t, outputStr, "State file updated")
 
 		// Verify environment still exists after reconcile
-		listCmd := exec.Command("/tmp/go-portalloc-test", "list", "--format", "json")
+		listCmd := exec.Command(cliBinary, "list", "--format", "json")
 		listCmd.Dir = tmpDir
 		listOutput, err := listCmd.CombinedOutput()
 		require.NoError(t, err)
@@ -243,7 +358,7 @@ func TestCLIIntegration(t *testing.T) {
 		assert.True(t, found, "environment should exist after reconcile")
 
 		// Cleanup
-		cleanupCmd := exec.Command("/tmp/go-portalloc-test", "cleanup", "--id", isolationID)
+		cleanupCmd := exec.Command(cliBinary, "cleanup", "--id", isolationID)
 		cleanupCmd.Dir = tmpDir
 		_ = cleanupCmd.Run()
 	})
@@ -254,7 +369,7 @@ func TestCLIIntegration(t *testing.T) {
 		// Create multiple environments
 		var isolationIDs []string
 		for i := 0; i < 3; i++ {
-			createCmd := exec.Command("/tmp/go-portalloc-test", "create", "--json")
+			createCmd := exec.Command(cliBinary, "create", "--json")
 			createCmd.Dir = tmpDir
 			createOutput, err := createCmd.CombinedOutput()
 			require.NoError(t, err)
@@ -265,7 +380,7 @@ func TestCLIIntegration(t *testing.T) {
 		}
 
 		// All environments should be stale (created by different process)
-		staleCmd := exec.Command("/tmp/go-portalloc-test", "cleanup", "--stale")
+		staleCmd := exec.Command(cliBinary, "cleanup", "--stale")
 		staleCmd.Dir = tmpDir
 		staleOutput, err := staleCmd.CombinedOutput()
 		require.NoError(t, err)
@@ -275,7 +390,7 @@ func TestCLIIntegration(t *testing.T) {
 		assert.Contains(t, outputStr, "Cleaned up")
 
 		// Verify all environments were cleaned
-		listCmd := exec.Command("/tmp/go-portalloc-test", "list", "--format", "json")
+		listCmd := exec.Command(cliBinary, "list", "--format", "json")
 		listCmd.Dir = tmpDir
 		listOutput, err := listCmd.CombinedOutput()
 		require.NoError(t, err)
@@ -297,7 +412,7 @@ func TestCLIIntegration(t *testing.T) {
 		tmpDir := t.TempDir()
 
 		// Create an environment
-		createCmd := exec.Command("/tmp/go-portalloc-test", "create", "--json")
+		createCmd := exec.Command(cliBinary, "create", "--json")
 		createCmd.Dir = tmpDir
 		createOutput, err := createCmd.CombinedOutput()
 		require.NoError(t, err)
@@ -307,7 +422,7 @@ func TestCLIIntegration(t *testing.T) {
 		isolationID := createResult["isolation_id"].(string)
 
 		// List with reconcile
-		listCmd := exec.Command("/tmp/go-portalloc-test", "list", "--reconcile")
+		listCmd := exec.Command(cliBinary, "list", "--reconcile")
 		listCmd.Dir = tmpDir
 		listOutput, err := listCmd.CombinedOutput()
 		require.NoError(t, err)
@@ -316,8 +431,1604 @@ func TestCLIIntegration(t *testing.T) {
 		assert.Contains(t, outputStr, isolationID)
 
 		// Cleanup
-		cleanupCmd := exec.Command("/tmp/go-portalloc-test", "cleanup", "--id", isolationID)
+		cleanupCmd := exec.Command(cliBinary, "cleanup", "--id", isolationID)
 		cleanupCmd.Dir = tmpDir
 		_ = cleanupCmd.Run()
 	})
+
+	t.Run("schema command prints versioned schemas", func(t *testing.T) {
+		for _, name := range []string{"state", "create-output", "list-output", "watch-event"} {
+			cmd := exec.Command(cliBinary, "schema", name)
+			output, err := cmd.Output()
+			require.NoError(t, err, name)
+
+			var schema map[string]interface{}
+			require.NoError(t, json.Unmarshal(output, &schema), name)
+			assert.Contains(t, schema["$id"], "/"+name+"/v")
+		}
+
+		// create --count prints an array, so either shape validates
+		output, err := exec.Command(cliBinary, "schema", "create-output").Output()
+		require.NoError(t, err)
+		var schema struct {
+			ID    string                   `json:"$id"`
+			OneOf []map[string]interface{} `json:"oneOf"`
+		}
+		require.NoError(t, json.Unmarshal(output, &schema))
+		assert.Contains(t, schema.ID, "/create-output/v2.json")
+		require.Len(t, schema.OneOf, 2)
+		assert.Equal(t, "object", schema.OneOf[0]["type"])
+		assert.Equal(t, "array", schema.OneOf[1]["type"])
+
+		cmd := exec.Command(cliBinary, "schema", "unknown")
+		assert.Error(t, cmd.Run())
+	})
+
+	t.Run("watch streams created and removed events", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		watchCmd := exec.Command(cliBinary, "watch", "--interval", "50ms")
+		stdout, err := watchCmd.StdoutPipe()
+		require.NoError(t, err)
+		require.NoError(t, watchCmd.Start())
+		defer func() {
+			_ = watchCmd.Process.Kill()
+			_ = watchCmd.Wait()
+		}()
+
+		events := make(chan map[string]interface{}, 16)
+		go func() {
+			scanner := bufio.NewScanner(stdout)
+			for scanner.Scan() {
+				var event map[string]interface{}
+				if json.Unmarshal(scanner.Bytes(), &event) == nil {
+					events <- event
+				}
+			}
+			close(events)
+		}()
+
+		// Let watch take its initial snapshot
+		time.Sleep(200 * time.Millisecond)
+
+		createCmd := exec.Command(cliBinary, "create", "--json")
+		createCmd.Dir = tmpDir
+		createOutput, err := createCmd.CombinedOutput()
+		require.NoError(t, err)
+
+		var createResult map[string]interface{}
+		require.NoError(t, json.Unmarshal(createOutput, &createResult))
+		isolationID := createResult["isolation_id"].(string)
+
+		// Other tests share the state file; only look at our environment
+		waitFor := func(want string) {
+			timeout := time.After(5 * time.Second)
+			for {
+				select {
+				case event, ok := <-events:
+					require.True(t, ok, "watch exited early")
+					if event["id"] == isolationID {
+						assert.Equal(t, want, event["event"])
+						return
+					}
+				case <-timeout:
+					t.Fatalf("timed out waiting for %s event", want)
+				}
+			}
+		}
+
+		waitFor("created")
+
+		cleanupCmd := exec.Command(cliBinary, "cleanup", "--id", isolationID)
+		cleanupCmd.Dir = tmpDir
+		require.NoError(t, cleanupCmd.Run())
+
+		waitFor("removed")
+	})
+
+	t.Run("webhooks receive created and removed events", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		type delivery struct {
+			event, signature string
+			body             []byte
+		}
+		deliveries := make(chan delivery, 8)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			deliveries <- delivery{r.Header.Get(webhook.EventHeader), r.Header.Get(webhook.SignatureHeader), body}
+		}))
+		defer server.Close()
+
+		configFile := filepath.Join(tmpDir, "config.json")
+		configJSON := fmt.Sprintf(`{"webhooks": [{"url": %q, "secret": "s3cret"}]}`, server.URL)
+		require.NoError(t, os.WriteFile(configFile, []byte(configJSON), 0o600))
+
+		createCmd := exec.Command(cliBinary, "create", "--json", "--config", configFile)
+		createCmd.Dir = tmpDir
+		createOutput, err := createCmd.Output()
+		require.NoError(t, err)
+
+		var createResult map[string]interface{}
+		require.NoError(t, json.Unmarshal(createOutput, &createResult))
+		isolationID := createResult["isolation_id"].(string)
+
+		cleanupCmd := exec.Command(cliBinary, "cleanup", "--id", isolationID, "--config", configFile)
+		cleanupCmd.Dir = tmpDir
+		require.NoError(t, cleanupCmd.Run())
+
+		for _, want := range []string{"created", "removed"} {
+			d := <-deliveries
+			assert.Equal(t, want, d.event)
+			assert.Equal(t, webhook.Sign("s3cret", d.body), d.signature)
+
+			var payload map[string]interface{}
+			require.NoError(t, json.Unmarshal(d.body, &payload))
+			assert.Equal(t, want, payload["event"])
+			assert.Equal(t, isolationID, payload["id"])
+		}
+	})
+
+	t.Run("run executes each copy in its own environment", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		cmd := exec.Command(cliBinary, "run", "--copies", "3", "--",
+			"sh", "-c", `echo "$PORTALLOC_COPY_INDEX $ISOLATION_ID $PORT_BASE"`)
+		cmd.Dir = tmpDir
+		output, err := cmd.Output()
+		require.NoError(t, err)
+
+		lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+		require.Len(t, lines, 3)
+
+		ids := map[string]bool{}
+		bases := map[string]bool{}
+		for _, line := range lines {
+			fields := strings.Fields(line)
+			require.Len(t, fields, 4, line)
+			assert.Equal(t, fields[0], "["+fields[1]+"]")
+			ids[fields[2]] = true
+			bases[fields[3]] = true
+		}
+		assert.Len(t, ids, 3)
+		assert.Len(t, bases, 3)
+
+		// Every copy is cleaned up and no env file is left behind
+		for id := range ids {
+			_, err := os.Stat(filepath.Join(os.TempDir(), "aigis-test-"+id))
+			assert.True(t, os.IsNotExist(err), id)
+		}
+		_, err = os.Stat(filepath.Join(tmpDir, ".env.isolation"))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("run fails if any copy fails", func(t *testing.T) {
+		cmd := exec.Command(cliBinary, "run", "--copies", "2", "--",
+			"sh", "-c", `exit $((PORTALLOC_COPY_INDEX * 7))`)
+		cmd.Dir = t.TempDir()
+		output, err := cmd.CombinedOutput()
+		require.Error(t, err)
+		assert.Contains(t, string(output), "1 of 2 copies failed")
+		assert.Equal(t, 7, cmd.ProcessState.ExitCode(), "the copy's exit status is passed on")
+
+		cmd = exec.Command(cliBinary, "run", "--", "sh", "-c", `kill -TERM $$`)
+		cmd.Dir = t.TempDir()
+		output, err = cmd.CombinedOutput()
+		require.Error(t, err)
+		assert.Contains(t, string(output), "killed by signal terminated")
+		assert.Equal(t, 128+int(syscall.SIGTERM), cmd.ProcessState.ExitCode())
+	})
+
+	t.Run("create --proxy forwards a stable port until cleanup", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		// Pick a free port to act as the stable proxy port
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		proxyPort := l.Addr().(*net.TCPAddr).Port
+		require.NoError(t, l.Close())
+
+		createCmd := exec.Command(cliBinary, "create", "--json", "--proxy", fmt.Sprintf("%d=api", proxyPort))
+		createCmd.Dir = tmpDir
+		createOutput, err := createCmd.Output()
+		require.NoError(t, err)
+
+		var result struct {
+			IsolationID string `json:"isolation_id"`
+			Proxies     []struct {
+				ListenPort int `json:"listen_port"`
+				TargetPort int `json:"target_port"`
+			} `json:"proxies"`
+		}
+		require.NoError(t, json.Unmarshal(createOutput, &result))
+		require.Len(t, result.Proxies, 1)
+		assert.Equal(t, proxyPort, result.Proxies[0].ListenPort)
+
+		// Serve on the allocated API port and reach it through the proxy
+		api, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", result.Proxies[0].TargetPort))
+		require.NoError(t, err)
+		defer api.Close()
+		go func() {
+			conn, err := api.Accept()
+			if err == nil {
+				_, _ = conn.Write([]byte("pong\n"))
+				_ = conn.Close()
+			}
+		}()
+
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", proxyPort))
+		require.NoError(t, err)
+		reply, err := bufio.NewReader(conn).ReadString('\n')
+		_ = conn.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "pong\n", reply)
+
+		cleanupCmd := exec.Command(cliBinary, "cleanup", "--id", result.IsolationID)
+		cleanupCmd.Dir = tmpDir
+		require.NoError(t, cleanupCmd.Run())
+
+		// The background proxy notices the cleanup and releases the port
+		assert.Eventually(t, func() bool {
+			l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", proxyPort))
+			if err != nil {
+				return false
+			}
+			_ = l.Close()
+			return true
+		}, 5*time.Second, 100*time.Millisecond)
+	})
+
+	t.Run("create --proxy fails when the stable port is taken", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer l.Close()
+
+		cmd := exec.Command(cliBinary, "create", "--json", "--proxy", fmt.Sprintf("%d=api", l.Addr().(*net.TCPAddr).Port))
+		cmd.Dir = t.TempDir()
+		output, err := cmd.CombinedOutput()
+		require.Error(t, err, "a port answering for someone else must not pass as the proxy")
+		assert.Contains(t, string(output), "failed to start proxy")
+	})
+
+	t.Run("create --proxy rejects invalid specs", func(t *testing.T) {
+		cmd := exec.Command(cliBinary, "create", "--proxy", "api")
+		cmd.Dir = t.TempDir()
+		output, err := cmd.CombinedOutput()
+		require.Error(t, err)
+		assert.Contains(t, string(output), "invalid proxy spec")
+	})
+
+	t.Run("resolve prints service addresses from services.json", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		createCmd := exec.Command(cliBinary, "create", "--json")
+		createCmd.Dir = tmpDir
+		createOutput, err := createCmd.Output()
+		require.NoError(t, err)
+
+		var result struct {
+			IsolationID  string `json:"isolation_id"`
+			ServicesFile string `json:"services_file"`
+		}
+		require.NoError(t, json.Unmarshal(createOutput, &result))
+		defer func() {
+			_ = exec.Command(cliBinary, "cleanup", "--id", result.IsolationID).Run()
+		}()
+
+		data, err := os.ReadFile(result.ServicesFile)
+		require.NoError(t, err)
+		var services map[string]string
+		require.NoError(t, json.Unmarshal(data, &services))
+
+		output, err := exec.Command(cliBinary, "resolve", "--id", result.IsolationID, "api").Output()
+		require.NoError(t, err)
+		assert.Equal(t, services["api"], strings.TrimSpace(string(output)))
+
+		output, err = exec.Command(cliBinary, "resolve", "--id", result.IsolationID, "api", "--port").Output()
+		require.NoError(t, err)
+		assert.True(t, strings.HasSuffix(services["api"], ":"+strings.TrimSpace(string(output))))
+
+		assert.Error(t, exec.Command(cliBinary, "resolve", "--id", result.IsolationID, "nope").Run())
+	})
+
+	t.Run("create --profile applies named ports and variables", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		configFile := filepath.Join(tmpDir, "config.json")
+		configJSON := `{"profiles": {"firebase": {
+			"ports": ["FIRESTORE_PORT", "AUTH_PORT", "STORAGE_PORT"],
+			"vars": {"FIRESTORE_EMULATOR_HOST": "127.0.0.1:${FIRESTORE_PORT}"}
+		}}}`
+		require.NoError(t, os.WriteFile(configFile, []byte(configJSON), 0o600))
+
+		cmd := exec.Command(cliBinary, "create", "--shell", "--ports", "1", "--profile", "firebase", "--config", configFile)
+		cmd.Dir = tmpDir
+		output, err := cmd.Output()
+		require.NoError(t, err)
+
+		vars := map[string]string{}
+		for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+			name, value, _ := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+			vars[name] = value
+		}
+		defer func() {
+			_ = exec.Command(cliBinary, "cleanup", "--id", vars["ISOLATION_ID"]).Run()
+		}()
+
+		assert.Equal(t, "3", vars["PORT_COUNT"])
+		assert.NotEmpty(t, vars["STORAGE_PORT"])
+		assert.Equal(t, "127.0.0.1:"+vars["FIRESTORE_PORT"], vars["FIRESTORE_EMULATOR_HOST"])
+
+		cmd = exec.Command(cliBinary, "create", "--profile", "missing", "--config", configFile)
+		cmd.Dir = tmpDir
+		output, err = cmd.CombinedOutput()
+		require.Error(t, err)
+		assert.Contains(t, string(output), "unknown profile")
+	})
+
+	t.Run("rewrite-compose publishes allocated ports", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		composeFile := filepath.Join(tmpDir, "docker-compose.yml")
+		require.NoError(t, os.WriteFile(composeFile, []byte("services:\n  api:\n    ports:\n      - \"8080:80\"\n"), 0o644))
+
+		createCmd := exec.Command(cliBinary, "create", "--json", "--ports", "2")
+		createCmd.Dir = tmpDir
+		createOutput, err := createCmd.Output()
+		require.NoError(t, err)
+
+		var result struct {
+			IsolationID string `json:"isolation_id"`
+			Ports       struct {
+				Ports []int `json:"ports"`
+			} `json:"ports"`
+		}
+		require.NoError(t, json.Unmarshal(createOutput, &result))
+		defer func() {
+			_ = exec.Command(cliBinary, "cleanup", "--id", result.IsolationID).Run()
+		}()
+
+		outFile := filepath.Join(tmpDir, "out.yml")
+		cmd := exec.Command(cliBinary, "rewrite-compose", "--id", result.IsolationID, "-f", composeFile, "-o", outFile)
+		output, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(output))
+
+		rewritten, err := os.ReadFile(outFile)
+		require.NoError(t, err)
+		assert.Contains(t, string(rewritten), fmt.Sprintf("%d:80", result.Ports.Ports[0]))
+
+		inspectOutput, err := exec.Command(cliBinary, "inspect", "--id", result.IsolationID, "--json").Output()
+		require.NoError(t, err)
+		var inspected struct {
+			ComposePorts []struct {
+				Service string `json:"service"`
+				Port    int    `json:"port"`
+			} `json:"compose_ports"`
+		}
+		require.NoError(t, json.Unmarshal(inspectOutput, &inspected))
+		require.Len(t, inspected.ComposePorts, 1)
+		assert.Equal(t, "api", inspected.ComposePorts[0].Service)
+		assert.Equal(t, result.Ports.Ports[0], inspected.ComposePorts[0].Port)
+	})
+
+	t.Run("render executes templates with environment values", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		createCmd := exec.Command(cliBinary, "create", "--json")
+		createCmd.Dir = tmpDir
+		createOutput, err := createCmd.Output()
+		require.NoError(t, err)
+
+		var result struct {
+			IsolationID string `json:"isolation_id"`
+			TempDir     string `json:"temp_dir"`
+			Ports       struct {
+				Ports []int `json:"ports"`
+			} `json:"ports"`
+		}
+		require.NoError(t, json.Unmarshal(createOutput, &result))
+		defer func() {
+			_ = exec.Command(cliBinary, "cleanup", "--id", result.IsolationID).Run()
+		}()
+
+		tmplFile := filepath.Join(tmpDir, "nginx.conf.tmpl")
+		require.NoError(t, os.WriteFile(tmplFile, []byte("listen {{.API_PORT}}; root {{.TEMP_DIR}}; auth {{.Services.auth}};\n"), 0o644))
+
+		outFile := filepath.Join(tmpDir, "nginx.conf")
+		output, err := exec.Command(cliBinary, "render", "--id", result.IsolationID, tmplFile, "-o", outFile).CombinedOutput()
+		require.NoError(t, err, string(output))
+
+		rendered, err := os.ReadFile(outFile)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("listen %d; root %s; auth 127.0.0.1:%d;\n",
+			result.Ports.Ports[2], result.TempDir, result.Ports.Ports[1]), string(rendered))
+
+		// Unknown variables are an error
+		badFile := filepath.Join(tmpDir, "bad.tmpl")
+		require.NoError(t, os.WriteFile(badFile, []byte("{{.NOPE}}"), 0o644))
+		assert.Error(t, exec.Command(cliBinary, "render", "--id", result.IsolationID, badFile).Run())
+	})
+
+	t.Run("hooks run on create and cleanup", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		hooksDir := filepath.Join(tmpDir, ".portalloc", "hooks")
+		require.NoError(t, os.MkdirAll(hooksDir, 0o755))
+
+		markerFile := filepath.Join(tmpDir, "hooks.log")
+		postCreate := "#!/bin/sh\necho \"$PORTALLOC_HOOK $ISOLATION_ID $API_PORT\" >> " + markerFile + "\n"
+		preCleanup := "#!/bin/sh\necho \"$PORTALLOC_HOOK $ISOLATION_ID\" >> " + markerFile + "\n"
+		require.NoError(t, os.WriteFile(filepath.Join(hooksDir, "post-create"), []byte(postCreate), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(hooksDir, "pre-cleanup"), []byte(preCleanup), 0o755))
+
+		createCmd := exec.Command(cliBinary, "create", "--json", "--no-env-file")
+		createCmd.Dir = tmpDir
+		createOutput, err := createCmd.Output()
+		require.NoError(t, err)
+
+		var result struct {
+			IsolationID string `json:"isolation_id"`
+			Ports       struct {
+				Ports []int `json:"ports"`
+			} `json:"ports"`
+		}
+		require.NoError(t, json.Unmarshal(createOutput, &result))
+
+		cleanupCmd := exec.Command(cliBinary, "cleanup", "--id", result.IsolationID)
+		cleanupCmd.Dir = tmpDir
+		require.NoError(t, cleanupCmd.Run())
+
+		log, err := os.ReadFile(markerFile)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("post-create %s %d\npre-cleanup %s\n",
+			result.IsolationID, result.Ports.Ports[2], result.IsolationID), string(log))
+
+		// A failing post-create hook aborts creation and removes the environment
+		require.NoError(t, os.WriteFile(filepath.Join(hooksDir, "post-create"), []byte("#!/bin/sh\nexit 3\n"), 0o755))
+		failCmd := exec.Command(cliBinary, "create", "--json", "--no-env-file")
+		failCmd.Dir = tmpDir
+		output, err := failCmd.CombinedOutput()
+		require.Error(t, err)
+		assert.Contains(t, string(output), "post-create hook failed")
+
+		// --no-hooks skips them
+		skipCmd := exec.Command(cliBinary, "create", "--json", "--no-env-file", "--no-hooks")
+		skipCmd.Dir = tmpDir
+		skipOutput, err := skipCmd.Output()
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(skipOutput, &result))
+		_ = exec.Command(cliBinary, "cleanup", "--id", result.IsolationID, "--no-hooks").Run()
+	})
+
+	t.Run("json logs go to stderr", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		createCmd := exec.Command(cliBinary, "create", "--json", "--no-env-file")
+		createCmd.Dir = tmpDir
+		createCmd.Env = append(os.Environ(), "PORTALLOC_LOG_FORMAT=json")
+		var stderr bytes.Buffer
+		createCmd.Stderr = &stderr
+		createOutput, err := createCmd.Output()
+		require.NoError(t, err)
+
+		// stdout still holds only the command output
+		var result struct {
+			IsolationID string `json:"isolation_id"`
+		}
+		require.NoError(t, json.Unmarshal(createOutput, &result))
+		defer func() {
+			_ = exec.Command(cliBinary, "cleanup", "--id", result.IsolationID).Run()
+		}()
+
+		var entry struct {
+			Level       string `json:"level"`
+			Msg         string `json:"msg"`
+			IsolationID string `json:"isolation_id"`
+			Ports       []int  `json:"ports"`
+			Duration    int64  `json:"duration"`
+		}
+		require.NoError(t, json.Unmarshal(stderr.Bytes(), &entry), stderr.String())
+		assert.Equal(t, "INFO", entry.Level)
+		assert.Equal(t, "environment created", entry.Msg)
+		assert.Equal(t, result.IsolationID, entry.IsolationID)
+		assert.Len(t, entry.Ports, 5)
+		assert.Positive(t, entry.Duration)
+
+		// The flag takes precedence over the environment variable
+		listCmd := exec.Command(cliBinary, "list", "--log-format", "bogus")
+		listCmd.Env = append(os.Environ(), "PORTALLOC_LOG_FORMAT=json")
+		output, err := listCmd.CombinedOutput()
+		require.Error(t, err)
+		assert.Contains(t, string(output), "unknown log format: bogus")
+	})
+
+	t.Run("docs generates man pages and markdown", func(t *testing.T) {
+		outDir := t.TempDir()
+
+		output, err := exec.Command(cliBinary, "docs", "man", "--out", filepath.Join(outDir, "man")).CombinedOutput()
+		require.NoError(t, err, string(output))
+		assert.FileExists(t, filepath.Join(outDir, "man", "go-portalloc.1"))
+		assert.FileExists(t, filepath.Join(outDir, "man", "go-portalloc-create.1"))
+
+		output, err = exec.Command(cliBinary, "docs", "markdown", "--out", filepath.Join(outDir, "md")).CombinedOutput()
+		require.NoError(t, err, string(output))
+		createDoc, err := os.ReadFile(filepath.Join(outDir, "md", "go-portalloc_create.md"))
+		require.NoError(t, err)
+		assert.Contains(t, string(createDoc), "--ports")
+
+		// The docs command itself is hidden
+		help, err := exec.Command(cliBinary, "--help").Output()
+		require.NoError(t, err)
+		assert.NotContains(t, string(help), "docs")
+	})
+
+	t.Run("create rolls back when interrupted", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		hooksDir := filepath.Join(tmpDir, ".portalloc", "hooks")
+		require.NoError(t, os.MkdirAll(hooksDir, 0o755))
+
+		// The hook records the environment, then blocks until killed
+		markerFile := filepath.Join(tmpDir, "created")
+		hook := "#!/bin/sh\necho \"$ISOLATION_ID $TEMP_DIR\" > " + markerFile + ".tmp\nmv " + markerFile + ".tmp " + markerFile + "\nexec sleep 30\n"
+		require.NoError(t, os.WriteFile(filepath.Join(hooksDir, "post-create"), []byte(hook), 0o755))
+
+		createCmd := exec.Command(cliBinary, "create", "--json")
+		createCmd.Dir = tmpDir
+		require.NoError(t, createCmd.Start())
+
+		var marker []byte
+		require.Eventually(t, func() bool {
+			var err error
+			marker, err = os.ReadFile(markerFile)
+			return err == nil
+		}, 10*time.Second, 20*time.Millisecond)
+
+		fields := strings.Fields(string(marker))
+		require.Len(t, fields, 2)
+		isolationID, tempDir := fields[0], fields[1]
+		lockFile := filepath.Join(os.TempDir(), "go-portalloc-locks", fmt.Sprintf("env-%s.lock", isolationID))
+		assert.FileExists(t, lockFile)
+
+		start := time.Now()
+		require.NoError(t, createCmd.Process.Signal(syscall.SIGTERM))
+		err := createCmd.Wait()
+		require.Error(t, err)
+		assert.Less(t, time.Since(start), 10*time.Second)
+
+		assert.NoFileExists(t, lockFile)
+		assert.NoDirExists(t, tempDir)
+		assert.NoFileExists(t, filepath.Join(tmpDir, ".env.isolation"))
+
+		listOutput, err := exec.Command(cliBinary, "list", "--format", "json").Output()
+		require.NoError(t, err)
+		assert.NotContains(t, string(listOutput), isolationID)
+	})
+
+	t.Run("run rolls back when interrupted during a hook", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		hooksDir := filepath.Join(tmpDir, ".portalloc", "hooks")
+		require.NoError(t, os.MkdirAll(hooksDir, 0o755))
+
+		// The hook records the environment, then blocks until killed
+		markerFile := filepath.Join(tmpDir, "created")
+		hook := "#!/bin/sh\necho \"$ISOLATION_ID $TEMP_DIR\" > " + markerFile + ".tmp\nmv " + markerFile + ".tmp " + markerFile + "\nexec sleep 30\n"
+		require.NoError(t, os.WriteFile(filepath.Join(hooksDir, "post-create"), []byte(hook), 0o755))
+
+		runCmd := exec.Command(cliBinary, "run", "--", "true")
+		runCmd.Dir = tmpDir
+		require.NoError(t, runCmd.Start())
+
+		var marker []byte
+		require.Eventually(t, func() bool {
+			var err error
+			marker, err = os.ReadFile(markerFile)
+			return err == nil
+		}, 10*time.Second, 20*time.Millisecond)
+
+		fields := strings.Fields(string(marker))
+		require.Len(t, fields, 2)
+		isolationID, tempDir := fields[0], fields[1]
+		lockFile := filepath.Join(os.TempDir(), "go-portalloc-locks", fmt.Sprintf("env-%s.lock", isolationID))
+		assert.FileExists(t, lockFile)
+
+		start := time.Now()
+		require.NoError(t, runCmd.Process.Signal(syscall.SIGINT))
+		err := runCmd.Wait()
+		require.Error(t, err)
+		assert.Less(t, time.Since(start), 10*time.Second)
+
+		assert.NoFileExists(t, lockFile)
+		assert.NoDirExists(t, tempDir)
+
+		listOutput, err := exec.Command(cliBinary, "list", "--format", "json").Output()
+		require.NoError(t, err)
+		assert.NotContains(t, string(listOutput), isolationID)
+	})
+
+	t.Run("restore downloads snapshot", func(t *testing.T) {
+		var mu sync.Mutex
+		objects := map[string][]byte{}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			if r.Method == http.MethodPut {
+				objects[r.URL.Path], _ = io.ReadAll(r.Body)
+				return
+			}
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				http.Error(w, "NoSuchKey", http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write(data)
+		}))
+		defer srv.Close()
+
+		client := &snapshot.Client{Endpoint: srv.URL, Region: "us-east-1", AccessKeyID: "k", SecretAccessKey: "s"}
+		loc, err := snapshot.ParseLocation("s3://audit/ci")
+		require.NoError(t, err)
+		st := &state.State{Version: state.CurrentVersion, Environments: []*state.EnvironmentState{{ID: "snapshotted1"}}}
+		_, err = snapshot.Upload(t.Context(), client, loc, "runner-9", st, time.Now())
+		require.NoError(t, err)
+
+		cmd := exec.Command(cliBinary, "restore", "--from", "s3://audit/ci", "--host", "runner-9", "--output", "-")
+		cmd.Env = append(os.Environ(), "PORTALLOC_S3_ENDPOINT="+srv.URL, "AWS_ACCESS_KEY_ID=k", "AWS_SECRET_ACCESS_KEY=s")
+		output, err := cmd.Output()
+		require.NoError(t, err)
+
+		var restored state.State
+		require.NoError(t, json.Unmarshal(output, &restored))
+		require.Len(t, restored.Environments, 1)
+		assert.Equal(t, "snapshotted1", restored.Environments[0].ID)
+	})
+
+	t.Run("mcp creates, lists, and cleans up environments", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		call := func(id int, tool string, args map[string]interface{}) string {
+			req, err := json.Marshal(map[string]interface{}{
+				"jsonrpc": "2.0", "id": id, "method": "tools/call",
+				"params": map[string]interface{}{"name": tool, "arguments": args},
+			})
+			require.NoError(t, err)
+			return string(req) + "\n"
+		}
+
+		// The ID is unknown until create returns, so run two sessions
+		cmd := exec.Command(cliBinary, "mcp")
+		cmd.Stdin = strings.NewReader(`{"jsonrpc":"2.0","id":0,"method":"initialize","params":{}}` + "\n" +
+			call(1, "create_environment", map[string]interface{}{"ports": 3, "worktree_path": tmpDir}) +
+			call(2, "allocate_ports", map[string]interface{}{"count": 2}))
+		output, err := cmd.Output()
+		require.NoError(t, err)
+
+		type toolResponse struct {
+			Result struct {
+				Content []struct {
+					Text string `json:"text"`
+				} `json:"content"`
+				IsError bool `json:"isError"`
+			} `json:"result"`
+		}
+		decode := func(line string) string {
+			var resp toolResponse
+			require.NoError(t, json.Unmarshal([]byte(line), &resp))
+			require.False(t, resp.Result.IsError, line)
+			return resp.Result.Content[0].Text
+		}
+
+		lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+		require.Len(t, lines, 3)
+
+		var created createOutput
+		require.NoError(t, json.Unmarshal([]byte(decode(lines[1])), &created))
+		assert.Equal(t, 3, created.Ports.Count)
+		assert.FileExists(t, created.LockFile)
+		assert.FileExists(t, filepath.Join(tmpDir, ".env.isolation"))
+
+		var allocated struct {
+			Ports []int `json:"ports"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(decode(lines[2])), &allocated))
+		assert.Len(t, allocated.Ports, 2)
+
+		cmd = exec.Command(cliBinary, "mcp")
+		cmd.Stdin = strings.NewReader(call(3, "list_environments", nil) +
+			call(4, "cleanup_environment", map[string]interface{}{"id": created.IsolationID}))
+		output, err = cmd.Output()
+		require.NoError(t, err)
+
+		lines = strings.Split(strings.TrimSpace(string(output)), "\n")
+		require.Len(t, lines, 2)
+		assert.Contains(t, decode(lines[0]), created.IsolationID)
+		decode(lines[1])
+		assert.NoFileExists(t, created.LockFile)
+		assert.NoFileExists(t, filepath.Join(tmpDir, ".env.isolation"))
+	})
+
+	t.Run("list probe counts bound ports", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		createCmd := exec.Command(cliBinary, "create", "--json", "--ports", "2")
+		createCmd.Dir = tmpDir
+		createOutput, err := createCmd.Output()
+		require.NoError(t, err)
+
+		var created struct {
+			ID    string `json:"isolation_id"`
+			Ports struct {
+				BasePort int `json:"base_port"`
+			} `json:"ports"`
+		}
+		require.NoError(t, json.Unmarshal(createOutput, &created))
+		defer exec.Command(cliBinary, "cleanup", "--id", created.ID).Run()
+
+		// Bind one of the two allocated ports
+		listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", created.Ports.BasePort))
+		require.NoError(t, err)
+		defer listener.Close()
+
+		// The environment belongs to tmpDir's project, not this repository's
+		tableOutput, err := exec.Command(cliBinary, "list", "--probe", "--all-projects").Output()
+		require.NoError(t, err)
+		assert.Contains(t, string(tableOutput), "BOUND")
+		assert.Contains(t, string(tableOutput), "1/2 bound")
+
+		jsonOutput, err := exec.Command(cliBinary, "list", "--probe", "--all-projects", "--format", "json").Output()
+		require.NoError(t, err)
+		var entries []listOutputEntry
+		require.NoError(t, json.Unmarshal(jsonOutput, &entries))
+		for _, entry := range entries {
+			if entry.ID == created.ID {
+				require.NotNil(t, entry.Ports.Bound)
+				assert.Equal(t, 1, *entry.Ports.Bound)
+				return
+			}
+		}
+		t.Fatalf("environment %s not listed", created.ID)
+	})
+
+	t.Run("reconcile prune-dead removes dead environments", func(t *testing.T) {
+		home := t.TempDir()
+		lockDir := t.TempDir()
+		worktree := t.TempDir()
+
+		id := fmt.Sprintf("prunedead%d", time.Now().UnixNano()%1000000)
+		lockFile := filepath.Join(lockDir, "env-"+id+".lock")
+		tmpDir := filepath.Join(os.TempDir(), "aigis-test-"+id)
+		require.NoError(t, os.MkdirAll(tmpDir, 0o750))
+		defer os.RemoveAll(tmpDir)
+		lock := fmt.Sprintf("PID=999999\nTimestamp=%d\nWorktree=%s\n", time.Now().Add(-2*time.Hour).Unix(), worktree)
+		require.NoError(t, os.WriteFile(lockFile, []byte(lock), 0o600))
+
+		env := append(os.Environ(), "HOME="+home)
+
+		// Younger than max_lock_age, the default threshold: kept
+		stdout, stderr, err := runCLI(t, "", env, "reconcile", "--lock-dir", lockDir, "--prune-dead")
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stdout, "Found 1 active")
+		assert.FileExists(t, lockFile)
+
+		// Younger than the threshold: kept
+		stdout, stderr, err = runCLI(t, "", env, "reconcile", "--lock-dir", lockDir, "--prune-dead", "--older-than", "3h")
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stdout, "Found 1 active")
+		assert.FileExists(t, lockFile)
+
+		stdout, stderr, err = runCLI(t, "", env, "reconcile", "--lock-dir", lockDir, "--prune-dead", "--older-than", "1h")
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stdout, "Pruned: "+id)
+		assert.Contains(t, stdout, "Found 0 active")
+		assert.NoFileExists(t, lockFile)
+		assert.NoDirExists(t, tmpDir)
+	})
+
+	t.Run("retention policy reaps on create and prune", func(t *testing.T) {
+		home := t.TempDir()
+		stateDir := filepath.Join(home, ".go-portalloc")
+		require.NoError(t, os.MkdirAll(stateDir, 0o750))
+
+		stale := func(id string, age time.Duration) *state.EnvironmentState {
+			return &state.EnvironmentState{
+				ID:        id,
+				PID:       999999,
+				CreatedAt: time.Now().Add(-age),
+				TempDir:   filepath.Join(t.TempDir(), id),
+				Ports:     &state.PortsState{},
+			}
+		}
+		require.NoError(t, state.NewManagerAt(filepath.Join(stateDir, "state.json")).Restore(&state.State{
+			Version:      state.CurrentVersion,
+			Environments: []*state.EnvironmentState{stale("retained-old", 48*time.Hour), stale("retained-new", time.Hour)},
+		}))
+
+		writeConfig := func(retention string) string {
+			path := filepath.Join(t.TempDir(), "config.json")
+			require.NoError(t, os.WriteFile(path, []byte(`{"retention": `+retention+`}`), 0o600))
+			return path
+		}
+		env := append(os.Environ(), "HOME="+home)
+
+		// At the quota, create makes room by removing the oldest stale environment
+		quota := writeConfig(`{"max_environments": 2}`)
+		stdout, stderr, err := runCLI(t, "", env, "create", "--json", "--no-env-file", "--config", quota)
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stderr, "Retention: removed retained-old")
+		var created map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(stdout), &created), "stdout must stay machine-readable")
+		defer func() { _, _, _ = runCLI(t, "", env, "cleanup", "--id", created["isolation_id"].(string)) }()
+
+		// The fresh environment's create process has exited, but it is
+		// younger than max_lock_age: the next create must not reap it
+		stdout, stderr, err = runCLI(t, "", env, "create", "--json", "--no-env-file", "--config", quota)
+		require.NoError(t, err, stderr)
+		assert.NotContains(t, stderr, "Retention: removed")
+		assert.Contains(t, stderr, "at or over retention max_environments")
+		assert.FileExists(t, created["lock_file"].(string))
+		var second map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(stdout), &second))
+		defer func() { _, _, _ = runCLI(t, "", env, "cleanup", "--id", second["isolation_id"].(string)) }()
+
+		// prune reconciles from locks, then enforces reap_stale without --max-disk
+		lockDir := t.TempDir()
+		lockFile := filepath.Join(lockDir, "env-retained-lock.lock")
+		lock := fmt.Sprintf("PID=999999\nTimestamp=%d\nWorktree=%s\n", time.Now().Add(-48*time.Hour).Unix(), t.TempDir())
+		require.NoError(t, os.WriteFile(lockFile, []byte(lock), 0o600))
+
+		reap := writeConfig(`{"reap_stale": true}`)
+
+		// A dry run writes nothing, not even the reconciled state
+		before, err := os.ReadFile(filepath.Join(stateDir, "state.json"))
+		require.NoError(t, err)
+		stdout, stderr, err = runCLI(t, "", env, "prune", "--lock-dir", lockDir, "--dry-run", "--config", reap)
+		require.NoError(t, err, stderr)
+		assert.NotContains(t, stdout, "Retention: removed")
+		after, err := os.ReadFile(filepath.Join(stateDir, "state.json"))
+		require.NoError(t, err)
+		assert.Equal(t, string(before), string(after))
+		assert.FileExists(t, lockFile)
+
+		stdout, stderr, err = runCLI(t, "", env, "prune", "--lock-dir", lockDir, "--config", reap)
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stdout, "Retention: removed retained-lock")
+		assert.NoFileExists(t, lockFile)
+		assert.NotContains(t, stdout, created["isolation_id"].(string))
+	})
+
+	t.Run("names identify environments in place of IDs", func(t *testing.T) {
+		home := t.TempDir()
+		name := fmt.Sprintf("named-%d", time.Now().UnixNano())
+		env := append(os.Environ(), "HOME="+home)
+
+		stdout, stderr, err := runCLI(t, "", env, "create", "--name", name, "--json", "--no-env-file")
+		require.NoError(t, err, stderr)
+		var created map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(stdout), &created))
+		assert.Equal(t, name, created["name"])
+		id := created["isolation_id"].(string)
+		defer func() { _, _, _ = runCLI(t, "", env, "cleanup", "--id", id) }()
+
+		_, stderr, err = runCLI(t, "", env, "create", "--name", name, "--no-env-file")
+		require.Error(t, err)
+		assert.Contains(t, stderr, "already in use")
+
+		_, stderr, err = runCLI(t, "", env, "create", "--name", "Not Valid", "--no-env-file")
+		require.Error(t, err)
+		assert.Contains(t, stderr, "invalid environment name")
+
+		stdout, stderr, err = runCLI(t, "", env, "inspect", "--name", name)
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stdout, id)
+		assert.Contains(t, stdout, "Name:           "+name)
+
+		stdout, stderr, err = runCLI(t, "", env, "env", "--name", name)
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stdout, "ISOLATION_ID="+id+"\n")
+		_, _, err = runCLI(t, "", env, "env")
+		assert.Error(t, err, "--id or --name is required")
+
+		_, stderr, err = runCLI(t, "", env, "cleanup", "--name", name)
+		require.NoError(t, err, stderr)
+		_, _, err = runCLI(t, "", env, "inspect", "--name", name)
+		assert.Error(t, err)
+	})
+
+	t.Run("create output writes the artifact to a file", func(t *testing.T) {
+		dir := t.TempDir()
+		outFile := filepath.Join(dir, "env.json")
+
+		stdout, stderr, err := runCLI(t, "", nil, "create", "--ports", "2", "--json", "--no-env-file", "--output", outFile)
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stderr, "Wrote "+outFile)
+		assert.Empty(t, stdout, "JSON must go to the file only")
+
+		data, err := os.ReadFile(outFile)
+		require.NoError(t, err)
+		var created map[string]interface{}
+		require.NoError(t, json.Unmarshal(data, &created))
+		defer exec.Command(cliBinary, "cleanup", "--id", created["isolation_id"].(string)).Run()
+
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Len(t, entries, 1, "no temp files may be left behind")
+
+		shFile := filepath.Join(dir, "env.sh")
+		stdout, stderr, err = runCLI(t, "", nil, "create", "--ports", "2", "--shell", "--no-env-file", "-o", shFile)
+		require.NoError(t, err, stderr)
+		assert.Empty(t, stdout)
+		data, err = os.ReadFile(shFile)
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "export ISOLATION_ID=")
+		id := strings.TrimPrefix(strings.SplitN(string(data), "\n", 2)[0], "export ISOLATION_ID=")
+		defer exec.Command(cliBinary, "cleanup", "--id", id).Run()
+
+		_, stderr, err = runCLI(t, "", nil, "create", "--output", outFile)
+		require.Error(t, err)
+		assert.Contains(t, stderr, "--output requires --json or --shell")
+	})
+
+	t.Run("exit codes classify failures", func(t *testing.T) {
+		home := t.TempDir()
+		env := append(os.Environ(), "HOME="+home)
+		exitCode := func(args ...string) int {
+			_, _, err := runCLI(t, "", env, args...)
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				return exitErr.ExitCode()
+			}
+			require.NoError(t, err)
+			return 0
+		}
+
+		assert.Equal(t, 2, exitCode("create", "--no-such-flag"), "unknown flag")
+		assert.Equal(t, 2, exitCode("inspect"), "missing required flag")
+		assert.Equal(t, 2, exitCode("run", "--copies", "0", "true"), "invalid flag value")
+		assert.Equal(t, 5, exitCode("inspect", "--id", "does-not-exist"))
+		assert.Equal(t, 5, exitCode("validate", "--id", "does-not-exist"))
+
+		require.NoError(t, os.MkdirAll(filepath.Join(home, ".go-portalloc"), 0o750))
+		require.NoError(t, os.WriteFile(filepath.Join(home, ".go-portalloc", "state.json"), []byte("{not json"), 0o600))
+		assert.Equal(t, 6, exitCode("inspect", "--id", "anything"))
+	})
+
+	t.Run("PORTALLOC environment variables configure defaults", func(t *testing.T) {
+		lockDir := t.TempDir()
+		stateDir := filepath.Join(t.TempDir(), "state")
+		env := append(os.Environ(),
+			"PORTALLOC_LOCK_DIR="+lockDir,
+			"PORTALLOC_STATE_DIR="+stateDir,
+			"PORTALLOC_PORT_RANGE=41000-41100",
+			"PORTALLOC_TEMP_PREFIX=ci-env-",
+			"PORTALLOC_DEFAULT_PORTS=3",
+		)
+
+		cmd := exec.Command(cliBinary, "create", "--json", "--no-env-file")
+		cmd.Env = env
+		output, err := cmd.Output()
+		require.NoError(t, err)
+
+		var created createOutput
+		require.NoError(t, json.Unmarshal(output, &created))
+		defer func() {
+			cmd := exec.Command(cliBinary, "cleanup", "--id", created.IsolationID)
+			cmd.Env = env
+			_ = cmd.Run()
+		}()
+
+		assert.Equal(t, filepath.Join(lockDir, "env-"+created.IsolationID+".lock"), created.LockFile)
+		assert.Equal(t, filepath.Join(os.TempDir(), "ci-env-"+created.IsolationID), created.TempDir)
+		assert.Equal(t, 3, created.Ports.Count)
+		assert.GreaterOrEqual(t, created.Ports.BasePort, 41000)
+		assert.Less(t, created.Ports.BasePort+created.Ports.Count-1, 41100)
+		assert.FileExists(t, filepath.Join(stateDir, "state.json"))
+
+		cmd = exec.Command(cliBinary, "cleanup", "--id", created.IsolationID)
+		cmd.Env = env
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+		assert.NoFileExists(t, created.LockFile)
+		assert.NoDirExists(t, created.TempDir)
+	})
+
+	t.Run("create and cleanup work without a home directory", func(t *testing.T) {
+		var env []string
+		for _, kv := range os.Environ() {
+			if !strings.HasPrefix(kv, "HOME=") && !strings.HasPrefix(kv, "PORTALLOC_STATE_DIR=") {
+				env = append(env, kv)
+			}
+		}
+
+		stdout, stderr, err := runCLI(t, "", env, "create", "--json", "--no-env-file")
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stderr, "State directory unavailable")
+		var created createOutput
+		require.NoError(t, json.Unmarshal([]byte(stdout), &created), "stdout must stay machine-readable")
+
+		// The degraded state is shared between commands
+		stdout, stderr, err = runCLI(t, "", env, "inspect", "--id", created.IsolationID)
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stdout, created.IsolationID)
+
+		_, stderr, err = runCLI(t, "", env, "cleanup", "--id", created.IsolationID)
+		require.NoError(t, err, stderr)
+		assert.NoFileExists(t, created.LockFile)
+	})
+
+	t.Run("list and cleanup are scoped to the current project", func(t *testing.T) {
+		lockDir := t.TempDir()
+		env := append(os.Environ(), "HOME="+t.TempDir(), "PORTALLOC_STATE_DIR="+t.TempDir(), "PORTALLOC_LOCK_DIR="+lockDir)
+		ids := make(map[string]string)
+		for _, project := range []string{"alpha", "beta"} {
+			stdout, stderr, err := runCLI(t, "", env, "create", "--json", "--no-env-file", "--project", project)
+			require.NoError(t, err, stderr)
+			var created createOutput
+			require.NoError(t, json.Unmarshal([]byte(stdout), &created))
+			ids[project] = created.IsolationID
+		}
+
+		stdout, stderr, err := runCLI(t, "", env, "list", "--project", "alpha")
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stdout, ids["alpha"])
+		assert.NotContains(t, stdout, ids["beta"])
+		assert.Contains(t, stdout, "1 in other projects hidden")
+
+		stdout, stderr, err = runCLI(t, "", env, "list", "--all-projects")
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stdout, ids["alpha"])
+		assert.Contains(t, stdout, ids["beta"])
+		assert.Contains(t, stdout, "PROJECT")
+
+		_, stderr, err = runCLI(t, "", env, "cleanup", "--all", "--project", "alpha")
+		require.NoError(t, err, stderr)
+		assert.NoFileExists(t, filepath.Join(lockDir, "env-"+ids["alpha"]+".lock"))
+		assert.FileExists(t, filepath.Join(lockDir, "env-"+ids["beta"]+".lock"))
+
+		_, stderr, err = runCLI(t, "", env, "cleanup", "--all", "--all-projects")
+		require.NoError(t, err, stderr)
+		assert.NoFileExists(t, filepath.Join(lockDir, "env-"+ids["beta"]+".lock"))
+	})
+
+	t.Run("doctor fix repairs state, config, and orphans", func(t *testing.T) {
+		home, stateDir, tmp := t.TempDir(), t.TempDir(), t.TempDir()
+		lockDir := filepath.Join(tmp, "locks")
+		env := append(os.Environ(), "HOME="+home, "TMPDIR="+tmp,
+			"PORTALLOC_STATE_DIR="+stateDir, "PORTALLOC_LOCK_DIR="+lockDir, "PORTALLOC_TEMP_PREFIX=doctor-")
+
+		require.NoError(t, os.WriteFile(filepath.Join(stateDir, "state.json"), []byte("{truncated"), 0o600))
+		configFile := filepath.Join(home, ".go-portalloc", "config.json")
+		require.NoError(t, os.MkdirAll(filepath.Dir(configFile), 0o750))
+		require.NoError(t, os.WriteFile(configFile, []byte(`{"max_lock_age": "soon"}`), 0o600))
+		orphan := filepath.Join(tmp, "doctor-abc123")
+		require.NoError(t, os.Mkdir(orphan, 0o750))
+
+		stdout, _, err := runCLI(t, "", env, "doctor")
+		require.Error(t, err, stdout)
+		assert.Contains(t, stdout, "max_lock_age")
+		assert.Contains(t, stdout, "corrupt state file")
+
+		// Without --yes, EOF on stdin declines the config rewrite
+		stdout, _, err = runCLI(t, "", env, "doctor", "--fix")
+		require.Error(t, err, stdout)
+		assert.Contains(t, stdout, "Config file left unchanged")
+		assert.FileExists(t, filepath.Join(stateDir, "state.json.bak"))
+		assert.NoDirExists(t, orphan)
+		assert.DirExists(t, lockDir)
+
+		stdout, stderr, err := runCLI(t, "", env, "doctor", "--fix", "--yes")
+		require.NoError(t, err, stdout+stderr)
+		assert.FileExists(t, configFile+".bak")
+
+		stdout, stderr, err = runCLI(t, "", env, "doctor")
+		require.NoError(t, err, stdout+stderr)
+		assert.Contains(t, stdout, "No problems found")
+	})
+
+	t.Run("compose prefix", func(t *testing.T) {
+		env := append(os.Environ(), "HOME="+t.TempDir(), "PORTALLOC_STATE_DIR="+t.TempDir(), "PORTALLOC_LOCK_DIR="+t.TempDir())
+
+		dir := t.TempDir()
+		stdout, stderr, err := runCLI(t, dir, env, "--compose-prefix", "ci-", "create", "--json")
+		require.NoError(t, err, stderr)
+		var created createOutput
+		require.NoError(t, json.Unmarshal([]byte(stdout), &created))
+		defer runCLI(t, dir, env, "cleanup", "--id", created.IsolationID)
+		assert.Equal(t, "ci-"+created.IsolationID, created.ComposeProjectName)
+
+		data, err := os.ReadFile(filepath.Join(dir, ".env.isolation"))
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "COMPOSE_PROJECT_NAME=ci-"+created.IsolationID+"\n")
+
+		// The config file applies when the flag is absent
+		configFile := filepath.Join(t.TempDir(), "config.json")
+		require.NoError(t, os.WriteFile(configFile, []byte(`{"compose_prefix": "team_"}`), 0o600))
+		other := t.TempDir()
+		stdout, stderr, err = runCLI(t, other, env, "--config", configFile, "create", "--shell")
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stdout, "export COMPOSE_PROJECT_NAME=team_")
+		assert.Equal(t, 1, strings.Count(stdout, "COMPOSE_PROJECT_NAME="))
+		defer runCLI(t, other, env, "cleanup", "--yes")
+
+		_, stderr, err = runCLI(t, "", env, "--compose-prefix", "Bad Prefix", "create")
+		require.Error(t, err)
+		assert.Contains(t, stderr, "invalid compose prefix")
+	})
+
+	t.Run("whoowns finds the environment of a port", func(t *testing.T) {
+		env := append(os.Environ(), "HOME="+t.TempDir(), "PORTALLOC_STATE_DIR="+t.TempDir(), "PORTALLOC_LOCK_DIR="+t.TempDir())
+
+		stdout, stderr, err := runCLI(t, "", env, "create", "--json", "--no-env-file", "--name", "owner")
+		require.NoError(t, err, stderr)
+		var created createOutput
+		require.NoError(t, json.Unmarshal([]byte(stdout), &created))
+		defer runCLI(t, "", env, "cleanup", "--id", created.IsolationID)
+
+		stdout, stderr, err = runCLI(t, "", env, "whoowns", strconv.Itoa(created.Ports.BasePort+2))
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stdout, "belongs to "+created.IsolationID+" (owner)")
+		assert.Contains(t, stdout, "Service:   api")
+
+		stdout, stderr, err = runCLI(t, "", env, "whoowns", strconv.Itoa(created.Ports.BasePort), "--json")
+		require.NoError(t, err, stderr)
+		var owner whoownsOutput
+		require.NoError(t, json.Unmarshal([]byte(stdout), &owner))
+		assert.Equal(t, created.IsolationID, owner.Environment.ID)
+		assert.Equal(t, "firestore", owner.Service)
+
+		_, stderr, err = runCLI(t, "", env, "whoowns", strconv.Itoa(created.Ports.BasePort+created.Ports.Count))
+		require.Error(t, err)
+		assert.Contains(t, stderr, "no environment owns port")
+	})
+
+	t.Run("create --preset allocates the preset's ports", func(t *testing.T) {
+		env := append(os.Environ(), "HOME="+t.TempDir(), "PORTALLOC_STATE_DIR="+t.TempDir(), "PORTALLOC_LOCK_DIR="+t.TempDir())
+
+		stdout, stderr, err := runCLI(t, "", env, "create", "--shell", "--no-env-file", "--preset", "kafka")
+		require.NoError(t, err, stderr)
+		vars := map[string]string{}
+		for _, line := range strings.Split(strings.TrimSpace(stdout), "\n") {
+			name, value, _ := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+			vars[name] = value
+		}
+		defer runCLI(t, "", env, "cleanup", "--id", vars["ISOLATION_ID"])
+
+		assert.Equal(t, "3", vars["PORT_COUNT"], "the preset defines the port count")
+		assert.Equal(t, "127.0.0.1:"+vars["KAFKA_PORT"], vars["KAFKA_BOOTSTRAP_SERVERS"])
+		assert.NotEmpty(t, vars["SCHEMA_REGISTRY_PORT"])
+
+		_, stderr, err = runCLI(t, "", env, "create", "--preset", "kafka", "--profile", "kafka")
+		require.Error(t, err, stderr)
+
+		// --profile keeps allocating at least the profile's ports
+		stdout, stderr, err = runCLI(t, "", env, "create", "--shell", "--no-env-file", "--profile", "kafka")
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stdout, "export PORT_COUNT=5")
+		for _, line := range strings.Split(stdout, "\n") {
+			if id, ok := strings.CutPrefix(line, "export ISOLATION_ID="); ok {
+				defer runCLI(t, "", env, "cleanup", "--id", id)
+			}
+		}
+	})
+
+	t.Run("create --count creates environments as a unit", func(t *testing.T) {
+		env := append(os.Environ(), "HOME="+t.TempDir(), "PORTALLOC_STATE_DIR="+t.TempDir(), "PORTALLOC_LOCK_DIR="+t.TempDir())
+		worktree := t.TempDir()
+
+		stdout, stderr, err := runCLI(t, worktree, env, "create", "--ports", "2", "--count", "3", "--name", "node", "--json")
+		require.NoError(t, err, stderr)
+		var created []createOutput
+		require.NoError(t, json.Unmarshal([]byte(stdout), &created), stdout)
+		require.Len(t, created, 3)
+		seen := map[int]bool{}
+		for i, c := range created {
+			defer runCLI(t, worktree, env, "cleanup", "--id", c.IsolationID)
+			assert.Equal(t, fmt.Sprintf("node-%d", i+1), c.Name)
+			assert.Equal(t, filepath.Join(worktree, isolation.EnvFileName(c.IsolationID)), c.EnvFile)
+			assert.FileExists(t, c.EnvFile)
+			for _, port := range c.Ports.Ports {
+				assert.False(t, seen[port], "port %d allocated twice", port)
+				seen[port] = true
+			}
+		}
+
+		// node-2 is taken, so the whole set is rolled back
+		_, stderr, err = runCLI(t, worktree, env, "create", "--count", "2", "--name", "node", "--env-file", ".env.retry")
+		require.Error(t, err, stderr)
+		assert.Contains(t, stderr, "environment name already in use")
+		assert.NoFileExists(t, filepath.Join(worktree, ".env.retry.1"))
+		stdout, stderr, err = runCLI(t, worktree, env, "list", "--format", "json")
+		require.NoError(t, err, stderr)
+		assert.Equal(t, 3, strings.Count(stdout, `"id"`), stdout)
+
+		_, stderr, err = runCLI(t, worktree, env, "create", "--count", "2", "--shell")
+		require.Error(t, err, stderr)
+		assert.Contains(t, stderr, "--shell cannot be used with --count")
+	})
+
+	t.Run("heartbeat records the last-used time", func(t *testing.T) {
+		env := append(os.Environ(), "HOME="+t.TempDir(), "PORTALLOC_STATE_DIR="+t.TempDir(), "PORTALLOC_LOCK_DIR="+t.TempDir())
+
+		stdout, stderr, err := runCLI(t, "", env, "create", "--json", "--no-env-file", "--name", "busy")
+		require.NoError(t, err, stderr)
+		var created createOutput
+		require.NoError(t, json.Unmarshal([]byte(stdout), &created), stdout)
+		defer runCLI(t, "", env, "cleanup", "--id", created.IsolationID)
+
+		stdout, stderr, err = runCLI(t, "", env, "inspect", "--name", "busy")
+		require.NoError(t, err, stderr)
+		assert.NotContains(t, stdout, "Last Used:")
+
+		_, stderr, err = runCLI(t, "", env, "heartbeat", "--name", "busy")
+		require.NoError(t, err, stderr)
+		stdout, stderr, err = runCLI(t, "", env, "inspect", "--name", "busy", "--json")
+		require.NoError(t, err, stderr)
+		var entry listOutputEntry
+		require.NoError(t, json.Unmarshal([]byte(stdout), &entry), stdout)
+		assert.NotEmpty(t, entry.LastUsedAt)
+
+		_, _, err = runCLI(t, "", env, "heartbeat", "--id", "missing")
+		assert.Error(t, err)
+	})
+
+	t.Run("create --id-only and port --quiet print a single bare line", func(t *testing.T) {
+		env := append(os.Environ(), "HOME="+t.TempDir(), "PORTALLOC_STATE_DIR="+t.TempDir(), "PORTALLOC_LOCK_DIR="+t.TempDir())
+
+		stdout, stderr, err := runCLI(t, "", env, "create", "--ports", "3", "--name", "quiet", "--id-only")
+		require.NoError(t, err, stderr)
+		assert.Regexp(t, `^\S+\n$`, stdout)
+		id := strings.TrimSpace(stdout)
+		t.Cleanup(func() { _, _, _ = runCLI(t, "", env, "cleanup", "--id", id) })
+
+		stdout, stderr, err = runCLI(t, "", env, "port", "--id", id, "--quiet")
+		require.NoError(t, err, stderr)
+		assert.Regexp(t, `^[0-9]+\n$`, stdout)
+		base := strings.TrimSpace(stdout)
+
+		stdout, stderr, err = runCLI(t, "", env, "port", "--name", "quiet")
+		require.NoError(t, err, stderr)
+		assert.Equal(t, "base port: "+base+"\n", stdout)
+
+		stdout, stderr, err = runCLI(t, "", env, "port", "--name", "quiet", "port1", "-q")
+		require.NoError(t, err, stderr)
+		api, err := strconv.Atoi(strings.TrimSpace(stdout))
+		require.NoError(t, err, stdout)
+		baseNum, err := strconv.Atoi(base)
+		require.NoError(t, err)
+		assert.Equal(t, baseNum+1, api)
+
+		_, _, err = runCLI(t, "", env, "port", "--name", "quiet", "nope", "-q")
+		assert.Error(t, err)
+
+		stdout, stderr, err = runCLI(t, "", env, "create", "--ports", "2", "--port-only", "--no-env-file")
+		require.NoError(t, err, stderr)
+		assert.Regexp(t, `^[0-9]+\n$`, stdout)
+		stdout, stderr, err = runCLI(t, "", env, "whoowns", strings.TrimSpace(stdout), "--json")
+		require.NoError(t, err, stderr)
+		var owner whoownsOutput
+		require.NoError(t, json.Unmarshal([]byte(stdout), &owner), stdout)
+		t.Cleanup(func() { _, _, _ = runCLI(t, "", env, "cleanup", "--id", owner.Environment.ID) })
+
+		_, _, err = runCLI(t, "", env, "create", "--id-only", "--json")
+		assert.Error(t, err)
+		_, _, err = runCLI(t, "", env, "create", "--id-only", "--count", "2")
+		assert.Error(t, err)
+	})
+
+	t.Run("inspect verifies the temp directory MANIFEST and traces stray directories", func(t *testing.T) {
+		stateDir, lockDir := t.TempDir(), t.TempDir()
+		env := append(os.Environ(), "HOME="+t.TempDir(), "PORTALLOC_STATE_DIR="+stateDir, "PORTALLOC_LOCK_DIR="+lockDir)
+
+		stdout, stderr, err := runCLI(t, "", env, "create", "--ports", "2", "--id-only", "--no-env-file")
+		require.NoError(t, err, stderr)
+		id := strings.TrimSpace(stdout)
+		defer func() { _, _, _ = runCLI(t, "", env, "cleanup", "--id", id) }()
+
+		stdout, stderr, err = runCLI(t, "", env, "inspect", "--id", id)
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stdout, "Manifest:       ok (created by ")
+
+		var inspected struct {
+			TempDir  string `json:"temp_dir"`
+			Manifest struct {
+				Status string `json:"status"`
+				PID    int    `json:"pid"`
+			} `json:"manifest"`
+		}
+		stdout, stderr, err = runCLI(t, "", env, "inspect", "--id", id, "--json")
+		require.NoError(t, err, stderr)
+		require.NoError(t, json.Unmarshal([]byte(stdout), &inspected), stdout)
+		assert.Equal(t, "ok", inspected.Manifest.Status)
+		assert.NotZero(t, inspected.Manifest.PID)
+
+		manifest, err := os.ReadFile(filepath.Join(inspected.TempDir, "MANIFEST"))
+		require.NoError(t, err)
+		assert.Contains(t, string(manifest), "ID="+id+"\n")
+
+		stdout, stderr, err = runCLI(t, "", env, "inspect", "--dir", inspected.TempDir)
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stdout, "Isolation ID:   "+id)
+
+		// Forgotten by the state file and the lock directory: only the
+		// manifest knows who created it
+		require.NoError(t, os.Remove(filepath.Join(stateDir, "state.json")))
+		require.NoError(t, os.Remove(filepath.Join(lockDir, "env-"+id+".lock")))
+		_, stderr, err = runCLI(t, "", env, "inspect", "--dir", inspected.TempDir)
+		assert.Error(t, err)
+		assert.Contains(t, stderr, "belongs to environment "+id+", created by ")
+		assert.Contains(t, stderr, "not recorded in the state file")
+		_ = os.RemoveAll(inspected.TempDir)
+	})
+
+	t.Run("--strict fails instead of silently skipping the state file", func(t *testing.T) {
+		lockDir, stateDir := t.TempDir(), t.TempDir()
+		// A directory where the state file should be: every state write fails
+		require.NoError(t, os.Mkdir(filepath.Join(stateDir, "state.json"), 0o750))
+		env := append(os.Environ(), "HOME="+t.TempDir(), "PORTALLOC_STATE_DIR="+stateDir, "PORTALLOC_LOCK_DIR="+lockDir)
+		strictEnv := append(env, "PORTALLOC_STRICT=1")
+		locks := func() []string {
+			matches, err := filepath.Glob(filepath.Join(lockDir, "env-*.lock"))
+			require.NoError(t, err)
+			return matches
+		}
+
+		stdout, stderr, err := runCLI(t, "", env, "create", "--id-only", "--no-env-file")
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stderr, "State recording skipped")
+		id := strings.TrimSpace(stdout)
+		require.Len(t, locks(), 1)
+
+		_, stderr, err = runCLI(t, "", env, "create", "--strict", "--no-env-file")
+		require.Error(t, err)
+		assert.Contains(t, stderr, "failed to record environment in state")
+		assert.Contains(t, stderr, "strict mode")
+		assert.Len(t, locks(), 1, "the environment is released when strict recording fails")
+
+		_, stderr, err = runCLI(t, "", strictEnv, "create", "--no-env-file")
+		require.Error(t, err)
+		assert.Contains(t, stderr, "strict mode")
+
+		_, stderr, err = runCLI(t, "", strictEnv, "cleanup", "--id", id)
+		require.Error(t, err, "the recorded environment cannot be read")
+		assert.Contains(t, stderr, "strict mode")
+		require.Len(t, locks(), 1)
+
+		_, stderr, err = runCLI(t, "", env, "cleanup", "--id", id)
+		require.NoError(t, err, stderr)
+		assert.Empty(t, locks())
+	})
+
+	t.Run("create skips ports from a reserved-ports file", func(t *testing.T) {
+		home := t.TempDir()
+		// The environments are left for t.TempDir to remove, temp dirs included
+		env := append(os.Environ(), "HOME="+home, "TMPDIR="+t.TempDir(), "PORTALLOC_STATE_DIR="+t.TempDir(), "PORTALLOC_LOCK_DIR="+t.TempDir())
+		createBase := func(args ...string) int {
+			stdout, stderr, err := runCLI(t, "", env, append([]string{"create", "--port-only", "--no-env-file"}, args...)...)
+			require.NoError(t, err, stderr)
+			base, err := strconv.Atoi(strings.TrimSpace(stdout))
+			require.NoError(t, err, stdout)
+			return base
+		}
+
+		lower := filepath.Join(t.TempDir(), "lower")
+		require.NoError(t, os.WriteFile(lower, []byte("# lower half\n20000-24999\n"), 0o600))
+		upper := filepath.Join(t.TempDir(), "upper")
+		require.NoError(t, os.WriteFile(upper, []byte("25000-29999\n"), 0o600))
+
+		// From the config file
+		cfgDir := filepath.Join(home, ".go-portalloc")
+		require.NoError(t, os.MkdirAll(cfgDir, 0o750))
+		require.NoError(t, os.WriteFile(filepath.Join(cfgDir, "config.json"), []byte(`{"reserved_file": "`+lower+`"}`), 0o600))
+		for i := 0; i < 5; i++ {
+			assert.GreaterOrEqual(t, createBase("--ports", "2"), 25000)
+		}
+
+		// --reserved-file overrides the config file
+		for i := 0; i < 5; i++ {
+			assert.Less(t, createBase("--ports", "2", "--reserved-file", upper), 25000)
+		}
+
+		_, stderr, err := runCLI(t, "", env, "create", "--reserved-file", filepath.Join(t.TempDir(), "missing"))
+		assert.Error(t, err)
+		assert.Contains(t, stderr, "reserved ports file")
+	})
+
+	t.Run("create --docker-network creates the network and cleanup removes it", func(t *testing.T) {
+		lockDir, binDir := t.TempDir(), t.TempDir()
+		dockerLog := filepath.Join(t.TempDir(), "docker.log")
+		// A fake docker that logs its arguments and fails while $DOCKER_FAIL is set
+		require.NoError(t, os.WriteFile(filepath.Join(binDir, "docker"), []byte(`#!/bin/sh
+echo "$*" >> "`+dockerLog+`"
+if [ -n "$DOCKER_FAIL" ]; then echo "$DOCKER_FAIL" >&2; exit 1; fi
+`), 0o700))
+		env := append(os.Environ(), "HOME="+t.TempDir(), "PORTALLOC_STATE_DIR="+t.TempDir(), "PORTALLOC_LOCK_DIR="+lockDir,
+			"PATH="+binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+		dockerCalls := func() string {
+			data, _ := os.ReadFile(dockerLog)
+			_ = os.Remove(dockerLog)
+			return string(data)
+		}
+
+		stdout, stderr, err := runCLI(t, "", env, "create", "--ports", "1", "--json")
+		require.NoError(t, err, stderr)
+		var plain createOutput
+		require.NoError(t, json.Unmarshal([]byte(stdout), &plain))
+		assert.Equal(t, "portalloc-"+plain.IsolationID, plain.DockerNetwork)
+		assert.False(t, plain.NetworkCreated)
+		assert.Empty(t, dockerCalls(), "docker is only run with --docker-network")
+		_, stderr, err = runCLI(t, "", env, "cleanup", "--id", plain.IsolationID)
+		require.NoError(t, err, stderr)
+		assert.Empty(t, dockerCalls())
+
+		stdout, stderr, err = runCLI(t, "", env, "create", "--ports", "1", "--docker-network", "--json")
+		require.NoError(t, err, stderr)
+		var created createOutput
+		require.NoError(t, json.Unmarshal([]byte(stdout), &created))
+		network := "portalloc-" + created.IsolationID
+		assert.True(t, created.NetworkCreated)
+		assert.Equal(t, "network create --label io.portalloc.isolation-id="+created.IsolationID+" "+network+"\n", dockerCalls())
+		envFile, err := os.ReadFile(created.EnvFile)
+		require.NoError(t, err)
+		assert.Contains(t, string(envFile), "DOCKER_NETWORK="+network+"\n")
+
+		stdout, stderr, err = runCLI(t, "", env, "inspect", "--id", created.IsolationID)
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stdout, "Docker Network: "+network)
+
+		// Containers still attached: the environment stays for a retry
+		_, stderr, err = runCLI(t, "", append(env, "DOCKER_FAIL=error while removing network: network "+network+" has active endpoints"), "cleanup", "--id", created.IsolationID)
+		assert.Error(t, err)
+		assert.Contains(t, stderr, "has active endpoints")
+		assert.FileExists(t, filepath.Join(lockDir, "env-"+created.IsolationID+".lock"))
+		dockerCalls()
+
+		_, stderr, err = runCLI(t, "", env, "cleanup", "--id", created.IsolationID)
+		require.NoError(t, err, stderr)
+		assert.Equal(t, "network rm "+network+"\n", dockerCalls())
+		assert.NoFileExists(t, filepath.Join(lockDir, "env-"+created.IsolationID+".lock"))
+
+		// A failed network creation rolls the environment back
+		_, stderr, err = runCLI(t, "", append(env, "DOCKER_FAIL=Cannot connect to the Docker daemon"), "create", "--docker-network")
+		assert.Error(t, err)
+		assert.Contains(t, stderr, "Cannot connect to the Docker daemon")
+		matches, err := filepath.Glob(filepath.Join(lockDir, "env-*.lock"))
+		require.NoError(t, err)
+		assert.Empty(t, matches)
+	})
+
+	t.Run("create --idempotency-key returns the environment of an earlier attempt", func(t *testing.T) {
+		lockDir := t.TempDir()
+		env := append(os.Environ(), "HOME="+t.TempDir(), "PORTALLOC_STATE_DIR="+t.TempDir(), "PORTALLOC_LOCK_DIR="+lockDir)
+		worktree := t.TempDir()
+		create := func(args ...string) (createOutput, string) {
+			stdout, stderr, err := runCLI(t, worktree, env, append([]string{"create", "--ports", "2", "--json"}, args...)...)
+			require.NoError(t, err, stderr)
+			var out createOutput
+			require.NoError(t, json.Unmarshal([]byte(stdout), &out), stdout)
+			return out, stderr
+		}
+
+		first, _ := create("--idempotency-key", "job-42")
+		assert.False(t, first.Reused)
+		assert.Equal(t, "job-42", first.IdempotencyKey)
+
+		retry, stderr := create("--idempotency-key", "job-42")
+		assert.True(t, retry.Reused)
+		assert.Contains(t, stderr, "Reusing environment "+first.IsolationID)
+		assert.Equal(t, first.IsolationID, retry.IsolationID)
+		assert.Equal(t, first.Ports, retry.Ports)
+
+		other, _ := create("--idempotency-key", "job-43")
+		assert.NotEqual(t, first.IsolationID, other.IsolationID)
+
+		stdout, _, err := runCLI(t, worktree, env, "inspect", "--id", first.IsolationID)
+		require.NoError(t, err)
+		assert.Contains(t, stdout, "Idempotency Key: job-42")
+
+		_, stderr, err = runCLI(t, worktree, env, "create", "--ports", "3", "--idempotency-key", "job-42")
+		assert.Error(t, err)
+		assert.Contains(t, stderr, "belongs to environment "+first.IsolationID+" with 2 port(s), not 3")
+
+		// Once cleaned up, the key allocates a new environment
+		_, stderr, err = runCLI(t, worktree, env, "cleanup", "--id", first.IsolationID)
+		require.NoError(t, err, stderr)
+		again, _ := create("--idempotency-key", "job-42")
+		assert.False(t, again.Reused)
+		assert.NotEqual(t, first.IsolationID, again.IsolationID)
+
+		matches, err := filepath.Glob(filepath.Join(lockDir, "env-*.lock"))
+		require.NoError(t, err)
+		assert.Len(t, matches, 2)
+
+		for _, id := range []string{other.IsolationID, again.IsolationID} {
+			_, stderr, err = runCLI(t, worktree, env, "cleanup", "--id", id)
+			require.NoError(t, err, stderr)
+		}
+	})
+
+	t.Run("create warns or refuses over --max-utilization", func(t *testing.T) {
+		home := t.TempDir()
+		// The environments are left for t.TempDir to remove, temp dirs included
+		env := append(os.Environ(), "HOME="+home, "TMPDIR="+t.TempDir(), "PORTALLOC_STATE_DIR="+t.TempDir(), "PORTALLOC_LOCK_DIR="+t.TempDir(),
+			"PORTALLOC_PORT_RANGE=46200-46210")
+
+		_, stderr, err := runCLI(t, "", env, "create", "--ports", "5", "--no-env-file", "--max-utilization", "40", "--utilization-action", "refuse")
+		require.NoError(t, err, stderr)
+		assert.NotContains(t, stderr, "port range")
+
+		// Half the range is now registered
+		_, stderr, err = runCLI(t, "", env, "create", "--ports", "3", "--no-env-file", "--max-utilization", "40")
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stderr, "port range 46200-46210 is 50% used (5 of 10 ports busy or registered, limit 40%)")
+		assert.Contains(t, stderr, "go-portalloc stats")
+
+		// The config file's action applies without the flag
+		require.NoError(t, os.MkdirAll(filepath.Join(home, ".go-portalloc"), 0o750))
+		require.NoError(t, os.WriteFile(filepath.Join(home, ".go-portalloc", "config.json"),
+			[]byte(`{"utilization": {"max_percent": 45, "action": "refuse"}}`), 0o600))
+		_, stderr, err = runCLI(t, "", env, "create", "--ports", "1", "--no-env-file")
+		var exitErr *exec.ExitError
+		require.ErrorAs(t, err, &exitErr, stderr)
+		assert.Equal(t, 3, exitErr.ExitCode())
+		assert.Contains(t, stderr, "limit 45%")
+
+		_, stderr, err = runCLI(t, "", env, "create", "--ports", "1", "--no-env-file", "--utilization-action", "block")
+		require.ErrorAs(t, err, &exitErr)
+		assert.Equal(t, 2, exitErr.ExitCode(), stderr)
+	})
+
+	t.Run("environments of one worktree keep their own env files", func(t *testing.T) {
+		env := append(os.Environ(), "HOME="+t.TempDir(), "PORTALLOC_STATE_DIR="+t.TempDir(), "PORTALLOC_LOCK_DIR="+t.TempDir())
+		worktree := t.TempDir()
+		create := func() createOutput {
+			stdout, stderr, err := runCLI(t, worktree, env, "create", "--ports", "2", "--json")
+			require.NoError(t, err, stderr)
+			var created createOutput
+			require.NoError(t, json.Unmarshal([]byte(stdout), &created), stdout)
+			return created
+		}
+		link := filepath.Join(worktree, isolation.DefaultEnvFileName)
+
+		first, second := create(), create()
+		defer runCLI(t, worktree, env, "cleanup", "--id", first.IsolationID)
+		defer runCLI(t, worktree, env, "cleanup", "--id", second.IsolationID)
+		assert.Equal(t, filepath.Join(worktree, isolation.EnvFileName(first.IsolationID)), first.EnvFile)
+		assert.Equal(t, filepath.Join(worktree, isolation.EnvFileName(second.IsolationID)), second.EnvFile)
+		target, err := os.Readlink(link)
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Base(second.EnvFile), target)
+
+		stdout, stderr, err := runCLI(t, worktree, env, "validate")
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stdout, first.IsolationID)
+		assert.Contains(t, stdout, second.IsolationID)
+
+		// Cleaning up the latest environment relinks to the remaining one
+		_, stderr, err = runCLI(t, worktree, env, "cleanup", "--id", second.IsolationID)
+		require.NoError(t, err, stderr)
+		assert.NoFileExists(t, second.EnvFile)
+		assert.FileExists(t, first.EnvFile)
+		target, err = os.Readlink(link)
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Base(first.EnvFile), target)
+
+		_, stderr, err = runCLI(t, worktree, env, "cleanup", "--id", first.IsolationID)
+		require.NoError(t, err, stderr)
+		_, err = os.Lstat(link)
+		assert.True(t, os.IsNotExist(err))
+
+		_, stderr, err = runCLI(t, worktree, env, "validate")
+		require.Error(t, err)
+		assert.Contains(t, stderr, "no environments recorded")
+	})
+}
+
+// failingWriter fails every write, like a stdout whose reader has gone.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, syscall.EPIPE }
+
+func TestCreateOutputWriteError(t *testing.T) {
+	env := &isolation.Environment{ID: "a", Ports: &ports.PortRange{BasePort: 20000, Count: 2}}
+
+	assert.ErrorIs(t, outputShell(failingWriter{}, env), syscall.EPIPE)
+	assert.ErrorIs(t, outputHuman(failingWriter{}, env, nil), syscall.EPIPE)
+	assert.ErrorIs(t, outputHumanList(failingWriter{}, []*isolation.Environment{env}), syscall.EPIPE)
 }
@@ -0,0 +1,75 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+)
+
+// dockerNetworkLabel carries the isolation ID on networks created by
+// create --docker-network.
+const dockerNetworkLabel = "io.portalloc.isolation-id"
+
+// createDockerNetwork creates the docker network named DOCKER_NETWORK for
+// env and records it on env, so cleanup removes it.
+func createDockerNetwork(ctx context.Context, env *isolation.Environment) error {
+	name := env.DockerNetworkName()
+	out, err := exec.CommandContext(ctx, "docker", "network", "create", "--label", dockerNetworkLabel+"="+env.ID, name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to create docker network %s: %w%s", name, err, dockerOutput(out))
+	}
+	env.DockerNetwork = name
+	return nil
+}
+
+// removeDockerNetwork removes the docker network created for env, if any.
+// A network that is already gone is not an error.
+func removeDockerNetwork(env *isolation.Environment) error {
+	if env.DockerNetwork == "" {
+		return nil
+	}
+	out, err := exec.Command("docker", "network", "rm", env.DockerNetwork).CombinedOutput()
+	if err != nil {
+		if bytes.Contains(bytes.ToLower(out), []byte("not found")) || bytes.Contains(bytes.ToLower(out), []byte("no such network")) {
+			return nil
+		}
+		return fmt.Errorf("failed to remove docker network %s (containers still attached?): %w%s", env.DockerNetwork, err, dockerOutput(out))
+	}
+	return nil
+}
+
+// dockerOutput formats docker's output for an error message.
+func dockerOutput(out []byte) string {
+	if msg := strings.TrimSpace(string(out)); msg != "" {
+		return ": " + msg
+	}
+	return ""
+}
+
+// cleanupEnvironment removes env's docker network, then env itself. While
+// containers still use the network, env is left in place so the cleanup can
+// be retried once they are stopped.
+func cleanupEnvironment(manager *isolation.EnvironmentManager, env *isolation.Environment) error {
+	if err := removeDockerNetwork(env); err != nil {
+		return err
+	}
+	return manager.Cleanup(env)
+}
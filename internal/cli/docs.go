@@ -0,0 +1,71 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/cobra/doc"
+)
+
+var docsOut string
+
+var docsCmd = &cobra.Command{
+	Use:   "docs <man|markdown>",
+	Short: "Generate man pages or a Markdown CLI reference",
+	Long: `Docs writes one file per command, generated from the command definitions,
+so packaged man pages and the CLI reference always match the actual flags.`,
+	Example: `  # Man pages for packaging
+  go-portalloc docs man --out share/man/man1
+
+  # Markdown reference for the wiki
+  go-portalloc docs markdown --out docs/cli`,
+	Hidden:    true,
+	Args:      cobra.ExactArgs(1),
+	ValidArgs: []string{"man", "markdown"},
+	RunE:      runDocs,
+}
+
+func init() {
+	docsCmd.Flags().StringVar(&docsOut, "out", ".", "Output directory")
+}
+
+func runDocs(cmd *cobra.Command, args []string) error {
+	if err := os.MkdirAll(docsOut, 0o755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	// Omit the generation date so regenerated docs only change with the flags
+	root := cmd.Root()
+	root.DisableAutoGenTag = true
+
+	switch args[0] {
+	case "man":
+		header := &doc.GenManHeader{Title: "GO-PORTALLOC", Section: "1", Source: "go-portalloc " + Version}
+		if err := doc.GenManTree(root, header, docsOut); err != nil {
+			return fmt.Errorf("failed to generate man pages: %w", err)
+		}
+	case "markdown":
+		if err := doc.GenMarkdownTree(root, docsOut); err != nil {
+			return fmt.Errorf("failed to generate markdown: %w", err)
+		}
+	default:
+		return usageErrorf("unknown format: %s (expected man or markdown)", args[0])
+	}
+
+	return nil
+}
@@ -0,0 +1,417 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/internal/config"
+	"github.com/pigeonworks-llc/go-portalloc/internal/daemon"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	doctorLockDir    string
+	doctorMaxLockAge time.Duration
+	doctorFix        bool
+	doctorYes        bool
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check locks, state, and temp directories for problems",
+	Long: `Doctor inspects the lock directory, state file, and temp directories and
+reports anything that needs attention:
+
+  - Lock and state directories that are not usable by their owner
+  - Invalid values in the config file
+  - A state file that cannot be decoded
+  - Locks whose owning process is gone (stale)
+  - Stale locks older than the maximum lock age (expired); these are
+    treated as free and reclaimed by the next create
+  - Temp directories with no lock and no state entry (orphaned)
+  - Under the portalloc naming scheme, environments still using the
+    legacy aigis lock directory or temp directory names
+
+Doctor also reports whether a 'serve' daemon is running for the state
+directory, from the lock on its PID file. That is not a problem either way.
+
+With --fix, doctor repairs what is safe to repair: it recreates missing
+directories and restores their permissions, removes orphaned temp
+directories, migrates stale environments to the portalloc names, and moves a corrupt state file to state.json.bak before
+rebuilding it from lock files. Invalid config values are reset to their
+defaults after confirmation (--yes skips the prompt); the previous file is
+kept as config.json.bak.
+
+The maximum lock age defaults to max_lock_age from the config file
+(24h if unset). Doctor exits non-zero when problems remain.`,
+	Example: `  # Check the default lock directory
+  go-portalloc doctor
+
+  # Report stale locks older than an hour as expired
+  go-portalloc doctor --max-lock-age 1h
+
+  # Repair what can be repaired, without prompting
+  go-portalloc doctor --fix --yes`,
+	RunE: runDoctor,
+}
+
+func init() {
+	doctorCmd.Flags().StringVar(&doctorLockDir, "lock-dir", defaultLockDir, "Lock directory path")
+	doctorCmd.Flags().DurationVar(&doctorMaxLockAge, "max-lock-age", 0, "Age after which stale locks are expired (default: max_lock_age from config, or 24h)")
+	doctorCmd.Flags().BoolVar(&doctorFix, "fix", false, "Repair the problems found")
+	doctorCmd.Flags().BoolVar(&doctorYes, "yes", false, "With --fix, rewrite the config file without asking")
+}
+
+// doctorLock is a lock file examined by doctor.
+type doctorLock struct {
+	info *isolation.LockInfo
+	id   string
+}
+
+func runDoctor(cmd *cobra.Command, args []string) error {
+	problems, fixed := 0, 0
+	report := func(found, repaired int) {
+		problems += found
+		fixed += repaired
+	}
+
+	report(checkDoctorDir("Lock directory", doctorLockDir, 0o750))
+	if dir, err := state.StateDir(); err == nil {
+		report(checkDoctorDir("State directory", dir, 0o755))
+	}
+	report(checkDoctorConfig(cmd.InOrStdin()))
+	checkDoctorDaemon()
+
+	maxLockAge := doctorMaxLockAge
+	if !cmd.Flags().Changed("max-lock-age") {
+		age, err := loadMaxLockAge()
+		if err != nil {
+			age = isolation.DefaultMaxLockAge
+		}
+		maxLockAge = age
+	}
+
+	stateMgr, err := newStateManager()
+	if err == nil {
+		_, err = stateMgr.ListEnvironments()
+	}
+	switch {
+	case err == nil:
+		fmt.Println(emoji("✅ State file: readable"))
+	case errors.Is(err, state.ErrCorruptState) && doctorFix:
+		fmt.Printf(emoji("❌ State file: %v\n"), err)
+		problems++
+		if repairStateFile(stateMgr) == nil {
+			fixed++
+		} else {
+			stateMgr = nil
+		}
+	default:
+		fmt.Printf(emoji("❌ State file: %v\n"), err)
+		problems++
+		stateMgr = nil
+	}
+
+	if stateMgr != nil {
+		report(checkDoctorLegacy(stateMgr))
+	}
+
+	locks, err := readDoctorLocks(doctorLockDir)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var stale, expired []doctorLock
+	for _, lock := range locks {
+		if lock.info.Alive() {
+			continue
+		}
+		if lock.info.Expired(maxLockAge, now) {
+			expired = append(expired, lock)
+		} else {
+			stale = append(stale, lock)
+		}
+	}
+
+	fmt.Printf(emoji("🔒 Locks: %d total, %d active, %d stale, %d expired\n"),
+		len(locks), len(locks)-len(stale)-len(expired), len(stale), len(expired))
+	for _, lock := range stale {
+		fmt.Printf("  stale:   %s (PID %d, created %s)\n", lock.id, lock.info.PID, formatTimeAgo(lock.info.CreatedAt))
+	}
+	if len(expired) > 0 {
+		fmt.Printf(emoji("❌ %d lock(s) older than %s with no running owner:\n"), len(expired), maxLockAge)
+		for _, lock := range expired {
+			fmt.Printf("  expired: %s (PID %d, age %s)\n", lock.id, lock.info.PID, now.Sub(lock.info.CreatedAt).Round(time.Second))
+		}
+		problems += len(expired)
+	}
+
+	if stateMgr != nil {
+		orphans, err := stateMgr.FindOrphanedTempDirs(os.TempDir(), doctorLockDir)
+		if err != nil {
+			fmt.Printf(emoji("⚠️  Failed to scan for orphaned temp directories: %v\n"), err)
+		} else if len(orphans) > 0 {
+			fmt.Printf(emoji("❌ %d orphaned temp director(ies):\n"), len(orphans))
+			for _, orphan := range orphans {
+				if manifest, err := isolation.ReadManifest(orphan.Path); err == nil {
+					fmt.Printf("  %s (modified %s, created by %s)\n", orphan.Path, formatTimeAgo(orphan.ModTime), formatCreator(manifest.User, manifest.Host))
+				} else {
+					fmt.Printf("  %s (modified %s)\n", orphan.Path, formatTimeAgo(orphan.ModTime))
+				}
+				if !doctorFix {
+					continue
+				}
+				if err := os.RemoveAll(orphan.Path); err != nil {
+					fmt.Printf(emoji("  ⚠️  Failed to remove: %v\n"), err)
+					continue
+				}
+				fmt.Println(emoji("  🔧 Removed"))
+				fixed++
+			}
+			problems += len(orphans)
+		} else {
+			fmt.Println(emoji("✅ No orphaned temp directories"))
+		}
+	}
+
+	if remaining := problems - fixed; remaining > 0 {
+		if doctorFix {
+			return fmt.Errorf("doctor fixed %d of %d problem(s); %d remain (run 'go-portalloc reconcile' or 'go-portalloc cleanup --stale')", fixed, problems, remaining)
+		}
+		return fmt.Errorf("doctor found %d problem(s) (run 'go-portalloc doctor --fix', 'go-portalloc reconcile', or 'go-portalloc cleanup --stale')", problems)
+	}
+
+	if fixed > 0 {
+		fmt.Printf(emoji("✅ Fixed %d problem(s)\n"), fixed)
+		return nil
+	}
+	fmt.Println(emoji("✅ No problems found"))
+	return nil
+}
+
+// checkDoctorDaemon reports the daemon holding the default PID file, if any.
+func checkDoctorDaemon() {
+	dir, err := state.StateDir()
+	if err != nil {
+		return
+	}
+	info, err := daemon.RunningDaemon(filepath.Join(dir, daemon.PIDFileName))
+	switch {
+	case err != nil:
+		fmt.Printf(emoji("⚠️  Daemon: %v\n"), err)
+	case info == nil:
+		fmt.Println(emoji("📈 Daemon: not running"))
+	case info.Address != "":
+		fmt.Printf(emoji("📈 Daemon: running (pid %d, %s, since %s)\n"), info.PID, info.Address, formatTimeAgo(info.StartedAt))
+	default:
+		fmt.Printf(emoji("📈 Daemon: running (pid %d, since %s)\n"), info.PID, formatTimeAgo(info.StartedAt))
+	}
+}
+
+// checkDoctorDir reports a directory its owner cannot use. A missing
+// directory is created on first use and is only created here with --fix;
+// --fix also restores mode on an unusable one.
+func checkDoctorDir(label, dir string, mode os.FileMode) (problems, fixed int) {
+	info, err := os.Stat(dir)
+	switch {
+	case os.IsNotExist(err):
+		if !doctorFix {
+			fmt.Printf(emoji("✅ %s: %s (created on first use)\n"), label, dir)
+			return 0, 0
+		}
+		if err := os.MkdirAll(dir, mode); err != nil {
+			fmt.Printf(emoji("❌ %s: %v\n"), label, err)
+			return 1, 0
+		}
+		fmt.Printf(emoji("🔧 %s: created %s\n"), label, dir)
+		return 0, 0
+	case err != nil:
+		fmt.Printf(emoji("❌ %s: %v\n"), label, err)
+		return 1, 0
+	case !info.IsDir():
+		fmt.Printf(emoji("❌ %s: %s is not a directory\n"), label, dir)
+		return 1, 0
+	case info.Mode().Perm()&0o700 == 0o700:
+		fmt.Printf(emoji("✅ %s: %s\n"), label, dir)
+		return 0, 0
+	}
+
+	fmt.Printf(emoji("❌ %s: %s has mode %s\n"), label, dir, info.Mode().Perm())
+	if !doctorFix {
+		return 1, 0
+	}
+	// #nosec G302 - restores the mode the directory is created with
+	if err := os.Chmod(dir, mode); err != nil {
+		fmt.Printf(emoji("  ⚠️  Failed to restore mode %s: %v\n"), mode, err)
+		return 1, 0
+	}
+	fmt.Printf(emoji("  🔧 Restored mode %s\n"), mode)
+	return 1, 1
+}
+
+// checkDoctorConfig reports invalid config values and, with --fix and
+// confirmation read from in, resets them.
+func checkDoctorConfig(in io.Reader) (problems, fixed int) {
+	path := configPath
+	if path == "" {
+		var err error
+		if path, err = config.DefaultPath(); err != nil {
+			return 0, 0
+		}
+	}
+
+	cfg, err := config.Load(path)
+	if err != nil {
+		fmt.Printf(emoji("❌ Config file: %v\n"), err)
+		return 1, 0
+	}
+	found := cfg.Problems()
+	if len(found) == 0 {
+		fmt.Println(emoji("✅ Config file: valid"))
+		return 0, 0
+	}
+
+	fmt.Printf(emoji("❌ Config file %s has %d invalid value(s):\n"), path, len(found))
+	for _, p := range found {
+		fmt.Printf("  %s: %v\n", p.Field, p.Err)
+	}
+	if !doctorFix {
+		return len(found), 0
+	}
+	if !doctorYes && !confirm(in, "Reset these values to their defaults?") {
+		fmt.Println("  Config file left unchanged")
+		return len(found), 0
+	}
+
+	cfg.Repair()
+	if err := cfg.Save(path); err != nil {
+		fmt.Printf(emoji("  ⚠️  %v\n"), err)
+		return len(found), 0
+	}
+	fmt.Printf(emoji("  🔧 Rewrote %s (previous file kept as %s.bak)\n"), path, filepath.Base(path))
+	return len(found), len(found)
+}
+
+// checkDoctorLegacy reports environments still using the legacy names and,
+// with --fix, migrates those whose owner is gone. Live environments are
+// listed but not counted as problems.
+func checkDoctorLegacy(stateMgr *state.Manager) (found, fixed int) {
+	if isolation.CurrentNaming() != isolation.NamingPortalloc {
+		return 0, 0
+	}
+	legacy, err := state.FindLegacy(doctorLockDir)
+	if err != nil {
+		fmt.Printf(emoji("⚠️  Failed to scan for legacy names: %v\n"), err)
+		return 0, 0
+	}
+	if len(legacy) == 0 {
+		fmt.Println(emoji("✅ No environments with legacy names"))
+		return 0, 0
+	}
+
+	fmt.Printf(emoji("❌ %d environment(s) with legacy names:\n"), len(legacy))
+	for _, env := range legacy {
+		var paths []string
+		for _, path := range []string{env.LockFile, env.TempDir} {
+			if path != "" {
+				paths = append(paths, path)
+			}
+		}
+		note := ""
+		if env.Live {
+			note = " (in use; migrate after it exits)"
+		} else {
+			found++
+		}
+		fmt.Printf("  %s: %s%s\n", env.ID, strings.Join(paths, ", "), note)
+	}
+	if !doctorFix || found == 0 {
+		return found, 0
+	}
+
+	migrated, err := stateMgr.MigrateLegacy(doctorLockDir)
+	if err != nil {
+		fmt.Printf(emoji("  ⚠️  %v\n"), err)
+	}
+	if len(migrated) > 0 {
+		fmt.Printf(emoji("  🔧 Migrated %d environment(s) to the portalloc names\n"), len(migrated))
+	}
+	return found, len(migrated)
+}
+
+// repairStateFile moves a corrupt state file aside and rebuilds the state
+// from lock files.
+func repairStateFile(stateMgr *state.Manager) error {
+	backup, err := stateMgr.Quarantine()
+	if err != nil {
+		fmt.Printf(emoji("  ⚠️  %v\n"), err)
+		return err
+	}
+	count, err := stateMgr.Reconcile(doctorLockDir)
+	if err != nil {
+		fmt.Printf(emoji("  ⚠️  Moved to %s, but reconcile failed: %v\n"), backup, err)
+		return err
+	}
+	fmt.Printf(emoji("  🔧 Moved to %s and rebuilt %d environment(s) from lock files\n"), backup, count)
+	return nil
+}
+
+// confirm asks a yes/no question on stdout, reading the answer from in.
+// Anything but "y" or "yes", including EOF, is no.
+func confirm(in io.Reader, question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	fmt.Println()
+	return answer == "y" || answer == "yes"
+}
+
+// readDoctorLocks reads all lock files in lockDir, and in the legacy lock
+// directory under the portalloc naming scheme, sorted by ID.
+func readDoctorLocks(lockDir string) ([]doctorLock, error) {
+	var matches []string
+	for _, dir := range isolation.LockDirs(lockDir) {
+		found, err := filepath.Glob(filepath.Join(dir, "env-*.lock"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list lock files: %w", err)
+		}
+		matches = append(matches, found...)
+	}
+	sort.Slice(matches, func(i, j int) bool { return filepath.Base(matches[i]) < filepath.Base(matches[j]) })
+
+	locks := make([]doctorLock, 0, len(matches))
+	for _, lockFile := range matches {
+		info, err := isolation.ReadLockInfo(lockFile)
+		if err != nil {
+			fmt.Printf(emoji("⚠️  %v\n"), err)
+			continue
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(lockFile), "env-"), ".lock")
+		locks = append(locks, doctorLock{info: info, id: id})
+	}
+	return locks, nil
+}
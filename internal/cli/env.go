@@ -0,0 +1,187 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/spf13/cobra"
+)
+
+var (
+	envID        string
+	envName      string
+	envFormat    string
+	envK8sName   string
+	envNamespace string
+)
+
+var envCmd = &cobra.Command{
+	Use:   "env (--id <isolation-id> | --name <name>)",
+	Short: "Print an environment's variables",
+	Long: `Print the variables of an existing environment in the requested format:
+
+  dotenv         NAME=value lines, as in the env file (default)
+  shell          export statements for eval
+  json           a JSON object of name -> value
+  k8s-configmap  a Kubernetes ConfigMap manifest
+  k8s-secret     a Kubernetes Secret manifest (values base64-encoded)
+
+The Kubernetes formats let tests running inside a kind cluster mount the
+allocated configuration directly. --k8s-name sets the manifest's metadata.name
+(default: the compose project name) and must be a valid DNS subdomain.`,
+	Example: `  # Load the variables into the current shell
+  eval "$(go-portalloc env --id abc123def456 --format shell)"
+
+  # Mount the allocation into a kind cluster
+  go-portalloc env --id abc123def456 --format k8s-configmap --k8s-name test-ports | kubectl apply -f -`,
+	Args: cobra.NoArgs,
+	RunE: runEnv,
+}
+
+func init() {
+	envCmd.Flags().StringVar(&envID, "id", "", "Isolation ID whose variables to print (or --name)")
+	envCmd.Flags().StringVar(&envName, "name", "", "Environment name (instead of --id)")
+	envCmd.Flags().StringVar(&envFormat, "format", "dotenv", "Output format: dotenv, shell, json, k8s-configmap, k8s-secret")
+	envCmd.Flags().StringVar(&envK8sName, "k8s-name", "", "metadata.name of the Kubernetes manifest (default: compose project name)")
+	envCmd.Flags().StringVar(&envNamespace, "namespace", "", "metadata.namespace of the Kubernetes manifest")
+	envCmd.MarkFlagsOneRequired("id", "name")
+	envCmd.MarkFlagsMutuallyExclusive("id", "name")
+}
+
+// k8sNamePattern matches a DNS-1123 subdomain, the format of ConfigMap and Secret names.
+var k8sNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+func runEnv(cmd *cobra.Command, args []string) error {
+	switch envFormat {
+	case "dotenv", "shell", "json", "k8s-configmap", "k8s-secret":
+	default:
+		return usageErrorf("unknown format: %s", envFormat)
+	}
+	if envK8sName != "" && !strings.HasPrefix(envFormat, "k8s-") {
+		return usageErrorf("--k8s-name requires --format k8s-configmap or k8s-secret")
+	}
+	if envNamespace != "" && !k8sNamePattern.MatchString(envNamespace) {
+		return usageErrorf("invalid --namespace %q", envNamespace)
+	}
+
+	if err := resolveEnvironmentFlag(&envID, envName); err != nil {
+		return err
+	}
+
+	stateMgr, err := newStateManager()
+	if err != nil {
+		return fmt.Errorf("failed to create state manager: %w", err)
+	}
+
+	env, err := stateMgr.LoadEnvironment(envID)
+	if err != nil {
+		return err
+	}
+	if err := stateMgr.MarkUsed(env.ID, time.Now()); err != nil {
+		if err := strictError(err); err != nil {
+			return err
+		}
+	}
+
+	switch envFormat {
+	case "shell":
+		return writeEnvShell(os.Stdout, env)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(env.Vars())
+	case "k8s-configmap", "k8s-secret":
+		name := envK8sName
+		if name == "" {
+			name = strings.ReplaceAll(env.ComposeProjectName(), "_", "-")
+		}
+		if len(name) > 253 || !k8sNamePattern.MatchString(name) {
+			return usageErrorf("invalid --k8s-name %q: must be a lowercase DNS subdomain", name)
+		}
+		return writeK8sManifest(os.Stdout, env, strings.TrimPrefix(envFormat, "k8s-"), name, envNamespace)
+	default:
+		return writeEnvDotenv(os.Stdout, env)
+	}
+}
+
+// writeEnvDotenv writes env's variables as NAME=value lines, in env file
+// order, quoting values as the env file does.
+func writeEnvDotenv(w io.Writer, env *isolation.Environment) error {
+	vars := env.Vars()
+	for _, name := range env.VarNames() {
+		if _, err := fmt.Fprintf(w, "%s=%s\n", name, isolation.ShellQuote(vars[name])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeEnvShell writes env's variables as export statements, in env file order.
+func writeEnvShell(w io.Writer, env *isolation.Environment) error {
+	vars := env.Vars()
+	for _, name := range env.VarNames() {
+		if _, err := fmt.Fprintf(w, "export %s=%s\n", name, isolation.ShellQuote(vars[name])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeK8sManifest writes a ConfigMap (kind "configmap") or Secret (kind
+// "secret") holding env's variables. Values are double-quoted so ports stay
+// strings, as Kubernetes requires.
+func writeK8sManifest(w io.Writer, env *isolation.Environment, kind, name, namespace string) error {
+	var b strings.Builder
+	b.WriteString("apiVersion: v1\n")
+	if kind == "secret" {
+		b.WriteString("kind: Secret\n")
+	} else {
+		b.WriteString("kind: ConfigMap\n")
+	}
+	b.WriteString("metadata:\n")
+	fmt.Fprintf(&b, "  name: %s\n", name)
+	if namespace != "" {
+		fmt.Fprintf(&b, "  namespace: %s\n", namespace)
+	}
+	b.WriteString("  labels:\n")
+	b.WriteString("    app.kubernetes.io/managed-by: go-portalloc\n")
+	fmt.Fprintf(&b, "    go-portalloc/isolation-id: %s\n", strconv.Quote(env.ID))
+	if kind == "secret" {
+		b.WriteString("type: Opaque\n")
+	}
+	b.WriteString("data:\n")
+
+	vars := env.Vars()
+	for _, n := range env.VarNames() {
+		value := vars[n]
+		if kind == "secret" {
+			value = base64.StdEncoding.EncodeToString([]byte(value))
+		}
+		fmt.Fprintf(&b, "  %s: %s\n", n, strconv.Quote(value))
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,76 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteEnvDotenv(t *testing.T) {
+	env := &isolation.Environment{
+		ID:      "abc123def456",
+		TempDir: "/tmp/my dir/$HOME's\nnext",
+		Ports:   &ports.PortRange{BasePort: 20000, Count: 2},
+	}
+
+	var b strings.Builder
+	require.NoError(t, writeEnvDotenv(&b, env))
+	out := b.String()
+	assert.Contains(t, out, "ISOLATION_ID=abc123def456\n")
+	assert.Contains(t, out, "FIRESTORE_PORT=20000\n")
+	assert.Contains(t, out, "TEMP_DIR='/tmp/my dir/$HOME'\\''s\nnext'\n")
+
+	// Sourced by a shell, the value comes back unchanged
+	script := filepath.Join(t.TempDir(), "env")
+	require.NoError(t, os.WriteFile(script, []byte(out), 0o600))
+	got, err := exec.Command("sh", "-c", `. "$0" && printf %s "$TEMP_DIR"`, script).Output()
+	require.NoError(t, err)
+	assert.Equal(t, env.TempDir, string(got))
+}
+
+func TestWriteK8sManifest(t *testing.T) {
+	env := &isolation.Environment{
+		ID:      "abc123def456",
+		TempDir: "/tmp/portalloc-abc123def456",
+		Ports:   &ports.PortRange{BasePort: 20000, Count: 2},
+	}
+
+	var b strings.Builder
+	require.NoError(t, writeK8sManifest(&b, env, "configmap", "test-ports", "ci"))
+	out := b.String()
+	assert.Contains(t, out, "kind: ConfigMap\n")
+	assert.Contains(t, out, "  name: test-ports\n  namespace: ci\n")
+	assert.Contains(t, out, "    go-portalloc/isolation-id: \"abc123def456\"\n")
+	assert.Contains(t, out, "  FIRESTORE_PORT: \"20000\"\n")
+	assert.Contains(t, out, "  COMPOSE_PROJECT_NAME: \"portalloc-abc123def456\"\n")
+	assert.NotContains(t, out, "type: Opaque")
+
+	b.Reset()
+	require.NoError(t, writeK8sManifest(&b, env, "secret", "test-ports", ""))
+	out = b.String()
+	assert.Contains(t, out, "kind: Secret\n")
+	assert.Contains(t, out, "type: Opaque\n")
+	assert.NotContains(t, out, "namespace:")
+	assert.Contains(t, out, "  FIRESTORE_PORT: \"MjAwMDA=\"\n", "secret values are base64-encoded")
+}
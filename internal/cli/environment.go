@@ -0,0 +1,135 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+)
+
+// resolveEnvironmentFlag replaces *id with the ID of the environment called
+// name, for commands that accept --name in place of --id.
+func resolveEnvironmentFlag(id *string, name string) error {
+	if name == "" {
+		return nil
+	}
+	stateMgr, err := newStateManager()
+	if err != nil {
+		return fmt.Errorf("failed to create state manager: %w", err)
+	}
+	env, err := stateMgr.FindByName(name)
+	if err != nil {
+		return err
+	}
+	*id = env.ID
+	return nil
+}
+
+// loadEnvironment returns the environment recorded in the state file, or
+// reconstructs it from the isolation ID and config when it is not recorded.
+// In strict mode, a state file that cannot be read is an error rather than
+// a reason to reconstruct.
+func loadEnvironment(isolationID string, config *isolation.Config) (*isolation.Environment, error) {
+	stateMgr, err := newStateManager()
+	if err == nil {
+		env, loadErr := stateMgr.LoadEnvironment(isolationID)
+		if loadErr == nil {
+			return env, nil
+		}
+		if !errors.Is(loadErr, state.ErrNotFound) {
+			err = loadErr
+		}
+	}
+	if err := strictError(err); err != nil {
+		return nil, err
+	}
+
+	return &isolation.Environment{
+		ID:           isolationID,
+		WorktreePath: config.WorktreePath,
+		TempDir:      isolation.FindTempDir(isolationID),
+		LockFile:     filepath.Join(config.LockDir, fmt.Sprintf("env-%s.lock", isolationID)),
+		EnvFile:      isolation.FindEnvFile(config.WorktreePath, isolationID),
+		Ports:        &ports.PortRange{BasePort: 0, Count: 0},
+	}, nil
+}
+
+// markUsed records that a command used the environment, so 'list' and the
+// retention policy see actual usage. Environments that are not recorded in
+// the state file are skipped, and other failures only matter in strict mode.
+func markUsed(isolationID string) error {
+	stateMgr, err := newStateManager()
+	if err == nil {
+		err = stateMgr.MarkUsed(isolationID, time.Now())
+	}
+	if errors.Is(err, state.ErrNotFound) {
+		return nil
+	}
+	return strictError(err)
+}
+
+// findIdempotentEnvironment returns the environment recorded with
+// idempotency key if it has not been cleaned up since, or nil; see
+// reuseIdempotentEnvironment.
+func findIdempotentEnvironment(key, lockDir string, wanted int) (*isolation.Environment, error) {
+	stateMgr, err := newStateManager()
+	if err != nil {
+		return nil, fmt.Errorf("--idempotency-key needs the state file: %w", err)
+	}
+	recorded, err := stateMgr.FindByIdempotencyKey(key)
+	if errors.Is(err, state.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up idempotency key: %w", err)
+	}
+	return reuseIdempotentEnvironment(recorded, key, lockDir, wanted)
+}
+
+// reuseIdempotentEnvironment returns recorded, the environment created with
+// idempotency key, if it has not been cleaned up since, or nil. A surviving
+// environment with a different number of ports than wanted is an error
+// rather than a reason to allocate a second one.
+func reuseIdempotentEnvironment(recorded *state.EnvironmentState, key, lockDir string, wanted int) (*isolation.Environment, error) {
+	// The owning process has usually exited; the lock and temp directory
+	// tell whether the environment is still there
+	idGen := isolation.NewIDGenerator(&isolation.Config{LockDir: lockDir})
+	if !idGen.IsLocked(recorded.ID) {
+		return nil, nil
+	}
+	if _, err := os.Stat(recorded.TempDir); err != nil {
+		return nil, nil
+	}
+	if recorded.Ports == nil || recorded.Ports.Count != wanted {
+		count := 0
+		if recorded.Ports != nil {
+			count = recorded.Ports.Count
+		}
+		return nil, usageErrorf("idempotency key %q belongs to environment %s with %d port(s), not %d", key, recorded.ID, count, wanted)
+	}
+
+	if err := markUsed(recorded.ID); err != nil {
+		return nil, err
+	}
+	logEnvironment("environment reused", recorded, time.Time{}, "idempotency_key", key)
+	return recorded.Environment(), nil
+}
@@ -0,0 +1,97 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/spf13/cobra"
+)
+
+// Exit codes of the go-portalloc binary. Codes 3 and 4 are worth retrying
+// later; the others are hard failures.
+const (
+	ExitOK             = 0
+	ExitFailure        = 1 // any error without a more specific code
+	ExitUsage          = 2 // invalid flags or arguments
+	ExitPortsExhausted = 3 // no free block of ports
+	ExitLockConflict   = 4 // isolation ID locked or name in use
+	ExitNotFound       = 5 // no such environment
+	ExitStateCorrupt   = 6 // state file cannot be decoded
+	ExitInterrupted    = 130
+)
+
+// ExitCode maps an error returned by Execute to the process exit code. A
+// failed 'run' exits with its command's code.
+func ExitCode(err error) int {
+	var usage *usageError
+	var command *commandExitError
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.As(err, &command):
+		return command.code
+	case errors.As(err, &usage):
+		return ExitUsage
+	case errors.Is(err, ports.ErrNoPortsAvailable):
+		return ExitPortsExhausted
+	case errors.Is(err, isolation.ErrLockConflict), errors.Is(err, isolation.ErrNameInUse):
+		return ExitLockConflict
+	case errors.Is(err, state.ErrNotFound):
+		return ExitNotFound
+	case errors.Is(err, state.ErrCorruptState):
+		return ExitStateCorrupt
+	case errors.Is(err, errCreateInterrupted):
+		return ExitInterrupted
+	default:
+		return ExitFailure
+	}
+}
+
+// usageError marks an invalid flag or argument.
+type usageError struct {
+	err error
+}
+
+func (e *usageError) Error() string { return e.err.Error() }
+func (e *usageError) Unwrap() error { return e.err }
+
+// usageErrorf formats a usage error.
+func usageErrorf(format string, args ...interface{}) error {
+	return &usageError{err: fmt.Errorf(format, args...)}
+}
+
+// runStarted is set once a command's RunE is reached. Errors returned
+// before that come from cobra's flag and argument checks (or from
+// setupLogging) and are usage errors.
+var runStarted bool
+
+// trackRunStarted wraps the RunE of cmd and its subcommands to set
+// runStarted.
+func trackRunStarted(cmd *cobra.Command) {
+	if run := cmd.RunE; run != nil {
+		cmd.RunE = func(cmd *cobra.Command, args []string) error {
+			runStarted = true
+			return run(cmd, args)
+		}
+	}
+	for _, sub := range cmd.Commands() {
+		trackRunStarted(sub)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"success", nil, ExitOK},
+		{"generic failure", errors.New("boom"), ExitFailure},
+		{"usage", usageErrorf("--copies must be at least 1"), ExitUsage},
+		{"ports exhausted", fmt.Errorf("failed to create environment: %w", ports.ErrNoPortsAvailable), ExitPortsExhausted},
+		{"lock conflict", fmt.Errorf("failed to create lock: %w", isolation.ErrLockConflict), ExitLockConflict},
+		{"name in use", fmt.Errorf("failed to create lock: %w", isolation.ErrNameInUse), ExitLockConflict},
+		{"not found", fmt.Errorf("%w: abc123", state.ErrNotFound), ExitNotFound},
+		{"corrupt state", fmt.Errorf("failed to load: %w", state.ErrCorruptState), ExitStateCorrupt},
+		{"interrupted", errCreateInterrupted, ExitInterrupted},
+		{"run command failed", &commandExitError{code: 42, err: errors.New("1 of 1 copies failed")}, 42},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, ExitCode(tt.err))
+		})
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/client"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	fleetHosts        []string
+	fleetStale        bool
+	fleetOlderThan    time.Duration
+	fleetSSHCommand   string
+	fleetRemoteBinary string
+	fleetParallel     int
+	fleetTimeout      time.Duration
+	fleetJSON         bool
+)
+
+var fleetCmd = &cobra.Command{
+	Use:   "fleet",
+	Short: "Operate on environments across a fleet of hosts",
+	Long: `Fleet runs go-portalloc operations on many hosts from one place and
+aggregates the results, for example to reap environments leaked on CI
+runners.
+
+Each host is either an SSH destination ([user@]host), on which the
+go-portalloc binary is run, or the URL of a 'go-portalloc serve' daemon
+(http://host:port), whose REST API is used.`,
+}
+
+var fleetCleanupCmd = &cobra.Command{
+	Use:   "cleanup",
+	Short: "Clean up stale environments on every host of a fleet",
+	Long: `Cleanup removes stale environments (owning process gone) of every project
+on each host, or with --older-than those created longer ago than that, and
+prints a summary per host and for the whole fleet.
+
+SSH hosts run 'go-portalloc cleanup --stale --all-projects' through
+--ssh-command in batch mode, so keys must already be set up. Daemon hosts
+are asked for their stale environments, which are then removed one by one,
+authenticating with the token in PORTALLOC_TOKEN if it is set.
+Hosts are processed in parallel; fleet cleanup fails if any host fails.`,
+	Example: `  # Reap stale environments on two runners over SSH
+  go-portalloc fleet cleanup --hosts runner1,runner2 --stale
+
+  # Through the runners' daemons instead, as JSON
+  go-portalloc fleet cleanup --hosts http://runner1:9465,http://runner2:9465 --stale --json
+
+  # Remove everything older than a day, whatever its status
+  go-portalloc fleet cleanup --hosts ci@runner1 --older-than 24h`,
+	RunE: runFleetCleanup,
+}
+
+func init() {
+	fleetCleanupCmd.Flags().StringSliceVar(&fleetHosts, "hosts", nil, "Hosts to clean up: SSH destinations or daemon URLs (comma-separated or repeated)")
+	fleetCleanupCmd.Flags().BoolVar(&fleetStale, "stale", false, "Clean up stale environments (dead processes)")
+	fleetCleanupCmd.Flags().DurationVar(&fleetOlderThan, "older-than", 0, "Clean up environments created longer ago than this, regardless of status")
+	fleetCleanupCmd.Flags().StringVar(&fleetSSHCommand, "ssh-command", "ssh", "SSH client used to reach SSH hosts")
+	fleetCleanupCmd.Flags().StringVar(&fleetRemoteBinary, "remote-binary", "go-portalloc", "Path of go-portalloc on SSH hosts")
+	fleetCleanupCmd.Flags().IntVar(&fleetParallel, "parallel", 8, "Maximum number of hosts processed at once")
+	fleetCleanupCmd.Flags().DurationVar(&fleetTimeout, "timeout", 5*time.Minute, "Give up on a host after this long")
+	fleetCleanupCmd.Flags().BoolVar(&fleetJSON, "json", false, "Output per-host results as JSON")
+	_ = fleetCleanupCmd.MarkFlagRequired("hosts")
+	fleetCleanupCmd.MarkFlagsOneRequired("stale", "older-than")
+	fleetCleanupCmd.MarkFlagsMutuallyExclusive("stale", "older-than")
+
+	fleetCmd.AddCommand(fleetCleanupCmd)
+}
+
+// fleetResult is the outcome of cleaning up one host.
+type fleetResult struct {
+	Host    string   `json:"host"`
+	Cleaned []string `json:"cleaned"`
+	Failed  []string `json:"failed,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+func runFleetCleanup(cmd *cobra.Command, args []string) error {
+	if fleetParallel < 1 {
+		return usageErrorf("--parallel must be at least 1, got %d", fleetParallel)
+	}
+	if fleetOlderThan < 0 {
+		return usageErrorf("--older-than must not be negative, got %s", fleetOlderThan)
+	}
+	if len(fleetHosts) == 0 {
+		return usageErrorf("--hosts names no host")
+	}
+	for _, host := range fleetHosts {
+		if host == "" || strings.HasPrefix(host, "-") {
+			return usageErrorf("invalid host %q", host)
+		}
+	}
+
+	// Failures from here on are the hosts', not a usage problem
+	cmd.SilenceUsage = true
+
+	results := make([]fleetResult, len(fleetHosts))
+	sem := make(chan struct{}, fleetParallel)
+	var wg sync.WaitGroup
+	for i, host := range fleetHosts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			ctx, cancel := context.WithTimeout(cmd.Context(), fleetTimeout)
+			defer cancel()
+			results[i] = cleanupFleetHost(ctx, host)
+		}()
+	}
+	wg.Wait()
+
+	if fleetJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(results); err != nil {
+			return err
+		}
+	} else {
+		outputFleetResults(os.Stdout, results)
+	}
+
+	failedHosts := 0
+	for _, r := range results {
+		if r.Error != "" || len(r.Failed) > 0 {
+			failedHosts++
+		}
+	}
+	if failedHosts > 0 {
+		return fmt.Errorf("fleet cleanup failed on %d of %d host(s)", failedHosts, len(results))
+	}
+	return nil
+}
+
+// cleanupFleetHost cleans up one host through its daemon or over SSH.
+func cleanupFleetHost(ctx context.Context, host string) fleetResult {
+	result := fleetResult{Host: host, Cleaned: []string{}}
+	var err error
+	if strings.HasPrefix(host, "http://") || strings.HasPrefix(host, "https://") {
+		err = cleanupDaemonHost(ctx, client.New(host, client.WithToken(os.Getenv("PORTALLOC_TOKEN"))), &result)
+	} else {
+		err = cleanupSSHHost(ctx, host, &result)
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// cleanupDaemonHost removes the matching environments a daemon reports.
+func cleanupDaemonHost(ctx context.Context, c *client.Client, result *fleetResult) error {
+	envs, err := c.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list environments: %w", err)
+	}
+	for _, env := range envs {
+		if fleetOlderThan > 0 {
+			if time.Since(env.CreatedAt) <= fleetOlderThan {
+				continue
+			}
+		} else if env.Status != string(state.StatusStale) {
+			continue
+		}
+		if err := c.Cleanup(ctx, env.ID); err != nil && !client.IsNotFound(err) {
+			result.Failed = append(result.Failed, env.ID)
+			continue
+		}
+		result.Cleaned = append(result.Cleaned, env.ID)
+	}
+	return nil
+}
+
+// cleanupSSHHost runs 'cleanup' on host over SSH and collects the IDs it
+// reports as cleaned or failed.
+func cleanupSSHHost(ctx context.Context, host string, result *fleetResult) error {
+	remote := []string{fleetRemoteBinary, "cleanup", "--all-projects"}
+	if fleetOlderThan > 0 {
+		remote = append(remote, "--stale", "--older-than", fleetOlderThan.String())
+	} else {
+		remote = append(remote, "--stale")
+	}
+	quoted := make([]string, len(remote))
+	for i, arg := range remote {
+		quoted[i] = isolation.ShellQuote(arg)
+	}
+
+	// #nosec G204 - the SSH client and host are chosen by the operator
+	c := exec.CommandContext(ctx, fleetSSHCommand, "-o", "BatchMode=yes", "--", host, strings.Join(quoted, " "))
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	out, err := c.Output()
+	result.Cleaned, result.Failed = parseCleanupOutput(bytes.NewReader(out))
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("timed out after %s", fleetTimeout)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%w: %s", exitError(err), lastLine(msg))
+		}
+		return exitError(err)
+	}
+	return nil
+}
+
+// parseCleanupOutput returns the IDs 'cleanup --stale' reported as cleaned
+// and as failed. Emoji spelled out for a dumb terminal are accepted too.
+func parseCleanupOutput(r io.Reader) (cleaned, failed []string) {
+	cleaned = []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := emojiFallback.Replace(scanner.Text())
+		if rest, ok := strings.CutPrefix(line, "[ok] Cleaned: "); ok {
+			id, _, _ := strings.Cut(rest, " ")
+			cleaned = append(cleaned, id)
+		} else if rest, ok := strings.CutPrefix(line, "[warn]  Failed to cleanup "); ok {
+			id, _, _ := strings.Cut(rest, ":")
+			failed = append(failed, id)
+		}
+	}
+	return cleaned, failed
+}
+
+// lastLine returns the last line of s, which for SSH errors names the cause.
+func lastLine(s string) string {
+	return s[strings.LastIndexByte(s, '\n')+1:]
+}
+
+// outputFleetResults prints one line per host and a fleet-wide summary.
+func outputFleetResults(w io.Writer, results []fleetResult) {
+	cleaned, failed, unreachable := 0, 0, 0
+	for _, r := range results {
+		cleaned += len(r.Cleaned)
+		failed += len(r.Failed)
+		switch {
+		case r.Error != "":
+			unreachable++
+			fmt.Fprintf(w, emoji("❌ %s: %s\n"), r.Host, r.Error)
+		case len(r.Failed) > 0:
+			fmt.Fprintf(w, emoji("⚠️  %s: cleaned %d, failed %d (%s)\n"), r.Host, len(r.Cleaned), len(r.Failed), strings.Join(r.Failed, ", "))
+		default:
+			fmt.Fprintf(w, emoji("✅ %s: cleaned %d\n"), r.Host, len(r.Cleaned))
+		}
+	}
+
+	fmt.Fprintf(w, "\nFleet: cleaned %d environment(s) on %d host(s)", cleaned, len(results))
+	if failed > 0 {
+		fmt.Fprintf(w, ", %d failed", failed)
+	}
+	if unreachable > 0 {
+		fmt.Fprintf(w, ", %d host(s) with errors", unreachable)
+	}
+	fmt.Fprintln(w)
+}
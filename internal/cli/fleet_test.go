@@ -0,0 +1,148 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCleanupOutput(t *testing.T) {
+	out := `🧹 Found 3 stale environment(s)
+✅ Cleaned: abc123 (process not found)
+⚠️  Failed to cleanup def456: cleanup errors: [boom]
+✅ Cleaned: ghi789 (created 26h0m0s ago)
+
+✅ Cleaned up 2 environment(s) (1 failed)
+`
+	cleaned, failed := parseCleanupOutput(strings.NewReader(out))
+	assert.Equal(t, []string{"abc123", "ghi789"}, cleaned)
+	assert.Equal(t, []string{"def456"}, failed)
+
+	// A remote with TERM=dumb spells out the emoji
+	cleaned, failed = parseCleanupOutput(strings.NewReader("[ok] Cleaned: abc123 (process not found)\n[warn]  Failed to cleanup def456: boom\n"))
+	assert.Equal(t, []string{"abc123"}, cleaned)
+	assert.Equal(t, []string{"def456"}, failed)
+
+	cleaned, failed = parseCleanupOutput(strings.NewReader("No environments to cleanup\n"))
+	assert.Empty(t, cleaned)
+	assert.Empty(t, failed)
+}
+
+func TestCleanupDaemonHost(t *testing.T) {
+	envs := []*client.Environment{
+		{ID: "stale-1", Status: "stale", CreatedAt: time.Now().Add(-time.Hour)},
+		{ID: "active-1", Status: "active", CreatedAt: time.Now().Add(-48 * time.Hour)},
+		{ID: "stale-2", Status: "stale", CreatedAt: time.Now()},
+	}
+	var deleted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/environments":
+			_ = json.NewEncoder(w).Encode(envs)
+		case r.Method == http.MethodDelete:
+			deleted = append(deleted, strings.TrimPrefix(r.URL.Path, "/v1/environments/"))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	t.Run("stale", func(t *testing.T) {
+		deleted = nil
+		result := cleanupFleetHost(context.Background(), server.URL)
+		assert.Empty(t, result.Error)
+		assert.Equal(t, []string{"stale-1", "stale-2"}, result.Cleaned)
+		assert.Equal(t, result.Cleaned, deleted)
+	})
+
+	t.Run("older than", func(t *testing.T) {
+		fleetOlderThan = 30 * time.Minute
+		defer func() { fleetOlderThan = 0 }()
+		deleted = nil
+		result := cleanupFleetHost(context.Background(), server.URL)
+		assert.Equal(t, []string{"stale-1", "active-1"}, result.Cleaned)
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		result := cleanupFleetHost(context.Background(), "http://127.0.0.1:1")
+		require.Contains(t, result.Error, "failed to list environments")
+
+		var buf bytes.Buffer
+		outputFleetResults(&buf, []fleetResult{{Host: "a", Cleaned: []string{"x"}}, result})
+		assert.Contains(t, buf.String(), "✅ a: cleaned 1")
+		assert.Contains(t, buf.String(), "❌ http://127.0.0.1:1: failed to list environments")
+		assert.Contains(t, buf.String(), "Fleet: cleaned 1 environment(s) on 2 host(s), 1 host(s) with errors")
+	})
+}
+
+func TestFleetIntegration(t *testing.T) {
+	buildCLI(t)
+
+	t.Run("fleet cleanup reaps stale environments over SSH", func(t *testing.T) {
+		env := append(os.Environ(), "HOME="+t.TempDir(), "PORTALLOC_STATE_DIR="+t.TempDir(), "PORTALLOC_LOCK_DIR="+t.TempDir())
+
+		// The fake SSH client runs the remote command locally
+		ssh := filepath.Join(t.TempDir(), "ssh")
+		script := `#!/bin/sh
+while [ "$1" != "--" ]; do shift; done
+shift
+if [ "$1" = down ]; then echo "ssh: connect to host down port 22: Connection refused" >&2; exit 255; fi
+exec sh -c "$2"
+`
+		require.NoError(t, os.WriteFile(ssh, []byte(script), 0o755))
+
+		var ids []string
+		for range 2 {
+			stdout, stderr, err := runCLI(t, "", env, "create", "--json", "--no-env-file")
+			require.NoError(t, err, stderr)
+			var created createOutput
+			require.NoError(t, json.Unmarshal([]byte(stdout), &created), stdout)
+			ids = append(ids, created.IsolationID)
+		}
+
+		stdout, _, err := runCLI(t, "", env, "fleet", "cleanup", "--hosts", "runner1,down", "--stale", "--json",
+			"--ssh-command", ssh, "--remote-binary", cliBinary)
+		require.Error(t, err, "an unreachable host fails the run")
+		var results []fleetResult
+		require.NoError(t, json.Unmarshal([]byte(stdout), &results), stdout)
+		require.Len(t, results, 2)
+		assert.Equal(t, "runner1", results[0].Host)
+		assert.ElementsMatch(t, ids, results[0].Cleaned)
+		assert.Empty(t, results[0].Error)
+		assert.Equal(t, "down", results[1].Host)
+		assert.Contains(t, results[1].Error, "Connection refused")
+
+		stdout, stderr, err := runCLI(t, "", env, "fleet", "cleanup", "--hosts", "runner1", "--stale", "--ssh-command", ssh, "--remote-binary", cliBinary)
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stdout, "✅ runner1: cleaned 0")
+
+		_, stderr, err = runCLI(t, "", env, "fleet", "cleanup", "--hosts", "runner1")
+		require.Error(t, err, stderr)
+	})
+}
@@ -0,0 +1,95 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	heartbeatID    string
+	heartbeatName  string
+	heartbeatEvery time.Duration
+)
+
+var heartbeatCmd = &cobra.Command{
+	Use:   "heartbeat",
+	Short: "Record that an environment is still in use",
+	Long: `Heartbeat sets the environment's last-used time in the state file, like
+env, validate, and run do whenever they use an environment. 'list' shows
+the time since then as IDLE, and a retention policy with max_idle only
+removes environments that have not been used for that long.
+
+With --every, heartbeat keeps recording at that interval until it is
+interrupted or the environment is removed, which suits long-running jobs
+that use an environment without calling go-portalloc.`,
+	Example: `  # Mark an environment as used once
+  go-portalloc heartbeat --id abc123def456
+
+  # Keep a long-running job's environment marked as used
+  go-portalloc heartbeat --name payments-it --every 5m &`,
+	RunE: runHeartbeat,
+}
+
+func init() {
+	heartbeatCmd.Flags().StringVar(&heartbeatID, "id", "", "Isolation ID of the environment (or --name)")
+	heartbeatCmd.Flags().StringVar(&heartbeatName, "name", "", "Environment name (instead of --id)")
+	heartbeatCmd.Flags().DurationVar(&heartbeatEvery, "every", 0, "Keep recording at this interval until interrupted (0 records once)")
+	heartbeatCmd.MarkFlagsOneRequired("id", "name")
+	heartbeatCmd.MarkFlagsMutuallyExclusive("id", "name")
+}
+
+func runHeartbeat(cmd *cobra.Command, args []string) error {
+	if heartbeatEvery < 0 {
+		return usageErrorf("--every must not be negative, got %s", heartbeatEvery)
+	}
+	if err := resolveEnvironmentFlag(&heartbeatID, heartbeatName); err != nil {
+		return err
+	}
+
+	stateMgr, err := newStateManager()
+	if err != nil {
+		return fmt.Errorf("failed to create state manager: %w", err)
+	}
+	if err := stateMgr.MarkUsed(heartbeatID, time.Now()); err != nil {
+		return err
+	}
+	if heartbeatEvery == 0 {
+		return nil
+	}
+
+	ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ticker := time.NewTicker(heartbeatEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			// Ends once the environment has been cleaned up
+			if err := stateMgr.MarkUsed(heartbeatID, time.Now()); err != nil {
+				return err
+			}
+		}
+	}
+}
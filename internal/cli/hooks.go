@@ -0,0 +1,89 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+)
+
+// HooksDir is the worktree-relative directory searched for hook executables.
+const HooksDir = ".portalloc/hooks"
+
+const (
+	hookPostCreate = "post-create"
+	hookPreCleanup = "pre-cleanup"
+)
+
+// hookKillGrace is how long a cancelled hook gets to exit before being killed.
+const hookKillGrace = 5 * time.Second
+
+// noHooks disables hook execution (--no-hooks on create, run, and cleanup).
+var noHooks bool
+
+// environmentVars returns the process environment with env's variables added.
+func environmentVars(env *isolation.Environment) []string {
+	vars := os.Environ()
+	for name, value := range env.Vars() {
+		vars = append(vars, name+"="+value)
+	}
+	return vars
+}
+
+// runHook runs the named hook from the environment's worktree, if present.
+// Hook output goes to stderr so --json and --shell output stay parseable.
+// The hook is terminated when ctx is done.
+func runHook(ctx context.Context, name string, env *isolation.Environment) error {
+	if noHooks || env.WorktreePath == "" {
+		return nil
+	}
+
+	path := filepath.Join(env.WorktreePath, HooksDir, name)
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat %s hook: %w", name, err)
+	}
+	if info.IsDir() || info.Mode()&0o111 == 0 {
+		fmt.Fprintf(os.Stderr, emoji("⚠️  Ignoring %s hook: %s is not executable\n"), name, path)
+		return nil
+	}
+
+	// #nosec G204 - hooks are executables checked into the user's worktree
+	c := exec.CommandContext(ctx, path)
+	c.Cancel = func() error { return c.Process.Signal(syscall.SIGTERM) }
+	c.WaitDelay = hookKillGrace
+	c.Dir = env.WorktreePath
+	c.Env = append(environmentVars(env), "PORTALLOC_HOOK="+name)
+	c.Stdout, c.Stderr = os.Stderr, os.Stderr
+
+	start := time.Now()
+	err = c.Run()
+	logger.Info("hook finished", "hook", name, "isolation_id", env.ID, "duration", time.Since(start), "error", err)
+	if err != nil {
+		return fmt.Errorf("%s hook failed: %w", name, err)
+	}
+	return nil
+}
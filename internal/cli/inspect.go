@@ -0,0 +1,199 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	inspectID   string
+	inspectName string
+	inspectDir  string
+	inspectJSON bool
+)
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect",
+	Short: "Show details of a single environment",
+	Long: `Inspect prints everything recorded about one environment in the state
+file: status, owning process, paths, allocated ports, and the git branch
+and commit it was created from.
+
+Every temp directory holds a MANIFEST naming its environment, creator
+(user, host, and PID), worktree, and ports. Inspect checks it against the
+state file and reports a missing or mismatched manifest. With --dir, the
+environment is the one named by the directory's MANIFEST, so a stray temp
+directory can be traced; if the state file does not record it, inspect
+reports who created it and fails.`,
+	Example: `  # Inspect an environment
+  go-portalloc inspect --id abc123def456
+
+  # Inspect by name (see 'create --name')
+  go-portalloc inspect --name payments-it
+
+  # Who owns this leftover temp directory?
+  go-portalloc inspect --dir /tmp/portalloc-abc123def456
+
+  # Inspect as JSON
+  go-portalloc inspect --id abc123def456 --json`,
+	RunE: runInspect,
+}
+
+func init() {
+	inspectCmd.Flags().StringVar(&inspectID, "id", "", "Isolation ID to inspect (or --name)")
+	inspectCmd.Flags().StringVar(&inspectName, "name", "", "Environment name (instead of --id)")
+	inspectCmd.Flags().StringVar(&inspectDir, "dir", "", "Temp directory whose MANIFEST names the environment (instead of --id)")
+	inspectCmd.Flags().BoolVar(&inspectJSON, "json", false, "Output as JSON")
+	inspectCmd.MarkFlagsOneRequired("id", "name", "dir")
+	inspectCmd.MarkFlagsMutuallyExclusive("id", "name", "dir")
+}
+
+// inspectOutput is the JSON output of inspect.
+type inspectOutput struct {
+	listOutputEntry
+	Manifest manifestCheck `json:"manifest"`
+}
+
+// manifestCheck is the result of verifying an environment's MANIFEST.
+type manifestCheck struct {
+	// Status is "ok", "missing", "invalid", or "mismatch".
+	Status   string   `json:"status"`
+	Problems []string `json:"problems,omitempty"`
+	User     string   `json:"user,omitempty"`
+	Host     string   `json:"host,omitempty"`
+	PID      int      `json:"pid,omitempty"`
+}
+
+// checkManifest verifies the MANIFEST in env's temp directory.
+func checkManifest(env *state.EnvironmentState) manifestCheck {
+	manifest, err := isolation.ReadManifest(env.TempDir)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return manifestCheck{Status: "missing"}
+	case err != nil:
+		return manifestCheck{Status: "invalid", Problems: []string{err.Error()}}
+	}
+	check := manifestCheck{Status: "ok", User: manifest.User, Host: manifest.Host, PID: manifest.PID}
+	if check.Problems = manifest.Verify(env.Environment()); len(check.Problems) > 0 {
+		check.Status = "mismatch"
+	}
+	return check
+}
+
+// formatCreator describes who created an environment, as "user@host".
+func formatCreator(user, host string) string {
+	switch {
+	case user != "" && host != "":
+		return user + "@" + host
+	case user != "":
+		return user
+	case host != "":
+		return host
+	}
+	return "unknown"
+}
+
+func runInspect(cmd *cobra.Command, args []string) error {
+	if err := resolveEnvironmentFlag(&inspectID, inspectName); err != nil {
+		return err
+	}
+	var manifest *isolation.Manifest
+	if inspectDir != "" {
+		m, err := isolation.ReadManifest(inspectDir)
+		if err != nil {
+			return fmt.Errorf("failed to identify %s: %w", inspectDir, err)
+		}
+		manifest, inspectID = m, m.ID
+	}
+
+	mgr, err := newStateManager()
+	if err != nil {
+		return fmt.Errorf("failed to create state manager: %w", err)
+	}
+
+	env, err := mgr.GetEnvironment(inspectID)
+	if manifest != nil && errors.Is(err, state.ErrNotFound) {
+		return fmt.Errorf("%s belongs to environment %s, created by %s (PID %d) on %s, which is not recorded in the state file (run 'go-portalloc reconcile', or 'go-portalloc doctor --fix' to remove orphaned directories)",
+			inspectDir, manifest.ID, formatCreator(manifest.User, manifest.Host), manifest.PID, manifest.CreatedAt.Format(time.RFC3339))
+	}
+	if err != nil {
+		return err
+	}
+	check := checkManifest(env)
+
+	if inspectJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(&inspectOutput{listOutputEntry: newListOutputEntry(env), Manifest: check})
+	}
+
+	status := state.GetEnvironmentStatus(env)
+
+	fmt.Printf("  Isolation ID:   %s\n", env.ID)
+	if env.Name != "" {
+		fmt.Printf("  Name:           %s\n", env.Name)
+	}
+	if env.Project != "" {
+		fmt.Printf("  Project:        %s\n", env.Project)
+	}
+	fmt.Printf("  Status:         %s\n", status)
+	fmt.Printf("  PID:            %d\n", env.PID)
+	fmt.Printf("  Created:        %s (%s)\n", env.CreatedAt.Format(time.RFC3339), formatTimeAgo(env.CreatedAt))
+	if !env.LastUsedAt.IsZero() {
+		fmt.Printf("  Last Used:      %s (%s)\n", env.LastUsedAt.Format(time.RFC3339), formatTimeAgo(env.LastUsedAt))
+	}
+	fmt.Printf("  Worktree:       %s\n", env.WorktreePath)
+	fmt.Printf("  Git:            %s\n", formatGit(env.GitBranch, env.GitCommit))
+	fmt.Printf("  Temp Directory: %s\n", env.TempDir)
+	switch check.Status {
+	case "ok":
+		fmt.Printf("  Manifest:       ok (created by %s, PID %d)\n", formatCreator(check.User, check.Host), check.PID)
+	case "missing":
+		fmt.Println("  Manifest:       missing")
+	default:
+		fmt.Printf("  Manifest:       %s: %s\n", check.Status, strings.Join(check.Problems, "; "))
+	}
+	if size, err := env.DiskUsage(); err == nil {
+		fmt.Printf("  Disk Usage:     %s\n", formatSize(size))
+	}
+	fmt.Printf("  Lock File:      %s\n", env.LockFile)
+	fmt.Printf("  Env File:       %s\n", env.EnvFile)
+	if env.Ports != nil {
+		fmt.Printf("  Base Port:      %d\n", env.Ports.BasePort)
+		fmt.Printf("  Port Count:     %d\n", env.Ports.Count)
+		fmt.Printf("  Allocated Ports: %v\n", env.Ports.Allocated)
+	}
+	if env.DockerNetwork != "" {
+		fmt.Printf("  Docker Network: %s\n", env.DockerNetwork)
+	}
+	if env.IdempotencyKey != "" {
+		fmt.Printf("  Idempotency Key: %s\n", env.IdempotencyKey)
+	}
+	for _, m := range env.ComposePorts {
+		fmt.Printf("  Compose Port:   %s %s -> %d (container %s)\n", m.Service, m.Published, m.Port, m.Target)
+	}
+
+	return nil
+}
@@ -18,10 +18,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"slices"
+	"sort"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
 	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
 	"github.com/spf13/cobra"
 )
@@ -30,6 +35,12 @@ var (
 	listFormat    string
 	listLockDir   string
 	listReconcile bool
+	listFollow    bool
+	listProbe     bool
+	listAllProj   bool
+	listGroupBy   string
+	listMaxAge    time.Duration
+	listMaxIdle   time.Duration
 )
 
 var listCmd = &cobra.Command{
@@ -39,27 +50,59 @@ var listCmd = &cobra.Command{
 
 This command displays all environments currently tracked by go-portalloc.
 It shows the environment ID, status (active/stale), allocated ports,
-creation time, process ID, and worktree path.`,
+creation time, process ID, and worktree path.
+
+With --probe, each environment's allocated ports are checked and the
+number currently bound is shown (e.g. "3/5 bound"), which tells
+environments whose services are running apart from ones that only hold
+a reservation.
+
+IDLE is the time since the environment was last used by env, validate,
+run, or heartbeat, or since its lock was last touched. With
+--max-age or --max-idle (or list_thresholds in the config file),
+environments past a threshold are flagged with "!" (highlighted on a
+terminal), since a live PID alone does not mean an environment is in use.`,
 	Example: `  # List all environments in table format
   go-portalloc list
 
   # List in JSON format
   go-portalloc list --format json
 
+  # Show how many allocated ports are actually bound
+  go-portalloc list --probe
+
+  # Flag environments older than a day or untouched for two hours
+  go-portalloc list --max-age 24h --max-idle 2h
+
+  # Show environments from every project, not just the current one
+  go-portalloc list --all-projects
+
+  # Which repository holds the most environments and ports?
+  go-portalloc list --group-by worktree
+
   # Force reconcile before listing
-  go-portalloc list --reconcile`,
+  go-portalloc list --reconcile
+
+  # Stream lifecycle events as JSONL (see 'watch')
+  go-portalloc list --follow`,
 	RunE: runList,
 }
 
 func init() {
 	listCmd.Flags().StringVar(&listFormat, "format", "table", "Output format (table, json)")
-	listCmd.Flags().StringVar(&listLockDir, "lock-dir", filepath.Join(os.TempDir(), "go-portalloc-locks"), "Lock directory path")
+	listCmd.Flags().StringVar(&listLockDir, "lock-dir", defaultLockDir, "Lock directory path")
 	listCmd.Flags().BoolVar(&listReconcile, "reconcile", false, "Force reconcile before listing")
+	listCmd.Flags().BoolVar(&listProbe, "probe", false, "Check how many allocated ports are bound right now")
+	listCmd.Flags().BoolVar(&listAllProj, "all-projects", false, "List environments from every project, not just the current one")
+	listCmd.Flags().StringVar(&listGroupBy, "group-by", "", "Group environments by worktree, status, or host, with per-group counts")
+	listCmd.Flags().DurationVar(&listMaxAge, "max-age", 0, "Flag environments created longer ago than this (default: config list_thresholds.max_age)")
+	listCmd.Flags().DurationVar(&listMaxIdle, "max-idle", 0, "Flag environments idle longer than this (default: config list_thresholds.max_idle)")
+	listCmd.Flags().BoolVar(&listFollow, "follow", false, "Stream created/removed/stale events as JSONL instead of listing")
 }
 
 func runList(cmd *cobra.Command, args []string) error {
 	// Create state manager
-	mgr, err := state.NewManager()
+	mgr, err := newStateManager()
 	if err != nil {
 		return fmt.Errorf("failed to create state manager: %w", err)
 	}
@@ -71,67 +114,292 @@ func runList(cmd *cobra.Command, args []string) error {
 		}
 	}
 
+	if listFollow {
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		return followEvents(ctx, os.Stdout, time.Second, false)
+	}
+
 	// List environments
 	envs, err := mgr.ListEnvironments()
 	if err != nil {
 		return fmt.Errorf("failed to list environments: %w", err)
 	}
+	if err := mgr.StoreError(); err != nil {
+		fmt.Fprintf(os.Stderr, emoji("⚠️  Shared state unavailable (%v); listing this host only\n"), err)
+	}
 
-	if len(envs) == 0 {
-		fmt.Println("No environments found")
-		return nil
+	if listFormat != "json" && listFormat != "table" {
+		return usageErrorf("unknown format: %s", listFormat)
+	}
+	groupKey, ok := listGroupKeys[listGroupBy]
+	if listGroupBy != "" && !ok {
+		return usageErrorf("unknown --group-by: %s (expected worktree, status, or host)", listGroupBy)
+	}
+
+	thresholds, err := loadListThresholds(listMaxAge, listMaxIdle)
+	if err != nil {
+		return err
 	}
 
-	// Output based on format
-	switch listFormat {
-	case "json":
-		return outputListJSON(envs)
-	case "table":
-		return outputListTable(envs)
+	hidden := 0
+	if !listAllProj {
+		project, err := currentProject("")
+		if err != nil {
+			return err
+		}
+		envs, hidden = filterProject(envs, project)
+	}
+
+	if listFormat == "json" {
+		if len(envs) == 0 {
+			fmt.Println("No environments found")
+			return nil
+		}
+		if groupKey != nil {
+			return outputListGroupsJSON(groupEnvironments(envs, groupKey), listProbe, thresholds)
+		}
+		return outputListJSON(envs, listProbe, thresholds)
+	}
+
+	switch {
+	case len(envs) == 0:
+		fmt.Println("No environments found")
+	case groupKey != nil:
+		if err := outputListGroups(groupEnvironments(envs, groupKey), listProbe, thresholds); err != nil {
+			return err
+		}
 	default:
-		return fmt.Errorf("unknown format: %s", listFormat)
+		if err := outputListTable(envs, listProbe, thresholds); err != nil {
+			return err
+		}
+		fmt.Printf("\nTotal: %d environment(s)\n", len(envs))
+	}
+	if hidden > 0 {
+		fmt.Printf("(%d in other projects hidden; use --all-projects)\n", hidden)
 	}
+
+	// Orphans are informational; failing to scan must not break list
+	if orphans, err := mgr.FindOrphanedTempDirs(os.TempDir(), listLockDir); err == nil && len(orphans) > 0 {
+		outputOrphans(orphans)
+	}
+
+	return nil
+}
+
+// listOutputEntry is a single element of the 'list --format json' output.
+type listOutputEntry struct {
+	ID           string                  `json:"id"`
+	Name         string                  `json:"name,omitempty"`
+	Project      string                  `json:"project,omitempty"`
+	Status       state.EnvironmentStatus `json:"status"`
+	PID          int                     `json:"pid"`
+	CreatedAt    string                  `json:"created_at"`
+	LastUsedAt   string                  `json:"last_used_at,omitempty"`
+	WorktreePath string                  `json:"worktree_path"`
+	TempDir      string                  `json:"temp_dir"`
+	LockFile     string                  `json:"lock_file"`
+	EnvFile      string                  `json:"env_file"`
+	EnvFiles     []string                `json:"env_files,omitempty"`
+	GitBranch    string                  `json:"git_branch,omitempty"`
+	GitCommit    string                  `json:"git_commit,omitempty"`
+	AgeSeconds   int64                   `json:"age_seconds"`
+	IdleSeconds  int64                   `json:"idle_seconds"`
+	// Flags name the thresholds the environment exceeds ("age", "idle").
+	Flags        []string            `json:"flags,omitempty"`
+	DiskUsage    int64               `json:"disk_usage_bytes"`
+	ComposePorts []state.ComposePort `json:"compose_ports,omitempty"`
+	Ports        listOutputPorts     `json:"ports"`
+}
+
+// listOutputPorts is the port section of listOutputEntry.
+type listOutputPorts struct {
+	BasePort  int   `json:"base_port"`
+	Count     int   `json:"count"`
+	Allocated []int `json:"allocated"`
+	// Bound is the number of allocated ports in use, set by 'list --probe'
+	Bound *int `json:"bound,omitempty"`
+}
+
+// newListOutputEntry converts a state entry into its JSON output form.
+func newListOutputEntry(env *state.EnvironmentState) listOutputEntry {
+	entry := listOutputEntry{
+		ID:           env.ID,
+		Name:         env.Name,
+		Project:      env.Project,
+		Status:       state.GetEnvironmentStatus(env),
+		PID:          env.PID,
+		CreatedAt:    env.CreatedAt.Format(time.RFC3339),
+		WorktreePath: env.WorktreePath,
+		TempDir:      env.TempDir,
+		LockFile:     env.LockFile,
+		EnvFile:      env.EnvFile,
+		EnvFiles:     env.EnvFiles,
+		GitBranch:    env.GitBranch,
+		GitCommit:    env.GitCommit,
+		ComposePorts: env.ComposePorts,
+		AgeSeconds:   int64(time.Since(env.CreatedAt).Seconds()),
+		IdleSeconds:  int64(time.Since(env.LastActivity()).Seconds()),
+	}
+	if !env.LastUsedAt.IsZero() {
+		entry.LastUsedAt = env.LastUsedAt.Format(time.RFC3339)
+	}
+	// Best effort: an unreadable temp dir reports what could be measured
+	entry.DiskUsage, _ = env.DiskUsage()
+	if env.Ports != nil {
+		entry.Ports = listOutputPorts{
+			BasePort:  env.Ports.BasePort,
+			Count:     env.Ports.Count,
+			Allocated: env.Ports.Allocated,
+		}
+	}
+	return entry
+}
+
+func outputListJSON(envs []*state.EnvironmentState, probe bool, thresholds listThresholds) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(newListOutputEntries(envs, probe, thresholds))
 }
 
-func outputListJSON(envs []*state.EnvironmentState) error {
-	output := make([]map[string]interface{}, 0, len(envs))
+// newListOutputEntries converts state entries into their JSON output form,
+// counting bound ports if probe is set and flagging exceeded thresholds.
+func newListOutputEntries(envs []*state.EnvironmentState, probe bool, thresholds listThresholds) []listOutputEntry {
+	output := make([]listOutputEntry, 0, len(envs))
 
+	var allocator *ports.Allocator
+	if probe {
+		allocator = newProbeAllocator()
+	}
+	now := time.Now()
 	for _, env := range envs {
-		status := state.GetEnvironmentStatus(env)
-		output = append(output, map[string]interface{}{
-			"id":            env.ID,
-			"status":        status,
-			"pid":           env.PID,
-			"created_at":    env.CreatedAt.Format(time.RFC3339),
-			"worktree_path": env.WorktreePath,
-			"temp_dir":      env.TempDir,
-			"lock_file":     env.LockFile,
-			"env_file":      env.EnvFile,
-			"ports": map[string]interface{}{
-				"base_port": env.Ports.BasePort,
-				"count":     env.Ports.Count,
-				"allocated": env.Ports.Allocated,
-			},
-		})
+		entry := newListOutputEntry(env)
+		if probe {
+			bound, _ := countBoundPorts(allocator, env)
+			entry.Ports.Bound = &bound
+		}
+		entry.Flags = thresholds.exceeded(env, now)
+		output = append(output, entry)
 	}
+	return output
+}
+
+// listGroupKeys are the --group-by values and the group each environment
+// falls in.
+var listGroupKeys = map[string]func(*state.EnvironmentState) string{
+	"worktree": func(env *state.EnvironmentState) string { return env.WorktreePath },
+	"status":   func(env *state.EnvironmentState) string { return string(state.GetEnvironmentStatus(env)) },
+	"host": func(env *state.EnvironmentState) string {
+		if env.Host != "" {
+			return env.Host
+		}
+		return isolation.Hostname()
+	},
+}
 
+// listGroup is a group of environments in 'list --group-by' output.
+type listGroup struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+	// Ports is the number of ports allocated to the group.
+	Ports int `json:"ports"`
+	envs  []*state.EnvironmentState
+	// Environments is only set in JSON output.
+	Environments []listOutputEntry `json:"environments"`
+}
+
+// groupEnvironments groups envs by key, the groups holding the most ports
+// first.
+func groupEnvironments(envs []*state.EnvironmentState, key func(*state.EnvironmentState) string) []*listGroup {
+	byKey := make(map[string]*listGroup)
+	var groups []*listGroup
+	for _, env := range envs {
+		k := key(env)
+		group, ok := byKey[k]
+		if !ok {
+			group = &listGroup{Key: k}
+			byKey[k] = group
+			groups = append(groups, group)
+		}
+		group.envs = append(group.envs, env)
+		group.Count++
+		if env.Ports != nil {
+			group.Ports += len(env.Ports.Allocated)
+		}
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].Ports != groups[j].Ports {
+			return groups[i].Ports > groups[j].Ports
+		}
+		return groups[i].Key < groups[j].Key
+	})
+	return groups
+}
+
+func outputListGroups(groups []*listGroup, probe bool, thresholds listThresholds) error {
+	total, allocated := 0, 0
+	for _, group := range groups {
+		fmt.Printf("== %s: %d environment(s), %d port(s)\n", orDash(group.Key), group.Count, group.Ports)
+		if err := outputListTable(group.envs, probe, thresholds); err != nil {
+			return err
+		}
+		fmt.Println()
+		total += group.Count
+		allocated += group.Ports
+	}
+	fmt.Printf("Total: %d environment(s), %d port(s) in %d group(s)\n", total, allocated, len(groups))
+	return nil
+}
+
+func outputListGroupsJSON(groups []*listGroup, probe bool, thresholds listThresholds) error {
+	for _, group := range groups {
+		group.Environments = newListOutputEntries(group.envs, probe, thresholds)
+	}
 	encoder := json.NewEncoder(os.Stdout)
 	encoder.SetIndent("", "  ")
-	return encoder.Encode(output)
+	return encoder.Encode(groups)
 }
 
-func outputListTable(envs []*state.EnvironmentState) error {
-	// Print header
-	fmt.Printf("%-15s %-8s %-15s %-20s %-8s %s\n",
-		"ID", "STATUS", "PORTS", "CREATED", "PID", "WORKTREE")
-	fmt.Println(strings.Repeat("-", 120))
+func outputListTable(envs []*state.EnvironmentState, probe bool, thresholds listThresholds) error {
+	// The NAME column is only shown when some environment has a name, and
+	// the PROJECT column only when environments span several projects
+	named := false
+	projects := make(map[string]bool)
+	for _, env := range envs {
+		projects[env.Project] = true
+		named = named || env.Name != ""
+	}
+	multiProject := len(projects) > 1
+
+	// The BOUND column is only shown with --probe
+	var allocator *ports.Allocator
+	if probe {
+		allocator = newProbeAllocator()
+	}
 
-	// Print environments
+	header := []string{"ID"}
+	if named {
+		header = append(header, "NAME")
+	}
+	if multiProject {
+		header = append(header, "PROJECT")
+	}
+	header = append(header, "STATUS", "PORTS")
+	if probe {
+		header = append(header, "BOUND")
+	}
+	header = append(header, "CREATED", "IDLE", "PID", "DISK", "GIT", "WORKTREE")
+
+	t := &table{rule: true}
+	t.add(header...)
+
+	now := time.Now()
+	flagged := false
 	for _, env := range envs {
 		status := state.GetEnvironmentStatus(env)
-		statusStr := string(status)
+		statusStr := paint(colorGreen, string(status))
 		if status == state.StatusStale {
-			statusStr += " ⚠️"
+			statusStr = paint(colorYellow, emoji(string(status)+emoji(" ⚠️")))
 		}
 
 		// Format ports
@@ -146,8 +414,24 @@ func outputListTable(envs []*state.EnvironmentState) error {
 			}
 		}
 
-		// Format created time
-		createdStr := formatTimeAgo(env.CreatedAt)
+		row := []string{env.ID}
+		if named {
+			row = append(row, orDash(env.Name))
+		}
+		if multiProject {
+			row = append(row, orDash(env.Project))
+		}
+		row = append(row, statusStr, portsStr)
+		if probe {
+			bound, total := countBoundPorts(allocator, env)
+			row = append(row, fmt.Sprintf("%d/%d bound", bound, total))
+		}
+
+		// Age and idle time, flagged past the thresholds
+		exceeded := thresholds.exceeded(env, now)
+		flagged = flagged || len(exceeded) > 0
+		createdStr := flagCell(formatTimeAgo(env.CreatedAt), slices.Contains(exceeded, "age"))
+		idleStr := flagCell(formatIdle(now.Sub(env.LastActivity())), slices.Contains(exceeded, "idle"))
 
 		// Format PID
 		pidStr := fmt.Sprintf("%d", env.PID)
@@ -161,20 +445,99 @@ func outputListTable(envs []*state.EnvironmentState) error {
 			worktree = "..." + worktree[len(worktree)-37:]
 		}
 
-		fmt.Printf("%-15s %-8s %-15s %-20s %-8s %s\n",
-			truncate(env.ID, 15),
-			statusStr,
-			portsStr,
-			createdStr,
-			pidStr,
-			worktree)
-	}
+		// Disk usage is computed on demand from the temp directory
+		diskStr := "-"
+		if size, err := env.DiskUsage(); err == nil {
+			diskStr = formatSize(size)
+		}
 
-	fmt.Printf("\nTotal: %d environment(s)\n", len(envs))
+		row = append(row, createdStr, idleStr, pidStr, diskStr,
+			truncate(formatGit(env.GitBranch, env.GitCommit), 25), worktree)
+		t.add(row...)
+	}
+	if err := t.write(os.Stdout); err != nil {
+		return err
+	}
+	if flagged {
+		fmt.Printf("\n! exceeds %s\n", thresholds)
+	}
 
 	return nil
 }
 
+// listThresholds flag environments in 'list' that are older or idler than
+// expected; zero disables a check.
+type listThresholds struct {
+	maxAge, maxIdle time.Duration
+}
+
+// exceeded names the thresholds env exceeds at now: "age" and/or "idle".
+func (t listThresholds) exceeded(env *state.EnvironmentState, now time.Time) []string {
+	var exceeded []string
+	if t.maxAge > 0 && now.Sub(env.CreatedAt) > t.maxAge {
+		exceeded = append(exceeded, "age")
+	}
+	if t.maxIdle > 0 && now.Sub(env.LastActivity()) > t.maxIdle {
+		exceeded = append(exceeded, "idle")
+	}
+	return exceeded
+}
+
+func (t listThresholds) String() string {
+	var parts []string
+	if t.maxAge > 0 {
+		parts = append(parts, "age "+t.maxAge.String())
+	}
+	if t.maxIdle > 0 {
+		parts = append(parts, "idle "+t.maxIdle.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// flagCell marks s with "!" when flagged, highlighted on a color terminal.
+func flagCell(s string, flagged bool) string {
+	if !flagged {
+		return s
+	}
+	return paint(colorYellow, s+" !")
+}
+
+// formatIdle renders how long an environment has been idle ("<1m", "5m", "3h", "2d").
+func formatIdle(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return "<1m"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+}
+
+// countBoundPorts returns how many of env's allocated ports are in use, and
+// how many ports it has allocated.
+func countBoundPorts(allocator *ports.Allocator, env *state.EnvironmentState) (bound, total int) {
+	if env.Ports == nil {
+		return 0, 0
+	}
+	for _, port := range env.Ports.Allocated {
+		if allocator.IsPortInUse(port) {
+			bound++
+		}
+	}
+	return bound, len(env.Ports.Allocated)
+}
+
+func outputOrphans(orphans []*state.OrphanedDir) {
+	fmt.Printf("\nOrphaned temp directories (no lock file or state entry):\n")
+	for _, orphan := range orphans {
+		fmt.Printf("  %s (modified %s)\n", orphan.Path, formatTimeAgo(orphan.ModTime))
+	}
+	fmt.Println("Run 'go-portalloc cleanup --orphans' to remove them")
+}
+
 func formatTimeAgo(t time.Time) string {
 	duration := time.Since(t)
 
@@ -202,6 +565,20 @@ func formatTimeAgo(t time.Time) string {
 	}
 }
 
+// formatGit renders branch and commit as "branch@commit" ("-" outside git).
+func formatGit(branch, commit string) string {
+	switch {
+	case branch != "" && commit != "":
+		return branch + "@" + commit
+	case commit != "":
+		return commit
+	case branch != "":
+		return branch
+	default:
+		return "-"
+	}
+}
+
 func truncate(s string, maxLen int) string {
 	if len(s) <= maxLen {
 		return s
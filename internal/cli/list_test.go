@@ -0,0 +1,73 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupEnvironments(t *testing.T) {
+	withPorts := func(id, worktree string, count int) *state.EnvironmentState {
+		return &state.EnvironmentState{ID: id, WorktreePath: worktree, Ports: &state.PortsState{Allocated: make([]int, count)}}
+	}
+	envs := []*state.EnvironmentState{
+		withPorts("a1", "/src/a", 2),
+		withPorts("b1", "/src/b", 5),
+		withPorts("a2", "/src/a", 2),
+		withPorts("c1", "/src/c", 4),
+		{ID: "d1", WorktreePath: "/src/d"},
+	}
+
+	groups := groupEnvironments(envs, listGroupKeys["worktree"])
+	require.Len(t, groups, 4)
+	assert.Equal(t, "/src/b", groups[0].Key)
+	assert.Equal(t, "/src/a", groups[1].Key, "ties are broken by key")
+	assert.Equal(t, 2, groups[1].Count)
+	assert.Equal(t, 4, groups[1].Ports)
+	assert.Equal(t, "/src/c", groups[2].Key)
+	assert.Equal(t, 0, groups[3].Ports)
+
+	groups = groupEnvironments(envs, listGroupKeys["status"])
+	require.Len(t, groups, 1)
+	assert.Equal(t, string(state.StatusStale), groups[0].Key)
+	assert.Equal(t, 5, groups[0].Count)
+}
+
+func TestListThresholds(t *testing.T) {
+	now := time.Now()
+	lockFile := filepath.Join(t.TempDir(), "env-abc.lock")
+	require.NoError(t, os.WriteFile(lockFile, nil, 0o600))
+	touched := now.Add(-3 * time.Hour)
+	require.NoError(t, os.Chtimes(lockFile, touched, touched))
+	env := &state.EnvironmentState{ID: "abc", CreatedAt: now.Add(-48 * time.Hour), LockFile: lockFile}
+
+	assert.Empty(t, listThresholds{}.exceeded(env, now), "no thresholds")
+	assert.Equal(t, []string{"age", "idle"}, listThresholds{maxAge: 24 * time.Hour, maxIdle: time.Hour}.exceeded(env, now))
+	assert.Equal(t, []string{"idle"}, listThresholds{maxAge: 72 * time.Hour, maxIdle: time.Hour}.exceeded(env, now))
+	assert.Empty(t, listThresholds{maxIdle: 4 * time.Hour}.exceeded(env, now))
+	assert.Equal(t, "age 24h0m0s, idle 1h0m0s", listThresholds{maxAge: 24 * time.Hour, maxIdle: time.Hour}.String())
+
+	assert.Equal(t, "3h", flagCell(formatIdle(3*time.Hour), false))
+	assert.Equal(t, "3h !", flagCell(formatIdle(3*time.Hour), true))
+	assert.Equal(t, "<1m", formatIdle(time.Second))
+	assert.Equal(t, "2d", formatIdle(50*time.Hour))
+}
@@ -0,0 +1,129 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/internal/daemon"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// logFormatEnv selects the log format when --log-format is not given.
+	logFormatEnv = "PORTALLOC_LOG_FORMAT"
+	// debugEnv enables debug logs like --verbose when set to a true value.
+	debugEnv = "PORTALLOC_DEBUG"
+)
+
+var (
+	// logFormat is the --log-format flag.
+	logFormat string
+	// verbose is the --verbose flag.
+	verbose bool
+)
+
+// logger receives structured logs on stderr; it discards them unless a log
+// format is selected, so stdout stays reserved for command output.
+var logger = slog.New(slog.DiscardHandler)
+
+// setupLogging configures logger from --log-format or PORTALLOC_LOG_FORMAT,
+// and --verbose or PORTALLOC_DEBUG. Verbose output defaults to text.
+func setupLogging(cmd *cobra.Command, args []string) error {
+	format := logFormat
+	if !cmd.Flags().Changed("log-format") {
+		format = os.Getenv(logFormatEnv)
+	}
+
+	debug := verbose
+	if !cmd.Flags().Changed("verbose") {
+		debug, _ = strconv.ParseBool(os.Getenv(debugEnv))
+	}
+
+	opts := &slog.HandlerOptions{Level: slog.LevelInfo}
+	if debug {
+		opts.Level = slog.LevelDebug
+		if format == "" || format == "none" {
+			format = "text"
+		}
+	}
+
+	switch format {
+	case "", "none":
+		logger = slog.New(slog.DiscardHandler)
+	case "text":
+		logger = slog.New(slog.NewTextHandler(os.Stderr, opts))
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	default:
+		return fmt.Errorf("unknown log format: %s (expected none, text, or json)", format)
+	}
+	return nil
+}
+
+// newPortAllocator returns an allocator with the default range that traces
+// allocation attempts to logger at debug level and skips the config file's
+// reserved ports and the ports leased from serve.
+func newPortAllocator() (*ports.Allocator, error) {
+	config, err := newAllocatorConfig("")
+	if err != nil {
+		return nil, err
+	}
+	return ports.NewAllocator(config), nil
+}
+
+// newAllocatorConfig returns the configuration of newPortAllocator, with the
+// ports of reservedFile reserved instead when it is set.
+func newAllocatorConfig(reservedFile string) (*ports.AllocatorConfig, error) {
+	reserved, err := loadReservedPorts(reservedFile)
+	if err != nil {
+		return nil, err
+	}
+	if reserved, err = daemon.ReserveLeasedPorts(reserved, leaseFilePath()); err != nil {
+		return nil, err
+	}
+	config := ports.DefaultAllocatorConfig()
+	config.Logger = logger
+	config.Reserved = reserved
+	return config, nil
+}
+
+// newProbeAllocator returns an allocator for checking whether ports are in
+// use. Reserved ports don't affect probes, so the reserved file is not read.
+func newProbeAllocator() *ports.Allocator {
+	config := ports.DefaultAllocatorConfig()
+	config.Logger = logger
+	return ports.NewAllocator(config)
+}
+
+// logEnvironment logs msg with the environment's ID and ports and, unless
+// start is zero, the time elapsed since start.
+func logEnvironment(msg string, env *state.EnvironmentState, start time.Time, args ...any) {
+	var allocated []int
+	if env.Ports != nil {
+		allocated = env.Ports.Allocated
+	}
+	attrs := []any{"isolation_id", env.ID, "ports", allocated}
+	if !start.IsZero() {
+		attrs = append(attrs, "duration", time.Since(start))
+	}
+	logger.Info(msg, append(attrs, args...)...)
+}
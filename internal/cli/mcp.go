@@ -0,0 +1,219 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/pigeonworks-llc/go-portalloc/internal/mcp"
+	"github.com/spf13/cobra"
+)
+
+var mcpLockDir string
+
+var mcpCmd = &cobra.Command{
+	Use:   "mcp",
+	Short: "Serve go-portalloc as Model Context Protocol tools over stdio",
+	Long: `MCP runs a Model Context Protocol server on stdin/stdout so coding agents
+can request collision-free ports instead of guessing. It exposes these tools:
+
+  allocate_ports        Find N consecutive free ports (not reserved)
+  create_environment    Create an isolated environment with reserved ports
+  list_environments     List recorded environments and their status
+  cleanup_environment   Remove an environment by isolation ID
+
+Environments created through MCP are owned by the server process: they
+show as active while the agent session runs and as stale after it ends,
+so 'cleanup --stale' reclaims anything the agent forgot. Hooks run as
+with create and cleanup; their output goes to stderr.`,
+	Example: `  # Register with an MCP client (e.g. in its server config)
+  {"command": "go-portalloc", "args": ["mcp"]}`,
+	Args: cobra.NoArgs,
+	RunE: runMCP,
+}
+
+func init() {
+	mcpCmd.Flags().StringVar(&mcpLockDir, "lock-dir", defaultLockDir, "Lock directory path")
+}
+
+func runMCP(cmd *cobra.Command, args []string) error {
+	// stdout carries the protocol; keep usage text off it
+	cmd.SilenceUsage = true
+	return newMCPServer().Serve(cmd.Context(), os.Stdin, os.Stdout)
+}
+
+// newMCPServer builds the server with all go-portalloc tools registered.
+func newMCPServer() *mcp.Server {
+	server := mcp.NewServer("go-portalloc", Version)
+
+	server.AddTool(&mcp.Tool{
+		Name: "allocate_ports",
+		Description: "Find consecutive free TCP ports. The ports are only checked, not reserved; " +
+			"use create_environment when other processes may allocate concurrently.",
+		InputSchema: objectSchema(map[string]interface{}{
+			"count": map[string]interface{}{"type": "integer", "minimum": 1, "description": "Number of consecutive ports (default 1)"},
+		}),
+		Handler: mcpAllocatePorts,
+	})
+	server.AddTool(&mcp.Tool{
+		Name: "create_environment",
+		Description: "Create an isolated environment: a unique isolation ID, a reserved block of consecutive ports, " +
+			"a temp directory, and an env file with PORT_BASE, PORT_0... variables.",
+		InputSchema: objectSchema(map[string]interface{}{
+			"ports":         map[string]interface{}{"type": "integer", "minimum": 1, "description": fmt.Sprintf("Number of ports to reserve (default %d)", defaultPorts)},
+			"worktree_path": map[string]interface{}{"type": "string", "description": "Directory to write the env file to (default: server working directory)"},
+			"instance_id":   map[string]interface{}{"type": "string", "description": "Extra input for the isolation ID, e.g. a task ID"},
+			"profile":       map[string]interface{}{"type": "string", "description": "Profile from the config file"},
+		}),
+		Handler: mcpCreateEnvironment,
+	})
+	server.AddTool(&mcp.Tool{
+		Name:        "list_environments",
+		Description: "List recorded environments with their ports and status (active or stale).",
+		InputSchema: objectSchema(map[string]interface{}{}),
+		Handler:     mcpListEnvironments,
+	})
+	server.AddTool(&mcp.Tool{
+		Name:        "cleanup_environment",
+		Description: "Remove an environment's lock, temp directory, env file, and state entry, releasing its ports.",
+		InputSchema: objectSchema(map[string]interface{}{
+			"id": map[string]interface{}{"type": "string", "description": "Isolation ID"},
+		}, "id"),
+		Handler: mcpCleanupEnvironment,
+	})
+
+	return server
+}
+
+func objectSchema(properties map[string]interface{}, required ...string) map[string]interface{} {
+	schema := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func mcpAllocatePorts(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		Count int `json:"count"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %w", err)
+	}
+	if args.Count == 0 {
+		args.Count = 1
+	}
+
+	allocator, err := newPortAllocator()
+	if err != nil {
+		return nil, err
+	}
+	basePort, err := allocator.AllocateRange(args.Count)
+	if err != nil {
+		return nil, err
+	}
+	ports := make([]int, args.Count)
+	for i := range ports {
+		ports[i] = basePort + i
+	}
+	return map[string]interface{}{"base_port": basePort, "ports": ports}, nil
+}
+
+func mcpCreateEnvironment(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		Ports        int    `json:"ports"`
+		WorktreePath string `json:"worktree_path"`
+		InstanceID   string `json:"instance_id"`
+		Profile      string `json:"profile"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %w", err)
+	}
+	if args.Ports == 0 {
+		args.Ports = defaultPorts
+	}
+	if args.WorktreePath == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get working directory: %w", err)
+		}
+		args.WorktreePath = wd
+	}
+
+	env, err := createRecordedEnvironment(ctx, &environmentRequest{
+		Ports:        args.Ports,
+		WorktreePath: args.WorktreePath,
+		InstanceID:   args.InstanceID,
+		Profile:      args.Profile,
+		LockDir:      mcpLockDir,
+		Via:          "mcp",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return newCreateOutput(env, nil), nil
+}
+
+func mcpListEnvironments(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	stateMgr, err := newStateManager()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create state manager: %w", err)
+	}
+	envs, err := stateMgr.ListEnvironments()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list environments: %w", err)
+	}
+
+	entries := make([]listOutputEntry, 0, len(envs))
+	for _, env := range envs {
+		entries = append(entries, newListOutputEntry(env))
+	}
+	return entries, nil
+}
+
+func mcpCleanupEnvironment(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %w", err)
+	}
+	if args.ID == "" {
+		return nil, fmt.Errorf("id is required")
+	}
+
+	stateMgr, err := newStateManager()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create state manager: %w", err)
+	}
+	recorded, err := stateMgr.GetEnvironment(args.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := removeRecordedEnvironment(ctx, stateMgr, recorded, mcpLockDir, "mcp"); err != nil {
+		return nil, err
+	}
+
+	return map[string]string{"removed": args.ID}, nil
+}
@@ -0,0 +1,126 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/internal/config"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/webhook"
+)
+
+// notifyTimeout bounds the time one command spends delivering webhooks, so
+// an unreachable endpoint cannot hold up create or cleanup with retries.
+var notifyTimeout = 3 * time.Second
+
+// notifyEvent sends a lifecycle event to the webhooks in the config file.
+// Delivery is best effort: failures are reported on stderr and never fail
+// the command that triggered them.
+func notifyEvent(eventType state.EventType, env *state.EnvironmentState) {
+	notifyEvents([]state.Event{{Type: eventType, Time: time.Now(), Environment: env}})
+}
+
+// notifyEvents sends each event in order within notifyTimeout and returns
+// the events that were delivered; see notifyEvent.
+func notifyEvents(events []state.Event) []state.Event {
+	if len(events) == 0 {
+		return nil
+	}
+
+	notifier := configuredNotifier()
+	if notifier == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	var delivered []state.Event
+	for _, event := range events {
+		body, err := json.Marshal(newWatchEvent(event))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, emoji("⚠️  Failed to encode %s event: %v\n"), event.Type, err)
+			continue
+		}
+		if err := notifier.Send(ctx, string(event.Type), body); err != nil {
+			fmt.Fprintf(os.Stderr, emoji("⚠️  Failed to deliver %s event for %s: %v\n"), event.Type, event.Environment.ID, err)
+			continue
+		}
+		delivered = append(delivered, event)
+	}
+	return delivered
+}
+
+// notifyStale sends a stale event for each environment that has not had
+// one yet and records the delivery in the state file, so environments left
+// in place are announced once rather than on every cleanup run.
+func notifyStale(mgr *state.Manager, envs []*state.EnvironmentState) {
+	now := time.Now()
+	var events []state.Event
+	for _, env := range envs {
+		if env.StaleNotifiedAt.IsZero() {
+			events = append(events, state.Event{Type: state.EventStale, Time: now, Environment: env})
+		}
+	}
+
+	for _, event := range notifyEvents(events) {
+		if mgr == nil {
+			continue
+		}
+		err := mgr.UpdateEnvironment(event.Environment.ID, func(env *state.EnvironmentState) {
+			env.StaleNotifiedAt = event.Time
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, emoji("⚠️  Failed to record stale notification for %s: %v\n"), event.Environment.ID, err)
+		}
+	}
+}
+
+// notifyShutdown sends the daemon's shutdown event to the webhooks.
+func notifyShutdown(event *shutdownEvent) {
+	notifier := configuredNotifier()
+	if notifier == nil {
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, emoji("⚠️  Failed to encode shutdown event: %v\n"), err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	if err := notifier.Send(ctx, event.Event, body); err != nil {
+		fmt.Fprintf(os.Stderr, emoji("⚠️  Failed to deliver shutdown event: %v\n"), err)
+	}
+}
+
+// configuredNotifier returns a notifier for the webhooks in the config
+// file, or nil if there are none.
+func configuredNotifier() *webhook.Notifier {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, emoji("⚠️  Webhooks disabled: %v\n"), err)
+		return nil
+	}
+	if len(cfg.Webhooks) == 0 {
+		return nil
+	}
+	return webhook.NewNotifier(cfg.Webhooks)
+}
@@ -0,0 +1,82 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useWebhook points the config file at a webhook served by handler.
+func useWebhook(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"webhooks": [{"url": "`+server.URL+`"}]}`), 0o600))
+
+	prev := configPath
+	configPath = path
+	t.Cleanup(func() { configPath = prev })
+}
+
+func TestNotifyEventsDeadline(t *testing.T) {
+	useWebhook(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	prev := notifyTimeout
+	notifyTimeout = 200 * time.Millisecond
+	defer func() { notifyTimeout = prev }()
+
+	start := time.Now()
+	delivered := notifyEvents([]state.Event{{Type: state.EventCreated, Time: start, Environment: &state.EnvironmentState{ID: "slow"}}})
+	assert.Empty(t, delivered)
+	assert.Less(t, time.Since(start), 2*time.Second, "retries should stop at the deadline")
+}
+
+func TestNotifyStaleOnce(t *testing.T) {
+	var deliveries atomic.Int32
+	useWebhook(t, func(w http.ResponseWriter, r *http.Request) {
+		deliveries.Add(1)
+	})
+
+	mgr := state.NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+	require.NoError(t, mgr.Restore(&state.State{
+		Version:      state.CurrentVersion,
+		Environments: []*state.EnvironmentState{{ID: "leaked", PID: 999999, Ports: &state.PortsState{}}},
+	}))
+
+	for range 2 {
+		envs, err := mgr.ListEnvironments()
+		require.NoError(t, err)
+		notifyStale(mgr, envs)
+	}
+	assert.Equal(t, int32(1), deliveries.Load())
+
+	env, err := mgr.GetEnvironment("leaked")
+	require.NoError(t, err)
+	assert.False(t, env.StaleNotifiedAt.IsZero())
+}
@@ -0,0 +1,84 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	portID    string
+	portName  string
+	portQuiet bool
+)
+
+var portCmd = &cobra.Command{
+	Use:   "port --id <isolation-id> [service]",
+	Short: "Print a port of an environment",
+	Long: `Port prints the port of a service in an environment, or its base port when no
+service is given. Services are named as for resolve; a zero-based port index
+is also accepted.
+
+With --quiet, the output is just the number on a single line, for command
+substitution in scripts and Makefiles.`,
+	Example: `  # Print the base port
+  go-portalloc port --id abc123def456
+
+  # Use the API port in a Makefile
+  API_PORT := $(shell go-portalloc port --name payments-it api --quiet)`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: runPort,
+}
+
+func init() {
+	portCmd.Flags().StringVar(&portID, "id", "", "Isolation ID (or --name)")
+	portCmd.Flags().StringVar(&portName, "name", "", "Environment name (instead of --id)")
+	portCmd.Flags().BoolVarP(&portQuiet, "quiet", "q", false, "Print only the port number")
+	portCmd.MarkFlagsOneRequired("id", "name")
+	portCmd.MarkFlagsMutuallyExclusive("id", "name")
+}
+
+func runPort(cmd *cobra.Command, args []string) error {
+	if err := resolveEnvironmentFlag(&portID, portName); err != nil {
+		return err
+	}
+
+	stateMgr, err := newStateManager()
+	if err != nil {
+		return fmt.Errorf("failed to create state manager: %w", err)
+	}
+
+	env, err := stateMgr.LoadEnvironment(portID)
+	if err != nil {
+		return err
+	}
+
+	label, port := "base", env.Ports.BasePort
+	if len(args) == 1 {
+		label = args[0]
+		if port, err = env.ServicePort(label); err != nil {
+			return err
+		}
+	}
+
+	if portQuiet {
+		fmt.Println(port)
+		return nil
+	}
+	fmt.Printf("%s port: %d\n", label, port)
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// groupPollInterval is how often killGroup checks whether a process group
+// has exited.
+const groupPollInterval = 50 * time.Millisecond
+
+// runProcessGroup runs c in its own process group and, once c exits,
+// terminates what is left of the group, so background processes it started
+// do not keep holding the environment's ports after cleanup. c must have
+// been created with exec.CommandContext; cancelling it signals the group.
+func runProcessGroup(c *exec.Cmd) error {
+	c.SysProcAttr = processGroupAttr()
+	c.Cancel = func() error { return syscall.Kill(-c.Process.Pid, syscall.SIGTERM) }
+
+	// Output is copied through pipes owned here, so Wait returns when the
+	// command exits rather than when its last descendant closes the pipe
+	var copies sync.WaitGroup
+	var writers []*os.File
+	for _, w := range []*io.Writer{&c.Stdout, &c.Stderr} {
+		if _, ok := (*w).(*os.File); ok || *w == nil {
+			continue
+		}
+		r, pw, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		copies.Add(1)
+		go func(dst io.Writer) {
+			defer copies.Done()
+			_, _ = io.Copy(dst, r)
+			_ = r.Close()
+		}(*w)
+		*w = pw
+		writers = append(writers, pw)
+	}
+
+	err := c.Start()
+	for _, pw := range writers {
+		_ = pw.Close()
+	}
+	if err == nil {
+		err = c.Wait()
+		killGroup(c.Process.Pid, runKillGrace)
+	}
+	copies.Wait()
+	return err
+}
+
+// killGroup sends SIGTERM to the process group pgid and waits for it to
+// exit, killing it after grace.
+func killGroup(pgid int, grace time.Duration) {
+	if syscall.Kill(-pgid, syscall.SIGTERM) != nil {
+		return // The group is already gone
+	}
+	deadline := time.Now().Add(grace)
+	for time.Now().Before(deadline) {
+		time.Sleep(groupPollInterval)
+		if syscall.Kill(-pgid, 0) != nil {
+			return
+		}
+	}
+	_ = syscall.Kill(-pgid, syscall.SIGKILL)
+}
@@ -0,0 +1,56 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunProcessGroup(t *testing.T) {
+	t.Run("terminates processes left in the group", func(t *testing.T) {
+		var stdout bytes.Buffer
+		c := exec.CommandContext(context.Background(), "sh", "-c", "sleep 30 & echo $!")
+		c.Stdout = &stdout
+
+		start := time.Now()
+		require.NoError(t, runProcessGroup(c))
+		assert.Less(t, time.Since(start), runKillGrace, "the sleep does not hold the output pipe open")
+
+		pid, err := strconv.Atoi(strings.TrimSpace(stdout.String()))
+		require.NoError(t, err, stdout.String())
+		assert.Eventually(t, func() bool {
+			return syscall.Kill(-c.Process.Pid, 0) != nil
+		}, 5*time.Second, 10*time.Millisecond, "background process %d still running", pid)
+	})
+
+	t.Run("returns the command's exit status", func(t *testing.T) {
+		err := runProcessGroup(exec.CommandContext(context.Background(), "sh", "-c", "exit 3"))
+		assert.EqualError(t, exitError(err), "exit status 3")
+	})
+
+	t.Run("reports a command that cannot start", func(t *testing.T) {
+		assert.Error(t, runProcessGroup(exec.CommandContext(context.Background(), "/nonexistent/command")))
+	})
+}
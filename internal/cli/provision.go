@@ -0,0 +1,139 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+)
+
+// environmentRequest describes an environment created on behalf of a
+// client by mcp or serve.
+type environmentRequest struct {
+	// WorktreePath receives the env file; empty means no env file.
+	WorktreePath string
+	InstanceID   string
+	Profile      string
+	LockDir      string
+	// Via names the front end in logs.
+	Via   string
+	Ports int
+}
+
+// createRecordedEnvironment creates an environment, records it in the
+// state, and runs the post-create hook, rolling back if the hook fails.
+func createRecordedEnvironment(ctx context.Context, req *environmentRequest) (*isolation.Environment, error) {
+	profile, err := loadProfile(req.Profile)
+	if err != nil {
+		return nil, err
+	}
+	maxLockAge, err := loadMaxLockAge()
+	if err != nil {
+		return nil, err
+	}
+	project, err := currentProject(req.WorktreePath)
+	if err != nil {
+		return nil, err
+	}
+	composePrefix, err := loadComposePrefix()
+	if err != nil {
+		return nil, err
+	}
+	gitIgnore, err := loadGitIgnore()
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	config := &isolation.Config{
+		WorktreePath:  req.WorktreePath,
+		InstanceID:    req.InstanceID,
+		Project:       project,
+		ComposePrefix: composePrefix,
+		GitIgnore:     gitIgnore,
+		LockDir:       req.LockDir,
+		MaxRetries:    999,
+		MaxLockAge:    maxLockAge,
+		NoEnvFile:     req.WorktreePath == "",
+		Strict:        strictMode,
+		OnReclaim:     forgetReclaimed,
+	}
+	if profile != nil {
+		config.Apply(isolation.WithProfile(profile))
+	}
+	allocator, err := newPortAllocator()
+	if err != nil {
+		return nil, err
+	}
+	manager := isolation.NewEnvironmentManager(isolation.NewIDGenerator(config), allocator)
+	reapForQuota(ctx, req.LockDir, req.Via)
+
+	env, err := manager.CreateEnvironment(req.Ports)
+	recordAllocation(req.WorktreePath, req.Ports, env, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create environment: %w", err)
+	}
+
+	stateMgr, err := newStateManager()
+	if err == nil {
+		err = stateMgr.RecordEnvironment(env)
+	}
+	if err != nil {
+		if err := stateSkipped(err); err != nil {
+			_ = manager.Cleanup(env)
+			return nil, err
+		}
+	}
+
+	if err := runHook(ctx, hookPostCreate, env); err != nil {
+		_ = manager.Cleanup(env)
+		if stateMgr != nil {
+			_ = stateMgr.RemoveEnvironment(env.ID)
+		}
+		return nil, err
+	}
+
+	created := state.NewEnvironmentState(env)
+	logEnvironment("environment created", created, start, "via", req.Via)
+	notifyEvent(state.EventCreated, created)
+
+	return env, nil
+}
+
+// removeRecordedEnvironment runs the pre-cleanup hook, then removes the
+// environment and its state entry.
+func removeRecordedEnvironment(ctx context.Context, stateMgr *state.Manager, recorded *state.EnvironmentState, lockDir, via string) error {
+	start := time.Now()
+	env := recorded.Environment()
+	if err := runHook(ctx, hookPreCleanup, env); err != nil {
+		return fmt.Errorf("cleanup aborted: %w", err)
+	}
+
+	manager := isolation.NewEnvironmentManager(isolation.NewIDGenerator(&isolation.Config{LockDir: lockDir}), nil)
+	if err := cleanupEnvironment(manager, env); err != nil {
+		return fmt.Errorf("cleanup failed: %w", err)
+	}
+	if err := forgetEnvironment(stateMgr, recorded.ID); err != nil {
+		return err
+	}
+
+	logEnvironment("environment removed", recorded, start, "via", via)
+	notifyEvent(state.EventRemoved, recorded)
+	return nil
+}
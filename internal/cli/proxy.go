@@ -0,0 +1,262 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/proxy"
+	"github.com/spf13/cobra"
+)
+
+var (
+	proxyID   string
+	proxyName string
+)
+
+// proxyLogFileName is the log of the background proxy started by 'create --proxy'.
+const proxyLogFileName = "proxy.log"
+
+// daemonStartTimeout bounds how long create waits for a background proxy or
+// reservation to become ready.
+const daemonStartTimeout = 5 * time.Second
+
+var proxyCmd = &cobra.Command{
+	Use:   "proxy --id <isolation-id> PORT=SERVICE...",
+	Short: "Forward stable local ports to an environment's allocated ports",
+	Long: `Proxy listens on well-known local ports and forwards each connection to
+the port allocated for a service in the environment.
+
+SERVICE is a port name such as api, auth, or metrics (matching API_PORT,
+AUTH_PORT, METRICS_PORT) or a zero-based port index.
+
+The proxy runs until interrupted or until the environment is cleaned up.
+'create --proxy' starts it in the background automatically.`,
+	Example: `  # Serve the environment's API on localhost:8080
+  go-portalloc proxy --id abc123def456 8080=api
+
+  # Forward several ports
+  go-portalloc proxy --id abc123def456 8080=api 9090=metrics`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: runProxy,
+}
+
+func init() {
+	proxyCmd.Flags().StringVar(&proxyID, "id", "", "Isolation ID to proxy for (or --name)")
+	proxyCmd.Flags().StringVar(&proxyName, "name", "", "Environment name (instead of --id)")
+	proxyCmd.MarkFlagsOneRequired("id", "name")
+	proxyCmd.MarkFlagsMutuallyExclusive("id", "name")
+}
+
+// resolvedProxy is a proxy spec with its target port resolved.
+type resolvedProxy struct {
+	spec       proxy.Spec
+	targetPort int
+}
+
+// resolveProxySpecs parses specs and resolves each service against env.
+func resolveProxySpecs(env *isolation.Environment, specs []string) ([]resolvedProxy, error) {
+	resolved := make([]resolvedProxy, 0, len(specs))
+	for _, s := range specs {
+		spec, err := proxy.ParseSpec(s)
+		if err != nil {
+			return nil, err
+		}
+		port := 0
+		if env != nil {
+			if port, err = env.ServicePort(spec.Service); err != nil {
+				return nil, fmt.Errorf("proxy %s: %w", spec, err)
+			}
+		}
+		resolved = append(resolved, resolvedProxy{spec: spec, targetPort: port})
+	}
+	return resolved, nil
+}
+
+func runProxy(cmd *cobra.Command, args []string) error {
+	if _, err := resolveProxySpecs(nil, args); err != nil {
+		return err
+	}
+
+	// Failures from here on are the command's, not a usage problem
+	cmd.SilenceUsage = true
+
+	if err := resolveEnvironmentFlag(&proxyID, proxyName); err != nil {
+		return err
+	}
+
+	stateMgr, err := newStateManager()
+	if err != nil {
+		return fmt.Errorf("failed to create state manager: %w", err)
+	}
+	env, err := stateMgr.LoadEnvironment(proxyID)
+	if err != nil {
+		return err
+	}
+
+	resolved, err := resolveProxySpecs(env, args)
+	if err != nil {
+		return err
+	}
+
+	proxies := make([]*proxy.Proxy, 0, len(resolved))
+	defer func() {
+		for _, p := range proxies {
+			_ = p.Close()
+		}
+	}()
+
+	for _, r := range resolved {
+		target := net.JoinHostPort("127.0.0.1", strconv.Itoa(r.targetPort))
+		p, err := proxy.Listen(r.spec.ListenAddr(), target)
+		if err != nil {
+			return err
+		}
+		proxies = append(proxies, p)
+		go func() { _ = p.Serve() }()
+		fmt.Printf(emoji("🔀 %s -> %s (%s)\n"), r.spec.ListenAddr(), target, r.spec.Service)
+	}
+	signalReady()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sigCh:
+			return nil
+		case <-ticker.C:
+			// Stop once the environment has been cleaned up
+			if env.LockFile != "" {
+				if _, err := os.Stat(env.LockFile); os.IsNotExist(err) {
+					fmt.Printf("Environment %s was cleaned up, stopping proxy\n", env.ID)
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// startProxyDaemon launches 'proxy' for env in the background and waits until
+// it listens on every port. The daemon exits on its own when the environment
+// is cleaned up.
+func startProxyDaemon(env *isolation.Environment, proxies []resolvedProxy) error {
+	args := []string{"proxy", "--id", env.ID}
+	for _, p := range proxies {
+		args = append(args, p.spec.String())
+	}
+
+	logPath := filepath.Join(env.TempDir, proxyLogFileName)
+	return startDaemon("proxy", env, args, logPath)
+}
+
+// readyFDEnv tells a daemon started by startDaemon which file descriptor to
+// report readiness on; see signalReady.
+const readyFDEnv = "PORTALLOC_READY_FD"
+
+// signalReady tells the process that started this daemon with startDaemon
+// that it is ready. It does nothing when the daemon was started otherwise.
+func signalReady() {
+	fd, err := strconv.Atoi(os.Getenv(readyFDEnv))
+	if err != nil {
+		return
+	}
+	_ = os.Unsetenv(readyFDEnv)
+	if f := os.NewFile(uintptr(fd), "ready"); f != nil {
+		_, _ = f.WriteString("ready\n")
+		_ = f.Close()
+	}
+}
+
+// startDaemon re-executes this binary with args in the background for env,
+// logging to logPath, and waits until the daemon calls signalReady. The
+// daemon runs with env's ISOLATION_ID, so validate counts the ports it
+// binds as env's own. Checking the
+// daemon's ports instead could find them bound by someone else after the
+// daemon failed. The daemon is killed if it is not ready within
+// daemonStartTimeout.
+func startDaemon(what string, env *isolation.Environment, args []string, logPath string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate executable: %w", err)
+	}
+
+	// #nosec G304 - logPath is inside the environment's temp directory
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open %s log: %w", what, err)
+	}
+	defer logFile.Close()
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to start %s: %w", what, err)
+	}
+	defer readyR.Close()
+
+	// #nosec G204 - re-executing this binary with controlled arguments
+	daemon := exec.Command(executable, args...)
+	daemon.Stdout = logFile
+	daemon.Stderr = logFile
+	daemon.ExtraFiles = []*os.File{readyW}
+	daemon.Env = append(os.Environ(), "ISOLATION_ID="+env.ID, readyFDEnv+"=3")
+	daemon.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = daemon.Start()
+	_ = readyW.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start %s: %w", what, err)
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- daemon.Wait() }()
+
+	// The pipe reaches EOF without a message if the daemon exits first
+	ready := make(chan bool, 1)
+	go func() {
+		line, _ := bufio.NewReader(readyR).ReadString('\n')
+		ready <- line == "ready\n"
+	}()
+
+	select {
+	case ok := <-ready:
+		if ok {
+			return nil
+		}
+		_ = daemon.Process.Kill()
+		err := <-exited
+		if err == nil {
+			err = errors.New("exited")
+		}
+		return fmt.Errorf("%s failed (%v), see %s", what, err, logPath)
+	case <-time.After(daemonStartTimeout):
+		_ = daemon.Process.Kill()
+		return fmt.Errorf("%s did not become ready within %s, see %s", what, daemonStartTimeout, logPath)
+	}
+}
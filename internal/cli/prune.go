@@ -0,0 +1,247 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/internal/config"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	pruneMaxDisk string
+	pruneLockDir string
+	pruneDryRun  bool
+)
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove stale environments to stay within a disk budget",
+	Long: `Prune removes stale environments, oldest first, until the total size of
+all environment temp directories falls below the given budget.
+
+If the config file has a retention policy, prune enforces it first:
+
+  {"retention": {"max_age": "72h", "max_environments": 50, "reap_stale": false}}
+
+  max_age            Remove stale environments older than this
+  max_environments   Remove the oldest stale environments beyond this count
+  reap_stale         Remove every stale environment
+
+The same policy is enforced by 'serve --gc' on every tick and by create
+once max_environments is reached. --max-disk is optional when a policy is
+configured.
+
+Active environments are never removed. If the budget cannot be met by
+removing stale environments alone, prune removes all of them and reports
+the remaining usage.`,
+	Example: `  # Keep temp directories under 10GB
+  go-portalloc prune --max-disk 10GB
+
+  # Enforce only the retention policy from the config file
+  go-portalloc prune
+
+  # Show what would be removed
+  go-portalloc prune --max-disk 500MB --dry-run`,
+	RunE: runPrune,
+}
+
+func init() {
+	pruneCmd.Flags().StringVar(&pruneMaxDisk, "max-disk", "", "Disk budget for all temp directories (e.g., 10GB, 500MB); required without a retention policy")
+	pruneCmd.Flags().StringVar(&pruneLockDir, "lock-dir", defaultLockDir, "Lock directory path")
+	pruneCmd.Flags().BoolVar(&pruneDryRun, "dry-run", false, "Show what would be removed without removing anything or reconciling the state file")
+}
+
+func runPrune(cmd *cobra.Command, args []string) error {
+	policy, err := loadRetention()
+	if err != nil {
+		return err
+	}
+	if policy == nil && pruneMaxDisk == "" {
+		return usageErrorf("--max-disk is required when no retention policy is configured")
+	}
+	var maxDisk int64
+	if pruneMaxDisk != "" {
+		if maxDisk, err = parseSize(pruneMaxDisk); err != nil {
+			return usageErrorf("invalid --max-disk: %w", err)
+		}
+	}
+
+	stateMgr, err := newStateManager()
+	if err != nil {
+		return fmt.Errorf("failed to create state manager: %w", err)
+	}
+
+	// Reconcile rewrites the state file, so a dry run works from the state
+	// as recorded
+	if !pruneDryRun {
+		if _, err := stateMgr.Reconcile(pruneLockDir); err != nil {
+			return fmt.Errorf("failed to reconcile state: %w", err)
+		}
+	}
+
+	envs, err := stateMgr.ListEnvironments()
+	if err != nil {
+		return fmt.Errorf("failed to list environments: %w", err)
+	}
+
+	if policy != nil {
+		if envs, err = pruneRetention(cmd, stateMgr, policy, envs); err != nil {
+			return err
+		}
+	}
+	if pruneMaxDisk == "" {
+		return nil
+	}
+
+	usage := make(map[string]int64, len(envs))
+	var total int64
+	for _, env := range envs {
+		size, err := env.DiskUsage()
+		if err != nil {
+			fmt.Printf(emoji("⚠️  Failed to measure %s: %v\n"), env.ID, err)
+		}
+		usage[env.ID] = size
+		total += size
+	}
+
+	fmt.Printf(emoji("💾 Disk usage: %s (budget %s)\n"), formatSize(total), formatSize(maxDisk))
+
+	if total <= maxDisk {
+		fmt.Println("No pruning needed")
+		return nil
+	}
+
+	toPrune := selectPruneCandidates(envs, usage, total, maxDisk)
+	if len(toPrune) == 0 {
+		fmt.Println(emoji("⚠️  Over budget, but no stale environments to prune"))
+		return nil
+	}
+
+	config := &isolation.Config{LockDir: pruneLockDir}
+	manager := isolation.NewEnvironmentManager(isolation.NewIDGenerator(config), nil)
+
+	pruned := 0
+	failed := 0
+
+	for _, env := range toPrune {
+		if pruneDryRun {
+			fmt.Printf("Would prune: %s (%s, created %s)\n", env.ID, formatSize(usage[env.ID]), formatTimeAgo(env.CreatedAt))
+			total -= usage[env.ID]
+			continue
+		}
+
+		start := time.Now()
+		if err := cleanupEnvironment(manager, env.Environment()); err != nil {
+			fmt.Printf(emoji("⚠️  Failed to prune %s: %v\n"), env.ID, err)
+			failed++
+			continue
+		}
+		if err := forgetEnvironment(stateMgr, env.ID); err != nil {
+			fmt.Printf(emoji("⚠️  %v\n"), err)
+			failed++
+		}
+		logEnvironment("environment removed", env, start, "reason", "prune", "disk_usage_bytes", usage[env.ID])
+		notifyEvent(state.EventRemoved, env)
+
+		fmt.Printf(emoji("✅ Pruned: %s (%s, created %s)\n"), env.ID, formatSize(usage[env.ID]), formatTimeAgo(env.CreatedAt))
+		total -= usage[env.ID]
+		pruned++
+	}
+
+	if pruneDryRun {
+		fmt.Printf("\nDisk usage after prune would be %s\n", formatSize(total))
+		return nil
+	}
+
+	fmt.Printf(emoji("\n✅ Pruned %d environment(s), disk usage now %s"), pruned, formatSize(total))
+	if failed > 0 {
+		fmt.Printf(" (%d failed)", failed)
+	}
+	fmt.Println()
+
+	if total > maxDisk {
+		fmt.Println(emoji("⚠️  Still over budget: remaining usage belongs to active environments"))
+	}
+
+	return nil
+}
+
+// pruneRetention removes the environments the retention policy selects and
+// returns the remaining ones.
+func pruneRetention(cmd *cobra.Command, stateMgr *state.Manager, policy *config.Retention, envs []*state.EnvironmentState) ([]*state.EnvironmentState, error) {
+	maxLockAge, err := loadMaxLockAge()
+	if err != nil {
+		return nil, err
+	}
+	selected := policy.Select(envs, time.Now(), 0, maxLockAge)
+	if len(selected) == 0 {
+		fmt.Println("Retention policy: nothing to remove")
+		return envs, nil
+	}
+
+	if pruneDryRun {
+		for _, env := range selected {
+			fmt.Printf("Would remove (retention): %s (created %s)\n", env.ID, formatTimeAgo(env.CreatedAt))
+		}
+	} else {
+		removeForRetention(cmd.Context(), stateMgr, selected, pruneLockDir, "prune", os.Stdout)
+	}
+
+	// Dry runs budget as if the selected environments were gone
+	remaining, err := stateMgr.ListEnvironments()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list environments: %w", err)
+	}
+	if pruneDryRun {
+		remaining = slices.DeleteFunc(remaining, func(env *state.EnvironmentState) bool {
+			return slices.ContainsFunc(selected, func(s *state.EnvironmentState) bool { return s.ID == env.ID })
+		})
+	}
+	return remaining, nil
+}
+
+// selectPruneCandidates returns the oldest stale environments whose removal
+// brings total usage to or below maxDisk. If that is not possible, all stale
+// environments are returned.
+func selectPruneCandidates(envs []*state.EnvironmentState, usage map[string]int64, total, maxDisk int64) []*state.EnvironmentState {
+	var stale []*state.EnvironmentState
+	for _, env := range envs {
+		if state.GetEnvironmentStatus(env) == state.StatusStale {
+			stale = append(stale, env)
+		}
+	}
+
+	sort.SliceStable(stale, func(i, j int) bool {
+		return stale[i].CreatedAt.Before(stale[j].CreatedAt)
+	})
+
+	var selected []*state.EnvironmentState
+	for _, env := range stale {
+		if total <= maxDisk {
+			break
+		}
+		selected = append(selected, env)
+		total -= usage[env.ID]
+	}
+	return selected
+}
@@ -0,0 +1,68 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectPruneCandidates(t *testing.T) {
+	now := time.Now()
+	envs := []*state.EnvironmentState{
+		{ID: "newest-stale", PID: 999999, CreatedAt: now.Add(-1 * time.Hour)},
+		{ID: "active", PID: os.Getpid(), CreatedAt: now.Add(-10 * time.Hour)},
+		{ID: "oldest-stale", PID: 999999, CreatedAt: now.Add(-5 * time.Hour)},
+		{ID: "middle-stale", PID: 999999, CreatedAt: now.Add(-3 * time.Hour)},
+	}
+	usage := map[string]int64{
+		"newest-stale": 100,
+		"active":       500,
+		"oldest-stale": 200,
+		"middle-stale": 300,
+	}
+	total := int64(1100)
+
+	ids := func(envs []*state.EnvironmentState) []string {
+		var out []string
+		for _, env := range envs {
+			out = append(out, env.ID)
+		}
+		return out
+	}
+
+	t.Run("removes oldest stale first until under budget", func(t *testing.T) {
+		selected := selectPruneCandidates(envs, usage, total, 700)
+		assert.Equal(t, []string{"oldest-stale", "middle-stale"}, ids(selected))
+	})
+
+	t.Run("stops as soon as budget is met", func(t *testing.T) {
+		selected := selectPruneCandidates(envs, usage, total, 900)
+		assert.Equal(t, []string{"oldest-stale"}, ids(selected))
+	})
+
+	t.Run("never selects active environments", func(t *testing.T) {
+		selected := selectPruneCandidates(envs, usage, total, 0)
+		assert.Equal(t, []string{"oldest-stale", "middle-stale", "newest-stale"}, ids(selected))
+	})
+
+	t.Run("nothing selected within budget", func(t *testing.T) {
+		assert.Empty(t, selectPruneCandidates(envs, usage, total, 2000))
+	})
+}
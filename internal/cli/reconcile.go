@@ -16,60 +16,142 @@ package cli
 
 import (
 	"fmt"
-	"os"
-	"path/filepath"
+	"time"
 
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
 	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
 	"github.com/spf13/cobra"
 )
 
-var reconcileLockDir string
+var (
+	reconcileLockDir   string
+	reconcilePruneDead bool
+	reconcileOlderThan time.Duration
+	reconcileMigrate   bool
+	reconcileFull      bool
+)
 
 var reconcileCmd = &cobra.Command{
 	Use:   "reconcile",
 	Short: "Reconcile state file from lock files",
-	Long: `Reconcile rebuilds the state file by scanning all lock files.
+	Long: `Reconcile brings the state file in line with the lock files.
 
 This command is useful when the state file is corrupted or out of sync
-with the actual lock files. It will scan all lock files in the lock
-directory and rebuild the state file from scratch.
+with the actual lock files. Entries whose lock still exists are kept as
+recorded, entries without a lock are dropped, and locks without an entry
+are added. Env file paths and ports that the lock files cannot provide are
+recovered from the journal (journal.jsonl next to the state file), which
+also has the ports of environments whose env file was deleted. The merge
+happens under the state file lock, so environments created concurrently
+are never lost.
+
+With --full, the state file is rebuilt from the lock files instead,
+carrying over only env file paths, git info, profiles, and ports from the
+existing entries.
+
+The reconcile operation is safe and idempotent.
+
+With --prune-dead, environments whose owning process is gone and whose
+lock is older than --older-than are dropped instead: their lock files,
+temp directories, and env files are removed, restoring a crashed runner
+to a clean baseline in one command. Environments created by the CLI
+record the short-lived create process, so --older-than defaults to the
+config file's max_lock_age (24h) to spare environments still in use.
 
-The reconcile operation is safe and idempotent.`,
+Under the portalloc naming scheme ("naming": "portalloc" in the config
+file, or PORTALLOC_NAMING=portalloc), locks in the legacy
+/tmp/aigis-isolation-locks directory are reconciled too. --migrate-legacy
+moves them into the lock directory and renames aigis-test- temp
+directories, skipping environments whose owning process is still running.`,
 	Example: `  # Reconcile state file
   go-portalloc reconcile
 
+  # Rebuild every entry from the lock files
+  go-portalloc reconcile --full
+
+  # Drop environments left behind by dead processes more than an hour ago
+  go-portalloc reconcile --prune-dead --older-than 1h
+
+  # Move environments created under the legacy aigis names
+  PORTALLOC_NAMING=portalloc go-portalloc reconcile --migrate-legacy
+
   # Reconcile with custom lock directory
   go-portalloc reconcile --lock-dir /custom/path/locks`,
 	RunE: runReconcile,
 }
 
 func init() {
-	reconcileCmd.Flags().StringVar(&reconcileLockDir, "lock-dir", filepath.Join(os.TempDir(), "go-portalloc-locks"), "Lock directory path")
+	reconcileCmd.Flags().StringVar(&reconcileLockDir, "lock-dir", defaultLockDir, "Lock directory path")
+	reconcileCmd.Flags().BoolVar(&reconcilePruneDead, "prune-dead", false, "Remove environments whose owning process is dead")
+	reconcileCmd.Flags().BoolVar(&reconcileMigrate, "migrate-legacy", false, "Rename stale environments using the legacy aigis names (portalloc naming only)")
+	reconcileCmd.Flags().BoolVar(&reconcileFull, "full", false, "Rebuild every entry from the lock files instead of merging with the recorded state")
+	reconcileCmd.Flags().DurationVar(&reconcileOlderThan, "older-than", 0, "With --prune-dead, only remove environments whose lock is older than this (default: max_lock_age)")
+	reconcileCmd.MarkFlagsMutuallyExclusive("full", "prune-dead")
 }
 
 func runReconcile(cmd *cobra.Command, args []string) error {
+	if reconcileMigrate && isolation.CurrentNaming() != isolation.NamingPortalloc {
+		return usageErrorf("--migrate-legacy requires the portalloc naming scheme (set \"naming\": \"portalloc\" in the config file or %s=portalloc)", isolation.NamingEnv)
+	}
+
+	olderThan := reconcileOlderThan
+	if reconcilePruneDead && !cmd.Flags().Changed("older-than") {
+		age, err := loadMaxLockAge()
+		if err != nil {
+			return err
+		}
+		olderThan = age
+	}
+
 	// Create state manager
-	mgr, err := state.NewManager()
+	mgr, err := newStateManager()
 	if err != nil {
 		return fmt.Errorf("failed to create state manager: %w", err)
 	}
 
-	fmt.Println("🔄 Reconciling state...")
+	if reconcileMigrate {
+		migrated, err := mgr.MigrateLegacy(reconcileLockDir)
+		for _, env := range migrated {
+			fmt.Printf(emoji("🔧 Migrated: %s\n"), env.ID)
+		}
+		if err != nil {
+			return fmt.Errorf("migration failed: %w", err)
+		}
+	}
+
+	fmt.Println(emoji("🔄 Reconciling state..."))
 
 	// Reconcile
-	count, err := mgr.Reconcile(reconcileLockDir)
+	var count int
+	var pruned []*state.EnvironmentState
+	switch {
+	case reconcilePruneDead:
+		count, pruned, err = mgr.ReconcilePruneDead(reconcileLockDir, olderThan)
+	case reconcileFull:
+		count, err = mgr.ReconcileFull(reconcileLockDir)
+	default:
+		count, err = mgr.Reconcile(reconcileLockDir)
+	}
 	if err != nil {
 		return fmt.Errorf("reconcile failed: %w", err)
 	}
 
-	fmt.Printf("✅ Found %d active environment(s)\n", count)
+	fmt.Printf(emoji("✅ Found %d active environment(s)\n"), count)
 
-	// Get home directory
-	homeDir, err := os.UserHomeDir()
-	if err == nil {
-		stateFile := filepath.Join(homeDir, ".go-portalloc", "state.json")
-		fmt.Printf("✅ State file updated: %s\n", stateFile)
+	// The locks are gone; remove the rest of each pruned environment. The
+	// entries are already out of the state file, so there is no delivery to
+	// record.
+	notifyStale(nil, pruned)
+	for _, env := range pruned {
+		if err := removeRecordedEnvironment(cmd.Context(), mgr, env, reconcileLockDir, "reconcile"); err != nil {
+			fmt.Printf(emoji("⚠️  Failed to clean up %s: %v\n"), env.ID, err)
+			continue
+		}
+		fmt.Printf(emoji("🧹 Pruned: %s (process %d dead, created %s ago)\n"),
+			env.ID, env.PID, time.Since(env.CreatedAt).Round(time.Minute))
 	}
 
+	fmt.Printf(emoji("✅ State file updated: %s\n"), mgr.Path())
+
 	return nil
 }
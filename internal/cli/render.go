@@ -0,0 +1,112 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/spf13/cobra"
+)
+
+var (
+	renderID     string
+	renderName   string
+	renderOutput string
+)
+
+var renderCmd = &cobra.Command{
+	Use:   "render --id <isolation-id> <template>",
+	Short: "Render a Go template with an environment's values",
+	Long: `Render executes a Go text/template with the environment's variables, so
+config files for nginx, envoy, or the application under test can be
+generated from an allocation.
+
+Every variable from the env file is available by name, plus
+COMPOSE_PROJECT_NAME and Services (service name -> host:port):
+
+  listen {{.API_PORT}};
+  root {{.TEMP_DIR}}/www;
+  upstream auth { server {{.Services.auth}}; }
+
+Referencing an unknown variable is an error.`,
+	Example: `  # Render an nginx config
+  go-portalloc render --id abc123def456 nginx.conf.tmpl -o nginx.conf
+
+  # Print to stdout
+  go-portalloc render --id abc123def456 app.yaml.tmpl`,
+	Args: cobra.ExactArgs(1),
+	RunE: runRender,
+}
+
+func init() {
+	renderCmd.Flags().StringVar(&renderID, "id", "", "Isolation ID whose values to use (or --name)")
+	renderCmd.Flags().StringVar(&renderName, "name", "", "Environment name (instead of --id)")
+	renderCmd.Flags().StringVarP(&renderOutput, "output", "o", "", "Output file (default: stdout)")
+	renderCmd.MarkFlagsOneRequired("id", "name")
+	renderCmd.MarkFlagsMutuallyExclusive("id", "name")
+}
+
+// templateData returns the values available to 'render' templates.
+func templateData(env *isolation.Environment) map[string]interface{} {
+	data := map[string]interface{}{
+		"Services": env.Services(),
+	}
+	for name, value := range env.Vars() {
+		data[name] = value
+	}
+	return data
+}
+
+func runRender(cmd *cobra.Command, args []string) error {
+	if err := resolveEnvironmentFlag(&renderID, renderName); err != nil {
+		return err
+	}
+
+	stateMgr, err := newStateManager()
+	if err != nil {
+		return fmt.Errorf("failed to create state manager: %w", err)
+	}
+
+	env, err := stateMgr.LoadEnvironment(renderID)
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := template.New(filepath.Base(args[0])).Option("missingkey=error").ParseFiles(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse template: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, templateData(env)); err != nil {
+		return fmt.Errorf("failed to render template: %w", err)
+	}
+
+	if renderOutput == "" {
+		_, err := os.Stdout.Write(buf.Bytes())
+		return err
+	}
+
+	// #nosec G306 - rendered config files are not secret
+	if err := os.WriteFile(renderOutput, buf.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+	return nil
+}
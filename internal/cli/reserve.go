@@ -0,0 +1,276 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// reserveSocketName is the control socket of the reservation started by
+	// 'create --reserve', inside the environment's temp directory.
+	reserveSocketName = "reserve.sock"
+	// reserveLogFileName is the log of the background reservation.
+	reserveLogFileName = "reserve.log"
+	// reservePollInterval is how often the reservation looks for services
+	// that bound a reserved port and for the environment's cleanup.
+	reservePollInterval = 100 * time.Millisecond
+)
+
+var (
+	reserveID   string
+	reserveName string
+)
+
+var reserveCmd = &cobra.Command{
+	Use:   "reserve (--id <isolation-id> | --name <name>)",
+	Short: "Hold an environment's ports until they are released",
+	Long: `Reserve listens on every port of the environment so that no other process
+can take one between create and the start of the service under test. Each
+port is given back with 'release-port'; on Linux, a service that binds with
+SO_REUSEPORT takes its port over automatically.
+
+Reserve exits once every port is released or the environment is cleaned up.
+'create --reserve' starts it in the background automatically.`,
+	Example: `  go-portalloc reserve --id abc123def456`,
+	Args:    cobra.NoArgs,
+	RunE:    runReserve,
+}
+
+var (
+	releasePortID      string
+	releasePortName    string
+	releasePortService string
+	releasePortNumber  int
+	releasePortAll     bool
+)
+
+var releasePortCmd = &cobra.Command{
+	Use:   "release-port (--id <isolation-id> | --name <name>) (--service <service> | --port <port> | --all)",
+	Short: "Release a port held by 'create --reserve'",
+	Long: `Release-port closes the reservation's listener on one port of the
+environment so that the service under test can bind it. --service takes a
+service such as api (matching API_PORT) or a zero-based port index.`,
+	Example: `  # Start the API server on its reserved port
+  go-portalloc release-port --id abc123def456 --service api && ./api-server
+
+  # Release everything
+  go-portalloc release-port --id abc123def456 --all`,
+	Args: cobra.NoArgs,
+	RunE: runReleasePort,
+}
+
+func init() {
+	reserveCmd.Flags().StringVar(&reserveID, "id", "", "Isolation ID whose ports to hold (or --name)")
+	reserveCmd.Flags().StringVar(&reserveName, "name", "", "Environment name (instead of --id)")
+	reserveCmd.MarkFlagsOneRequired("id", "name")
+	reserveCmd.MarkFlagsMutuallyExclusive("id", "name")
+
+	releasePortCmd.Flags().StringVar(&releasePortID, "id", "", "Isolation ID holding the port (or --name)")
+	releasePortCmd.Flags().StringVar(&releasePortName, "name", "", "Environment name (instead of --id)")
+	releasePortCmd.Flags().StringVar(&releasePortService, "service", "", "Service whose port to release (e.g. api, or a port index)")
+	releasePortCmd.Flags().IntVar(&releasePortNumber, "port", 0, "Port to release")
+	releasePortCmd.Flags().BoolVar(&releasePortAll, "all", false, "Release every held port")
+	releasePortCmd.MarkFlagsOneRequired("id", "name")
+	releasePortCmd.MarkFlagsMutuallyExclusive("id", "name")
+	releasePortCmd.MarkFlagsOneRequired("service", "port", "all")
+	releasePortCmd.MarkFlagsMutuallyExclusive("service", "port", "all")
+}
+
+// reserveSocketPath returns the control socket of env's reservation.
+func reserveSocketPath(env *isolation.Environment) string {
+	return filepath.Join(env.TempDir, reserveSocketName)
+}
+
+func runReserve(cmd *cobra.Command, args []string) error {
+	if err := resolveEnvironmentFlag(&reserveID, reserveName); err != nil {
+		return err
+	}
+	stateMgr, err := newStateManager()
+	if err != nil {
+		return fmt.Errorf("failed to create state manager: %w", err)
+	}
+	env, err := stateMgr.LoadEnvironment(reserveID)
+	if err != nil {
+		return err
+	}
+
+	res, err := ports.Reserve(env.Ports.Ports())
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	socketPath := reserveSocketPath(env)
+	_ = os.Remove(socketPath)
+	control, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", socketPath, err)
+	}
+	defer func() {
+		_ = control.Close()
+		_ = os.Remove(socketPath)
+	}()
+	go serveReserveControl(control, res)
+	fmt.Printf(emoji("🔒 Holding ports %v of %s\n"), res.Held(), env.ID)
+	signalReady()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	ticker := time.NewTicker(reservePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sigCh:
+			return nil
+		case <-ticker.C:
+			for _, port := range res.ReleaseTaken() {
+				fmt.Printf(emoji("🔓 Port %d was bound by a service, released\n"), port)
+			}
+			if len(res.Held()) == 0 {
+				fmt.Println("All ports released")
+				return nil
+			}
+			if _, err := os.Stat(env.LockFile); os.IsNotExist(err) {
+				fmt.Printf("Environment %s was cleaned up, releasing ports\n", env.ID)
+				return nil
+			}
+		}
+	}
+}
+
+// serveReserveControl answers release requests on the control socket. A
+// request is "release <port>" or "release all"; the reply is "ok" followed by
+// the released ports, or "error <message>".
+func serveReserveControl(l net.Listener, res *ports.Reservation) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				return
+			}
+			fmt.Fprintln(conn, handleReserveRequest(res, strings.TrimSpace(line)))
+		}()
+	}
+}
+
+// handleReserveRequest applies one control request to res and returns the reply.
+func handleReserveRequest(res *ports.Reservation, request string) string {
+	target, ok := strings.CutPrefix(request, "release ")
+	if !ok {
+		return "error unknown request"
+	}
+
+	var released []int
+	if target == "all" {
+		released = res.Held()
+		if err := res.Close(); err != nil {
+			return "error " + err.Error()
+		}
+	} else {
+		port, err := strconv.Atoi(target)
+		if err != nil {
+			return "error invalid port " + target
+		}
+		if err := res.Release(port); err != nil {
+			return "error " + err.Error()
+		}
+		released = []int{port}
+	}
+	fmt.Printf(emoji("🔓 Released %v on request\n"), released)
+	return strings.TrimSpace(fmt.Sprintf("ok %s", strings.Trim(fmt.Sprint(released), "[]")))
+}
+
+// startReserveDaemon launches 'reserve' for env in the background and waits
+// until its control socket is listening, by which time every port is held.
+func startReserveDaemon(env *isolation.Environment) error {
+	logPath := filepath.Join(env.TempDir, reserveLogFileName)
+	return startDaemon("reservation", env, []string{"reserve", "--id", env.ID}, logPath)
+}
+
+func runReleasePort(cmd *cobra.Command, args []string) error {
+	if err := resolveEnvironmentFlag(&releasePortID, releasePortName); err != nil {
+		return err
+	}
+	stateMgr, err := newStateManager()
+	if err != nil {
+		return fmt.Errorf("failed to create state manager: %w", err)
+	}
+	env, err := stateMgr.LoadEnvironment(releasePortID)
+	if err != nil {
+		return err
+	}
+
+	target := "all"
+	switch {
+	case releasePortService != "":
+		port, err := env.ServicePort(releasePortService)
+		if err != nil {
+			return usageErrorf("%v", err)
+		}
+		target = strconv.Itoa(port)
+	case releasePortNumber != 0:
+		target = strconv.Itoa(releasePortNumber)
+	}
+
+	conn, err := net.DialTimeout("unix", reserveSocketPath(env), time.Second)
+	if err != nil {
+		return fmt.Errorf("no ports of %s are reserved (create --reserve): %w", env.ID, err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := fmt.Fprintf(conn, "release %s\n", target); err != nil {
+		return fmt.Errorf("failed to send release request: %w", err)
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read release reply: %w", err)
+	}
+	reply = strings.TrimSpace(reply)
+	if msg, failed := strings.CutPrefix(reply, "error "); failed {
+		return fmt.Errorf("failed to release port: %s", msg)
+	}
+
+	released := strings.TrimSpace(strings.TrimPrefix(reply, "ok"))
+	if released == "" {
+		fmt.Println("No ports were held")
+	} else {
+		fmt.Printf(emoji("🔓 Released port %s\n"), strings.ReplaceAll(released, " ", ", "))
+	}
+	return nil
+}
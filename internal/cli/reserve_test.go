@@ -0,0 +1,48 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleReserveRequest(t *testing.T) {
+	var free []int
+	for range 3 {
+		l, err := net.Listen("tcp", ":0")
+		require.NoError(t, err)
+		free = append(free, l.Addr().(*net.TCPAddr).Port)
+		require.NoError(t, l.Close())
+	}
+	res, err := ports.Reserve(free)
+	require.NoError(t, err)
+	defer res.Close()
+
+	assert.Equal(t, fmt.Sprintf("ok %d", free[0]), handleReserveRequest(res, fmt.Sprintf("release %d", free[0])))
+	assert.Contains(t, handleReserveRequest(res, fmt.Sprintf("release %d", free[0])), "error ", "already released")
+	assert.Equal(t, "error invalid port api", handleReserveRequest(res, "release api"))
+	assert.Equal(t, "error unknown request", handleReserveRequest(res, "hold 1"))
+
+	want := fmt.Sprintf("ok %d %d", min(free[1], free[2]), max(free[1], free[2]))
+	assert.Equal(t, want, handleReserveRequest(res, "release all"))
+	assert.Empty(t, res.Held())
+	assert.Equal(t, "ok", handleReserveRequest(res, "release all"))
+}
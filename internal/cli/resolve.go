@@ -0,0 +1,81 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	resolveID   string
+	resolveName string
+	resolvePort bool
+)
+
+var resolveCmd = &cobra.Command{
+	Use:   "resolve --id <isolation-id> <service>",
+	Short: "Print the address of a service in an environment",
+	Long: `Resolve prints the host:port of a service, as listed in the environment's
+services.json.
+
+Services are named after the port variables without the _PORT suffix
+(firestore, auth, api, metrics, debug); additional ports are port5, port6,
+and so on. A zero-based port index is also accepted.`,
+	Example: `  # Print the API address
+  go-portalloc resolve --id abc123def456 api
+
+  # Print only the port number
+  go-portalloc resolve --id abc123def456 api --port`,
+	Args: cobra.ExactArgs(1),
+	RunE: runResolve,
+}
+
+func init() {
+	resolveCmd.Flags().StringVar(&resolveID, "id", "", "Isolation ID (or --name)")
+	resolveCmd.Flags().StringVar(&resolveName, "name", "", "Environment name (instead of --id)")
+	resolveCmd.Flags().BoolVar(&resolvePort, "port", false, "Print only the port number")
+	resolveCmd.MarkFlagsOneRequired("id", "name")
+	resolveCmd.MarkFlagsMutuallyExclusive("id", "name")
+}
+
+func runResolve(cmd *cobra.Command, args []string) error {
+	if err := resolveEnvironmentFlag(&resolveID, resolveName); err != nil {
+		return err
+	}
+
+	stateMgr, err := newStateManager()
+	if err != nil {
+		return fmt.Errorf("failed to create state manager: %w", err)
+	}
+
+	env, err := stateMgr.LoadEnvironment(resolveID)
+	if err != nil {
+		return err
+	}
+
+	port, err := env.ServicePort(args[0])
+	if err != nil {
+		return err
+	}
+
+	if resolvePort {
+		fmt.Println(port)
+		return nil
+	}
+	fmt.Printf("127.0.0.1:%d\n", port)
+	return nil
+}
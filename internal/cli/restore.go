@@ -0,0 +1,161 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/internal/snapshot"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	restoreFrom   string
+	restoreHost   string
+	restoreOutput string
+	restoreForce  bool
+)
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Download a state snapshot from S3 or GCS",
+	Long: `Restore downloads a state snapshot uploaded by 'serve --snapshot-to'.
+
+--from is either a snapshot object (ending in .json) or the snapshot
+prefix, in which case the latest snapshot of --host (default: this
+machine's hostname) is used.
+
+By default the snapshot replaces the local state file, which is refused
+if it already records environments unless --force is given. Use
+--output to write the snapshot elsewhere for auditing ("-" for stdout).`,
+	Example: `  # Inspect what a recycled runner left behind
+  go-portalloc restore --from s3://ci-audit/portalloc --host runner-42 --output -
+
+  # Restore a specific snapshot into the local state file
+  go-portalloc restore --from s3://ci-audit/portalloc/runner-42/20261016T120000Z.json --force`,
+	RunE: runRestore,
+}
+
+func init() {
+	restoreCmd.Flags().StringVar(&restoreFrom, "from", "", "Snapshot object or prefix (s3://bucket/... or gs://bucket/...) (required)")
+	restoreCmd.Flags().StringVar(&restoreHost, "host", "", "Host whose latest snapshot to use when --from is a prefix (default: this host)")
+	restoreCmd.Flags().StringVarP(&restoreOutput, "output", "o", "", "Write the snapshot to this file instead of the state file (- for stdout)")
+	restoreCmd.Flags().BoolVar(&restoreForce, "force", false, "Replace a state file that already records environments")
+	_ = restoreCmd.MarkFlagRequired("from")
+}
+
+func runRestore(cmd *cobra.Command, args []string) error {
+	loc, err := snapshot.ParseLocation(restoreFrom)
+	if err != nil {
+		return err
+	}
+
+	host := restoreHost
+	if host == "" {
+		if host, err = os.Hostname(); err != nil {
+			return fmt.Errorf("failed to get hostname: %w", err)
+		}
+	}
+
+	st, key, err := snapshot.Download(cmd.Context(), snapshot.NewClient(loc), loc, host)
+	if err != nil {
+		return err
+	}
+
+	if restoreOutput != "" {
+		data, err := json.MarshalIndent(st, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode snapshot: %w", err)
+		}
+		data = append(data, '\n')
+		if restoreOutput == "-" {
+			_, err = os.Stdout.Write(data)
+			return err
+		}
+		// #nosec G306 - the snapshot is the user's own state
+		if err := os.WriteFile(restoreOutput, data, 0o644); err != nil {
+			return fmt.Errorf("failed to write snapshot: %w", err)
+		}
+		fmt.Printf(emoji("✅ Wrote snapshot %s (%d environment(s)) to %s\n"), key, len(st.Environments), restoreOutput)
+		return nil
+	}
+
+	// Only the local file is restored; a shared store is authoritative
+	stateMgr, err := state.NewManager()
+	if err != nil {
+		return fmt.Errorf("failed to create state manager: %w", err)
+	}
+	if !restoreForce {
+		current, err := stateMgr.Snapshot()
+		if err != nil {
+			return fmt.Errorf("failed to read state: %w", err)
+		}
+		if len(current.Environments) > 0 {
+			return fmt.Errorf("state file already records %d environment(s) (use --force to replace, or --output to save elsewhere)", len(current.Environments))
+		}
+	}
+	if err := stateMgr.Restore(st); err != nil {
+		return fmt.Errorf("failed to restore state: %w", err)
+	}
+
+	fmt.Printf(emoji("✅ Restored %d environment(s) from %s\n"), len(st.Environments), key)
+	fmt.Println("Run 'go-portalloc reconcile' to drop environments whose locks no longer exist")
+	return nil
+}
+
+// snapshotUploader periodically uploads the state for serve --snapshot-to.
+type snapshotUploader struct {
+	client   *snapshot.Client
+	loc      *snapshot.Location
+	stateMgr *state.Manager
+}
+
+func (u *snapshotUploader) run(ctx context.Context, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := u.upload(ctx); err != nil && ctx.Err() == nil {
+			onError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (u *snapshotUploader) upload(ctx context.Context) error {
+	st, err := u.stateMgr.Snapshot()
+	if err != nil {
+		return fmt.Errorf("failed to read state for snapshot: %w", err)
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("failed to get hostname: %w", err)
+	}
+	key, err := snapshot.Upload(ctx, u.client, u.loc, host, st, time.Now())
+	if err != nil {
+		return err
+	}
+	logger.Info("snapshot uploaded", "bucket", u.loc.Bucket, "key", key, "environments", len(st.Environments))
+	return nil
+}
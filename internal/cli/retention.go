@@ -0,0 +1,70 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+)
+
+// removeForRetention removes environments selected by the retention policy
+// and returns how many were removed. Progress is written to out.
+func removeForRetention(ctx context.Context, stateMgr *state.Manager, selected []*state.EnvironmentState, lockDir, via string, out io.Writer) int {
+	removed := 0
+	for _, env := range selected {
+		if err := removeRecordedEnvironment(ctx, stateMgr, env, lockDir, via); err != nil {
+			fmt.Fprintf(out, emoji("⚠️  Failed to remove %s: %v\n"), env.ID, err)
+			continue
+		}
+		fmt.Fprintf(out, emoji("🧹 Retention: removed %s (stale, created %s)\n"), env.ID, formatTimeAgo(env.CreatedAt))
+		removed++
+	}
+	return removed
+}
+
+// reapForQuota enforces the retention policy before an environment is
+// created, once max_environments is reached, so hosts recover without
+// anyone running cleanup. It is best effort and reports on stderr, keeping
+// stdout free for create's output.
+func reapForQuota(ctx context.Context, lockDir, via string) {
+	policy, err := loadRetention()
+	if err != nil || policy == nil {
+		return
+	}
+	maxLockAge, err := loadMaxLockAge()
+	if err != nil {
+		return
+	}
+	stateMgr, err := newStateManager()
+	if err != nil {
+		return
+	}
+	envs, err := stateMgr.ListEnvironments()
+	if err != nil || !policy.QuotaReached(len(envs)) {
+		return
+	}
+
+	selected := policy.Select(envs, time.Now(), 1, maxLockAge)
+	removed := removeForRetention(ctx, stateMgr, selected, lockDir, via, os.Stderr)
+	if remaining := len(envs) - removed; policy.QuotaReached(remaining) {
+		fmt.Fprintf(os.Stderr, emoji("⚠️  %d environment(s) recorded, at or over retention max_environments (%d); see 'go-portalloc list' and 'go-portalloc prune'\n"),
+			remaining, policy.MaxEnvironments)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/compose"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	rewriteComposeID     string
+	rewriteComposeName   string
+	rewriteComposeFile   string
+	rewriteComposeOutput string
+)
+
+var rewriteComposeCmd = &cobra.Command{
+	Use:   "rewrite-compose",
+	Short: "Rewrite a compose file to publish the environment's ports",
+	Long: `Rewrite-compose replaces every published host port in a docker compose
+file with one of the environment's allocated ports, in document order, and
+records the mapping in the state file (see 'inspect').
+
+Container ports, host IPs, protocols, and comments are preserved. Entries
+without a host port (e.g. "3000") and port ranges are left unchanged. The
+environment must have at least as many ports as the file publishes.`,
+	Example: `  # Write a rewritten copy next to the original
+  go-portalloc rewrite-compose --id abc123def456 -f docker-compose.yml -o docker-compose.isolated.yml
+  docker compose -f docker-compose.isolated.yml up -d
+
+  # Print to stdout
+  go-portalloc rewrite-compose --id abc123def456 -f docker-compose.yml`,
+	RunE: runRewriteCompose,
+}
+
+func init() {
+	rewriteComposeCmd.Flags().StringVar(&rewriteComposeID, "id", "", "Isolation ID whose ports to use (or --name)")
+	rewriteComposeCmd.Flags().StringVar(&rewriteComposeName, "name", "", "Environment name (instead of --id)")
+	rewriteComposeCmd.Flags().StringVarP(&rewriteComposeFile, "file", "f", "docker-compose.yml", "Compose file to read")
+	rewriteComposeCmd.Flags().StringVarP(&rewriteComposeOutput, "output", "o", "", "Output file (default: stdout)")
+	rewriteComposeCmd.MarkFlagsOneRequired("id", "name")
+	rewriteComposeCmd.MarkFlagsMutuallyExclusive("id", "name")
+}
+
+func runRewriteCompose(cmd *cobra.Command, args []string) error {
+	if err := resolveEnvironmentFlag(&rewriteComposeID, rewriteComposeName); err != nil {
+		return err
+	}
+
+	stateMgr, err := newStateManager()
+	if err != nil {
+		return fmt.Errorf("failed to create state manager: %w", err)
+	}
+
+	env, err := stateMgr.LoadEnvironment(rewriteComposeID)
+	if err != nil {
+		return err
+	}
+
+	// #nosec G304 - reading the user's compose file is the purpose of this command
+	data, err := os.ReadFile(rewriteComposeFile)
+	if err != nil {
+		return fmt.Errorf("failed to read compose file: %w", err)
+	}
+
+	out, mappings, err := compose.Rewrite(data, env.Ports.Ports())
+	if err != nil {
+		return err
+	}
+
+	if err := stateMgr.UpdateEnvironment(env.ID, func(e *state.EnvironmentState) {
+		e.ComposePorts = make([]state.ComposePort, len(mappings))
+		for i, m := range mappings {
+			e.ComposePorts[i] = state.ComposePort(m)
+		}
+	}); err != nil {
+		return fmt.Errorf("failed to record port mapping: %w", err)
+	}
+
+	// Keep stdout clean for the rewritten file
+	summary := os.Stderr
+	if rewriteComposeOutput == "" {
+		if _, err := os.Stdout.Write(out); err != nil {
+			return fmt.Errorf("failed to write compose file: %w", err)
+		}
+	} else {
+		// #nosec G306 - compose files are not secret
+		if err := os.WriteFile(rewriteComposeOutput, out, 0o644); err != nil {
+			return fmt.Errorf("failed to write compose file: %w", err)
+		}
+		summary = os.Stdout
+		fmt.Fprintf(summary, emoji("✅ Wrote %s\n"), rewriteComposeOutput)
+	}
+
+	for _, m := range mappings {
+		fmt.Fprintf(summary, "  %s: %s -> %d (container %s)\n", m.Service, m.Published, m.Port, m.Target)
+	}
+
+	return nil
+}
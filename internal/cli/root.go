@@ -16,9 +16,12 @@
 package cli
 
 import (
-	"fmt"
+	"os"
+	"strconv"
 
 	"github.com/spf13/cobra"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
 )
 
 var (
@@ -35,7 +38,7 @@ Features:
   - SHA256-based unique environment ID generation
   - Atomic locking mechanism for concurrent safety
   - Automatic cleanup with idempotent operations
-  - Zero external dependencies (pure Go standard library)
+  - Core packages (ports, isolation, state) use only the Go standard library
 
 Example:
   # Allocate 5 consecutive ports
@@ -46,28 +49,83 @@ Example:
 
   # Cleanup allocated resources
   go-portalloc cleanup --id <isolation-id>`,
-		Version: Version,
+		Version:           Version,
+		PersistentPreRunE: setupRoot,
 	}
 )
 
-// Execute runs the root command
+// Execute runs the root command. Pass the error to ExitCode for the
+// process exit code.
 func Execute() error {
-	return rootCmd.Execute()
+	trackRunStarted(rootCmd)
+	cmd, err := rootCmd.ExecuteC()
+	if err != nil && !runStarted {
+		err = &usageError{err: err}
+	}
+	if err != nil {
+		logger.Error("command failed", "command", cmd.CommandPath(), "error", err)
+	}
+	return err
+}
+
+// setupRoot runs before every command: it configures logging and strict
+// mode, and applies the config file's naming scheme.
+func setupRoot(cmd *cobra.Command, args []string) error {
+	if err := setupLogging(cmd, args); err != nil {
+		return err
+	}
+	if !cmd.Flags().Changed("strict") {
+		strictMode, _ = strconv.ParseBool(os.Getenv(strictEnv))
+	}
+	applyNaming()
+	return nil
 }
 
 func init() {
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "none", "Structured log format on stderr: none, text, or json (env: "+logFormatEnv+")")
+	rootCmd.PersistentFlags().BoolVar(&verbose, "verbose", false, "Log every port allocation attempt to stderr (env: "+debugEnv+"=1)")
+	rootCmd.PersistentFlags().StringVar(&projectFlag, "project", "", "Project key (default: config project, else the git repository name)")
+	rootCmd.PersistentFlags().StringVar(&composePrefixFlag, "compose-prefix", "", "COMPOSE_PROJECT_NAME prefix (default: config compose_prefix, else \""+isolation.DefaultComposePrefix+"\")")
+	rootCmd.PersistentFlags().BoolVar(&noColor, "no-color", false, "Disable colored output (env: "+noColorEnv+"); output that is not a terminal is never colored")
+	rootCmd.PersistentFlags().StringVar(&configPath, "config", "", "Config file path (default: ~/.go-portalloc/config.json)")
+	rootCmd.PersistentFlags().BoolVar(&strictMode, "strict", false, "Fail instead of silently falling back when state or env files cannot be written (env: "+strictEnv+"=1)")
+
 	rootCmd.AddCommand(createCmd)
 	rootCmd.AddCommand(cleanupCmd)
+	rootCmd.AddCommand(undoCleanupCmd)
+	rootCmd.AddCommand(runCmd)
+	rootCmd.AddCommand(proxyCmd)
+	rootCmd.AddCommand(reserveCmd)
+	rootCmd.AddCommand(releasePortCmd)
+	rootCmd.AddCommand(rewriteComposeCmd)
+	rootCmd.AddCommand(renderCmd)
+	rootCmd.AddCommand(envCmd)
 	rootCmd.AddCommand(validateCmd)
+	rootCmd.AddCommand(heartbeatCmd)
 	rootCmd.AddCommand(listCmd)
+	rootCmd.AddCommand(inspectCmd)
+	rootCmd.AddCommand(resolveCmd)
+	rootCmd.AddCommand(portCmd)
+	rootCmd.AddCommand(whoownsCmd)
+	rootCmd.AddCommand(watchCmd)
 	rootCmd.AddCommand(reconcileCmd)
+	rootCmd.AddCommand(pruneCmd)
+	rootCmd.AddCommand(fleetCmd)
+	rootCmd.AddCommand(doctorCmd)
+	rootCmd.AddCommand(scanCmd)
+	rootCmd.AddCommand(benchCmd)
+	rootCmd.AddCommand(statsCmd)
+	rootCmd.AddCommand(restoreCmd)
+	rootCmd.AddCommand(serveCmd)
+	rootCmd.AddCommand(mcpCmd)
+	rootCmd.AddCommand(schemaCmd)
+	rootCmd.AddCommand(selfUpdateCmd)
 	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(docsCmd)
 }
 
 var versionCmd = &cobra.Command{
 	Use:   "version",
 	Short: "Print version information",
-	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Printf("go-portalloc version %s\n", Version)
-	},
+	RunE:  runVersion,
 }
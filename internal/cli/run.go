@@ -0,0 +1,408 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	runCopies      int
+	runPortsCount  int
+	runWorktree    string
+	runLayout      bool
+	runProfile     string
+	runSetup       string
+	runWaitFor     []string
+	runWaitTimeout time.Duration
+	runKillTree    bool
+
+	// runWaitGates are the parsed runWaitFor specs.
+	runWaitGates []waitGate
+)
+
+// runKillGrace is how long copies get to exit after SIGTERM before being killed.
+const runKillGrace = 10 * time.Second
+
+var runCmd = &cobra.Command{
+	Use:   "run [flags] -- command [args...]",
+	Short: "Run a command in one or more isolated environments",
+	Long: `Run creates isolated environments, runs the command once per environment
+concurrently, and cleans up every environment when the commands exit.
+
+Each copy receives the environment's variables (ISOLATION_ID,
+COMPOSE_PROJECT_NAME, TEMP_DIR, PORT_BASE, PORT_COUNT, named ports) plus:
+
+  PORTALLOC_COPY_INDEX  Zero-based index of the copy
+  PORTALLOC_COPIES      Total number of copies
+
+Hooks in .portalloc/hooks run for every copy. No env file is written; output lines are prefixed with the copy index when
+more than one copy runs. Run fails if any copy fails.
+
+Readiness gates replace hand-rolled wait loops. --setup starts a shell
+command in each copy first (in its own process group, stopped when the
+copy ends), then every --wait-for gate must pass before the command runs:
+
+  SERVICE:tcp   The service's port accepts TCP connections (e.g. api:tcp)
+  URL           An http:// or https:// URL returns 2xx; $VARS such as
+                $API_PORT are expanded from the environment
+
+A copy fails if a gate does not pass within --wait-timeout or --setup
+exits non-zero first.
+
+A command that starts background processes (a server spawned by a test
+script, say) can leave them holding ports after it exits. With --kill-tree
+the command runs in its own process group, and whatever is left of the group
+when the command exits is sent SIGTERM, then SIGKILL after 10 seconds, before
+the environment is cleaned up. On Linux the command is also killed if
+go-portalloc itself dies. Processes that leave the group (setsid) are not
+tracked, and the command only reads standard input when it is not a
+terminal.`,
+	Example: `  # Shard an integration suite across four environments
+  go-portalloc run --copies 4 -- ./integration.sh
+
+  # Run a single command with 10 ports
+  go-portalloc run --ports 10 -- go test ./integration/...
+
+  # Stop servers the test script left running in the background
+  go-portalloc run --kill-tree -- ./integration.sh
+
+  # Start the API, wait until it is healthy, then run the suite
+  go-portalloc run --setup './bin/api' --wait-for api:tcp \
+    --wait-for 'http://localhost:$API_PORT/health' -- go test ./e2e/...`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: runRun,
+}
+
+func init() {
+	runCmd.Flags().IntVar(&runCopies, "copies", 1, "Number of isolated copies to run")
+	runCmd.Flags().IntVarP(&runPortsCount, "ports", "p", defaultPorts, "Number of ports to allocate per copy")
+	runCmd.Flags().StringVarP(&runWorktree, "worktree", "w", "", "Working directory path (current directory if not provided)")
+	runCmd.Flags().StringVar(&runProfile, "profile", "", "Apply a profile from the config file to every copy")
+	runCmd.Flags().BoolVar(&runLayout, "layout", false, "Create data/, logs/, tmp/, and sockets/ under each temp directory")
+	runCmd.Flags().StringVar(&runSetup, "setup", "", "Shell command started in each copy before the command, e.g. to start services (stopped when the copy ends)")
+	runCmd.Flags().StringArrayVar(&runWaitFor, "wait-for", nil, "Wait until SERVICE:tcp accepts connections or an http(s) URL returns 2xx before running the command (repeatable; $VARS are expanded)")
+	runCmd.Flags().DurationVar(&runWaitTimeout, "wait-timeout", time.Minute, "How long to wait for --wait-for gates")
+	runCmd.Flags().BoolVar(&runKillTree, "kill-tree", false, "Run the command in its own process group and terminate processes it leaves behind before cleanup")
+	runCmd.Flags().BoolVar(&noHooks, "no-hooks", false, "Do not run hooks from "+HooksDir)
+}
+
+func runRun(cmd *cobra.Command, args []string) error {
+	if runCopies < 1 {
+		return usageErrorf("--copies must be at least 1")
+	}
+	if runWaitTimeout <= 0 {
+		return usageErrorf("--wait-timeout must be positive, got %s", runWaitTimeout)
+	}
+	runWaitGates = runWaitGates[:0]
+	for _, spec := range runWaitFor {
+		gate, err := parseWaitGate(spec)
+		if err != nil {
+			return err
+		}
+		runWaitGates = append(runWaitGates, gate)
+	}
+
+	// Failures from here on are the command's, not a usage problem
+	cmd.SilenceUsage = true
+
+	profile, err := loadProfile(runProfile)
+	if err != nil {
+		return err
+	}
+	maxLockAge, err := loadMaxLockAge()
+	if err != nil {
+		return err
+	}
+
+	worktree := runWorktree
+	if worktree == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return fmt.Errorf("failed to get working directory: %w", err)
+		}
+		worktree = wd
+	}
+	project, err := currentProject(worktree)
+	if err != nil {
+		return err
+	}
+	composePrefix, err := loadComposePrefix()
+	if err != nil {
+		return err
+	}
+
+	config := &isolation.Config{
+		WorktreePath:  worktree,
+		Project:       project,
+		ComposePrefix: composePrefix,
+		LockDir:       defaultLockDir,
+		MaxRetries:    999,
+		MaxLockAge:    maxLockAge,
+		// Copies share the worktree, so variables are passed via the process environment
+		NoEnvFile:  true,
+		TempLayout: runLayout,
+		Profile:    profile,
+		Strict:     strictMode,
+		OnReclaim:  forgetReclaimed,
+	}
+	allocator, err := newPortAllocator()
+	if err != nil {
+		return err
+	}
+	manager := isolation.NewEnvironmentManager(isolation.NewIDGenerator(config), allocator)
+	reapForQuota(cmd.Context(), config.LockDir, "run")
+
+	stateMgr, err := newStateManager()
+	if err != nil {
+		// Continue without state management, unless --strict
+		if err := stateSkipped(err); err != nil {
+			return err
+		}
+		stateMgr = nil
+	}
+
+	// Installed before any copy exists so an interrupt during creation or
+	// hooks still reaches the deferred cleanup
+	ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	envs := make([]*isolation.Environment, 0, runCopies)
+	recorded := make([]*state.EnvironmentState, 0, runCopies)
+	defer func() {
+		for i, env := range envs {
+			start := time.Now()
+			if err := runHook(context.Background(), hookPreCleanup, env); err != nil {
+				fmt.Fprintf(os.Stderr, emoji("⚠️  %s: %v\n"), env.ID, err)
+			}
+			if err := manager.Cleanup(env); err != nil {
+				fmt.Fprintf(os.Stderr, emoji("⚠️  Failed to cleanup %s: %v\n"), env.ID, err)
+				continue
+			}
+			if stateMgr != nil {
+				_ = stateMgr.RemoveEnvironment(env.ID)
+			}
+			logEnvironment("environment removed", recorded[i], start)
+			notifyEvent(state.EventRemoved, recorded[i])
+		}
+	}()
+
+	for i := 0; i < runCopies; i++ {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("interrupted before copy %d: %w", i, err)
+		}
+		start := time.Now()
+		env, err := manager.CreateEnvironment(runPortsCount)
+		recordAllocation(worktree, runPortsCount, env, err)
+		if err != nil {
+			return fmt.Errorf("failed to create environment for copy %d: %w", i, err)
+		}
+		envs = append(envs, env)
+		recorded = append(recorded, state.NewEnvironmentState(env))
+		if stateMgr != nil {
+			if err := stateMgr.RecordEnvironment(env); err != nil {
+				if err := stateSkipped(err); err != nil {
+					return err
+				}
+			}
+		}
+		logEnvironment("environment created", recorded[i], start, "copy", i)
+		notifyEvent(state.EventCreated, recorded[i])
+
+		if err := runHook(ctx, hookPostCreate, env); err != nil {
+			return fmt.Errorf("copy %d: %w", i, err)
+		}
+	}
+
+	errs := make([]error, len(envs))
+	var wg sync.WaitGroup
+	for i, env := range envs {
+		wg.Add(1)
+		go func(i int, env *isolation.Environment) {
+			defer wg.Done()
+			start := time.Now()
+			errs[i] = runCopy(ctx, i, env, args)
+			if stateMgr != nil {
+				_ = stateMgr.MarkUsed(env.ID, time.Now())
+			}
+			logEnvironment("copy exited", recorded[i], start, "copy", i, "error", errs[i])
+		}(i, env)
+	}
+	wg.Wait()
+
+	failed := 0
+	var exit *commandExitError
+	for i, err := range errs {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, emoji("❌ Copy %d (%s): %v\n"), i, envs[i].ID, err)
+			failed++
+			if exit == nil {
+				errors.As(err, &exit)
+			}
+		}
+	}
+	if failed > 0 {
+		err := fmt.Errorf("%d of %d copies failed", failed, len(envs))
+		// Exit with the status of the first copy that exited unsuccessfully
+		if exit != nil {
+			return &commandExitError{code: exit.code, err: err}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// runCopy runs args in env and waits for it to exit.
+func runCopy(ctx context.Context, index int, env *isolation.Environment, args []string) error {
+	// #nosec G204 - running the user's command is the purpose of 'run'
+	c := exec.CommandContext(ctx, args[0], args[1:]...)
+	c.Dir = env.WorktreePath
+	c.Cancel = func() error { return c.Process.Signal(syscall.SIGTERM) }
+	c.WaitDelay = runKillGrace
+
+	c.Env = append(environmentVars(env),
+		fmt.Sprintf("PORTALLOC_COPY_INDEX=%d", index),
+		fmt.Sprintf("PORTALLOC_COPIES=%d", runCopies),
+	)
+
+	var stdout, stderr io.Writer = os.Stdout, os.Stderr
+	if runCopies > 1 {
+		prefix := fmt.Sprintf("[%d] ", index)
+		prefixOut := newPrefixWriter(os.Stdout, prefix)
+		prefixErr := newPrefixWriter(os.Stderr, prefix)
+		defer prefixOut.Flush()
+		defer prefixErr.Flush()
+		stdout, stderr = prefixOut, prefixErr
+	} else if !runKillTree || !isTerminal(os.Stdin) {
+		// A terminal would stop a background process group that reads it
+		c.Stdin = os.Stdin
+	}
+	c.Stdout, c.Stderr = stdout, stderr
+
+	// Services started by --setup must be ready before the command runs
+	var setup *setupProcess
+	if runSetup != "" {
+		var err error
+		if setup, err = startSetup(runSetup, c.Dir, c.Env, stdout, stderr); err != nil {
+			return err
+		}
+		defer setup.Stop()
+	}
+	if err := waitForGates(ctx, env, runWaitGates, runWaitTimeout, setup, stderr); err != nil {
+		return err
+	}
+
+	if runKillTree {
+		return exitError(runProcessGroup(c))
+	}
+	return exitError(c.Run())
+}
+
+// commandExitError is a command run by 'run' exiting unsuccessfully. The
+// go-portalloc process exits with the same code; see ExitCode.
+type commandExitError struct {
+	code int
+	err  error
+}
+
+func (e *commandExitError) Error() string { return e.err.Error() }
+func (e *commandExitError) Unwrap() error { return e.err }
+
+// exitError converts a command's exit error to a *commandExitError with its
+// exit status, or 128+N if it was killed by signal N, as shells report it.
+func exitError(err error) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return &commandExitError{
+			code: 128 + int(status.Signal()),
+			err:  fmt.Errorf("killed by signal %s", status.Signal()),
+		}
+	}
+	return &commandExitError{
+		code: exitErr.ExitCode(),
+		err:  fmt.Errorf("exit status %d", exitErr.ExitCode()),
+	}
+}
+
+// prefixWriter prefixes every line written to it. Complete lines are written
+// atomically so output from concurrent copies does not interleave mid-line.
+type prefixWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+// outputMu serializes line writes across all prefixWriters.
+var outputMu sync.Mutex
+
+func newPrefixWriter(w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{w: w, prefix: []byte(prefix)}
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.buf = append(p.buf, data...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := p.writeLine(p.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[i+1:]
+	}
+	return len(data), nil
+}
+
+// Flush writes any trailing partial line.
+func (p *prefixWriter) Flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.buf) > 0 {
+		_ = p.writeLine(append(p.buf, '\n'))
+		p.buf = nil
+	}
+}
+
+func (p *prefixWriter) writeLine(line []byte) error {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+
+	_, err := p.w.Write(append(append([]byte{}, p.prefix...), line...))
+	return err
+}
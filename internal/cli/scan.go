@@ -0,0 +1,253 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/spf13/cobra"
+)
+
+var (
+	scanRange  string
+	scanFormat string
+)
+
+// heatmapWidth is the number of cells per heatmap row.
+const heatmapWidth = 50
+
+var scanCmd = &cobra.Command{
+	Use:   "scan",
+	Short: "Show which ports in a range are bound",
+	Long: `Scan probes every port in a range the way the allocator does and reports
+which are bound, with the owning processes where they can be resolved
+(Linux; other users' processes need root) and the environment that
+allocated each port. Use it to find out why allocations fail on a host.
+
+Formats:
+  table     One row per bound port, plus a summary (default)
+  json      Machine-readable report
+  heatmap   Density of bound ports across the range`,
+	Example: `  # Ports bound in the default allocation range
+  go-portalloc scan
+
+  # Density overview of a custom range
+  go-portalloc scan --range 40000-50000 --format heatmap`,
+	Args: cobra.NoArgs,
+	RunE: runScan,
+}
+
+func init() {
+	scanCmd.Flags().StringVar(&scanRange, "range", defaultScanRange(), "Port range to scan as START-END (END exclusive)")
+	scanCmd.Flags().StringVar(&scanFormat, "format", "table", "Output format (table, json, heatmap)")
+}
+
+// scanPort is a bound port in the 'scan --format json' output.
+type scanPort struct {
+	Port        int      `json:"port"`
+	PIDs        []int    `json:"pids,omitempty"`
+	Commands    []string `json:"commands,omitempty"`
+	Environment string   `json:"environment,omitempty"`
+}
+
+// scanReport is the 'scan --format json' output.
+type scanReport struct {
+	StartPort      int        `json:"start_port"`
+	EndPort        int        `json:"end_port"`
+	Total          int        `json:"total"`
+	Bound          int        `json:"bound"`
+	LargestFreeRun int        `json:"largest_free_run"`
+	Ports          []scanPort `json:"ports"`
+}
+
+func runScan(cmd *cobra.Command, args []string) error {
+	switch scanFormat {
+	case "table", "json", "heatmap":
+	default:
+		return usageErrorf("unknown format: %s", scanFormat)
+	}
+	start, end, err := parsePortRange(scanRange)
+	if err != nil {
+		return &usageError{err: err}
+	}
+
+	config := ports.DefaultAllocatorConfig()
+	config.StartPort = start
+	config.EndPort = end
+	config.Logger = logger
+	busy := ports.NewAllocator(config).BusyPorts()
+
+	report := newScanReport(start, end, busy)
+
+	switch scanFormat {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	case "heatmap":
+		outputScanHeatmap(report)
+	default:
+		outputScanTable(report)
+	}
+	return nil
+}
+
+// defaultScanRange is the allocator's range, as --range.
+func defaultScanRange() string {
+	start, end := ports.DefaultRange()
+	return fmt.Sprintf("%d-%d", start, end)
+}
+
+// parsePortRange parses "START-END" with END exclusive.
+func parsePortRange(s string) (int, int, error) {
+	startStr, endStr, ok := strings.Cut(s, "-")
+	start, startErr := strconv.Atoi(strings.TrimSpace(startStr))
+	end, endErr := strconv.Atoi(strings.TrimSpace(endStr))
+	if !ok || startErr != nil || endErr != nil {
+		return 0, 0, fmt.Errorf("invalid range %q: expected START-END", s)
+	}
+	if start < 1 || end > 65536 || start >= end {
+		return 0, 0, fmt.Errorf("invalid range %q: expected 1 <= START < END <= 65536", s)
+	}
+	return start, end, nil
+}
+
+// newScanReport annotates busy ports with their owning processes and
+// recorded environments. Both lookups are best effort.
+func newScanReport(start, end int, busy []int) *scanReport {
+	owners, _ := ports.ListenerPIDs()
+
+	envByPort := make(map[int]string)
+	if stateMgr, err := newStateManager(); err == nil {
+		if envs, err := stateMgr.ListEnvironments(); err == nil {
+			for _, env := range envs {
+				if env.Ports == nil {
+					continue
+				}
+				for _, port := range env.Ports.Allocated {
+					envByPort[port] = env.ID
+				}
+			}
+		}
+	}
+
+	report := &scanReport{
+		StartPort: start,
+		EndPort:   end,
+		Total:     end - start,
+		Bound:     len(busy),
+		Ports:     make([]scanPort, 0, len(busy)),
+	}
+
+	prev := start - 1
+	for _, port := range busy {
+		report.LargestFreeRun = max(report.LargestFreeRun, port-prev-1)
+		prev = port
+
+		entry := scanPort{Port: port, PIDs: owners[port], Environment: envByPort[port]}
+		for _, pid := range entry.PIDs {
+			entry.Commands = append(entry.Commands, processCommand(pid))
+		}
+		report.Ports = append(report.Ports, entry)
+	}
+	report.LargestFreeRun = max(report.LargestFreeRun, end-prev-1)
+
+	return report
+}
+
+// processCommand returns the command name of pid, or "?" if unknown.
+func processCommand(pid int) string {
+	// #nosec G304 - reads the command name of a process under /proc
+	comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return "?"
+	}
+	return strings.TrimSpace(string(comm))
+}
+
+func outputScanTable(report *scanReport) {
+	if len(report.Ports) > 0 {
+		t := &table{rule: true}
+		t.add("PORT", "PID", "COMMAND", "ENVIRONMENT")
+		for _, p := range report.Ports {
+			pids := make([]string, len(p.PIDs))
+			for i, pid := range p.PIDs {
+				pids[i] = strconv.Itoa(pid)
+			}
+			t.add(strconv.Itoa(p.Port),
+				orDash(strings.Join(pids, ",")),
+				truncate(orDash(strings.Join(p.Commands, ",")), 25),
+				orDash(p.Environment))
+		}
+		_ = t.write(os.Stdout)
+		fmt.Println()
+	}
+	printScanSummary(report)
+}
+
+func outputScanHeatmap(report *scanReport) {
+	cellSize := max(1, (report.Total+heatmapWidth*20-1)/(heatmapWidth*20))
+	counts := make([]int, (report.Total+cellSize-1)/cellSize)
+	for _, p := range report.Ports {
+		counts[(p.Port-report.StartPort)/cellSize]++
+	}
+
+	fmt.Printf("Each cell is %d port(s):  . none  ░ <25%%  ▒ <50%%  ▓ <100%%  █ all bound\n\n", cellSize)
+	for row := 0; row < len(counts); row += heatmapWidth {
+		var line strings.Builder
+		for cell := row; cell < min(row+heatmapWidth, len(counts)); cell++ {
+			size := min(cellSize, report.Total-cell*cellSize)
+			line.WriteRune(heatmapCell(counts[cell], size))
+		}
+		fmt.Printf("%5d %s\n", report.StartPort+row*cellSize, line.String())
+	}
+	fmt.Println()
+	printScanSummary(report)
+}
+
+// orDash returns s, or "-" if s is empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// heatmapCell renders the share of bound ports in a cell.
+func heatmapCell(bound, total int) rune {
+	switch {
+	case bound == 0:
+		return '.'
+	case bound == total:
+		return '█'
+	case bound*4 < total:
+		return '░'
+	case bound*2 < total:
+		return '▒'
+	default:
+		return '▓'
+	}
+}
+
+func printScanSummary(report *scanReport) {
+	fmt.Printf("Scanned %d-%d: %d of %d port(s) bound (%.1f%%), largest free run %d\n",
+		report.StartPort, report.EndPort, report.Bound, report.Total,
+		float64(report.Bound)*100/float64(report.Total), report.LargestFreeRun)
+}
@@ -0,0 +1,42 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePortRange(t *testing.T) {
+	start, end, err := parsePortRange("20000-30000")
+	require.NoError(t, err)
+	assert.Equal(t, 20000, start)
+	assert.Equal(t, 30000, end)
+
+	for _, invalid := range []string{"", "20000", "a-b", "300-200", "0-10", "1-70000"} {
+		_, _, err := parsePortRange(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestHeatmapCell(t *testing.T) {
+	assert.Equal(t, '.', heatmapCell(0, 10))
+	assert.Equal(t, '░', heatmapCell(2, 10))
+	assert.Equal(t, '▒', heatmapCell(4, 10))
+	assert.Equal(t, '▓', heatmapCell(9, 10))
+	assert.Equal(t, '█', heatmapCell(10, 10))
+}
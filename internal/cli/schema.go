@@ -0,0 +1,175 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/spf13/cobra"
+)
+
+// outputSchemaVersion is the version of the create/list JSON output contract.
+// Bump it whenever a field is renamed or removed, or a document changes
+// shape. Version 2: 'create --count N --json' prints an array.
+const outputSchemaVersion = "2"
+
+const schemaBaseURL = "https://github.com/pigeonworks-llc/go-portalloc/schema"
+
+var schemaCmd = &cobra.Command{
+	Use:   "schema <state|create-output|list-output|watch-event>",
+	Short: "Print JSON Schemas for state and command output",
+	Long: `Schema prints a JSON Schema (draft 2020-12) describing one of the
+JSON documents produced by go-portalloc.
+
+Available schemas:
+  state          The state file (~/.go-portalloc/state.json)
+  create-output  The output of 'create --json': one document, or an
+                 array of them with --count
+  list-output    The output of 'list --format json'
+  watch-event    One line of 'watch --format jsonl' output
+
+Schemas are generated from the Go types that produce the documents and
+carry a versioned $id, so downstream tools can validate against them.`,
+	Example: `  # Print the state file schema
+  go-portalloc schema state
+
+  # Save the create output schema for codegen
+  go-portalloc schema create-output > create-output.schema.json`,
+	Args:      cobra.ExactArgs(1),
+	ValidArgs: []string{"state", "create-output", "list-output", "watch-event"},
+	RunE:      runSchema,
+}
+
+func runSchema(cmd *cobra.Command, args []string) error {
+	var (
+		value   interface{}
+		version string
+		title   string
+	)
+
+	switch args[0] {
+	case "state":
+		value, version, title = state.State{}, state.CurrentVersion, "go-portalloc state file"
+	case "create-output":
+		value, version, title = createOutput{}, outputSchemaVersion, "go-portalloc create --json output"
+	case "list-output":
+		value, version, title = []listOutputEntry{}, outputSchemaVersion, "go-portalloc list --format json output"
+	case "watch-event":
+		value, version, title = watchEvent{}, outputSchemaVersion, "go-portalloc watch --format jsonl event"
+	default:
+		return usageErrorf("unknown schema: %s (expected state, create-output, list-output, or watch-event)", args[0])
+	}
+
+	schema := schemaFor(reflect.TypeOf(value))
+	if args[0] == "create-output" {
+		// create --count prints an array of the usual documents
+		schema = map[string]interface{}{
+			"oneOf": []interface{}{schema, map[string]interface{}{"type": "array", "items": schema}},
+		}
+	}
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["$id"] = fmt.Sprintf("%s/%s/v%s.json", schemaBaseURL, args[0], version)
+	schema["title"] = title
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(schema)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaFor builds a JSON Schema for a Go type using its encoding/json tags.
+// Pointers, slices, and maps may be encoded as null and are marked nullable.
+func schemaFor(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		return map[string]interface{}{
+			"anyOf": []interface{}{schemaFor(t.Elem()), map[string]interface{}{"type": "null"}},
+		}
+	}
+
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": []string{"array", "null"}, "items": schemaFor(t.Elem())}
+	case reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": []string{"object", "null"}, "additionalProperties": schemaFor(t.Elem())}
+	case reflect.Struct:
+		return structSchema(t)
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// structSchema builds an object schema; fields without omitempty are required.
+func structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := field.Name
+		omitEmpty := false
+		if tag, ok := field.Tag.Lookup("json"); ok {
+			parts := strings.Split(tag, ",")
+			if parts[0] == "-" {
+				continue
+			}
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			for _, opt := range parts[1:] {
+				if opt == "omitempty" {
+					omitEmpty = true
+				}
+			}
+		}
+
+		properties[name] = schemaFor(field.Type)
+		if !omitEmpty {
+			required = append(required, name)
+		}
+	}
+
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/internal/selfupdate"
+	"github.com/spf13/cobra"
+)
+
+var (
+	selfUpdateForce bool
+	versionCheck    bool
+)
+
+// updateTimeout bounds release lookups and downloads.
+const updateTimeout = 2 * time.Minute
+
+// newUpdateClient returns the releases client; PORTALLOC_UPDATE_API_URL
+// points it at a mirror of the GitHub API.
+func newUpdateClient() *selfupdate.Client {
+	client := selfupdate.NewClient()
+	if url := os.Getenv("PORTALLOC_UPDATE_API_URL"); url != "" {
+		client.APIURL = url
+	}
+	return client
+}
+
+var selfUpdateCmd = &cobra.Command{
+	Use:   "self-update",
+	Short: "Update go-portalloc to the latest release",
+	Long: `Self-update downloads the latest GitHub release for this platform, verifies
+the release's checksums.txt against its minisign signature and the public key
+built into this binary, verifies the archive against checksums.txt (SHA-256),
+and replaces the running binary. Set GITHUB_TOKEN to avoid API rate limits; it
+is only sent to api.github.com.
+
+Use 'go-portalloc version --check' to only report whether an update exists.`,
+	Example: `  # Update in a CI image
+  go-portalloc self-update
+
+  # Reinstall the latest release even if it is not newer
+  go-portalloc self-update --force`,
+	Args: cobra.NoArgs,
+	RunE: runSelfUpdate,
+}
+
+func init() {
+	selfUpdateCmd.Flags().BoolVar(&selfUpdateForce, "force", false, "Install the latest release even if it is not newer")
+	versionCmd.Flags().BoolVar(&versionCheck, "check", false, "Check whether a newer release is available")
+}
+
+func runSelfUpdate(cmd *cobra.Command, args []string) error {
+	cmd.SilenceUsage = true
+
+	ctx, cancel := context.WithTimeout(cmd.Context(), updateTimeout)
+	defer cancel()
+
+	client := newUpdateClient()
+	release, err := client.LatestRelease(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !selfUpdateForce && !selfupdate.IsNewer(release.TagName, Version) {
+		fmt.Printf(emoji("✅ go-portalloc %s is up to date\n"), Version)
+		return nil
+	}
+
+	binary, err := client.DownloadBinary(ctx, release, runtime.GOOS, runtime.GOARCH)
+	if err != nil {
+		return err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate executable: %w", err)
+	}
+	if err := selfupdate.ReplaceExecutable(executable, binary); err != nil {
+		return err
+	}
+
+	fmt.Printf(emoji("✅ Updated go-portalloc %s -> %s\n"), Version, release.TagName)
+	return nil
+}
+
+func runVersion(cmd *cobra.Command, args []string) error {
+	fmt.Printf("go-portalloc version %s\n", Version)
+	if !versionCheck {
+		return nil
+	}
+
+	cmd.SilenceUsage = true
+
+	ctx, cancel := context.WithTimeout(cmd.Context(), updateTimeout)
+	defer cancel()
+
+	release, err := newUpdateClient().LatestRelease(ctx)
+	if err != nil {
+		return err
+	}
+
+	if selfupdate.IsNewer(release.TagName, Version) {
+		fmt.Printf("A newer release is available: %s (run 'go-portalloc self-update')\n", release.TagName)
+	} else {
+		fmt.Println("Up to date")
+	}
+	return nil
+}
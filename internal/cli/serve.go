@@ -0,0 +1,587 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/internal/daemon"
+	"github.com/pigeonworks-llc/go-portalloc/internal/snapshot"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/client"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	serveListen   string
+	serveInterval time.Duration
+	serveGC       bool
+	serveNotify   bool
+	serveLockDir  string
+	serveReadOnly bool
+
+	serveUnixSocket  string
+	serveSocketMode  string
+	serveSocketGroup string
+
+	serveSnapshotTo       string
+	serveSnapshotInterval time.Duration
+
+	serveRateLimit            float64
+	serveRateBurst            int
+	serveMaxConcurrentCreates int
+
+	serveTokenFile   string
+	serveTLSCert     string
+	serveTLSKey      string
+	serveTLSClientCA string
+
+	serveDrainTimeout time.Duration
+	serveLeaseTTL     time.Duration
+
+	servePIDFile string
+	serveSystemd bool
+)
+
+// serveShutdownTimeout bounds how long in-flight HTTP requests may take on exit.
+const serveShutdownTimeout = 5 * time.Second
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Run as a daemon that reconciles state and exposes metrics",
+	Long: `Serve runs in the foreground, reconciling the state file from lock files
+every --interval and serving Prometheus metrics on /metrics:
+
+  portalloc_environments{status}      Active and stale environments
+  portalloc_allocated_ports           Ports held by recorded environments
+  portalloc_port_range_utilization    Allocated ports / allocation range size
+  portalloc_operations_total{operation}  create, cleanup, and reconcile counts
+  portalloc_stale_detections_total    Environments whose process died
+
+With --gc, stale environments are cleaned up on every tick; if the config
+file has a retention policy, only the environments it selects are. With
+--notify, observed lifecycle events are sent to the configured webhooks.
+
+The REST API under /v1 (used by pkg/client) lists, creates, and removes
+environments and allocates ports:
+
+  GET    /v1/environments        List environments
+  POST   /v1/environments        Create an environment
+  GET    /v1/environments/{id}   Get an environment
+  DELETE /v1/environments/{id}   Clean up an environment
+  POST   /v1/ports               Find free ports (not reserved)
+  GET    /v1/leases              List port leases
+  POST   /v1/leases              Lease ports within constraints
+  DELETE /v1/leases/{id}         Release a lease
+  POST   /v1/leases/{id}/renew   Extend a lease by its TTL
+
+Environments created through the API are owned by the daemon. Leases are
+port ranges the daemon allocates from its range, within the client's
+min/max port, count, and protocol constraints, and records with the
+client's labels and identity in leases.json next to the state file. A
+lease lives for its TTL (--lease-ttl, or the request's ttl_seconds up to
+24h) unless its owner renews it, and only its owner may renew or release
+it. Every allocation, including create and POST /v1/ports, skips leased
+ports, so leased ports are never handed out twice. Use --read-only to
+disable creating and removing environments and leases.
+
+With --unix-socket, the daemon serves on a Unix socket instead of a TCP
+port, and access is restricted by the socket's --socket-mode and
+--socket-group. Connect with client.WithUnixSocket or curl --unix-socket.
+
+With --token-file, TCP clients must send "Authorization: Bearer TOKEN"
+with a token from the file (one TOKEN or USER:TOKEN per line, mode 0600).
+With --tls-cert and --tls-key the daemon serves HTTPS, and --tls-client-ca
+also accepts client certificates signed by that CA in place of a token.
+Unix socket clients never authenticate, and TCP is only served with
+authentication: without --token-file or --tls-client-ca, use --unix-socket.
+
+With --snapshot-to, the state is uploaded to S3 or GCS every
+--snapshot-interval and on exit, as <prefix>/<hostname>/<timestamp>.json
+plus <prefix>/<hostname>/latest.json, so environments created on ephemeral
+VMs stay auditable after the VM is recycled. Credentials are read from
+AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY (GCS HMAC keys for gs://);
+PORTALLOC_S3_ENDPOINT selects an S3-compatible endpoint such as MinIO.
+Use 'go-portalloc restore' to download a snapshot.
+
+On SIGTERM or SIGINT, the daemon stops creating environments and leases
+(503, code UNAVAILABLE) while the rest of the API keeps serving. With
+--drain-timeout, it then waits up to that long for the active environments
+of other processes to be cleaned up, cleaning up stale ones with --gc; a
+second signal stops the wait. It reconciles the state file a last time,
+uploads a final snapshot, and emits a "shutdown" event (log record and,
+with --notify, webhook) listing the environments still active.
+
+For supervisors, GET /healthz answers 200 while the process serves HTTP,
+and GET /readyz answers 200 only while the last tick reconciled the state
+file within three intervals and the daemon is not shutting down (503
+otherwise). Neither requires authentication. The daemon holds a lock on
+--pid-file (serve.pid in the state directory) while it runs, refuses to
+start if another daemon holds it, and 'go-portalloc doctor' reports the
+daemon holding it. Garbage collection runs in the same daemon with --gc.
+
+With --systemd, the daemon serves on the socket systemd passes it through
+socket activation (LISTEN_FDS) if there is one, and otherwise binds as
+usual; it also reports readiness and shutdown for Type=notify units. Use
+'go-portalloc serve install' to generate user-level systemd units.`,
+	Example: `  # Expose metrics for a Prometheus scrape job
+  go-portalloc serve --listen 127.0.0.1:9465 --token-file ~/.config/portalloc/tokens
+
+  # Also reap environments left behind by crashed jobs every minute
+  go-portalloc serve --unix-socket /run/portalloc.sock --gc --interval 1m
+
+  # Serve only to members of the "dev" group, without using a port
+  go-portalloc serve --unix-socket /run/portalloc.sock --socket-group dev
+
+  # Keep an audit trail of environments in S3
+  go-portalloc serve --unix-socket /run/portalloc.sock --snapshot-to s3://ci-audit/portalloc --snapshot-interval 5m
+
+  # Allow each client 5 API requests/s and at most 4 creations at a time
+  go-portalloc serve --unix-socket /run/portalloc.sock --rate-limit 5 --max-concurrent-creates 4
+
+  # Expose the daemon on a shared build host with per-user tokens and mTLS
+  go-portalloc serve --listen 0.0.0.0:9465 --token-file /etc/portalloc/tokens \
+    --tls-cert server.pem --tls-key server-key.pem --tls-client-ca ci-ca.pem`,
+	RunE: runServe,
+}
+
+func init() {
+	serveCmd.Flags().StringVar(&serveListen, "listen", "127.0.0.1:9465", "HTTP listen address")
+	serveCmd.Flags().DurationVar(&serveInterval, "interval", 30*time.Second, "Reconcile interval")
+	serveCmd.Flags().BoolVar(&serveGC, "gc", false, "Clean up stale environments on every tick")
+	serveCmd.Flags().BoolVar(&serveNotify, "notify", false, "Send observed lifecycle events to configured webhooks")
+	serveCmd.Flags().StringVar(&serveLockDir, "lock-dir", defaultLockDir, "Lock directory")
+	serveCmd.Flags().StringVar(&serveUnixSocket, "unix-socket", "", "Serve on this Unix socket instead of --listen")
+	serveCmd.Flags().StringVar(&serveSocketMode, "socket-mode", "0660", "Permissions of the Unix socket (e.g. 0600 for owner only)")
+	serveCmd.Flags().StringVar(&serveSocketGroup, "socket-group", "", "Group that owns the Unix socket")
+	serveCmd.Flags().BoolVar(&serveReadOnly, "read-only", false, "Disable API endpoints that create or remove environments")
+	serveCmd.Flags().StringVar(&serveSnapshotTo, "snapshot-to", "", "Upload state snapshots to this s3:// or gs:// prefix")
+	serveCmd.Flags().DurationVar(&serveSnapshotInterval, "snapshot-interval", 15*time.Minute, "Snapshot upload interval")
+	serveCmd.Flags().Float64Var(&serveRateLimit, "rate-limit", 0, "API requests per second allowed per client IP (0 = unlimited)")
+	serveCmd.Flags().IntVar(&serveRateBurst, "rate-burst", 0, "API requests a client may burst above --rate-limit (default: the rate)")
+	serveCmd.Flags().IntVar(&serveMaxConcurrentCreates, "max-concurrent-creates", 0, "Environment creations the API runs at once (0 = unlimited)")
+	serveCmd.Flags().StringVar(&serveTokenFile, "token-file", "", "Require TCP clients to send a bearer token from this file")
+	serveCmd.Flags().StringVar(&serveTLSCert, "tls-cert", "", "Serve HTTPS with this certificate (PEM)")
+	serveCmd.Flags().StringVar(&serveTLSKey, "tls-key", "", "Private key for --tls-cert (PEM)")
+	serveCmd.Flags().DurationVar(&serveDrainTimeout, "drain-timeout", 0, "On shutdown, wait up to this long for active environments to be cleaned up")
+	serveCmd.Flags().StringVar(&serveTLSClientCA, "tls-client-ca", "", "Authenticate TCP clients by certificates signed by this CA (PEM)")
+	serveCmd.Flags().BoolVar(&serveSystemd, "systemd", false, "Serve on the socket passed by systemd socket activation, if any, and notify systemd when ready")
+	serveCmd.Flags().DurationVar(&serveLeaseTTL, "lease-ttl", daemon.DefaultLeaseTTL, "How long a lease lives unless its owner renews it")
+	serveCmd.Flags().StringVar(&servePIDFile, "pid-file", "", "PID file locked while the daemon runs (default: serve.pid in the state directory)")
+}
+
+func runServe(cmd *cobra.Command, args []string) error {
+	if serveInterval <= 0 {
+		return usageErrorf("--interval must be positive")
+	}
+	if serveDrainTimeout < 0 {
+		return usageErrorf("--drain-timeout must not be negative")
+	}
+	if serveRateLimit < 0 || serveRateBurst < 0 || serveMaxConcurrentCreates < 0 {
+		return usageErrorf("--rate-limit, --rate-burst, and --max-concurrent-creates must not be negative")
+	}
+	if serveLeaseTTL < time.Second || serveLeaseTTL > daemon.MaxLeaseTTL {
+		return usageErrorf("--lease-ttl must be between 1s and %s", daemon.MaxLeaseTTL)
+	}
+
+	stateMgr, err := newStateManager()
+	if err != nil {
+		return fmt.Errorf("failed to create state manager: %w", err)
+	}
+
+	var snapshots *snapshotUploader
+	if serveSnapshotTo != "" {
+		if serveSnapshotInterval <= 0 {
+			return usageErrorf("--snapshot-interval must be positive")
+		}
+		loc, err := snapshot.ParseLocation(serveSnapshotTo)
+		if err != nil {
+			return err
+		}
+		snapshots = &snapshotUploader{client: snapshot.NewClient(loc), loc: loc, stateMgr: stateMgr}
+	}
+
+	rangeStart, rangeEnd := ports.DefaultRange()
+	config := daemon.Config{
+		LockDir:    serveLockDir,
+		Interval:   serveInterval,
+		RangeStart: rangeStart,
+		RangeSize:  rangeEnd - rangeStart,
+		Leases:     !serveReadOnly,
+		LeaseFile:  filepath.Join(filepath.Dir(stateMgr.Path()), daemon.LeaseFileName),
+		LeaseTTL:   serveLeaseTTL,
+
+		RateLimit:            serveRateLimit,
+		RateBurst:            serveRateBurst,
+		MaxConcurrentCreates: serveMaxConcurrentCreates,
+	}
+	if serveTokenFile != "" {
+		if config.Tokens, err = daemon.LoadTokens(serveTokenFile); err != nil {
+			return err
+		}
+	}
+	tlsConfig, err := serveTLSConfig()
+	if err != nil {
+		return err
+	}
+	config.ClientCertAuth = serveTLSClientCA != ""
+	if serveGC {
+		manager := isolation.NewEnvironmentManager(isolation.NewIDGenerator(&isolation.Config{LockDir: serveLockDir}), nil)
+		config.Cleanup = func(env *state.EnvironmentState) error {
+			if err := cleanupEnvironment(manager, env.Environment()); err != nil {
+				return err
+			}
+			return stateMgr.RemoveEnvironment(env.ID)
+		}
+
+		// A retention policy narrows --gc from every stale environment
+		policy, err := loadRetention()
+		if err != nil {
+			return err
+		}
+		if policy != nil {
+			maxLockAge, err := loadMaxLockAge()
+			if err != nil {
+				return err
+			}
+			config.SelectCleanup = func(envs []*state.EnvironmentState) []*state.EnvironmentState {
+				return policy.Select(envs, time.Now(), 0, maxLockAge)
+			}
+		}
+	}
+	config.OnEvents = func(events []state.Event) {
+		for _, event := range events {
+			logEnvironment("environment "+string(event.Type), event.Environment, time.Time{})
+		}
+		if serveNotify {
+			notifyEvents(events)
+		}
+	}
+
+	if !serveReadOnly {
+		config.Create = func(ctx context.Context, req *client.CreateRequest) (*state.EnvironmentState, error) {
+			portsNeeded := req.Ports
+			if portsNeeded == 0 {
+				portsNeeded = defaultPorts
+			}
+			env, err := createRecordedEnvironment(ctx, &environmentRequest{
+				Ports:        portsNeeded,
+				WorktreePath: req.WorktreePath,
+				InstanceID:   req.InstanceID,
+				Profile:      req.Profile,
+				LockDir:      serveLockDir,
+				Via:          apiVia(ctx),
+			})
+			if err != nil {
+				return nil, err
+			}
+			return state.NewEnvironmentState(env), nil
+		}
+		config.Remove = func(ctx context.Context, env *state.EnvironmentState) error {
+			return removeRecordedEnvironment(ctx, stateMgr, env, serveLockDir, apiVia(ctx))
+		}
+	}
+	// Report a bad reserved ports file now; the allocator is rebuilt per
+	// request so that it sees the leases granted since startup
+	if _, err := newPortAllocator(); err != nil {
+		return err
+	}
+	config.AllocatePorts = func(count int) (int, error) {
+		allocator, err := newPortAllocator()
+		if err != nil {
+			return 0, err
+		}
+		return allocator.AllocateRange(count)
+	}
+
+	server := daemon.New(stateMgr, config)
+
+	// Bind before serving so an address in use is reported immediately
+	listener, err := serveListener(cmd, len(config.Tokens) > 0 || config.ClientCertAuth)
+	if err != nil {
+		return err
+	}
+
+	// One daemon per state directory: a second would race the first's ticks
+	pidFile, err := servePIDPath()
+	if err != nil {
+		_ = listener.Close()
+		return err
+	}
+	address := listener.Addr().String()
+	if listener.Addr().Network() == "unix" {
+		address = "unix:" + address
+	}
+	releasePIDFile, err := daemon.AcquirePIDFile(pidFile, daemon.PIDInfo{PID: os.Getpid(), Address: address, StartedAt: time.Now().UTC()})
+	if err != nil {
+		_ = listener.Close()
+		return err
+	}
+	defer releasePIDFile()
+	httpServer := &http.Server{
+		Handler:           server.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig:         tlsConfig,
+	}
+
+	// Failures from here on are the daemon's, not a usage problem
+	cmd.SilenceUsage = true
+
+	ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if tlsConfig != nil {
+			// The certificate is already in tlsConfig
+			serveErr <- httpServer.ServeTLS(listener, "", "")
+		} else {
+			serveErr <- httpServer.Serve(listener)
+		}
+		stop()
+	}()
+
+	switch {
+	case listener.Addr().Network() == "unix":
+		fmt.Printf(emoji("📈 Serving metrics on %s (/metrics)\n"), address)
+	case tlsConfig != nil:
+		fmt.Printf(emoji("📈 Serving metrics on https://%s/metrics\n"), listener.Addr())
+	default:
+		fmt.Printf(emoji("📈 Serving metrics on http://%s/metrics\n"), listener.Addr())
+	}
+
+	onError := func(err error) {
+		fmt.Fprintf(os.Stderr, emoji("⚠️  %v\n"), err)
+	}
+	if snapshots != nil {
+		go snapshots.run(ctx, serveSnapshotInterval, onError)
+	}
+
+	if serveSystemd {
+		if err := daemon.NotifySystemd("READY=1"); err != nil {
+			onError(err)
+		}
+	}
+
+	_ = server.Run(ctx, onError)
+
+	// Stop creating, but keep serving so clients can still clean up
+	server.StopAccepting()
+	if serveSystemd {
+		_ = daemon.NotifySystemd("STOPPING=1")
+	}
+	fmt.Println(emoji("🛑 Shutting down: no longer creating environments"))
+	var remaining []*state.EnvironmentState
+	if serveDrainTimeout > 0 {
+		remaining = drainEnvironments(cmd.Context(), server, onError)
+	}
+	if err := server.Tick(); err != nil {
+		onError(err)
+	}
+
+	if snapshots != nil {
+		// Final snapshot so the record survives the host
+		finalCtx, cancel := context.WithTimeout(context.Background(), serveShutdownTimeout)
+		if err := snapshots.upload(finalCtx); err != nil {
+			onError(err)
+		}
+		cancel()
+	}
+
+	emitShutdown(remaining)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), serveShutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shut down HTTP server: %w", err)
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("HTTP server failed: %w", err)
+	}
+	return nil
+}
+
+// servePIDPath returns --pid-file, or serve.pid in the state directory.
+// leaseFilePath returns the lease file serve keeps next to the state file,
+// or "" if there is no state directory.
+func leaseFilePath() string {
+	mgr, err := state.NewManager()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(mgr.Path()), daemon.LeaseFileName)
+}
+
+func servePIDPath() (string, error) {
+	if servePIDFile != "" {
+		return servePIDFile, nil
+	}
+	dir, err := state.StateDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate state directory: %w", err)
+	}
+	return filepath.Join(dir, daemon.PIDFileName), nil
+}
+
+// serveListener binds the TCP address or, with --unix-socket, the Unix socket.
+// With --systemd, a socket passed by systemd socket activation is used
+// instead if there is one. TCP is only served with authentication, since
+// every local user can reach even a loopback address.
+func serveListener(cmd *cobra.Command, authenticated bool) (net.Listener, error) {
+	if serveSystemd {
+		listener, err := daemon.ListenSystemd()
+		switch {
+		case err == nil:
+			if cmd.Flags().Changed("listen") || serveUnixSocket != "" {
+				_ = listener.Close()
+				return nil, usageErrorf("--listen and --unix-socket cannot be used with a socket passed by systemd")
+			}
+			if listener.Addr().Network() == "tcp" && !authenticated {
+				_ = listener.Close()
+				return nil, usageErrorf("refusing to serve %s without authentication: use --token-file or --tls-client-ca", listener.Addr())
+			}
+			return listener, nil
+		case !errors.Is(err, daemon.ErrNotSocketActivated):
+			return nil, err
+		}
+		// Started without socket activation: bind as usual
+	}
+	if serveUnixSocket == "" {
+		if !authenticated {
+			return nil, usageErrorf("refusing to serve %s without authentication: use --token-file or --tls-client-ca, or --unix-socket", serveListen)
+		}
+		listener, err := net.Listen("tcp", serveListen)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %w", serveListen, err)
+		}
+		return listener, nil
+	}
+	if cmd.Flags().Changed("listen") {
+		return nil, usageErrorf("--listen and --unix-socket are mutually exclusive")
+	}
+	mode, err := strconv.ParseUint(serveSocketMode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return nil, usageErrorf("invalid --socket-mode %q: expected octal permissions such as 0660", serveSocketMode)
+	}
+	return daemon.ListenUnix(serveUnixSocket, os.FileMode(mode), serveSocketGroup)
+}
+
+// drainEnvironments waits up to --drain-timeout, or until another signal,
+// for the active environments of other processes to be cleaned up, and
+// returns those still active.
+func drainEnvironments(parent context.Context, server *daemon.Server, onError func(error)) []*state.EnvironmentState {
+	ctx, stop := signal.NotifyContext(parent, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, serveDrainTimeout)
+	defer cancel()
+
+	fmt.Printf(emoji("⏳ Waiting up to %s for active environments to be cleaned up\n"), serveDrainTimeout)
+	remaining := server.Drain(ctx, min(serveInterval, time.Second), onError)
+	if len(remaining) == 0 {
+		fmt.Println(emoji("✅ All environments drained"))
+	}
+	return remaining
+}
+
+// shutdownEvent is the log record and webhook body emitted on shutdown.
+type shutdownEvent struct {
+	Event     string   `json:"event"`
+	Time      string   `json:"time"`
+	Host      string   `json:"host"`
+	Remaining []string `json:"remaining"`
+}
+
+// emitShutdown reports the daemon's shutdown and the environments still
+// active, which are left to their owners.
+func emitShutdown(remaining []*state.EnvironmentState) {
+	event := shutdownEvent{
+		Event:     "shutdown",
+		Time:      time.Now().UTC().Format(time.RFC3339),
+		Host:      isolation.Hostname(),
+		Remaining: []string{},
+	}
+	for _, env := range remaining {
+		event.Remaining = append(event.Remaining, env.ID)
+	}
+	if len(remaining) > 0 {
+		fmt.Fprintf(os.Stderr, emoji("⚠️  %d environment(s) still active: %s\n"), len(remaining), strings.Join(event.Remaining, ", "))
+	}
+	logger.Info("daemon shutdown", "host", event.Host, "remaining", len(event.Remaining))
+
+	if serveNotify {
+		notifyShutdown(&event)
+	}
+}
+
+// serveTLSConfig loads --tls-cert and --tls-key and, with --tls-client-ca,
+// verifies client certificates given against the CA. It returns nil when
+// TLS is not configured.
+func serveTLSConfig() (*tls.Config, error) {
+	if serveTLSCert == "" && serveTLSKey == "" {
+		if serveTLSClientCA != "" {
+			return nil, usageErrorf("--tls-client-ca requires --tls-cert and --tls-key")
+		}
+		return nil, nil
+	}
+	if serveTLSCert == "" || serveTLSKey == "" {
+		return nil, usageErrorf("--tls-cert and --tls-key must be given together")
+	}
+	if serveUnixSocket != "" {
+		return nil, usageErrorf("--tls-cert cannot be used with --unix-socket")
+	}
+
+	cert, err := tls.LoadX509KeyPair(serveTLSCert, serveTLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if serveTLSClientCA != "" {
+		pem, err := os.ReadFile(serveTLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", serveTLSClientCA)
+		}
+		// Clients may authenticate with a token instead of a certificate
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// apiVia names an API request in logs, with the authenticated user if any.
+func apiVia(ctx context.Context) string {
+	if user := daemon.UserFromContext(ctx); user != "" {
+		return "api:" + user
+	}
+	return "api"
+}
@@ -0,0 +1,270 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	installName             string
+	installDir              string
+	installListen           string
+	installUnixSocket       string
+	installTokenFile        string
+	installSocketActivation bool
+	installInterval         time.Duration
+	installGC               bool
+	installPrint            bool
+	installForce            bool
+)
+
+// installEnv are the variables copied into the unit, so the daemon sees
+// the same lock directory, state, and allocation range as the CLI.
+var installEnv = []string{
+	state.StateDirEnv,
+	isolation.LockDirEnv,
+	isolation.TempPrefixEnv,
+	isolation.NamingEnv,
+	isolation.HostEnv,
+	ports.PortRangeEnv,
+	"TMPDIR",
+}
+
+var serveInstallCmd = &cobra.Command{
+	Use:   "install",
+	Short: "Generate user-level systemd units for the daemon",
+	Long: `Install writes a systemd user unit that runs 'go-portalloc serve --systemd'
+with this binary, to ~/.config/systemd/user by default. The unit has
+Type=notify, so systemd knows when the daemon is serving, and restarts it
+on failure. The lock directory, state directory, port range, and naming
+variables set when install runs are copied into the unit.
+
+The daemon only serves TCP with authentication, so --listen requires
+--token-file; otherwise serve on --unix-socket.
+
+With --socket-activation, a .socket unit is written too: systemd listens
+on --listen (or --unix-socket) and starts the daemon on the first
+connection, passing it the socket. The address is written as given, so
+systemd specifiers such as %t (the user's runtime directory) work there.
+
+Existing units are only replaced with --force. Use --print to write the
+units to stdout instead.`,
+	Example: `  # Run the daemon with garbage collection whenever you are logged in
+  go-portalloc serve install --gc --unix-socket %t/portalloc.sock
+  systemctl --user daemon-reload && systemctl --user enable --now go-portalloc.service
+
+  # Start it on demand on a Unix socket
+  go-portalloc serve install --socket-activation --unix-socket %t/portalloc.sock
+  systemctl --user daemon-reload && systemctl --user enable --now go-portalloc.socket`,
+	Args: cobra.NoArgs,
+	RunE: runServeInstall,
+}
+
+func init() {
+	serveInstallCmd.Flags().StringVar(&installName, "name", "go-portalloc", "Unit name, without the .service suffix")
+	serveInstallCmd.Flags().StringVar(&installDir, "dir", "", "Directory to write units to (default: ~/.config/systemd/user)")
+	serveInstallCmd.Flags().StringVar(&installListen, "listen", "127.0.0.1:9465", "HTTP listen address of the daemon")
+	serveInstallCmd.Flags().StringVar(&installUnixSocket, "unix-socket", "", "Serve on this Unix socket instead of --listen")
+	serveInstallCmd.Flags().StringVar(&installTokenFile, "token-file", "", "Token file the daemon authenticates TCP clients with (required with --listen)")
+	serveInstallCmd.Flags().BoolVar(&installSocketActivation, "socket-activation", false, "Also write a .socket unit that starts the daemon on the first connection")
+	serveInstallCmd.Flags().DurationVar(&installInterval, "interval", 30*time.Second, "Reconcile interval")
+	serveInstallCmd.Flags().BoolVar(&installGC, "gc", false, "Clean up stale environments on every tick")
+	serveInstallCmd.Flags().BoolVar(&installPrint, "print", false, "Write the units to stdout instead of the directory")
+	serveInstallCmd.Flags().BoolVar(&installForce, "force", false, "Replace existing units")
+	serveInstallCmd.MarkFlagsMutuallyExclusive("listen", "unix-socket")
+
+	serveCmd.AddCommand(serveInstallCmd)
+}
+
+// systemdUnit is a generated unit file.
+type systemdUnit struct {
+	Name    string
+	Content string
+}
+
+// systemdUnitOptions configures the generated units.
+type systemdUnitOptions struct {
+	Name string
+	// Command is the daemon's command line, executable first.
+	Command []string
+	// Env are KEY=VALUE pairs set in the service.
+	Env []string
+	// Listen is the socket unit's ListenStream; no socket unit is
+	// generated when it is empty.
+	Listen string
+}
+
+func runServeInstall(cmd *cobra.Command, args []string) error {
+	if installName == "" || strings.ContainsAny(installName, "/ ") {
+		return usageErrorf("invalid --name %q", installName)
+	}
+	if installInterval <= 0 {
+		return usageErrorf("--interval must be positive")
+	}
+
+	if installUnixSocket == "" && installTokenFile == "" {
+		return usageErrorf("serving on TCP requires --token-file; or use --unix-socket")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate the go-portalloc binary: %w", err)
+	}
+	command := []string{exe, "serve", "--systemd", "--interval", installInterval.String()}
+	if installGC {
+		command = append(command, "--gc")
+	}
+	if configPath != "" {
+		abs, err := filepath.Abs(configPath)
+		if err != nil {
+			return fmt.Errorf("failed to resolve config path: %w", err)
+		}
+		command = append(command, "--config", abs)
+	}
+	if installTokenFile != "" {
+		abs, err := filepath.Abs(installTokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to resolve token file path: %w", err)
+		}
+		command = append(command, "--token-file", abs)
+	}
+
+	opts := systemdUnitOptions{Name: installName}
+	switch {
+	case installSocketActivation && installUnixSocket != "":
+		opts.Listen = installUnixSocket
+	case installSocketActivation:
+		opts.Listen = installListen
+	case installUnixSocket != "":
+		command = append(command, "--unix-socket", installUnixSocket)
+	default:
+		command = append(command, "--listen", installListen)
+	}
+	opts.Command = command
+	for _, key := range installEnv {
+		if value, ok := os.LookupEnv(key); ok {
+			opts.Env = append(opts.Env, key+"="+value)
+		}
+	}
+	units := systemdUnits(opts)
+
+	if installPrint {
+		for i, unit := range units {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("# %s\n%s", unit.Name, unit.Content)
+		}
+		return nil
+	}
+
+	dir := installDir
+	if dir == "" {
+		config, err := os.UserConfigDir()
+		if err != nil {
+			return fmt.Errorf("failed to locate the systemd user unit directory: %w", err)
+		}
+		dir = filepath.Join(config, "systemd", "user")
+	}
+	if !installForce {
+		for _, unit := range units {
+			path := filepath.Join(dir, unit.Name)
+			if _, err := os.Stat(path); err == nil {
+				return fmt.Errorf("%s already exists (use --force to replace it)", path)
+			} else if !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("failed to check %s: %w", path, err)
+			}
+		}
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create unit directory: %w", err)
+	}
+	for _, unit := range units {
+		path := filepath.Join(dir, unit.Name)
+		if err := os.WriteFile(path, []byte(unit.Content), 0o644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+		fmt.Printf(emoji("✅ Wrote %s\n"), path)
+	}
+
+	enable := units[len(units)-1].Name
+	fmt.Printf(emoji("💡 Start it with: systemctl --user daemon-reload && systemctl --user enable --now %s\n"), enable)
+	return nil
+}
+
+// systemdUnits renders the service unit and, with a Listen address, the
+// socket unit that activates it; the unit to enable comes last.
+func systemdUnits(opts systemdUnitOptions) []systemdUnit {
+	var service strings.Builder
+	service.WriteString("[Unit]\n")
+	service.WriteString("Description=go-portalloc daemon\n")
+	service.WriteString("Documentation=https://github.com/pigeonworks-llc/go-portalloc\n")
+	if opts.Listen != "" {
+		fmt.Fprintf(&service, "Requires=%s.socket\nAfter=%s.socket\n", opts.Name, opts.Name)
+	}
+	service.WriteString("\n[Service]\n")
+	service.WriteString("Type=notify\n")
+	quoted := make([]string, len(opts.Command))
+	for i, arg := range opts.Command {
+		// ExecStart also expands $VARIABLES
+		quoted[i] = systemdQuote(strings.ReplaceAll(arg, "$", "$$"))
+	}
+	fmt.Fprintf(&service, "ExecStart=%s\n", strings.Join(quoted, " "))
+	for _, env := range opts.Env {
+		fmt.Fprintf(&service, "Environment=%s\n", systemdQuote(env))
+	}
+	service.WriteString("Restart=on-failure\n")
+	service.WriteString("RestartSec=5s\n")
+	if opts.Listen == "" {
+		service.WriteString("\n[Install]\nWantedBy=default.target\n")
+		return []systemdUnit{{Name: opts.Name + ".service", Content: service.String()}}
+	}
+
+	var socket strings.Builder
+	socket.WriteString("[Unit]\n")
+	socket.WriteString("Description=go-portalloc daemon socket\n")
+	socket.WriteString("\n[Socket]\n")
+	// Written as given, so specifiers such as %t work
+	fmt.Fprintf(&socket, "ListenStream=%s\n", opts.Listen)
+	if strings.HasPrefix(opts.Listen, "/") || strings.HasPrefix(opts.Listen, "%") {
+		socket.WriteString("SocketMode=0600\n")
+	}
+	socket.WriteString("\n[Install]\nWantedBy=sockets.target\n")
+	return []systemdUnit{
+		{Name: opts.Name + ".service", Content: service.String()},
+		{Name: opts.Name + ".socket", Content: socket.String()},
+	}
+}
+
+// systemdQuote quotes s as one word of a unit setting, escaping specifiers
+// so it is passed through literally.
+func systemdQuote(s string) string {
+	s = strings.ReplaceAll(s, "%", "%%")
+	if s != "" && !strings.ContainsAny(s, " \t\n\"'\\;") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`).Replace(s) + `"`
+}
@@ -0,0 +1,197 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSystemdQuote(t *testing.T) {
+	for in, want := range map[string]string{
+		"/usr/bin/go-portalloc": "/usr/bin/go-portalloc",
+		"":                      `""`,
+		"/opt/my tools/bin":     `"/opt/my tools/bin"`,
+		`say "hi"`:              `"say \"hi\""`,
+		"50%":                   "50%%",
+		`C:\path`:               `"C:\\path"`,
+	} {
+		assert.Equal(t, want, systemdQuote(in), in)
+	}
+}
+
+func TestSystemdUnits(t *testing.T) {
+	t.Run("service only", func(t *testing.T) {
+		units := systemdUnits(systemdUnitOptions{
+			Name:    "go-portalloc",
+			Command: []string{"/home/me/bin/go-portalloc", "serve", "--systemd", "--listen", "127.0.0.1:9465"},
+			Env:     []string{"PORTALLOC_LOCK_DIR=/tmp/my locks", "PORTALLOC_PORT_RANGE=20000-21000"},
+		})
+		require.Len(t, units, 1)
+		assert.Equal(t, "go-portalloc.service", units[0].Name)
+		assert.Contains(t, units[0].Content, "Type=notify\n")
+		assert.Contains(t, units[0].Content, "ExecStart=/home/me/bin/go-portalloc serve --systemd --listen 127.0.0.1:9465\n")
+		assert.Contains(t, units[0].Content, `Environment="PORTALLOC_LOCK_DIR=/tmp/my locks"`+"\n")
+		assert.Contains(t, units[0].Content, "Environment=PORTALLOC_PORT_RANGE=20000-21000\n")
+		assert.Contains(t, units[0].Content, "WantedBy=default.target\n")
+		assert.NotContains(t, units[0].Content, "Requires=")
+	})
+
+	t.Run("socket activation", func(t *testing.T) {
+		units := systemdUnits(systemdUnitOptions{
+			Name:    "pa",
+			Command: []string{"/usr/bin/go-portalloc", "serve", "--systemd"},
+			Listen:  "%t/portalloc.sock",
+		})
+		require.Len(t, units, 2)
+		assert.Equal(t, "pa.service", units[0].Name)
+		assert.Contains(t, units[0].Content, "Requires=pa.socket\n")
+		assert.NotContains(t, units[0].Content, "[Install]")
+		assert.Equal(t, "pa.socket", units[1].Name, "the unit to enable comes last")
+		assert.Contains(t, units[1].Content, "ListenStream=%t/portalloc.sock\n")
+		assert.Contains(t, units[1].Content, "SocketMode=0600\n")
+		assert.Contains(t, units[1].Content, "WantedBy=sockets.target\n")
+	})
+}
+
+func TestServeIntegration(t *testing.T) {
+	buildCLI(t)
+
+	t.Run("serve holds a PID file that doctor reports and answers probes", func(t *testing.T) {
+		stateDir := t.TempDir()
+		env := append(os.Environ(), "HOME="+t.TempDir(), "PORTALLOC_STATE_DIR="+stateDir, "PORTALLOC_LOCK_DIR="+t.TempDir(), "TERM=dumb")
+
+		stdout, _, _ := runCLI(t, "", env, "doctor")
+		assert.Contains(t, stdout, "Daemon: not running")
+
+		// Unix socket paths are limited to ~100 bytes
+		sockDir, err := os.MkdirTemp("", "pa")
+		require.NoError(t, err)
+		defer func() { _ = os.RemoveAll(sockDir) }()
+		socket := filepath.Join(sockDir, "s")
+
+		serve := exec.Command(cliBinary, "serve", "--unix-socket", socket, "--interval", "1s")
+		serve.Dir, serve.Env = t.TempDir(), env
+		require.NoError(t, serve.Start())
+		defer func() {
+			_ = serve.Process.Signal(syscall.SIGTERM)
+			_ = serve.Wait()
+		}()
+
+		httpClient := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		}}
+		require.Eventually(t, func() bool {
+			resp, err := httpClient.Get("http://daemon/readyz")
+			if err != nil {
+				return false
+			}
+			_ = resp.Body.Close()
+			return resp.StatusCode == http.StatusOK
+		}, 10*time.Second, 50*time.Millisecond)
+		resp, err := httpClient.Get("http://daemon/healthz")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		assert.FileExists(t, filepath.Join(stateDir, "serve.pid"))
+		stdout, _, _ = runCLI(t, "", env, "doctor")
+		assert.Contains(t, stdout, fmt.Sprintf("Daemon: running (pid %d, unix:%s", serve.Process.Pid, socket))
+
+		_, stderr, err := runCLI(t, "", env, "serve", "--unix-socket", socket+"2")
+		assert.Error(t, err)
+		assert.Contains(t, stderr, "daemon already running")
+
+		require.NoError(t, serve.Process.Signal(syscall.SIGTERM))
+		require.NoError(t, serve.Wait())
+		assert.NoFileExists(t, filepath.Join(stateDir, "serve.pid"))
+	})
+
+	t.Run("serve --systemd uses a socket-activated listener and install writes units", func(t *testing.T) {
+		env := append(os.Environ(), "HOME="+t.TempDir(), "PORTALLOC_STATE_DIR="+t.TempDir(), "PORTALLOC_LOCK_DIR="+t.TempDir())
+
+		// Every local user can reach loopback: TCP requires authentication
+		_, stderr, err := runCLI(t, "", env, "serve", "--listen", "127.0.0.1:0")
+		require.Error(t, err)
+		assert.Contains(t, stderr, "refusing to serve 127.0.0.1:0 without authentication")
+		tokenFile := filepath.Join(t.TempDir(), "tokens")
+		require.NoError(t, os.WriteFile(tokenFile, []byte("s3cret\n"), 0o600))
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		file, err := listener.(*net.TCPListener).File()
+		require.NoError(t, err)
+		_ = listener.Close()
+
+		// LISTEN_PID must name the daemon itself, as systemd sets it
+		serve := exec.Command("sh", "-c", `LISTEN_PID=$$ LISTEN_FDS=1 exec `+cliBinary+` serve --systemd --interval 1s --token-file `+tokenFile)
+		serve.Dir, serve.Env = t.TempDir(), env
+		serve.ExtraFiles = []*os.File{file}
+		require.NoError(t, serve.Start())
+		_ = file.Close()
+		defer func() {
+			_ = serve.Process.Signal(syscall.SIGTERM)
+			_ = serve.Wait()
+		}()
+
+		url := "http://" + listener.Addr().String() + "/readyz"
+		require.Eventually(t, func() bool {
+			resp, err := http.Get(url)
+			if err != nil {
+				return false
+			}
+			_ = resp.Body.Close()
+			return resp.StatusCode == http.StatusOK
+		}, 10*time.Second, 50*time.Millisecond)
+
+		unitDir := t.TempDir()
+		installEnv := append(env, "PORTALLOC_PORT_RANGE=25000-26000")
+		_, stderr, err = runCLI(t, "", installEnv, "serve", "install", "--dir", unitDir, "--socket-activation")
+		require.Error(t, err)
+		assert.Contains(t, stderr, "requires --token-file")
+		stdout, stderr, err := runCLI(t, "", installEnv, "serve", "install", "--dir", unitDir, "--gc", "--socket-activation", "--token-file", tokenFile)
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stdout, "enable --now go-portalloc.socket")
+		service, err := os.ReadFile(filepath.Join(unitDir, "go-portalloc.service"))
+		require.NoError(t, err)
+		assert.Contains(t, string(service), "ExecStart="+cliBinary+" serve --systemd --interval 30s --gc --token-file "+tokenFile+"\n")
+		assert.Contains(t, string(service), "Environment=PORTALLOC_PORT_RANGE=25000-26000\n")
+		socket, err := os.ReadFile(filepath.Join(unitDir, "go-portalloc.socket"))
+		require.NoError(t, err)
+		assert.Contains(t, string(socket), "ListenStream=127.0.0.1:9465\n")
+
+		_, stderr, err = runCLI(t, "", installEnv, "serve", "install", "--dir", unitDir, "--token-file", tokenFile)
+		assert.Error(t, err, "existing units are kept without --force")
+		assert.Contains(t, stderr, "already exists")
+		_, stderr, err = runCLI(t, "", installEnv, "serve", "install", "--dir", unitDir, "--force", "--unix-socket", "/run/user/1000/pa.sock")
+		require.NoError(t, err, stderr)
+		service, err = os.ReadFile(filepath.Join(unitDir, "go-portalloc.service"))
+		require.NoError(t, err)
+		assert.Contains(t, string(service), "--unix-socket /run/user/1000/pa.sock\n")
+	})
+}
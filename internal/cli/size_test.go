@@ -0,0 +1,57 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int64
+	}{
+		{"0", 0},
+		{"512", 512},
+		{"100B", 100},
+		{"1K", 1024},
+		{"1kb", 1024},
+		{"10GB", 10 << 30},
+		{"1.5GiB", 3 << 29},
+		{"2 TB", 2 << 40},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.input)
+		require.NoError(t, err, tt.input)
+		assert.Equal(t, tt.want, got, tt.input)
+	}
+
+	for _, input := range []string{"", "GB", "ten", "-1GB"} {
+		_, err := parseSize(input)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	assert.Equal(t, "0B", formatSize(0))
+	assert.Equal(t, "1023B", formatSize(1023))
+	assert.Equal(t, "1.0K", formatSize(1024))
+	assert.Equal(t, "1.5M", formatSize(3<<19))
+	assert.Equal(t, "10.0G", formatSize(10<<30))
+	assert.Equal(t, "2.0T", formatSize(2<<40))
+}
@@ -0,0 +1,219 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	statsHistory bool
+	statsPort    int
+	statsSince   time.Duration
+	statsFormat  string
+)
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show allocation statistics and history",
+	Long: `Stats summarizes recorded environments and recent allocations.
+
+Every create, run, and environment created over serve or mcp appends to an
+allocation history (the last 1000 attempts, successful or not) kept next to
+the state file. Unlike the state, the history survives cleanup, so
+--history can answer who had a port after the environment is gone.`,
+	Example: `  # Summary of environments and allocations
+  go-portalloc stats
+
+  # Who had port 24873 in the last three hours?
+  go-portalloc stats --history --port 24873 --since 3h`,
+	Args: cobra.NoArgs,
+	RunE: runStats,
+}
+
+func init() {
+	statsCmd.Flags().BoolVar(&statsHistory, "history", false, "List recorded allocations")
+	statsCmd.Flags().IntVar(&statsPort, "port", 0, "With --history, only allocations that included this port")
+	statsCmd.Flags().DurationVar(&statsSince, "since", 0, "With --history, only allocations in this period (e.g. 3h)")
+	statsCmd.Flags().StringVar(&statsFormat, "format", "table", "Output format (table, json)")
+}
+
+// statsSummary is the 'stats --format json' output.
+type statsSummary struct {
+	Environments int `json:"environments"`
+	Active       int `json:"active"`
+	Stale        int `json:"stale"`
+	PortsInUse   int `json:"ports_allocated"`
+	RangeStart   int `json:"range_start"`
+	RangeEnd     int `json:"range_end"`
+	Allocations  int `json:"allocations"`
+	Failed       int `json:"failed_allocations"`
+	// Since is the time of the oldest recorded allocation.
+	Since *time.Time `json:"since,omitempty"`
+}
+
+func runStats(cmd *cobra.Command, args []string) error {
+	if statsFormat != "table" && statsFormat != "json" {
+		return usageErrorf("unknown format: %s", statsFormat)
+	}
+	if !statsHistory && (statsPort != 0 || statsSince != 0) {
+		return usageErrorf("--port and --since require --history")
+	}
+
+	mgr, err := newStateManager()
+	if err != nil {
+		return fmt.Errorf("failed to create state manager: %w", err)
+	}
+	history, err := mgr.History()
+	if err != nil {
+		return err
+	}
+
+	if statsHistory {
+		return outputHistory(filterHistory(history, statsPort, statsSince, time.Now()))
+	}
+
+	envs, err := mgr.ListEnvironments()
+	if err != nil {
+		return fmt.Errorf("failed to list environments: %w", err)
+	}
+	summary := newStatsSummary(envs, history)
+
+	if statsFormat == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(summary)
+	}
+
+	fmt.Printf("Environments:    %d (%d active, %d stale)\n", summary.Environments, summary.Active, summary.Stale)
+	width := summary.RangeEnd - summary.RangeStart
+	fmt.Printf("Ports allocated: %d of %d in %d-%d (%.1f%%)\n",
+		summary.PortsInUse, width, summary.RangeStart, summary.RangeEnd, 100*float64(summary.PortsInUse)/float64(width))
+	if summary.Since == nil {
+		fmt.Println("Allocations:     none recorded")
+		return nil
+	}
+	fmt.Printf("Allocations:     %d since %s, %d failed\n",
+		summary.Allocations, summary.Since.Format(time.RFC3339), summary.Failed)
+	return nil
+}
+
+func newStatsSummary(envs []*state.EnvironmentState, history []state.AllocationRecord) *statsSummary {
+	start, end := ports.DefaultRange()
+	summary := &statsSummary{
+		Environments: len(envs),
+		RangeStart:   start,
+		RangeEnd:     end,
+		Allocations:  len(history),
+	}
+	for _, env := range envs {
+		if state.GetEnvironmentStatus(env) == state.StatusActive {
+			summary.Active++
+		} else {
+			summary.Stale++
+		}
+		if env.Ports != nil {
+			summary.PortsInUse += len(env.Ports.Allocated)
+		}
+	}
+	for _, rec := range history {
+		if !rec.Success {
+			summary.Failed++
+		}
+	}
+	if len(history) > 0 {
+		summary.Since = &history[0].Time
+	}
+	return summary
+}
+
+// filterHistory returns the records that included port (if non-zero) and
+// happened within since of now (if non-zero).
+func filterHistory(history []state.AllocationRecord, port int, since time.Duration, now time.Time) []state.AllocationRecord {
+	var filtered []state.AllocationRecord
+	for _, rec := range history {
+		if port != 0 && !rec.Contains(port) {
+			continue
+		}
+		if since != 0 && now.Sub(rec.Time) > since {
+			continue
+		}
+		filtered = append(filtered, rec)
+	}
+	return filtered
+}
+
+func outputHistory(records []state.AllocationRecord) error {
+	if statsFormat == "json" {
+		if records == nil {
+			records = []state.AllocationRecord{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(records)
+	}
+
+	if len(records) == 0 {
+		fmt.Println("No allocations recorded")
+		return nil
+	}
+
+	fmt.Printf("%-20s %-7s %-25s %-12s %s\n", "TIME", "RESULT", "ID", "PORTS", "WORKTREE")
+	fmt.Println(strings.Repeat("-", 100))
+	for _, rec := range records {
+		// Pad before coloring so the escape codes don't count as width
+		result, portsStr := paint(colorGreen, fmt.Sprintf("%-7s", "ok")), fmt.Sprintf("%d-%d", rec.BasePort, rec.BasePort+rec.Count-1)
+		if !rec.Success {
+			result, portsStr = paint(colorRed, fmt.Sprintf("%-7s", "failed")), fmt.Sprintf("(%d)", rec.Count)
+		}
+		fmt.Printf("%-20s %s %-25s %-12s %s\n",
+			rec.Time.Local().Format("2006-01-02 15:04:05"),
+			result,
+			orDash(rec.IsolationID),
+			portsStr,
+			rec.Worktree)
+		if rec.Error != "" {
+			fmt.Printf("  %s\n", rec.Error)
+		}
+	}
+	return nil
+}
+
+// recordAllocation adds the outcome of CreateEnvironment to the allocation
+// history, best effort.
+func recordAllocation(worktree string, count int, env *isolation.Environment, err error) {
+	mgr, mgrErr := newStateManager()
+	if mgrErr != nil {
+		return
+	}
+	rec := state.AllocationRecord{Time: time.Now(), Count: count, Worktree: worktree, Success: err == nil}
+	if err != nil {
+		rec.Error = err.Error()
+	} else {
+		rec.IsolationID = env.ID
+		rec.BasePort = env.Ports.BasePort
+		rec.Count = env.Ports.Count
+	}
+	_ = mgr.RecordAllocation(rec)
+}
@@ -0,0 +1,76 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterHistory(t *testing.T) {
+	now := time.Now()
+	history := []state.AllocationRecord{
+		{Time: now.Add(-5 * time.Hour), IsolationID: "old", BasePort: 24870, Count: 5, Success: true},
+		{Time: now.Add(-2 * time.Hour), IsolationID: "recent", BasePort: 24870, Count: 5, Success: true},
+		{Time: now.Add(-time.Hour), IsolationID: "other", BasePort: 25000, Count: 5, Success: true},
+		{Time: now.Add(-time.Hour), Count: 5, Error: "no free ports available"},
+	}
+
+	ids := func(records []state.AllocationRecord) []string {
+		var out []string
+		for _, rec := range records {
+			out = append(out, rec.IsolationID)
+		}
+		return out
+	}
+	assert.Equal(t, []string{"old", "recent"}, ids(filterHistory(history, 24873, 0, now)))
+	assert.Equal(t, []string{"recent"}, ids(filterHistory(history, 24873, 3*time.Hour, now)))
+	assert.Len(t, filterHistory(history, 0, 0, now), 4)
+}
+
+func TestStatsIntegration(t *testing.T) {
+	buildCLI(t)
+
+	t.Run("stats history remembers cleaned up environments", func(t *testing.T) {
+		env := append(os.Environ(), "HOME="+t.TempDir(), "PORTALLOC_STATE_DIR="+t.TempDir())
+
+		stdout, stderr, err := runCLI(t, "", env, "create", "--json", "--no-env-file", "--ports", "3")
+		require.NoError(t, err, stderr)
+		var created createOutput
+		require.NoError(t, json.Unmarshal([]byte(stdout), &created))
+		_, stderr, err = runCLI(t, "", env, "cleanup", "--id", created.IsolationID)
+		require.NoError(t, err, stderr)
+
+		var records []state.AllocationRecord
+		port := strconv.Itoa(created.Ports.BasePort + 2)
+		stdout, stderr, err = runCLI(t, "", env, "stats", "--history", "--port", port, "--format", "json")
+		require.NoError(t, err, stderr)
+		require.NoError(t, json.Unmarshal([]byte(stdout), &records))
+		require.Len(t, records, 1)
+		assert.Equal(t, created.IsolationID, records[0].IsolationID)
+		assert.True(t, records[0].Success)
+
+		stdout, stderr, err = runCLI(t, "", env, "stats")
+		require.NoError(t, err, stderr)
+		assert.Contains(t, stdout, "Allocations:     1 since")
+	})
+}
@@ -0,0 +1,199 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// noColor is set by --no-color.
+var noColor bool
+
+// noColorEnv disables color when set to any value (https://no-color.org).
+const noColorEnv = "NO_COLOR"
+
+// ANSI colors used in human output.
+const (
+	colorRed    = "31"
+	colorGreen  = "32"
+	colorYellow = "33"
+)
+
+// isTerminal reports whether f is a character device.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// dumbTerminal reports whether TERM says the terminal cannot render
+// colors or emoji.
+func dumbTerminal() bool {
+	return os.Getenv("TERM") == "dumb"
+}
+
+// colorEnabled reports whether human output on stdout is colored: only on a
+// terminal, and never with --no-color, NO_COLOR, or TERM=dumb. Output
+// redirected to a file or pipe stays plain.
+func colorEnabled() bool {
+	return !noColor && os.Getenv(noColorEnv) == "" && !dumbTerminal() && isTerminal(os.Stdout)
+}
+
+// paint colors s when colorEnabled.
+func paint(color, s string) string {
+	if !colorEnabled() {
+		return s
+	}
+	return "\033[" + color + "m" + s + "\033[0m"
+}
+
+// emojiFallback spells out the emoji of human output on dumb terminals.
+// Emoji with a variation selector come before the bare character.
+var emojiFallback = strings.NewReplacer(
+	"✅", "[ok]",
+	"⚠️", "[warn]",
+	"⚠", "[warn]",
+	"❌", "[error]",
+	"✓", "[ok]",
+	"🔧", "[fix]",
+	"🧹", "[clean]",
+	"🔒", "[lock]",
+	"🔓", "[unlock]",
+	"📈", "[serve]",
+	"🛑", "[stop]",
+	"🔄", "[sync]",
+	"🔀", "[proxy]",
+	"💾", "[disk]",
+	"💡", "[hint]",
+	"⏳", "[wait]",
+	"⏱️", "[time]",
+)
+
+// emoji returns s, with its emoji spelled out on dumb terminals.
+func emoji(s string) string {
+	if dumbTerminal() {
+		return emojiFallback.Replace(s)
+	}
+	return s
+}
+
+// table lays out rows in columns aligned by display width, so cells with
+// colors, emoji, or wide characters line up. The last column is not padded.
+type table struct {
+	rows [][]string
+	// rule draws a line of dashes under the first row.
+	rule bool
+}
+
+// add appends a row.
+func (t *table) add(cells ...string) {
+	t.rows = append(t.rows, cells)
+}
+
+// write renders the table to w, separating columns by a space.
+func (t *table) write(w io.Writer) error {
+	var widths []int
+	for _, row := range t.rows {
+		for i, cell := range row {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[i] = max(widths[i], displayWidth(cell))
+		}
+	}
+	total := 0
+	for _, width := range widths {
+		total += width + 1
+	}
+
+	var b strings.Builder
+	for r, row := range t.rows {
+		for i, cell := range row {
+			b.WriteString(cell)
+			if i < len(row)-1 {
+				b.WriteString(strings.Repeat(" ", widths[i]-displayWidth(cell)+1))
+			}
+		}
+		b.WriteByte('\n')
+		if r == 0 && t.rule {
+			b.WriteString(strings.Repeat("-", max(0, total-1)))
+			b.WriteByte('\n')
+		}
+	}
+	_, err := fmt.Fprint(w, b.String())
+	return err
+}
+
+// displayWidth returns the number of terminal columns s occupies, skipping
+// ANSI escape sequences and counting wide characters and emoji as two.
+func displayWidth(s string) int {
+	width, last := 0, 0
+	for i := 0; i < len(s); {
+		if s[i] == '\033' {
+			// Skip a CSI sequence such as "\033[33m"
+			j := i + 1
+			if j < len(s) && s[j] == '[' {
+				for j++; j < len(s) && (s[j] < 0x40 || s[j] > 0x7e); j++ {
+				}
+			}
+			i = j + 1
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+
+		switch {
+		case r == 0xfe0f:
+			// Emoji presentation widens the preceding character
+			if last == 1 {
+				width++
+				last = 2
+			}
+		case r == 0x200d || (r >= 0xfe00 && r <= 0xfe0e) || unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Me, r):
+		case wideRune(r):
+			width += 2
+			last = 2
+		default:
+			width++
+			last = 1
+		}
+	}
+	return width
+}
+
+// wideRune reports whether r is a wide (East Asian) character or an emoji.
+func wideRune(r rune) bool {
+	switch {
+	case r >= 0x1100 && r <= 0x115f,
+		r >= 0x2e80 && r <= 0xa4cf && r != 0x303f,
+		r >= 0xac00 && r <= 0xd7a3,
+		r >= 0xf900 && r <= 0xfaff,
+		r >= 0xfe30 && r <= 0xfe4f,
+		r >= 0xff00 && r <= 0xff60,
+		r >= 0xffe0 && r <= 0xffe6,
+		r >= 0x1f300 && r <= 0x1f64f,
+		r >= 0x1f900 && r <= 0x1f9ff,
+		r >= 0x20000 && r <= 0x3fffd:
+		return true
+	case r == 0x2705 || r == 0x274c || r == 0x23f3:
+		// ✅ ❌ ⏳ default to emoji presentation
+		return true
+	}
+	return false
+}
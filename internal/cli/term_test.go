@@ -0,0 +1,77 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDisplayWidth(t *testing.T) {
+	for s, want := range map[string]int{
+		"active":               6,
+		"stale ⚠️":             8,
+		"\033[33mstale\033[0m": 5,
+		"✅ ok":                 5,
+		"日本語":                  6,
+		"café":                 4,
+		"":                     0,
+	} {
+		assert.Equal(t, want, displayWidth(s), "%q", s)
+	}
+}
+
+func TestTable(t *testing.T) {
+	tbl := &table{rule: true}
+	tbl.add("ID", "STATUS", "PORTS")
+	tbl.add("abc", "stale ⚠️", "20000-20004")
+	tbl.add("longer-id", "\033[32mactive\033[0m", "-")
+
+	var b strings.Builder
+	require.NoError(t, tbl.write(&b))
+	assert.Equal(t, "ID        STATUS   PORTS\n"+
+		"------------------------------\n"+
+		"abc       stale ⚠️ 20000-20004\n"+
+		"longer-id \033[32mactive\033[0m   -\n", b.String())
+}
+
+func TestEmoji(t *testing.T) {
+	t.Setenv("TERM", "xterm-256color")
+	assert.Equal(t, "✅ Cleaned: abc", emoji("✅ Cleaned: abc"))
+
+	t.Setenv("TERM", "dumb")
+	assert.Equal(t, "[ok] Cleaned: abc", emoji("✅ Cleaned: abc"))
+	assert.Equal(t, "[warn]  Failed", emoji("⚠️  Failed"))
+}
+
+func TestColorEnabled(t *testing.T) {
+	t.Setenv(noColorEnv, "")
+	t.Setenv("TERM", "xterm")
+
+	// Tests run with stdout redirected, which is never colored
+	if !isTerminal(os.Stdout) {
+		assert.False(t, colorEnabled())
+		assert.Equal(t, "stale", paint(colorYellow, "stale"))
+		return
+	}
+	assert.True(t, colorEnabled())
+
+	t.Setenv(noColorEnv, "1")
+	assert.False(t, colorEnabled())
+}
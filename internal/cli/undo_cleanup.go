@@ -0,0 +1,176 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	undoCleanupID   string
+	undoCleanupName string
+)
+
+var undoCleanupCmd = &cobra.Command{
+	Use:   "undo-cleanup",
+	Short: "Recreate an environment removed with cleanup --keep-record",
+	Long: `Undo-cleanup recreates an environment from the record kept by
+'cleanup --keep-record': the lock is created again with the same ID and
+ports, the temp directory, manifest, and services file are recreated,
+the env files are rewritten, and the docker network is created again if
+the environment had one.
+
+The temp directory comes back empty: its contents were deleted by the
+cleanup. Env files whose directory no longer exists are skipped.
+
+Undo fails when the ID is locked again, or when one of the ports is in
+use or allocated to another environment.
+
+Without --id or --name, the kept records are listed, most recently
+cleaned first. --name recreates the most recently cleaned environment of
+that name.`,
+	Example: `  # List the environments that can be recreated
+  go-portalloc undo-cleanup
+
+  # Recreate an environment removed by mistake
+  go-portalloc undo-cleanup --id abc123def456
+
+  # Recreate it by name
+  go-portalloc undo-cleanup --name payments-it`,
+	RunE: runUndoCleanup,
+}
+
+func init() {
+	undoCleanupCmd.Flags().StringVar(&undoCleanupID, "id", "", "Isolation ID to recreate")
+	undoCleanupCmd.Flags().StringVar(&undoCleanupName, "name", "", "Environment name (instead of --id)")
+	undoCleanupCmd.MarkFlagsMutuallyExclusive("id", "name")
+}
+
+func runUndoCleanup(cmd *cobra.Command, args []string) error {
+	stateMgr, err := newStateManager()
+	if err != nil {
+		return fmt.Errorf("failed to create state manager: %w", err)
+	}
+
+	if undoCleanupID == "" && undoCleanupName == "" {
+		return listCleaned(stateMgr)
+	}
+
+	start := time.Now()
+	var record *state.EnvironmentState
+	if undoCleanupName != "" {
+		record, err = stateMgr.FindCleanedByName(undoCleanupName)
+	} else {
+		record, err = stateMgr.FindCleaned(undoCleanupID)
+	}
+	if errors.Is(err, state.ErrNotFound) {
+		return fmt.Errorf("%w (only cleanup --keep-record keeps records)", err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read cleaned records: %w", err)
+	}
+
+	recorded, err := stateMgr.ListEnvironments()
+	if err != nil {
+		return fmt.Errorf("failed to list environments: %w", err)
+	}
+	others := make([]*isolation.Environment, len(recorded))
+	for i, other := range recorded {
+		others[i] = other.Environment()
+	}
+
+	config := &isolation.Config{
+		WorktreePath: record.WorktreePath,
+		LockDir:      defaultLockDir,
+		Strict:       strictMode,
+	}
+	manager := isolation.NewEnvironmentManager(isolation.NewIDGenerator(config), nil)
+
+	env := record.Environment()
+	network := env.DockerNetwork
+	env.DockerNetwork = ""
+	if err := manager.Recreate(env, others...); err != nil {
+		return fmt.Errorf("failed to recreate environment %s: %w", env.ID, err)
+	}
+	if network != "" {
+		if err := createDockerNetwork(cmd.Context(), env); err != nil {
+			_ = manager.Cleanup(env)
+			return err
+		}
+	}
+
+	// Keep what only the record knows, such as the creation time
+	restored := *record
+	owner := state.NewEnvironmentState(env)
+	restored.PID, restored.BootID, restored.StartTime, restored.Host = owner.PID, owner.BootID, owner.StartTime, owner.Host
+	restored.LockFile, restored.TempDir = env.LockFile, env.TempDir
+	restored.EnvFile, restored.EnvFiles = env.EnvFile, env.EnvFiles
+	restored.DockerNetwork = env.DockerNetwork
+	restored.LastUsedAt = start
+	if err := stateMgr.UndoCleanup(&restored); err != nil {
+		_ = cleanupEnvironment(manager, env)
+		return fmt.Errorf("failed to record environment %s: %w", env.ID, err)
+	}
+
+	logEnvironment("environment restored", &restored, start)
+	notifyEvent(state.EventCreated, &restored)
+
+	fmt.Printf(emoji("🔄 Environment %s recreated (cleaned %s)\n"), env.ID, formatTimeAgo(record.CleanedAt))
+	fmt.Printf("   Ports: %d-%d\n", env.Ports.BasePort, env.Ports.BasePort+env.Ports.Count-1)
+	fmt.Printf("   Temp Dir: %s (empty)\n", env.TempDir)
+	for _, envFile := range env.EnvFiles {
+		fmt.Printf("   Env File: %s\n", envFile)
+	}
+	if skipped := len(record.EnvFiles) - len(env.EnvFiles); skipped > 0 {
+		fmt.Fprintf(os.Stderr, emoji("⚠️  Skipped %d env file(s) whose directory no longer exists\n"), skipped)
+	}
+	if env.DockerNetwork != "" {
+		fmt.Printf("   Docker Network: %s\n", env.DockerNetwork)
+	}
+	return nil
+}
+
+// listCleaned prints the records kept by cleanup --keep-record.
+func listCleaned(stateMgr *state.Manager) error {
+	cleaned, err := stateMgr.CleanedEnvironments()
+	if err != nil {
+		return fmt.Errorf("failed to read cleaned records: %w", err)
+	}
+	if len(cleaned) == 0 {
+		fmt.Println("No cleaned environments recorded (use cleanup --keep-record)")
+		return nil
+	}
+
+	fmt.Println("Cleaned environments (undo with --id):")
+	for _, env := range cleaned {
+		ports := ""
+		if env.Ports != nil && env.Ports.Count > 0 {
+			ports = fmt.Sprintf(", ports %d-%d", env.Ports.BasePort, env.Ports.BasePort+env.Ports.Count-1)
+		}
+		label := env.ID
+		if env.Name != "" {
+			label += " (" + env.Name + ")"
+		}
+		fmt.Printf("  %s%s, cleaned %s, %s\n", label, ports, formatTimeAgo(env.CleanedAt), env.WorktreePath)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pigeonworks-llc/go-portalloc/internal/config"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+)
+
+// rangeUsage is how much of the allocation range [start, end) is taken.
+type rangeUsage struct {
+	start, end int
+	// capacity is the number of ports of the range that are not reserved.
+	capacity int
+	// used counts the unreserved ports registered to a recorded environment
+	// or bound by a listener.
+	used int
+}
+
+// percent returns used as a percentage of capacity; a range without
+// capacity is full.
+func (u rangeUsage) percent() float64 {
+	if u.capacity <= 0 {
+		return 100
+	}
+	return 100 * float64(u.used) / float64(u.capacity)
+}
+
+// measureRange counts the ports of allocConfig's range that envs registered
+// or listeners bind, leaving out reserved ports.
+func measureRange(allocConfig *ports.AllocatorConfig, envs []*state.EnvironmentState, listeners map[int][]int) rangeUsage {
+	usage := rangeUsage{start: allocConfig.StartPort, end: allocConfig.EndPort}
+	inRange := func(port int) bool {
+		return port >= usage.start && port < usage.end && !allocConfig.Reserved.Contains(port)
+	}
+
+	taken := make(map[int]bool)
+	for _, env := range envs {
+		if env.Ports == nil {
+			continue
+		}
+		for _, port := range env.Ports.Allocated {
+			if inRange(port) {
+				taken[port] = true
+			}
+		}
+	}
+	for port := range listeners {
+		if inRange(port) {
+			taken[port] = true
+		}
+	}
+
+	usage.used = len(taken)
+	for port := usage.start; port < usage.end; port++ {
+		if inRange(port) {
+			usage.capacity++
+		}
+	}
+	return usage
+}
+
+// loadUtilizationLimit returns the utilization guardrail: the config file's,
+// with maxPercent and action overriding it when set. It returns nil when no
+// limit applies.
+func loadUtilizationLimit(maxPercent float64, action string) (*config.Utilization, error) {
+	limit := &config.Utilization{MaxPercent: maxPercent, Action: action}
+	if err := limit.Validate(); err != nil {
+		return nil, usageErrorf("%v", err)
+	}
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return nil, err
+	}
+	cfgLimit, err := cfg.UtilizationLimit()
+	if err != nil {
+		return nil, err
+	}
+	if cfgLimit != nil {
+		if limit.MaxPercent == 0 {
+			limit.MaxPercent = cfgLimit.MaxPercent
+		}
+		if limit.Action == "" {
+			limit.Action = cfgLimit.Action
+		}
+	}
+	if limit.MaxPercent == 0 {
+		return nil, nil
+	}
+	return limit, nil
+}
+
+// checkUtilization warns on stderr, or fails with ports.ErrNoPortsAvailable
+// when limit says to refuse, while more of allocConfig's range than the
+// limit allows is busy or registered. Listeners are only counted where
+// they can be read (Linux); registered ports always are.
+func checkUtilization(allocConfig *ports.AllocatorConfig, limit *config.Utilization) error {
+	if limit == nil {
+		return nil
+	}
+	stateMgr, err := newStateManager()
+	if err != nil {
+		return nil
+	}
+	envs, err := stateMgr.ListEnvironments()
+	if err != nil {
+		return nil
+	}
+	listeners, _ := ports.ListenerPIDs()
+
+	usage := measureRange(allocConfig, envs, listeners)
+	if usage.percent() <= limit.MaxPercent {
+		return nil
+	}
+
+	msg := fmt.Sprintf("port range %d-%d is %.0f%% used (%d of %d ports busy or registered, limit %g%%); "+
+		"see 'go-portalloc stats' and reclaim ports with 'go-portalloc prune' or 'go-portalloc cleanup --stale'",
+		usage.start, usage.end, usage.percent(), usage.used, usage.capacity, limit.MaxPercent)
+	if limit.Refuse() {
+		return fmt.Errorf("%w: %s", ports.ErrNoPortsAvailable, msg)
+	}
+	fmt.Fprintf(os.Stderr, emoji("⚠️  %s\n"), msg)
+	return nil
+}
@@ -0,0 +1,45 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMeasureRange(t *testing.T) {
+	reserved, err := ports.ParseReservedPorts(strings.NewReader("20008-20009\n"))
+	require.NoError(t, err)
+	allocConfig := &ports.AllocatorConfig{StartPort: 20000, EndPort: 20010, Reserved: reserved}
+
+	envs := []*state.EnvironmentState{
+		{ID: "a", Ports: &state.PortsState{Allocated: []int{20000, 20001}}},
+		{ID: "b", Ports: &state.PortsState{Allocated: []int{20001, 20002, 30000}}},
+		{ID: "c"},
+	}
+	listeners := map[int][]int{20003: nil, 20008: {42}, 8080: {1}}
+
+	usage := measureRange(allocConfig, envs, listeners)
+	assert.Equal(t, 8, usage.capacity, "reserved ports are left out")
+	assert.Equal(t, 4, usage.used, "overlaps, reserved, and out-of-range ports are not counted")
+	assert.InDelta(t, 50.0, usage.percent(), 0.001)
+
+	assert.Equal(t, 100.0, rangeUsage{}.percent(), "a range without capacity is full")
+}
@@ -15,18 +15,24 @@
 package cli
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
 	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
 	"github.com/spf13/cobra"
 )
 
 var (
 	validateID       string
+	validateName     string
 	validateWorktree string
+	validateJSON     bool
 )
 
 var validateCmd = &cobra.Command{
@@ -37,25 +43,45 @@ var validateCmd = &cobra.Command{
 This command verifies:
   1. Lock file exists and is valid
   2. Temporary directory exists
-  3. Environment variable file exists
-  4. Allocated ports are accessible
+  3. Environment variable file exists and was not overwritten by another
+     environment
+  4. Allocated ports collide with no other environment
+
+Without --id or --name, every environment recorded for the current
+worktree is validated (with --json, one document per environment).
+
+With --json, each check (lock, temp_dir, env_file, port_collisions,
+port_ownership) is reported with pass/fail and details. The command exits
+non-zero if any check fails.
 
 Validation helps ensure environment isolation is working correctly.`,
-	Example: `  # Validate specific environment by ID
+	Example: `  # Validate every environment of the current worktree
+  go-portalloc validate
+
+  # Validate specific environment by ID
   go-portalloc validate --id abc123def456
 
   # Validate with custom worktree
-  go-portalloc validate --id abc123def456 --worktree /path/to/project`,
+  go-portalloc validate --id abc123def456 --worktree /path/to/project
+
+  # Archive per-check results in CI
+  go-portalloc validate --id abc123def456 --json > validate.json`,
 	RunE: runValidate,
 }
 
 func init() {
-	validateCmd.Flags().StringVar(&validateID, "id", "", "Isolation ID to validate (required)")
+	validateCmd.Flags().StringVar(&validateID, "id", "", "Isolation ID to validate (or --name)")
+	validateCmd.Flags().StringVar(&validateName, "name", "", "Environment name (instead of --id)")
 	validateCmd.Flags().StringVarP(&validateWorktree, "worktree", "w", "", "Working directory path (current directory if not provided)")
-	_ = validateCmd.MarkFlagRequired("id")
+	validateCmd.Flags().BoolVar(&validateJSON, "json", false, "Output per-check results as JSON")
+	validateCmd.MarkFlagsMutuallyExclusive("id", "name")
 }
 
 func runValidate(cmd *cobra.Command, args []string) error {
+	if err := resolveEnvironmentFlag(&validateID, validateName); err != nil {
+		return err
+	}
+
 	// Prepare configuration
 	worktree := validateWorktree
 	if worktree == "" {
@@ -68,7 +94,7 @@ func runValidate(cmd *cobra.Command, args []string) error {
 
 	config := &isolation.Config{
 		WorktreePath: worktree,
-		LockDir:      filepath.Join(os.TempDir(), "go-portalloc-locks"),
+		LockDir:      defaultLockDir,
 	}
 
 	// Create components
@@ -76,38 +102,101 @@ func runValidate(cmd *cobra.Command, args []string) error {
 	portAlloc := ports.NewAllocator(nil)
 	manager := isolation.NewEnvironmentManager(idGen, portAlloc)
 
-	// Reconstruct environment from ID
-	lockFile := filepath.Join(config.LockDir, fmt.Sprintf("env-%s.lock", validateID))
-	tmpDir := filepath.Join(os.TempDir(), fmt.Sprintf("aigis-test-%s", validateID))
-	envFile := filepath.Join(worktree, ".env.isolation")
+	if validateID == "" {
+		return validateWorktreeEnvironments(manager, config)
+	}
+	return validateEnvironment(manager, validateID, config)
+}
 
+// validateWorktreeEnvironments validates every environment recorded for
+// the worktree of config, or one of its subdirectories.
+func validateWorktreeEnvironments(manager *isolation.EnvironmentManager, config *isolation.Config) error {
+	stateMgr, err := newStateManager()
+	if err != nil {
+		return fmt.Errorf("failed to create state manager: %w", err)
+	}
+	envs, err := stateMgr.ListEnvironments()
+	if err != nil {
+		return fmt.Errorf("failed to list environments: %w", err)
+	}
+
+	var matched []string
+	for _, env := range envs {
+		if withinWorktree(config.WorktreePath, env.WorktreePath) {
+			matched = append(matched, env.ID)
+		}
+	}
+	if len(matched) == 0 {
+		return fmt.Errorf("%w: no environments recorded for %s (use --id or --name)", state.ErrNotFound, config.WorktreePath)
+	}
+
+	var failed int
+	for i, id := range matched {
+		if i > 0 && !validateJSON {
+			fmt.Println()
+		}
+		if err := validateEnvironment(manager, id, config); err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("validation failed for %d of %d environment(s)", failed, len(matched))
+	}
+	return nil
+}
+
+// validateEnvironment validates the environment isolationID and prints the
+// result.
+func validateEnvironment(manager *isolation.EnvironmentManager, isolationID string, config *isolation.Config) error {
 	// Check if lock exists to determine if environment exists
+	lockFile := filepath.Join(config.LockDir, fmt.Sprintf("env-%s.lock", isolationID))
 	if !fileExists(lockFile) {
-		return fmt.Errorf("environment %s does not exist (no lock file found)", validateID)
+		return fmt.Errorf("%w: %s (no lock file found)", state.ErrNotFound, isolationID)
 	}
 
-	env := &isolation.Environment{
-		ID:           validateID,
-		WorktreePath: worktree,
-		TempDir:      tmpDir,
-		LockFile:     lockFile,
-		EnvFile:      envFile,
-		Ports:        &ports.PortRange{BasePort: 0, Count: 0}, // Ports not needed for basic validation
+	env, err := loadEnvironment(isolationID, config)
+	if err != nil {
+		return err
+	}
+	if err := markUsed(env.ID); err != nil {
+		return err
+	}
+	others, stateErr := otherEnvironments(env.ID)
+
+	if validateJSON {
+		return outputValidateJSON(env, others, stateErr)
 	}
 
 	// Validate environment
-	if err := manager.Validate(env); err != nil {
-		fmt.Printf("❌ Validation failed: %v\n", err)
+	if err := manager.Validate(env, others...); err != nil {
+		var collision *isolation.PortCollisionError
+		if errors.As(err, &collision) {
+			fmt.Printf(emoji("❌ Validation failed: %d port collision(s) in %s\n"), len(collision.Collisions), env.ID)
+			for _, c := range collision.Collisions {
+				fmt.Printf("  %s\n", c)
+			}
+			return err
+		}
+		fmt.Printf(emoji("❌ Validation failed: %v\n"), err)
 		return err
 	}
 
 	// Print validation results
-	fmt.Println("✅ Environment validation successful!")
+	fmt.Println(emoji("✅ Environment validation successful!"))
 	fmt.Println()
 	fmt.Printf("  Isolation ID:   %s\n", env.ID)
-	fmt.Printf("  Lock File:      %s ✓\n", env.LockFile)
-	fmt.Printf("  Temp Directory: %s ✓\n", env.TempDir)
-	fmt.Printf("  Env File:       %s ✓\n", env.EnvFile)
+	fmt.Printf(emoji("  Lock File:      %s ✓\n"), env.LockFile)
+	fmt.Printf(emoji("  Temp Directory: %s ✓\n"), env.TempDir)
+	if env.EnvFile != "" {
+		fmt.Printf(emoji("  Env File:       %s ✓\n"), env.EnvFile)
+	} else {
+		fmt.Println("  Env File:       (none)")
+	}
+	if stateErr != nil {
+		fmt.Printf("  Ports:          not compared (state unavailable: %v)\n", stateErr)
+	} else {
+		fmt.Printf(emoji("  Ports:          no collisions with %d other environment(s) ✓\n"), len(others))
+	}
 	fmt.Println()
 	fmt.Println("Environment is properly isolated and functional.")
 
@@ -118,3 +207,151 @@ func fileExists(path string) bool {
 	_, err := os.Stat(path)
 	return err == nil
 }
+
+// otherEnvironments returns every recorded environment except id.
+func otherEnvironments(id string) ([]*isolation.Environment, error) {
+	stateMgr, err := newStateManager()
+	if err != nil {
+		return nil, err
+	}
+	envs, err := stateMgr.ListEnvironments()
+	if err != nil {
+		return nil, err
+	}
+	others := make([]*isolation.Environment, 0, len(envs))
+	for _, env := range envs {
+		if env.ID != id {
+			others = append(others, env.Environment())
+		}
+	}
+	return others, nil
+}
+
+// validateCheck is one check in the 'validate --json' output.
+type validateCheck struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail"`
+}
+
+// validateOutput is the 'validate --json' output.
+type validateOutput struct {
+	IsolationID string          `json:"isolation_id"`
+	Valid       bool            `json:"valid"`
+	Checks      []validateCheck `json:"checks"`
+}
+
+// outputValidateJSON runs every check on env, prints the results, and
+// returns an error naming the failed checks.
+func outputValidateJSON(env *isolation.Environment, others []*isolation.Environment, stateErr error) error {
+	output := validateOutput{IsolationID: env.ID, Valid: true}
+
+	listeners, listenErr := ports.ListenerPIDs()
+	collisions := isolation.PortCollisions(env, others, listeners)
+
+	output.Checks = []validateCheck{
+		checkLockFile(env),
+		checkPath("temp_dir", env.TempDir),
+		checkEnvFile(env),
+		checkPortCollisions(env, collisions, stateErr),
+		checkPortOwnership(env, collisions, listeners, listenErr),
+	}
+
+	var failed []string
+	for _, check := range output.Checks {
+		if !check.Passed {
+			output.Valid = false
+			failed = append(failed, check.Name)
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(output); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("validation failed: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func checkLockFile(env *isolation.Environment) validateCheck {
+	info, err := isolation.ReadLockInfo(env.LockFile)
+	if err != nil {
+		return validateCheck{Name: "lock", Detail: err.Error()}
+	}
+	return validateCheck{Name: "lock", Passed: true, Detail: fmt.Sprintf("%s (PID %d)", env.LockFile, info.PID)}
+}
+
+func checkPath(name, path string) validateCheck {
+	if !fileExists(path) {
+		return validateCheck{Name: name, Detail: "missing: " + path}
+	}
+	return validateCheck{Name: name, Passed: true, Detail: path}
+}
+
+func checkEnvFile(env *isolation.Environment) validateCheck {
+	if env.EnvFile == "" {
+		return validateCheck{Name: "env_file", Passed: true, Detail: "(none)"}
+	}
+	if owner := isolation.EnvFileOwner(env.EnvFile); owner != "" && owner != env.ID {
+		return validateCheck{Name: "env_file", Detail: fmt.Sprintf("overwritten by environment %s: %s", owner, env.EnvFile)}
+	}
+	return checkPath("env_file", env.EnvFile)
+}
+
+// checkPortCollisions fails if another recorded environment was allocated
+// one of env's ports.
+func checkPortCollisions(env *isolation.Environment, collisions []isolation.PortCollision, stateErr error) validateCheck {
+	check := validateCheck{Name: "port_collisions", Passed: true}
+	if stateErr != nil {
+		check.Detail = fmt.Sprintf("skipped: state unavailable: %v", stateErr)
+		return check
+	}
+
+	var shared []string
+	for _, c := range collisions {
+		if !c.Bound {
+			shared = append(shared, c.String())
+		}
+	}
+	if len(shared) > 0 {
+		check.Passed = false
+		check.Detail = strings.Join(shared, ", ")
+		return check
+	}
+	check.Detail = fmt.Sprintf("%d port(s) allocated to no other environment", env.Ports.Count)
+	return check
+}
+
+// checkPortOwnership fails if one of env's ports is bound by a process
+// outside env. Owners are resolved from /proc, best effort.
+func checkPortOwnership(env *isolation.Environment, collisions []isolation.PortCollision, listeners map[int][]int, listenErr error) validateCheck {
+	check := validateCheck{Name: "port_ownership", Passed: true}
+	if listenErr != nil {
+		check.Detail = fmt.Sprintf("skipped: %v", listenErr)
+		return check
+	}
+
+	var foreign []string
+	for _, c := range collisions {
+		if c.Bound {
+			foreign = append(foreign, c.String())
+		}
+	}
+	if len(foreign) > 0 {
+		check.Passed = false
+		check.Detail = strings.Join(foreign, ", ")
+		return check
+	}
+
+	bound := 0
+	for i := 0; i < env.Ports.Count; i++ {
+		if _, ok := listeners[env.Ports.BasePort+i]; ok {
+			bound++
+		}
+	}
+	check.Detail = fmt.Sprintf("%d/%d bound, none outside the environment", bound, env.Ports.Count)
+	return check
+}
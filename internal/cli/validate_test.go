@@ -0,0 +1,104 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidatePortChecks(t *testing.T) {
+	env := &isolation.Environment{ID: "a", Ports: &ports.PortRange{BasePort: 20000, Count: 3}}
+	collisions := []isolation.PortCollision{
+		{Port: 20001, Environment: "b"},
+		{Port: 20002, Environment: "c", PID: 4242, Bound: true},
+		{Port: 20002, PID: 4343, Bound: true},
+	}
+	listeners := map[int][]int{20002: {4242, 4343}}
+
+	check := checkPortCollisions(env, collisions, nil)
+	assert.False(t, check.Passed)
+	assert.Equal(t, "20001 allocated to b", check.Detail)
+
+	check = checkPortOwnership(env, collisions, listeners, nil)
+	assert.False(t, check.Passed)
+	assert.Equal(t, "20002 bound by c (PID 4242), 20002 bound by PID 4343 outside the environment", check.Detail)
+
+	check = checkPortCollisions(env, nil, errors.New("locked"))
+	assert.True(t, check.Passed)
+	assert.Contains(t, check.Detail, "skipped")
+
+	check = checkPortOwnership(env, nil, listeners, nil)
+	assert.True(t, check.Passed)
+	assert.Equal(t, "1/3 bound, none outside the environment", check.Detail)
+}
+
+func TestValidateIntegration(t *testing.T) {
+	buildCLI(t)
+
+	t.Run("validate accepts the ports held by create --reserve", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		stdout, stderr, err := runCLI(t, tmpDir, nil, "create", "--json", "--reserve", "--no-env-file")
+		require.NoError(t, err, stderr)
+		var created createOutput
+		require.NoError(t, json.Unmarshal([]byte(stdout), &created))
+		defer func() { _, _, _ = runCLI(t, tmpDir, nil, "cleanup", "--id", created.IsolationID) }()
+
+		stdout, stderr, err = runCLI(t, tmpDir, nil, "validate", "--id", created.IsolationID, "--json")
+		require.NoError(t, err, stdout+stderr)
+		assert.Contains(t, stdout, `"valid": true`)
+	})
+
+	t.Run("validate json reports every check", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		env := append(os.Environ(), "HOME="+t.TempDir())
+
+		stdout, stderr, err := runCLI(t, tmpDir, env, "create", "--json", "--ports", "2")
+		require.NoError(t, err, stderr)
+		var created createOutput
+		require.NoError(t, json.Unmarshal([]byte(stdout), &created))
+		defer func() { _, _, _ = runCLI(t, tmpDir, env, "cleanup", "--id", created.IsolationID) }()
+
+		validate := func() (validateOutput, error) {
+			stdout, _, err := runCLI(t, tmpDir, env, "validate", "--id", created.IsolationID, "--json")
+			var result validateOutput
+			require.NoError(t, json.Unmarshal([]byte(stdout), &result), stdout)
+			return result, err
+		}
+
+		result, err := validate()
+		require.NoError(t, err)
+		assert.True(t, result.Valid)
+		names := make([]string, 0, len(result.Checks))
+		for _, check := range result.Checks {
+			names = append(names, check.Name)
+		}
+		assert.Equal(t, []string{"lock", "temp_dir", "env_file", "port_collisions", "port_ownership"}, names)
+
+		require.NoError(t, os.RemoveAll(created.TempDir))
+		result, err = validate()
+		require.Error(t, err)
+		assert.False(t, result.Valid)
+		assert.False(t, result.Checks[1].Passed)
+	})
+}
@@ -0,0 +1,206 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+)
+
+// waitPollInterval is how often readiness gates are re-checked.
+const waitPollInterval = 200 * time.Millisecond
+
+// waitGate is one 'run --wait-for' readiness gate: a service's TCP port,
+// or an HTTP URL that may reference the environment's variables.
+type waitGate struct {
+	spec    string
+	service string
+	url     string
+}
+
+// parseWaitGate parses SERVICE[:tcp] or an http:// or https:// URL.
+func parseWaitGate(spec string) (waitGate, error) {
+	if strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://") {
+		return waitGate{spec: spec, url: spec}, nil
+	}
+	if strings.Contains(spec, "://") {
+		return waitGate{}, usageErrorf("invalid --wait-for %q: only http:// and https:// URLs are supported", spec)
+	}
+	service, kind, _ := strings.Cut(spec, ":")
+	if service == "" || (kind != "" && kind != "tcp") {
+		return waitGate{}, usageErrorf("invalid --wait-for %q: expected SERVICE:tcp or a URL", spec)
+	}
+	return waitGate{spec: spec, service: service}, nil
+}
+
+// check makes one readiness attempt against env.
+func (g waitGate) check(ctx context.Context, env *isolation.Environment) error {
+	if g.url == "" {
+		port, err := env.ServicePort(g.service)
+		if err != nil {
+			return err
+		}
+		dialer := net.Dialer{Timeout: time.Second}
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	url, err := expandVars(g.url, env.Vars())
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// permanent returns the error that keeps the gate from ever passing in
+// env, such as an unknown service or variable, so nobody waits for it.
+func (g waitGate) permanent(env *isolation.Environment) error {
+	if g.url == "" {
+		_, err := env.ServicePort(g.service)
+		return err
+	}
+	_, err := expandVars(g.url, env.Vars())
+	return err
+}
+
+// expandVars replaces $NAME and ${NAME} in s with vars, failing on names
+// vars does not define.
+func expandVars(s string, vars map[string]string) (string, error) {
+	var missing []string
+	expanded := os.Expand(s, func(name string) string {
+		value, ok := vars[name]
+		if !ok {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("unknown variable $%s in %q", missing[0], s)
+	}
+	return expanded, nil
+}
+
+// waitForGates polls every gate until all pass, timeout elapses, ctx is
+// done, or setup (if not nil) fails. Progress is written to out.
+func waitForGates(ctx context.Context, env *isolation.Environment, gates []waitGate, timeout time.Duration, setup *setupProcess, out io.Writer) error {
+	for _, g := range gates {
+		if err := g.permanent(env); err != nil {
+			return fmt.Errorf("--wait-for %s: %w", g.spec, err)
+		}
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+
+	var setupDone <-chan struct{}
+	if setup != nil {
+		setupDone = setup.done
+	}
+	for _, g := range gates {
+		for {
+			err := g.check(ctx, env)
+			if err == nil {
+				fmt.Fprintf(out, emoji("✅ Ready: %s (%s)\n"), g.spec, time.Since(start).Round(time.Millisecond))
+				break
+			}
+			select {
+			case <-ctx.Done():
+				if ctx.Err() == context.DeadlineExceeded {
+					return fmt.Errorf("timed out after %s waiting for %s: %w", timeout, g.spec, err)
+				}
+				return ctx.Err()
+			case <-setupDone:
+				if setup.err != nil {
+					return fmt.Errorf("setup failed before %s was ready: %w", g.spec, setup.err)
+				}
+				// Setup finished (e.g. started services in the background)
+				setupDone = nil
+			case <-ticker.C:
+			}
+		}
+	}
+	return nil
+}
+
+// setupProcess is a 'run --setup' command running alongside a copy.
+type setupProcess struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+	err  error
+}
+
+// startSetup starts command with sh in its own process group, so Stop
+// reaches the services it starts.
+func startSetup(command, dir string, env []string, stdout, stderr io.Writer) (*setupProcess, error) {
+	// #nosec G204 - running the user's setup command is the purpose of --setup
+	c := exec.Command("sh", "-c", command)
+	c.Dir, c.Env = dir, env
+	c.Stdout, c.Stderr = stdout, stderr
+	c.SysProcAttr = processGroupAttr()
+	if err := c.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start setup: %w", err)
+	}
+
+	s := &setupProcess{cmd: c, done: make(chan struct{})}
+	go func() {
+		s.err = exitError(c.Wait())
+		close(s.done)
+	}()
+	return s, nil
+}
+
+// Stop terminates the setup process group, including services the setup
+// command left running in the background, killing it after runKillGrace.
+func (s *setupProcess) Stop() {
+	_ = syscall.Kill(-s.cmd.Process.Pid, syscall.SIGTERM)
+	select {
+	case <-s.done:
+	case <-time.After(runKillGrace):
+		_ = syscall.Kill(-s.cmd.Process.Pid, syscall.SIGKILL)
+		<-s.done
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseWaitGate(t *testing.T) {
+	for spec, want := range map[string]waitGate{
+		"api:tcp":                     {spec: "api:tcp", service: "api"},
+		"db":                          {spec: "db", service: "db"},
+		"http://localhost:$API_PORT/": {spec: "http://localhost:$API_PORT/", url: "http://localhost:$API_PORT/"},
+	} {
+		gate, err := parseWaitGate(spec)
+		require.NoError(t, err, spec)
+		assert.Equal(t, want, gate, spec)
+	}
+
+	for _, spec := range []string{"api:udp", ":tcp", "grpc://localhost:1"} {
+		_, err := parseWaitGate(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestWaitForGates(t *testing.T) {
+	var healthy atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	port, err := strconv.Atoi(server.URL[strings.LastIndex(server.URL, ":")+1:])
+	require.NoError(t, err)
+
+	env := &isolation.Environment{
+		ID:      "abc",
+		Ports:   &ports.PortRange{BasePort: port, Count: 1},
+		Profile: &isolation.Profile{Ports: []string{"API_PORT"}},
+	}
+	gates := func(specs ...string) []waitGate {
+		var out []waitGate
+		for _, spec := range specs {
+			gate, err := parseWaitGate(spec)
+			require.NoError(t, err)
+			out = append(out, gate)
+		}
+		return out
+	}
+
+	t.Run("passes once every gate is ready", func(t *testing.T) {
+		time.AfterFunc(300*time.Millisecond, func() { healthy.Store(true) })
+		defer healthy.Store(false)
+		err := waitForGates(context.Background(), env, gates("api:tcp", "http://127.0.0.1:${API_PORT}/health"), 5*time.Second, nil, io.Discard)
+		require.NoError(t, err)
+	})
+
+	t.Run("times out", func(t *testing.T) {
+		err := waitForGates(context.Background(), env, gates("http://127.0.0.1:$API_PORT/health"), 300*time.Millisecond, nil, io.Discard)
+		assert.ErrorContains(t, err, "timed out after 300ms")
+		assert.ErrorContains(t, err, "503")
+	})
+
+	t.Run("fails fast on unknown services and variables", func(t *testing.T) {
+		err := waitForGates(context.Background(), env, gates("db:tcp"), time.Minute, nil, io.Discard)
+		assert.ErrorContains(t, err, `unknown service "db"`)
+		err = waitForGates(context.Background(), env, gates("http://127.0.0.1:$DB_PORT/"), time.Minute, nil, io.Discard)
+		assert.ErrorContains(t, err, "unknown variable $DB_PORT")
+	})
+
+	t.Run("fails when setup exits non-zero first", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		closed := &isolation.Environment{ID: "abc", Ports: &ports.PortRange{BasePort: l.Addr().(*net.TCPAddr).Port, Count: 1}}
+		require.NoError(t, l.Close())
+
+		setup, err := startSetup("exit 3", t.TempDir(), nil, io.Discard, io.Discard)
+		require.NoError(t, err)
+		defer setup.Stop()
+		err = waitForGates(context.Background(), closed, gates("port0:tcp"), 5*time.Second, setup, io.Discard)
+		assert.ErrorContains(t, err, "setup failed before port0:tcp was ready: exit status 3")
+	})
+}
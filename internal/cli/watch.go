@@ -0,0 +1,145 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	watchFormat   string
+	watchInterval time.Duration
+	watchNotify   bool
+)
+
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Stream environment lifecycle events",
+	Long: `Watch polls the state file and prints one JSON object per line (JSONL)
+for every environment change until interrupted:
+
+  created  An environment appeared in the state file
+  stale    An environment's owning process exited
+  removed  An environment was cleaned up
+
+Each event carries the same environment fields as 'list --format json'.
+Environments that exist when watch starts are not reported.
+
+With --notify, events are also POSTed to the webhooks configured in
+~/.go-portalloc/config.json.`,
+	Example: `  # Stream events to a log pipeline
+  go-portalloc watch --format jsonl >> /var/log/portalloc-events.jsonl
+
+  # Same as above, via list
+  go-portalloc list --follow
+
+  # Announce stale environments through configured webhooks
+  go-portalloc watch --notify > /dev/null`,
+	RunE: runWatch,
+}
+
+func init() {
+	watchCmd.Flags().StringVar(&watchFormat, "format", "jsonl", "Output format (jsonl)")
+	watchCmd.Flags().DurationVar(&watchInterval, "interval", time.Second, "Polling interval")
+	watchCmd.Flags().BoolVar(&watchNotify, "notify", false, "Also send events to configured webhooks")
+}
+
+// watchEvent is a single line of 'watch --format jsonl' output.
+type watchEvent struct {
+	Event       state.EventType `json:"event"`
+	Time        string          `json:"time"`
+	ID          string          `json:"id"`
+	Environment listOutputEntry `json:"environment"`
+}
+
+func runWatch(cmd *cobra.Command, args []string) error {
+	if watchFormat != "jsonl" {
+		return usageErrorf("unknown format: %s", watchFormat)
+	}
+
+	ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	return followEvents(ctx, os.Stdout, watchInterval, watchNotify)
+}
+
+// newWatchEvent converts a state event into its JSONL/webhook form.
+func newWatchEvent(event state.Event) watchEvent {
+	return watchEvent{
+		Event:       event.Type,
+		Time:        event.Time.UTC().Format(time.RFC3339Nano),
+		ID:          event.Environment.ID,
+		Environment: newListOutputEntry(event.Environment),
+	}
+}
+
+// followEvents writes state change events as JSONL to w until ctx is done,
+// optionally forwarding them to the configured webhooks.
+func followEvents(ctx context.Context, w io.Writer, interval time.Duration, notify bool) error {
+	if interval <= 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+
+	mgr, err := newStateManager()
+	if err != nil {
+		return fmt.Errorf("failed to create state manager: %w", err)
+	}
+
+	envs, err := mgr.ListEnvironments()
+	if err != nil {
+		return fmt.Errorf("failed to list environments: %w", err)
+	}
+	snapshot := state.NewSnapshot(envs)
+
+	encoder := json.NewEncoder(w)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		envs, err := mgr.ListEnvironments()
+		if err != nil {
+			// The state file may be mid-rewrite; try again next tick
+			continue
+		}
+
+		next := state.NewSnapshot(envs)
+		events := snapshot.Diff(next)
+		for _, event := range events {
+			if err := encoder.Encode(newWatchEvent(event)); err != nil {
+				return fmt.Errorf("failed to write event: %w", err)
+			}
+		}
+		if notify {
+			notifyEvents(events)
+		}
+		snapshot = next
+	}
+}
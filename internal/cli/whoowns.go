@@ -0,0 +1,124 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/spf13/cobra"
+)
+
+var whoownsJSON bool
+
+var whoownsCmd = &cobra.Command{
+	Use:   "whoowns <port>",
+	Short: "Show which environment a port is allocated to",
+	Long: `Whoowns searches the state file for the environment whose allocated range
+contains the port and prints its ID, worktree, owning process, and age,
+along with the service the port is assigned to and any processes
+listening on it.
+
+When several environments recorded the port, an active one is preferred,
+then the most recently created. Whoowns exits non-zero when no
+environment owns the port.`,
+	Example: `  # Who allocated port 24873?
+  go-portalloc whoowns 24873
+
+  # As JSON
+  go-portalloc whoowns 24873 --json`,
+	Args: cobra.ExactArgs(1),
+	RunE: runWhoowns,
+}
+
+func init() {
+	whoownsCmd.Flags().BoolVar(&whoownsJSON, "json", false, "Output as JSON")
+}
+
+// whoownsOutput is the 'whoowns --json' document.
+type whoownsOutput struct {
+	Port        int             `json:"port"`
+	Service     string          `json:"service,omitempty"`
+	Listeners   []int           `json:"listeners,omitempty"`
+	Environment listOutputEntry `json:"environment"`
+}
+
+func runWhoowns(cmd *cobra.Command, args []string) error {
+	port, err := strconv.Atoi(args[0])
+	if err != nil || port < 1 || port > 65535 {
+		return usageErrorf("invalid port %q", args[0])
+	}
+
+	mgr, err := newStateManager()
+	if err != nil {
+		return fmt.Errorf("failed to create state manager: %w", err)
+	}
+
+	env, err := mgr.FindByPort(port)
+	if err != nil {
+		return err
+	}
+
+	// Best effort: listener lookup is only supported on Linux
+	listeners, _ := ports.ListenerPIDs()
+	output := whoownsOutput{
+		Port:        port,
+		Service:     serviceOfPort(env, port),
+		Listeners:   listeners[port],
+		Environment: newListOutputEntry(env),
+	}
+
+	if whoownsJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(output)
+	}
+
+	name := env.ID
+	if env.Name != "" {
+		name = fmt.Sprintf("%s (%s)", env.ID, env.Name)
+	}
+	fmt.Printf("Port %d belongs to %s\n", port, name)
+	if output.Service != "" {
+		fmt.Printf("  Service:   %s\n", output.Service)
+	}
+	fmt.Printf("  Worktree:  %s\n", env.WorktreePath)
+	fmt.Printf("  PID:       %d (%s)\n", env.PID, state.GetEnvironmentStatus(env))
+	fmt.Printf("  Created:   %s (%s)\n", env.CreatedAt.Format(time.RFC3339), formatTimeAgo(env.CreatedAt))
+	if env.Ports != nil && env.Ports.Count > 0 {
+		fmt.Printf("  Ports:     %d-%d\n", env.Ports.BasePort, env.Ports.BasePort+env.Ports.Count-1)
+	}
+	if len(output.Listeners) > 0 {
+		fmt.Printf("  Listening: PID %v\n", output.Listeners)
+	}
+	return nil
+}
+
+// serviceOfPort returns the name of the service env assigns port to, or "".
+func serviceOfPort(env *state.EnvironmentState, port int) string {
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	for name, serviceAddr := range env.Environment().Services() {
+		if serviceAddr == addr {
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,509 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package config loads the optional go-portalloc configuration file.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/webhook"
+)
+
+// FileName is the name of the configuration file inside the state directory.
+const FileName = "config.json"
+
+// Config is the contents of ~/.go-portalloc/config.json.
+type Config struct {
+	// Webhooks receive environment lifecycle events.
+	Webhooks []webhook.Endpoint `json:"webhooks,omitempty"`
+	// Profiles are named environment stacks selected with --profile.
+	Profiles map[string]*isolation.Profile `json:"profiles,omitempty"`
+	// MaxLockAge overrides isolation.DefaultMaxLockAge, e.g. "12h".
+	// "0" disables lock expiry.
+	MaxLockAge string `json:"max_lock_age,omitempty"`
+	// StateBackend mirrors the state file to a store shared by several hosts.
+	StateBackend *StateBackend `json:"state_backend,omitempty"`
+	// Retention removes stale environments automatically; see Retention.
+	Retention *Retention `json:"retention,omitempty"`
+	// ListThresholds flags old or idle environments in 'list'.
+	ListThresholds *ListThresholds `json:"list_thresholds,omitempty"`
+	// Utilization makes create warn or refuse while the allocation range
+	// is nearly full; see Utilization.
+	Utilization *Utilization `json:"utilization,omitempty"`
+	// Project overrides the project key derived from the git repository.
+	Project string `json:"project,omitempty"`
+	// ComposePrefix overrides isolation.DefaultComposePrefix in
+	// COMPOSE_PROJECT_NAME.
+	ComposePrefix string `json:"compose_prefix,omitempty"`
+	// Naming selects temp and lock directory names: "legacy" (default,
+	// aigis-test-) or "portalloc"; see isolation.Naming.
+	Naming string `json:"naming,omitempty"`
+	// GitIgnore registers env files written by create as ignored in the
+	// worktree's git repository: "exclude" (.git/info/exclude) or
+	// "gitignore" (a managed block of .gitignore).
+	GitIgnore string `json:"gitignore,omitempty"`
+	// ReservedFile is a reserved ports file (see ports.ParseReservedPorts)
+	// whose ports are never allocated. Use an absolute path.
+	ReservedFile string `json:"reserved_file,omitempty"`
+}
+
+// Retention is the policy prune, serve --gc, and create enforce. Only stale
+// environments (owning process gone) past max_lock_age are ever removed.
+type Retention struct {
+	// MaxAge removes stale environments created longer ago than this, e.g. "72h".
+	MaxAge string `json:"max_age,omitempty"`
+	// MaxIdle removes stale environments last used longer ago than this,
+	// e.g. "24h"; see state.EnvironmentState.LastActivity.
+	MaxIdle string `json:"max_idle,omitempty"`
+	// MaxEnvironments removes the least recently used stale environments
+	// while more than this many are recorded. Reaching it also makes create
+	// reap first.
+	MaxEnvironments int `json:"max_environments,omitempty"`
+	// ReapStale removes every stale environment.
+	ReapStale bool `json:"reap_stale,omitempty"`
+}
+
+// Validate checks the policy's values.
+func (r *Retention) Validate() error {
+	if r.MaxAge != "" {
+		if age, err := time.ParseDuration(r.MaxAge); err != nil || age <= 0 {
+			return fmt.Errorf("invalid retention max_age %q", r.MaxAge)
+		}
+	}
+	if r.MaxIdle != "" {
+		if idle, err := time.ParseDuration(r.MaxIdle); err != nil || idle <= 0 {
+			return fmt.Errorf("invalid retention max_idle %q", r.MaxIdle)
+		}
+	}
+	if r.MaxEnvironments < 0 {
+		return fmt.Errorf("invalid retention max_environments %d", r.MaxEnvironments)
+	}
+	return nil
+}
+
+// QuotaReached reports whether count recorded environments reach
+// MaxEnvironments.
+func (r *Retention) QuotaReached(count int) bool {
+	return r.MaxEnvironments > 0 && count >= r.MaxEnvironments
+}
+
+// Select returns the stale environments in envs that the policy removes,
+// least recently used first, leaving room under MaxEnvironments for
+// headroom more environments (create passes 1). Environments younger than
+// maxLockAge, or whose lock has not expired, are kept: the CLI records the
+// short-lived create process, so they look stale while still in use. The
+// policy must be valid.
+func (r *Retention) Select(envs []*state.EnvironmentState, now time.Time, headroom int, maxLockAge time.Duration) []*state.EnvironmentState {
+	var maxAge, maxIdle time.Duration
+	if r.MaxAge != "" {
+		maxAge, _ = time.ParseDuration(r.MaxAge)
+	}
+	if r.MaxIdle != "" {
+		maxIdle, _ = time.ParseDuration(r.MaxIdle)
+	}
+
+	var stale []*state.EnvironmentState
+	for _, env := range envs {
+		if state.GetEnvironmentStatus(env) == state.StatusStale && !inLockGrace(env, now, maxLockAge) {
+			stale = append(stale, env)
+		}
+	}
+	lastActivity := make(map[*state.EnvironmentState]time.Time, len(stale))
+	for _, env := range stale {
+		lastActivity[env] = env.LastActivity()
+	}
+	sort.SliceStable(stale, func(i, j int) bool {
+		return lastActivity[stale[i]].Before(lastActivity[stale[j]])
+	})
+
+	// Over the quota, the least recently used stale environments go first
+	excess := 0
+	if r.MaxEnvironments > 0 {
+		excess = len(envs) + headroom - r.MaxEnvironments
+	}
+
+	var selected []*state.EnvironmentState
+	for i, env := range stale {
+		switch {
+		case r.ReapStale,
+			maxAge > 0 && now.Sub(env.CreatedAt) > maxAge,
+			maxIdle > 0 && now.Sub(lastActivity[env]) > maxIdle,
+			i < excess:
+			selected = append(selected, env)
+		}
+	}
+	return selected
+}
+
+// inLockGrace reports whether env was created within maxLockAge, or holds
+// a lock that has not expired after maxLockAge.
+func inLockGrace(env *state.EnvironmentState, now time.Time, maxLockAge time.Duration) bool {
+	if maxLockAge <= 0 {
+		return false
+	}
+	if now.Sub(env.CreatedAt) <= maxLockAge {
+		return true
+	}
+	if env.LockFile == "" {
+		return false
+	}
+	info, err := isolation.ReadLockInfo(env.LockFile)
+	return err == nil && !info.Expired(maxLockAge, now)
+}
+
+// ListThresholds are the ages after which 'list' flags an environment as
+// suspicious, even while its process is alive. Empty values disable a check.
+type ListThresholds struct {
+	// MaxAge flags environments created longer ago than this, e.g. "24h".
+	MaxAge string `json:"max_age,omitempty"`
+	// MaxIdle flags environments last used longer ago than this, e.g.
+	// "2h"; see state.EnvironmentState.LastActivity.
+	MaxIdle string `json:"max_idle,omitempty"`
+}
+
+// Durations parses the thresholds; unset ones are 0.
+func (t *ListThresholds) Durations() (maxAge, maxIdle time.Duration, err error) {
+	if t == nil {
+		return 0, 0, nil
+	}
+	if maxAge, err = parseThreshold("max_age", t.MaxAge); err != nil {
+		return 0, 0, err
+	}
+	if maxIdle, err = parseThreshold("max_idle", t.MaxIdle); err != nil {
+		return 0, 0, err
+	}
+	return maxAge, maxIdle, nil
+}
+
+func parseThreshold(field, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid list_thresholds %s %q", field, value)
+	}
+	return d, nil
+}
+
+// RetentionPolicy returns the configured retention policy, or nil if none is
+// configured.
+func (c *Config) RetentionPolicy() (*Retention, error) {
+	if c.Retention == nil {
+		return nil, nil
+	}
+	if err := c.Retention.Validate(); err != nil {
+		return nil, err
+	}
+	return c.Retention, nil
+}
+
+// Utilization actions.
+const (
+	UtilizationWarn   = "warn"
+	UtilizationRefuse = "refuse"
+)
+
+// Utilization is the guardrail create applies to the allocation range, so a
+// host running out of ports degrades predictably instead of failing
+// allocations deep inside test suites.
+type Utilization struct {
+	// MaxPercent is how much of the range, in percent, may be busy (bound
+	// by a listener) or registered (allocated to a recorded environment)
+	// before create acts, e.g. 80. 0 disables the check.
+	MaxPercent float64 `json:"max_percent,omitempty"`
+	// Action is UtilizationWarn (the default) or UtilizationRefuse.
+	Action string `json:"action,omitempty"`
+}
+
+// Validate checks the guardrail's values.
+func (u *Utilization) Validate() error {
+	if u.MaxPercent < 0 || u.MaxPercent > 100 {
+		return fmt.Errorf("invalid utilization max_percent %g (want 0-100)", u.MaxPercent)
+	}
+	switch u.Action {
+	case "", UtilizationWarn, UtilizationRefuse:
+	default:
+		return fmt.Errorf("invalid utilization action %q (want %s or %s)", u.Action, UtilizationWarn, UtilizationRefuse)
+	}
+	return nil
+}
+
+// Refuse reports whether create fails, rather than warns, over MaxPercent.
+func (u *Utilization) Refuse() bool {
+	return u.Action == UtilizationRefuse
+}
+
+// UtilizationLimit returns the utilization guardrail, or nil if none is
+// configured.
+func (c *Config) UtilizationLimit() (*Utilization, error) {
+	if c.Utilization == nil {
+		return nil, nil
+	}
+	if err := c.Utilization.Validate(); err != nil {
+		return nil, err
+	}
+	return c.Utilization, nil
+}
+
+// StateBackend configures a shared state store.
+type StateBackend struct {
+	// Type is the backend type; only "etcd" is supported.
+	Type      string   `json:"type"`
+	Endpoints []string `json:"endpoints"`
+	// Prefix defaults to state.DefaultEtcdPrefix.
+	Prefix string `json:"prefix,omitempty"`
+	// LeaseTTL is how long a host's heartbeat outlives its last write;
+	// defaults to state.DefaultEtcdLeaseTTL, e.g. "2h".
+	LeaseTTL string `json:"lease_ttl,omitempty"`
+}
+
+// Store returns the configured shared store, or nil if none is configured.
+func (c *Config) Store() (state.Store, error) {
+	b := c.StateBackend
+	if b == nil {
+		return nil, nil
+	}
+	if b.Type != "etcd" {
+		return nil, fmt.Errorf("unsupported state_backend type %q (expected etcd)", b.Type)
+	}
+	if len(b.Endpoints) == 0 {
+		return nil, fmt.Errorf("state_backend requires at least one endpoint")
+	}
+
+	store := state.NewEtcdStore(b.Endpoints...)
+	if b.Prefix != "" {
+		store.Prefix = b.Prefix
+	}
+	if b.LeaseTTL != "" {
+		ttl, err := time.ParseDuration(b.LeaseTTL)
+		if err != nil || ttl < time.Second {
+			return nil, fmt.Errorf("invalid state_backend lease_ttl %q", b.LeaseTTL)
+		}
+		store.LeaseTTL = ttl
+	}
+	return store, nil
+}
+
+// LockAge returns the configured maximum lock age.
+func (c *Config) LockAge() (time.Duration, error) {
+	if c.MaxLockAge == "" {
+		return isolation.DefaultMaxLockAge, nil
+	}
+	age, err := time.ParseDuration(c.MaxLockAge)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("invalid max_lock_age %q in config file", c.MaxLockAge)
+	}
+	return age, nil
+}
+
+// GitIgnoreMode returns where generated env files are registered as ignored.
+func (c *Config) GitIgnoreMode() (isolation.GitIgnore, error) {
+	mode, err := isolation.ParseGitIgnore(c.GitIgnore)
+	if err != nil {
+		return "", fmt.Errorf("%w in config file", err)
+	}
+	return mode, nil
+}
+
+// ReservedPorts loads ReservedFile, or returns nil if none is configured.
+func (c *Config) ReservedPorts() (*ports.ReservedPorts, error) {
+	if c.ReservedFile == "" {
+		return nil, nil
+	}
+	reserved, err := ports.LoadReservedPorts(c.ReservedFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reserved_file in config file: %w", err)
+	}
+	return reserved, nil
+}
+
+// Profile returns the named profile: one from the config file, or else the
+// built-in preset of that name (see isolation.Preset).
+func (c *Config) Profile(name string) (*isolation.Profile, error) {
+	profile, ok := c.Profiles[name]
+	if !ok || profile == nil {
+		if preset, ok := isolation.Preset(name); ok {
+			return preset, nil
+		}
+		names := isolation.PresetNames()
+		for n := range c.Profiles {
+			if !slices.Contains(names, n) {
+				names = append(names, n)
+			}
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown profile %q (available: %s)", name, strings.Join(names, ", "))
+	}
+
+	p := *profile
+	p.Name = name
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Problem is an invalid value in the configuration file.
+type Problem struct {
+	// Field is the JSON path of the value, e.g. "retention.max_age".
+	Field string
+	Err   error
+	// fix resets the value so that its default applies.
+	fix func(*Config)
+}
+
+// Problems returns the values that would make commands fail, sorted by field.
+func (c *Config) Problems() []Problem {
+	var problems []Problem
+	add := func(field string, err error, fix func(*Config)) {
+		problems = append(problems, Problem{Field: field, Err: err, fix: fix})
+	}
+
+	if _, err := c.LockAge(); err != nil {
+		add("max_lock_age", err, func(c *Config) { c.MaxLockAge = "" })
+	}
+	if r := c.Retention; r != nil {
+		if err := (&Retention{MaxAge: r.MaxAge}).Validate(); err != nil {
+			add("retention.max_age", err, func(c *Config) { c.Retention.MaxAge = "" })
+		}
+		if err := (&Retention{MaxIdle: r.MaxIdle}).Validate(); err != nil {
+			add("retention.max_idle", err, func(c *Config) { c.Retention.MaxIdle = "" })
+		}
+		if err := (&Retention{MaxEnvironments: r.MaxEnvironments}).Validate(); err != nil {
+			add("retention.max_environments", err, func(c *Config) { c.Retention.MaxEnvironments = 0 })
+		}
+	}
+	if t := c.ListThresholds; t != nil {
+		if _, _, err := (&ListThresholds{MaxAge: t.MaxAge}).Durations(); err != nil {
+			add("list_thresholds.max_age", err, func(c *Config) { c.ListThresholds.MaxAge = "" })
+		}
+		if _, _, err := (&ListThresholds{MaxIdle: t.MaxIdle}).Durations(); err != nil {
+			add("list_thresholds.max_idle", err, func(c *Config) { c.ListThresholds.MaxIdle = "" })
+		}
+	}
+	if u := c.Utilization; u != nil {
+		if err := (&Utilization{MaxPercent: u.MaxPercent}).Validate(); err != nil {
+			add("utilization.max_percent", err, func(c *Config) { c.Utilization.MaxPercent = 0 })
+		}
+		if err := (&Utilization{Action: u.Action}).Validate(); err != nil {
+			add("utilization.action", err, func(c *Config) { c.Utilization.Action = "" })
+		}
+	}
+	if b := c.StateBackend; b != nil {
+		if _, err := (&Config{StateBackend: &StateBackend{Type: b.Type, Endpoints: b.Endpoints}}).Store(); err != nil {
+			add("state_backend", err, func(c *Config) { c.StateBackend = nil })
+		} else if _, err := c.Store(); err != nil {
+			add("state_backend.lease_ttl", err, func(c *Config) { c.StateBackend.LeaseTTL = "" })
+		}
+	}
+	if _, err := isolation.ParseNaming(c.Naming); err != nil {
+		add("naming", err, func(c *Config) { c.Naming = "" })
+	}
+	if _, err := c.GitIgnoreMode(); err != nil {
+		add("gitignore", err, func(c *Config) { c.GitIgnore = "" })
+	}
+	if _, err := c.ReservedPorts(); err != nil {
+		add("reserved_file", err, func(c *Config) { c.ReservedFile = "" })
+	}
+	if err := isolation.ValidateComposePrefix(c.ComposePrefix); err != nil {
+		add("compose_prefix", err, func(c *Config) { c.ComposePrefix = "" })
+	}
+	for name := range c.Profiles {
+		if _, err := c.Profile(name); err != nil {
+			add("profiles."+name, err, func(c *Config) { delete(c.Profiles, name) })
+		}
+	}
+
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Field < problems[j].Field })
+	return problems
+}
+
+// Repair resets every value reported by Problems: invalid settings fall back
+// to their defaults, and invalid profiles and state backends are removed.
+func (c *Config) Repair() []Problem {
+	problems := c.Problems()
+	for _, p := range problems {
+		p.fix(c)
+	}
+	return problems
+}
+
+// Save writes c to path, keeping the previous file as path.bak. Fields
+// unknown to this version are not preserved.
+func (c *Config) Save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+	if _, err := os.Stat(path); err == nil {
+		if err := os.Rename(path, path+".bak"); err != nil {
+			return fmt.Errorf("failed to back up config file: %w", err)
+		}
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	return nil
+}
+
+// DefaultPath returns ~/.go-portalloc/config.json.
+func DefaultPath() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to get home directory: %w", err)
+	}
+	return filepath.Join(homeDir, ".go-portalloc", FileName), nil
+}
+
+// Load reads the configuration file at path. A missing file yields an empty
+// configuration; an empty path means DefaultPath, and without a home
+// directory there is no configuration to read.
+func Load(path string) (*Config, error) {
+	if path == "" {
+		var err error
+		if path, err = DefaultPath(); err != nil {
+			return &Config{}, nil
+		}
+	}
+
+	// #nosec G304 - path is the user's own configuration file
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Config{}, nil
+		}
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,288 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	t.Run("missing file is empty config", func(t *testing.T) {
+		cfg, err := Load(filepath.Join(t.TempDir(), FileName))
+		require.NoError(t, err)
+		assert.Empty(t, cfg.Webhooks)
+	})
+
+	t.Run("parses webhooks", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), FileName)
+		content := `{"webhooks": [{"url": "https://example.com/hook", "secret": "s", "events": ["stale"]}]}`
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+		cfg, err := Load(path)
+		require.NoError(t, err)
+		require.Len(t, cfg.Webhooks, 1)
+		assert.Equal(t, "https://example.com/hook", cfg.Webhooks[0].URL)
+		assert.Equal(t, "s", cfg.Webhooks[0].Secret)
+		assert.Equal(t, []string{"stale"}, cfg.Webhooks[0].Events)
+	})
+
+	t.Run("invalid JSON", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), FileName)
+		require.NoError(t, os.WriteFile(path, []byte("{"), 0o600))
+
+		_, err := Load(path)
+		assert.Error(t, err)
+	})
+
+	t.Run("no home directory is empty config", func(t *testing.T) {
+		t.Setenv("HOME", "")
+
+		cfg, err := Load("")
+		require.NoError(t, err)
+		assert.Empty(t, cfg.Webhooks)
+	})
+}
+
+func TestConfig_Profile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileName)
+	content := `{"profiles": {
+		"kafka": {
+			"ports": ["KAFKA_PORT", "ZOOKEEPER_PORT"],
+			"vars": {"KAFKA_ADVERTISED_LISTENERS": "PLAINTEXT://127.0.0.1:${KAFKA_PORT}"}
+		},
+		"broken": {"ports": ["not a name"]}
+	}}`
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	cfg, err := Load(path)
+	require.NoError(t, err)
+
+	profile, err := cfg.Profile("kafka")
+	require.NoError(t, err)
+	assert.Equal(t, "kafka", profile.Name)
+	assert.Equal(t, []string{"KAFKA_PORT", "ZOOKEEPER_PORT"}, profile.Ports, "config profiles override presets")
+
+	profile, err = cfg.Profile("localstack")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"LOCALSTACK_PORT"}, profile.Ports, "built-in presets need no config")
+
+	_, err = cfg.Profile("broken")
+	assert.Error(t, err)
+
+	_, err = cfg.Profile("missing")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "available: broken, firebase-emulators, kafka, localstack, postgres+redis")
+}
+
+func TestConfig_LockAge(t *testing.T) {
+	age, err := (&Config{}).LockAge()
+	require.NoError(t, err)
+	assert.Equal(t, isolation.DefaultMaxLockAge, age)
+
+	age, err = (&Config{MaxLockAge: "0"}).LockAge()
+	require.NoError(t, err)
+	assert.Zero(t, age)
+
+	_, err = (&Config{MaxLockAge: "soon"}).LockAge()
+	assert.Error(t, err)
+}
+
+func TestConfig_Store(t *testing.T) {
+	store, err := (&Config{}).Store()
+	require.NoError(t, err)
+	assert.Nil(t, store)
+
+	cfg := &Config{StateBackend: &StateBackend{
+		Type:      "etcd",
+		Endpoints: []string{"http://etcd:2379"},
+		Prefix:    "/ci/",
+		LeaseTTL:  "2h",
+	}}
+	store, err = cfg.Store()
+	require.NoError(t, err)
+	etcd, ok := store.(*state.EtcdStore)
+	require.True(t, ok)
+	assert.Equal(t, "/ci/", etcd.Prefix)
+	assert.Equal(t, 2*time.Hour, etcd.LeaseTTL)
+
+	_, err = (&Config{StateBackend: &StateBackend{Type: "consul", Endpoints: []string{"x"}}}).Store()
+	assert.Error(t, err)
+	_, err = (&Config{StateBackend: &StateBackend{Type: "etcd"}}).Store()
+	assert.Error(t, err)
+}
+
+func TestConfig_ReservedPorts(t *testing.T) {
+	reserved, err := (&Config{}).ReservedPorts()
+	require.NoError(t, err)
+	assert.Nil(t, reserved)
+
+	path := filepath.Join(t.TempDir(), "reserved")
+	require.NoError(t, os.WriteFile(path, []byte("22\n8000-8099\n"), 0o600))
+	reserved, err = (&Config{ReservedFile: path}).ReservedPorts()
+	require.NoError(t, err)
+	assert.True(t, reserved.Contains(8042))
+
+	_, err = (&Config{ReservedFile: path + ".missing"}).ReservedPorts()
+	assert.ErrorContains(t, err, "reserved_file")
+}
+
+func TestConfig_Repair(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileName)
+	cfg := &Config{
+		MaxLockAge:     "soon",
+		ComposePrefix:  "My App-",
+		Naming:         "aigis",
+		GitIgnore:      "always",
+		ReservedFile:   filepath.Join(t.TempDir(), "missing"),
+		Retention:      &Retention{MaxAge: "-1h", MaxEnvironments: 10},
+		ListThresholds: &ListThresholds{MaxAge: "24h", MaxIdle: "idle"},
+		StateBackend: &StateBackend{
+			Type:      "etcd",
+			Endpoints: []string{"http://etcd:2379"},
+			LeaseTTL:  "1ms",
+		},
+		Profiles: map[string]*isolation.Profile{
+			"ok":  {Ports: []string{"API_PORT"}},
+			"bad": {Ports: []string{"API-PORT"}},
+		},
+	}
+	require.NoError(t, cfg.Save(path))
+
+	fields := func(problems []Problem) []string {
+		var names []string
+		for _, p := range problems {
+			names = append(names, p.Field)
+		}
+		return names
+	}
+	want := []string{"compose_prefix", "gitignore", "list_thresholds.max_idle", "max_lock_age", "naming", "profiles.bad", "reserved_file", "retention.max_age", "state_backend.lease_ttl"}
+	assert.Equal(t, want, fields(cfg.Problems()))
+	assert.Equal(t, want, fields(cfg.Repair()))
+	assert.Empty(t, cfg.Problems())
+
+	// Valid values survive the repair
+	assert.Equal(t, 10, cfg.Retention.MaxEnvironments)
+	assert.Equal(t, "24h", cfg.ListThresholds.MaxAge)
+	assert.Equal(t, []string{"http://etcd:2379"}, cfg.StateBackend.Endpoints)
+	assert.Contains(t, cfg.Profiles, "ok")
+
+	require.NoError(t, cfg.Save(path))
+	assert.FileExists(t, path+".bak")
+	saved, err := Load(path)
+	require.NoError(t, err)
+	assert.Empty(t, saved.Problems())
+}
+
+func TestRetention(t *testing.T) {
+	now := time.Now()
+	const deadPID = 999999
+	envs := []*state.EnvironmentState{
+		{ID: "active-old", PID: os.Getpid(), CreatedAt: now.Add(-100 * time.Hour)},
+		{ID: "stale-old", PID: deadPID, CreatedAt: now.Add(-80 * time.Hour)},
+		{ID: "stale-mid", PID: deadPID, CreatedAt: now.Add(-10 * time.Hour)},
+		{ID: "stale-new", PID: deadPID, CreatedAt: now.Add(-time.Minute)},
+		{ID: "stale-used", PID: deadPID, CreatedAt: now.Add(-90 * time.Hour), LastUsedAt: now.Add(-time.Hour)},
+	}
+	ids := func(selected []*state.EnvironmentState) []string {
+		var out []string
+		for _, env := range selected {
+			out = append(out, env.ID)
+		}
+		return out
+	}
+
+	t.Run("reap_stale selects every stale environment", func(t *testing.T) {
+		r := &Retention{ReapStale: true}
+		assert.Equal(t, []string{"stale-old", "stale-mid", "stale-used", "stale-new"}, ids(r.Select(envs, now, 0, 0)))
+	})
+
+	t.Run("max_age selects old stale environments only", func(t *testing.T) {
+		r := &Retention{MaxAge: "72h"}
+		assert.Equal(t, []string{"stale-old", "stale-used"}, ids(r.Select(envs, now, 0, 0)))
+	})
+
+	t.Run("max_idle selects stale environments unused for long", func(t *testing.T) {
+		r := &Retention{MaxIdle: "5h"}
+		assert.Equal(t, []string{"stale-old", "stale-mid"}, ids(r.Select(envs, now, 0, 0)))
+	})
+
+	t.Run("max_environments selects the least recently used stale environments", func(t *testing.T) {
+		r := &Retention{MaxEnvironments: 4}
+		assert.Equal(t, []string{"stale-old"}, ids(r.Select(envs, now, 0, 0)))
+		assert.Equal(t, []string{"stale-old", "stale-mid"}, ids(r.Select(envs, now, 1, 0)))
+		assert.True(t, r.QuotaReached(4))
+		assert.False(t, r.QuotaReached(3))
+		assert.False(t, (&Retention{}).QuotaReached(100))
+	})
+
+	t.Run("active environments are never selected", func(t *testing.T) {
+		r := &Retention{MaxEnvironments: 1, MaxAge: "1s", ReapStale: true}
+		assert.NotContains(t, ids(r.Select(envs, now, 0, 0)), "active-old")
+	})
+
+	t.Run("environments within max_lock_age are kept", func(t *testing.T) {
+		r := &Retention{ReapStale: true}
+		assert.Equal(t, []string{"stale-old", "stale-used"}, ids(r.Select(envs, now, 0, 24*time.Hour)))
+
+		lockFile := filepath.Join(t.TempDir(), "env-locked.lock")
+		lock := fmt.Sprintf("PID=%d\nTimestamp=%d\n", deadPID, now.Add(-time.Hour).Unix())
+		require.NoError(t, os.WriteFile(lockFile, []byte(lock), 0o600))
+		relocked := &state.EnvironmentState{ID: "relocked", PID: deadPID, CreatedAt: now.Add(-80 * time.Hour), LockFile: lockFile}
+		assert.Empty(t, r.Select([]*state.EnvironmentState{relocked}, now, 0, 24*time.Hour), "an unexpired lock keeps the environment")
+	})
+
+	t.Run("validation", func(t *testing.T) {
+		policy, err := (&Config{}).RetentionPolicy()
+		require.NoError(t, err)
+		assert.Nil(t, policy)
+
+		_, err = (&Config{Retention: &Retention{MaxAge: "soon"}}).RetentionPolicy()
+		assert.Error(t, err)
+		_, err = (&Config{Retention: &Retention{MaxEnvironments: -1}}).RetentionPolicy()
+		assert.Error(t, err)
+		_, err = (&Config{Retention: &Retention{MaxIdle: "0s"}}).RetentionPolicy()
+		assert.Error(t, err)
+	})
+}
+
+func TestConfig_UtilizationLimit(t *testing.T) {
+	limit, err := (&Config{}).UtilizationLimit()
+	require.NoError(t, err)
+	assert.Nil(t, limit)
+
+	limit, err = (&Config{Utilization: &Utilization{MaxPercent: 80, Action: "refuse"}}).UtilizationLimit()
+	require.NoError(t, err)
+	assert.True(t, limit.Refuse())
+	assert.False(t, (&Utilization{MaxPercent: 80}).Refuse(), "warn by default")
+
+	_, err = (&Config{Utilization: &Utilization{MaxPercent: 120}}).UtilizationLimit()
+	assert.ErrorContains(t, err, "invalid utilization max_percent 120")
+	_, err = (&Config{Utilization: &Utilization{Action: "block"}}).UtilizationLimit()
+	assert.ErrorContains(t, err, `invalid utilization action "block"`)
+
+	problems := (&Config{Utilization: &Utilization{MaxPercent: -1, Action: "block"}}).Problems()
+	require.Len(t, problems, 2)
+	assert.Equal(t, "utilization.action", problems[0].Field)
+	assert.Equal(t, "utilization.max_percent", problems[1].Field)
+}
@@ -0,0 +1,174 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/client"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+)
+
+// maxRequestSize bounds API request bodies.
+const maxRequestSize = 1 << 20
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	envs, err := s.state.ListEnvironments()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	out := make([]*client.Environment, 0, len(envs))
+	for _, env := range envs {
+		out = append(out, toClientEnvironment(env))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	env, err := s.state.GetEnvironment(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toClientEnvironment(env))
+}
+
+func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
+	if s.config.Create == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("create is not enabled"))
+		return
+	}
+
+	if s.rejectDraining(w) {
+		return
+	}
+
+	var req client.CreateRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if req.Ports < 0 {
+		writeError(w, http.StatusBadRequest, errors.New("ports must not be negative"))
+		return
+	}
+
+	if !s.acquireCreate() {
+		s.metrics.AddRejected(RejectConcurrency)
+		writeExhausted(w, time.Second, "too many concurrent environment creations")
+		return
+	}
+	defer s.releaseCreate()
+
+	env, err := s.config.Create(r.Context(), &req)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.metrics.AddOperations(OpCreate, 1)
+	writeJSON(w, http.StatusCreated, toClientEnvironment(env))
+}
+
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	if s.config.Remove == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("cleanup is not enabled"))
+		return
+	}
+
+	env, err := s.state.GetEnvironment(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err := s.config.Remove(r.Context(), env); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.metrics.AddOperations(OpCleanup, 1)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleAllocatePorts(w http.ResponseWriter, r *http.Request) {
+	if s.config.AllocatePorts == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("port allocation is not enabled"))
+		return
+	}
+
+	var req client.AllocateRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if req.Count <= 0 {
+		writeError(w, http.StatusBadRequest, errors.New("count must be positive"))
+		return
+	}
+
+	basePort, err := s.config.AllocatePorts(req.Count)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	ports := make([]int, req.Count)
+	for i := range ports {
+		ports[i] = basePort + i
+	}
+	writeJSON(w, http.StatusOK, &client.PortRange{BasePort: basePort, Ports: ports})
+}
+
+func toClientEnvironment(env *state.EnvironmentState) *client.Environment {
+	out := &client.Environment{
+		CreatedAt:    env.CreatedAt,
+		ID:           env.ID,
+		Status:       string(state.GetEnvironmentStatus(env)),
+		Host:         env.Host,
+		WorktreePath: env.WorktreePath,
+		TempDir:      env.TempDir,
+		EnvFile:      env.EnvFile,
+		PID:          env.PID,
+		Ports:        []int{},
+	}
+	if env.Ports != nil {
+		out.BasePort = env.Ports.BasePort
+		if env.Ports.Allocated != nil {
+			out.Ports = env.Ports.Allocated
+		}
+	}
+	return out
+}
+
+// decodeRequest decodes a JSON body, writing a 400 and returning false on failure.
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, &client.ErrorResponse{Error: err.Error()})
+}
@@ -0,0 +1,141 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/client"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_API(t *testing.T) {
+	stateMgr := state.NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+
+	var removed []string
+	config := Config{
+		Create: func(ctx context.Context, req *client.CreateRequest) (*state.EnvironmentState, error) {
+			if req.InstanceID == "fail" {
+				return nil, errors.New("no free ports")
+			}
+			env := &isolation.Environment{
+				ID:           "api-" + req.InstanceID,
+				WorktreePath: req.WorktreePath,
+				TempDir:      filepath.Join(os.TempDir(), "aigis-test-api"),
+				Ports:        &ports.PortRange{BasePort: 24000, Count: req.Ports},
+			}
+			if err := stateMgr.RecordEnvironment(env); err != nil {
+				return nil, err
+			}
+			return state.NewEnvironmentState(env), nil
+		},
+		Remove: func(ctx context.Context, env *state.EnvironmentState) error {
+			removed = append(removed, env.ID)
+			return stateMgr.RemoveEnvironment(env.ID)
+		},
+		AllocatePorts: func(count int) (int, error) { return 25000, nil },
+	}
+	server := New(stateMgr, config)
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	c := client.New(ts.URL, client.WithRetries(0, 0))
+	ctx := context.Background()
+
+	env, err := c.Create(ctx, &client.CreateRequest{Ports: 3, InstanceID: "job1", WorktreePath: "/work"})
+	require.NoError(t, err)
+	assert.Equal(t, "api-job1", env.ID)
+	assert.Equal(t, "active", env.Status)
+	assert.Equal(t, []int{24000, 24001, 24002}, env.Ports)
+
+	envs, err := c.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, envs, 1)
+	assert.Equal(t, "/work", envs[0].WorktreePath)
+
+	got, err := c.Get(ctx, "api-job1")
+	require.NoError(t, err)
+	assert.Equal(t, 24000, got.BasePort)
+
+	pr, err := c.AllocatePorts(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []int{25000, 25001}, pr.Ports)
+
+	_, err = c.Create(ctx, &client.CreateRequest{InstanceID: "fail"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no free ports")
+
+	require.NoError(t, c.Cleanup(ctx, "api-job1"))
+	assert.Equal(t, []string{"api-job1"}, removed)
+
+	// Only the successful create and cleanup are counted
+	body := scrape(t, server)
+	assert.Contains(t, body, `portalloc_operations_total{operation="create"} 1`)
+	assert.Contains(t, body, `portalloc_operations_total{operation="cleanup"} 1`)
+
+	err = c.Cleanup(ctx, "api-job1")
+	assert.True(t, client.IsNotFound(err), "%v", err)
+	_, err = c.Get(ctx, "missing")
+	assert.True(t, client.IsNotFound(err), "%v", err)
+}
+
+func TestServer_APIValidation(t *testing.T) {
+	stateMgr := state.NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+	ts := httptest.NewServer(New(stateMgr, Config{}).Handler())
+	defer ts.Close()
+
+	post := func(path, body string) int {
+		resp, err := http.Post(ts.URL+path, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Read-only daemon
+	assert.Equal(t, http.StatusNotImplemented, post("/v1/environments", `{}`))
+	assert.Equal(t, http.StatusNotImplemented, post("/v1/ports", `{"count":1}`))
+
+	resp, err := http.Get(ts.URL + "/v1/environments")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	server := New(stateMgr, Config{AllocatePorts: func(int) (int, error) { return 1, nil }})
+	ts2 := httptest.NewServer(server.Handler())
+	defer ts2.Close()
+	for body, want := range map[string]int{
+		`{"count":0}`:  http.StatusBadRequest,
+		`{"counts":1}`: http.StatusBadRequest,
+		`not json`:     http.StatusBadRequest,
+		`{"count":2}`:  http.StatusOK,
+	} {
+		resp, err := http.Post(ts2.URL+"/v1/ports", "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, want, resp.StatusCode, body)
+	}
+
+}
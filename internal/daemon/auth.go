@@ -0,0 +1,141 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/client"
+)
+
+// StaticTokenUser is the user name of a token file line without "USER:".
+const StaticTokenUser = "token"
+
+// Token is an API token and the user it authenticates.
+type Token struct {
+	User  string
+	Value string
+}
+
+// LoadTokens reads a token file: one token per line, either TOKEN or
+// USER:TOKEN; blank lines and lines starting with # are ignored. The file
+// must not be accessible by group or others.
+func LoadTokens(path string) ([]Token, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open token file: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat token file: %w", err)
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		return nil, fmt.Errorf("token file %s is accessible by other users (mode %04o); chmod 600 it", path, info.Mode().Perm())
+	}
+
+	var tokens []Token
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		token := Token{User: StaticTokenUser, Value: line}
+		if user, value, ok := strings.Cut(line, ":"); ok {
+			token = Token{User: strings.TrimSpace(user), Value: strings.TrimSpace(value)}
+		}
+		if token.User == "" || token.Value == "" {
+			return nil, fmt.Errorf("%s:%d: expected TOKEN or USER:TOKEN", path, lineNo)
+		}
+		tokens = append(tokens, token)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read token file: %w", err)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("token file %s has no tokens", path)
+	}
+	return tokens, nil
+}
+
+type userKey struct{}
+
+// UserFromContext returns the user a request was authenticated as: the
+// token's user or the client certificate's common name. It is empty for
+// Unix socket clients and when authentication is disabled.
+func UserFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
+
+// authRequired reports whether requests must authenticate.
+func (s *Server) authRequired() bool {
+	return len(s.config.Tokens) > 0 || s.config.ClientCertAuth
+}
+
+// authenticated wraps a handler so that, when authentication is enabled,
+// TCP clients must present a token or a verified client certificate.
+// Unix socket clients are trusted: the socket's permissions restrict them.
+func (s *Server) authenticated(h http.HandlerFunc) http.HandlerFunc {
+	if !s.authRequired() {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if overUnixSocket(r) {
+			h(w, r)
+			return
+		}
+		user, ok := s.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="go-portalloc"`)
+			writeJSON(w, http.StatusUnauthorized, &client.ErrorResponse{Error: "authentication required", Code: client.CodeUnauthenticated})
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	}
+}
+
+// authenticate checks the bearer token, then the client certificate.
+func (s *Server) authenticate(r *http.Request) (string, bool) {
+	if value, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && value != "" {
+		// Compare against every token so timing reveals nothing
+		user := ""
+		for _, token := range s.config.Tokens {
+			if subtle.ConstantTimeCompare([]byte(value), []byte(token.Value)) == 1 && user == "" {
+				user = token.User
+			}
+		}
+		return user, user != ""
+	}
+	if s.config.ClientCertAuth && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName, true
+	}
+	return "", false
+}
+
+// overUnixSocket reports whether r arrived on a Unix socket listener.
+func overUnixSocket(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
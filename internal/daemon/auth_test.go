@@ -0,0 +1,159 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/client"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadTokens(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("static and per-user tokens", func(t *testing.T) {
+		path := filepath.Join(dir, "tokens")
+		require.NoError(t, os.WriteFile(path, []byte("# CI tokens\ns3cret\n\nalice: a-token\n"), 0o600))
+
+		tokens, err := LoadTokens(path)
+		require.NoError(t, err)
+		assert.Equal(t, []Token{{User: StaticTokenUser, Value: "s3cret"}, {User: "alice", Value: "a-token"}}, tokens)
+	})
+
+	t.Run("refuses readable file", func(t *testing.T) {
+		path := filepath.Join(dir, "readable")
+		require.NoError(t, os.WriteFile(path, []byte("s3cret\n"), 0o644))
+
+		_, err := LoadTokens(path)
+		assert.ErrorContains(t, err, "accessible by other users")
+	})
+
+	t.Run("refuses empty token", func(t *testing.T) {
+		path := filepath.Join(dir, "empty")
+		require.NoError(t, os.WriteFile(path, []byte("bob:\n"), 0o600))
+
+		_, err := LoadTokens(path)
+		assert.ErrorContains(t, err, "empty:1")
+	})
+}
+
+func TestServer_TokenAuth(t *testing.T) {
+	stateMgr := state.NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+	server := New(stateMgr, Config{Tokens: []Token{{User: "alice", Value: "a-token"}}})
+	ctx := context.Background()
+
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	_, err := client.New(ts.URL, client.WithRetries(0, 0)).List(ctx)
+	var apiErr *client.APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusUnauthorized, apiErr.StatusCode)
+	assert.Equal(t, client.CodeUnauthenticated, apiErr.Code)
+
+	_, err = client.New(ts.URL, client.WithRetries(0, 0), client.WithToken("wrong")).List(ctx)
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusUnauthorized, apiErr.StatusCode)
+
+	_, err = client.New(ts.URL, client.WithToken("a-token")).List(ctx)
+	assert.NoError(t, err)
+
+	resp, err := http.Get(ts.URL + "/metrics")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	t.Run("unix socket clients are trusted", func(t *testing.T) {
+		path := filepath.Join(shortTempDir(t), "d.sock")
+		listener, err := ListenUnix(path, DefaultSocketMode, "")
+		require.NoError(t, err)
+		httpServer := &http.Server{Handler: server.Handler()}
+		go func() { _ = httpServer.Serve(listener) }()
+		defer httpServer.Close()
+
+		_, err = client.New("http://unix", client.WithUnixSocket(path)).List(ctx)
+		assert.NoError(t, err)
+	})
+}
+
+func TestServer_ClientCertAuth(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	clientDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "ci-runner"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, &clientKey.PublicKey, caKey)
+	require.NoError(t, err)
+
+	stateMgr := state.NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+	var user string
+	handler := New(stateMgr, Config{ClientCertAuth: true}).authenticated(func(w http.ResponseWriter, r *http.Request) {
+		user = UserFromContext(r.Context())
+	})
+	ts := httptest.NewUnstartedServer(handler)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	ts.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	ts.StartTLS()
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	transport := ts.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{{Certificate: [][]byte{clientDER}, PrivateKey: clientKey}}
+	resp, err = (&http.Client{Transport: transport}).Get(ts.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "ci-runner", user)
+}
@@ -0,0 +1,261 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package daemon implements the long-running 'serve' mode: it periodically
+// reconciles the state file, optionally garbage-collects stale environments,
+// and exposes metrics and a REST API over HTTP.
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/client"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+)
+
+// Config configures a Server.
+type Config struct {
+	// LockDir is the lock directory reconciled on every tick.
+	LockDir string
+	// Interval is the time between ticks.
+	Interval time.Duration
+	// RangeStart and RangeSize are the allocation range: utilization is
+	// reported against it, and leases are drawn from it.
+	RangeStart int
+	RangeSize  int
+	// Cleanup removes a stale environment. When nil, stale environments
+	// are only reported.
+	Cleanup func(*state.EnvironmentState) error
+	// SelectCleanup chooses the environments Cleanup removes on each tick
+	// (default: every stale environment).
+	SelectCleanup func([]*state.EnvironmentState) []*state.EnvironmentState
+	// OnEvents is called with the lifecycle events observed on each tick.
+	OnEvents func([]state.Event)
+
+	// Create, Remove, and AllocatePorts back the REST API under /v1 (see
+	// pkg/client). Endpoints whose function is nil respond 501.
+	Create        func(ctx context.Context, req *client.CreateRequest) (*state.EnvironmentState, error)
+	Remove        func(ctx context.Context, env *state.EnvironmentState) error
+	AllocatePorts func(count int) (int, error)
+
+	// Leases enables POST and DELETE /v1/leases, which allocate ports from
+	// the range and record them, in LeaseFile if set, until released or
+	// not renewed for their TTL (LeaseTTL unless the request sets one;
+	// default DefaultLeaseTTL). PortFree checks that a port can be bound
+	// (default: PortFree).
+	Leases    bool
+	LeaseFile string
+	LeaseTTL  time.Duration
+	PortFree  func(port int, protocol string) bool
+
+	// RateLimit is the number of /v1 requests per second each client (by
+	// IP address) may make after a burst of RateBurst (default: RateLimit
+	// rounded up). Requests over the limit get a 429. 0 disables the limit.
+	RateLimit float64
+	RateBurst int
+	// MaxConcurrentCreates bounds the environment creations in progress;
+	// further create requests get a 429. 0 means no limit.
+	MaxConcurrentCreates int
+
+	// Tokens are the bearer tokens accepted from TCP clients, and with
+	// ClientCertAuth, verified TLS client certificates are accepted too.
+	// If either is set, TCP clients must authenticate; Unix socket
+	// clients never do.
+	Tokens         []Token
+	ClientCertAuth bool
+}
+
+// Server runs the daemon loop and serves its HTTP endpoints.
+type Server struct {
+	config  Config
+	state   *state.Manager
+	metrics *Metrics
+
+	limiter *rateLimiter
+	creates chan struct{}
+	leases  *leaseBook
+
+	draining atomic.Bool
+	health   health
+
+	mu       sync.Mutex
+	snapshot *state.Snapshot
+}
+
+// New creates a daemon server backed by the given state manager.
+func New(stateMgr *state.Manager, config Config) *Server {
+	s := &Server{
+		config:  config,
+		state:   stateMgr,
+		metrics: NewMetrics(config.RangeSize),
+		leases:  &leaseBook{path: config.LeaseFile},
+	}
+	if config.RateLimit > 0 {
+		s.limiter = newRateLimiter(config.RateLimit, config.RateBurst)
+	}
+	if config.MaxConcurrentCreates > 0 {
+		s.creates = make(chan struct{}, config.MaxConcurrentCreates)
+	}
+	return s
+}
+
+// Metrics returns the server's metrics.
+func (s *Server) Metrics() *Metrics {
+	return s.metrics
+}
+
+// Handler returns the HTTP handler serving the daemon's endpoints.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	// Probes are neither authenticated nor rate limited
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+	mux.HandleFunc("GET /metrics", s.authenticated(s.handleMetrics))
+	mux.HandleFunc("GET /v1/environments", s.authenticated(s.limited(s.handleList)))
+	mux.HandleFunc("POST /v1/environments", s.authenticated(s.limited(s.handleCreate)))
+	mux.HandleFunc("GET /v1/environments/{id}", s.authenticated(s.limited(s.handleGet)))
+	mux.HandleFunc("DELETE /v1/environments/{id}", s.authenticated(s.limited(s.handleDelete)))
+	mux.HandleFunc("POST /v1/ports", s.authenticated(s.limited(s.handleAllocatePorts)))
+	mux.HandleFunc("GET /v1/leases", s.authenticated(s.limited(s.handleListLeases)))
+	mux.HandleFunc("POST /v1/leases", s.authenticated(s.limited(s.handleCreateLease)))
+	mux.HandleFunc("DELETE /v1/leases/{id}", s.authenticated(s.limited(s.handleReleaseLease)))
+	mux.HandleFunc("POST /v1/leases/{id}/renew", s.authenticated(s.limited(s.handleRenewLease)))
+	return mux
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = s.metrics.Write(w)
+}
+
+// Run ticks until ctx is done. Tick errors are passed to onError, if set.
+func (s *Server) Run(ctx context.Context, onError func(error)) error {
+	if s.config.Interval <= 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Tick(); err != nil && onError != nil {
+			onError(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Tick reconciles the state file, cleans up stale environments if
+// configured, and updates the metrics. Failures to reconcile or list make
+// /readyz report the daemon as not ready; cleanup failures do not.
+func (s *Server) Tick() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.state.Reconcile(s.config.LockDir); err != nil {
+		err = fmt.Errorf("failed to reconcile state: %w", err)
+		s.health.record(err, time.Now())
+		return err
+	}
+	s.metrics.AddOperations(OpReconcile, 1)
+
+	envs, err := s.state.ListEnvironments()
+	if err != nil {
+		err = fmt.Errorf("failed to list environments: %w", err)
+		s.health.record(err, time.Now())
+		return err
+	}
+	s.health.record(nil, time.Now())
+	if s.snapshot == nil {
+		s.snapshot = state.NewSnapshot(envs)
+	}
+	events := s.observe(envs)
+
+	var cleanupErr error
+	if s.config.Cleanup != nil {
+		cleaned := 0
+		for _, env := range s.cleanupCandidates(envs) {
+			if err := s.config.Cleanup(env); err != nil {
+				if cleanupErr == nil {
+					cleanupErr = fmt.Errorf("failed to cleanup %s: %w", env.ID, err)
+				}
+				continue
+			}
+			cleaned++
+		}
+		s.metrics.AddOperations(OpCleanup, cleaned)
+		if cleaned > 0 {
+			if envs, err = s.state.ListEnvironments(); err != nil {
+				return fmt.Errorf("failed to list environments: %w", err)
+			}
+			events = append(events, s.observe(envs)...)
+		}
+	}
+
+	for _, event := range events {
+		if event.Type == state.EventStale {
+			s.metrics.AddStaleDetections(1)
+		}
+	}
+	if len(events) > 0 && s.config.OnEvents != nil {
+		s.config.OnEvents(events)
+	}
+
+	active, stale, allocated := 0, 0, 0
+	for _, env := range envs {
+		if state.GetEnvironmentStatus(env) == state.StatusActive {
+			active++
+		} else {
+			stale++
+		}
+		if env.Ports != nil {
+			allocated += env.Ports.Count
+		}
+	}
+	s.metrics.SetEnvironments(active, stale, allocated)
+
+	return cleanupErr
+}
+
+// cleanupCandidates returns the environments to clean up this tick.
+func (s *Server) cleanupCandidates(envs []*state.EnvironmentState) []*state.EnvironmentState {
+	if s.config.SelectCleanup != nil {
+		return s.config.SelectCleanup(envs)
+	}
+	var stale []*state.EnvironmentState
+	for _, env := range envs {
+		if state.GetEnvironmentStatus(env) == state.StatusStale {
+			stale = append(stale, env)
+		}
+	}
+	return stale
+}
+
+// observe replaces the snapshot with envs and returns the events in between.
+func (s *Server) observe(envs []*state.EnvironmentState) []state.Event {
+	next := state.NewSnapshot(envs)
+	events := s.snapshot.Diff(next)
+	s.snapshot = next
+	return events
+}
@@ -0,0 +1,156 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// deadPID is a PID that is assumed not to be running.
+const deadPID = 999999
+
+// writeLock creates a lock file (and an env file with ports) for id.
+func writeLock(t *testing.T, lockDir, id string, pid, basePort int) {
+	t.Helper()
+
+	worktree := t.TempDir()
+	content := fmt.Sprintf("PID=%d\nTimestamp=%d\nWorktree=%s\n", pid, time.Now().Unix(), worktree)
+	require.NoError(t, os.WriteFile(filepath.Join(lockDir, "env-"+id+".lock"), []byte(content), 0o600))
+
+	envFile := fmt.Sprintf("PORT_BASE=%d\nPORT_COUNT=5\n", basePort)
+	require.NoError(t, os.WriteFile(filepath.Join(worktree, ".env.isolation"), []byte(envFile), 0o600))
+}
+
+func scrape(t *testing.T, server *Server) string {
+	t.Helper()
+
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/plain")
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestServer_Tick(t *testing.T) {
+	lockDir := t.TempDir()
+	stateMgr := state.NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+
+	writeLock(t, lockDir, "existing", os.Getpid(), 21000)
+
+	server := New(stateMgr, Config{LockDir: lockDir, Interval: time.Second, RangeSize: 100})
+
+	t.Run("first tick sets the baseline", func(t *testing.T) {
+		require.NoError(t, server.Tick())
+
+		body := scrape(t, server)
+		assert.Contains(t, body, `portalloc_environments{status="active"} 1`)
+		assert.Contains(t, body, `portalloc_environments{status="stale"} 0`)
+		assert.Contains(t, body, "portalloc_allocated_ports 5\n")
+		assert.Contains(t, body, "portalloc_port_range_utilization 0.05\n")
+		assert.Contains(t, body, `portalloc_operations_total{operation="create"} 0`)
+		assert.Contains(t, body, `portalloc_operations_total{operation="reconcile"} 1`)
+	})
+
+	t.Run("reports environments changed by other processes without counting them", func(t *testing.T) {
+		writeLock(t, lockDir, "new", os.Getpid(), 22000)
+		require.NoError(t, os.Remove(filepath.Join(lockDir, "env-existing.lock")))
+
+		var observed []state.Event
+		server.config.OnEvents = func(events []state.Event) { observed = append(observed, events...) }
+		defer func() { server.config.OnEvents = nil }()
+
+		require.NoError(t, server.Tick())
+
+		body := scrape(t, server)
+		assert.Contains(t, body, `portalloc_operations_total{operation="create"} 0`)
+		assert.Contains(t, body, `portalloc_operations_total{operation="cleanup"} 0`)
+		assert.Contains(t, body, `portalloc_operations_total{operation="reconcile"} 2`)
+		assert.Len(t, observed, 2)
+	})
+
+	t.Run("garbage-collects stale environments", func(t *testing.T) {
+		writeLock(t, lockDir, "stale", deadPID, 23000)
+
+		var cleaned []string
+		server.config.Cleanup = func(env *state.EnvironmentState) error {
+			cleaned = append(cleaned, env.ID)
+			if err := os.Remove(env.LockFile); err != nil {
+				return err
+			}
+			return stateMgr.RemoveEnvironment(env.ID)
+		}
+		defer func() { server.config.Cleanup = nil }()
+
+		require.NoError(t, server.Tick())
+		assert.Equal(t, []string{"stale"}, cleaned)
+
+		body := scrape(t, server)
+		assert.Contains(t, body, `portalloc_environments{status="active"} 1`)
+		assert.Contains(t, body, `portalloc_environments{status="stale"} 0`)
+		assert.Contains(t, body, `portalloc_operations_total{operation="create"} 0`)
+		assert.Contains(t, body, `portalloc_operations_total{operation="cleanup"} 1`)
+	})
+
+	t.Run("cleans only the environments selected by the policy", func(t *testing.T) {
+		writeLock(t, lockDir, "stale-keep", deadPID, 24000)
+		writeLock(t, lockDir, "stale-drop", deadPID, 25000)
+
+		var cleaned []string
+		server.config.Cleanup = func(env *state.EnvironmentState) error {
+			cleaned = append(cleaned, env.ID)
+			if err := os.Remove(env.LockFile); err != nil {
+				return err
+			}
+			return stateMgr.RemoveEnvironment(env.ID)
+		}
+		server.config.SelectCleanup = func(envs []*state.EnvironmentState) []*state.EnvironmentState {
+			var selected []*state.EnvironmentState
+			for _, env := range envs {
+				if env.ID == "stale-drop" {
+					selected = append(selected, env)
+				}
+			}
+			return selected
+		}
+		defer func() {
+			server.config.Cleanup = nil
+			server.config.SelectCleanup = nil
+		}()
+
+		require.NoError(t, server.Tick())
+		assert.Equal(t, []string{"stale-drop"}, cleaned)
+
+		body := scrape(t, server)
+		assert.Contains(t, body, `portalloc_environments{status="stale"} 1`)
+	})
+}
@@ -0,0 +1,88 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/client"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+)
+
+// errDraining is returned for creations after StopAccepting.
+var errDraining = errors.New("daemon is shutting down")
+
+// StopAccepting makes the API reject new environments and leases with a
+// 503 (code UNAVAILABLE) for the rest of the server's life. Listing and
+// removing environments keep working, so clients can still clean up.
+func (s *Server) StopAccepting() {
+	s.draining.Store(true)
+}
+
+// rejectDraining writes a 503 and returns true once StopAccepting was called.
+func (s *Server) rejectDraining(w http.ResponseWriter) bool {
+	if !s.draining.Load() {
+		return false
+	}
+	writeJSON(w, http.StatusServiceUnavailable, &client.ErrorResponse{Error: errDraining.Error(), Code: client.CodeUnavailable})
+	return true
+}
+
+// Drain ticks every interval until no environment is owned by a live
+// process other than the daemon itself, or until ctx is done, and returns
+// the environments still active. Environments the daemon owns (created
+// through the API) are not waited for: they go stale when it exits.
+func (s *Server) Drain(ctx context.Context, interval time.Duration, onError func(error)) []*state.EnvironmentState {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Tick(); err != nil && onError != nil {
+			onError(err)
+		}
+		active, err := s.activeElsewhere()
+		if err != nil && onError != nil {
+			onError(err)
+		}
+		if err == nil && len(active) == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return active
+		case <-ticker.C:
+		}
+	}
+}
+
+// activeElsewhere returns the active environments owned by other processes.
+func (s *Server) activeElsewhere() ([]*state.EnvironmentState, error) {
+	envs, err := s.state.ListEnvironments()
+	if err != nil {
+		return nil, err
+	}
+	var active []*state.EnvironmentState
+	for _, env := range envs {
+		if env.PID != os.Getpid() && state.GetEnvironmentStatus(env) == state.StatusActive {
+			active = append(active, env)
+		}
+	}
+	return active, nil
+}
@@ -0,0 +1,95 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/client"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_StopAccepting(t *testing.T) {
+	stateMgr := state.NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+	config := Config{
+		RangeStart: 30000,
+		RangeSize:  10,
+		Leases:     true,
+		PortFree:   func(int, string) bool { return true },
+		Create: func(ctx context.Context, req *client.CreateRequest) (*state.EnvironmentState, error) {
+			t.Fatal("create called while draining")
+			return nil, nil
+		},
+	}
+	server := New(stateMgr, config)
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	c := client.New(ts.URL, client.WithRetries(0, 0))
+	ctx := context.Background()
+	server.StopAccepting()
+
+	var apiErr *client.APIError
+	_, err := c.Create(ctx, &client.CreateRequest{Ports: 1})
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusServiceUnavailable, apiErr.StatusCode)
+	assert.Equal(t, client.CodeUnavailable, apiErr.Code)
+
+	_, err = c.Lease(ctx, &client.LeaseRequest{Count: 1})
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, client.CodeUnavailable, apiErr.Code)
+
+	// Reads keep working while draining
+	_, err = c.List(ctx)
+	assert.NoError(t, err)
+}
+
+func TestServer_Drain(t *testing.T) {
+	lockDir := t.TempDir()
+	stateMgr := state.NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+
+	// Owned by the daemon itself, so never waited for
+	writeLock(t, lockDir, "own", os.Getpid(), 21000)
+	// Owned by another live process
+	writeLock(t, lockDir, "other", os.Getppid(), 22000)
+
+	server := New(stateMgr, Config{LockDir: lockDir, Interval: time.Second})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	remaining := server.Drain(ctx, 10*time.Millisecond, nil)
+	require.Len(t, remaining, 1)
+	assert.Equal(t, "other", remaining[0].ID)
+
+	// The owner cleans up while the daemon waits
+	done := make(chan []*state.EnvironmentState)
+	go func() { done <- server.Drain(context.Background(), 10*time.Millisecond, nil) }()
+	require.NoError(t, os.Remove(filepath.Join(lockDir, "env-other.lock")))
+
+	select {
+	case remaining = <-done:
+		assert.Empty(t, remaining)
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain did not finish after the environment was cleaned up")
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// staleTicks is how many intervals may pass without a successful tick
+// before /readyz reports the daemon as not ready.
+const staleTicks = 3
+
+// health records the outcome of the last tick for /readyz.
+type health struct {
+	mu        sync.Mutex
+	lastOK    time.Time
+	lastError error
+}
+
+// record stores the outcome of a tick.
+func (h *health) record(err error, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastError = err
+	if err == nil {
+		h.lastOK = now
+	}
+}
+
+// notReady returns why the daemon is not ready, or "" if it is.
+func (h *health) notReady(interval time.Duration, now time.Time) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case h.lastError != nil:
+		return h.lastError.Error()
+	case h.lastOK.IsZero():
+		return "state not reconciled yet"
+	case interval > 0 && now.Sub(h.lastOK) > staleTicks*interval:
+		return fmt.Sprintf("no successful reconcile since %s", h.lastOK.UTC().Format(time.RFC3339))
+	}
+	return ""
+}
+
+// HealthStatus is the body of /healthz and /readyz.
+type HealthStatus struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// handleHealthz reports that the process is up and serving HTTP.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &HealthStatus{Status: "ok"})
+}
+
+// handleReadyz reports whether the last tick reconciled the state file
+// within the last few intervals and the daemon is not shutting down.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	reason := s.health.notReady(s.config.Interval, time.Now())
+	if reason == "" && s.draining.Load() {
+		reason = errDraining.Error()
+	}
+	if reason != "" {
+		writeJSON(w, http.StatusServiceUnavailable, &HealthStatus{Status: "unavailable", Reason: reason})
+		return
+	}
+	writeJSON(w, http.StatusOK, &HealthStatus{Status: "ok"})
+}
@@ -0,0 +1,88 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func probe(t *testing.T, server *Server, path string) (int, HealthStatus) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	var status HealthStatus
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	return rec.Code, status
+}
+
+func TestServer_Probes(t *testing.T) {
+	stateMgr := state.NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+	// Probes must not require the token TCP clients send
+	server := New(stateMgr, Config{LockDir: t.TempDir(), Interval: time.Minute, Tokens: []Token{{User: "ci", Value: "s3cret"}}})
+
+	code, _ := probe(t, server, "/healthz")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, status := probe(t, server, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code, "not ready before the first tick")
+	assert.Equal(t, "state not reconciled yet", status.Reason)
+
+	require.NoError(t, server.Tick())
+	code, status = probe(t, server, "/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", status.Status)
+
+	server.StopAccepting()
+	code, status = probe(t, server, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, errDraining.Error(), status.Reason)
+
+	code, _ = probe(t, server, "/healthz")
+	assert.Equal(t, http.StatusOK, code, "alive while draining")
+}
+
+func TestServer_ReadyzFailedTick(t *testing.T) {
+	// A state file under a regular file can never be written
+	blocker := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(blocker, nil, 0o644))
+	stateMgr := state.NewManagerAt(filepath.Join(blocker, "state.json"))
+	server := New(stateMgr, Config{LockDir: t.TempDir(), Interval: time.Minute})
+
+	require.Error(t, server.Tick())
+	code, status := probe(t, server, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, status.Reason, "failed to reconcile state")
+}
+
+func TestHealth_NotReady(t *testing.T) {
+	now := time.Now()
+	var h health
+	h.record(nil, now)
+	assert.Empty(t, h.notReady(time.Minute, now.Add(2*time.Minute)))
+	assert.Contains(t, h.notReady(time.Minute, now.Add(4*time.Minute)), "no successful reconcile since")
+
+	h.record(assert.AnError, now)
+	assert.Equal(t, assert.AnError.Error(), h.notReady(time.Minute, now))
+}
@@ -0,0 +1,479 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/client"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+)
+
+// LeaseFileName is the lease file serve keeps next to the state file.
+const LeaseFileName = "leases.json"
+
+const (
+	// DefaultLeaseTTL is how long a lease lives without renewal unless the
+	// request or Config.LeaseTTL says otherwise.
+	DefaultLeaseTTL = 10 * time.Minute
+	// MaxLeaseTTL bounds the TTL a client may ask for.
+	MaxLeaseTTL = 24 * time.Hour
+)
+
+var (
+	// errNoFreePorts means no window within a lease's constraints is free.
+	errNoFreePorts = errors.New("no free ports within the requested constraints")
+	// errNotLeaseOwner means a client tried to renew or release another
+	// client's lease.
+	errNotLeaseOwner = errors.New("lease is owned by another client")
+)
+
+// leaseBook holds the daemon's leases, persisted to path if set. Leases
+// that expired without renewal are dropped on every access.
+type leaseBook struct {
+	path string
+	// now defaults to time.Now.
+	now func() time.Time
+
+	mu     sync.Mutex
+	leases map[string]*client.Lease
+}
+
+// readLeases reads a lease file; a missing file holds no leases.
+func readLeases(path string) ([]*client.Lease, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read lease file: %w", err)
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var list []*client.Lease
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse lease file %s: %w", path, err)
+	}
+	return list, nil
+}
+
+// leaseExpired reports whether lease has expired at now. Leases written
+// before leases had a TTL expire DefaultLeaseTTL after their creation.
+func leaseExpired(lease *client.Lease, now time.Time) bool {
+	expires := lease.ExpiresAt
+	if expires.IsZero() {
+		expires = lease.CreatedAt.Add(DefaultLeaseTTL)
+	}
+	return !now.Before(expires)
+}
+
+// ReserveLeasedPorts returns reserved plus the ports of the unexpired leases
+// in the lease file at path, so allocations outside the daemon skip ports
+// that are leased but not yet bound. A missing file leases nothing.
+func ReserveLeasedPorts(reserved *ports.ReservedPorts, path string) (*ports.ReservedPorts, error) {
+	list, err := readLeases(path)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, lease := range list {
+		if leaseExpired(lease, now) || len(lease.Ports) == 0 {
+			continue
+		}
+		reserved = reserved.Add(lease.BasePort, lease.BasePort+len(lease.Ports)-1)
+	}
+	return reserved, nil
+}
+
+// load reads the lease file on first use and drops expired leases. Must
+// be called with mu held.
+func (b *leaseBook) load() error {
+	if b.leases == nil {
+		leases := make(map[string]*client.Lease)
+		if b.path != "" {
+			list, err := readLeases(b.path)
+			if err != nil {
+				return err
+			}
+			for _, lease := range list {
+				leases[lease.ID] = lease
+			}
+		}
+		b.leases = leases
+	}
+
+	now := b.clock()
+	expired := false
+	for id, lease := range b.leases {
+		if leaseExpired(lease, now) {
+			delete(b.leases, id)
+			expired = true
+		}
+	}
+	if expired {
+		return b.save()
+	}
+	return nil
+}
+
+func (b *leaseBook) clock() time.Time {
+	if b.now != nil {
+		return b.now()
+	}
+	return time.Now()
+}
+
+// save writes the lease file atomically. Must be called with mu held.
+func (b *leaseBook) save() error {
+	if b.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(b.sorted(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode leases: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(b.path), ".leases-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to write lease file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write lease file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write lease file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), b.path); err != nil {
+		return fmt.Errorf("failed to write lease file: %w", err)
+	}
+	return nil
+}
+
+// sorted returns the leases by base port. Must be called with mu held.
+func (b *leaseBook) sorted() []*client.Lease {
+	return slices.SortedFunc(maps.Values(b.leases), func(a, b *client.Lease) int {
+		return a.BasePort - b.BasePort
+	})
+}
+
+// List returns the leases by base port.
+func (b *leaseBook) List() ([]*client.Lease, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+	return b.sorted(), nil
+}
+
+// Grant allocates the first window of req.Count ports in [lo, hi] that
+// holds no taken port, leased port, or port free reports busy, and records
+// it for owner until it expires after ttl.
+func (b *leaseBook) Grant(req *client.LeaseRequest, lo, hi int, taken func(port int) bool, free func(port int, protocol string) bool, owner string, ttl time.Duration) (*client.Lease, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+
+	leased := make(map[int]bool)
+	for _, lease := range b.leases {
+		for _, port := range lease.Ports {
+			leased[port] = true
+		}
+	}
+
+	basePort := 0
+	for base := lo; base+req.Count-1 <= hi && basePort == 0; {
+		busy := 0
+		for port := base; port < base+req.Count; port++ {
+			if leased[port] || taken(port) || !free(port, req.Protocol) {
+				busy = port
+				break
+			}
+		}
+		if busy == 0 {
+			basePort = base
+		} else {
+			base = busy + 1
+		}
+	}
+	if basePort == 0 {
+		return nil, errNoFreePorts
+	}
+
+	id, err := newLeaseID()
+	if err != nil {
+		return nil, err
+	}
+	now := b.clock().UTC()
+	lease := &client.Lease{
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(ttl),
+		TTLSeconds: int(ttl / time.Second),
+		ID:         id,
+		Ports:      make([]int, req.Count),
+		BasePort:   basePort,
+		Protocol:   req.Protocol,
+		Labels:     req.Labels,
+		Owner:      owner,
+	}
+	for i := range lease.Ports {
+		lease.Ports[i] = basePort + i
+	}
+
+	b.leases[lease.ID] = lease
+	if err := b.save(); err != nil {
+		delete(b.leases, lease.ID)
+		return nil, err
+	}
+	return lease, nil
+}
+
+// Renew extends owner's lease with the given ID by its TTL from now. It
+// returns nil if no such lease exists.
+func (b *leaseBook) Renew(id, owner string) (*client.Lease, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+	lease, ok := b.leases[id]
+	if !ok {
+		return nil, nil
+	}
+	if lease.Owner != owner {
+		return nil, errNotLeaseOwner
+	}
+
+	previous := lease.ExpiresAt
+	lease.ExpiresAt = b.clock().UTC().Add(time.Duration(lease.TTLSeconds) * time.Second)
+	if err := b.save(); err != nil {
+		lease.ExpiresAt = previous
+		return nil, err
+	}
+	renewed := *lease
+	return &renewed, nil
+}
+
+// Release removes owner's lease with the given ID, reporting whether it
+// existed.
+func (b *leaseBook) Release(id, owner string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.load(); err != nil {
+		return false, err
+	}
+	lease, ok := b.leases[id]
+	if !ok {
+		return false, nil
+	}
+	if lease.Owner != owner {
+		return false, errNotLeaseOwner
+	}
+	delete(b.leases, id)
+	if err := b.save(); err != nil {
+		b.leases[id] = lease
+		return false, err
+	}
+	return true, nil
+}
+
+func newLeaseID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate lease ID: %w", err)
+	}
+	return "lease-" + hex.EncodeToString(buf), nil
+}
+
+// PortFree reports whether port can be bound on all interfaces for
+// protocol: client.ProtocolTCP, client.ProtocolUDP, or client.ProtocolBoth.
+func PortFree(port int, protocol string) bool {
+	addr := fmt.Sprintf(":%d", port)
+	if protocol != client.ProtocolUDP {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return false
+		}
+		_ = listener.Close()
+	}
+	if protocol != client.ProtocolTCP {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return false
+		}
+		_ = conn.Close()
+	}
+	return true
+}
+
+func (s *Server) handleListLeases(w http.ResponseWriter, r *http.Request) {
+	leases, err := s.leases.List()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, leases)
+}
+
+func (s *Server) handleCreateLease(w http.ResponseWriter, r *http.Request) {
+	if !s.config.Leases {
+		writeError(w, http.StatusNotImplemented, errors.New("leases are not enabled"))
+		return
+	}
+
+	if s.rejectDraining(w) {
+		return
+	}
+
+	var req client.LeaseRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if req.Protocol == "" {
+		req.Protocol = client.ProtocolTCP
+	}
+	if req.Protocol != client.ProtocolTCP && req.Protocol != client.ProtocolUDP && req.Protocol != client.ProtocolBoth {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid protocol %q: expected tcp, udp, or both", req.Protocol))
+		return
+	}
+	if req.Count <= 0 {
+		writeError(w, http.StatusBadRequest, errors.New("count must be positive"))
+		return
+	}
+	ttl := s.config.LeaseTTL
+	if ttl <= 0 {
+		ttl = DefaultLeaseTTL
+	}
+	if req.TTLSeconds != 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	if ttl < time.Second || ttl > MaxLeaseTTL {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("ttl_seconds must be between 1 and %d", int(MaxLeaseTTL/time.Second)))
+		return
+	}
+
+	// Clamp the constraints to the daemon's range
+	lo, hi := max(1, s.config.RangeStart), s.config.RangeStart+s.config.RangeSize-1
+	if req.MinPort > 0 {
+		lo = max(lo, req.MinPort)
+	}
+	if req.MaxPort > 0 {
+		hi = min(hi, req.MaxPort)
+	}
+	if hi-lo+1 < req.Count {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("constraints leave fewer than %d ports of the daemon's range %d-%d",
+			req.Count, s.config.RangeStart, s.config.RangeStart+s.config.RangeSize-1))
+		return
+	}
+
+	// Ports of recorded environments are never leased
+	envs, err := s.state.ListEnvironments()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	taken := func(port int) bool {
+		for _, env := range envs {
+			if env.Ports.Contains(port) {
+				return true
+			}
+		}
+		return false
+	}
+	free := s.config.PortFree
+	if free == nil {
+		free = PortFree
+	}
+
+	lease, err := s.leases.Grant(&req, lo, hi, taken, free, leaseOwner(r), ttl)
+	if errors.Is(err, errNoFreePorts) {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, lease)
+}
+
+func (s *Server) handleReleaseLease(w http.ResponseWriter, r *http.Request) {
+	if !s.config.Leases {
+		writeError(w, http.StatusNotImplemented, errors.New("leases are not enabled"))
+		return
+	}
+
+	found, err := s.leases.Release(r.PathValue("id"), leaseOwner(r))
+	if errors.Is(err, errNotLeaseOwner) {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Errorf("lease %s not found", r.PathValue("id")))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleRenewLease(w http.ResponseWriter, r *http.Request) {
+	if !s.config.Leases {
+		writeError(w, http.StatusNotImplemented, errors.New("leases are not enabled"))
+		return
+	}
+
+	lease, err := s.leases.Renew(r.PathValue("id"), leaseOwner(r))
+	if errors.Is(err, errNotLeaseOwner) {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if lease == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("lease %s not found", r.PathValue("id")))
+		return
+	}
+	writeJSON(w, http.StatusOK, lease)
+}
+
+// leaseOwner records who asked for a lease: the authenticated user, the
+// client's IP address, or "local" for Unix socket clients.
+func leaseOwner(r *http.Request) string {
+	if user := UserFromContext(r.Context()); user != "" {
+		return user
+	}
+	if key := clientKey(r); key != "unix" {
+		return key
+	}
+	return "local"
+}
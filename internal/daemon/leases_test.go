@@ -0,0 +1,205 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/client"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Leases(t *testing.T) {
+	dir := t.TempDir()
+	stateMgr := state.NewManagerAt(filepath.Join(dir, "state.json"))
+	require.NoError(t, stateMgr.RecordEnvironment(&isolation.Environment{
+		ID:    "env1",
+		Ports: &ports.PortRange{BasePort: 30000, Count: 3},
+	}))
+
+	config := Config{
+		RangeStart: 30000,
+		RangeSize:  20,
+		Leases:     true,
+		LeaseFile:  filepath.Join(dir, "leases.json"),
+		PortFree: func(port int, protocol string) bool {
+			// 30010 is bound by something outside the daemon
+			return port != 30010 || protocol == client.ProtocolUDP
+		},
+	}
+	ts := httptest.NewServer(New(stateMgr, config).Handler())
+	defer ts.Close()
+
+	c := client.New(ts.URL, client.WithRetries(0, 0))
+	ctx := context.Background()
+
+	first, err := c.Lease(ctx, &client.LeaseRequest{Count: 4, Labels: map[string]string{"job": "42"}})
+	require.NoError(t, err)
+	assert.Equal(t, []int{30003, 30004, 30005, 30006}, first.Ports, "skips the environment's ports")
+	assert.Equal(t, client.ProtocolTCP, first.Protocol)
+	assert.Equal(t, "127.0.0.1", first.Owner)
+	assert.Equal(t, map[string]string{"job": "42"}, first.Labels)
+	assert.Equal(t, int(DefaultLeaseTTL/time.Second), first.TTLSeconds)
+	assert.WithinDuration(t, first.CreatedAt.Add(DefaultLeaseTTL), first.ExpiresAt, time.Second)
+
+	second, err := c.Lease(ctx, &client.LeaseRequest{Count: 4})
+	require.NoError(t, err)
+	assert.Equal(t, 30011, second.BasePort, "skips leased and busy ports")
+
+	udp, err := c.Lease(ctx, &client.LeaseRequest{Count: 1, MinPort: 30010, Protocol: client.ProtocolUDP})
+	require.NoError(t, err)
+	assert.Equal(t, 30010, udp.BasePort)
+
+	_, err = c.Lease(ctx, &client.LeaseRequest{Count: 6})
+	var apiErr *client.APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusServiceUnavailable, apiErr.StatusCode)
+
+	for _, req := range []*client.LeaseRequest{
+		{Count: 0},
+		{Count: 1, Protocol: "sctp"},
+		{Count: 3, MinPort: 30018},
+		{Count: 1, MaxPort: 29999},
+		{Count: 1, TTLSeconds: -1},
+		{Count: 1, TTLSeconds: int(MaxLeaseTTL/time.Second) + 1},
+	} {
+		_, err = c.Lease(ctx, req)
+		require.ErrorAs(t, err, &apiErr, "%+v", req)
+		assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode, "%+v", req)
+	}
+
+	require.NoError(t, c.ReleaseLease(ctx, first.ID))
+	err = c.ReleaseLease(ctx, first.ID)
+	assert.True(t, client.IsNotFound(err))
+
+	// Leases survive a restart
+	restarted := httptest.NewServer(New(stateMgr, config).Handler())
+	defer restarted.Close()
+	leases, err := client.New(restarted.URL).Leases(ctx)
+	require.NoError(t, err)
+	require.Len(t, leases, 2)
+	assert.Equal(t, udp.ID, leases[0].ID)
+	assert.Equal(t, second.ID, leases[1].ID)
+
+	again, err := client.New(restarted.URL).Lease(ctx, &client.LeaseRequest{Count: 4, MaxPort: 30009})
+	require.NoError(t, err)
+	assert.Equal(t, 30003, again.BasePort, "released ports are leased again")
+}
+
+func TestServer_LeaseExpiry(t *testing.T) {
+	dir := t.TempDir()
+	stateMgr := state.NewManagerAt(filepath.Join(dir, "state.json"))
+	leaseFile := filepath.Join(dir, LeaseFileName)
+	server := New(stateMgr, Config{
+		RangeStart: 30000,
+		RangeSize:  10,
+		Leases:     true,
+		LeaseFile:  leaseFile,
+		LeaseTTL:   time.Minute,
+		PortFree:   func(int, string) bool { return true },
+	})
+	now := time.Now()
+	server.leases.now = func() time.Time { return now }
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	c := client.New(ts.URL, client.WithRetries(0, 0))
+	ctx := context.Background()
+
+	lease, err := c.Lease(ctx, &client.LeaseRequest{Count: 2})
+	require.NoError(t, err)
+	assert.Equal(t, 60, lease.TTLSeconds)
+
+	// Allocations outside the daemon skip the leased ports
+	reserved, err := ReserveLeasedPorts(nil, leaseFile)
+	require.NoError(t, err)
+	assert.True(t, reserved.Contains(30000))
+	assert.True(t, reserved.Contains(30001))
+	assert.False(t, reserved.Contains(30002))
+
+	now = now.Add(50 * time.Second)
+	renewed, err := c.RenewLease(ctx, lease.ID)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(time.Minute).UTC(), renewed.ExpiresAt)
+
+	now = now.Add(50 * time.Second)
+	leases, err := c.Leases(ctx)
+	require.NoError(t, err)
+	assert.Len(t, leases, 1, "renewed lease is still held")
+
+	now = now.Add(time.Minute)
+	leases, err = c.Leases(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, leases, "lease expired without renewal")
+
+	_, err = c.RenewLease(ctx, lease.ID)
+	assert.True(t, client.IsNotFound(err))
+}
+
+func TestServer_LeaseOwner(t *testing.T) {
+	dir := t.TempDir()
+	stateMgr := state.NewManagerAt(filepath.Join(dir, "state.json"))
+	ts := httptest.NewServer(New(stateMgr, Config{
+		RangeStart: 30000,
+		RangeSize:  10,
+		Leases:     true,
+		PortFree:   func(int, string) bool { return true },
+		Tokens:     []Token{{User: "alice", Value: "a-token"}, {User: "bob", Value: "b-token"}},
+	}).Handler())
+	defer ts.Close()
+
+	ctx := context.Background()
+	alice := client.New(ts.URL, client.WithRetries(0, 0), client.WithToken("a-token"))
+	bob := client.New(ts.URL, client.WithRetries(0, 0), client.WithToken("b-token"))
+
+	lease, err := alice.Lease(ctx, &client.LeaseRequest{Count: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "alice", lease.Owner)
+
+	var apiErr *client.APIError
+	err = bob.ReleaseLease(ctx, lease.ID)
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusForbidden, apiErr.StatusCode)
+	_, err = bob.RenewLease(ctx, lease.ID)
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusForbidden, apiErr.StatusCode)
+
+	require.NoError(t, alice.ReleaseLease(ctx, lease.ID))
+}
+
+func TestServer_LeasesDisabled(t *testing.T) {
+	stateMgr := state.NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+	ts := httptest.NewServer(New(stateMgr, Config{RangeStart: 30000, RangeSize: 10}).Handler())
+	defer ts.Close()
+
+	c := client.New(ts.URL, client.WithRetries(0, 0))
+	_, err := c.Lease(context.Background(), &client.LeaseRequest{Count: 1})
+	var apiErr *client.APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusNotImplemented, apiErr.StatusCode)
+
+	leases, err := c.Leases(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, leases)
+}
@@ -0,0 +1,132 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Operation names counted by portalloc_operations_total.
+const (
+	OpCreate    = "create"
+	OpCleanup   = "cleanup"
+	OpReconcile = "reconcile"
+)
+
+// Metrics holds the values exposed on /metrics in the Prometheus text format.
+type Metrics struct {
+	mu              sync.Mutex
+	operations      map[string]uint64
+	staleDetections uint64
+	rejected        map[string]uint64
+	active          int
+	stale           int
+	allocatedPorts  int
+	rangeSize       int
+}
+
+// NewMetrics returns metrics for an allocation range of rangeSize ports.
+func NewMetrics(rangeSize int) *Metrics {
+	return &Metrics{
+		operations: map[string]uint64{OpCreate: 0, OpCleanup: 0, OpReconcile: 0},
+		rejected:   map[string]uint64{RejectRateLimit: 0, RejectConcurrency: 0},
+		rangeSize:  rangeSize,
+	}
+}
+
+// AddOperations increments the counter for op by n.
+func (m *Metrics) AddOperations(op string, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.operations[op] += uint64(n)
+}
+
+// AddStaleDetections increments the stale detection counter by n.
+func (m *Metrics) AddStaleDetections(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.staleDetections += uint64(n)
+}
+
+// AddRejected increments the counter of API requests rejected for reason.
+func (m *Metrics) AddRejected(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rejected[reason]++
+}
+
+// SetEnvironments updates the environment and port gauges.
+func (m *Metrics) SetEnvironments(active, stale, allocatedPorts int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.active, m.stale, m.allocatedPorts = active, stale, allocatedPorts
+}
+
+// Write writes all metrics to w in the Prometheus text exposition format.
+func (m *Metrics) Write(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	utilization := 0.0
+	if m.rangeSize > 0 {
+		utilization = float64(m.allocatedPorts) / float64(m.rangeSize)
+	}
+
+	ops := make([]string, 0, len(m.operations))
+	for op := range m.operations {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	reasons := make([]string, 0, len(m.rejected))
+	for reason := range m.rejected {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	var b []byte
+	b = fmt.Appendf(b, "# HELP portalloc_environments Number of recorded environments by status.\n")
+	b = fmt.Appendf(b, "# TYPE portalloc_environments gauge\n")
+	b = fmt.Appendf(b, "portalloc_environments{status=\"active\"} %d\n", m.active)
+	b = fmt.Appendf(b, "portalloc_environments{status=\"stale\"} %d\n", m.stale)
+	b = fmt.Appendf(b, "# HELP portalloc_allocated_ports Number of ports held by recorded environments.\n")
+	b = fmt.Appendf(b, "# TYPE portalloc_allocated_ports gauge\n")
+	b = fmt.Appendf(b, "portalloc_allocated_ports %d\n", m.allocatedPorts)
+	b = fmt.Appendf(b, "# HELP portalloc_port_range_size Number of ports in the allocation range.\n")
+	b = fmt.Appendf(b, "# TYPE portalloc_port_range_size gauge\n")
+	b = fmt.Appendf(b, "portalloc_port_range_size %d\n", m.rangeSize)
+	b = fmt.Appendf(b, "# HELP portalloc_port_range_utilization Fraction of the allocation range held by environments.\n")
+	b = fmt.Appendf(b, "# TYPE portalloc_port_range_utilization gauge\n")
+	b = fmt.Appendf(b, "portalloc_port_range_utilization %g\n", utilization)
+	b = fmt.Appendf(b, "# HELP portalloc_operations_total Environment operations performed by the daemon.\n")
+	b = fmt.Appendf(b, "# TYPE portalloc_operations_total counter\n")
+	for _, op := range ops {
+		b = fmt.Appendf(b, "portalloc_operations_total{operation=%q} %d\n", op, m.operations[op])
+	}
+	b = fmt.Appendf(b, "# HELP portalloc_stale_detections_total Environments whose owning process was found dead.\n")
+	b = fmt.Appendf(b, "# TYPE portalloc_stale_detections_total counter\n")
+	b = fmt.Appendf(b, "portalloc_stale_detections_total %d\n", m.staleDetections)
+	b = fmt.Appendf(b, "# HELP portalloc_api_rejected_total API requests rejected with 429 by reason.\n")
+	b = fmt.Appendf(b, "# TYPE portalloc_api_rejected_total counter\n")
+	for _, reason := range reasons {
+		b = fmt.Appendf(b, "portalloc_api_rejected_total{reason=%q} %d\n", reason, m.rejected[reason])
+	}
+
+	_, err := w.Write(b)
+	return err
+}
@@ -0,0 +1,118 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// PIDFileName is the name of the daemon's PID file in the state directory.
+const PIDFileName = "serve.pid"
+
+// ErrAlreadyRunning is returned by AcquirePIDFile when another daemon holds
+// the PID file.
+var ErrAlreadyRunning = errors.New("daemon already running")
+
+// PIDInfo is the content of a PID file.
+type PIDInfo struct {
+	PID       int       `json:"pid"`
+	Address   string    `json:"address,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// AcquirePIDFile writes info to path and holds an exclusive lock on it until
+// release is called, which also removes the file. The lock, not the file's
+// existence, marks the daemon as running, so a file left behind by a crashed
+// daemon is taken over. If another daemon holds the lock, the error wraps
+// ErrAlreadyRunning and names its PID.
+func AcquirePIDFile(path string, info PIDInfo) (release func(), err error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create PID file directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PID file: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			if holder, readErr := readPIDFile(path); readErr == nil && holder.PID > 0 {
+				return nil, fmt.Errorf("%w (pid %d, %s)", ErrAlreadyRunning, holder.PID, path)
+			}
+			return nil, fmt.Errorf("%w (%s)", ErrAlreadyRunning, path)
+		}
+		return nil, fmt.Errorf("failed to lock PID file: %w", err)
+	}
+
+	data, err := json.Marshal(&info)
+	if err == nil {
+		if err = f.Truncate(0); err == nil {
+			_, err = f.WriteAt(append(data, '\n'), 0)
+		}
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("failed to write PID file: %w", err)
+	}
+
+	return func() {
+		// Remove before unlocking so a new daemon never loses its file
+		_ = os.Remove(path)
+		_ = f.Close()
+	}, nil
+}
+
+// RunningDaemon returns the PID file content of the daemon holding path, or
+// nil if none does.
+func RunningDaemon(path string) (*PIDInfo, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PID file: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == nil {
+		// Left behind by a daemon that did not exit cleanly
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		return nil, nil
+	}
+	if !errors.Is(err, syscall.EWOULDBLOCK) {
+		return nil, fmt.Errorf("failed to check PID file lock: %w", err)
+	}
+	return readPIDFile(path)
+}
+
+// readPIDFile decodes the PID file at path.
+func readPIDFile(path string) (*PIDInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PID file: %w", err)
+	}
+	var info PIDInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("failed to decode PID file: %w", err)
+	}
+	return &info, nil
+}
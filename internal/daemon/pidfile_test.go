@@ -0,0 +1,71 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPIDFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", PIDFileName)
+
+	info, err := RunningDaemon(path)
+	require.NoError(t, err)
+	assert.Nil(t, info, "no file means no daemon")
+
+	started := time.Now().UTC().Truncate(time.Second)
+	release, err := AcquirePIDFile(path, PIDInfo{PID: os.Getpid(), Address: "127.0.0.1:9465", StartedAt: started})
+	require.NoError(t, err)
+
+	info, err = RunningDaemon(path)
+	require.NoError(t, err)
+	require.NotNil(t, info)
+	assert.Equal(t, os.Getpid(), info.PID)
+	assert.Equal(t, "127.0.0.1:9465", info.Address)
+	assert.True(t, started.Equal(info.StartedAt))
+
+	_, err = AcquirePIDFile(path, PIDInfo{PID: 1})
+	require.ErrorIs(t, err, ErrAlreadyRunning)
+	assert.Contains(t, err.Error(), "pid ")
+
+	release()
+	assert.NoFileExists(t, path)
+	info, err = RunningDaemon(path)
+	require.NoError(t, err)
+	assert.Nil(t, info)
+}
+
+func TestPIDFile_LeftBehind(t *testing.T) {
+	path := filepath.Join(t.TempDir(), PIDFileName)
+	require.NoError(t, os.WriteFile(path, []byte(`{"pid":999999}`), 0o644))
+
+	info, err := RunningDaemon(path)
+	require.NoError(t, err)
+	assert.Nil(t, info, "an unlocked file is left over from a crash")
+
+	release, err := AcquirePIDFile(path, PIDInfo{PID: os.Getpid()})
+	require.NoError(t, err)
+	defer release()
+	info, err = RunningDaemon(path)
+	require.NoError(t, err)
+	require.NotNil(t, info)
+	assert.Equal(t, os.Getpid(), info.PID)
+}
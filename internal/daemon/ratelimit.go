@@ -0,0 +1,149 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/client"
+)
+
+// Reasons counted by portalloc_api_rejected_total.
+const (
+	RejectRateLimit   = "rate_limit"
+	RejectConcurrency = "concurrency"
+)
+
+// maxTrackedClients bounds the rate limiter's memory; beyond it, clients
+// whose buckets have refilled are forgotten.
+const maxTrackedClients = 4096
+
+// rateLimiter is a token bucket per client: each client may make burst
+// requests at once and rate requests per second after that.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = max(1, int(math.Ceil(rate)))
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), now: time.Now, buckets: make(map[string]*bucket)}
+}
+
+// allow takes a token for key, or reports how long until one is available.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxTrackedClients {
+			l.forgetIdle(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// forgetIdle drops the buckets that have refilled completely.
+func (l *rateLimiter) forgetIdle(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// clientKey identifies the client of r for rate limiting: its authenticated
+// user, its IP address, or "unix" for every client of a Unix socket, which
+// file permissions already restrict.
+func clientKey(r *http.Request) string {
+	if user := UserFromContext(r.Context()); user != "" {
+		return "user:" + user
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || host == "" || overUnixSocket(r) {
+		return "unix"
+	}
+	return host
+}
+
+// limited wraps an API handler with the per-client rate limit, if any.
+func (s *Server) limited(h http.HandlerFunc) http.HandlerFunc {
+	if s.limiter == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := s.limiter.allow(clientKey(r)); !ok {
+			s.metrics.AddRejected(RejectRateLimit)
+			writeExhausted(w, wait, "rate limit exceeded")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// acquireCreate takes a slot for an environment creation, or reports false
+// when MaxConcurrentCreates creations are already in progress.
+func (s *Server) acquireCreate() bool {
+	if s.creates == nil {
+		return true
+	}
+	select {
+	case s.creates <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseCreate returns a slot taken by acquireCreate.
+func (s *Server) releaseCreate() {
+	if s.creates != nil {
+		<-s.creates
+	}
+}
+
+// writeExhausted writes a 429 with code RESOURCE_EXHAUSTED, telling the
+// client when to retry.
+func writeExhausted(w http.ResponseWriter, retryAfter time.Duration, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(retryAfter.Seconds())))))
+	writeJSON(w, http.StatusTooManyRequests, &client.ErrorResponse{Error: msg, Code: client.CodeResourceExhausted})
+}
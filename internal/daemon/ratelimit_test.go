@@ -0,0 +1,136 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/client"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newRateLimiter(2, 3)
+	l.now = func() time.Time { return now }
+
+	for range 3 {
+		ok, _ := l.allow("a")
+		assert.True(t, ok)
+	}
+	ok, wait := l.allow("a")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	// Other clients have their own bucket
+	ok, _ = l.allow("b")
+	assert.True(t, ok)
+
+	now = now.Add(500 * time.Millisecond)
+	ok, _ = l.allow("a")
+	assert.True(t, ok)
+	ok, _ = l.allow("a")
+	assert.False(t, ok)
+}
+
+func TestServer_RateLimit(t *testing.T) {
+	stateMgr := state.NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+	server := New(stateMgr, Config{RateLimit: 1, RateBurst: 2})
+	handler := server.Handler()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	assert.Equal(t, http.StatusOK, get("/v1/environments").Code)
+	assert.Equal(t, http.StatusOK, get("/v1/environments").Code)
+
+	rec := get("/v1/environments")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+	var body client.ErrorResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, client.CodeResourceExhausted, body.Code)
+
+	// Metrics are not rate limited
+	rec = get("/metrics")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `portalloc_api_rejected_total{reason="rate_limit"} 1`)
+}
+
+func TestServer_MaxConcurrentCreates(t *testing.T) {
+	stateMgr := state.NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+	started := make(chan struct{})
+	release := make(chan struct{})
+	config := Config{
+		MaxConcurrentCreates: 1,
+		Create: func(ctx context.Context, req *client.CreateRequest) (*state.EnvironmentState, error) {
+			close(started)
+			<-release
+			return state.NewEnvironmentState(&isolation.Environment{
+				ID:    "slow",
+				Ports: &ports.PortRange{BasePort: 24000, Count: 1},
+			}), nil
+		},
+	}
+	server := New(stateMgr, config)
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	c := client.New(ts.URL, client.WithRetries(0, 0))
+	ctx := context.Background()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Create(ctx, &client.CreateRequest{Ports: 1})
+		done <- err
+	}()
+	<-started
+
+	_, err := c.Create(ctx, &client.CreateRequest{Ports: 1})
+	var apiErr *client.APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusTooManyRequests, apiErr.StatusCode)
+	assert.Equal(t, client.CodeResourceExhausted, apiErr.Code)
+	assert.Contains(t, apiErr.Message, "concurrent")
+
+	close(release)
+	require.NoError(t, <-done)
+
+	var b strings.Builder
+	require.NoError(t, server.metrics.Write(&b))
+	assert.Contains(t, b.String(), `portalloc_api_rejected_total{reason="concurrency"} 1`)
+	// The slot is free again once the first creation finishes
+	assert.Eventually(t, func() bool {
+		if !server.acquireCreate() {
+			return false
+		}
+		server.releaseCreate()
+		return true
+	}, time.Second, 10*time.Millisecond)
+}
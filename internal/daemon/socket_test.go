@@ -0,0 +1,85 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemon
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func shortTempDir(t *testing.T) string {
+	t.Helper()
+	// Socket paths are length-limited, so avoid the long t.TempDir path
+	dir, err := os.MkdirTemp("", "portalloc")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+func TestListenUnix(t *testing.T) {
+	t.Run("applies socket mode", func(t *testing.T) {
+		path := filepath.Join(shortTempDir(t), "d.sock")
+		listener, err := ListenUnix(path, 0o600, "")
+		require.NoError(t, err)
+		defer listener.Close()
+
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.NotZero(t, info.Mode()&os.ModeSocket)
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	})
+
+	t.Run("replaces stale socket", func(t *testing.T) {
+		path := filepath.Join(shortTempDir(t), "d.sock")
+		stale, err := net.Listen("unix", path)
+		require.NoError(t, err)
+		// Leave the socket file behind as a crashed daemon would
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		require.NoError(t, stale.Close())
+
+		listener, err := ListenUnix(path, DefaultSocketMode, "")
+		require.NoError(t, err)
+		defer listener.Close()
+	})
+
+	t.Run("refuses live socket", func(t *testing.T) {
+		path := filepath.Join(shortTempDir(t), "d.sock")
+		live, err := ListenUnix(path, DefaultSocketMode, "")
+		require.NoError(t, err)
+		defer live.Close()
+
+		_, err = ListenUnix(path, DefaultSocketMode, "")
+		assert.ErrorContains(t, err, "another daemon")
+	})
+
+	t.Run("refuses regular file", func(t *testing.T) {
+		path := filepath.Join(shortTempDir(t), "d.sock")
+		require.NoError(t, os.WriteFile(path, nil, 0o600))
+
+		_, err := ListenUnix(path, DefaultSocketMode, "")
+		assert.ErrorContains(t, err, "not a socket")
+	})
+
+	t.Run("unknown group", func(t *testing.T) {
+		path := filepath.Join(shortTempDir(t), "d.sock")
+		_, err := ListenUnix(path, DefaultSocketMode, "no-such-group-portalloc")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,122 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serve(t *testing.T, s *Server, lines ...string) []map[string]interface{} {
+	t.Helper()
+	var out bytes.Buffer
+	require.NoError(t, s.Serve(context.Background(), strings.NewReader(strings.Join(lines, "\n")+"\n"), &out))
+
+	var responses []map[string]interface{}
+	decoder := json.NewDecoder(&out)
+	for decoder.More() {
+		var resp map[string]interface{}
+		require.NoError(t, decoder.Decode(&resp))
+		responses = append(responses, resp)
+	}
+	return responses
+}
+
+func newTestServer() *Server {
+	s := NewServer("test", "1.2.3")
+	s.AddTool(&Tool{
+		Name:        "echo",
+		Description: "Echo the arguments",
+		Handler: func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+			var v map[string]interface{}
+			err := json.Unmarshal(args, &v)
+			return v, err
+		},
+	})
+	s.AddTool(&Tool{
+		Name: "fail",
+		Handler: func(ctx context.Context, args json.RawMessage) (interface{}, error) {
+			return nil, errors.New("no ports left")
+		},
+	})
+	return s
+}
+
+func TestServer_Lifecycle(t *testing.T) {
+	responses := serve(t, newTestServer(),
+		`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"protocolVersion":"2024-11-05","capabilities":{}}}`,
+		`{"jsonrpc":"2.0","method":"notifications/initialized"}`,
+		`{"jsonrpc":"2.0","id":"two","method":"tools/list"}`,
+		`{"jsonrpc":"2.0","id":3,"method":"ping"}`,
+	)
+	require.Len(t, responses, 3, "notifications get no response")
+
+	init := responses[0]["result"].(map[string]interface{})
+	assert.Equal(t, ProtocolVersion, init["protocolVersion"])
+	assert.Equal(t, map[string]interface{}{"name": "test", "version": "1.2.3"}, init["serverInfo"])
+	assert.Contains(t, init["capabilities"], "tools")
+
+	assert.Equal(t, "two", responses[1]["id"])
+	tools := responses[1]["result"].(map[string]interface{})["tools"].([]interface{})
+	require.Len(t, tools, 2)
+	echo := tools[0].(map[string]interface{})
+	assert.Equal(t, "echo", echo["name"])
+	assert.Equal(t, map[string]interface{}{"type": "object"}, echo["inputSchema"])
+
+	assert.Equal(t, float64(3), responses[2]["id"])
+}
+
+func TestServer_ToolsCall(t *testing.T) {
+	responses := serve(t, newTestServer(),
+		`{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"echo","arguments":{"a":1}}}`,
+		`{"jsonrpc":"2.0","id":2,"method":"tools/call","params":{"name":"fail"}}`,
+		`{"jsonrpc":"2.0","id":3,"method":"tools/call","params":{"name":"missing"}}`,
+	)
+	require.Len(t, responses, 3)
+
+	result := responses[0]["result"].(map[string]interface{})
+	assert.Equal(t, false, result["isError"])
+	content := result["content"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "text", content["type"])
+	assert.JSONEq(t, `{"a":1}`, content["text"].(string))
+
+	failed := responses[1]["result"].(map[string]interface{})
+	assert.Equal(t, true, failed["isError"])
+	assert.Equal(t, "no ports left", failed["content"].([]interface{})[0].(map[string]interface{})["text"])
+
+	rpcErr := responses[2]["error"].(map[string]interface{})
+	assert.Equal(t, float64(codeInvalidParams), rpcErr["code"])
+}
+
+func TestServer_Errors(t *testing.T) {
+	responses := serve(t, newTestServer(),
+		`not json`,
+		`{"jsonrpc":"1.0","id":1,"method":"ping"}`,
+		`{"jsonrpc":"2.0","id":2,"method":"resources/list"}`,
+	)
+	require.Len(t, responses, 3)
+
+	assert.Nil(t, responses[0]["id"])
+	assert.Equal(t, float64(codeParseError), responses[0]["error"].(map[string]interface{})["code"])
+	assert.Equal(t, float64(codeInvalidRequest), responses[1]["error"].(map[string]interface{})["code"])
+	assert.Equal(t, float64(codeMethodNotFound), responses[2]["error"].(map[string]interface{})["code"])
+}
@@ -0,0 +1,398 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package selfupdate finds, verifies, and installs go-portalloc releases
+// published on GitHub by GoReleaser.
+package selfupdate
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultAPIURL is the GitHub REST API base URL.
+	DefaultAPIURL = "https://api.github.com"
+	// DefaultRepository is the repository releases are published to.
+	DefaultRepository = "pigeonworks-llc/go-portalloc"
+	// ChecksumsFile is the release asset listing SHA-256 sums of all archives.
+	ChecksumsFile = "checksums.txt"
+	// SignatureFile is the minisign signature of ChecksumsFile.
+	SignatureFile = ChecksumsFile + ".minisig"
+
+	binaryName = "go-portalloc"
+	// maxAssetSize bounds downloads so a bad response cannot exhaust memory.
+	maxAssetSize = 256 << 20
+)
+
+// Release is a GitHub release.
+type Release struct {
+	TagName string  `json:"tag_name"`
+	HTMLURL string  `json:"html_url"`
+	Assets  []Asset `json:"assets"`
+}
+
+// Asset is a file attached to a release.
+type Asset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+// Asset returns the asset with the given name.
+func (r *Release) Asset(name string) (*Asset, bool) {
+	for i := range r.Assets {
+		if r.Assets[i].Name == name {
+			return &r.Assets[i], true
+		}
+	}
+	return nil, false
+}
+
+// Client talks to the GitHub releases API.
+type Client struct {
+	HTTPClient *http.Client
+	APIURL     string
+	Repository string
+	// Token is sent as a bearer token when set (e.g. GITHUB_TOKEN), raising
+	// the API rate limit. It is only sent to the GitHub API host, never to
+	// asset download hosts or API mirrors.
+	Token string
+	// PublicKey is the minisign key checksums.txt must be signed with.
+	PublicKey string
+}
+
+// NewClient returns a client for the official releases.
+func NewClient() *Client {
+	return &Client{
+		HTTPClient: http.DefaultClient,
+		APIURL:     DefaultAPIURL,
+		Repository: DefaultRepository,
+		Token:      os.Getenv("GITHUB_TOKEN"),
+		PublicKey:  ReleasePublicKey,
+	}
+}
+
+// LatestRelease returns the latest published (non-draft, non-prerelease) release.
+func (c *Client) LatestRelease(ctx context.Context) (*Release, error) {
+	url := fmt.Sprintf("%s/repos/%s/releases/latest", strings.TrimSuffix(c.APIURL, "/"), c.Repository)
+	data, err := c.get(ctx, url, "application/vnd.github+json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch latest release: %w", err)
+	}
+
+	var release Release
+	if err := json.Unmarshal(data, &release); err != nil {
+		return nil, fmt.Errorf("failed to parse release: %w", err)
+	}
+	if release.TagName == "" {
+		return nil, fmt.Errorf("release has no tag")
+	}
+	return &release, nil
+}
+
+// DownloadBinary downloads the archive for the given platform, verifies the
+// release's checksums file against its minisign signature and the archive
+// against the checksums file, and returns the extracted binary.
+func (c *Client) DownloadBinary(ctx context.Context, release *Release, goos, goarch string) ([]byte, error) {
+	if c.PublicKey == "" {
+		return nil, fmt.Errorf("this build has no release signing key; refusing to install unverified binary")
+	}
+	publicKey, err := ParsePublicKey(c.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	name := AssetName(goos, goarch)
+	asset, ok := release.Asset(name)
+	if !ok {
+		return nil, fmt.Errorf("release %s has no asset %s", release.TagName, name)
+	}
+	checksums, ok := release.Asset(ChecksumsFile)
+	if !ok {
+		return nil, fmt.Errorf("release %s has no %s; refusing to install unverified binary", release.TagName, ChecksumsFile)
+	}
+	signature, ok := release.Asset(SignatureFile)
+	if !ok {
+		return nil, fmt.Errorf("release %s has no %s; refusing to install unverified binary", release.TagName, SignatureFile)
+	}
+
+	sums, err := c.get(ctx, checksums.URL, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", ChecksumsFile, err)
+	}
+	sig, err := c.get(ctx, signature.URL, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", SignatureFile, err)
+	}
+	if err := publicKey.Verify(sums, sig); err != nil {
+		return nil, fmt.Errorf("%s: %w", ChecksumsFile, err)
+	}
+
+	want, err := lookupChecksum(sums, name)
+	if err != nil {
+		return nil, err
+	}
+
+	archive, err := c.get(ctx, asset.URL, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", name, err)
+	}
+	sum := sha256.Sum256(archive)
+	if got := hex.EncodeToString(sum[:]); got != want {
+		return nil, fmt.Errorf("checksum mismatch for %s: got %s, want %s", name, got, want)
+	}
+
+	return extractBinary(archive, goos)
+}
+
+func (c *Client) get(ctx context.Context, url, accept string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if c.Token != "" && req.URL.Host == githubAPIHost {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxAssetSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxAssetSize {
+		return nil, fmt.Errorf("response from %s exceeds %d bytes", url, maxAssetSize)
+	}
+	return data, nil
+}
+
+// githubAPIHost is the only host the token is sent to.
+var githubAPIHost = mustHost(DefaultAPIURL)
+
+func mustHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		panic(err)
+	}
+	return u.Host
+}
+
+// httpClient returns HTTPClient with a redirect policy that drops the
+// token whenever a redirect leaves the GitHub API host.
+func (c *Client) httpClient() *http.Client {
+	client := http.DefaultClient
+	if c.HTTPClient != nil {
+		client = c.HTTPClient
+	}
+	wrapped := *client
+	next := client.CheckRedirect
+	wrapped.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if req.URL.Host != githubAPIHost {
+			req.Header.Del("Authorization")
+		}
+		if next != nil {
+			return next(req, via)
+		}
+		if len(via) >= 10 {
+			return fmt.Errorf("stopped after 10 redirects")
+		}
+		return nil
+	}
+	return &wrapped
+}
+
+// AssetName returns the archive name GoReleaser publishes for a platform,
+// e.g. go-portalloc_Linux_x86_64.tar.gz.
+func AssetName(goos, goarch string) string {
+	arch := goarch
+	switch goarch {
+	case "amd64":
+		arch = "x86_64"
+	case "386":
+		arch = "i386"
+	}
+
+	ext := ".tar.gz"
+	if goos == "windows" {
+		ext = ".zip"
+	}
+
+	osName := goos
+	if osName != "" {
+		osName = strings.ToUpper(osName[:1]) + osName[1:]
+	}
+
+	return fmt.Sprintf("%s_%s_%s%s", binaryName, osName, arch, ext)
+}
+
+// lookupChecksum finds name in a sha256sum-style checksums file.
+func lookupChecksum(data []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("%s does not list %s", ChecksumsFile, name)
+}
+
+// extractBinary returns the go-portalloc executable from a release archive.
+func extractBinary(archive []byte, goos string) ([]byte, error) {
+	want := binaryName
+	if goos == "windows" {
+		want += ".exe"
+		zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open archive: %w", err)
+		}
+		for _, f := range zr.File {
+			if path.Base(f.Name) != want {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", want, err)
+			}
+			defer rc.Close()
+			return io.ReadAll(io.LimitReader(rc, maxAssetSize))
+		}
+		return nil, fmt.Errorf("archive does not contain %s", want)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("archive does not contain %s", want)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+		if hdr.Typeflag == tar.TypeReg && path.Base(hdr.Name) == want {
+			return io.ReadAll(io.LimitReader(tr, maxAssetSize))
+		}
+	}
+}
+
+// ReplaceExecutable atomically replaces the file at path with binary,
+// keeping its permissions. The new file is written next to path and renamed
+// over it, so a failed update leaves the old binary in place.
+func ReplaceExecutable(path string, binary []byte) error {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve executable: %w", err)
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return fmt.Errorf("failed to stat executable: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(resolved), "."+filepath.Base(resolved)+".new-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(binary); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write new binary: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write new binary: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to set permissions: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), resolved); err != nil {
+		return fmt.Errorf("failed to replace executable: %w", err)
+	}
+	return nil
+}
+
+// IsNewer reports whether version latest is newer than current. Versions
+// are compared as vMAJOR.MINOR.PATCH; a current version that does not parse
+// (such as "dev") is considered older than any release.
+func IsNewer(latest, current string) bool {
+	l, ok := parseVersion(latest)
+	if !ok {
+		return false
+	}
+	c, ok := parseVersion(current)
+	if !ok {
+		return true
+	}
+	for i := range l {
+		if l[i] != c[i] {
+			return l[i] > c[i]
+		}
+	}
+	return false
+}
+
+// parseVersion parses "v1.2.3" or "1.2.3", ignoring pre-release and build
+// suffixes.
+func parseVersion(v string) ([3]int, bool) {
+	var parsed [3]int
+
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return parsed, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return parsed, false
+		}
+		parsed[i] = n
+	}
+	return parsed, true
+}
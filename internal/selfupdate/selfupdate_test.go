@@ -0,0 +1,282 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package selfupdate
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+)
+
+func tarGz(t *testing.T, name string, content []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0o755, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+	_, err := tw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+	return buf.Bytes()
+}
+
+// testKey is a minisign key pair for signing fake releases.
+type testKey struct {
+	keyID [keyIDLen]byte
+	priv  ed25519.PrivateKey
+}
+
+func newTestKey(t *testing.T) *testKey {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	k := &testKey{priv: priv}
+	_, err = rand.Read(k.keyID[:])
+	require.NoError(t, err)
+	return k
+}
+
+// PublicKey returns the key in minisign .pub format.
+func (k *testKey) PublicKey() string {
+	raw := append([]byte(sigAlgPure), k.keyID[:]...)
+	raw = append(raw, k.priv.Public().(ed25519.PublicKey)...)
+	return "untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(raw) + "\n"
+}
+
+// Sign returns a minisign signature file over message using alg.
+func (k *testKey) Sign(message []byte, alg string) []byte {
+	signed := message
+	if alg == sigAlgPrehash {
+		sum := blake2b.Sum512(message)
+		signed = sum[:]
+	}
+	sig := ed25519.Sign(k.priv, signed)
+	comment := "timestamp:1700000000\tfile:checksums.txt"
+	global := ed25519.Sign(k.priv, append(append([]byte{}, sig...), comment...))
+
+	raw := append([]byte(alg), k.keyID[:]...)
+	raw = append(raw, sig...)
+	return []byte(strings.Join([]string{
+		"untrusted comment: signature from minisign secret key",
+		base64.StdEncoding.EncodeToString(raw),
+		trustedComment + comment,
+		base64.StdEncoding.EncodeToString(global),
+	}, "\n") + "\n")
+}
+
+// releaseServer serves a fake releases API with one linux/amd64 archive and
+// a checksums file signed by key.
+func releaseServer(t *testing.T, archive []byte, checksum string, key *testKey) *httptest.Server {
+	t.Helper()
+
+	asset := AssetName("linux", "amd64")
+	sums := []byte(fmt.Sprintf("%s  %s\n%s  other.tar.gz\n", checksum, asset, checksum))
+	mux := http.NewServeMux()
+	var server *httptest.Server
+	mux.HandleFunc("/repos/"+DefaultRepository+"/releases/latest", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(Release{
+			TagName: "v1.2.0",
+			Assets: []Asset{
+				{Name: asset, URL: server.URL + "/download/" + asset},
+				{Name: ChecksumsFile, URL: server.URL + "/download/" + ChecksumsFile},
+				{Name: SignatureFile, URL: server.URL + "/download/" + SignatureFile},
+			},
+		})
+	})
+	mux.HandleFunc("/download/"+asset, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(archive)
+	})
+	mux.HandleFunc("/download/"+ChecksumsFile, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(sums)
+	})
+	mux.HandleFunc("/download/"+SignatureFile, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(key.Sign(sums, sigAlgPrehash))
+	})
+	server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestAssetName(t *testing.T) {
+	assert.Equal(t, "go-portalloc_Linux_x86_64.tar.gz", AssetName("linux", "amd64"))
+	assert.Equal(t, "go-portalloc_Darwin_arm64.tar.gz", AssetName("darwin", "arm64"))
+	assert.Equal(t, "go-portalloc_Windows_x86_64.zip", AssetName("windows", "amd64"))
+}
+
+func TestIsNewer(t *testing.T) {
+	assert.True(t, IsNewer("v1.2.0", "v1.1.9"))
+	assert.True(t, IsNewer("v2.0.0", "1.9.9"))
+	assert.True(t, IsNewer("v1.0.0", "dev"))
+	assert.False(t, IsNewer("v1.2.0", "v1.2.0"))
+	assert.False(t, IsNewer("v1.2.0", "v1.3.0-rc1"))
+	assert.False(t, IsNewer("nightly", "v1.0.0"))
+}
+
+func TestClient_DownloadBinary(t *testing.T) {
+	binary := []byte("#!/bin/sh\necho new\n")
+	archive := tarGz(t, "go-portalloc", binary)
+	sum := sha256.Sum256(archive)
+	key := newTestKey(t)
+
+	t.Run("verifies and extracts the binary", func(t *testing.T) {
+		server := releaseServer(t, archive, hex.EncodeToString(sum[:]), key)
+		client := &Client{HTTPClient: server.Client(), APIURL: server.URL, Repository: DefaultRepository, PublicKey: key.PublicKey()}
+
+		release, err := client.LatestRelease(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "v1.2.0", release.TagName)
+
+		got, err := client.DownloadBinary(context.Background(), release, "linux", "amd64")
+		require.NoError(t, err)
+		assert.Equal(t, binary, got)
+	})
+
+	t.Run("rejects checksum mismatch", func(t *testing.T) {
+		server := releaseServer(t, archive, hex.EncodeToString(make([]byte, sha256.Size)), key)
+		client := &Client{HTTPClient: server.Client(), APIURL: server.URL, Repository: DefaultRepository, PublicKey: key.PublicKey()}
+
+		release, err := client.LatestRelease(context.Background())
+		require.NoError(t, err)
+
+		_, err = client.DownloadBinary(context.Background(), release, "linux", "amd64")
+		assert.ErrorContains(t, err, "checksum mismatch")
+	})
+
+	t.Run("rejects checksums signed by another key", func(t *testing.T) {
+		server := releaseServer(t, archive, hex.EncodeToString(sum[:]), newTestKey(t))
+		client := &Client{HTTPClient: server.Client(), APIURL: server.URL, Repository: DefaultRepository, PublicKey: key.PublicKey()}
+
+		release, err := client.LatestRelease(context.Background())
+		require.NoError(t, err)
+
+		_, err = client.DownloadBinary(context.Background(), release, "linux", "amd64")
+		assert.ErrorContains(t, err, "different key")
+	})
+
+	t.Run("refuses without a public key", func(t *testing.T) {
+		server := releaseServer(t, archive, hex.EncodeToString(sum[:]), key)
+		client := &Client{HTTPClient: server.Client(), APIURL: server.URL, Repository: DefaultRepository}
+
+		release, err := client.LatestRelease(context.Background())
+		require.NoError(t, err)
+
+		_, err = client.DownloadBinary(context.Background(), release, "linux", "amd64")
+		assert.ErrorContains(t, err, "no release signing key")
+	})
+
+	t.Run("rejects missing platform asset", func(t *testing.T) {
+		server := releaseServer(t, archive, hex.EncodeToString(sum[:]), key)
+		client := &Client{HTTPClient: server.Client(), APIURL: server.URL, Repository: DefaultRepository, PublicKey: key.PublicKey()}
+
+		release, err := client.LatestRelease(context.Background())
+		require.NoError(t, err)
+
+		_, err = client.DownloadBinary(context.Background(), release, "plan9", "amd64")
+		assert.ErrorContains(t, err, "has no asset")
+	})
+}
+
+func TestPublicKey_Verify(t *testing.T) {
+	key := newTestKey(t)
+	pk, err := ParsePublicKey(key.PublicKey())
+	require.NoError(t, err)
+
+	message := []byte("abc  go-portalloc_Linux_x86_64.tar.gz\n")
+	for _, alg := range []string{sigAlgPure, sigAlgPrehash} {
+		assert.NoError(t, pk.Verify(message, key.Sign(message, alg)), alg)
+	}
+
+	assert.ErrorContains(t, pk.Verify([]byte("tampered"), key.Sign(message, sigAlgPrehash)), "verification failed")
+
+	sig := strings.Replace(string(key.Sign(message, sigAlgPrehash)), "file:checksums.txt", "file:other.txt", 1)
+	assert.ErrorContains(t, pk.Verify(message, []byte(sig)), "trusted comment")
+
+	_, err = ParsePublicKey("not a key")
+	assert.Error(t, err)
+}
+
+func TestClient_TokenOnlySentToAPIHost(t *testing.T) {
+	var apiAuth, assetAuth string
+	assets := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assetAuth = r.Header.Get("Authorization")
+	}))
+	t.Cleanup(assets.Close)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiAuth = r.Header.Get("Authorization")
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, assets.URL+"/asset", http.StatusFound)
+		}
+	}))
+	t.Cleanup(api.Close)
+
+	orig := githubAPIHost
+	githubAPIHost = mustHost(api.URL)
+	t.Cleanup(func() { githubAPIHost = orig })
+
+	client := &Client{HTTPClient: http.DefaultClient, Token: "secret"}
+
+	_, err := client.get(context.Background(), api.URL+"/redirect", "")
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer secret", apiAuth)
+	assert.Empty(t, assetAuth, "token must not follow a cross-host redirect")
+
+	_, err = client.get(context.Background(), assets.URL+"/asset", "")
+	require.NoError(t, err)
+	assert.Empty(t, assetAuth, "token must not be sent to other hosts")
+}
+
+func TestReplaceExecutable(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "go-portalloc")
+	require.NoError(t, os.WriteFile(path, []byte("old"), 0o755))
+
+	link := filepath.Join(dir, "link")
+	require.NoError(t, os.Symlink(path, link))
+
+	require.NoError(t, ReplaceExecutable(link, []byte("new")))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o755), info.Mode().Perm())
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2, "temp file should be removed")
+}
@@ -0,0 +1,312 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package snapshot uploads state snapshots to object storage and downloads
+// them for restore.
+//
+// Requests use the S3 API signed with AWS Signature Version 4, which covers
+// AWS S3, S3-compatible stores such as MinIO, and Google Cloud Storage
+// through its XML API with HMAC keys.
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+)
+
+const (
+	// LatestName is the object updated with every snapshot of a host.
+	LatestName = "latest.json"
+
+	gcsEndpoint   = "https://storage.googleapis.com"
+	defaultRegion = "us-east-1"
+	amzDateFormat = "20060102T150405Z"
+	// maxSnapshotSize bounds downloads so a bad object cannot exhaust memory.
+	maxSnapshotSize = 64 << 20
+)
+
+// Location is a parsed s3:// or gs:// URL.
+type Location struct {
+	Scheme string
+	Bucket string
+	// Key is an object key ending in .json, or a prefix.
+	Key string
+}
+
+// ParseLocation parses s3://bucket/prefix or gs://bucket/prefix.
+func ParseLocation(raw string) (*Location, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot URL %q: %w", raw, err)
+	}
+	if u.Scheme != "s3" && u.Scheme != "gs" {
+		return nil, fmt.Errorf("invalid snapshot URL %q: scheme must be s3 or gs", raw)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid snapshot URL %q: missing bucket", raw)
+	}
+	return &Location{Scheme: u.Scheme, Bucket: u.Host, Key: strings.Trim(u.Path, "/")}, nil
+}
+
+// String returns the location as a URL.
+func (l *Location) String() string {
+	return fmt.Sprintf("%s://%s/%s", l.Scheme, l.Bucket, l.Key)
+}
+
+// Client reads and writes objects with SigV4-signed S3 requests.
+type Client struct {
+	HTTPClient *http.Client
+	// Endpoint overrides the service URL and selects path-style requests
+	// (e.g. http://minio:9000). Empty means AWS S3.
+	Endpoint        string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	now func() time.Time
+}
+
+// NewClient returns a client for loc configured from the environment:
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN, AWS_REGION
+// (default us-east-1), and PORTALLOC_S3_ENDPOINT. For gs:// locations the
+// access key and secret are GCS HMAC keys.
+func NewClient(loc *Location) *Client {
+	c := &Client{
+		HTTPClient:      &http.Client{Timeout: 60 * time.Second},
+		Endpoint:        os.Getenv("PORTALLOC_S3_ENDPOINT"),
+		Region:          os.Getenv("AWS_REGION"),
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if c.Region == "" {
+		c.Region = defaultRegion
+	}
+	if loc.Scheme == "gs" && c.Endpoint == "" {
+		c.Endpoint = gcsEndpoint
+		c.Region = "auto"
+	}
+	return c
+}
+
+// Put uploads data to bucket/key.
+func (c *Client) Put(ctx context.Context, bucket, key string, data []byte) error {
+	resp, err := c.do(ctx, http.MethodPut, bucket, key, data)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+// Get downloads bucket/key.
+func (c *Client) Get(ctx context.Context, bucket, key string) ([]byte, error) {
+	resp, err := c.do(ctx, http.MethodGet, bucket, key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSnapshotSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	if len(data) > maxSnapshotSize {
+		return nil, fmt.Errorf("snapshot %s exceeds %d bytes", key, maxSnapshotSize)
+	}
+	return data, nil
+}
+
+func (c *Client) do(ctx context.Context, method, bucket, key string, body []byte) (*http.Response, error) {
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return nil, fmt.Errorf("missing credentials (set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY)")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.objectURL(bucket, key), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	c.sign(req, body)
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%s %s returned %s: %s", method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// objectURL uses virtual-hosted style for AWS and path style for custom endpoints.
+func (c *Client) objectURL(bucket, key string) string {
+	if c.Endpoint == "" {
+		return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, c.Region, encodePath(key))
+	}
+	return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(c.Endpoint, "/"), bucket, encodePath(key))
+}
+
+// sign adds AWS Signature Version 4 headers, signing every header already set.
+func (c *Client) sign(req *http.Request, body []byte) {
+	now := time.Now
+	if c.now != nil {
+		now = c.now
+	}
+	t := now().UTC()
+	amzDate := t.Format(amzDateFormat)
+	date := t.Format("20060102")
+
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, c.Region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretAccessKey), date)
+	key = hmacSHA256(key, c.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// Upload stores st as <prefix>/<host>/<timestamp>.json and updates
+// <prefix>/<host>/latest.json. It returns the timestamped key.
+func Upload(ctx context.Context, c *Client, loc *Location, host string, st *state.State, now time.Time) (string, error) {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+
+	dir := path.Join(loc.Key, host)
+	key := path.Join(dir, now.UTC().Format(amzDateFormat)+".json")
+	if err := c.Put(ctx, loc.Bucket, key, data); err != nil {
+		return "", err
+	}
+	if err := c.Put(ctx, loc.Bucket, path.Join(dir, LatestName), data); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// Download fetches a snapshot. If loc names a .json object it is used
+// directly; otherwise the latest snapshot of host under the prefix is used.
+func Download(ctx context.Context, c *Client, loc *Location, host string) (*state.State, string, error) {
+	key := loc.Key
+	if !strings.HasSuffix(key, ".json") {
+		key = path.Join(loc.Key, host, LatestName)
+	}
+
+	data, err := c.Get(ctx, loc.Bucket, key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var st state.State
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, "", fmt.Errorf("failed to parse snapshot %s: %w", key, err)
+	}
+	if st.Version == "" {
+		return nil, "", fmt.Errorf("%s is not a go-portalloc state snapshot", key)
+	}
+	return &st, key, nil
+}
+
+// encodePath escapes everything but unreserved characters and slashes, as
+// SigV4 canonical URIs require.
+func encodePath(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		ch := key[i]
+		if ch == '/' || ch == '-' || ch == '_' || ch == '.' || ch == '~' ||
+			('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') || ('0' <= ch && ch <= '9') {
+			b.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", ch)
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
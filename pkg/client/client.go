@@ -0,0 +1,314 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client is a typed Go client for the REST API served by
+// `go-portalloc serve`.
+//
+// Basic usage:
+//
+//	c := client.New("http://127.0.0.1:9465", client.WithToken(token))
+//	env, err := c.Create(ctx, &client.CreateRequest{Ports: 3})
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	defer c.Cleanup(context.Background(), env.ID)
+//
+// A daemon serving on a Unix socket is reached with WithUnixSocket:
+//
+//	c := client.New("http://unix", client.WithUnixSocket("/run/portalloc.sock"))
+//
+// Requests are retried on connection errors, 429, and 5xx responses. Create
+// is only retried when the daemon could not be reached or rejected it with
+// 429, so an environment is never created twice.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRetries is the number of retries after a failed attempt.
+	DefaultRetries = 3
+	// DefaultBackoff is the delay before the first retry; it doubles after
+	// every attempt.
+	DefaultBackoff = 200 * time.Millisecond
+)
+
+// APIError is a non-2xx response from the daemon.
+type APIError struct {
+	Message    string
+	StatusCode int
+	// Code is the response's ErrorResponse.Code, e.g. CodeResourceExhausted.
+	Code string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("daemon returned %d: %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound reports whether err is a 404 from the daemon.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// Client calls the daemon API. It is safe for concurrent use.
+type Client struct {
+	httpClient *http.Client
+	baseURL    string
+	retries    int
+	backoff    time.Duration
+	token      string
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used for requests.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithRetries sets the number of retries and the initial backoff.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.backoff = backoff
+	}
+}
+
+// WithToken authenticates requests with a bearer token from the daemon's
+// token file (serve --token-file).
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithUnixSocket connects to a daemon serving on the Unix socket at path
+// (serve --unix-socket). The host in baseURL is then ignored, so New("http://unix")
+// is the conventional base URL.
+func WithUnixSocket(path string) Option {
+	return func(c *Client) {
+		var dialer net.Dialer
+		c.httpClient = &http.Client{
+			Timeout: c.httpClient.Timeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", path)
+				},
+			},
+		}
+	}
+}
+
+// New creates a client for the daemon at baseURL (e.g. http://127.0.0.1:9465).
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		retries:    DefaultRetries,
+		backoff:    DefaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Create creates an environment.
+func (c *Client) Create(ctx context.Context, req *CreateRequest) (*Environment, error) {
+	if req == nil {
+		req = &CreateRequest{}
+	}
+	var env Environment
+	if err := c.do(ctx, http.MethodPost, "/v1/environments", req, &env, false); err != nil {
+		return nil, err
+	}
+	return &env, nil
+}
+
+// List returns all recorded environments.
+func (c *Client) List(ctx context.Context) ([]*Environment, error) {
+	var envs []*Environment
+	if err := c.do(ctx, http.MethodGet, "/v1/environments", nil, &envs, true); err != nil {
+		return nil, err
+	}
+	return envs, nil
+}
+
+// Get returns the environment with the given isolation ID.
+func (c *Client) Get(ctx context.Context, isolationID string) (*Environment, error) {
+	var env Environment
+	if err := c.do(ctx, http.MethodGet, "/v1/environments/"+url.PathEscape(isolationID), nil, &env, true); err != nil {
+		return nil, err
+	}
+	return &env, nil
+}
+
+// Cleanup removes the environment with the given isolation ID.
+func (c *Client) Cleanup(ctx context.Context, isolationID string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/environments/"+url.PathEscape(isolationID), nil, nil, true)
+}
+
+// AllocatePorts finds count consecutive free ports. They are checked, not
+// reserved; use Create to reserve ports.
+func (c *Client) AllocatePorts(ctx context.Context, count int) (*PortRange, error) {
+	var pr PortRange
+	if err := c.do(ctx, http.MethodPost, "/v1/ports", &AllocateRequest{Count: count}, &pr, true); err != nil {
+		return nil, err
+	}
+	return &pr, nil
+}
+
+// Lease asks the daemon to allocate ports within req's constraints and to
+// record them as held until ReleaseLease, or until the lease's TTL passes
+// without RenewLease. Unlike AllocatePorts, leased ports are never handed
+// to another lease or allocation.
+func (c *Client) Lease(ctx context.Context, req *LeaseRequest) (*Lease, error) {
+	var lease Lease
+	if err := c.do(ctx, http.MethodPost, "/v1/leases", req, &lease, false); err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// Leases returns the daemon's current leases.
+func (c *Client) Leases(ctx context.Context) ([]*Lease, error) {
+	var leases []*Lease
+	if err := c.do(ctx, http.MethodGet, "/v1/leases", nil, &leases, true); err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+// RenewLease extends the lease with the given ID by its TTL from now. Only
+// the client that took the lease may renew it.
+func (c *Client) RenewLease(ctx context.Context, id string) (*Lease, error) {
+	var lease Lease
+	if err := c.do(ctx, http.MethodPost, "/v1/leases/"+url.PathEscape(id)+"/renew", nil, &lease, true); err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// ReleaseLease releases the lease with the given ID. Only the client that
+// took the lease may release it.
+func (c *Client) ReleaseLease(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/leases/"+url.PathEscape(id), nil, nil, true)
+}
+
+// do sends a request, retrying as described in the package documentation.
+// Non-idempotent requests are retried only when the connection failed.
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}, idempotent bool) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+	}
+
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		err := c.attempt(ctx, method, path, payload, out)
+		if err == nil || attempt >= c.retries || !retryable(err, idempotent) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, method, path string, payload []byte, out interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var errResp ErrorResponse
+		if json.Unmarshal(data, &errResp) != nil || errResp.Error == "" {
+			errResp.Error = strings.TrimSpace(string(data))
+		}
+		return &APIError{StatusCode: resp.StatusCode, Message: errResp.Error, Code: errResp.Code}
+	}
+
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// retryable reports whether a failed attempt may be retried.
+func retryable(err error, idempotent bool) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		// A rejected (429) request was not processed and is always safe to retry
+		return apiErr.StatusCode == http.StatusTooManyRequests || (idempotent && apiErr.StatusCode >= 500)
+	}
+
+	// The request never reached the daemon, so even Create is safe to retry
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return idempotent
+}
@@ -0,0 +1,164 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_Retries(t *testing.T) {
+	t.Run("retries idempotent requests on 5xx", func(t *testing.T) {
+		var calls atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) < 3 {
+				http.Error(w, `{"error":"busy"}`, http.StatusServiceUnavailable)
+				return
+			}
+			_ = json.NewEncoder(w).Encode([]*Environment{{ID: "a"}})
+		}))
+		defer ts.Close()
+
+		envs, err := New(ts.URL, WithRetries(3, time.Millisecond)).List(context.Background())
+		require.NoError(t, err)
+		assert.Len(t, envs, 1)
+		assert.Equal(t, int32(3), calls.Load())
+	})
+
+	t.Run("does not retry create on 5xx", func(t *testing.T) {
+		var calls atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(&ErrorResponse{Error: "disk full"})
+		}))
+		defer ts.Close()
+
+		_, err := New(ts.URL, WithRetries(3, time.Millisecond)).Create(context.Background(), nil)
+		require.Error(t, err)
+		var apiErr *APIError
+		require.ErrorAs(t, err, &apiErr)
+		assert.Equal(t, http.StatusInternalServerError, apiErr.StatusCode)
+		assert.Equal(t, "disk full", apiErr.Message)
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("retries create on 429", func(t *testing.T) {
+		var calls atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) == 1 {
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			_ = json.NewEncoder(w).Encode(&Environment{ID: "b"})
+		}))
+		defer ts.Close()
+
+		env, err := New(ts.URL, WithRetries(1, time.Millisecond)).Create(context.Background(), &CreateRequest{Ports: 2})
+		require.NoError(t, err)
+		assert.Equal(t, "b", env.ID)
+	})
+
+	t.Run("retries create when the daemon is unreachable", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addr := listener.Addr().String()
+		require.NoError(t, listener.Close())
+
+		start := time.Now()
+		_, err = New("http://"+addr, WithRetries(2, 10*time.Millisecond)).Create(context.Background(), nil)
+		require.Error(t, err)
+		assert.GreaterOrEqual(t, time.Since(start), 30*time.Millisecond, "two retries with backoff")
+	})
+
+	t.Run("stops on context cancel", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer ts.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := New(ts.URL, WithRetries(100, time.Second)).List(ctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestClient_Requests(t *testing.T) {
+	var method, path string
+	var body map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.EscapedPath()
+		body = nil
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		_, _ = w.Write([]byte(`{"base_port":20000,"ports":[20000]}`))
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL + "/")
+	ctx := context.Background()
+
+	require.NoError(t, c.Cleanup(ctx, "a/b"))
+	assert.Equal(t, "DELETE /v1/environments/a%2Fb", method+" "+path)
+
+	pr, err := c.AllocatePorts(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "POST /v1/ports", method+" "+path)
+	assert.Equal(t, map[string]interface{}{"count": float64(1)}, body)
+	assert.Equal(t, 20000, pr.BasePort)
+
+	_, err = c.Create(ctx, &CreateRequest{Ports: 3, InstanceID: "job"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"ports": float64(3), "instance_id": "job"}, body)
+}
+
+func TestClient_WithUnixSocket(t *testing.T) {
+	// Socket paths are length-limited, so avoid the long t.TempDir path
+	dir, err := os.MkdirTemp("", "portalloc")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "d.sock")
+
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/environments", r.URL.Path)
+		_ = json.NewEncoder(w).Encode([]*Environment{{ID: "a"}})
+	}))
+	ts.Listener = listener
+	ts.Start()
+	defer ts.Close()
+
+	envs, err := New("http://unix", WithUnixSocket(socket)).List(context.Background())
+	require.NoError(t, err)
+	require.Len(t, envs, 1)
+	assert.Equal(t, "a", envs[0].ID)
+}
@@ -0,0 +1,117 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import "time"
+
+// CreateRequest is the body of POST /v1/environments.
+type CreateRequest struct {
+	// Ports is the number of consecutive ports to reserve (default 5).
+	Ports int `json:"ports,omitempty"`
+	// WorktreePath is where the env file is written. When empty, no env
+	// file is written and the ports are only returned.
+	WorktreePath string `json:"worktree_path,omitempty"`
+	// InstanceID is mixed into ID generation (e.g. a CI job ID).
+	InstanceID string `json:"instance_id,omitempty"`
+	// Profile names a profile from the daemon's config file.
+	Profile string `json:"profile,omitempty"`
+}
+
+// Environment is an environment recorded by the daemon.
+type Environment struct {
+	CreatedAt    time.Time `json:"created_at"`
+	ID           string    `json:"id"`
+	Status       string    `json:"status"`
+	Host         string    `json:"host,omitempty"`
+	WorktreePath string    `json:"worktree_path,omitempty"`
+	TempDir      string    `json:"temp_dir"`
+	EnvFile      string    `json:"env_file,omitempty"`
+	Ports        []int     `json:"ports"`
+	BasePort     int       `json:"base_port"`
+	PID          int       `json:"pid"`
+}
+
+// PortRange is the body returned by POST /v1/ports.
+type PortRange struct {
+	Ports    []int `json:"ports"`
+	BasePort int   `json:"base_port"`
+}
+
+// AllocateRequest is the body of POST /v1/ports.
+type AllocateRequest struct {
+	Count int `json:"count"`
+}
+
+// Lease protocols. A lease for ProtocolBoth holds each port for TCP and UDP.
+const (
+	ProtocolTCP  = "tcp"
+	ProtocolUDP  = "udp"
+	ProtocolBoth = "both"
+)
+
+// LeaseRequest is the body of POST /v1/leases: the constraints the daemon
+// allocates within.
+type LeaseRequest struct {
+	// Count is the number of consecutive ports.
+	Count int `json:"count"`
+	// MinPort and MaxPort (inclusive) narrow the daemon's range; 0 means
+	// the range's own bound.
+	MinPort int `json:"min_port,omitempty"`
+	MaxPort int `json:"max_port,omitempty"`
+	// Protocol is ProtocolTCP (default), ProtocolUDP, or ProtocolBoth.
+	Protocol string `json:"protocol,omitempty"`
+	// Labels are recorded with the lease, e.g. {"job": "1234"}.
+	Labels map[string]string `json:"labels,omitempty"`
+	// TTLSeconds is how long the lease lives without RenewLease; 0 means
+	// the daemon's default.
+	TTLSeconds int `json:"ttl_seconds,omitempty"`
+}
+
+// Lease is a port range the daemon allocated and recorded for a client.
+type Lease struct {
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is when the daemon drops the lease unless it is renewed
+	// for another TTLSeconds.
+	ExpiresAt  time.Time         `json:"expires_at"`
+	TTLSeconds int               `json:"ttl_seconds"`
+	ID         string            `json:"id"`
+	Ports      []int             `json:"ports"`
+	BasePort   int               `json:"base_port"`
+	Protocol   string            `json:"protocol"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	// Owner is the authenticated user, or the client's address. Only the
+	// owner may renew or release the lease.
+	Owner string `json:"owner"`
+}
+
+// ErrorResponse is the body of every non-2xx response.
+type ErrorResponse struct {
+	Error string `json:"error"`
+	// Code classifies the error, e.g. CodeResourceExhausted; it is empty
+	// for most errors.
+	Code string `json:"code,omitempty"`
+}
+
+// CodeResourceExhausted is the ErrorResponse code of a 429: the client hit
+// the daemon's rate limit or concurrent creation limit.
+const CodeResourceExhausted = "RESOURCE_EXHAUSTED"
+
+// CodeUnavailable is the ErrorResponse code of a 503 from a daemon that is
+// shutting down and no longer creates environments or leases.
+const CodeUnavailable = "UNAVAILABLE"
+
+// CodeUnauthenticated is the ErrorResponse code of a 401: the daemon
+// requires a token (see WithToken) or a client certificate.
+const CodeUnauthenticated = "UNAUTHENTICATED"
@@ -0,0 +1,200 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package compose rewrites docker compose files to use allocated ports.
+//
+// Some stacks cannot interpolate environment variables in their port
+// mappings. Rewrite replaces every published host port with one of the
+// environment's allocated ports, leaving container ports, host IPs,
+// protocols, comments, and all other content untouched.
+package compose
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Mapping records how one published port was rewritten.
+type Mapping struct {
+	// Service is the compose service name.
+	Service string `json:"service"`
+	// Published is the original host-side port (as written in the file).
+	Published string `json:"published"`
+	// Target is the container-side port.
+	Target string `json:"target"`
+	// Port is the allocated host port that replaced Published.
+	Port int `json:"port"`
+}
+
+// Rewrite replaces published host ports in a compose file with ports, in
+// document order. Entries without a host port (e.g. "80") and port ranges
+// are left unchanged. It fails if the file publishes more ports than given.
+func Rewrite(data []byte, ports []int) ([]byte, []Mapping, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse compose file: %w", err)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, nil, fmt.Errorf("compose file is not a mapping")
+	}
+
+	r := &rewriter{ports: ports}
+	services := mappingValue(doc.Content[0], "services")
+	if services != nil && services.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(services.Content); i += 2 {
+			service := services.Content[i].Value
+			portsNode := mappingValue(services.Content[i+1], "ports")
+			if portsNode == nil || portsNode.Kind != yaml.SequenceNode {
+				continue
+			}
+			for _, entry := range portsNode.Content {
+				if err := r.rewriteEntry(service, entry); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, nil, fmt.Errorf("failed to encode compose file: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, nil, fmt.Errorf("failed to encode compose file: %w", err)
+	}
+
+	return buf.Bytes(), r.mappings, nil
+}
+
+// CountPublished returns the number of host ports a compose file publishes,
+// i.e. how many ports Rewrite needs.
+func CountPublished(data []byte) (int, error) {
+	// Rewriting with an unbounded supply of placeholder ports counts them
+	_, mappings, err := Rewrite(data, nil)
+	if err != nil {
+		return 0, err
+	}
+	return len(mappings), nil
+}
+
+type rewriter struct {
+	ports    []int
+	mappings []Mapping
+}
+
+// next returns the next allocated port; a nil port list counts without limit.
+func (r *rewriter) next() (int, error) {
+	i := len(r.mappings)
+	if r.ports == nil {
+		return 0, nil
+	}
+	if i >= len(r.ports) {
+		return 0, fmt.Errorf("compose file publishes more than %d port(s); allocate more ports", len(r.ports))
+	}
+	return r.ports[i], nil
+}
+
+func (r *rewriter) rewriteEntry(service string, entry *yaml.Node) error {
+	switch entry.Kind {
+	case yaml.ScalarNode:
+		hostIP, published, target, ok := parseShort(entry.Value)
+		if !ok {
+			return nil
+		}
+		port, err := r.next()
+		if err != nil {
+			return err
+		}
+
+		value := strconv.Itoa(port) + ":" + target
+		if hostIP != "" {
+			value = hostIP + ":" + value
+		}
+		entry.Value = value
+		entry.Tag = "!!str"
+		if entry.Style == 0 {
+			// "8080:80" must stay quoted to avoid YAML 1.1 base-60 parsing
+			entry.Style = yaml.DoubleQuotedStyle
+		}
+		r.mappings = append(r.mappings, Mapping{Service: service, Published: published, Target: target, Port: port})
+
+	case yaml.MappingNode:
+		publishedNode := mappingValue(entry, "published")
+		if publishedNode == nil || publishedNode.Value == "" || strings.Contains(publishedNode.Value, "-") {
+			return nil
+		}
+		port, err := r.next()
+		if err != nil {
+			return err
+		}
+
+		target := ""
+		if targetNode := mappingValue(entry, "target"); targetNode != nil {
+			target = targetNode.Value
+		}
+		r.mappings = append(r.mappings, Mapping{Service: service, Published: publishedNode.Value, Target: target, Port: port})
+		publishedNode.Value = strconv.Itoa(port)
+	}
+
+	return nil
+}
+
+// parseShort splits a short-syntax port entry "[HOST_IP:]HOST:CONTAINER[/PROTO]".
+// ok is false when no single host port is published.
+func parseShort(s string) (hostIP, published, target string, ok bool) {
+	// IPv6 host IPs are bracketed: "[::1]:8080:80"
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]:")
+		if end < 0 {
+			return "", "", "", false
+		}
+		hostIP, s = s[:end+1], s[end+2:]
+	}
+
+	parts := strings.Split(s, ":")
+	switch {
+	case hostIP != "" && len(parts) == 2:
+		published, target = parts[0], parts[1]
+	case hostIP == "" && len(parts) == 2:
+		published, target = parts[0], parts[1]
+	case hostIP == "" && len(parts) == 3:
+		hostIP, published, target = parts[0], parts[1], parts[2]
+	default:
+		return "", "", "", false
+	}
+
+	if published == "" || strings.Contains(published, "-") {
+		return "", "", "", false
+	}
+	return hostIP, published, target, true
+}
+
+// mappingValue returns the value node for key in a mapping node.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compose
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+const sampleCompose = `# Test stack
+services:
+  api:
+    image: example/api
+    ports:
+      - "8080:80"            # public API
+      - 127.0.0.1:9090:9090/tcp
+      - "3000"
+  db:
+    image: postgres
+    ports:
+      - target: 5432
+        published: 5432
+        protocol: tcp
+      - "[::1]:6543:5432"
+      - "7000-7001:7000-7001"
+  worker:
+    image: example/worker
+`
+
+func TestRewrite(t *testing.T) {
+	out, mappings, err := Rewrite([]byte(sampleCompose), []int{21000, 21001, 21002, 21003, 21004})
+	require.NoError(t, err)
+
+	assert.Equal(t, []Mapping{
+		{Service: "api", Published: "8080", Target: "80", Port: 21000},
+		{Service: "api", Published: "9090", Target: "9090/tcp", Port: 21001},
+		{Service: "db", Published: "5432", Target: "5432", Port: 21002},
+		{Service: "db", Published: "6543", Target: "5432", Port: 21003},
+	}, mappings)
+
+	var parsed struct {
+		Services map[string]struct {
+			Ports []interface{} `yaml:"ports"`
+		} `yaml:"services"`
+	}
+	require.NoError(t, yaml.Unmarshal(out, &parsed))
+
+	assert.Equal(t, []interface{}{"21000:80", "127.0.0.1:21001:9090/tcp", "3000"}, parsed.Services["api"].Ports)
+	dbPorts := parsed.Services["db"].Ports
+	assert.Equal(t, 21002, dbPorts[0].(map[string]interface{})["published"])
+	assert.Equal(t, 5432, dbPorts[0].(map[string]interface{})["target"])
+	assert.Equal(t, "[::1]:21003:5432", dbPorts[1])
+	assert.Equal(t, "7000-7001:7000-7001", dbPorts[2], "ranges are left alone")
+
+	// Comments and unrelated content survive
+	assert.Contains(t, string(out), "# Test stack")
+	assert.Contains(t, string(out), "# public API")
+	assert.Contains(t, string(out), "image: example/worker")
+}
+
+func TestRewrite_NotEnoughPorts(t *testing.T) {
+	_, _, err := Rewrite([]byte(sampleCompose), []int{21000, 21001})
+	assert.ErrorContains(t, err, "allocate more ports")
+}
+
+func TestRewrite_Invalid(t *testing.T) {
+	_, _, err := Rewrite([]byte("services: [unclosed"), nil)
+	assert.Error(t, err)
+
+	_, _, err = Rewrite([]byte("- just\n- a list\n"), nil)
+	assert.Error(t, err)
+}
+
+func TestCountPublished(t *testing.T) {
+	n, err := CountPublished([]byte(sampleCompose))
+	require.NoError(t, err)
+	assert.Equal(t, 4, n)
+
+	n, err = CountPublished([]byte("services:\n  app:\n    image: x\n"))
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+func TestParseShort(t *testing.T) {
+	tests := []struct {
+		in                        string
+		hostIP, published, target string
+		ok                        bool
+	}{
+		{"8080:80", "", "8080", "80", true},
+		{"0.0.0.0:8080:80/udp", "0.0.0.0", "8080", "80/udp", true},
+		{"[::1]:8080:80", "[::1]", "8080", "80", true},
+		{"80", "", "", "", false},
+		{"127.0.0.1::80", "", "", "", false},
+		{"8000-8001:80-81", "", "", "", false},
+	}
+	for _, tt := range tests {
+		hostIP, published, target, ok := parseShort(tt.in)
+		assert.Equal(t, tt.ok, ok, tt.in)
+		if tt.ok {
+			assert.Equal(t, tt.hostIP, hostIP, tt.in)
+			assert.Equal(t, tt.published, published, tt.in)
+			assert.Equal(t, tt.target, target, tt.in)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+)
+
+// PortCollision is a port of an environment that something else also
+// claims: another environment's allocation, or a listener the environment
+// does not own.
+type PortCollision struct {
+	Port int
+	// Environment is the ID of the other environment, or empty if the
+	// port is bound by a process outside any environment.
+	Environment string
+	// PID is the process listening on Port, or 0 if the port is allocated
+	// to both environments.
+	PID int
+	// Bound is set if Port is bound rather than allocated to another
+	// environment.
+	Bound bool
+}
+
+func (c PortCollision) String() string {
+	switch {
+	case !c.Bound:
+		return fmt.Sprintf("%d allocated to %s", c.Port, c.Environment)
+	case c.Environment != "":
+		return fmt.Sprintf("%d bound by %s (PID %d)", c.Port, c.Environment, c.PID)
+	default:
+		return fmt.Sprintf("%d bound by PID %d outside the environment", c.Port, c.PID)
+	}
+}
+
+// PortCollisionError lists the collisions found by Validate.
+type PortCollisionError struct {
+	ID         string
+	Collisions []PortCollision
+}
+
+func (e *PortCollisionError) Error() string {
+	parts := make([]string, len(e.Collisions))
+	for i, c := range e.Collisions {
+		parts[i] = c.String()
+	}
+	return fmt.Sprintf("port collision in %s: %s", e.ID, strings.Join(parts, ", "))
+}
+
+// Is reports whether target is ErrPortCollision.
+func (e *PortCollisionError) Is(target error) bool {
+	return target == ErrPortCollision
+}
+
+// PortCollisions compares env's allocated range against others and
+// listeners (port to listening PIDs, see ports.ListenerPIDs). It reports
+// ports allocated to another environment, and every listener on env's
+// ports that env does not own. A listener is env's if it is env's lock
+// owner or was started with ISOLATION_ID set to env's ID, as 'run' and
+// the env file set it; another environment's lock owner or ISOLATION_ID
+// attributes it to that environment. Listeners whose process cannot be
+// read, such as docker-proxy publishing env's containers as root, are
+// not reported.
+func PortCollisions(env *Environment, others []*Environment, listeners map[int][]int) []PortCollision {
+	if env.Ports == nil || env.Ports.Count == 0 {
+		return nil
+	}
+	inRange := func(port int) bool {
+		return port >= env.Ports.BasePort && port < env.Ports.BasePort+env.Ports.Count
+	}
+
+	var collisions []PortCollision
+	ownerOf := make(map[int]string)
+	for _, other := range others {
+		if other.ID == env.ID {
+			continue
+		}
+		if other.Ports != nil {
+			for i := 0; i < other.Ports.Count; i++ {
+				if port := other.Ports.BasePort + i; inRange(port) {
+					collisions = append(collisions, PortCollision{Port: port, Environment: other.ID})
+				}
+			}
+		}
+		if other.LockFile == "" {
+			continue
+		}
+		if info, err := ReadLockInfo(other.LockFile); err == nil && info.Alive() {
+			ownerOf[info.PID] = other.ID
+		}
+	}
+
+	ownPID := 0
+	if env.LockFile != "" {
+		if info, err := ReadLockInfo(env.LockFile); err == nil {
+			ownPID = info.PID
+		}
+	}
+
+	for port, pids := range listeners {
+		if !inRange(port) {
+			continue
+		}
+		for _, pid := range pids {
+			if id, ok := ownerOf[pid]; ok {
+				collisions = append(collisions, PortCollision{Port: port, Environment: id, PID: pid, Bound: true})
+				continue
+			}
+			if pid == ownPID {
+				continue
+			}
+			id, err := ports.ProcessEnv(pid, "ISOLATION_ID")
+			if err == nil && id != env.ID {
+				collisions = append(collisions, PortCollision{Port: port, Environment: id, PID: pid, Bound: true})
+			}
+		}
+	}
+
+	sort.Slice(collisions, func(i, j int) bool {
+		if collisions[i].Port != collisions[j].Port {
+			return collisions[i].Port < collisions[j].Port
+		}
+		if collisions[i].Environment != collisions[j].Environment {
+			return collisions[i].Environment < collisions[j].Environment
+		}
+		return collisions[i].PID < collisions[j].PID
+	})
+	return collisions
+}
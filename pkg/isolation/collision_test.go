@@ -0,0 +1,109 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports/portstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortCollisions(t *testing.T) {
+	lockDir := t.TempDir()
+	liveLock := filepath.Join(lockDir, "env-live.lock")
+	writeTestLock(t, liveLock, os.Getpid(), time.Now())
+	deadLock := filepath.Join(lockDir, "env-dead.lock")
+	writeTestLock(t, deadLock, deadPID, time.Now())
+
+	own := startSleeper(t, "ISOLATION_ID=self")
+	foreign := startSleeper(t, "ISOLATION_ID=elsewhere")
+	unrelated := startSleeper(t)
+
+	env := &Environment{ID: "self", Ports: &ports.PortRange{BasePort: 20000, Count: 8}}
+	others := []*Environment{
+		env,
+		{ID: "overlap", Ports: &ports.PortRange{BasePort: 20006, Count: 5}},
+		{ID: "live", LockFile: liveLock, Ports: &ports.PortRange{BasePort: 30000, Count: 2}},
+		{ID: "dead", LockFile: deadLock, Ports: &ports.PortRange{BasePort: 31000, Count: 2}},
+	}
+	listeners := map[int][]int{
+		20000: {os.Getpid()},
+		20001: {deadPID},
+		20002: {own},
+		20003: {foreign},
+		20004: {unrelated},
+		30000: {os.Getpid()},
+	}
+
+	assert.Equal(t, []PortCollision{
+		{Port: 20000, Environment: "live", PID: os.Getpid(), Bound: true},
+		{Port: 20003, Environment: "elsewhere", PID: foreign, Bound: true},
+		{Port: 20004, PID: unrelated, Bound: true},
+		{Port: 20006, Environment: "overlap"},
+		{Port: 20007, Environment: "overlap"},
+	}, PortCollisions(env, others, listeners))
+
+	delete(listeners, 20000)
+	env.LockFile = filepath.Join(lockDir, "env-self.lock")
+	writeTestLock(t, env.LockFile, unrelated, time.Now())
+	assert.Equal(t, []PortCollision{
+		{Port: 20003, Environment: "elsewhere", PID: foreign, Bound: true},
+	}, PortCollisions(env, nil, listeners), "env's lock owner and ISOLATION_ID listeners are env's own")
+}
+
+// startSleeper starts a process with environment env and returns its PID.
+func startSleeper(t *testing.T, env ...string) int {
+	t.Helper()
+	if _, err := os.Stat("/proc/self/environ"); err != nil {
+		t.Skip("no /proc on this platform")
+	}
+	cmd := exec.Command("sleep", "30")
+	cmd.Env = env
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	return cmd.Process.Pid
+}
+
+func TestEnvironmentManager_ValidateReportsCollisions(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := &Config{
+		WorktreePath: tmpDir,
+		LockDir:      filepath.Join(tmpDir, "locks"),
+		MaxRetries:   10,
+		NoEnvFile:    true,
+	}
+	manager := NewEnvironmentManager(NewIDGenerator(config), portstest.NewFakeAllocator(20000))
+
+	env, err := manager.CreateEnvironment(3)
+	require.NoError(t, err)
+	defer manager.Cleanup(env)
+
+	other := &Environment{ID: "other", Ports: &ports.PortRange{BasePort: env.Ports.BasePort + 2, Count: 3}}
+	err = manager.Validate(env, other)
+	assert.ErrorIs(t, err, ErrPortCollision)
+	assert.Contains(t, err.Error(), "allocated to other")
+
+	assert.NoError(t, manager.Validate(env))
+}
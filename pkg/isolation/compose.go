@@ -0,0 +1,71 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultComposePrefix is prepended to the isolation ID to form
+// COMPOSE_PROJECT_NAME unless WithComposePrefix says otherwise.
+const DefaultComposePrefix = "portalloc-"
+
+// WithComposePrefix sets the prefix of the environment's docker compose
+// project name (default: DefaultComposePrefix).
+func WithComposePrefix(prefix string) Option {
+	return func(c *Config) {
+		c.ComposePrefix = prefix
+	}
+}
+
+// ValidateComposePrefix checks that prefix followed by an isolation ID is a
+// valid docker compose project name: lowercase letters, digits, dashes, and
+// underscores, starting with a letter or digit.
+func ValidateComposePrefix(prefix string) error {
+	for i, r := range prefix {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+		case (r == '-' || r == '_') && i > 0:
+		default:
+			return fmt.Errorf("invalid compose prefix %q: use lowercase letters, digits, '-' and '_', starting with a letter or digit", prefix)
+		}
+	}
+	return nil
+}
+
+// ComposeProjectName returns the environment's COMPOSE_PROJECT_NAME: its
+// compose prefix (default: DefaultComposePrefix) followed by its ID.
+func (env *Environment) ComposeProjectName() string {
+	prefix := env.ComposePrefix
+	if prefix == "" {
+		prefix = DefaultComposePrefix
+	}
+	return prefix + env.ID
+}
+
+// DockerNetworkName returns the environment's DOCKER_NETWORK: its compose
+// project name reduced to the characters docker accepts in network names,
+// so compose files of several projects can join one network per
+// environment.
+func (env *Environment) DockerNetworkName() string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '-'
+	}, env.ComposeProjectName())
+}
@@ -0,0 +1,101 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports/portstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateComposePrefix(t *testing.T) {
+	for _, prefix := range []string{"", "portalloc-", "ci_", "team1-"} {
+		assert.NoError(t, ValidateComposePrefix(prefix), prefix)
+	}
+	for _, prefix := range []string{"CI-", "-ci", "my app-", "ci."} {
+		assert.Error(t, ValidateComposePrefix(prefix), prefix)
+	}
+}
+
+func TestEnvironmentManager_ComposePrefix(t *testing.T) {
+	t.Run("defaults to portalloc-", func(t *testing.T) {
+		env := &Environment{ID: "abc123"}
+		assert.Equal(t, "portalloc-abc123", env.ComposeProjectName())
+	})
+
+	t.Run("applies the prefix to every output", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		config := (&Config{
+			WorktreePath: tmpDir,
+			LockDir:      filepath.Join(tmpDir, "locks"),
+			MaxRetries:   10,
+		}).Apply(WithComposePrefix("ci-"))
+		manager := NewEnvironmentManager(NewIDGenerator(config), portstest.NewFakeAllocator(20000))
+
+		env, err := manager.CreateEnvironment(2)
+		require.NoError(t, err)
+		defer manager.Cleanup(env)
+
+		name := "ci-" + env.ID
+		assert.Equal(t, name, env.ComposeProjectName())
+		assert.Equal(t, name, env.Vars()["COMPOSE_PROJECT_NAME"])
+		assert.Equal(t, []string{"ISOLATION_ID", "COMPOSE_PROJECT_NAME"}, env.VarNames()[:2])
+
+		data, err := os.ReadFile(env.EnvFile)
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "COMPOSE_PROJECT_NAME="+name+"\n")
+
+		encoded, err := json.Marshal(env)
+		require.NoError(t, err)
+		assert.Contains(t, string(encoded), `"compose_project_name":"`+name+`"`)
+
+		var decoded Environment
+		require.NoError(t, json.Unmarshal(encoded, &decoded))
+		assert.Equal(t, name, decoded.ComposeProjectName())
+	})
+}
+
+func TestEnvironment_DockerNetworkName(t *testing.T) {
+	env := &Environment{ID: "abc123", Ports: &ports.PortRange{}}
+	assert.Equal(t, "portalloc-abc123", env.DockerNetworkName())
+	assert.Equal(t, "portalloc-abc123", env.Vars()["DOCKER_NETWORK"])
+
+	env = &Environment{ID: "a/b c", ComposePrefix: "ci_"}
+	assert.Equal(t, "ci_a-b-c", env.DockerNetworkName())
+
+	t.Run("records created networks in JSON", func(t *testing.T) {
+		env := &Environment{ID: "abc123", Ports: &ports.PortRange{}}
+		encoded, err := json.Marshal(env)
+		require.NoError(t, err)
+		assert.Contains(t, string(encoded), `"docker_network":"portalloc-abc123"`)
+		assert.NotContains(t, string(encoded), "docker_network_created")
+
+		var decoded Environment
+		require.NoError(t, json.Unmarshal(encoded, &decoded))
+		assert.Empty(t, decoded.DockerNetwork)
+
+		env.DockerNetwork = env.DockerNetworkName()
+		encoded, err = json.Marshal(env)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(encoded, &decoded))
+		assert.Equal(t, "portalloc-abc123", decoded.DockerNetwork)
+	})
+}
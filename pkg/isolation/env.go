@@ -0,0 +1,170 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Environment variables that override defaults of the CLI and the library,
+// so containerized CI can configure go-portalloc without passing flags
+// through several layers of scripts.
+const (
+	// LockDirEnv overrides the default lock directory.
+	LockDirEnv = "PORTALLOC_LOCK_DIR"
+	// TempPrefixEnv overrides the temp directory name prefix.
+	TempPrefixEnv = "PORTALLOC_TEMP_PREFIX"
+	// DefaultPortsEnv overrides the number of ports allocated by default.
+	DefaultPortsEnv = "PORTALLOC_DEFAULT_PORTS"
+	// NamingEnv selects the naming scheme ("legacy" or "portalloc").
+	NamingEnv = "PORTALLOC_NAMING"
+	// HostEnv overrides the hostname recorded in locks and state, for
+	// lock directories shared by machines with identical hostnames.
+	HostEnv = "PORTALLOC_HOST"
+)
+
+// DefaultTempPrefix prefixes environment temp directory names.
+const DefaultTempPrefix = LegacyTempPrefix
+
+// Names of temp and lock directories under each naming scheme.
+const (
+	// LegacyTempPrefix and LegacyLockDir are the historical aigis names.
+	LegacyTempPrefix = "aigis-test-"
+	LegacyLockDir    = "/tmp/aigis-isolation-locks"
+	// PortallocTempPrefix prefixes temp directories under NamingPortalloc.
+	PortallocTempPrefix = "portalloc-"
+)
+
+// Naming selects the default names of temp directories and the lock
+// directory.
+type Naming string
+
+const (
+	// NamingLegacy keeps the aigis-test- temp prefix and LegacyLockDir.
+	NamingLegacy Naming = "legacy"
+	// NamingPortalloc uses PortallocTempPrefix and the go-portalloc-locks
+	// directory shared with the CLI. Resources still using the legacy
+	// names are recognized, and can be migrated with state.MigrateLegacy.
+	NamingPortalloc Naming = "portalloc"
+)
+
+// naming is the scheme set by SetNaming.
+var naming atomic.Value
+
+// ParseNaming parses a naming scheme name; empty means NamingLegacy.
+func ParseNaming(name string) (Naming, error) {
+	switch Naming(name) {
+	case "", NamingLegacy:
+		return NamingLegacy, nil
+	case NamingPortalloc:
+		return NamingPortalloc, nil
+	}
+	return "", fmt.Errorf("invalid naming %q (want %q or %q)", name, NamingLegacy, NamingPortalloc)
+}
+
+// SetNaming sets the process-wide naming scheme. $PORTALLOC_NAMING, when
+// valid, takes precedence.
+func SetNaming(n Naming) {
+	naming.Store(n)
+}
+
+// CurrentNaming returns the naming scheme in effect: $PORTALLOC_NAMING,
+// then the scheme set by SetNaming, then NamingLegacy.
+func CurrentNaming() Naming {
+	if name := os.Getenv(NamingEnv); name != "" {
+		if n, err := ParseNaming(name); err == nil {
+			return n
+		}
+	}
+	if n, ok := naming.Load().(Naming); ok {
+		return n
+	}
+	return NamingLegacy
+}
+
+// DefaultLockDir returns the lock directory of the current naming scheme,
+// overridable with $PORTALLOC_LOCK_DIR.
+func DefaultLockDir() string {
+	if CurrentNaming() == NamingPortalloc {
+		return LockDirFromEnv(filepath.Join(os.TempDir(), "go-portalloc-locks"))
+	}
+	return LockDirFromEnv(LegacyLockDir)
+}
+
+// LockDirs returns lockDir followed by LegacyLockDir when the portalloc
+// naming scheme is in effect, so environments locked under the legacy
+// names are still found.
+func LockDirs(lockDir string) []string {
+	dirs := []string{lockDir}
+	if CurrentNaming() == NamingPortalloc && filepath.Clean(lockDir) != LegacyLockDir {
+		dirs = append(dirs, LegacyLockDir)
+	}
+	return dirs
+}
+
+// LockDirFromEnv returns $PORTALLOC_LOCK_DIR, or fallback when it is unset.
+func LockDirFromEnv(fallback string) string {
+	if dir := os.Getenv(LockDirEnv); dir != "" {
+		return dir
+	}
+	return fallback
+}
+
+// TempPrefix returns $PORTALLOC_TEMP_PREFIX, or the current naming
+// scheme's prefix when it is unset or contains a path separator.
+func TempPrefix() string {
+	prefix := os.Getenv(TempPrefixEnv)
+	if prefix == "" || strings.ContainsRune(prefix, filepath.Separator) {
+		if CurrentNaming() == NamingPortalloc {
+			return PortallocTempPrefix
+		}
+		return DefaultTempPrefix
+	}
+	return prefix
+}
+
+// TempDirPath returns the temp directory of the environment with the
+// given ID.
+func TempDirPath(isolationID string) string {
+	return filepath.Join(os.TempDir(), TempPrefix()+isolationID)
+}
+
+// FindTempDir returns the existing temp directory of the environment with
+// the given ID, checking TempDirPath first and then the legacy name, or
+// TempDirPath when neither exists.
+func FindTempDir(isolationID string) string {
+	path := TempDirPath(isolationID)
+	if fileExists(path) {
+		return path
+	}
+	if legacy := filepath.Join(os.TempDir(), LegacyTempPrefix+isolationID); fileExists(legacy) {
+		return legacy
+	}
+	return path
+}
+
+// DefaultPorts returns $PORTALLOC_DEFAULT_PORTS when it is a positive
+// integer, or fallback.
+func DefaultPorts(fallback int) int {
+	if n, err := strconv.Atoi(os.Getenv(DefaultPortsEnv)); err == nil && n > 0 {
+		return n
+	}
+	return fallback
+}
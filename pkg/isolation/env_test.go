@@ -0,0 +1,101 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvOverrides(t *testing.T) {
+	t.Run("defaults without variables", func(t *testing.T) {
+		t.Setenv(LockDirEnv, "")
+		t.Setenv(TempPrefixEnv, "")
+		t.Setenv(DefaultPortsEnv, "")
+
+		assert.Equal(t, "/fallback", LockDirFromEnv("/fallback"))
+		assert.Equal(t, filepath.Join(os.TempDir(), "aigis-test-abc"), TempDirPath("abc"))
+		assert.Equal(t, 5, DefaultPorts(5))
+	})
+
+	t.Run("variables override defaults", func(t *testing.T) {
+		t.Setenv(LockDirEnv, "/ci/locks")
+		t.Setenv(TempPrefixEnv, "ci-")
+		t.Setenv(DefaultPortsEnv, "8")
+
+		assert.Equal(t, "/ci/locks", LockDirFromEnv("/fallback"))
+		assert.Equal(t, "/ci/locks", DefaultConfig().LockDir)
+		assert.Equal(t, filepath.Join(os.TempDir(), "ci-abc"), TempDirPath("abc"))
+		assert.Equal(t, 8, DefaultPorts(5))
+	})
+
+	t.Run("invalid values are ignored", func(t *testing.T) {
+		t.Setenv(TempPrefixEnv, "../escape-")
+		t.Setenv(DefaultPortsEnv, "zero")
+
+		assert.Equal(t, DefaultTempPrefix, TempPrefix())
+		assert.Equal(t, 5, DefaultPorts(5))
+	})
+}
+
+func TestNaming(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	t.Setenv(LockDirEnv, "")
+	t.Setenv(TempPrefixEnv, "")
+
+	t.Run("legacy by default", func(t *testing.T) {
+		t.Setenv(NamingEnv, "")
+		assert.Equal(t, NamingLegacy, CurrentNaming())
+		assert.Equal(t, LegacyTempPrefix, TempPrefix())
+		assert.Equal(t, LegacyLockDir, DefaultLockDir())
+		assert.Equal(t, []string{"/locks"}, LockDirs("/locks"))
+	})
+
+	t.Run("portalloc names recognize legacy resources", func(t *testing.T) {
+		t.Setenv(NamingEnv, string(NamingPortalloc))
+		assert.Equal(t, PortallocTempPrefix, TempPrefix())
+		assert.Equal(t, filepath.Join(os.TempDir(), "go-portalloc-locks"), DefaultLockDir())
+		assert.Equal(t, []string{"/locks", LegacyLockDir}, LockDirs("/locks"))
+		assert.Equal(t, []string{LegacyLockDir}, LockDirs(LegacyLockDir))
+
+		assert.Equal(t, TempDirPath("abc"), FindTempDir("abc"))
+		legacy := filepath.Join(os.TempDir(), LegacyTempPrefix+"abc")
+		require.NoError(t, os.Mkdir(legacy, 0o750))
+		assert.Equal(t, legacy, FindTempDir("abc"))
+		require.NoError(t, os.Mkdir(TempDirPath("abc"), 0o750))
+		assert.Equal(t, TempDirPath("abc"), FindTempDir("abc"))
+	})
+
+	t.Run("the environment overrides SetNaming", func(t *testing.T) {
+		SetNaming(NamingPortalloc)
+		defer SetNaming(NamingLegacy)
+
+		t.Setenv(NamingEnv, "")
+		assert.Equal(t, NamingPortalloc, CurrentNaming())
+		t.Setenv(NamingEnv, string(NamingLegacy))
+		assert.Equal(t, NamingLegacy, CurrentNaming())
+	})
+
+	t.Run("invalid names are rejected", func(t *testing.T) {
+		t.Setenv(NamingEnv, "aigis")
+		assert.Equal(t, NamingLegacy, CurrentNaming())
+		_, err := ParseNaming("aigis")
+		assert.Error(t, err)
+	})
+}
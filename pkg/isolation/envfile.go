@@ -0,0 +1,128 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// EnvFileName returns the name of the env file written for isolationID by
+// default: DefaultEnvFileName with the ID appended, so that the
+// environments of one worktree never overwrite each other's files.
+func EnvFileName(isolationID string) string {
+	return DefaultEnvFileName + "." + isolationID
+}
+
+// FindEnvFile returns the default env file of isolationID in worktree:
+// the per-ID file if it exists, else DefaultEnvFileName as written by older
+// versions. It is meant for environments that are not recorded.
+func FindEnvFile(worktree, isolationID string) string {
+	path := filepath.Join(worktree, EnvFileName(isolationID))
+	if _, err := os.Lstat(path); err == nil {
+		return path
+	}
+	return filepath.Join(worktree, DefaultEnvFileName)
+}
+
+// EnvFileOwner returns the ISOLATION_ID written in the env file at path,
+// or "" if the file cannot be read or has none. An env file shared by
+// several environments belongs to the one that wrote it last.
+func EnvFileOwner(path string) string {
+	// #nosec G304 - path is a recorded env file
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "ISOLATION_ID="); ok {
+			return strings.Trim(value, "'")
+		}
+	}
+	return ""
+}
+
+// latestLink returns the DefaultEnvFileName symlink next to a per-ID env file.
+func latestLink(envFile string) string {
+	return filepath.Join(filepath.Dir(envFile), DefaultEnvFileName)
+}
+
+// linkLatestEnvFile points the DefaultEnvFileName symlink next to envFile
+// at it, so tools that source .env.isolation get the latest environment.
+// A regular file in its place, written by an older version or by hand, is
+// left alone.
+func linkLatestEnvFile(envFile string) error {
+	link := latestLink(envFile)
+	if info, err := os.Lstat(link); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+
+	// Replace the link atomically; the temp name is unique per environment
+	tmp := link + ".tmp-" + filepath.Base(envFile)
+	_ = os.Remove(tmp)
+	if err := os.Symlink(filepath.Base(envFile), tmp); err != nil {
+		return fmt.Errorf("failed to link %s: %w", link, err)
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to link %s: %w", link, err)
+	}
+	return nil
+}
+
+// unlinkEnvFile repoints the DefaultEnvFileName symlink at the most
+// recently written env file of another environment once envFile is gone,
+// or removes it when none is left. Links pointing elsewhere are left alone.
+func unlinkEnvFile(envFile string) error {
+	link := latestLink(envFile)
+	target, err := os.Readlink(link)
+	if err != nil || target != filepath.Base(envFile) {
+		return nil
+	}
+
+	matches, err := filepath.Glob(filepath.Join(filepath.Dir(envFile), DefaultEnvFileName+".*"))
+	if err != nil {
+		return fmt.Errorf("failed to find env files: %w", err)
+	}
+	var latest string
+	var latestTime time.Time
+	for _, match := range matches {
+		if match == envFile || strings.Contains(filepath.Base(match), ".tmp-") {
+			continue
+		}
+		info, err := os.Lstat(match)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if latest == "" || info.ModTime().After(latestTime) {
+			latest, latestTime = match, info.ModTime()
+		}
+	}
+
+	if latest == "" {
+		if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", link, err)
+		}
+		return nil
+	}
+	return linkLatestEnvFile(latest)
+}
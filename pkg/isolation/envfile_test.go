@@ -0,0 +1,112 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports/portstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvironmentManager_EnvFilePerEnvironment(t *testing.T) {
+	worktree := t.TempDir()
+	config := &Config{
+		WorktreePath: worktree,
+		LockDir:      filepath.Join(t.TempDir(), "locks"),
+		MaxRetries:   10,
+	}
+	manager := NewEnvironmentManager(NewIDGenerator(config), portstest.NewFakeAllocator(20000))
+	link := filepath.Join(worktree, DefaultEnvFileName)
+
+	first, err := manager.CreateEnvironment(2)
+	require.NoError(t, err)
+	// Keep the modification times apart for the relink order
+	past := time.Now().Add(-time.Minute)
+	require.NoError(t, os.Chtimes(first.EnvFile, past, past))
+	second, err := manager.CreateEnvironment(2)
+	require.NoError(t, err)
+
+	assert.Equal(t, filepath.Join(worktree, EnvFileName(first.ID)), first.EnvFile)
+	assert.Equal(t, filepath.Join(worktree, EnvFileName(second.ID)), second.EnvFile)
+	assert.Equal(t, first.ID, EnvFileOwner(first.EnvFile), "not overwritten by the second environment")
+	target, err := os.Readlink(link)
+	require.NoError(t, err)
+	assert.Equal(t, EnvFileName(second.ID), target, "links the latest environment")
+	assert.NoError(t, manager.Validate(first))
+	assert.Equal(t, first.EnvFile, FindEnvFile(worktree, first.ID))
+
+	require.NoError(t, manager.Cleanup(second))
+	assert.FileExists(t, first.EnvFile)
+	target, err = os.Readlink(link)
+	require.NoError(t, err)
+	assert.Equal(t, EnvFileName(first.ID), target, "relinked to the remaining environment")
+
+	require.NoError(t, manager.Cleanup(first))
+	_, err = os.Lstat(link)
+	assert.True(t, os.IsNotExist(err), "removed with the last environment")
+
+	assert.Equal(t, filepath.Join(worktree, DefaultEnvFileName), FindEnvFile(worktree, first.ID), "falls back to the legacy name once removed")
+}
+
+func TestEnvironmentManager_LegacyEnvFileLeftAlone(t *testing.T) {
+	worktree := t.TempDir()
+	config := &Config{
+		WorktreePath: worktree,
+		LockDir:      filepath.Join(t.TempDir(), "locks"),
+		MaxRetries:   10,
+	}
+	manager := NewEnvironmentManager(NewIDGenerator(config), portstest.NewFakeAllocator(20000))
+	legacy := filepath.Join(worktree, DefaultEnvFileName)
+	require.NoError(t, os.WriteFile(legacy, []byte("ISOLATION_ID=older\n"), 0o600))
+
+	env, err := manager.CreateEnvironment(2)
+	require.NoError(t, err)
+	require.NoError(t, manager.Cleanup(env))
+
+	data, err := os.ReadFile(legacy)
+	require.NoError(t, err)
+	assert.Equal(t, "ISOLATION_ID=older\n", string(data))
+	assert.Equal(t, legacy, FindEnvFile(worktree, env.ID), "falls back to the legacy name")
+}
+
+func TestEnvironmentManager_SharedEnvFile(t *testing.T) {
+	worktree := t.TempDir()
+	config := &Config{
+		WorktreePath: worktree,
+		LockDir:      filepath.Join(t.TempDir(), "locks"),
+		MaxRetries:   10,
+		EnvFilePath:  ".env.test",
+	}
+	manager := NewEnvironmentManager(NewIDGenerator(config), portstest.NewFakeAllocator(20000))
+
+	first, err := manager.CreateEnvironment(2)
+	require.NoError(t, err)
+	second, err := manager.CreateEnvironment(2)
+	require.NoError(t, err)
+	require.Equal(t, first.EnvFile, second.EnvFile)
+
+	assert.ErrorContains(t, manager.Validate(first), "was overwritten by environment "+second.ID)
+
+	// Cleaning up the first environment keeps the second's file
+	require.NoError(t, manager.Cleanup(first))
+	assert.FileExists(t, second.EnvFile)
+	require.NoError(t, manager.Cleanup(second))
+	assert.NoFileExists(t, second.EnvFile)
+}
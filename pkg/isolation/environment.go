@@ -17,49 +17,189 @@ package isolation
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
 )
 
 // Environment represents an isolated test environment.
 type Environment struct {
-	ID           string
-	WorktreePath string
-	TempDir      string
-	Ports        *ports.PortRange
-	LockFile     string
-	EnvFile      string
+	ID string
+	// Name is the optional human-friendly name given at creation.
+	Name string
+	// Project is the project namespace the environment belongs to.
+	Project string
+	// InstanceID is the Config.InstanceID the environment was created
+	// with, or empty if NewIDGenerator derived it; see
+	// GetOrCreateByInstanceID.
+	InstanceID string
+	// ComposePrefix prefixes the ID in COMPOSE_PROJECT_NAME; empty means
+	// DefaultComposePrefix. See ComposeProjectName.
+	ComposePrefix string
+	WorktreePath  string
+	TempDir       string
+	Ports         *ports.PortRange
+	LockFile      string
+	// EnvFile is the primary env file; EnvFiles lists every env file
+	// written for the environment, starting with EnvFile.
+	EnvFile  string
+	EnvFiles []string
+	// GitBranch and GitCommit identify the checkout the environment was
+	// created from; both are empty outside a git repository.
+	GitBranch string
+	GitCommit string
+	// Layout reports whether the standard temp subdirectories were created.
+	Layout bool
+	// DockerNetwork is the docker network created for the environment, if
+	// any. EnvironmentManager never creates networks; callers that do
+	// record them here, see DockerNetworkName.
+	DockerNetwork string
+	// Profile is the profile the environment was created with, if any.
+	Profile *Profile
+	// IdempotencyKey is the key the environment was created under, e.g. a
+	// CI job ID. EnvironmentManager never sets it; callers that retry
+	// creation record it here.
+	IdempotencyKey string
 }
 
-// PortAllocator interface for port allocation.
-type PortAllocator interface {
-	AllocateRange(int) (int, error)
-	IsPortInUse(int) bool
+// Vars returns exactly the variables written to the environment's env file.
+func (env *Environment) Vars() map[string]string {
+	vars := make(map[string]string)
+	for _, v := range envVariables(env) {
+		vars[v.name] = v.value
+	}
+	return vars
 }
 
-// EnvironmentManager manages isolated test environments.
+// VarNames returns the names of Vars in env file order.
+func (env *Environment) VarNames() []string {
+	vars := envVariables(env)
+	names := make([]string, len(vars))
+	for i, v := range vars {
+		names[i] = v.name
+	}
+	return names
+}
+
+// Addr returns the loopback address "127.0.0.1:PORT" of the port at index i.
+func (env *Environment) Addr(i int) (string, error) {
+	port, err := env.Ports.GetPort(i)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), nil
+}
+
+// URL returns a URL such as "http://127.0.0.1:PORT" for the port at index i.
+func (env *Environment) URL(scheme string, i int) (string, error) {
+	addr, err := env.Addr(i)
+	if err != nil {
+		return "", err
+	}
+	return scheme + "://" + addr, nil
+}
+
+// ServicePort returns the port for a service name or a zero-based index.
+// Names match the conventional port variables case-insensitively, so "api"
+// and "API_PORT" both select API_PORT; "portN" selects index N as in Services.
+func (env *Environment) ServicePort(name string) (int, error) {
+	if i, err := strconv.Atoi(strings.TrimPrefix(strings.ToLower(name), "port")); err == nil {
+		return env.Ports.GetPort(i)
+	}
 
+	for i, portName := range env.portNames() {
+		if strings.EqualFold(portName, name) || strings.EqualFold(portName, name+"_PORT") {
+			return env.Ports.GetPort(i)
+		}
+	}
+	return 0, fmt.Errorf("unknown service %q", name)
+}
+
+// PortAllocator interface for port allocation; see ports.PortAllocator.
+type PortAllocator = ports.PortAllocator
+
+// EnvironmentManager manages isolated test environments.
 type EnvironmentManager struct {
-	idGen     *IDGenerator
+	idGen     IDGenerator
 	portAlloc PortAllocator
+	config    *Config
+}
+
+// portReleaser is implemented by allocators that hold claims on allocated
+// ports, such as a coordinated ports.Allocator.
+type portReleaser interface {
+	Release(basePort, count int)
+}
+
+// releasePorts returns claimed ports to the allocator, if it holds claims.
+func (em *EnvironmentManager) releasePorts(basePort, count int) {
+	if releaser, ok := em.portAlloc.(portReleaser); ok {
+		releaser.Release(basePort, count)
+	}
+}
+
+// configProvider is implemented by ID generators that carry a Config.
+type configProvider interface {
+	Config() *Config
 }
 
 // NewEnvironmentManager creates a new environment manager.
-func NewEnvironmentManager(idGen *IDGenerator, portAlloc PortAllocator) *EnvironmentManager {
+//
+// If idGen is nil, the default SHA256 generator is used. The manager takes
+// its Config from idGen when it provides one; otherwise it uses
+// DefaultConfig() for the current directory. If portAlloc is nil, a
+// ports.Allocator with the default configuration is used, probing with
+// Config.Listen and waiting with Config.Clock when they are set.
+func NewEnvironmentManager(idGen IDGenerator, portAlloc PortAllocator) *EnvironmentManager {
 	if idGen == nil {
 		idGen = NewIDGenerator(nil)
 	}
 
+	var config *Config
+	if cp, ok := idGen.(configProvider); ok && cp.Config() != nil {
+		config = cp.Config()
+	} else {
+		config = DefaultConfig()
+		if wd, err := os.Getwd(); err == nil {
+			config.WorktreePath = wd
+		} else {
+			config.WorktreePath = "."
+		}
+	}
+
+	if portAlloc == nil {
+		portAlloc = ports.NewAllocator(nil, ports.WithListenFunc(config.Listen), ports.WithClock(config.Clock))
+	}
+
 	return &EnvironmentManager{
 		idGen:     idGen,
 		portAlloc: portAlloc,
+		config:    config,
 	}
 }
 
-// CreateEnvironment creates a new isolated environment.
+// CreateEnvironment creates a new isolated environment. With a profile,
+// at least as many ports as the profile names are allocated.
 func (em *EnvironmentManager) CreateEnvironment(portsNeeded int) (*Environment, error) {
+	if em.config.Name != "" {
+		if err := ValidateName(em.config.Name); err != nil {
+			return nil, err
+		}
+	}
+	if profile := em.config.Profile; profile != nil {
+		if err := profile.Validate(); err != nil {
+			return nil, err
+		}
+		if portsNeeded < len(profile.Ports) {
+			portsNeeded = len(profile.Ports)
+		}
+	}
+
 	// Generate unique ID
 	isolationID, err := em.idGen.Generate()
 	if err != nil {
@@ -78,66 +218,306 @@ func (em *EnvironmentManager) CreateEnvironment(portsNeeded int) (*Environment,
 		_ = em.idGen.ReleaseLock(isolationID)
 		return nil, fmt.Errorf("failed to allocate ports: %w", err)
 	}
+	if err := writeLockPorts(lockFile, basePort, portsNeeded); err != nil {
+		em.releasePorts(basePort, portsNeeded)
+		_ = em.idGen.ReleaseLock(isolationID)
+		return nil, err
+	}
 
 	// Create temporary directory
-	tmpDir := filepath.Join(os.TempDir(), fmt.Sprintf("aigis-test-%s", isolationID))
+	tmpDir := TempDirPath(isolationID)
 	if err := os.MkdirAll(tmpDir, 0o750); err != nil {
+		em.releasePorts(basePort, portsNeeded)
 		_ = em.idGen.ReleaseLock(isolationID)
 		return nil, fmt.Errorf("failed to create temp directory: %w", err)
 	}
 
 	env := &Environment{
-		ID:           isolationID,
-		WorktreePath: em.idGen.config.WorktreePath,
-		TempDir:      tmpDir,
+		ID:            isolationID,
+		Name:          em.config.Name,
+		Project:       em.config.Project,
+		InstanceID:    em.config.explicitInstanceID(),
+		ComposePrefix: em.config.ComposePrefix,
+		WorktreePath:  em.config.WorktreePath,
+		TempDir:       tmpDir,
 		Ports: &ports.PortRange{
 			BasePort: basePort,
 			Count:    portsNeeded,
 		},
 		LockFile: lockFile,
+		Profile:  em.config.Profile,
+	}
+	if env.Project == "" {
+		env.Project = ProjectKey(env.WorktreePath)
+	}
+	if git := DetectGit(env.WorktreePath); git != nil {
+		env.GitBranch = git.Branch
+		env.GitCommit = git.Commit
 	}
 
-	// Create environment file
-	envFile, err := em.createEnvFile(env)
-	if err != nil {
+	// Record the owner where a stray temp directory will be found
+	if err := writeManifest(env, em.config.host(), em.config.clock().Now()); err != nil {
 		_ = em.Cleanup(env)
-		return nil, fmt.Errorf("failed to create env file: %w", err)
+		return nil, err
+	}
+
+	// Publish the service registry
+	if err := writeServicesFile(env); err != nil {
+		_ = em.Cleanup(env)
+		return nil, err
+	}
+
+	// Create standard temp subdirectories
+	if em.config.TempLayout {
+		if err := createLayout(env); err != nil {
+			_ = em.Cleanup(env)
+			return nil, err
+		}
+		env.Layout = true
+	}
+
+	// Create environment files
+	if !em.config.NoEnvFile {
+		if err := em.createEnvFiles(env); err != nil {
+			_ = em.Cleanup(env)
+			return nil, fmt.Errorf("failed to create env file: %w", err)
+		}
+	}
+
+	// Keep generated env files out of commits
+	if em.config.GitIgnore != GitIgnoreOff && len(env.EnvFiles) > 0 {
+		if err := ignoreFiles(env.WorktreePath, em.config.GitIgnore, ignoredEnvFiles(env)); err != nil {
+			_ = em.Cleanup(env)
+			return nil, fmt.Errorf("failed to update git ignore rules: %w", err)
+		}
+	}
+
+	// Update direnv file
+	if em.config.Envrc {
+		if _, err := writeEnvrc(env); err != nil {
+			_ = em.Cleanup(env)
+			return nil, fmt.Errorf("failed to update envrc: %w", err)
+		}
 	}
-	env.EnvFile = envFile
 
 	return env, nil
 }
 
-// createEnvFile creates an environment variable file.
-func (em *EnvironmentManager) createEnvFile(env *Environment) (string, error) {
-	envFilePath := filepath.Join(env.WorktreePath, ".env.isolation")
+// Spec describes one environment for CreateEnvironments.
+type Spec struct {
+	// Ports is the number of ports to allocate, as for CreateEnvironment.
+	Ports int
+	// Name overrides Config.Name for this environment when set.
+	Name string
+	// EnvFiles overrides the configured env file paths, primary first,
+	// when set. Give each environment its own paths so they don't
+	// overwrite each other's files.
+	EnvFiles []string
+}
+
+// maxOverlapRetries bounds how often CreateEnvironments reallocates an
+// environment whose ports overlap an earlier one's.
+const maxOverlapRetries = 10
 
+// CreateEnvironments creates one environment per spec as a unit: if any
+// of them fails, the ones already created are cleaned up and the error is
+// returned. The allocated port ranges never overlap each other.
+//
+// The overrides in each Spec are applied to the manager's Config while
+// that environment is created, so CreateEnvironments must not run
+// concurrently with other calls on em.
+func (em *EnvironmentManager) CreateEnvironments(specs []Spec) ([]*Environment, error) {
+	envs := make([]*Environment, 0, len(specs))
+	rollback := func() {
+		for _, env := range envs {
+			_ = em.Cleanup(env)
+		}
+	}
+
+	for i, spec := range specs {
+		env, err := em.createSpec(spec, envs)
+		if err != nil {
+			rollback()
+			return nil, fmt.Errorf("environment %d of %d: %w", i+1, len(specs), err)
+		}
+		envs = append(envs, env)
+	}
+	return envs, nil
+}
+
+// createSpec creates the environment for spec, reallocating while its
+// ports overlap those of an environment in created.
+func (em *EnvironmentManager) createSpec(spec Spec, created []*Environment) (*Environment, error) {
+	name, envFile, extra := em.config.Name, em.config.EnvFilePath, em.config.ExtraEnvFiles
+	defer func() {
+		em.config.Name, em.config.EnvFilePath, em.config.ExtraEnvFiles = name, envFile, extra
+	}()
+	if spec.Name != "" {
+		em.config.Name = spec.Name
+	}
+	if len(spec.EnvFiles) > 0 {
+		em.config.EnvFilePath, em.config.ExtraEnvFiles = spec.EnvFiles[0], spec.EnvFiles[1:]
+	}
+
+	for attempt := 0; ; attempt++ {
+		env, err := em.CreateEnvironment(spec.Ports)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.ContainsFunc(created, func(other *Environment) bool {
+			return portsOverlap(env.Ports, other.Ports)
+		}) {
+			return env, nil
+		}
+		_ = em.Cleanup(env)
+		if attempt == maxOverlapRetries {
+			return nil, fmt.Errorf("failed to allocate ports: range overlaps another environment after %d attempts", attempt+1)
+		}
+	}
+}
+
+// portsOverlap reports whether two port ranges share a port.
+func portsOverlap(a, b *ports.PortRange) bool {
+	return a.BasePort < b.BasePort+b.Count && b.BasePort < a.BasePort+a.Count
+}
+
+// envFilePaths returns the configured env file paths, primary first.
+// Relative paths are resolved against the worktree. Without a configured
+// path, the primary env file is named per environment; see EnvFileName.
+func (em *EnvironmentManager) envFilePaths(env *Environment) []string {
+	primary := em.config.EnvFilePath
+	if primary == "" {
+		primary = EnvFileName(env.ID)
+	}
+
+	paths := make([]string, 0, 1+len(em.config.ExtraEnvFiles))
+	for _, p := range append([]string{primary}, em.config.ExtraEnvFiles...) {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(env.WorktreePath, p)
+		}
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// createEnvFiles writes the env file to every configured path, recording
+// each written path on env so a failed creation can be cleaned up. A
+// per-environment primary file becomes the target of the DefaultEnvFileName
+// symlink.
+func (em *EnvironmentManager) createEnvFiles(env *Environment) error {
+	for _, path := range em.envFilePaths(env) {
+		if err := writeEnvFile(path, env, em.config.Strict); err != nil {
+			return err
+		}
+		if env.EnvFile == "" {
+			env.EnvFile = path
+		}
+		env.EnvFiles = append(env.EnvFiles, path)
+	}
+	if isDefaultEnvFile(env, env.EnvFile) {
+		return linkLatestEnvFile(env.EnvFile)
+	}
+	return nil
+}
+
+// isDefaultEnvFile reports whether path is env's per-environment env file.
+func isDefaultEnvFile(env *Environment, path string) bool {
+	return path != "" && filepath.Base(path) == EnvFileName(env.ID)
+}
+
+// ignoredEnvFiles returns the env files of env to register as ignored. The
+// per-environment file is covered by a pattern matching the symlink and the
+// files of every other environment of the directory, so ignore rules don't
+// grow with each environment.
+func ignoredEnvFiles(env *Environment) []string {
+	files := make([]string, len(env.EnvFiles))
+	for i, path := range env.EnvFiles {
+		if isDefaultEnvFile(env, path) {
+			path = latestLink(path) + "*"
+		}
+		files[i] = path
+	}
+	return files
+}
+
+// writeEnvFile writes an environment variable file to envFilePath. Errors
+// writing the content are only returned in strict mode.
+func writeEnvFile(envFilePath string, env *Environment, strict bool) error {
 	// #nosec G304 - envFilePath is constructed from controlled inputs
 	f, err := os.Create(envFilePath)
 	if err != nil {
-		return "", fmt.Errorf("failed to create env file: %w", err)
+		return fmt.Errorf("failed to create env file: %w", err)
 	}
-	defer f.Close()
 
 	// Write environment variables
-	_, _ = fmt.Fprintf(f, "# Parallel Test Environment Isolation\n")
-	_, _ = fmt.Fprintf(f, "# Generated: %s\n\n", env.ID)
-	_, _ = fmt.Fprintf(f, "ISOLATION_ID=%s\n", env.ID)
-	_, _ = fmt.Fprintf(f, "TEMP_DIR=%s\n", env.TempDir)
-	_, _ = fmt.Fprintf(f, "PORT_BASE=%d\n", env.Ports.BasePort)
-	_, _ = fmt.Fprintf(f, "PORT_COUNT=%d\n", env.Ports.Count)
-
-	// Write individual port assignments
-	portNames := []string{"FIRESTORE_PORT", "AUTH_PORT", "API_PORT", "METRICS_PORT", "DEBUG_PORT"}
-	for i := 0; i < env.Ports.Count && i < len(portNames); i++ {
+	var b strings.Builder
+	b.WriteString("# Parallel Test Environment Isolation\n")
+	fmt.Fprintf(&b, "# Generated: %s\n\n", env.ID)
+	for _, v := range envVariables(env) {
+		fmt.Fprintf(&b, "%s=%s\n", v.name, ShellQuote(v.value))
+	}
+	_, err = f.WriteString(b.String())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil && strict {
+		return fmt.Errorf("failed to write env file %s: %w", envFilePath, err)
+	}
+	return nil
+}
+
+// ShellQuote single-quotes s for the shell unless it only contains safe
+// characters, so values with spaces, quotes, or newlines survive being
+// sourced or eval'd.
+func ShellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("_-./:@,+=%", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// envVar is a single NAME=value pair exported for an environment.
+type envVar struct {
+	name  string
+	value string
+}
+
+// portNames are the conventional variable names assigned to the first ports of a range.
+var portNames = []string{"FIRESTORE_PORT", "AUTH_PORT", "API_PORT", "METRICS_PORT", "DEBUG_PORT"}
+
+// envVariables returns the variables exported for an environment, in file order.
+func envVariables(env *Environment) []envVar {
+	vars := []envVar{
+		{"ISOLATION_ID", env.ID},
+		{"COMPOSE_PROJECT_NAME", env.ComposeProjectName()},
+		{"DOCKER_NETWORK", env.DockerNetworkName()},
+		{"TEMP_DIR", env.TempDir},
+		{"PORT_BASE", strconv.Itoa(env.Ports.BasePort)},
+		{"PORT_COUNT", strconv.Itoa(env.Ports.Count)},
+		{"SERVICES_FILE", env.ServicesFile()},
+	}
+
+	// Individual port assignments
+	names := env.portNames()
+	for i := 0; i < env.Ports.Count && i < len(names); i++ {
 		port, err := env.Ports.GetPort(i)
 		if err != nil {
 			continue
 		}
-		_, _ = fmt.Fprintf(f, "%s=%d\n", portNames[i], port)
+		vars = append(vars, envVar{names[i], strconv.Itoa(port)})
 	}
 
-	return envFilePath, nil
+	if env.Layout {
+		for _, dir := range layoutDirs {
+			vars = append(vars, envVar{dir.varName, filepath.Join(env.TempDir, dir.subdir)})
+		}
+	}
+
+	vars = append(vars, env.profileVars(vars)...)
+
+	return vars
 }
 
 // Cleanup removes all resources associated with the environment.
@@ -149,11 +529,36 @@ func (em *EnvironmentManager) Cleanup(env *Environment) error {
 		errors = append(errors, fmt.Errorf("failed to remove temp dir: %w", err))
 	}
 
-	// Remove env file
-	if env.EnvFile != "" {
-		if err := os.Remove(env.EnvFile); err != nil && !os.IsNotExist(err) {
+	// Remove env files, except those another environment has overwritten
+	removed := make(map[string]bool)
+	for _, envFile := range append([]string{env.EnvFile}, env.EnvFiles...) {
+		if envFile == "" || removed[envFile] {
+			continue
+		}
+		removed[envFile] = true
+		if owner := EnvFileOwner(envFile); owner != "" && owner != env.ID {
+			continue
+		}
+		if err := os.Remove(envFile); err != nil && !os.IsNotExist(err) {
 			errors = append(errors, fmt.Errorf("failed to remove env file: %w", err))
 		}
+		if isDefaultEnvFile(env, envFile) {
+			if err := unlinkEnvFile(envFile); err != nil {
+				errors = append(errors, err)
+			}
+		}
+	}
+
+	// Remove managed .envrc block
+	if env.WorktreePath != "" {
+		if err := removeEnvrcBlock(env.WorktreePath, env.ID); err != nil {
+			errors = append(errors, fmt.Errorf("failed to clean envrc: %w", err))
+		}
+	}
+
+	// Return claimed ports to the allocator
+	if env.Ports != nil && env.Ports.Count > 0 {
+		em.releasePorts(env.Ports.BasePort, env.Ports.Count)
 	}
 
 	// Release lock
@@ -168,8 +573,104 @@ func (em *EnvironmentManager) Cleanup(env *Environment) error {
 	return nil
 }
 
-// Validate checks if the environment is properly isolated.
-func (em *EnvironmentManager) Validate(env *Environment) error {
+// Recreate brings back an environment removed by Cleanup, e.g. from its
+// state record: the lock is created again for the same ID, the temp
+// directory, manifest, services file, and layout are recreated (empty),
+// and the env files are rewritten. Env files whose directory no longer
+// exists are skipped and dropped from env.
+//
+// Recreate fails with ErrLockConflict if the ID is locked again, and when
+// a port of env is in use or overlaps one of others, typically every
+// environment recorded in the state. On failure, whatever was recreated
+// is removed again.
+func (em *EnvironmentManager) Recreate(env *Environment, others ...*Environment) error {
+	if env.Ports == nil || env.Ports.Count == 0 {
+		return fmt.Errorf("environment %s has no ports recorded", env.ID)
+	}
+	for _, other := range others {
+		if other.ID != env.ID && other.Ports != nil && portsOverlap(env.Ports, other.Ports) {
+			return fmt.Errorf("ports %d-%d overlap environment %s", env.Ports.BasePort, env.Ports.BasePort+env.Ports.Count-1, other.ID)
+		}
+	}
+	var inUse []int
+	for _, port := range env.Ports.Ports() {
+		if em.portAlloc.IsPortInUse(port) {
+			inUse = append(inUse, port)
+		}
+	}
+	if len(inUse) > 0 {
+		return fmt.Errorf("ports in use: %v", inUse)
+	}
+
+	// The lock records the environment's own name, project, and worktree
+	config := *em.config
+	config.Name, config.Project, config.WorktreePath = env.Name, env.Project, env.WorktreePath
+	lockFile, err := NewIDGenerator(&config).CreateLock(env.ID)
+	if err != nil {
+		return fmt.Errorf("failed to create lock: %w", err)
+	}
+	env.LockFile = lockFile
+	if err := writeLockPorts(lockFile, env.Ports.BasePort, env.Ports.Count); err != nil {
+		_ = em.idGen.ReleaseLock(env.ID)
+		return err
+	}
+
+	if env.TempDir == "" {
+		env.TempDir = TempDirPath(env.ID)
+	}
+	envFiles := env.EnvFiles
+	if len(envFiles) == 0 && env.EnvFile != "" {
+		envFiles = []string{env.EnvFile}
+	}
+	env.EnvFile, env.EnvFiles = "", nil
+
+	if err := os.MkdirAll(env.TempDir, 0o750); err != nil {
+		_ = em.Cleanup(env)
+		return fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	if err := writeManifest(env, em.config.host(), em.config.clock().Now()); err != nil {
+		_ = em.Cleanup(env)
+		return err
+	}
+	if err := writeServicesFile(env); err != nil {
+		_ = em.Cleanup(env)
+		return err
+	}
+	if env.Layout {
+		if err := createLayout(env); err != nil {
+			_ = em.Cleanup(env)
+			return err
+		}
+	}
+
+	for _, path := range envFiles {
+		if _, err := os.Stat(filepath.Dir(path)); err != nil {
+			continue
+		}
+		if err := writeEnvFile(path, env, em.config.Strict); err != nil {
+			_ = em.Cleanup(env)
+			return fmt.Errorf("failed to create env file: %w", err)
+		}
+		if env.EnvFile == "" {
+			env.EnvFile = path
+		}
+		env.EnvFiles = append(env.EnvFiles, path)
+	}
+	if isDefaultEnvFile(env, env.EnvFile) {
+		if err := linkLatestEnvFile(env.EnvFile); err != nil {
+			_ = em.Cleanup(env)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Validate checks if the environment is properly isolated. Its ports are
+// compared against others, typically every environment recorded in the
+// state, and against live listeners; collisions are returned as a
+// *PortCollisionError.
+func (em *EnvironmentManager) Validate(env *Environment, others ...*Environment) error {
 	// Check lock exists
 	if !em.idGen.IsLocked(env.ID) {
 		return fmt.Errorf("lock file missing for %s", env.ID)
@@ -180,23 +681,24 @@ func (em *EnvironmentManager) Validate(env *Environment) error {
 		return fmt.Errorf("temp directory missing: %s", env.TempDir)
 	}
 
-	// Check env file exists
-	if _, err := os.Stat(env.EnvFile); os.IsNotExist(err) {
-		return fmt.Errorf("env file missing: %s", env.EnvFile)
-	}
-
-	// Check ports are still available (not ideal but validates allocation)
-	for i := 0; i < env.Ports.Count; i++ {
-		port, err := env.Ports.GetPort(i)
-		if err != nil {
-			return fmt.Errorf("invalid port index %d: %w", i, err)
+	// Check env file exists (environments created with NoEnvFile have none)
+	// and was not overwritten by another environment of the worktree
+	if env.EnvFile != "" && !em.config.NoEnvFile {
+		if _, err := os.Stat(env.EnvFile); os.IsNotExist(err) {
+			return fmt.Errorf("env file missing: %s", env.EnvFile)
 		}
-		if em.portAlloc.IsPortInUse(port) {
-			// Port is in use, which is expected if tests are running
-			// This is actually a good sign - just log it
-			continue
+		if owner := EnvFileOwner(env.EnvFile); owner != "" && owner != env.ID {
+			return fmt.Errorf("env file %s was overwritten by environment %s", env.EnvFile, owner)
 		}
 	}
 
+	// Bound ports are expected while tests run; they only collide when
+	// another environment allocated them or a process outside env holds
+	// them. Unreadable listener tables leave allocation overlaps to check.
+	listeners, _ := ports.ListenerPIDs()
+	if collisions := PortCollisions(env, others, listeners); len(collisions) > 0 {
+		return &PortCollisionError{ID: env.ID, Collisions: collisions}
+	}
+
 	return nil
 }
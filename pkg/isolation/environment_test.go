@@ -15,36 +15,54 @@
 package isolation
 
 import (
+	"fmt"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
-	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports/portstest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-// mockPortAllocator implements PortAllocator for testing
-type mockPortAllocator struct {
-	basePort atomic.Int32
+// fixedIDGenerator implements IDGenerator with a caller-chosen ID
+type fixedIDGenerator struct {
+	*SHA256Generator
+	id string
 }
 
-func newMockPortAllocator(startPort int) *mockPortAllocator {
-	m := &mockPortAllocator{}
-	m.basePort.Store(int32(startPort))
-	return m
+func (g *fixedIDGenerator) Generate() (string, error) {
+	return g.id, nil
 }
 
-func (m *mockPortAllocator) AllocateRange(count int) (int, error) {
-	port := m.basePort.Add(int32(count + 100))
-	return int(port) - (count + 100), nil
-}
+func TestEnvironmentManager_CustomIDGenerator(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := &Config{
+		WorktreePath: tmpDir,
+		LockDir:      filepath.Join(tmpDir, "locks"),
+		MaxRetries:   10,
+	}
+
+	idGen := &fixedIDGenerator{SHA256Generator: NewIDGenerator(config), id: "ci-job-42"}
+	manager := NewEnvironmentManager(idGen, portstest.NewFakeAllocator(20000))
+
+	env, err := manager.CreateEnvironment(2)
+	require.NoError(t, err)
+	defer manager.Cleanup(env)
 
-func (m *mockPortAllocator) IsPortInUse(port int) bool {
-	return false
+	assert.Equal(t, "ci-job-42", env.ID)
+	assert.Equal(t, tmpDir, env.WorktreePath)
+	assert.True(t, idGen.IsLocked("ci-job-42"))
+
+	// The lock prevents a second environment with the same ID
+	_, err = manager.CreateEnvironment(2)
+	assert.Error(t, err)
 }
 
 func TestEnvironmentManager_CreateEnvironment(t *testing.T) {
@@ -56,7 +74,7 @@ func TestEnvironmentManager_CreateEnvironment(t *testing.T) {
 	}
 
 	idGen := NewIDGenerator(config)
-	portAlloc := newMockPortAllocator(20000)
+	portAlloc := portstest.NewFakeAllocator(20000)
 	manager := NewEnvironmentManager(idGen, portAlloc)
 
 	t.Run("creates valid environment", func(t *testing.T) {
@@ -119,9 +137,12 @@ func TestEnvironmentManager_createEnvFile(t *testing.T) {
 	}
 
 	t.Run("creates env file with correct content", func(t *testing.T) {
-		envFile, err := manager.createEnvFile(env)
+		err := manager.createEnvFiles(env)
 		require.NoError(t, err)
+		envFile := env.EnvFile
 		defer os.Remove(envFile)
+		assert.Equal(t, filepath.Join(tmpDir, DefaultEnvFileName+".test-123"), envFile)
+		defer os.Remove(filepath.Join(tmpDir, DefaultEnvFileName))
 
 		// Read and verify content
 		data, err := os.ReadFile(envFile)
@@ -138,6 +159,177 @@ func TestEnvironmentManager_createEnvFile(t *testing.T) {
 	})
 }
 
+func TestEnvironmentManager_EnvFilePaths(t *testing.T) {
+	tmpDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "api"), 0o750))
+	require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "web"), 0o750))
+	config := &Config{
+		WorktreePath:  tmpDir,
+		LockDir:       filepath.Join(tmpDir, "locks"),
+		MaxRetries:    10,
+		EnvFilePath:   "api/.env.test",
+		ExtraEnvFiles: []string{filepath.Join(tmpDir, "web", ".env.test")},
+	}
+
+	manager := NewEnvironmentManager(NewIDGenerator(config), portstest.NewFakeAllocator(20000))
+	env, err := manager.CreateEnvironment(2)
+	require.NoError(t, err)
+
+	assert.Equal(t, filepath.Join(tmpDir, "api", ".env.test"), env.EnvFile)
+	assert.Equal(t, []string{env.EnvFile, filepath.Join(tmpDir, "web", ".env.test")}, env.EnvFiles)
+	for _, f := range env.EnvFiles {
+		assert.FileExists(t, f)
+	}
+	assert.NoFileExists(t, filepath.Join(tmpDir, DefaultEnvFileName))
+
+	require.NoError(t, manager.Cleanup(env))
+	for _, f := range env.EnvFiles {
+		assert.NoFileExists(t, f)
+	}
+}
+
+func TestEnvironmentManager_NoEnvFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := &Config{
+		WorktreePath: tmpDir,
+		LockDir:      filepath.Join(tmpDir, "locks"),
+		MaxRetries:   10,
+		NoEnvFile:    true,
+	}
+
+	manager := NewEnvironmentManager(NewIDGenerator(config), portstest.NewFakeAllocator(20000))
+	env, err := manager.CreateEnvironment(2)
+	require.NoError(t, err)
+	defer manager.Cleanup(env)
+
+	assert.Empty(t, env.EnvFile)
+	assert.NoFileExists(t, filepath.Join(tmpDir, DefaultEnvFileName))
+	assert.NoError(t, manager.Validate(env))
+}
+
+func TestEnvironmentManager_StrictEnvFile(t *testing.T) {
+	// Every write to /dev/full fails with ENOSPC
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("/dev/full not available")
+	}
+	env := &Environment{ID: "abc", Ports: &ports.PortRange{BasePort: 20000, Count: 2}}
+	assert.NoError(t, writeEnvFile("/dev/full", env, false), "write errors are ignored by default")
+	assert.ErrorIs(t, writeEnvFile("/dev/full", env, true), syscall.ENOSPC)
+
+	tmpDir := t.TempDir()
+	config := &Config{
+		WorktreePath: tmpDir,
+		LockDir:      filepath.Join(tmpDir, "locks"),
+		MaxRetries:   10,
+		EnvFilePath:  "/dev/full",
+	}
+	config.Apply(WithStrict())
+	manager := NewEnvironmentManager(NewIDGenerator(config), portstest.NewFakeAllocator(20000))
+	_, err := manager.CreateEnvironment(2)
+	require.ErrorContains(t, err, "failed to write env file /dev/full")
+
+	// The failed environment was released
+	locks, err := filepath.Glob(filepath.Join(config.LockDir, "env-*.lock"))
+	require.NoError(t, err)
+	assert.Empty(t, locks)
+	_, err = os.Stat("/dev/full")
+	assert.NoError(t, err, "a file that was never written is not removed")
+}
+
+func TestEnvironmentManager_TempLayout(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := &Config{
+		WorktreePath: tmpDir,
+		LockDir:      filepath.Join(tmpDir, "locks"),
+		MaxRetries:   10,
+		TempLayout:   true,
+	}
+
+	manager := NewEnvironmentManager(NewIDGenerator(config), portstest.NewFakeAllocator(20000))
+	env, err := manager.CreateEnvironment(2)
+	require.NoError(t, err)
+	defer manager.Cleanup(env)
+
+	assert.True(t, env.Layout)
+	for _, dir := range []string{env.DataDir(), env.LogsDir(), env.TmpDir(), env.SocketsDir()} {
+		assert.DirExists(t, dir)
+	}
+
+	vars := env.Vars()
+	assert.Equal(t, env.DataDir(), vars["DATA_DIR"])
+	assert.Equal(t, env.LogsDir(), vars["LOGS_DIR"])
+	assert.Equal(t, filepath.Join(env.TempDir, "sockets"), vars["SOCKETS_DIR"])
+
+	data, err := os.ReadFile(env.EnvFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "DATA_DIR="+env.DataDir())
+}
+
+func TestEnvironment_ServicePort(t *testing.T) {
+	env := &Environment{Ports: &ports.PortRange{BasePort: 21000, Count: 3}}
+
+	for name, want := range map[string]int{"api": 21002, "API_PORT": 21002, "Auth": 21001, "0": 21000} {
+		port, err := env.ServicePort(name)
+		require.NoError(t, err, name)
+		assert.Equal(t, want, port, name)
+	}
+
+	_, err := env.ServicePort("metrics")
+	assert.Error(t, err, "metrics is beyond the allocated range")
+	_, err = env.ServicePort("unknown")
+	assert.Error(t, err)
+	_, err = env.ServicePort("7")
+	assert.Error(t, err)
+}
+
+func TestEnvironment_Vars(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := &Config{
+		WorktreePath: tmpDir,
+		LockDir:      filepath.Join(tmpDir, "locks"),
+		MaxRetries:   10,
+	}
+
+	manager := NewEnvironmentManager(NewIDGenerator(config), portstest.NewFakeAllocator(20000))
+	env, err := manager.CreateEnvironment(3)
+	require.NoError(t, err)
+	defer manager.Cleanup(env)
+
+	t.Run("matches env file content", func(t *testing.T) {
+		data, err := os.ReadFile(env.EnvFile)
+		require.NoError(t, err)
+
+		fileVars := map[string]string{}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			parts := strings.SplitN(line, "=", 2)
+			fileVars[parts[0]] = parts[1]
+		}
+
+		assert.Equal(t, fileVars, env.Vars())
+		assert.Equal(t, env.ID, env.Vars()["ISOLATION_ID"])
+	})
+}
+
+func TestEnvironment_AddrAndURL(t *testing.T) {
+	env := &Environment{Ports: &ports.PortRange{BasePort: 23000, Count: 2}}
+
+	addr, err := env.Addr(1)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:23001", addr)
+
+	url, err := env.URL("http", 0)
+	require.NoError(t, err)
+	assert.Equal(t, "http://127.0.0.1:23000", url)
+
+	_, err = env.Addr(2)
+	assert.Error(t, err)
+	_, err = env.URL("http", -1)
+	assert.Error(t, err)
+}
+
 func TestEnvironmentManager_Cleanup(t *testing.T) {
 	tmpDir := t.TempDir()
 	config := &Config{
@@ -147,7 +339,7 @@ func TestEnvironmentManager_Cleanup(t *testing.T) {
 	}
 
 	idGen := NewIDGenerator(config)
-	portAlloc := newMockPortAllocator(20000)
+	portAlloc := portstest.NewFakeAllocator(20000)
 	manager := NewEnvironmentManager(idGen, portAlloc)
 
 	t.Run("cleans up all resources", func(t *testing.T) {
@@ -186,6 +378,102 @@ func TestEnvironmentManager_Cleanup(t *testing.T) {
 		err = manager.Cleanup(env)
 		assert.NoError(t, err)
 	})
+
+	t.Run("releases coordinated port claims", func(t *testing.T) {
+		portConfig := ports.DefaultAllocatorConfig()
+		portConfig.StartPort = 41400
+		portConfig.EndPort = 41404
+		portConfig.MaxRetries = 1
+		portConfig.Coordinated = true
+		manager := NewEnvironmentManager(idGen, ports.NewAllocator(portConfig))
+
+		env, err := manager.CreateEnvironment(3)
+		require.NoError(t, err)
+		require.NoError(t, manager.Cleanup(env))
+
+		// The range only fits one environment, so this needs the claim released
+		env, err = manager.CreateEnvironment(3)
+		require.NoError(t, err)
+		assert.NoError(t, manager.Cleanup(env))
+	})
+
+	t.Run("releases coordinated port claims when creation fails", func(t *testing.T) {
+		portConfig := ports.DefaultAllocatorConfig()
+		portConfig.StartPort = 41410
+		portConfig.EndPort = 41414
+		portConfig.MaxRetries = 1
+		portConfig.Coordinated = true
+		manager := NewEnvironmentManager(idGen, ports.NewAllocator(portConfig))
+
+		// A file in place of the temp root: the temp directory cannot be created
+		notDir := filepath.Join(t.TempDir(), "file")
+		require.NoError(t, os.WriteFile(notDir, nil, 0o600))
+		t.Setenv("TMPDIR", notDir)
+		_, err := manager.CreateEnvironment(3)
+		require.Error(t, err)
+
+		t.Setenv("TMPDIR", t.TempDir())
+		env, err := manager.CreateEnvironment(3)
+		require.NoError(t, err)
+		assert.NoError(t, manager.Cleanup(env))
+	})
+}
+
+func TestEnvironmentManager_Recreate(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := &Config{
+		WorktreePath: tmpDir,
+		LockDir:      filepath.Join(tmpDir, "locks"),
+		Name:         "api",
+		MaxRetries:   10,
+	}
+	idGen := NewIDGenerator(config)
+	portAlloc := portstest.NewFakeAllocator(20000)
+	manager := NewEnvironmentManager(idGen, portAlloc)
+
+	env, err := manager.CreateEnvironment(3)
+	require.NoError(t, err)
+	require.NoError(t, manager.Cleanup(env))
+
+	t.Run("recreates lock and files", func(t *testing.T) {
+		restored := *env
+		require.NoError(t, manager.Recreate(&restored))
+		t.Cleanup(func() { _ = manager.Cleanup(&restored) })
+
+		assert.True(t, idGen.IsLocked(env.ID))
+		info, err := ReadLockInfo(restored.LockFile)
+		require.NoError(t, err)
+		assert.Equal(t, "api", info.Name)
+		assert.Equal(t, 20000, info.BasePort)
+		assert.DirExists(t, restored.TempDir)
+		assert.FileExists(t, restored.ServicesFile())
+
+		content, err := os.ReadFile(restored.EnvFile)
+		require.NoError(t, err)
+		assert.Contains(t, string(content), "ISOLATION_ID="+env.ID)
+
+		assert.ErrorIs(t, manager.Recreate(&restored), ErrLockConflict, "already recreated")
+	})
+
+	t.Run("skips env files in missing directories", func(t *testing.T) {
+		restored := *env
+		restored.EnvFiles = []string{env.EnvFile, filepath.Join(tmpDir, "gone", ".env")}
+		require.NoError(t, manager.Recreate(&restored))
+		defer func() { _ = manager.Cleanup(&restored) }()
+
+		assert.Equal(t, []string{env.EnvFile}, restored.EnvFiles)
+	})
+
+	t.Run("refuses overlapping or busy ports", func(t *testing.T) {
+		other := &Environment{ID: "other", Ports: &ports.PortRange{BasePort: 20002, Count: 2}}
+		restored := *env
+		assert.ErrorContains(t, manager.Recreate(&restored, other), "overlap environment other")
+
+		portAlloc.SetBusy(20001)
+		restored = *env
+		assert.ErrorContains(t, manager.Recreate(&restored), "ports in use: [20001]")
+		assert.False(t, idGen.IsLocked(env.ID))
+	})
 }
 
 func TestEnvironmentManager_Validate(t *testing.T) {
@@ -196,7 +484,7 @@ func TestEnvironmentManager_Validate(t *testing.T) {
 		MaxRetries:   10,
 	}
 
-	portAlloc := newMockPortAllocator(20000)
+	portAlloc := portstest.NewFakeAllocator(20000)
 	manager := NewEnvironmentManager(NewIDGenerator(config), portAlloc)
 
 	t.Run("validates healthy environment", func(t *testing.T) {
@@ -256,7 +544,7 @@ func TestEnvironmentManager_ConcurrentEnvironments(t *testing.T) {
 		MaxRetries:   10,
 	}
 
-	portAlloc := newMockPortAllocator(20000)
+	portAlloc := portstest.NewFakeAllocator(20000)
 	manager := NewEnvironmentManager(NewIDGenerator(config), portAlloc)
 
 	t.Run("creates multiple environments concurrently", func(t *testing.T) {
@@ -313,7 +601,7 @@ func TestEnvironmentManager_ConcurrentEnvironments(t *testing.T) {
 func TestNewEnvironmentManager(t *testing.T) {
 	t.Run("uses provided components", func(t *testing.T) {
 		idGen := NewIDGenerator(nil)
-		portAlloc := newMockPortAllocator(20000)
+		portAlloc := portstest.NewFakeAllocator(20000)
 
 		manager := NewEnvironmentManager(idGen, portAlloc)
 		assert.Equal(t, idGen, manager.idGen)
@@ -321,8 +609,177 @@ func TestNewEnvironmentManager(t *testing.T) {
 	})
 
 	t.Run("creates default idGen when nil", func(t *testing.T) {
-		portAlloc := newMockPortAllocator(20000)
+		portAlloc := portstest.NewFakeAllocator(20000)
 		manager := NewEnvironmentManager(nil, portAlloc)
 		assert.NotNil(t, manager.idGen)
 	})
 }
+
+func TestEnvironmentManager_WithListenFunc(t *testing.T) {
+	tmpDir := t.TempDir()
+	clock := &stepClock{now: time.Now()}
+	config := (&Config{
+		WorktreePath: tmpDir,
+		LockDir:      filepath.Join(tmpDir, "locks"),
+		MaxRetries:   10,
+	}).Apply(
+		WithListenFunc(func(string, string) (net.Listener, error) { return nil, syscall.EADDRINUSE }),
+		WithClock(clock),
+	)
+	idGen := NewIDGenerator(config)
+
+	// A nil allocator selects the default one, which probes with Config.Listen
+	manager := NewEnvironmentManager(idGen, nil)
+	_, err := manager.CreateEnvironment(2)
+	require.ErrorContains(t, err, "failed to allocate ports")
+
+	// Every port looked busy, and the retries waited on the fake clock
+	assert.Equal(t, time.Duration(ports.DefaultMaxRetries)*time.Second, clock.slept)
+
+	entries, err := os.ReadDir(config.LockDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "lock must be released after a failed allocation")
+}
+
+func TestEnvironmentManager_Name(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := (&Config{
+		WorktreePath: tmpDir,
+		LockDir:      filepath.Join(tmpDir, "locks"),
+		MaxRetries:   10,
+	}).Apply(WithName("payments-it"))
+	manager := NewEnvironmentManager(NewIDGenerator(config), portstest.NewFakeAllocator(20000))
+
+	env, err := manager.CreateEnvironment(2)
+	require.NoError(t, err)
+	assert.Equal(t, "payments-it", env.Name)
+
+	info, err := ReadLockInfo(env.LockFile)
+	require.NoError(t, err)
+	assert.Equal(t, "payments-it", info.Name)
+
+	t.Run("rejects a name held by an active environment", func(t *testing.T) {
+		_, err := manager.CreateEnvironment(2)
+		require.ErrorIs(t, err, ErrNameInUse)
+
+		// The losing lock is removed again
+		entries, err := os.ReadDir(config.LockDir)
+		require.NoError(t, err)
+		assert.Len(t, entries, 1)
+	})
+
+	t.Run("frees the name on cleanup", func(t *testing.T) {
+		require.NoError(t, manager.Cleanup(env))
+
+		again, err := manager.CreateEnvironment(2)
+		require.NoError(t, err)
+		defer manager.Cleanup(again)
+		assert.Equal(t, "payments-it", again.Name)
+	})
+
+	t.Run("ignores expired locks with the name", func(t *testing.T) {
+		expired := filepath.Join(config.LockDir, "env-expired.lock")
+		lock := fmt.Sprintf("PID=999999\nTimestamp=%d\nWorktree=%s\nName=payments-it\n", time.Now().Add(-2*time.Hour).Unix(), tmpDir)
+		require.NoError(t, os.WriteFile(expired, []byte(lock), 0o600))
+		config.MaxLockAge = time.Hour
+
+		again, err := manager.CreateEnvironment(2)
+		require.NoError(t, err)
+		require.NoError(t, manager.Cleanup(again))
+	})
+
+	t.Run("rejects invalid names", func(t *testing.T) {
+		for _, name := range []string{"Payments", "-lead", "has space", "new\nline", strings.Repeat("a", 64)} {
+			config.Name = name
+			_, err := manager.CreateEnvironment(2)
+			assert.ErrorContains(t, err, "invalid environment name", name)
+		}
+	})
+}
+
+// sequenceAllocator returns the given base ports in order.
+type sequenceAllocator struct {
+	bases []int
+}
+
+func (a *sequenceAllocator) AllocateRange(int) (int, error) {
+	if len(a.bases) == 0 {
+		return 0, fmt.Errorf("no ports left")
+	}
+	base := a.bases[0]
+	a.bases = a.bases[1:]
+	return base, nil
+}
+
+func (a *sequenceAllocator) IsPortInUse(int) bool { return false }
+
+func TestEnvironmentManager_CreateEnvironments(t *testing.T) {
+	newManager := func(t *testing.T, alloc PortAllocator) (*EnvironmentManager, *Config) {
+		tmpDir := t.TempDir()
+		config := &Config{
+			WorktreePath: tmpDir,
+			LockDir:      filepath.Join(tmpDir, "locks"),
+			MaxRetries:   10,
+			Name:         "cluster",
+		}
+		return NewEnvironmentManager(NewIDGenerator(config), alloc), config
+	}
+
+	t.Run("creates every environment", func(t *testing.T) {
+		manager, config := newManager(t, portstest.NewFakeAllocator(20000))
+		envs, err := manager.CreateEnvironments([]Spec{
+			{Ports: 2, Name: "node-1", EnvFiles: []string{".env.node-1"}},
+			{Ports: 3, Name: "node-2", EnvFiles: []string{".env.node-2"}},
+			{Ports: 1},
+		})
+		require.NoError(t, err)
+		require.Len(t, envs, 3)
+		for _, env := range envs {
+			defer manager.Cleanup(env)
+		}
+
+		assert.Equal(t, "node-1", envs[0].Name)
+		assert.Equal(t, filepath.Join(config.WorktreePath, ".env.node-1"), envs[0].EnvFile)
+		assert.Equal(t, 3, envs[1].Ports.Count)
+		assert.Equal(t, "cluster", envs[2].Name)
+		assert.Equal(t, filepath.Join(config.WorktreePath, EnvFileName(envs[2].ID)), envs[2].EnvFile)
+
+		// The overrides only apply while each environment is created
+		assert.Equal(t, "cluster", config.Name)
+		assert.Empty(t, config.EnvFilePath)
+	})
+
+	t.Run("rolls back when one fails", func(t *testing.T) {
+		alloc := portstest.NewFakeAllocator(20000)
+		manager, config := newManager(t, alloc)
+		_, err := manager.CreateEnvironments([]Spec{
+			{Ports: 2, Name: "node-1", EnvFiles: []string{".env.node-1"}},
+			{Ports: 2, Name: "node-2", EnvFiles: []string{".env.node-2"}},
+			{Ports: 2, Name: "node-1", EnvFiles: []string{".env.node-3"}},
+		})
+		require.ErrorIs(t, err, ErrNameInUse)
+		assert.ErrorContains(t, err, "environment 3 of 3")
+
+		entries, err := os.ReadDir(config.LockDir)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+		for _, name := range []string{".env.node-1", ".env.node-2", ".env.node-3"} {
+			assert.NoFileExists(t, filepath.Join(config.WorktreePath, name))
+		}
+		assert.Len(t, alloc.Released(), 2)
+	})
+
+	t.Run("reallocates overlapping ranges", func(t *testing.T) {
+		manager, _ := newManager(t, &sequenceAllocator{bases: []int{20000, 20002, 20004}})
+		envs, err := manager.CreateEnvironments([]Spec{
+			{Ports: 3, Name: "a", EnvFiles: []string{".env.a"}},
+			{Ports: 3, Name: "b", EnvFiles: []string{".env.b"}},
+		})
+		require.NoError(t, err)
+		for _, env := range envs {
+			defer manager.Cleanup(env)
+		}
+		assert.Equal(t, 20000, envs[0].Ports.BasePort)
+		assert.Equal(t, 20004, envs[1].Ports.BasePort)
+	})
+}
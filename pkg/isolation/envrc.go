@@ -0,0 +1,112 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// EnvrcFileName is the direnv file updated when Config.Envrc is set.
+	EnvrcFileName = ".envrc"
+
+	envrcBlockBegin = "# BEGIN go-portalloc managed block"
+	envrcBlockEnd   = "# END go-portalloc managed block"
+)
+
+// writeEnvrc writes or replaces the go-portalloc managed block in the
+// worktree's .envrc, leaving any user content outside the block untouched.
+func writeEnvrc(env *Environment) (string, error) {
+	envrcPath := filepath.Join(env.WorktreePath, EnvrcFileName)
+
+	// #nosec G304 - envrcPath is constructed from controlled inputs
+	data, err := os.ReadFile(envrcPath)
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read %s: %w", EnvrcFileName, err)
+	}
+
+	content, _ := stripEnvrcBlock(string(data))
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+
+	var b strings.Builder
+	b.WriteString(content)
+	b.WriteString(envrcBlockBegin + "\n")
+	for _, v := range envVariables(env) {
+		fmt.Fprintf(&b, "export %s=%s\n", v.name, ShellQuote(v.value))
+	}
+	b.WriteString(envrcBlockEnd + "\n")
+
+	// #nosec G306 - .envrc is a user-owned shell file
+	if err := os.WriteFile(envrcPath, []byte(b.String()), 0o644); err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", EnvrcFileName, err)
+	}
+
+	return envrcPath, nil
+}
+
+// removeEnvrcBlock removes the managed block from the worktree's .envrc if it
+// belongs to the given isolation ID. The file is deleted when nothing else remains.
+func removeEnvrcBlock(worktreePath, isolationID string) error {
+	envrcPath := filepath.Join(worktreePath, EnvrcFileName)
+
+	// #nosec G304 - envrcPath is constructed from controlled inputs
+	data, err := os.ReadFile(envrcPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read %s: %w", EnvrcFileName, err)
+	}
+
+	content, block := stripEnvrcBlock(string(data))
+	if !strings.Contains(block, fmt.Sprintf("export ISOLATION_ID=%s\n", isolationID)) {
+		// Block is absent or owned by another environment
+		return nil
+	}
+
+	if strings.TrimSpace(content) == "" {
+		if err := os.Remove(envrcPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", EnvrcFileName, err)
+		}
+		return nil
+	}
+
+	// #nosec G306 - .envrc is a user-owned shell file
+	if err := os.WriteFile(envrcPath, []byte(content), 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", EnvrcFileName, err)
+	}
+	return nil
+}
+
+// stripEnvrcBlock splits content into the text outside the managed block and
+// the block itself (empty if there is none).
+func stripEnvrcBlock(content string) (rest, block string) {
+	start := strings.Index(content, envrcBlockBegin+"\n")
+	if start < 0 {
+		return content, ""
+	}
+	end := strings.Index(content[start:], envrcBlockEnd+"\n")
+	if end < 0 {
+		return content, ""
+	}
+	end += start + len(envrcBlockEnd) + 1
+
+	return content[:start] + content[end:], content[start:end]
+}
@@ -0,0 +1,83 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports/portstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvironmentManager_Envrc(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := &Config{
+		WorktreePath: tmpDir,
+		LockDir:      filepath.Join(tmpDir, "locks"),
+		MaxRetries:   10,
+		Envrc:        true,
+	}
+
+	manager := NewEnvironmentManager(NewIDGenerator(config), portstest.NewFakeAllocator(20000))
+	envrcPath := filepath.Join(tmpDir, EnvrcFileName)
+
+	t.Run("creates and removes managed block", func(t *testing.T) {
+		env, err := manager.CreateEnvironment(3)
+		require.NoError(t, err)
+
+		data, err := os.ReadFile(envrcPath)
+		require.NoError(t, err)
+		assert.Contains(t, string(data), envrcBlockBegin)
+		assert.Contains(t, string(data), "export ISOLATION_ID="+env.ID)
+		assert.Contains(t, string(data), "export FIRESTORE_PORT=")
+
+		require.NoError(t, manager.Cleanup(env))
+
+		_, err = os.Stat(envrcPath)
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("preserves user content and replaces previous block", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(envrcPath, []byte("layout go\n"), 0o644))
+		defer os.Remove(envrcPath)
+
+		env1, err := manager.CreateEnvironment(2)
+		require.NoError(t, err)
+		env2, err := manager.CreateEnvironment(2)
+		require.NoError(t, err)
+
+		data, err := os.ReadFile(envrcPath)
+		require.NoError(t, err)
+		content := string(data)
+		assert.True(t, strings.HasPrefix(content, "layout go\n"))
+		assert.Equal(t, 1, strings.Count(content, envrcBlockBegin))
+		assert.Contains(t, content, "export ISOLATION_ID="+env2.ID)
+
+		// Cleaning up the replaced environment leaves the current block alone
+		require.NoError(t, manager.Cleanup(env1))
+		data, err = os.ReadFile(envrcPath)
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "export ISOLATION_ID="+env2.ID)
+
+		require.NoError(t, manager.Cleanup(env2))
+		data, err = os.ReadFile(envrcPath)
+		require.NoError(t, err)
+		assert.Equal(t, "layout go\n", string(data))
+	})
+}
@@ -13,3 +13,21 @@
 // limitations under the License.
 
 package isolation
+
+import "errors"
+
+// ErrLockConflict is returned when an isolation ID is already locked by
+// another environment. Retrying with a new ID may succeed.
+var ErrLockConflict = errors.New("isolation ID already locked")
+
+// ErrNotFound is returned when no environment matches an ID, name, or
+// instance ID.
+var ErrNotFound = errors.New("environment not found")
+
+// ErrNameInUse is returned when an active environment already has the
+// requested name.
+var ErrNameInUse = errors.New("environment name already in use")
+
+// ErrPortCollision is returned by Validate when another environment
+// claims one of the environment's ports; see PortCollisionError.
+var ErrPortCollision = errors.New("port collision")
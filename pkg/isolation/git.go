@@ -0,0 +1,173 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// shortCommitLen is the length of abbreviated commit hashes.
+const shortCommitLen = 7
+
+// GitInfo describes the git checkout an environment was created from.
+type GitInfo struct {
+	// Branch is empty when HEAD is detached.
+	Branch string
+	// Commit is the abbreviated commit hash of HEAD.
+	Commit string
+}
+
+// DetectGit reads branch and commit for the repository containing path by
+// parsing .git directly (no git binary required). It supports linked
+// worktrees and packed refs, and returns nil if path is not in a git repo.
+func DetectGit(path string) *GitInfo {
+	gitDir, ok := findGitDir(path)
+	if !ok {
+		return nil
+	}
+
+	// #nosec G304 - gitDir is discovered from the worktree
+	data, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return nil
+	}
+	head := strings.TrimSpace(string(data))
+
+	info := &GitInfo{}
+	if ref, isRef := strings.CutPrefix(head, "ref: "); isRef {
+		info.Branch = strings.TrimPrefix(ref, "refs/heads/")
+		info.Commit = shortHash(resolveRef(gitDir, ref))
+	} else {
+		info.Commit = shortHash(head)
+	}
+
+	return info
+}
+
+// findGitDir walks up from path to the nearest .git directory, following
+// "gitdir:" files used by linked worktrees and submodules.
+func findGitDir(path string) (string, bool) {
+	_, gitDir, ok := findGitRoot(path)
+	return gitDir, ok
+}
+
+// findGitRoot is findGitDir that also returns the top-level directory of
+// the working tree containing path.
+func findGitRoot(path string) (top, gitDir string, ok bool) {
+	dir, err := filepath.Abs(path)
+	if err != nil {
+		return "", "", false
+	}
+
+	for {
+		candidate := filepath.Join(dir, ".git")
+		if info, err := os.Stat(candidate); err == nil {
+			if info.IsDir() {
+				return dir, candidate, true
+			}
+
+			// #nosec G304 - candidate is a .git file inside the worktree
+			data, err := os.ReadFile(candidate)
+			if err != nil {
+				return "", "", false
+			}
+			gitDir, ok := strings.CutPrefix(strings.TrimSpace(string(data)), "gitdir: ")
+			if !ok {
+				return "", "", false
+			}
+			if !filepath.IsAbs(gitDir) {
+				gitDir = filepath.Join(dir, gitDir)
+			}
+			return dir, gitDir, true
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", false
+		}
+		dir = parent
+	}
+}
+
+// gitCommonDir returns the directory holding refs and config shared by all
+// worktrees of gitDir's repository: gitDir itself unless it is a linked
+// worktree's.
+func gitCommonDir(gitDir string) string {
+	// #nosec G304 - gitDir is discovered from the worktree
+	data, err := os.ReadFile(filepath.Join(gitDir, "commondir"))
+	if err != nil {
+		return gitDir
+	}
+	commonDir := strings.TrimSpace(string(data))
+	if !filepath.IsAbs(commonDir) {
+		commonDir = filepath.Join(gitDir, commonDir)
+	}
+	return filepath.Clean(commonDir)
+}
+
+// resolveRef returns the full hash a ref points to, checking loose refs in
+// the worktree and common git directories before packed-refs.
+func resolveRef(gitDir, ref string) string {
+	dirs := []string{gitDir}
+
+	// Linked worktrees keep shared refs in the common directory
+	if commonDir := gitCommonDir(gitDir); commonDir != filepath.Clean(gitDir) {
+		dirs = append(dirs, commonDir)
+	}
+
+	for _, dir := range dirs {
+		// #nosec G304 - ref comes from HEAD of the discovered repository
+		if data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(ref))); err == nil {
+			return strings.TrimSpace(string(data))
+		}
+	}
+
+	for _, dir := range dirs {
+		if hash := lookupPackedRef(filepath.Join(dir, "packed-refs"), ref); hash != "" {
+			return hash
+		}
+	}
+
+	return ""
+}
+
+// lookupPackedRef finds ref in a packed-refs file.
+func lookupPackedRef(path, ref string) string {
+	// #nosec G304 - path is packed-refs of the discovered repository
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		hash, name, ok := strings.Cut(scanner.Text(), " ")
+		if ok && name == ref {
+			return hash
+		}
+	}
+	return ""
+}
+
+func shortHash(hash string) string {
+	if len(hash) > shortCommitLen {
+		return hash[:shortCommitLen]
+	}
+	return hash
+}
@@ -0,0 +1,88 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testCommit = "0123456789abcdef0123456789abcdef01234567"
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o750))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+}
+
+func TestDetectGit(t *testing.T) {
+	t.Run("returns nil outside a repository", func(t *testing.T) {
+		assert.Nil(t, DetectGit(t.TempDir()))
+	})
+
+	t.Run("reads branch and loose ref", func(t *testing.T) {
+		repo := t.TempDir()
+		writeFile(t, filepath.Join(repo, ".git", "HEAD"), "ref: refs/heads/feature/login\n")
+		writeFile(t, filepath.Join(repo, ".git", "refs", "heads", "feature", "login"), testCommit+"\n")
+
+		info := DetectGit(repo)
+		require.NotNil(t, info)
+		assert.Equal(t, "feature/login", info.Branch)
+		assert.Equal(t, "0123456", info.Commit)
+	})
+
+	t.Run("finds repository from subdirectory and packed refs", func(t *testing.T) {
+		repo := t.TempDir()
+		writeFile(t, filepath.Join(repo, ".git", "HEAD"), "ref: refs/heads/main\n")
+		writeFile(t, filepath.Join(repo, ".git", "packed-refs"),
+			"# pack-refs with: peeled fully-peeled sorted\n"+testCommit+" refs/heads/main\n")
+		sub := filepath.Join(repo, "services", "api")
+		require.NoError(t, os.MkdirAll(sub, 0o750))
+
+		info := DetectGit(sub)
+		require.NotNil(t, info)
+		assert.Equal(t, "main", info.Branch)
+		assert.Equal(t, "0123456", info.Commit)
+	})
+
+	t.Run("handles detached HEAD", func(t *testing.T) {
+		repo := t.TempDir()
+		writeFile(t, filepath.Join(repo, ".git", "HEAD"), testCommit+"\n")
+
+		info := DetectGit(repo)
+		require.NotNil(t, info)
+		assert.Empty(t, info.Branch)
+		assert.Equal(t, "0123456", info.Commit)
+	})
+
+	t.Run("follows linked worktree gitdir", func(t *testing.T) {
+		root := t.TempDir()
+		mainGit := filepath.Join(root, "main", ".git")
+		worktreeGit := filepath.Join(mainGit, "worktrees", "wt")
+		writeFile(t, filepath.Join(mainGit, "refs", "heads", "wt-branch"), testCommit+"\n")
+		writeFile(t, filepath.Join(worktreeGit, "HEAD"), "ref: refs/heads/wt-branch\n")
+		writeFile(t, filepath.Join(worktreeGit, "commondir"), "../..\n")
+		writeFile(t, filepath.Join(root, "wt", ".git"), "gitdir: "+worktreeGit+"\n")
+
+		info := DetectGit(filepath.Join(root, "wt"))
+		require.NotNil(t, info)
+		assert.Equal(t, "wt-branch", info.Branch)
+		assert.Equal(t, "0123456", info.Commit)
+	})
+}
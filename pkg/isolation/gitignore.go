@@ -0,0 +1,135 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GitIgnore selects where generated env files are registered as ignored,
+// so they stop showing up in commits.
+type GitIgnore string
+
+const (
+	// GitIgnoreOff leaves ignore rules alone.
+	GitIgnoreOff GitIgnore = ""
+	// GitIgnoreExclude lists generated files in .git/info/exclude, which
+	// is local to the clone and shared by its linked worktrees.
+	GitIgnoreExclude GitIgnore = "exclude"
+	// GitIgnoreFile lists generated files in a managed block of the
+	// repository's top-level .gitignore.
+	GitIgnoreFile GitIgnore = "gitignore"
+)
+
+// gitignoreEscaper escapes the characters that are special in gitignore
+// patterns, so paths containing them match literally.
+var gitignoreEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`)
+
+// ParseGitIgnore parses a GitIgnore mode; empty means GitIgnoreOff.
+func ParseGitIgnore(mode string) (GitIgnore, error) {
+	switch GitIgnore(mode) {
+	case GitIgnoreOff, GitIgnoreExclude, GitIgnoreFile:
+		return GitIgnore(mode), nil
+	}
+	return "", fmt.Errorf("invalid gitignore %q (want %q or %q)", mode, GitIgnoreExclude, GitIgnoreFile)
+}
+
+// ignoreFiles adds files to the managed block of the ignore file selected
+// by mode, as patterns anchored at the top of worktree's git repository.
+// Files outside the repository, and worktrees outside git, are skipped.
+// A file ending in "*" is added as a prefix pattern. Patterns are only ever
+// added, since other worktrees may still use them.
+func ignoreFiles(worktree string, mode GitIgnore, files []string) error {
+	top, gitDir, ok := findGitRoot(worktree)
+	if !ok || mode == GitIgnoreOff {
+		return nil
+	}
+
+	var path string
+	if mode == GitIgnoreFile {
+		path = filepath.Join(top, ".gitignore")
+	} else {
+		path = filepath.Join(gitCommonDir(gitDir), "info", "exclude")
+	}
+
+	// #nosec G304 - path is inside the discovered repository
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	content, block := stripEnvrcBlock(string(data))
+
+	listed := make(map[string]bool)
+	for _, line := range strings.Split(content+block, "\n") {
+		listed[strings.TrimSpace(line)] = true
+	}
+
+	var patterns []string
+	for _, line := range strings.Split(block, "\n") {
+		if line != "" && line != envrcBlockBegin && line != envrcBlockEnd {
+			patterns = append(patterns, line)
+		}
+	}
+	added := false
+	for _, file := range files {
+		file, prefix := strings.CutSuffix(file, "*")
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(top, abs)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || strings.ContainsAny(rel, "\r\n") {
+			continue
+		}
+		pattern := "/" + gitignoreEscaper.Replace(filepath.ToSlash(rel))
+		if prefix {
+			pattern += "*"
+		} else if strings.HasSuffix(pattern, " ") {
+			// Git strips unescaped trailing spaces
+			pattern = pattern[:len(pattern)-1] + `\ `
+		}
+		if !listed[pattern] {
+			listed[pattern] = true
+			patterns = append(patterns, pattern)
+			added = true
+		}
+	}
+	if !added {
+		return nil
+	}
+
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	var b strings.Builder
+	b.WriteString(content)
+	b.WriteString(envrcBlockBegin + "\n")
+	for _, p := range patterns {
+		b.WriteString(p + "\n")
+	}
+	b.WriteString(envrcBlockEnd + "\n")
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	// #nosec G306 - ignore files are readable by design
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
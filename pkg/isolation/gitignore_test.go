@@ -0,0 +1,95 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports/portstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvironmentManager_GitIgnore(t *testing.T) {
+	repo := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(repo, ".git"), 0o750))
+	worktree := filepath.Join(repo, "services", "api")
+	require.NoError(t, os.MkdirAll(worktree, 0o750))
+
+	config := &Config{
+		WorktreePath:  worktree,
+		LockDir:       filepath.Join(t.TempDir(), "locks"),
+		MaxRetries:    10,
+		ExtraEnvFiles: []string{"../web/.env.isolation", filepath.Join(t.TempDir(), "outside.env")},
+		GitIgnore:     GitIgnoreExclude,
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(repo, "services", "web"), 0o750))
+	manager := NewEnvironmentManager(NewIDGenerator(config), portstest.NewFakeAllocator(20000))
+
+	for range 2 {
+		env, err := manager.CreateEnvironment(2)
+		require.NoError(t, err)
+		require.NoError(t, manager.Cleanup(env))
+	}
+
+	data, err := os.ReadFile(filepath.Join(repo, ".git", "info", "exclude"))
+	require.NoError(t, err)
+	assert.Equal(t, envrcBlockBegin+"\n/services/api/.env.isolation*\n/services/web/.env.isolation\n"+envrcBlockEnd+"\n", string(data),
+		"patterns are anchored at the repository top, listed once, and kept after cleanup")
+	assert.NoFileExists(t, filepath.Join(repo, ".gitignore"))
+}
+
+func TestIgnoreFiles(t *testing.T) {
+	t.Run("gitignore keeps user content", func(t *testing.T) {
+		repo := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(repo, ".git"), 0o750))
+		gitignore := filepath.Join(repo, ".gitignore")
+		require.NoError(t, os.WriteFile(gitignore, []byte("node_modules/\n/.env.isolation"), 0o644))
+
+		require.NoError(t, ignoreFiles(repo, GitIgnoreFile, []string{filepath.Join(repo, ".env.isolation"), filepath.Join(repo, ".env.test")}))
+
+		data, err := os.ReadFile(gitignore)
+		require.NoError(t, err)
+		assert.Equal(t, "node_modules/\n/.env.isolation\n"+envrcBlockBegin+"\n/.env.test\n"+envrcBlockEnd+"\n", string(data),
+			"files the user already ignores are not repeated")
+	})
+
+	t.Run("linked worktree uses the common exclude file", func(t *testing.T) {
+		main := t.TempDir()
+		gitDir := filepath.Join(main, ".git", "worktrees", "feature")
+		require.NoError(t, os.MkdirAll(gitDir, 0o750))
+		require.NoError(t, os.WriteFile(filepath.Join(gitDir, "commondir"), []byte("../..\n"), 0o644))
+		worktree := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(worktree, ".git"), []byte("gitdir: "+gitDir+"\n"), 0o644))
+
+		require.NoError(t, ignoreFiles(worktree, GitIgnoreExclude, []string{filepath.Join(worktree, ".env.isolation")}))
+
+		data, err := os.ReadFile(filepath.Join(main, ".git", "info", "exclude"))
+		require.NoError(t, err)
+		assert.True(t, strings.Contains(string(data), "\n/.env.isolation\n"))
+	})
+
+	t.Run("outside git is a no-op", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, ignoreFiles(dir, GitIgnoreFile, []string{filepath.Join(dir, ".env.isolation")}))
+		assert.NoFileExists(t, filepath.Join(dir, ".gitignore"))
+	})
+
+	_, err := ParseGitIgnore("always")
+	assert.Error(t, err)
+}
@@ -22,36 +22,188 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
 )
 
 // Config holds configuration for isolation ID generation.
 type Config struct {
-	WorktreePath     string
-	InstanceID       string
+	WorktreePath string
+	// InstanceID is mixed into the ID hash. When it is empty, NewIDGenerator
+	// derives it (and IDPrefix) from the worktree's git branch.
+	InstanceID string
+	// IDPrefix is prepended to generated IDs as "<prefix>-<hash>" so that
+	// environments (and compose project names) are recognizable.
+	IDPrefix         string
 	LockDir          string
 	MaxRetries       int
 	CollisionBackoff time.Duration
+	// MaxLockAge expires locks older than this whose owning process is no
+	// longer running: Generate treats their IDs as free and CreateLock
+	// replaces them. Zero disables expiry.
+	MaxLockAge time.Duration
+	// EnvFilePath is where the env file is written (default:
+	// DefaultEnvFileName). Relative paths are resolved against WorktreePath.
+	EnvFilePath string
+	// ExtraEnvFiles are additional env files written with the same content,
+	// e.g. one per service directory in a monorepo.
+	ExtraEnvFiles []string
+	// NoEnvFile skips writing env files entirely, for callers that only
+	// consume the Environment (or JSON output) and want a clean worktree.
+	NoEnvFile bool
+	// TempLayout creates standard data/, logs/, tmp/, and sockets/
+	// subdirectories under the environment's temp directory.
+	TempLayout bool
+	// GitIgnore registers the written env files as ignored in the
+	// worktree's git repository; see GitIgnore.
+	GitIgnore GitIgnore
+	// Envrc also writes the allocated variables into a managed block of the
+	// worktree's .envrc for direnv users.
+	Envrc bool
+	// Profile names the ports and adds variables; see WithProfile.
+	Profile *Profile
+	// Name is an optional human-friendly name recorded in the lock file;
+	// see WithName.
+	Name string
+	// Project is the project namespace recorded in the lock file. When it
+	// is empty, NewIDGenerator derives it from the worktree; see WithProject.
+	Project string
+	// ComposePrefix prefixes the ID in COMPOSE_PROJECT_NAME; see
+	// WithComposePrefix.
+	ComposePrefix string
+	// Host identifies this machine in lock files and ID hashes (default:
+	// the hostname). When LockDir is on storage shared by several machines,
+	// locks from other hosts are never expired or reclaimed, since their
+	// processes cannot be checked; see WithHost.
+	Host string
+	// Clock supplies lock timestamps, expiry checks, and collision backoff
+	// (default: ports.SystemClock); see WithClock.
+	Clock ports.Clock
+	// Listen probes port availability when NewEnvironmentManager creates
+	// the default allocator (default: net.Listen); see WithListenFunc.
+	Listen ports.ListenFunc
+	// Store records environments for GetOrCreateByInstanceID; see
+	// WithStore.
+	Store EnvironmentStore
+	// Strict fails creation when writing an env file fails part way,
+	// instead of leaving a truncated file behind; see WithStrict.
+	Strict bool
+	// OnReclaim is called with the ID of an expired environment after
+	// CreateLock removed its lock, temp directory, and env files, so that
+	// callers can drop their own records of it; see WithOnReclaim.
+	OnReclaim func(isolationID string)
+
+	// derivedInstanceID is set when NewIDGenerator derived InstanceID, which
+	// is then not recorded in environments; see explicitInstanceID.
+	derivedInstanceID bool
+}
+
+// explicitInstanceID returns InstanceID if the caller set it, or "" if
+// NewIDGenerator derived it from the git branch or the time. Only explicit
+// instance IDs identify an environment for GetOrCreateByInstanceID; every
+// environment of a branch shares the derived one.
+func (c *Config) explicitInstanceID() string {
+	if c.derivedInstanceID {
+		return ""
+	}
+	return c.InstanceID
 }
 
+// DefaultEnvFileName is the env file written into the worktree by default.
+const DefaultEnvFileName = ".env.isolation"
+
 // DefaultConfig returns default configuration.
 func DefaultConfig() *Config {
 	return &Config{
 		WorktreePath:     "",
-		InstanceID:       fmt.Sprintf("%d", time.Now().UnixNano()%10000000000),
-		LockDir:          "/tmp/aigis-isolation-locks",
+		InstanceID:       "",
+		LockDir:          DefaultLockDir(),
 		MaxRetries:       999,
 		CollisionBackoff: 1 * time.Millisecond,
+		MaxLockAge:       DefaultMaxLockAge,
+	}
+}
+
+// WithClock sets the clock used for lock timestamps, lock expiry, and
+// collision backoff, so tests can advance time instead of sleeping.
+func WithClock(clock ports.Clock) Option {
+	return func(c *Config) {
+		c.Clock = clock
+	}
+}
+
+// WithListenFunc sets the function the default port allocator probes ports
+// with, so tests can simulate busy ports without opening sockets.
+func WithListenFunc(listen ports.ListenFunc) Option {
+	return func(c *Config) {
+		c.Listen = listen
+	}
+}
+
+// WithHost sets the name identifying this machine in lock files, for lock
+// directories shared by machines whose hostnames are not unique (e.g.
+// containers that all report "localhost").
+func WithHost(host string) Option {
+	return func(c *Config) {
+		c.Host = host
+	}
+}
+
+// WithStrict makes errors that are otherwise ignored fail the operation.
+func WithStrict() Option {
+	return func(c *Config) {
+		c.Strict = true
+	}
+}
+
+// WithOnReclaim sets the function called with the ID of each expired
+// environment CreateLock reclaims, e.g. to remove its state file entry.
+func WithOnReclaim(fn func(isolationID string)) Option {
+	return func(c *Config) {
+		c.OnReclaim = fn
+	}
+}
+
+// host returns the configured host or the hostname.
+func (c *Config) host() string {
+	if c.Host != "" {
+		return c.Host
 	}
+	return Hostname()
 }
 
-// IDGenerator generates unique isolation IDs with collision detection.
-type IDGenerator struct {
+// clock returns the configured clock or the system clock.
+func (c *Config) clock() ports.Clock {
+	if c.Clock != nil {
+		return c.Clock
+	}
+	return ports.SystemClock{}
+}
+
+// IDGenerator generates isolation IDs and manages their locks.
+//
+// Implementations can provide deterministic IDs (e.g. derived from CI job
+// IDs) or their own collision strategy. Implementations that also have a
+// Config() *Config method supply the worktree and options used by
+// EnvironmentManager.
+type IDGenerator interface {
+	Generate() (string, error)
+	CreateLock(isolationID string) (string, error)
+	ReleaseLock(isolationID string) error
+	IsLocked(isolationID string) bool
+}
+
+// SHA256Generator is the default IDGenerator. It hashes the worktree,
+// instance ID, time, randomness, hostname, and PID into a 12-character ID
+// and uses lock files for collision detection.
+type SHA256Generator struct {
 	config *Config
 }
 
-// NewIDGenerator creates a new ID generator.
-func NewIDGenerator(config *Config) *IDGenerator {
+// NewIDGenerator creates a new SHA256-based ID generator.
+func NewIDGenerator(config *Config) *SHA256Generator {
 	if config == nil {
 		config = DefaultConfig()
 	}
@@ -65,14 +217,33 @@ func NewIDGenerator(config *Config) *IDGenerator {
 		}
 	}
 
+	if config.Project == "" {
+		config.Project = ProjectKey(config.WorktreePath)
+	}
+
+	if config.InstanceID == "" && config.IDPrefix == "" {
+		if name := gitInstanceName(config.WorktreePath); name != "" {
+			config.InstanceID = name
+			config.IDPrefix = sanitizeIDPrefix(name)
+		} else {
+			config.InstanceID = fmt.Sprintf("%d", config.clock().Now().UnixNano()%10000000000)
+		}
+		config.derivedInstanceID = true
+	}
+
 	// Create lock directory
 	_ = os.MkdirAll(config.LockDir, 0o750)
 
-	return &IDGenerator{
+	return &SHA256Generator{
 		config: config,
 	}
 }
 
+// Config returns the generator's configuration.
+func (g *SHA256Generator) Config() *Config {
+	return g.config
+}
+
 // randomInt64 generates a cryptographically secure random int64.
 func randomInt64() (int64, error) {
 	var b [8]byte
@@ -84,16 +255,16 @@ func randomInt64() (int64, error) {
 }
 
 // Generate creates a unique isolation ID with collision avoidance.
-func (g *IDGenerator) Generate() (string, error) {
+func (g *SHA256Generator) Generate() (string, error) {
 	// Generate base hash from multiple entropy sources
-	timestamp := time.Now().UnixNano()
+	timestamp := g.config.clock().Now().UnixNano()
 	randomComponent, err := randomInt64()
 	if err != nil {
 		return "", fmt.Errorf("failed to generate random component: %w", err)
 	}
 	processID := os.Getpid()
-	hostname, err := os.Hostname()
-	if err != nil {
+	hostname := g.config.host()
+	if hostname == "" {
 		hostname = "unknown"
 	}
 
@@ -108,6 +279,9 @@ func (g *IDGenerator) Generate() (string, error) {
 
 	hash := sha256.Sum256([]byte(baseInput))
 	baseID := fmt.Sprintf("%x", hash[:6]) // 12 characters
+	if g.config.IDPrefix != "" {
+		baseID = g.config.IDPrefix + "-" + baseID
+	}
 
 	// Collision detection with exponential backoff
 	counter := 0
@@ -124,49 +298,85 @@ func (g *IDGenerator) Generate() (string, error) {
 
 		// Check for collisions
 		lockFile := filepath.Join(g.config.LockDir, fmt.Sprintf("env-%s.lock", isolationID))
-		tmpDir := filepath.Join(os.TempDir(), fmt.Sprintf("aigis-test-%s", isolationID))
+		tmpDir := FindTempDir(isolationID)
 
 		if !fileExists(lockFile) && !fileExists(tmpDir) {
 			return isolationID, nil
 		}
+		// An expired lock and its temp directory are reclaimed by CreateLock
+		if lockExpired(lockFile, g.config.host(), g.config.MaxLockAge, g.config.clock().Now()) {
+			return isolationID, nil
+		}
 
 		counter++
-		time.Sleep(g.config.CollisionBackoff)
+		g.config.clock().Sleep(g.config.CollisionBackoff)
 	}
 
-	return "", fmt.Errorf("unable to generate unique isolation ID after %d attempts", g.config.MaxRetries)
+	return "", fmt.Errorf("%w: unable to generate unique isolation ID after %d attempts", ErrLockConflict, g.config.MaxRetries)
 }
 
-// CreateLock creates a lock file for the isolation ID.
-func (g *IDGenerator) CreateLock(isolationID string) (string, error) {
+// CreateLock creates a lock file for the isolation ID, replacing an expired
+// lock (see Config.MaxLockAge).
+func (g *SHA256Generator) CreateLock(isolationID string) (string, error) {
 	lockFile := filepath.Join(g.config.LockDir, fmt.Sprintf("env-%s.lock", isolationID))
+	tmpDir := FindTempDir(isolationID)
+	if reclaimExpiredLock(lockFile, tmpDir, g.config.host(), g.config.MaxLockAge, g.config.clock().Now()) && g.config.OnReclaim != nil {
+		g.config.OnReclaim(isolationID)
+	}
 
 	// Atomic file creation (fails if exists)
 	// #nosec G302 - 0o600 is appropriate for lock files
 	f, err := os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if os.IsExist(err) {
+		return "", fmt.Errorf("%w: %s", ErrLockConflict, isolationID)
+	}
 	if err != nil {
 		return "", fmt.Errorf("failed to create lock: %w", err)
 	}
 	defer f.Close()
 
 	// Write metadata
-	metadata := fmt.Sprintf("PID=%d\nTimestamp=%d\nWorktree=%s\n",
-		os.Getpid(),
-		time.Now().Unix(),
-		g.config.WorktreePath,
+	pid := os.Getpid()
+	metadata := fmt.Sprintf("PID=%d\nTimestamp=%d\nWorktree=%s\nBootID=%s\nStartTime=%d\n",
+		pid,
+		g.config.clock().Now().Unix(),
+		lockValue(g.config.WorktreePath),
+		BootID(),
+		ProcessStartTime(pid),
 	)
+	if g.config.Name != "" {
+		metadata += fmt.Sprintf("Name=%s\n", lockValue(g.config.Name))
+	}
+	if g.config.Project != "" {
+		metadata += fmt.Sprintf("Project=%s\n", lockValue(g.config.Project))
+	}
+	if host := g.config.host(); host != "" {
+		metadata += fmt.Sprintf("Host=%s\n", lockValue(host))
+	}
 	_, err = f.WriteString(metadata)
 	if err != nil {
 		_ = os.Remove(lockFile)
 		return "", fmt.Errorf("failed to write lock metadata: %w", err)
 	}
 
+	// Checked after writing our lock, so two concurrent creates with the
+	// same name cannot both succeed
+	if g.config.Name != "" {
+		if holder := nameHolder(g.config.LockDir, g.config.Name, lockFile, g.config.host(), g.config.MaxLockAge, g.config.clock().Now()); holder != "" {
+			_ = os.Remove(lockFile)
+			return "", fmt.Errorf("%w: %s (%s)", ErrNameInUse, g.config.Name, filepath.Base(holder))
+		}
+	}
+
 	return lockFile, nil
 }
 
-// ReleaseLock removes the lock file.
-func (g *IDGenerator) ReleaseLock(isolationID string) error {
+// ReleaseLock removes the lock file and its sidecar (see SidecarPath).
+func (g *SHA256Generator) ReleaseLock(isolationID string) error {
 	lockFile := filepath.Join(g.config.LockDir, fmt.Sprintf("env-%s.lock", isolationID))
+	if err := os.Remove(SidecarPath(lockFile)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove lock sidecar: %w", err)
+	}
 	if err := os.Remove(lockFile); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("failed to release lock: %w", err)
 	}
@@ -174,11 +384,50 @@ func (g *IDGenerator) ReleaseLock(isolationID string) error {
 }
 
 // IsLocked checks if an isolation ID is currently locked.
-func (g *IDGenerator) IsLocked(isolationID string) bool {
+func (g *SHA256Generator) IsLocked(isolationID string) bool {
 	lockFile := filepath.Join(g.config.LockDir, fmt.Sprintf("env-%s.lock", isolationID))
 	return fileExists(lockFile)
 }
 
+// maxIDPrefixLen bounds the prefix so IDs stay readable in tables.
+const maxIDPrefixLen = 24
+
+// gitInstanceName returns the branch checked out in worktree, or the
+// worktree directory name when HEAD is detached. It is empty outside git.
+func gitInstanceName(worktree string) string {
+	git := DetectGit(worktree)
+	if git == nil {
+		return ""
+	}
+	if git.Branch != "" {
+		return git.Branch
+	}
+	return filepath.Base(worktree)
+}
+
+// sanitizeIDPrefix lowercases name and replaces every run of characters
+// outside [a-z0-9] with a single '-', so the result is valid in file names
+// and docker compose project names.
+func sanitizeIDPrefix(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+
+	prefix := b.String()
+	if len(prefix) > maxIDPrefixLen {
+		prefix = prefix[:maxIDPrefixLen]
+	}
+	return strings.TrimRight(prefix, "-")
+}
+
 func fileExists(path string) bool {
 	_, err := os.Stat(path)
 	return err == nil
@@ -15,10 +15,13 @@
 package isolation
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -242,3 +245,143 @@ func TestIDGenerator_DefaultConfig(t *testing.T) {
 		assert.NotEmpty(t, gen.config.WorktreePath)
 	})
 }
+
+func TestIDGenerator_GitDerivedPrefix(t *testing.T) {
+	t.Run("prefixes IDs with sanitized branch name", func(t *testing.T) {
+		repo := t.TempDir()
+		writeFile(t, filepath.Join(repo, ".git", "HEAD"), "ref: refs/heads/Feature/Login_Page\n")
+
+		gen := NewIDGenerator(&Config{
+			WorktreePath: repo,
+			LockDir:      filepath.Join(repo, "locks"),
+			MaxRetries:   10,
+		})
+		assert.Equal(t, "Feature/Login_Page", gen.config.InstanceID)
+		assert.Equal(t, "feature-login-page", gen.config.IDPrefix)
+
+		id, err := gen.Generate()
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(id, "feature-login-page-"), id)
+		assert.Len(t, id, len("feature-login-page-")+12)
+	})
+
+	t.Run("explicit instance ID disables prefix", func(t *testing.T) {
+		repo := t.TempDir()
+		writeFile(t, filepath.Join(repo, ".git", "HEAD"), "ref: refs/heads/main\n")
+
+		gen := NewIDGenerator(&Config{
+			WorktreePath: repo,
+			InstanceID:   "ci-build-123",
+			LockDir:      filepath.Join(repo, "locks"),
+			MaxRetries:   10,
+		})
+		id, err := gen.Generate()
+		require.NoError(t, err)
+		assert.Len(t, id, 12)
+	})
+
+	t.Run("falls back to timestamp outside git", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		gen := NewIDGenerator(&Config{WorktreePath: tmpDir, LockDir: filepath.Join(tmpDir, "locks")})
+		assert.NotEmpty(t, gen.config.InstanceID)
+		assert.Empty(t, gen.config.IDPrefix)
+	})
+}
+
+func TestSanitizeIDPrefix(t *testing.T) {
+	tests := map[string]string{
+		"main":                                 "main",
+		"feature/login":                        "feature-login",
+		"--Fix__Bug--":                         "fix-bug",
+		"release/v1.2.3":                       "release-v1-2-3",
+		"a-very-long-branch-name-that-exceeds": "a-very-long-branch-name",
+		"///":                                  "",
+	}
+	for in, want := range tests {
+		assert.Equal(t, want, sanitizeIDPrefix(in), in)
+	}
+}
+
+// stepClock is a ports.Clock whose time only moves on Sleep.
+type stepClock struct {
+	now   time.Time
+	slept time.Duration
+}
+
+func (c *stepClock) Now() time.Time        { return c.now }
+func (c *stepClock) Sleep(d time.Duration) { c.now = c.now.Add(d); c.slept += d }
+
+func TestIDGenerator_WithClock(t *testing.T) {
+	tmpDir := t.TempDir()
+	clock := &stepClock{now: time.Now().Add(48 * time.Hour)}
+	config := (&Config{
+		WorktreePath: tmpDir,
+		LockDir:      filepath.Join(tmpDir, "locks"),
+		MaxRetries:   10,
+		MaxLockAge:   24 * time.Hour,
+	}).Apply(WithClock(clock))
+	gen := NewIDGenerator(config)
+
+	t.Run("timestamps locks with the clock", func(t *testing.T) {
+		lockFile, err := gen.CreateLock("clocked")
+		require.NoError(t, err)
+		defer gen.ReleaseLock("clocked")
+
+		info, err := ReadLockInfo(lockFile)
+		require.NoError(t, err)
+		assert.Equal(t, clock.now.Unix(), info.CreatedAt.Unix())
+	})
+
+	t.Run("expires locks as the clock advances", func(t *testing.T) {
+		lockFile := filepath.Join(config.LockDir, "env-dead.lock")
+		writeTestLock(t, lockFile, deadPID, time.Now())
+
+		// 48h ahead of the lock's timestamp, past MaxLockAge
+		_, err := gen.CreateLock("dead")
+		require.NoError(t, err)
+		assert.NoError(t, gen.ReleaseLock("dead"))
+	})
+}
+
+func TestIDGenerator_SharedLockDir(t *testing.T) {
+	// Two machines mounting the same lock directory
+	lockDir := filepath.Join(t.TempDir(), "shared-locks")
+	newHost := func(host string) *SHA256Generator {
+		return NewIDGenerator((&Config{
+			WorktreePath: t.TempDir(),
+			LockDir:      lockDir,
+			MaxRetries:   10,
+			MaxLockAge:   time.Hour,
+		}).Apply(WithHost(host)))
+	}
+	hostA, hostB := newHost("ci-a"), newHost("ci-b")
+
+	lockFile, err := hostA.CreateLock("shared")
+	require.NoError(t, err)
+	info, err := ReadLockInfo(lockFile)
+	require.NoError(t, err)
+	assert.Equal(t, "ci-a", info.Host)
+
+	_, err = hostB.CreateLock("shared")
+	assert.ErrorIs(t, err, ErrLockConflict, "the same ID is taken across hosts")
+	require.NoError(t, hostA.ReleaseLock("shared"))
+
+	// A lock from another host looks dead locally (its PID is not ours),
+	// but must never be expired or reclaimed by this host
+	stale := filepath.Join(lockDir, "env-remote.lock")
+	content := fmt.Sprintf("PID=%d\nTimestamp=%d\nWorktree=/src/app\nHost=ci-a\n", deadPID, time.Now().Add(-48*time.Hour).Unix())
+	require.NoError(t, os.WriteFile(stale, []byte(content), 0o600))
+
+	_, err = hostB.CreateLock("remote")
+	assert.ErrorIs(t, err, ErrLockConflict)
+	assert.FileExists(t, stale)
+	info, err = ReadLockInfo(stale)
+	require.NoError(t, err)
+	assert.False(t, info.Local("ci-b"))
+	assert.False(t, info.expiredOn("ci-b", time.Hour, time.Now()))
+
+	// Its own host can reclaim it
+	_, err = hostA.CreateLock("remote")
+	require.NoError(t, err)
+	assert.NoError(t, hostA.ReleaseLock("remote"))
+}
@@ -0,0 +1,116 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+)
+
+// environmentJSON is the wire format of an Environment.
+type environmentJSON struct {
+	ID                 string     `json:"id"`
+	Name               string     `json:"name,omitempty"`
+	Project            string     `json:"project,omitempty"`
+	ComposeProjectName string     `json:"compose_project_name"`
+	ComposePrefix      string     `json:"compose_prefix,omitempty"`
+	DockerNetwork      string     `json:"docker_network"`
+	NetworkCreated     bool       `json:"docker_network_created,omitempty"`
+	WorktreePath       string     `json:"worktree_path"`
+	TempDir            string     `json:"temp_dir"`
+	LockFile           string     `json:"lock_file"`
+	EnvFile            string     `json:"env_file"`
+	EnvFiles           []string   `json:"env_files,omitempty"`
+	Ports              *portsJSON `json:"ports"`
+	GitBranch          string     `json:"git_branch,omitempty"`
+	GitCommit          string     `json:"git_commit,omitempty"`
+	Layout             bool       `json:"layout,omitempty"`
+	Profile            *Profile   `json:"profile,omitempty"`
+}
+
+// portsJSON is the wire format of an Environment's port range.
+type portsJSON struct {
+	BasePort int   `json:"base_port"`
+	Count    int   `json:"count"`
+	Ports    []int `json:"ports"`
+}
+
+// MarshalJSON encodes the environment with snake_case keys and the full
+// list of allocated ports.
+func (env *Environment) MarshalJSON() ([]byte, error) {
+	out := environmentJSON{
+		ID:                 env.ID,
+		Name:               env.Name,
+		Project:            env.Project,
+		ComposeProjectName: env.ComposeProjectName(),
+		ComposePrefix:      env.ComposePrefix,
+		DockerNetwork:      env.DockerNetworkName(),
+		NetworkCreated:     env.DockerNetwork != "",
+		WorktreePath:       env.WorktreePath,
+		TempDir:            env.TempDir,
+		LockFile:           env.LockFile,
+		EnvFile:            env.EnvFile,
+		EnvFiles:           env.EnvFiles,
+		GitBranch:          env.GitBranch,
+		GitCommit:          env.GitCommit,
+		Layout:             env.Layout,
+		Profile:            env.Profile,
+	}
+	if env.Ports != nil {
+		out.Ports = &portsJSON{
+			BasePort: env.Ports.BasePort,
+			Count:    env.Ports.Count,
+			Ports:    env.Ports.Ports(),
+		}
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON decodes an environment produced by MarshalJSON.
+//
+// The port list is informational; the range is rebuilt from base_port and count.
+func (env *Environment) UnmarshalJSON(data []byte) error {
+	var in environmentJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return fmt.Errorf("failed to decode environment: %w", err)
+	}
+
+	*env = Environment{
+		ID:            in.ID,
+		Name:          in.Name,
+		Project:       in.Project,
+		ComposePrefix: in.ComposePrefix,
+		WorktreePath:  in.WorktreePath,
+		TempDir:       in.TempDir,
+		LockFile:      in.LockFile,
+		EnvFile:       in.EnvFile,
+		EnvFiles:      in.EnvFiles,
+		GitBranch:     in.GitBranch,
+		GitCommit:     in.GitCommit,
+		Layout:        in.Layout,
+		Profile:       in.Profile,
+		Ports:         &ports.PortRange{},
+	}
+	if in.NetworkCreated {
+		env.DockerNetwork = in.DockerNetwork
+	}
+	if in.Ports != nil {
+		env.Ports.BasePort = in.Ports.BasePort
+		env.Ports.Count = in.Ports.Count
+	}
+	return nil
+}
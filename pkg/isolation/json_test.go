@@ -0,0 +1,65 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvironment_JSON(t *testing.T) {
+	env := &Environment{
+		ID:           "test-123",
+		WorktreePath: "/path/to/project",
+		TempDir:      "/tmp/test-123",
+		LockFile:     "/tmp/locks/env-test-123.lock",
+		EnvFile:      "/path/to/project/.env.isolation",
+		Ports:        &ports.PortRange{BasePort: 20000, Count: 3},
+	}
+
+	t.Run("marshals with snake_case keys and port list", func(t *testing.T) {
+		data, err := json.Marshal(env)
+		require.NoError(t, err)
+
+		var raw map[string]interface{}
+		require.NoError(t, json.Unmarshal(data, &raw))
+		assert.Equal(t, "test-123", raw["id"])
+		assert.Equal(t, "/tmp/test-123", raw["temp_dir"])
+
+		portsRaw := raw["ports"].(map[string]interface{})
+		assert.Equal(t, float64(20000), portsRaw["base_port"])
+		assert.Equal(t, []interface{}{float64(20000), float64(20001), float64(20002)}, portsRaw["ports"])
+	})
+
+	t.Run("round-trips", func(t *testing.T) {
+		data, err := json.Marshal(env)
+		require.NoError(t, err)
+
+		var decoded Environment
+		require.NoError(t, json.Unmarshal(data, &decoded))
+		assert.Equal(t, env, &decoded)
+	})
+
+	t.Run("missing ports decode to empty range", func(t *testing.T) {
+		var decoded Environment
+		require.NoError(t, json.Unmarshal([]byte(`{"id":"x"}`), &decoded))
+		require.NotNil(t, decoded.Ports)
+		assert.Equal(t, 0, decoded.Ports.Count)
+	})
+}
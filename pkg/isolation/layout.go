@@ -0,0 +1,70 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Standard subdirectories created under TempDir when Config.TempLayout is set.
+const (
+	DataSubdir    = "data"
+	LogsSubdir    = "logs"
+	TmpSubdir     = "tmp"
+	SocketsSubdir = "sockets"
+)
+
+// layoutDirs maps each layout subdirectory to the variable exporting it.
+var layoutDirs = []struct {
+	subdir  string
+	varName string
+}{
+	{DataSubdir, "DATA_DIR"},
+	{LogsSubdir, "LOGS_DIR"},
+	{TmpSubdir, "TMP_DIR"},
+	{SocketsSubdir, "SOCKETS_DIR"},
+}
+
+// DataDir returns the directory for persistent service data (e.g. emulator files).
+func (env *Environment) DataDir() string {
+	return filepath.Join(env.TempDir, DataSubdir)
+}
+
+// LogsDir returns the directory for service and test logs.
+func (env *Environment) LogsDir() string {
+	return filepath.Join(env.TempDir, LogsSubdir)
+}
+
+// TmpDir returns the directory for scratch files.
+func (env *Environment) TmpDir() string {
+	return filepath.Join(env.TempDir, TmpSubdir)
+}
+
+// SocketsDir returns the directory for unix sockets.
+func (env *Environment) SocketsDir() string {
+	return filepath.Join(env.TempDir, SocketsSubdir)
+}
+
+// createLayout creates the standard subdirectories under env.TempDir.
+func createLayout(env *Environment) error {
+	for _, dir := range layoutDirs {
+		if err := os.MkdirAll(filepath.Join(env.TempDir, dir.subdir), 0o750); err != nil {
+			return fmt.Errorf("failed to create %s directory: %w", dir.subdir, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// DefaultMaxLockAge is the age after which a lock whose owning process is
+// gone is considered expired.
+const DefaultMaxLockAge = 24 * time.Hour
+
+// LockInfo is the metadata written into a lock file by CreateLock.
+type LockInfo struct {
+	CreatedAt time.Time
+	Worktree  string
+	// Name is the environment's human-friendly name, if it has one.
+	Name string
+	// Project is the environment's project namespace; empty in locks
+	// written by older versions.
+	Project string
+	// Host is the machine that created the lock (see Config.Host); empty
+	// in locks written by older versions, which are treated as local.
+	Host string
+	// BootID and StartTime identify the owning process beyond its PID;
+	// they are empty in locks written by older versions.
+	BootID    string
+	PID       int
+	StartTime uint64
+	// BasePort and PortCount are the allocated port range, appended once
+	// the ports are allocated; zero in locks written by older versions.
+	BasePort  int
+	PortCount int
+}
+
+// ReadLockInfo parses the metadata of a lock file.
+func ReadLockInfo(lockFile string) (*LockInfo, error) {
+	// #nosec G304 - lockFile is a lock file in the configured lock directory
+	f, err := os.Open(lockFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	defer f.Close()
+
+	info := &LockInfo{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		value = parseLockValue(value)
+		switch key {
+		case "PID":
+			info.PID, _ = strconv.Atoi(value)
+		case "Timestamp":
+			if ts, err := strconv.ParseInt(value, 10, 64); err == nil {
+				info.CreatedAt = time.Unix(ts, 0)
+			}
+		case "Worktree":
+			info.Worktree = value
+		case "BootID":
+			info.BootID = value
+		case "StartTime":
+			info.StartTime, _ = strconv.ParseUint(value, 10, 64)
+		case "Name":
+			info.Name = value
+		case "Project":
+			info.Project = value
+		case "Host":
+			info.Host = value
+		case "BasePort":
+			info.BasePort, _ = strconv.Atoi(value)
+		case "PortCount":
+			info.PortCount, _ = strconv.Atoi(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read lock file: %w", err)
+	}
+
+	return info, nil
+}
+
+// SidecarPath returns the path of the metadata file kept next to lockFile,
+// env-<id>.json for env-<id>.lock. The state package writes the full
+// recorded environment there; the lock file alone decides whether the
+// environment exists.
+func SidecarPath(lockFile string) string {
+	return strings.TrimSuffix(lockFile, ".lock") + ".json"
+}
+
+// writeLockPorts appends the allocated port range to lockFile, so that the
+// ports can be recovered from the lock alone. Generators whose CreateLock
+// returns no lock file on disk are skipped.
+func writeLockPorts(lockFile string, basePort, count int) error {
+	if lockFile == "" {
+		return nil
+	}
+	// #nosec G304 - lockFile was just created by CreateLock
+	f, err := os.OpenFile(lockFile, os.O_WRONLY|os.O_APPEND, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open lock file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintf(f, "BasePort=%d\nPortCount=%d\n", basePort, count); err != nil {
+		return fmt.Errorf("failed to write lock ports: %w", err)
+	}
+	return nil
+}
+
+// lockValue encodes a lock file value. Values that would break the
+// line-based format (newlines and other control characters) or that start
+// with a quote are written as Go quoted strings; everything else, including
+// spaces and '=', is written as is so lock files stay readable.
+func lockValue(s string) string {
+	if strings.HasPrefix(s, `"`) || strings.IndexFunc(s, unicode.IsControl) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// parseLockValue decodes a value written by lockValue.
+func parseLockValue(s string) string {
+	if strings.HasPrefix(s, `"`) {
+		if unquoted, err := strconv.Unquote(s); err == nil {
+			return unquoted
+		}
+	}
+	return s
+}
+
+// Local reports whether the lock was created on host, or on this machine
+// when host is empty.
+func (l *LockInfo) Local(host string) bool {
+	if host == "" {
+		host = Hostname()
+	}
+	return l.Host == "" || host == "" || l.Host == host
+}
+
+// Alive reports whether the process that created the lock is still running.
+// Locks created on another host, as found in a lock directory on shared
+// storage, cannot be checked and are reported alive so that they are never
+// reclaimed from under their owner.
+func (l *LockInfo) Alive() bool {
+	return l.aliveOn("")
+}
+
+func (l *LockInfo) aliveOn(host string) bool {
+	if !l.Local(host) {
+		return true
+	}
+	return ProcessAlive(l.PID, l.BootID, l.StartTime)
+}
+
+// Expired reports whether the lock is older than maxAge and its owning
+// process is gone. A zero maxAge never expires.
+func (l *LockInfo) Expired(maxAge time.Duration, now time.Time) bool {
+	return l.expiredOn("", maxAge, now)
+}
+
+func (l *LockInfo) expiredOn(host string, maxAge time.Duration, now time.Time) bool {
+	if maxAge <= 0 || l.CreatedAt.IsZero() {
+		return false
+	}
+	return now.Sub(l.CreatedAt) > maxAge && !l.aliveOn(host)
+}
+
+// lockExpired reports whether lockFile exists and has expired, as seen from
+// host (empty means this machine).
+func lockExpired(lockFile, host string, maxAge time.Duration, now time.Time) bool {
+	if maxAge <= 0 {
+		return false
+	}
+	info, err := ReadLockInfo(lockFile)
+	return err == nil && info.expiredOn(host, maxAge, now)
+}
+
+// reclaimExpiredLock removes an expired lock file, its sidecar, and the temp
+// directory and env files of its environment. The lock is first renamed
+// aside and re-checked, so a lock that another process reclaimed and
+// re-created in the meantime is restored rather than deleted.
+func reclaimExpiredLock(lockFile, tmpDir, host string, maxAge time.Duration, now time.Time) bool {
+	if !lockExpired(lockFile, host, maxAge, now) {
+		return false
+	}
+
+	aside := fmt.Sprintf("%s.expired-%d", lockFile, os.Getpid())
+	if err := os.Rename(lockFile, aside); err != nil {
+		return false
+	}
+	if !lockExpired(aside, host, maxAge, now) {
+		// Raced with a new owner; put its lock back
+		_ = os.Link(aside, lockFile)
+		_ = os.Remove(aside)
+		return false
+	}
+
+	// Env files are removed only while they still belong to the expired
+	// environment; a later one may have rewritten a shared file
+	isolationID := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(lockFile), "env-"), ".lock")
+	for _, envFile := range expiredEnvFiles(aside, SidecarPath(lockFile), isolationID) {
+		if EnvFileOwner(envFile) == isolationID {
+			_ = os.Remove(envFile)
+		}
+	}
+
+	_ = os.Remove(aside)
+	_ = os.Remove(SidecarPath(lockFile))
+	_ = os.RemoveAll(filepath.Clean(tmpDir))
+	return true
+}
+
+// expiredEnvFiles returns the env files an expired environment may have
+// left behind: those recorded in its sidecar, and the default env file of
+// the worktree in its lock.
+func expiredEnvFiles(lockFile, sidecar, isolationID string) []string {
+	var files []string
+
+	// #nosec G304 - the sidecar of a lock file in the configured lock directory
+	if data, err := os.ReadFile(sidecar); err == nil {
+		var recorded struct {
+			EnvFile  string   `json:"env_file"`
+			EnvFiles []string `json:"env_files"`
+		}
+		if json.Unmarshal(data, &recorded) == nil {
+			files = append(files, recorded.EnvFile)
+			files = append(files, recorded.EnvFiles...)
+		}
+	}
+	if info, err := ReadLockInfo(lockFile); err == nil && info.Worktree != "" {
+		files = append(files, FindEnvFile(info.Worktree, isolationID))
+	}
+
+	slices.Sort(files)
+	return slices.Compact(slices.DeleteFunc(files, func(f string) bool { return f == "" }))
+}
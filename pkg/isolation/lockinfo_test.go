@@ -0,0 +1,193 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports/portstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// deadPID is assumed not to belong to a running process.
+const deadPID = 999999
+
+func writeTestLock(t *testing.T, lockFile string, pid int, created time.Time) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(lockFile), 0o750))
+	content := fmt.Sprintf("PID=%d\nTimestamp=%d\nWorktree=/tmp/wt\n", pid, created.Unix())
+	require.NoError(t, os.WriteFile(lockFile, []byte(content), 0o600))
+}
+
+func TestReadLockInfo(t *testing.T) {
+	lockFile := filepath.Join(t.TempDir(), "env-abc.lock")
+	created := time.Now().Add(-time.Hour).Truncate(time.Second)
+	writeTestLock(t, lockFile, 1234, created)
+
+	info, err := ReadLockInfo(lockFile)
+	require.NoError(t, err)
+	assert.Equal(t, 1234, info.PID)
+	assert.Equal(t, "/tmp/wt", info.Worktree)
+	assert.True(t, created.Equal(info.CreatedAt))
+
+	_, err = ReadLockInfo(filepath.Join(t.TempDir(), "missing.lock"))
+	assert.Error(t, err)
+}
+
+func TestCreateEnvironment_RecordsPortsInLock(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := &Config{
+		WorktreePath: tmpDir,
+		LockDir:      filepath.Join(tmpDir, "locks"),
+		MaxRetries:   10,
+		NoEnvFile:    true,
+	}
+	manager := NewEnvironmentManager(NewIDGenerator(config), portstest.NewFakeAllocator(20000))
+
+	env, err := manager.CreateEnvironment(4)
+	require.NoError(t, err)
+	defer manager.Cleanup(env)
+
+	info, err := ReadLockInfo(env.LockFile)
+	require.NoError(t, err)
+	assert.Equal(t, env.Ports.BasePort, info.BasePort)
+	assert.Equal(t, 4, info.PortCount)
+	assert.Equal(t, os.Getpid(), info.PID, "the metadata written before the ports is intact")
+
+	// Generators without a lock file on disk are left alone
+	assert.NoError(t, writeLockPorts("", 20000, 1))
+	assert.NoError(t, writeLockPorts(filepath.Join(tmpDir, "missing.lock"), 20000, 1))
+	assert.NoFileExists(t, filepath.Join(tmpDir, "missing.lock"))
+}
+
+func TestReleaseLock_RemovesSidecar(t *testing.T) {
+	config := &Config{WorktreePath: t.TempDir(), LockDir: t.TempDir()}
+	gen := NewIDGenerator(config)
+
+	lockFile, err := gen.CreateLock("withsidecar")
+	require.NoError(t, err)
+	sidecar := SidecarPath(lockFile)
+	assert.Equal(t, filepath.Join(config.LockDir, "env-withsidecar.json"), sidecar)
+	require.NoError(t, os.WriteFile(sidecar, []byte("{}"), 0o600))
+
+	require.NoError(t, gen.ReleaseLock("withsidecar"))
+	assert.NoFileExists(t, lockFile)
+	assert.NoFileExists(t, sidecar)
+}
+
+func TestLockValue(t *testing.T) {
+	for _, value := range append(pathologicalNames, `"leading quote`, "/plain/path", "") {
+		assert.Equal(t, value, parseLockValue(lockValue(value)), "%q", value)
+		assert.NotContains(t, lockValue(value), "\n")
+	}
+	assert.Equal(t, "/with space/a=b", lockValue("/with space/a=b"), "printable values are written as is")
+	assert.Equal(t, `"unterminated`, parseLockValue(`"unterminated`), "values from older versions are kept")
+}
+
+func TestLockInfo_Expired(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+
+	assert.True(t, (&LockInfo{PID: deadPID, CreatedAt: old}).Expired(DefaultMaxLockAge, now))
+	assert.False(t, (&LockInfo{PID: deadPID, CreatedAt: now}).Expired(DefaultMaxLockAge, now), "young lock")
+	assert.False(t, (&LockInfo{PID: os.Getpid(), CreatedAt: old}).Expired(DefaultMaxLockAge, now), "live owner")
+	assert.False(t, (&LockInfo{PID: deadPID, CreatedAt: old}).Expired(0, now), "expiry disabled")
+	assert.False(t, (&LockInfo{PID: deadPID}).Expired(DefaultMaxLockAge, now), "unknown age")
+}
+
+func TestCreateLock_ReclaimsExpiredLock(t *testing.T) {
+	lockDir := t.TempDir()
+	gen := NewIDGenerator(&Config{LockDir: lockDir, MaxLockAge: time.Hour})
+
+	id := fmt.Sprintf("expired%d", os.Getpid())
+	lockFile := filepath.Join(lockDir, fmt.Sprintf("env-%s.lock", id))
+	tmpDir := filepath.Join(os.TempDir(), fmt.Sprintf("aigis-test-%s", id))
+	require.NoError(t, os.MkdirAll(tmpDir, 0o750))
+	t.Cleanup(func() { _ = os.RemoveAll(tmpDir) })
+
+	t.Run("keeps young dead lock", func(t *testing.T) {
+		writeTestLock(t, lockFile, deadPID, time.Now())
+		_, err := gen.CreateLock(id)
+		assert.Error(t, err)
+	})
+
+	t.Run("keeps old lock with live owner", func(t *testing.T) {
+		writeTestLock(t, lockFile, os.Getpid(), time.Now().Add(-2*time.Hour))
+		_, err := gen.CreateLock(id)
+		assert.Error(t, err)
+	})
+
+	t.Run("reclaims old dead lock", func(t *testing.T) {
+		writeTestLock(t, lockFile, deadPID, time.Now().Add(-2*time.Hour))
+		got, err := gen.CreateLock(id)
+		require.NoError(t, err)
+		assert.Equal(t, lockFile, got)
+
+		info, err := ReadLockInfo(lockFile)
+		require.NoError(t, err)
+		assert.Equal(t, os.Getpid(), info.PID)
+		assert.NoDirExists(t, tmpDir)
+	})
+
+	t.Run("removes the expired environment's files and reports it", func(t *testing.T) {
+		require.NoError(t, os.Remove(lockFile))
+		worktree := t.TempDir()
+		content := fmt.Sprintf("PID=%d\nTimestamp=%d\nWorktree=%s\n", deadPID, time.Now().Add(-2*time.Hour).Unix(), worktree)
+		require.NoError(t, os.WriteFile(lockFile, []byte(content), 0o600))
+
+		owned := filepath.Join(worktree, EnvFileName(id))
+		extra := filepath.Join(worktree, "api", ".env")
+		shared := filepath.Join(worktree, "web", ".env")
+		require.NoError(t, os.MkdirAll(filepath.Dir(extra), 0o750))
+		require.NoError(t, os.MkdirAll(filepath.Dir(shared), 0o750))
+		require.NoError(t, os.WriteFile(owned, []byte("ISOLATION_ID="+id+"\n"), 0o600))
+		require.NoError(t, os.WriteFile(extra, []byte("ISOLATION_ID="+id+"\n"), 0o600))
+		require.NoError(t, os.WriteFile(shared, []byte("ISOLATION_ID=other\n"), 0o600))
+		sidecar := fmt.Sprintf(`{"id": %q, "env_files": [%q, %q]}`, id, extra, shared)
+		require.NoError(t, os.WriteFile(SidecarPath(lockFile), []byte(sidecar), 0o600))
+
+		var reclaimed []string
+		gen := NewIDGenerator(&Config{
+			LockDir:    lockDir,
+			MaxLockAge: time.Hour,
+			OnReclaim:  func(id string) { reclaimed = append(reclaimed, id) },
+		})
+		_, err := gen.CreateLock(id)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{id}, reclaimed)
+		assert.NoFileExists(t, owned)
+		assert.NoFileExists(t, extra)
+		assert.FileExists(t, shared, "rewritten by another environment")
+		assert.NoFileExists(t, SidecarPath(lockFile))
+	})
+}
+
+func TestLockExpired(t *testing.T) {
+	lockFile := filepath.Join(t.TempDir(), "env-old.lock")
+	now := time.Now()
+	writeTestLock(t, lockFile, deadPID, now.Add(-2*time.Hour))
+
+	assert.True(t, lockExpired(lockFile, "", time.Hour, now))
+	assert.False(t, lockExpired(lockFile, "", 0, now), "expiry disabled")
+	assert.False(t, lockExpired(lockFile, "", 3*time.Hour, now), "younger than max age")
+	assert.True(t, lockExpired(lockFile, "", 3*time.Hour, now.Add(2*time.Hour)), "expires as time advances")
+	assert.False(t, lockExpired(filepath.Join(t.TempDir(), "missing.lock"), "", time.Hour, now))
+}
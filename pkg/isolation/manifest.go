@@ -0,0 +1,159 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ManifestFileName is the ownership record written into every temp directory.
+const ManifestFileName = "MANIFEST"
+
+// manifestHeader opens every manifest so a stray directory explains itself.
+const manifestHeader = "# go-portalloc environment; run 'go-portalloc inspect --dir <this directory>' for details\n"
+
+// Manifest identifies the environment a temp directory belongs to and who
+// created it, so a stray directory can be traced without the state file.
+// It uses the same KEY=value lines as lock files.
+type Manifest struct {
+	ID        string
+	Name      string
+	Project   string
+	CreatedAt time.Time
+	// User, Host, and PID identify the creator.
+	User      string
+	Host      string
+	PID       int
+	Worktree  string
+	BasePort  int
+	PortCount int
+}
+
+// ManifestFile returns the path of the environment's MANIFEST.
+func (env *Environment) ManifestFile() string {
+	return filepath.Join(env.TempDir, ManifestFileName)
+}
+
+// writeManifest records env and its creator in the temp directory.
+func writeManifest(env *Environment, host string, createdAt time.Time) error {
+	var b strings.Builder
+	b.WriteString(manifestHeader)
+	fmt.Fprintf(&b, "ID=%s\n", env.ID)
+	if env.Name != "" {
+		fmt.Fprintf(&b, "Name=%s\n", lockValue(env.Name))
+	}
+	if env.Project != "" {
+		fmt.Fprintf(&b, "Project=%s\n", lockValue(env.Project))
+	}
+	fmt.Fprintf(&b, "CreatedAt=%s\n", createdAt.UTC().Format(time.RFC3339))
+	if name := currentUser(); name != "" {
+		fmt.Fprintf(&b, "User=%s\n", lockValue(name))
+	}
+	if host != "" {
+		fmt.Fprintf(&b, "Host=%s\n", lockValue(host))
+	}
+	fmt.Fprintf(&b, "PID=%d\n", os.Getpid())
+	fmt.Fprintf(&b, "Worktree=%s\n", lockValue(env.WorktreePath))
+	if env.Ports != nil {
+		fmt.Fprintf(&b, "BasePort=%d\nPortCount=%d\n", env.Ports.BasePort, env.Ports.Count)
+	}
+
+	if err := os.WriteFile(env.ManifestFile(), []byte(b.String()), 0o600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", ManifestFileName, err)
+	}
+	return nil
+}
+
+// currentUser returns the name of the user running the process.
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// ReadManifest reads the MANIFEST in a temp directory. Directories created
+// by older versions have none; the error then wraps os.ErrNotExist.
+func ReadManifest(dir string) (*Manifest, error) {
+	// #nosec G304 - dir is an environment temp directory
+	f, err := os.Open(filepath.Join(dir, ManifestFileName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open manifest: %w", err)
+	}
+	defer f.Close()
+
+	m := &Manifest{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || strings.HasPrefix(key, "#") {
+			continue
+		}
+		value = parseLockValue(value)
+		switch key {
+		case "ID":
+			m.ID = value
+		case "Name":
+			m.Name = value
+		case "Project":
+			m.Project = value
+		case "CreatedAt":
+			m.CreatedAt, _ = time.Parse(time.RFC3339, value)
+		case "User":
+			m.User = value
+		case "Host":
+			m.Host = value
+		case "PID":
+			m.PID, _ = strconv.Atoi(value)
+		case "Worktree":
+			m.Worktree = value
+		case "BasePort":
+			m.BasePort, _ = strconv.Atoi(value)
+		case "PortCount":
+			m.PortCount, _ = strconv.Atoi(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if m.ID == "" {
+		return nil, errors.New("invalid manifest: no ID")
+	}
+	return m, nil
+}
+
+// Verify returns how the manifest disagrees with env (the ID, worktree, and
+// port range), or nil if it matches.
+func (m *Manifest) Verify(env *Environment) []string {
+	var mismatches []string
+	if m.ID != env.ID {
+		mismatches = append(mismatches, fmt.Sprintf("ID is %s, expected %s", m.ID, env.ID))
+	}
+	if m.Worktree != env.WorktreePath {
+		mismatches = append(mismatches, fmt.Sprintf("worktree is %s, expected %s", m.Worktree, env.WorktreePath))
+	}
+	if env.Ports != nil && (m.BasePort != env.Ports.BasePort || m.PortCount != env.Ports.Count) {
+		mismatches = append(mismatches, fmt.Sprintf("ports are %d+%d, expected %d+%d", m.BasePort, m.PortCount, env.Ports.BasePort, env.Ports.Count))
+	}
+	return mismatches
+}
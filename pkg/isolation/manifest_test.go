@@ -0,0 +1,85 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports/portstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvironmentManager_WritesManifest(t *testing.T) {
+	tmpDir := t.TempDir()
+	worktree := filepath.Join(tmpDir, "my\nworktree")
+	require.NoError(t, os.Mkdir(worktree, 0o750))
+	config := &Config{
+		WorktreePath: worktree,
+		LockDir:      filepath.Join(tmpDir, "locks"),
+		MaxRetries:   10,
+		Name:         "payments-it",
+		Host:         "runner-42",
+	}
+
+	before := time.Now().Add(-time.Second)
+	manager := NewEnvironmentManager(NewIDGenerator(config), portstest.NewFakeAllocator(20000))
+	env, err := manager.CreateEnvironment(3)
+	require.NoError(t, err)
+	defer manager.Cleanup(env)
+
+	manifest, err := ReadManifest(env.TempDir)
+	require.NoError(t, err)
+	assert.Equal(t, env.ID, manifest.ID)
+	assert.Equal(t, "payments-it", manifest.Name)
+	assert.Equal(t, env.Project, manifest.Project)
+	assert.Equal(t, "runner-42", manifest.Host)
+	assert.Equal(t, os.Getpid(), manifest.PID)
+	assert.NotEmpty(t, manifest.User)
+	assert.Equal(t, worktree, manifest.Worktree, "values are escaped like lock values")
+	assert.Equal(t, 20000, manifest.BasePort)
+	assert.Equal(t, 3, manifest.PortCount)
+	assert.True(t, manifest.CreatedAt.After(before))
+	assert.Empty(t, manifest.Verify(env))
+
+	// The manifest goes with the temp directory
+	require.NoError(t, manager.Cleanup(env))
+	_, err = ReadManifest(env.TempDir)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestManifest_Verify(t *testing.T) {
+	manifest := &Manifest{ID: "abc", Worktree: "/src/app", BasePort: 20000, PortCount: 3}
+	env := &Environment{ID: "abc", WorktreePath: "/src/app", Ports: &ports.PortRange{BasePort: 20000, Count: 3}}
+	assert.Empty(t, manifest.Verify(env))
+
+	env = &Environment{ID: "def", WorktreePath: "/src/other", Ports: &ports.PortRange{BasePort: 21000, Count: 3}}
+	assert.Equal(t, []string{
+		"ID is abc, expected def",
+		"worktree is /src/app, expected /src/other",
+		"ports are 20000+3, expected 21000+3",
+	}, manifest.Verify(env))
+}
+
+func TestReadManifest_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ManifestFileName), []byte("# empty\n"), 0o600))
+	_, err := ReadManifest(dir)
+	assert.ErrorContains(t, err, "no ID")
+}
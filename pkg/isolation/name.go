@@ -0,0 +1,65 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// maxNameLen bounds environment names so they stay readable in tables.
+const maxNameLen = 63
+
+// namePattern is the set of valid environment names: lowercase letters,
+// digits, '-', '_', and '.', starting with a letter or digit.
+var namePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// WithName gives the environment a human-friendly name. A name stays taken
+// until its environment is cleaned up or its lock expires (see
+// Config.MaxLockAge), since CLI-created environments outlive their creator.
+func WithName(name string) Option {
+	return func(c *Config) {
+		c.Name = name
+	}
+}
+
+// ValidateName checks that name is usable as an environment name.
+func ValidateName(name string) error {
+	if len(name) > maxNameLen || !namePattern.MatchString(name) {
+		return fmt.Errorf("invalid environment name %q: use up to %d lowercase letters, digits, '.', '_', or '-'", name, maxNameLen)
+	}
+	return nil
+}
+
+// nameHolder returns the lock file other than except in lockDir that
+// records name and has not expired as seen from host, or "".
+func nameHolder(lockDir, name, except, host string, maxAge time.Duration, now time.Time) string {
+	lockFiles, err := filepath.Glob(filepath.Join(lockDir, "env-*.lock"))
+	if err != nil {
+		return ""
+	}
+	for _, lockFile := range lockFiles {
+		if lockFile == except {
+			continue
+		}
+		info, err := ReadLockInfo(lockFile)
+		if err == nil && info.Name == name && !info.expiredOn(host, maxAge, now) {
+			return lockFile
+		}
+	}
+	return ""
+}
@@ -0,0 +1,92 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports/portstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pathologicalNames are directory names that break naive key=value and
+// shell parsing.
+var pathologicalNames = []string{
+	"with space",
+	"a=b",
+	"quote'single",
+	`quote"double`,
+	"dollar$HOME",
+	"new\nline",
+	"tab\tand [glob*?]",
+	"trailing ",
+	"ünïcødé",
+}
+
+func TestSpecialCharacterPaths(t *testing.T) {
+	for _, name := range pathologicalNames {
+		t.Run(strconv.Quote(name), func(t *testing.T) {
+			repo := filepath.Join(t.TempDir(), name)
+			require.NoError(t, os.MkdirAll(filepath.Join(repo, ".git"), 0o750))
+			worktree := filepath.Join(repo, name)
+			require.NoError(t, os.MkdirAll(worktree, 0o750))
+			// Values in the env file derive from the temp directory
+			t.Setenv("TMPDIR", filepath.Join(t.TempDir(), name))
+			require.NoError(t, os.MkdirAll(os.Getenv("TMPDIR"), 0o750))
+
+			config := &Config{
+				WorktreePath: worktree,
+				LockDir:      filepath.Join(t.TempDir(), "locks"),
+				MaxRetries:   10,
+				Project:      name,
+				TempLayout:   true,
+				Envrc:        true,
+				GitIgnore:    GitIgnoreExclude,
+			}
+			manager := NewEnvironmentManager(NewIDGenerator(config), portstest.NewFakeAllocator(20000))
+			env, err := manager.CreateEnvironment(2)
+			require.NoError(t, err)
+			defer manager.Cleanup(env)
+
+			info, err := ReadLockInfo(env.LockFile)
+			require.NoError(t, err)
+			assert.Equal(t, worktree, info.Worktree)
+			assert.Equal(t, name, info.Project)
+			assert.Equal(t, os.Getpid(), info.PID)
+			assert.Equal(t, env.Ports.BasePort, info.BasePort)
+
+			// The env file and .envrc survive being sourced by a shell
+			for _, file := range []string{env.EnvFile, filepath.Join(worktree, EnvrcFileName)} {
+				out, err := exec.Command("sh", "-c", `. "$1" && printf '%s|%s' "$TEMP_DIR" "$DATA_DIR"`, "sh", file).Output()
+				require.NoError(t, err, file)
+				assert.Equal(t, env.TempDir+"|"+filepath.Join(env.TempDir, "data"), string(out), file)
+			}
+
+			if _, err := exec.LookPath("git"); err == nil && name != "new\nline" {
+				cmd := exec.Command("git", "init", "-q", repo)
+				require.NoError(t, cmd.Run())
+				rel, err := filepath.Rel(repo, env.EnvFile)
+				require.NoError(t, err)
+				cmd = exec.Command("git", "-C", repo, "check-ignore", "-q", "--no-index", rel)
+				assert.NoError(t, cmd.Run(), "the env file is ignored")
+			}
+		})
+	}
+}
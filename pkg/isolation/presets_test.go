@@ -0,0 +1,65 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPresets(t *testing.T) {
+	assert.Equal(t, []string{"firebase-emulators", "kafka", "localstack", "postgres+redis"}, PresetNames())
+
+	ref := regexp.MustCompile(`\$\{(\w+)\}`)
+	for _, name := range PresetNames() {
+		preset, ok := Preset(name)
+		require.True(t, ok)
+		assert.Equal(t, name, preset.Name)
+		require.NoError(t, preset.Validate())
+		assert.NotEmpty(t, preset.Ports)
+
+		// Every reference resolves to one of the preset's ports
+		for _, value := range preset.Vars {
+			for _, m := range ref.FindAllStringSubmatch(value, -1) {
+				assert.Contains(t, preset.Ports, m[1], "%s: %s", name, value)
+			}
+		}
+	}
+
+	// Callers get a copy
+	p, _ := Preset("kafka")
+	p.Vars["EXTRA"] = "1"
+	p.Ports[0] = "CHANGED"
+	again, _ := Preset("kafka")
+	assert.NotContains(t, again.Vars, "EXTRA")
+	assert.Equal(t, "KAFKA_PORT", again.Ports[0])
+
+	_, ok := Preset("mongodb")
+	assert.False(t, ok)
+}
+
+func TestPresets_Environment(t *testing.T) {
+	preset, _ := Preset("postgres+redis")
+	env := &Environment{ID: "abc", Ports: &ports.PortRange{BasePort: 20000, Count: 2}, Profile: preset}
+
+	vars := env.Vars()
+	assert.Equal(t, "20000", vars["POSTGRES_PORT"])
+	assert.Equal(t, "20000", vars["PGPORT"])
+	assert.Equal(t, "redis://127.0.0.1:20001", vars["REDIS_URL"])
+}
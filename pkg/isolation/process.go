@@ -0,0 +1,109 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// bootIDPath identifies the current boot on Linux.
+const bootIDPath = "/proc/sys/kernel/random/boot_id"
+
+// BootID returns the kernel boot ID, or "" where it is unavailable.
+func BootID() string {
+	data, err := os.ReadFile(bootIDPath)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Hostname returns $PORTALLOC_HOST or the machine's hostname, or "" where
+// it is unavailable.
+func Hostname() string {
+	if host := os.Getenv(HostEnv); host != "" {
+		return host
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// ProcessStartTime returns the start time of pid in clock ticks since boot,
+// or 0 where it is unavailable (non-Linux, or pid not visible).
+func ProcessStartTime(pid int) uint64 {
+	if pid <= 0 {
+		return 0
+	}
+	// #nosec G304 - path is built from a numeric PID
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0
+	}
+
+	// The command name may contain spaces and parentheses; fields resume
+	// after the last ')'. starttime is field 22, the 20th after the name.
+	end := strings.LastIndexByte(string(data), ')')
+	if end < 0 {
+		return 0
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 20 {
+		return 0
+	}
+	start, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return start
+}
+
+// ProcessAlive reports whether the process identified by pid, bootID, and
+// startTime is still running. PID-only checks misreport liveness across
+// reboots, container restarts, and PID reuse, so a recorded boot ID or start
+// time that differs from the current one means the process is gone. Empty
+// or zero values (old locks, non-Linux hosts) are not compared.
+func ProcessAlive(pid int, bootID string, startTime uint64) bool {
+	if pid <= 0 {
+		return false
+	}
+	if bootID != "" {
+		if current := BootID(); current != "" && current != bootID {
+			return false
+		}
+	}
+
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// Signal 0 checks for existence without delivering a signal
+	if process.Signal(syscall.Signal(0)) != nil {
+		return false
+	}
+
+	if startTime != 0 {
+		if current := ProcessStartTime(pid); current != 0 && current != startTime {
+			return false
+		}
+	}
+	return true
+}
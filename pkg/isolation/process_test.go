@@ -0,0 +1,53 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessAlive(t *testing.T) {
+	pid := os.Getpid()
+
+	assert.True(t, ProcessAlive(pid, "", 0), "PID only")
+	assert.True(t, ProcessAlive(pid, BootID(), ProcessStartTime(pid)), "full identity")
+	assert.False(t, ProcessAlive(0, "", 0))
+	assert.False(t, ProcessAlive(999999, "", 0))
+
+	if BootID() != "" {
+		assert.False(t, ProcessAlive(pid, "another-boot", 0), "different boot")
+	}
+	if start := ProcessStartTime(pid); start != 0 {
+		assert.False(t, ProcessAlive(pid, "", start+1), "reused PID")
+	}
+}
+
+func TestCreateLock_RecordsProcessIdentity(t *testing.T) {
+	gen := NewIDGenerator(&Config{LockDir: t.TempDir()})
+
+	lockFile, err := gen.CreateLock("identity")
+	require.NoError(t, err)
+	info, err := ReadLockInfo(lockFile)
+	require.NoError(t, err)
+
+	assert.Equal(t, os.Getpid(), info.PID)
+	assert.Equal(t, BootID(), info.BootID)
+	assert.Equal(t, ProcessStartTime(os.Getpid()), info.StartTime)
+	assert.True(t, info.Alive())
+}
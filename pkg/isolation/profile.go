@@ -0,0 +1,123 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Profile is a named, reusable environment stack: what to call its ports and
+// which extra variables to export, e.g.
+//
+//	{
+//	  "ports": ["KAFKA_PORT", "ZOOKEEPER_PORT", "SCHEMA_REGISTRY_PORT"],
+//	  "vars": {"KAFKA_ADVERTISED_LISTENERS": "PLAINTEXT://127.0.0.1:${KAFKA_PORT}"}
+//	}
+//
+// Var values may reference other environment variables as ${NAME}.
+type Profile struct {
+	Name string `json:"name,omitempty"`
+	// Ports names the ports in allocation order. At least len(Ports) ports
+	// are allocated.
+	Ports []string `json:"ports,omitempty"`
+	// Vars are additional variables exported after the port variables.
+	Vars map[string]string `json:"vars,omitempty"`
+}
+
+// Option customizes a Config.
+type Option func(*Config)
+
+// WithProfile applies a profile: its port names, extra variables, and
+// minimum port count.
+func WithProfile(p *Profile) Option {
+	return func(c *Config) {
+		c.Profile = p
+	}
+}
+
+// Apply applies opts to c and returns c.
+func (c *Config) Apply(opts ...Option) *Config {
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Validate checks that port and variable names are usable shell variable names.
+func (p *Profile) Validate() error {
+	seen := make(map[string]bool, len(p.Ports))
+	for _, name := range p.Ports {
+		if !isVarName(name) {
+			return fmt.Errorf("profile %s: invalid port name %q", p.Name, name)
+		}
+		if seen[name] {
+			return fmt.Errorf("profile %s: duplicate port name %q", p.Name, name)
+		}
+		seen[name] = true
+	}
+	for name := range p.Vars {
+		if !isVarName(name) {
+			return fmt.Errorf("profile %s: invalid variable name %q", p.Name, name)
+		}
+	}
+	return nil
+}
+
+// portNames returns the names of the environment's ports in allocation order.
+func (env *Environment) portNames() []string {
+	if env.Profile != nil && len(env.Profile.Ports) > 0 {
+		return env.Profile.Ports
+	}
+	return portNames
+}
+
+// profileVars expands the profile's variables against vars, in name order.
+func (env *Environment) profileVars(vars []envVar) []envVar {
+	if env.Profile == nil || len(env.Profile.Vars) == 0 {
+		return nil
+	}
+
+	lookup := make(map[string]string, len(vars))
+	for _, v := range vars {
+		lookup[v.name] = v.value
+	}
+
+	names := make([]string, 0, len(env.Profile.Vars))
+	for name := range env.Profile.Vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := make([]envVar, 0, len(names))
+	for _, name := range names {
+		value := os.Expand(env.Profile.Vars[name], func(key string) string {
+			return lookup[key]
+		})
+		out = append(out, envVar{name, value})
+	}
+	return out
+}
+
+func isVarName(s string) bool {
+	if s == "" || (s[0] >= '0' && s[0] <= '9') {
+		return false
+	}
+	return strings.IndexFunc(s, func(r rune) bool {
+		return !(r == '_' || (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9'))
+	}) < 0
+}
@@ -0,0 +1,110 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports/portstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func kafkaProfile() *Profile {
+	return &Profile{
+		Name:  "kafka",
+		Ports: []string{"KAFKA_PORT", "ZOOKEEPER_PORT", "SCHEMA_REGISTRY_PORT"},
+		Vars: map[string]string{
+			"KAFKA_ADVERTISED_LISTENERS": "PLAINTEXT://127.0.0.1:${KAFKA_PORT}",
+			"KAFKA_LOG_DIRS":             "${TEMP_DIR}/kafka-logs",
+		},
+	}
+}
+
+func TestEnvironmentManager_WithProfile(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := (&Config{
+		WorktreePath: tmpDir,
+		LockDir:      filepath.Join(tmpDir, "locks"),
+		MaxRetries:   10,
+	}).Apply(WithProfile(kafkaProfile()))
+
+	manager := NewEnvironmentManager(NewIDGenerator(config), portstest.NewFakeAllocator(20000))
+
+	// The profile raises the port count to the number of named ports
+	env, err := manager.CreateEnvironment(1)
+	require.NoError(t, err)
+	defer manager.Cleanup(env)
+	require.Equal(t, 3, env.Ports.Count)
+
+	vars := env.Vars()
+	assert.Equal(t, "20000", vars["KAFKA_PORT"])
+	assert.Equal(t, "20001", vars["ZOOKEEPER_PORT"])
+	assert.Equal(t, "20002", vars["SCHEMA_REGISTRY_PORT"])
+	assert.Equal(t, "PLAINTEXT://127.0.0.1:20000", vars["KAFKA_ADVERTISED_LISTENERS"])
+	assert.Equal(t, env.TempDir+"/kafka-logs", vars["KAFKA_LOG_DIRS"])
+	assert.NotContains(t, vars, "FIRESTORE_PORT")
+
+	// Profile variables come after the port variables, in name order
+	names := env.VarNames()
+	assert.Equal(t, []string{"KAFKA_ADVERTISED_LISTENERS", "KAFKA_LOG_DIRS"}, names[len(names)-2:])
+
+	assert.Equal(t, map[string]string{
+		"kafka":           "127.0.0.1:20000",
+		"zookeeper":       "127.0.0.1:20001",
+		"schema_registry": "127.0.0.1:20002",
+	}, env.Services())
+
+	port, err := env.ServicePort("zookeeper")
+	require.NoError(t, err)
+	assert.Equal(t, 20001, port)
+
+	data, err := os.ReadFile(env.EnvFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "KAFKA_ADVERTISED_LISTENERS=PLAINTEXT://127.0.0.1:20000\n")
+}
+
+func TestEnvironmentManager_InvalidProfile(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := (&Config{
+		WorktreePath: tmpDir,
+		LockDir:      filepath.Join(tmpDir, "locks"),
+		MaxRetries:   10,
+	}).Apply(WithProfile(&Profile{Name: "bad", Ports: []string{"A_PORT", "A_PORT"}}))
+
+	manager := NewEnvironmentManager(NewIDGenerator(config), portstest.NewFakeAllocator(20000))
+	_, err := manager.CreateEnvironment(2)
+	assert.ErrorContains(t, err, "duplicate port name")
+}
+
+func TestProfile_Validate(t *testing.T) {
+	assert.NoError(t, kafkaProfile().Validate())
+	assert.Error(t, (&Profile{Ports: []string{"1PORT"}}).Validate())
+	assert.Error(t, (&Profile{Ports: []string{"API-PORT"}}).Validate())
+	assert.Error(t, (&Profile{Vars: map[string]string{"": "x"}}).Validate())
+}
+
+func TestEnvironment_ProfileJSONRoundTrip(t *testing.T) {
+	env := &Environment{ID: "abc", Ports: nil, Profile: kafkaProfile()}
+	data, err := json.Marshal(env)
+	require.NoError(t, err)
+
+	var decoded Environment
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, kafkaProfile(), decoded.Profile)
+}
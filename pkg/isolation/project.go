@@ -0,0 +1,50 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// WithProject sets the project namespace recorded with the environment, so
+// teams sharing a machine can list and clean up only their own
+// environments. By default it is derived from the worktree (see ProjectKey).
+func WithProject(project string) Option {
+	return func(c *Config) {
+		c.Project = project
+	}
+}
+
+// ProjectKey derives the project of worktree: the directory name of the git
+// repository's main worktree, shared by all of its linked worktrees, or the
+// name of worktree itself outside git.
+func ProjectKey(worktree string) string {
+	dir, err := filepath.Abs(worktree)
+	if err != nil {
+		return ""
+	}
+
+	if gitDir, ok := findGitDir(dir); ok {
+		commonDir := gitCommonDir(gitDir)
+		if filepath.Base(commonDir) == ".git" {
+			return filepath.Base(filepath.Dir(commonDir))
+		}
+		// Bare repositories and submodules (.git/modules/<name>)
+		return strings.TrimSuffix(filepath.Base(commonDir), ".git")
+	}
+
+	return filepath.Base(dir)
+}
@@ -0,0 +1,72 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports/portstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProjectKey(t *testing.T) {
+	t.Run("uses the directory name outside a repository", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "scratch")
+		require.NoError(t, os.MkdirAll(dir, 0o750))
+		assert.Equal(t, "scratch", ProjectKey(dir))
+	})
+
+	t.Run("uses the repository name from a subdirectory", func(t *testing.T) {
+		repo := filepath.Join(t.TempDir(), "payments")
+		writeFile(t, filepath.Join(repo, ".git", "HEAD"), "ref: refs/heads/main\n")
+		sub := filepath.Join(repo, "services", "api")
+		require.NoError(t, os.MkdirAll(sub, 0o750))
+
+		assert.Equal(t, "payments", ProjectKey(sub))
+	})
+
+	t.Run("shares the main repository name across linked worktrees", func(t *testing.T) {
+		root := t.TempDir()
+		mainGit := filepath.Join(root, "payments", ".git")
+		worktreeGit := filepath.Join(mainGit, "worktrees", "feature-x")
+		writeFile(t, filepath.Join(worktreeGit, "HEAD"), "ref: refs/heads/feature-x\n")
+		writeFile(t, filepath.Join(worktreeGit, "commondir"), "../..\n")
+		writeFile(t, filepath.Join(root, "feature-x", ".git"), "gitdir: "+worktreeGit+"\n")
+
+		assert.Equal(t, "payments", ProjectKey(filepath.Join(root, "feature-x")))
+	})
+}
+
+func TestEnvironmentManager_Project(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := (&Config{
+		WorktreePath: tmpDir,
+		LockDir:      filepath.Join(tmpDir, "locks"),
+		MaxRetries:   10,
+	}).Apply(WithProject("payments"))
+	manager := NewEnvironmentManager(NewIDGenerator(config), portstest.NewFakeAllocator(20000))
+
+	env, err := manager.CreateEnvironment(2)
+	require.NoError(t, err)
+	defer manager.Cleanup(env)
+	assert.Equal(t, "payments", env.Project)
+
+	info, err := ReadLockInfo(env.LockFile)
+	require.NoError(t, err)
+	assert.Equal(t, "payments", info.Project)
+}
@@ -0,0 +1,79 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"errors"
+	"fmt"
+)
+
+// EnvironmentStore records environments so that they can be found again
+// by instance ID. *state.Manager implements it.
+type EnvironmentStore interface {
+	RecordEnvironment(env *Environment) error
+	// LoadByInstanceID returns the environment recorded with instanceID,
+	// or an error wrapping ErrNotFound if there is none.
+	LoadByInstanceID(instanceID string) (*Environment, error)
+}
+
+// WithStore sets the store GetOrCreateByInstanceID looks environments up
+// in and records new ones to.
+func WithStore(store EnvironmentStore) Option {
+	return func(c *Config) {
+		c.Store = store
+	}
+}
+
+// GetOrCreateByInstanceID returns the environment recorded in Config.Store
+// for instanceID if it still passes Validate and has at least portsNeeded
+// ports. Otherwise it creates an environment with that instance ID and
+// records it, so every process of a CI job that passes the job ID shares
+// one environment.
+//
+// Like CreateEnvironments, it sets Config.InstanceID while creating, so it
+// must not run concurrently with other calls on em.
+func (em *EnvironmentManager) GetOrCreateByInstanceID(instanceID string, portsNeeded int) (*Environment, error) {
+	if instanceID == "" {
+		return nil, errors.New("instance ID is required")
+	}
+	store := em.config.Store
+	if store == nil {
+		return nil, errors.New("no environment store configured (see WithStore)")
+	}
+
+	env, err := store.LoadByInstanceID(instanceID)
+	switch {
+	case err == nil:
+		if env.Ports != nil && env.Ports.Count >= portsNeeded && em.Validate(env) == nil {
+			return env, nil
+		}
+	case !errors.Is(err, ErrNotFound):
+		return nil, fmt.Errorf("failed to look up instance %s: %w", instanceID, err)
+	}
+
+	saved, derived := em.config.InstanceID, em.config.derivedInstanceID
+	em.config.InstanceID, em.config.derivedInstanceID = instanceID, false
+	defer func() { em.config.InstanceID, em.config.derivedInstanceID = saved, derived }()
+
+	env, err = em.CreateEnvironment(portsNeeded)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.RecordEnvironment(env); err != nil {
+		_ = em.Cleanup(env)
+		return nil, fmt.Errorf("failed to record environment: %w", err)
+	}
+	return env, nil
+}
@@ -0,0 +1,156 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports/portstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memStore is an in-memory EnvironmentStore.
+type memStore struct {
+	envs map[string]*Environment
+	err  error
+}
+
+func (s *memStore) RecordEnvironment(env *Environment) error {
+	if s.err != nil {
+		return s.err
+	}
+	copied := *env
+	s.envs[env.InstanceID] = &copied
+	return nil
+}
+
+func (s *memStore) LoadByInstanceID(instanceID string) (*Environment, error) {
+	env, ok := s.envs[instanceID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, instanceID)
+	}
+	return env, nil
+}
+
+func TestEnvironmentManager_GetOrCreateByInstanceID(t *testing.T) {
+	newManager := func(t *testing.T, store EnvironmentStore) *EnvironmentManager {
+		tmpDir := t.TempDir()
+		config := (&Config{
+			WorktreePath: tmpDir,
+			LockDir:      filepath.Join(tmpDir, "locks"),
+			MaxRetries:   10,
+		}).Apply(WithStore(store))
+		return NewEnvironmentManager(NewIDGenerator(config), portstest.NewFakeAllocator(20000))
+	}
+
+	t.Run("reuses the environment recorded for the instance", func(t *testing.T) {
+		store := &memStore{envs: map[string]*Environment{}}
+		manager := newManager(t, store)
+
+		first, err := manager.GetOrCreateByInstanceID("ci-job-7", 3)
+		require.NoError(t, err)
+		defer manager.Cleanup(first)
+		assert.Equal(t, "ci-job-7", first.InstanceID)
+		assert.Contains(t, store.envs, "ci-job-7")
+
+		again, err := manager.GetOrCreateByInstanceID("ci-job-7", 2)
+		require.NoError(t, err)
+		assert.Equal(t, first.ID, again.ID)
+		assert.Equal(t, first.Ports.BasePort, again.Ports.BasePort)
+
+		other, err := manager.GetOrCreateByInstanceID("ci-job-8", 3)
+		require.NoError(t, err)
+		defer manager.Cleanup(other)
+		assert.NotEqual(t, first.ID, other.ID)
+	})
+
+	t.Run("derived instance IDs are not recorded", func(t *testing.T) {
+		store := &memStore{envs: map[string]*Environment{}}
+		manager := newManager(t, store)
+		require.NotEmpty(t, manager.config.InstanceID, "NewIDGenerator derives one")
+
+		env, err := manager.CreateEnvironment(2)
+		require.NoError(t, err)
+		defer manager.Cleanup(env)
+		assert.Empty(t, env.InstanceID)
+		require.NoError(t, store.RecordEnvironment(env))
+
+		reused, err := manager.GetOrCreateByInstanceID(manager.config.InstanceID, 2)
+		require.NoError(t, err)
+		defer manager.Cleanup(reused)
+		assert.NotEqual(t, env.ID, reused.ID)
+		assert.Equal(t, manager.config.InstanceID, reused.InstanceID)
+
+		again, err := manager.CreateEnvironment(2)
+		require.NoError(t, err)
+		defer manager.Cleanup(again)
+		assert.Empty(t, again.InstanceID, "the derived instance ID is restored")
+	})
+
+	t.Run("replaces an environment that is no longer valid", func(t *testing.T) {
+		store := &memStore{envs: map[string]*Environment{}}
+		manager := newManager(t, store)
+
+		first, err := manager.GetOrCreateByInstanceID("ci-job-7", 3)
+		require.NoError(t, err)
+		require.NoError(t, os.RemoveAll(first.TempDir))
+
+		second, err := manager.GetOrCreateByInstanceID("ci-job-7", 3)
+		require.NoError(t, err)
+		defer manager.Cleanup(second)
+		assert.NotEqual(t, first.ID, second.ID)
+		assert.Equal(t, second.ID, store.envs["ci-job-7"].ID)
+		_ = manager.Cleanup(first)
+	})
+
+	t.Run("replaces an environment with too few ports", func(t *testing.T) {
+		store := &memStore{envs: map[string]*Environment{}}
+		manager := newManager(t, store)
+
+		first, err := manager.GetOrCreateByInstanceID("ci-job-7", 2)
+		require.NoError(t, err)
+		defer manager.Cleanup(first)
+
+		second, err := manager.GetOrCreateByInstanceID("ci-job-7", 4)
+		require.NoError(t, err)
+		defer manager.Cleanup(second)
+		assert.NotEqual(t, first.ID, second.ID)
+		assert.Equal(t, 4, second.Ports.Count)
+	})
+
+	t.Run("cleans up when recording fails", func(t *testing.T) {
+		store := &memStore{envs: map[string]*Environment{}, err: errors.New("disk full")}
+		manager := newManager(t, store)
+
+		_, err := manager.GetOrCreateByInstanceID("ci-job-7", 2)
+		require.ErrorContains(t, err, "disk full")
+		entries, err := os.ReadDir(manager.config.LockDir)
+		require.NoError(t, err)
+		assert.Empty(t, entries, "the lock is released")
+	})
+
+	t.Run("requires a store and an instance ID", func(t *testing.T) {
+		_, err := newManager(t, nil).GetOrCreateByInstanceID("ci-job-7", 2)
+		assert.ErrorContains(t, err, "no environment store")
+
+		_, err = newManager(t, &memStore{envs: map[string]*Environment{}}).GetOrCreateByInstanceID("", 2)
+		assert.ErrorContains(t, err, "instance ID is required")
+	})
+}
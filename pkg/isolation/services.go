@@ -0,0 +1,69 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ServicesFileName is the service registry written into every temp directory.
+const ServicesFileName = "services.json"
+
+// serviceName returns the registry name of the port at index i: the
+// lower-cased port variable without its _PORT suffix (e.g. "api"), or
+// "portN" for ports beyond the named ones.
+func (env *Environment) serviceName(i int) string {
+	if names := env.portNames(); i < len(names) {
+		return strings.ToLower(strings.TrimSuffix(names[i], "_PORT"))
+	}
+	return fmt.Sprintf("port%d", i)
+}
+
+// Services maps every allocated port's service name to its loopback address,
+// e.g. "api" -> "127.0.0.1:23088". This is the content of ServicesFile.
+func (env *Environment) Services() map[string]string {
+	services := make(map[string]string, env.Ports.Count)
+	for i := 0; i < env.Ports.Count; i++ {
+		addr, err := env.Addr(i)
+		if err != nil {
+			continue
+		}
+		services[env.serviceName(i)] = addr
+	}
+	return services
+}
+
+// ServicesFile returns the path of the environment's services.json.
+func (env *Environment) ServicesFile() string {
+	return filepath.Join(env.TempDir, ServicesFileName)
+}
+
+// writeServicesFile writes the service registry into the temp directory so
+// non-Go harnesses can discover ports without parsing dotenv files.
+func writeServicesFile(env *Environment) error {
+	data, err := json.MarshalIndent(env.Services(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode services: %w", err)
+	}
+
+	if err := os.WriteFile(env.ServicesFile(), append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", ServicesFileName, err)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package isolation
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports/portstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvironment_Services(t *testing.T) {
+	env := &Environment{Ports: &ports.PortRange{BasePort: 21000, Count: 7}}
+
+	assert.Equal(t, map[string]string{
+		"firestore": "127.0.0.1:21000",
+		"auth":      "127.0.0.1:21001",
+		"api":       "127.0.0.1:21002",
+		"metrics":   "127.0.0.1:21003",
+		"debug":     "127.0.0.1:21004",
+		"port5":     "127.0.0.1:21005",
+		"port6":     "127.0.0.1:21006",
+	}, env.Services())
+
+	// Every registry name resolves back to its port
+	for name, addr := range env.Services() {
+		port, err := env.ServicePort(name)
+		require.NoError(t, err, name)
+		assert.Equal(t, addr, "127.0.0.1:"+strconv.Itoa(port), name)
+	}
+}
+
+func TestEnvironmentManager_WritesServicesFile(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := &Config{
+		WorktreePath: tmpDir,
+		LockDir:      filepath.Join(tmpDir, "locks"),
+		MaxRetries:   10,
+	}
+
+	manager := NewEnvironmentManager(NewIDGenerator(config), portstest.NewFakeAllocator(20000))
+	env, err := manager.CreateEnvironment(3)
+	require.NoError(t, err)
+	defer manager.Cleanup(env)
+
+	data, err := os.ReadFile(env.ServicesFile())
+	require.NoError(t, err)
+
+	var services map[string]string
+	require.NoError(t, json.Unmarshal(data, &services))
+	assert.Equal(t, env.Services(), services)
+	assert.Len(t, services, 3)
+
+	assert.Equal(t, env.ServicesFile(), env.Vars()["SERVICES_FILE"])
+}
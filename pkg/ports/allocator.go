@@ -35,6 +35,7 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
+	"log/slog"
 	"net"
 	"time"
 )
@@ -55,6 +56,46 @@ const (
 //   - EndPort: Upper bound of port range (exclusive, default: 30000)
 //   - MaxRetries: Maximum number of allocation attempts (default: 10)
 //   - RetryDelay: Wait time between retries (default: 1s)
+//   - Logger: Receives a debug record for every allocation attempt (optional)
+//   - Observer: Receives allocation telemetry for metrics (optional)
+//   - CheckLoopbackOnly: Probe 127.0.0.1 instead of all interfaces
+//   - Coordinated: Coordinate with other coordinated allocators in this process
+//   - ScanCacheTTL: Serve allocations from a cached scan of the range (0 disables)
+//   - Spacing: Start every range on a fresh block of this many ports (0 disables)
+//   - Reserved: Ports never allocated, even when free (optional)
+//
+// Probing the wildcard address can trigger macOS firewall dialogs or need
+// network permissions in sandboxed CI. Loopback probing avoids both and
+// still detects services bound to loopback or to all interfaces on Linux;
+// on macOS it may miss services bound only to the wildcard address.
+//
+// Uncoordinated allocators pick random windows independently, so goroutines
+// allocating at the same time can race for the same window and exhaust
+// MaxRetries. Coordinated allocators share an in-process set of claimed
+// ports and are served in FIFO order; they scan the whole range and only
+// fail when no free window exists. Claimed ports stay claimed until
+// Release is called.
+//
+// With ScanCacheTTL set, the first allocation probes the whole range in
+// parallel and records the free ports in a bitmap. Later allocations pick
+// windows from the bitmap and only probe the chosen window to verify it,
+// until the bitmap is older than ScanCacheTTL and the range is rescanned.
+// This suits suites allocating hundreds of ranges per minute; keep the TTL
+// short (seconds), since ports bound by other processes after a scan are
+// only noticed when a window is verified. Coordinated allocation does not
+// use the cache.
+//
+// With Spacing set, base ports are StartPort plus a multiple of Spacing, so
+// each range starts on a fresh block and the rest of its block stays
+// unallocated. A service that opens base+count by convention then lands in
+// that buffer instead of in the next environment's range. Ranges larger
+// than Spacing are rejected. Partitioned allocators use their own blocks
+// and ignore Spacing.
+//
+// Reserved ports, typically loaded with LoadReservedPorts, are skipped by
+// AllocateRange, Partitioned allocators, and FreePorts without being
+// probed. AllocateSpecific and IsPortInUse still probe them, since callers
+// name those ports explicitly.
 //
 // Example custom configuration:
 //
@@ -69,43 +110,72 @@ type AllocatorConfig struct {
 	EndPort    int
 	MaxRetries int
 	RetryDelay time.Duration
+	Logger     *slog.Logger
+	Observer   Observer
+
+	CheckLoopbackOnly bool
+	Coordinated       bool
+	ScanCacheTTL      time.Duration
+	Spacing           int
+	Reserved          *ReservedPorts
 }
 
 // DefaultAllocatorConfig returns default configuration.
 //
 // Default values:
-//   - StartPort: 20000
-//   - EndPort: 30000
+//   - StartPort: 20000 (or from $PORTALLOC_PORT_RANGE, see DefaultRange)
+//   - EndPort: 30000 (or from $PORTALLOC_PORT_RANGE)
 //   - MaxRetries: 10
 //   - RetryDelay: 1 second
+//   - CheckLoopbackOnly: true
 //
 // This range (20000-30000) is chosen to avoid conflicts with:
 //   - Well-known ports (0-1023)
 //   - Registered ports (1024-49151)
 //   - Most ephemeral port ranges (varies by OS, typically 32768-60999)
 func DefaultAllocatorConfig() *AllocatorConfig {
+	start, end := DefaultRange()
 	return &AllocatorConfig{
-		StartPort:  DefaultStartPort,
-		EndPort:    DefaultEndPort,
+		StartPort:  start,
+		EndPort:    end,
 		MaxRetries: DefaultMaxRetries,
 		RetryDelay: 1 * time.Second,
+
+		CheckLoopbackOnly: true,
 	}
 }
 
+// PortAllocator allocates ranges of consecutive ports. *Allocator is the
+// real implementation; portstest.FakeAllocator is a deterministic one for
+// unit tests.
+type PortAllocator interface {
+	AllocateRange(portsNeeded int) (int, error)
+	IsPortInUse(port int) bool
+}
+
+var _ PortAllocator = (*Allocator)(nil)
+
 // Allocator allocates available ports for test environments.
 //
-// The allocator is stateless and thread-safe. It checks port availability
-// at allocation time using TCP listeners, ensuring accurate detection
-// without caching or state management.
+// By default the allocator keeps no state: it checks port availability at
+// allocation time using TCP listeners. With ScanCacheTTL set it keeps a
+// bitmap of the last range scan, and coordinated allocators record their
+// ports in a process-wide claimed set until Release; see AllocatorConfig.
+// Returned windows are always verified with real probes.
 //
 // Thread-safety: All methods are safe for concurrent use.
 type Allocator struct {
 	config *AllocatorConfig
+	listen ListenFunc
+	clock  Clock
+	cache  scanCache
 }
 
 // NewAllocator creates a new port allocator.
 //
-// If config is nil, DefaultAllocatorConfig() is used.
+// If config is nil, DefaultAllocatorConfig() is used. Options replace the
+// listener used for probes and the clock used between retries (see
+// WithListenFunc and WithClock).
 //
 // Example with default config:
 //
@@ -120,14 +190,20 @@ type Allocator struct {
 //	    RetryDelay: 100 * time.Millisecond,
 //	}
 //	allocator := ports.NewAllocator(config)
-func NewAllocator(config *AllocatorConfig) *Allocator {
+func NewAllocator(config *AllocatorConfig, opts ...Option) *Allocator {
 	if config == nil {
 		config = DefaultAllocatorConfig()
 	}
 
-	return &Allocator{
+	a := &Allocator{
 		config: config,
+		listen: net.Listen,
+		clock:  SystemClock{},
+	}
+	for _, opt := range opts {
+		opt(a)
 	}
+	return a
 }
 
 // randomIntn generates a cryptographically secure random integer in range [0, n).
@@ -164,51 +240,127 @@ func randomIntn(n int) (int, error) {
 //
 // Thread-safety: Safe for concurrent use.
 func (a *Allocator) AllocateRange(portsNeeded int) (int, error) {
+	o := a.observe(portsNeeded)
 	if portsNeeded <= 0 {
-		return 0, fmt.Errorf("portsNeeded must be positive, got %d", portsNeeded)
+		return o.done(0, fmt.Errorf("portsNeeded must be positive, got %d", portsNeeded))
 	}
 
 	portRange := a.config.EndPort - a.config.StartPort - portsNeeded
 	if portRange <= 0 {
-		return 0, fmt.Errorf("insufficient port range for %d ports", portsNeeded)
+		return o.done(0, fmt.Errorf("insufficient port range for %d ports", portsNeeded))
+	}
+	if a.config.Spacing > 0 && portsNeeded > a.config.Spacing {
+		return o.done(0, fmt.Errorf("%d ports do not fit in a spacing of %d", portsNeeded, a.config.Spacing))
+	}
+	windows, step := a.windows(portRange)
+
+	if a.config.Coordinated {
+		return o.done(a.allocateCoordinated(o, portsNeeded, windows, step))
+	}
+	if a.config.ScanCacheTTL > 0 {
+		return o.done(a.allocateCached(o, portsNeeded, windows, step))
+	}
+
+	// Only windows clear of reserved ports are candidates
+	candidates := a.unreservedWindows(windows, step, portsNeeded)
+	if candidates != nil && len(candidates) == 0 {
+		return o.done(0, fmt.Errorf("%w: every range of %d ports contains a reserved port", ErrNoPortsAvailable, portsNeeded))
 	}
 
 	for attempt := 0; attempt < a.config.MaxRetries; attempt++ {
 		// Random starting point to reduce collision probability
-		offset, err := randomIntn(portRange)
+		offset, err := randomIntn(windows)
+		if candidates != nil {
+			offset, err = randomIntn(len(candidates))
+			offset = candidates[offset]
+		}
 		if err != nil {
-			return 0, fmt.Errorf("failed to generate random offset: %w", err)
+			return o.done(0, fmt.Errorf("failed to generate random offset: %w", err))
 		}
-		basePort := a.config.StartPort + offset
+		basePort := a.config.StartPort + offset*step
 
 		// Check if all required ports are available
-		if a.arePortsAvailable(basePort, portsNeeded) {
-			return basePort, nil
+		busyPort := o.probe(basePort, func() int { return a.firstBusyPort(basePort, portsNeeded) })
+		if busyPort == 0 {
+			a.debug("allocation attempt succeeded", "attempt", attempt+1, "candidate_base", basePort, "count", portsNeeded)
+			return o.done(basePort, nil)
 		}
 
+		a.debug("allocation attempt failed",
+			"attempt", attempt+1,
+			"max_attempts", a.config.MaxRetries,
+			"candidate_base", basePort,
+			"count", portsNeeded,
+			"busy_port", busyPort,
+			"busy_offset", busyPort-basePort,
+			"backoff", a.config.RetryDelay,
+		)
+
 		// Wait before retry
-		time.Sleep(a.config.RetryDelay)
+		o.retry(busyPort, a.config.RetryDelay)
+		a.clock.Sleep(a.config.RetryDelay)
+	}
+
+	a.debug("allocation exhausted retries", "attempts", a.config.MaxRetries, "count", portsNeeded,
+		"start_port", a.config.StartPort, "end_port", a.config.EndPort)
+	return o.done(0, fmt.Errorf("%w: unable to allocate %d consecutive ports after %d attempts", ErrNoPortsAvailable, portsNeeded, a.config.MaxRetries))
+}
+
+// windows returns the number of candidate base ports among the first
+// portRange ports of the range and the distance between them: every port,
+// or every Spacing-th port.
+func (a *Allocator) windows(portRange int) (windows, step int) {
+	if a.config.Spacing <= 0 {
+		return portRange, 1
 	}
+	return (portRange-1)/a.config.Spacing + 1, a.config.Spacing
+}
+
+// windowsPast returns how many windows, step ports apart, to skip from the
+// one at basePort so the next one starts after busyPort.
+func windowsPast(basePort, busyPort, step int) int {
+	return (busyPort - basePort + step) / step
+}
 
-	return 0, fmt.Errorf("unable to allocate %d consecutive ports after %d attempts", portsNeeded, a.config.MaxRetries)
+// unreservedWindows returns the offsets of the windows holding no reserved
+// port, or nil if no ports are reserved.
+func (a *Allocator) unreservedWindows(windows, step, portsNeeded int) []int {
+	if a.config.Reserved.Len() == 0 {
+		return nil
+	}
+	candidates := make([]int, 0, windows)
+	for offset := 0; offset < windows; offset++ {
+		basePort := a.config.StartPort + offset*step
+		if !a.config.Reserved.Overlaps(basePort, basePort+portsNeeded-1) {
+			candidates = append(candidates, offset)
+		}
+	}
+	return candidates
 }
 
-// arePortsAvailable checks if a range of ports is available.
-func (a *Allocator) arePortsAvailable(basePort, count int) bool {
+// firstBusyPort returns the first unavailable port in a range, or 0 if the
+// whole range is available.
+func (a *Allocator) firstBusyPort(basePort, count int) int {
 	for i := 0; i < count; i++ {
 		port := basePort + i
-		if !a.isPortAvailable(port) {
-			return false
+		if a.config.Reserved.Contains(port) || !a.isPortAvailable(port) {
+			return port
 		}
 	}
-	return true
+	return 0
+}
+
+// debug logs an allocation trace record if a logger is configured.
+func (a *Allocator) debug(msg string, args ...any) {
+	if a.config.Logger != nil {
+		a.config.Logger.Debug(msg, args...)
+	}
 }
 
 // isPortAvailable checks if a specific port is available.
 func (a *Allocator) isPortAvailable(port int) bool {
 	// Try to bind to the port
-	addr := fmt.Sprintf(":%d", port)
-	listener, err := net.Listen("tcp", addr)
+	listener, err := a.listen("tcp", a.probeAddr(port))
 	if err != nil {
 		return false
 	}
@@ -216,6 +368,14 @@ func (a *Allocator) isPortAvailable(port int) bool {
 	return true
 }
 
+// probeAddr returns the address bound to test port availability.
+func (a *Allocator) probeAddr(port int) string {
+	if a.config.CheckLoopbackOnly {
+		return fmt.Sprintf("127.0.0.1:%d", port)
+	}
+	return fmt.Sprintf(":%d", port)
+}
+
 // IsPortInUse checks if a port is currently in use.
 //
 // Parameters:
@@ -15,6 +15,9 @@
 package ports
 
 import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
 	"net"
 	"sync"
 	"testing"
@@ -70,6 +73,51 @@ func TestAllocator_AllocateRange(t *testing.T) {
 	})
 }
 
+func TestAllocator_Logger(t *testing.T) {
+	// Occupy the only candidate base port so every attempt fails on it
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	defer listener.Close()
+	busyPort := listener.Addr().(*net.TCPAddr).Port
+
+	var buf bytes.Buffer
+	config := &AllocatorConfig{
+		StartPort:  busyPort,
+		EndPort:    busyPort + 2,
+		MaxRetries: 2,
+		RetryDelay: time.Millisecond,
+		Logger:     slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	}
+
+	_, err = NewAllocator(config).AllocateRange(1)
+	require.Error(t, err)
+
+	type record struct {
+		Msg           string `json:"msg"`
+		Attempt       int    `json:"attempt"`
+		CandidateBase int    `json:"candidate_base"`
+		BusyPort      int    `json:"busy_port"`
+		Backoff       int64  `json:"backoff"`
+	}
+	var records []record
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var r record
+		require.NoError(t, decoder.Decode(&r))
+		records = append(records, r)
+	}
+
+	require.Len(t, records, 3)
+	for i, r := range records[:2] {
+		assert.Equal(t, "allocation attempt failed", r.Msg)
+		assert.Equal(t, i+1, r.Attempt)
+		assert.Equal(t, busyPort, r.CandidateBase)
+		assert.Equal(t, busyPort, r.BusyPort)
+		assert.Equal(t, time.Millisecond.Nanoseconds(), r.Backoff)
+	}
+	assert.Equal(t, "allocation exhausted retries", records[2].Msg)
+}
+
 func TestAllocator_IsPortAvailable(t *testing.T) {
 	config := DefaultAllocatorConfig()
 	alloc := NewAllocator(config)
@@ -221,6 +269,25 @@ func TestDefaultAllocatorConfig(t *testing.T) {
 		assert.Equal(t, DefaultEndPort, config.EndPort)
 		assert.Equal(t, DefaultMaxRetries, config.MaxRetries)
 		assert.Greater(t, config.RetryDelay, time.Duration(0))
+		assert.True(t, config.CheckLoopbackOnly)
+	})
+}
+
+func TestAllocator_CheckLoopbackOnly(t *testing.T) {
+	loopback := NewAllocator(&AllocatorConfig{CheckLoopbackOnly: true})
+	wildcard := NewAllocator(&AllocatorConfig{})
+
+	assert.Equal(t, "127.0.0.1:25000", loopback.probeAddr(25000))
+	assert.Equal(t, ":25000", wildcard.probeAddr(25000))
+
+	t.Run("detects loopback listener", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+
+		port := listener.Addr().(*net.TCPAddr).Port
+		assert.True(t, loopback.IsPortInUse(port))
+		assert.True(t, wildcard.IsPortInUse(port))
 	})
 }
 
@@ -242,3 +309,58 @@ func TestNewAllocator(t *testing.T) {
 		assert.Equal(t, customConfig, alloc.config)
 	})
 }
+
+func TestAllocator_Spacing(t *testing.T) {
+	newAllocator := func(configure func(*AllocatorConfig), listen ListenFunc) *Allocator {
+		config := &AllocatorConfig{
+			StartPort:  41000,
+			EndPort:    41500,
+			MaxRetries: 10,
+			Spacing:    100,
+
+			CheckLoopbackOnly: true,
+		}
+		if configure != nil {
+			configure(config)
+		}
+		return NewAllocator(config, WithListenFunc(listen), WithClock(&fakeClock{}))
+	}
+
+	t.Run("base ports start fresh blocks", func(t *testing.T) {
+		alloc := newAllocator(nil, listenBusy())
+		for i := 0; i < 20; i++ {
+			basePort, err := alloc.AllocateRange(5)
+			require.NoError(t, err)
+			assert.Zero(t, (basePort-41000)%100, "base port %d", basePort)
+		}
+	})
+
+	t.Run("coordinated allocations get separate blocks", func(t *testing.T) {
+		alloc := newAllocator(func(c *AllocatorConfig) { c.Coordinated = true }, listenBusy())
+		seen := make(map[int]bool)
+		for i := 0; i < 5; i++ {
+			basePort, err := alloc.AllocateRange(5)
+			require.NoError(t, err)
+			defer alloc.Release(basePort, 5)
+			assert.Zero(t, (basePort-41000)%100)
+			assert.False(t, seen[basePort], "block %d handed out twice", basePort)
+			seen[basePort] = true
+		}
+		_, err := alloc.AllocateRange(5)
+		assert.ErrorIs(t, err, ErrNoPortsAvailable, "every block is claimed")
+	})
+
+	t.Run("cached allocations skip to the next block", func(t *testing.T) {
+		alloc := newAllocator(func(c *AllocatorConfig) { c.ScanCacheTTL = time.Minute }, listenBusy("127.0.0.1:41002", "127.0.0.1:41201"))
+		for i := 0; i < 3; i++ {
+			basePort, err := alloc.AllocateRange(5)
+			require.NoError(t, err)
+			assert.Contains(t, []int{41100, 41300, 41400}, basePort)
+		}
+	})
+
+	t.Run("ranges larger than the spacing are rejected", func(t *testing.T) {
+		_, err := newAllocator(nil, listenBusy()).AllocateRange(101)
+		assert.ErrorContains(t, err, "spacing of 100")
+	})
+}
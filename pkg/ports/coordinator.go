@@ -0,0 +1,138 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ports
+
+import (
+	"fmt"
+	"sync"
+)
+
+// coordinator tracks ports claimed by coordinated allocators in this process.
+// It is shared by all allocators with AllocatorConfig.Coordinated set, so
+// concurrent goroutines never hand out overlapping ranges even before the
+// ports are bound.
+type coordinator struct {
+	lock    fairMutex
+	claimed map[int]struct{}
+}
+
+var sharedCoordinator = &coordinator{claimed: make(map[int]struct{})}
+
+// fairMutex is a mutex that is handed to waiters in FIFO order, so a
+// goroutine cannot be starved by others repeatedly reacquiring it.
+type fairMutex struct {
+	mu      sync.Mutex
+	locked  bool
+	waiters []chan struct{}
+}
+
+// Lock acquires the mutex, waiting behind earlier callers.
+func (f *fairMutex) Lock() {
+	f.mu.Lock()
+	if !f.locked {
+		f.locked = true
+		f.mu.Unlock()
+		return
+	}
+	ready := make(chan struct{})
+	f.waiters = append(f.waiters, ready)
+	f.mu.Unlock()
+	// Ownership is handed over directly by Unlock
+	<-ready
+}
+
+// Unlock releases the mutex to the longest-waiting caller, if any.
+func (f *fairMutex) Unlock() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.waiters) == 0 {
+		f.locked = false
+		return
+	}
+	next := f.waiters[0]
+	f.waiters = f.waiters[1:]
+	close(next)
+}
+
+// allocateCoordinated scans every window of the range, starting at a random
+// offset, and claims the first one that is neither claimed nor busy. Callers
+// are served in arrival order, so an allocation only fails when no window
+// of portsNeeded free ports exists.
+func (a *Allocator) allocateCoordinated(o *observation, portsNeeded, windows, step int) (int, error) {
+	offset, err := randomIntn(windows)
+	if err != nil {
+		return 0, fmt.Errorf("failed to generate random offset: %w", err)
+	}
+
+	c := sharedCoordinator
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for scanned := 0; scanned < windows; {
+		pos := (offset + scanned) % windows
+		basePort := a.config.StartPort + pos*step
+
+		busyPort := o.probe(basePort, func() int {
+			if port := c.firstClaimedPort(basePort, portsNeeded); port != 0 {
+				return port
+			}
+			return a.firstBusyPort(basePort, portsNeeded)
+		})
+		if busyPort == 0 {
+			for port := basePort; port < basePort+portsNeeded; port++ {
+				c.claimed[port] = struct{}{}
+			}
+			a.debug("coordinated allocation succeeded", "candidate_base", basePort, "count", portsNeeded)
+			return basePort, nil
+		}
+
+		o.retry(busyPort, 0)
+
+		// No window containing busyPort can succeed; skip past it, but not
+		// beyond the end of the range, where the scan wraps to its start
+		scanned += min(windowsPast(basePort, busyPort, step), windows-pos)
+	}
+
+	a.debug("coordinated allocation found no free window", "count", portsNeeded,
+		"start_port", a.config.StartPort, "end_port", a.config.EndPort)
+	return 0, fmt.Errorf("%w: no %d consecutive free ports in range %d-%d", ErrNoPortsAvailable, portsNeeded, a.config.StartPort, a.config.EndPort)
+}
+
+// firstClaimedPort returns the first claimed port in a range, or 0 if none is.
+func (c *coordinator) firstClaimedPort(basePort, count int) int {
+	for port := basePort; port < basePort+count; port++ {
+		if _, ok := c.claimed[port]; ok {
+			return port
+		}
+	}
+	return 0
+}
+
+// Release returns ports claimed by a coordinated allocation so other
+// goroutines can allocate them again. It is a no-op for allocators without
+// AllocatorConfig.Coordinated.
+//
+// Thread-safety: Safe for concurrent use.
+func (a *Allocator) Release(basePort, count int) {
+	if !a.config.Coordinated {
+		return
+	}
+	c := sharedCoordinator
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for port := basePort; port < basePort+count; port++ {
+		delete(c.claimed, port)
+	}
+}
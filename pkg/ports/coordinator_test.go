@@ -0,0 +1,133 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ports
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func coordinatedConfig(start, end int) *AllocatorConfig {
+	config := DefaultAllocatorConfig()
+	config.StartPort = start
+	config.EndPort = end
+	config.MaxRetries = 1
+	config.RetryDelay = 0
+	config.Coordinated = true
+	return config
+}
+
+func TestAllocator_Coordinated(t *testing.T) {
+	t.Run("concurrent allocations fill the range", func(t *testing.T) {
+		alloc := NewAllocator(coordinatedConfig(41000, 41032))
+		windows := 41032 - 41000 - 1
+
+		var mu sync.Mutex
+		seen := make(map[int]bool)
+		var wg sync.WaitGroup
+		for i := 0; i < windows; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				port, err := alloc.AllocateRange(1)
+				assert.NoError(t, err)
+				mu.Lock()
+				defer mu.Unlock()
+				assert.False(t, seen[port], "port %d allocated twice", port)
+				seen[port] = true
+			}()
+		}
+		wg.Wait()
+		assert.Len(t, seen, windows)
+
+		_, err := alloc.AllocateRange(1)
+		assert.ErrorContains(t, err, "no 1 consecutive free ports")
+
+		for port := range seen {
+			alloc.Release(port, 1)
+		}
+	})
+
+	t.Run("release makes ports available again", func(t *testing.T) {
+		alloc := NewAllocator(coordinatedConfig(41100, 41104))
+
+		basePort, err := alloc.AllocateRange(3)
+		require.NoError(t, err)
+		assert.Equal(t, 41100, basePort)
+
+		_, err = alloc.AllocateRange(3)
+		require.Error(t, err)
+
+		alloc.Release(basePort, 3)
+		again, err := alloc.AllocateRange(3)
+		require.NoError(t, err)
+		assert.Equal(t, basePort, again)
+		alloc.Release(again, 3)
+	})
+
+	t.Run("claims are shared between allocators", func(t *testing.T) {
+		first := NewAllocator(coordinatedConfig(41200, 41204))
+		second := NewAllocator(coordinatedConfig(41200, 41204))
+
+		basePort, err := first.AllocateRange(3)
+		require.NoError(t, err)
+		defer first.Release(basePort, 3)
+
+		_, err = second.AllocateRange(3)
+		assert.Error(t, err)
+	})
+
+	t.Run("release is a no-op when uncoordinated", func(t *testing.T) {
+		coordinated := NewAllocator(coordinatedConfig(41300, 41302))
+		basePort, err := coordinated.AllocateRange(1)
+		require.NoError(t, err)
+		defer coordinated.Release(basePort, 1)
+
+		NewAllocator(nil).Release(basePort, 1)
+		_, err = coordinated.AllocateRange(1)
+		assert.Error(t, err)
+	})
+}
+
+func TestFairMutex_FIFO(t *testing.T) {
+	var f fairMutex
+	f.Lock()
+
+	var order []int
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.Lock()
+			order = append(order, i)
+			f.Unlock()
+		}()
+		// Wait until the goroutine is queued so arrival order is known
+		require.Eventually(t, func() bool {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			return len(f.waiters) == i+1
+		}, time.Second, time.Millisecond)
+	}
+
+	f.Unlock()
+	wg.Wait()
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, order)
+}
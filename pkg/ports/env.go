@@ -0,0 +1,48 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ports
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// PortRangeEnv overrides the default port range as "START-END" (END
+// exclusive), e.g. PORTALLOC_PORT_RANGE=40000-45000.
+const PortRangeEnv = "PORTALLOC_PORT_RANGE"
+
+// DefaultRange returns the port range from $PORTALLOC_PORT_RANGE, or
+// DefaultStartPort-DefaultEndPort when it is unset or invalid.
+func DefaultRange() (start, end int) {
+	if start, end, ok := parseRange(os.Getenv(PortRangeEnv)); ok {
+		return start, end
+	}
+	return DefaultStartPort, DefaultEndPort
+}
+
+// parseRange parses "START-END" with 1 <= START < END <= 65536.
+func parseRange(s string) (start, end int, ok bool) {
+	lo, hi, found := strings.Cut(s, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err1 := strconv.Atoi(strings.TrimSpace(lo))
+	end, err2 := strconv.Atoi(strings.TrimSpace(hi))
+	if err1 != nil || err2 != nil || start < 1 || start >= end || end > 65536 {
+		return 0, 0, false
+	}
+	return start, end, true
+}
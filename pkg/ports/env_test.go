@@ -0,0 +1,51 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ports
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultRange(t *testing.T) {
+	tests := []struct {
+		env   string
+		start int
+		end   int
+	}{
+		{"", DefaultStartPort, DefaultEndPort},
+		{"40000-45000", 40000, 45000},
+		{" 40000 - 45000 ", 40000, 45000},
+		{"45000-40000", DefaultStartPort, DefaultEndPort},
+		{"0-100", DefaultStartPort, DefaultEndPort},
+		{"40000-70000", DefaultStartPort, DefaultEndPort},
+		{"40000", DefaultStartPort, DefaultEndPort},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv(PortRangeEnv, tt.env)
+
+			start, end := DefaultRange()
+			assert.Equal(t, tt.start, start)
+			assert.Equal(t, tt.end, end)
+
+			config := DefaultAllocatorConfig()
+			assert.Equal(t, tt.start, config.StartPort)
+			assert.Equal(t, tt.end, config.EndPort)
+		})
+	}
+}
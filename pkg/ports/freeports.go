@@ -0,0 +1,48 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ports
+
+import (
+	"context"
+	"iter"
+)
+
+// FreePorts returns an iterator over the ports in the configured range that
+// are free, in ascending order. Ports are probed lazily as the iteration
+// advances, so callers can implement their own selection policy and stop
+// as soon as they have enough:
+//
+//	for port := range allocator.FreePorts(ctx) {
+//	    if port%2 == 0 {
+//	        return port, nil // prefer even ports
+//	    }
+//	}
+//
+// Iteration ends at the end of the range or when ctx is done. Like
+// AllocateSpecific, a yielded port is only free at the moment it was probed.
+//
+// Thread-safety: Safe for concurrent use; each iteration probes anew.
+func (a *Allocator) FreePorts(ctx context.Context) iter.Seq[int] {
+	return func(yield func(int) bool) {
+		for port := a.config.StartPort; port < a.config.EndPort; port++ {
+			if ctx.Err() != nil {
+				return
+			}
+			if !a.config.Reserved.Contains(port) && a.isPortAvailable(port) && !yield(port) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ports
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllocator_FreePorts(t *testing.T) {
+	config := &AllocatorConfig{StartPort: 40000, EndPort: 40006, CheckLoopbackOnly: true}
+	var probed []int
+	listen := func(network, address string) (net.Listener, error) {
+		var port int
+		_, _ = fmt.Sscanf(address, "127.0.0.1:%d", &port)
+		probed = append(probed, port)
+		return listenBusy("127.0.0.1:40001", "127.0.0.1:40004")(network, address)
+	}
+	allocator := NewAllocator(config, WithListenFunc(listen))
+
+	t.Run("yields free ports in order", func(t *testing.T) {
+		probed = nil
+		assert.Equal(t, []int{40000, 40002, 40003, 40005}, slices.Collect(allocator.FreePorts(context.Background())))
+	})
+
+	t.Run("probes lazily", func(t *testing.T) {
+		probed = nil
+		for port := range allocator.FreePorts(context.Background()) {
+			if port > 40001 {
+				break
+			}
+		}
+		assert.Equal(t, []int{40000, 40001, 40002}, probed)
+	})
+
+	t.Run("stops when the context is done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var got []int
+		for port := range allocator.FreePorts(ctx) {
+			got = append(got, port)
+			cancel()
+		}
+		assert.Equal(t, []int{40000}, got)
+	})
+}
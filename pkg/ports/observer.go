@@ -0,0 +1,109 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ports
+
+import "time"
+
+// Observer receives allocation telemetry, so applications can feed
+// attempts, retries, and latencies into their own metrics system. Set it
+// with AllocatorConfig.Observer.
+//
+// Methods are called synchronously from AllocateRange, possibly from
+// several goroutines at once; they should return quickly. Embed
+// NopObserver to implement only some of them:
+//
+//	type retryCounter struct {
+//	    ports.NopObserver
+//	    retries atomic.Int64
+//	}
+//
+//	func (c *retryCounter) OnRetry(attempt, busyPort int, delay time.Duration) {
+//	    c.retries.Add(1)
+//	}
+type Observer interface {
+	// OnAttempt reports that the window of count ports at basePort was
+	// probed, taking d. Attempts are numbered from 1 per allocation.
+	OnAttempt(attempt, basePort, count int, d time.Duration)
+	// OnRetry reports that attempt found busyPort in use. The allocator
+	// waits delay before the next attempt; zero when it moves straight on.
+	OnRetry(attempt, busyPort int, delay time.Duration)
+	// OnSuccess reports that count ports were allocated at basePort after
+	// attempts attempts, taking d in total.
+	OnSuccess(basePort, count, attempts int, d time.Duration)
+	// OnFailure reports that allocating count ports failed with err after
+	// attempts attempts, taking d in total.
+	OnFailure(count, attempts int, d time.Duration, err error)
+}
+
+// NopObserver implements Observer with methods that do nothing.
+type NopObserver struct{}
+
+// OnAttempt does nothing.
+func (NopObserver) OnAttempt(attempt, basePort, count int, d time.Duration) {}
+
+// OnRetry does nothing.
+func (NopObserver) OnRetry(attempt, busyPort int, delay time.Duration) {}
+
+// OnSuccess does nothing.
+func (NopObserver) OnSuccess(basePort, count, attempts int, d time.Duration) {}
+
+// OnFailure does nothing.
+func (NopObserver) OnFailure(count, attempts int, d time.Duration, err error) {}
+
+// observation reports one allocation to the configured Observer.
+type observation struct {
+	a        *Allocator
+	count    int
+	start    time.Time
+	attempts int
+}
+
+// observe starts observing an allocation of count ports.
+func (a *Allocator) observe(count int) *observation {
+	return &observation{a: a, count: count, start: a.clock.Now()}
+}
+
+// probe runs check on the window at basePort as the next attempt and
+// returns its result, the first busy port or 0.
+func (o *observation) probe(basePort int, check func() int) int {
+	o.attempts++
+	start := o.a.clock.Now()
+	busyPort := check()
+	if obs := o.a.config.Observer; obs != nil {
+		obs.OnAttempt(o.attempts, basePort, o.count, o.a.clock.Now().Sub(start))
+	}
+	return busyPort
+}
+
+// retry reports that the last attempt found busyPort in use and that the
+// next one follows after delay.
+func (o *observation) retry(busyPort int, delay time.Duration) {
+	if obs := o.a.config.Observer; obs != nil {
+		obs.OnRetry(o.attempts, busyPort, delay)
+	}
+}
+
+// done reports the outcome of the allocation and returns it unchanged.
+func (o *observation) done(basePort int, err error) (int, error) {
+	if obs := o.a.config.Observer; obs != nil {
+		d := o.a.clock.Now().Sub(o.start)
+		if err != nil {
+			obs.OnFailure(o.count, o.attempts, d, err)
+		} else {
+			obs.OnSuccess(basePort, o.count, o.attempts, d)
+		}
+	}
+	return basePort, err
+}
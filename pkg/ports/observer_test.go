@@ -0,0 +1,127 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ports
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingObserver records every callback as a string.
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *recordingObserver) record(format string, args ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+}
+
+func (r *recordingObserver) OnAttempt(attempt, basePort, count int, d time.Duration) {
+	r.record("attempt %d: %d+%d in %s", attempt, basePort, count, d)
+}
+
+func (r *recordingObserver) OnRetry(attempt, busyPort int, delay time.Duration) {
+	r.record("retry %d: %d busy, wait %s", attempt, busyPort, delay)
+}
+
+func (r *recordingObserver) OnSuccess(basePort, count, attempts int, d time.Duration) {
+	r.record("success: %d+%d after %d in %s", basePort, count, attempts, d)
+}
+
+func (r *recordingObserver) OnFailure(count, attempts int, d time.Duration, err error) {
+	r.record("failure: %d after %d in %s", count, attempts, d)
+}
+
+func TestAllocator_Observer(t *testing.T) {
+	// A range with a single window makes the candidate deterministic
+	newAllocator := func(observer Observer, listen ListenFunc) *Allocator {
+		config := &AllocatorConfig{
+			StartPort:  41000,
+			EndPort:    41003,
+			MaxRetries: 2,
+			RetryDelay: time.Second,
+			Observer:   observer,
+
+			CheckLoopbackOnly: true,
+		}
+		return NewAllocator(config, WithListenFunc(listen), WithClock(&fakeClock{now: time.Unix(0, 0)}))
+	}
+
+	t.Run("reports attempts, retries, and success", func(t *testing.T) {
+		calls := 0
+		listen := func(network, address string) (net.Listener, error) {
+			calls++
+			if calls == 2 {
+				return nil, syscall.EADDRINUSE
+			}
+			return fakeListener{}, nil
+		}
+		observer := &recordingObserver{}
+
+		basePort, err := newAllocator(observer, listen).AllocateRange(2)
+		require.NoError(t, err)
+		assert.Equal(t, 41000, basePort)
+		assert.Equal(t, []string{
+			"attempt 1: 41000+2 in 0s",
+			"retry 1: 41001 busy, wait 1s",
+			"attempt 2: 41000+2 in 0s",
+			"success: 41000+2 after 2 in 1s",
+		}, observer.events)
+	})
+
+	t.Run("reports failure", func(t *testing.T) {
+		observer := &recordingObserver{}
+
+		_, err := newAllocator(observer, listenBusy("127.0.0.1:41000")).AllocateRange(2)
+		require.ErrorIs(t, err, ErrNoPortsAvailable)
+		assert.Equal(t, "failure: 2 after 2 in 2s", observer.events[len(observer.events)-1])
+		assert.Len(t, observer.events, 5)
+	})
+
+	t.Run("reports invalid requests", func(t *testing.T) {
+		observer := &recordingObserver{}
+
+		_, err := newAllocator(observer, listenBusy()).AllocateRange(0)
+		require.Error(t, err)
+		assert.Equal(t, []string{"failure: 0 after 0 in 0s"}, observer.events)
+	})
+
+	t.Run("reports block allocations", func(t *testing.T) {
+		observer := &recordingObserver{}
+
+		_, err := newAllocator(observer, listenBusy()).Partitioned("a", 3).AllocateRange(2)
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"attempt 1: 41000+2 in 0s",
+			"success: 41000+2 after 1 in 0s",
+		}, observer.events)
+	})
+
+	t.Run("NopObserver can be embedded", func(t *testing.T) {
+		var observer struct{ NopObserver }
+		_, err := newAllocator(observer, listenBusy()).AllocateRange(2)
+		assert.NoError(t, err)
+	})
+}
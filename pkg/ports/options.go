@@ -0,0 +1,76 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ports
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// ListenFunc binds a listener like net.Listen. The allocator calls it to
+// probe whether a port is free and closes the returned listener.
+type ListenFunc func(network, address string) (net.Listener, error)
+
+// Clock provides the current time and sleeping, so tests can advance time
+// instead of waiting.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// SystemClock is the real Clock, backed by the time package.
+type SystemClock struct{}
+
+// Now returns time.Now().
+func (SystemClock) Now() time.Time { return time.Now() }
+
+// Sleep calls time.Sleep.
+func (SystemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// Option customizes an Allocator.
+type Option func(*Allocator)
+
+// WithListenFunc replaces net.Listen for availability probes. Tests can use
+// it to simulate busy ports without opening sockets:
+//
+//	busy := func(network, addr string) (net.Listener, error) {
+//	    return nil, errors.New("address already in use")
+//	}
+//	allocator := ports.NewAllocator(nil, ports.WithListenFunc(busy))
+func WithListenFunc(listen ListenFunc) Option {
+	return func(a *Allocator) {
+		if listen != nil {
+			a.listen = listen
+		}
+	}
+}
+
+// WithListenConfig probes availability with lc, e.g. to set socket options
+// through its Control function.
+func WithListenConfig(lc *net.ListenConfig) Option {
+	return WithListenFunc(func(network, address string) (net.Listener, error) {
+		return lc.Listen(context.Background(), network, address)
+	})
+}
+
+// WithClock replaces the clock used to wait between retries.
+func WithClock(clock Clock) Option {
+	return func(a *Allocator) {
+		if clock != nil {
+			a.clock = clock
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ports
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock advances its time on Sleep instead of waiting.
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	slept []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.slept = append(c.slept, d)
+}
+
+// fakeListener is returned for ports the fake listen function reports free.
+type fakeListener struct{}
+
+func (l fakeListener) Accept() (net.Conn, error) { return nil, errors.New("not implemented") }
+func (l fakeListener) Close() error              { return nil }
+func (l fakeListener) Addr() net.Addr            { return &net.TCPAddr{} }
+
+// listenBusy reports the given addresses as in use.
+func listenBusy(busy ...string) ListenFunc {
+	return func(network, address string) (net.Listener, error) {
+		for _, addr := range busy {
+			if addr == address {
+				return nil, syscall.EADDRINUSE
+			}
+		}
+		return fakeListener{}, nil
+	}
+}
+
+func TestAllocator_WithListenFunc(t *testing.T) {
+	alloc := NewAllocator(nil, WithListenFunc(listenBusy("127.0.0.1:41001")))
+
+	assert.True(t, alloc.IsPortInUse(41001))
+	assert.False(t, alloc.IsPortInUse(41002))
+	assert.ErrorContains(t, alloc.AllocateSpecific(41000, 41001), "[41001]")
+}
+
+func TestAllocator_WithClock(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	config := DefaultAllocatorConfig()
+	config.MaxRetries = 3
+	config.RetryDelay = time.Hour
+	alloc := NewAllocator(config,
+		WithListenFunc(func(string, string) (net.Listener, error) { return nil, syscall.EADDRINUSE }),
+		WithClock(clock),
+	)
+
+	start := time.Now()
+	_, err := alloc.AllocateRange(2)
+	require.Error(t, err)
+	assert.Less(t, time.Since(start), time.Minute, "retries must not really sleep")
+	assert.Equal(t, []time.Duration{time.Hour, time.Hour, time.Hour}, clock.slept)
+	assert.Equal(t, time.Unix(0, 0).Add(3*time.Hour), clock.Now())
+}
+
+func TestAllocator_WithListenConfig(t *testing.T) {
+	lc := &net.ListenConfig{
+		Control: func(string, string, syscall.RawConn) error { return syscall.EADDRINUSE },
+	}
+	alloc := NewAllocator(nil, WithListenConfig(lc))
+	assert.True(t, alloc.IsPortInUse(41003))
+}
+
+func TestAllocator_NilOptionsKeepDefaults(t *testing.T) {
+	alloc := NewAllocator(nil, WithListenFunc(nil), WithClock(nil))
+	assert.NotNil(t, alloc.listen)
+	assert.Equal(t, SystemClock{}, alloc.clock)
+}
@@ -0,0 +1,125 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ports
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// tcpListen is the socket state of listening sockets in /proc/net/tcp.
+const tcpListen = "0A"
+
+// ListenerPIDs maps TCP ports with a listening socket to the IDs of the
+// processes holding it. It reads /proc, so it only works on Linux and only
+// resolves processes whose file descriptors are readable (other users'
+// processes need root); ports whose owner is unknown map to no PIDs.
+func ListenerPIDs() (map[int][]int, error) {
+	inodes := make(map[string]int)
+	var readErr error
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		if err := readListenInodes(table, inodes); err != nil {
+			readErr = err
+		}
+	}
+	if len(inodes) == 0 && readErr != nil {
+		return nil, fmt.Errorf("failed to read socket table: %w", readErr)
+	}
+
+	owners := make(map[int][]int, len(inodes))
+	for _, port := range inodes {
+		owners[port] = nil
+	}
+
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return owners, nil
+	}
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join("/proc", proc.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			port, ok := inodes[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")]
+			if ok && !slices.Contains(owners[port], pid) {
+				owners[port] = append(owners[port], pid)
+			}
+		}
+	}
+	return owners, nil
+}
+
+// readListenInodes adds the socket inode and local port of every listening
+// socket in a /proc/net/tcp style table to inodes.
+func readListenInodes(table string, inodes map[string]int) error {
+	// #nosec G304 - fixed /proc paths
+	f, err := os.Open(table)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// sl local_address rem_address st tx:rx tr:when retrnsmt uid timeout inode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[3] != tcpListen {
+			continue
+		}
+		_, portHex, ok := strings.Cut(fields[1], ":")
+		if !ok {
+			continue
+		}
+		port, err := strconv.ParseInt(portHex, 16, 32)
+		if err != nil {
+			continue
+		}
+		inodes[fields[9]] = int(port)
+	}
+	return scanner.Err()
+}
+
+// ProcessEnv returns the value of key in the environment process pid was
+// started with, read from /proc/<pid>/environ. It returns an empty string
+// if the variable is unset, and an error if the process is not readable.
+func ProcessEnv(pid int, key string) (string, error) {
+	// #nosec G304 - fixed /proc path
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "environ"))
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range strings.Split(string(data), "\x00") {
+		if value, ok := strings.CutPrefix(entry, key+"="); ok {
+			return value, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,66 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ports
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenerPIDs(t *testing.T) {
+	if _, err := os.Stat("/proc/net/tcp"); err != nil {
+		t.Skip("no /proc socket table on this platform")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	owners, err := ListenerPIDs()
+	require.NoError(t, err)
+	assert.Contains(t, owners, port)
+	assert.Contains(t, owners[port], os.Getpid())
+}
+
+func TestProcessEnv(t *testing.T) {
+	if _, err := os.Stat("/proc/self/environ"); err != nil {
+		t.Skip("no /proc on this platform")
+	}
+
+	cmd := exec.Command("sleep", "10")
+	cmd.Env = []string{"ISOLATION_ID=abc"}
+	require.NoError(t, cmd.Start())
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	id, err := ProcessEnv(cmd.Process.Pid, "ISOLATION_ID")
+	require.NoError(t, err)
+	assert.Equal(t, "abc", id)
+
+	path, err := ProcessEnv(cmd.Process.Pid, "PATH")
+	require.NoError(t, err)
+	assert.Empty(t, path)
+
+	_, err = ProcessEnv(-1, "ISOLATION_ID")
+	assert.Error(t, err)
+}
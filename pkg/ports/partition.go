@@ -0,0 +1,121 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ports
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// DefaultBlockSize is the partition block size used when none is given.
+const DefaultBlockSize = 32
+
+// BlockAllocator maps a key, such as a Go package path, to a fixed block of
+// the allocator's range, so concurrent processes with different keys (e.g.
+// `go test ./... -p 16`) get disjoint ports without sharing any state.
+//
+// If a key's block is busy (another key hashed to it, or an unrelated
+// process holds a port), the following blocks are probed in order.
+type BlockAllocator struct {
+	allocator *Allocator
+	key       string
+	blockSize int
+}
+
+// Partitioned returns a BlockAllocator for key. A blockSize of 0 selects
+// DefaultBlockSize.
+//
+// Example:
+//
+//	alloc := ports.NewAllocator(nil).Partitioned("github.com/acme/app/store", 0)
+//	basePort, err := alloc.AllocateRange(3)
+func (a *Allocator) Partitioned(key string, blockSize int) *BlockAllocator {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	return &BlockAllocator{allocator: a, key: key, blockSize: blockSize}
+}
+
+// BlockBase returns the first port of the block key hashes to.
+func (b *BlockAllocator) BlockBase() (int, error) {
+	blocks := b.blocks()
+	if blocks == 0 {
+		return 0, fmt.Errorf("port range %d-%d is smaller than block size %d",
+			b.allocator.config.StartPort, b.allocator.config.EndPort, b.blockSize)
+	}
+	return b.allocator.config.StartPort + b.index()*b.blockSize, nil
+}
+
+// AllocateRange returns the first port of portsNeeded consecutive free ports
+// at the start of the key's block, probing up to MaxRetries blocks.
+//
+// Thread-safety: Safe for concurrent use.
+func (b *BlockAllocator) AllocateRange(portsNeeded int) (int, error) {
+	o := b.allocator.observe(portsNeeded)
+	if portsNeeded <= 0 {
+		return o.done(0, fmt.Errorf("portsNeeded must be positive, got %d", portsNeeded))
+	}
+	if portsNeeded > b.blockSize {
+		return o.done(0, fmt.Errorf("%d ports do not fit in a block of %d", portsNeeded, b.blockSize))
+	}
+
+	blocks := b.blocks()
+	if blocks == 0 {
+		return o.done(0, fmt.Errorf("port range %d-%d is smaller than block size %d",
+			b.allocator.config.StartPort, b.allocator.config.EndPort, b.blockSize))
+	}
+
+	first := b.index()
+	attempts := min(b.allocator.config.MaxRetries, blocks)
+	for attempt := 0; attempt < attempts; attempt++ {
+		block := (first + attempt) % blocks
+		basePort := b.allocator.config.StartPort + block*b.blockSize
+
+		busyPort := o.probe(basePort, func() int { return b.allocator.firstBusyPort(basePort, portsNeeded) })
+		if busyPort == 0 {
+			b.allocator.debug("block allocation succeeded", "key", b.key, "block", block, "attempt", attempt+1, "candidate_base", basePort, "count", portsNeeded)
+			return o.done(basePort, nil)
+		}
+
+		b.allocator.debug("block allocation attempt failed",
+			"key", b.key,
+			"block", block,
+			"attempt", attempt+1,
+			"candidate_base", basePort,
+			"count", portsNeeded,
+			"busy_port", busyPort,
+		)
+		o.retry(busyPort, 0)
+	}
+
+	return o.done(0, fmt.Errorf("%w: unable to allocate %d ports for key %q after probing %d blocks", ErrNoPortsAvailable, portsNeeded, b.key, attempts))
+}
+
+// IsPortInUse checks if a port is currently in use.
+func (b *BlockAllocator) IsPortInUse(port int) bool {
+	return b.allocator.IsPortInUse(port)
+}
+
+// blocks returns the number of whole blocks in the range.
+func (b *BlockAllocator) blocks() int {
+	return (b.allocator.config.EndPort - b.allocator.config.StartPort) / b.blockSize
+}
+
+// index returns the block the key hashes to.
+func (b *BlockAllocator) index() int {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(b.key))
+	return int(h.Sum64() % uint64(b.blocks()))
+}
@@ -0,0 +1,81 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ports
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockAllocator_BlockBase(t *testing.T) {
+	alloc := NewAllocator(nil)
+
+	base, err := alloc.Partitioned("github.com/acme/app/store", 0).BlockBase()
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, base, DefaultStartPort)
+	assert.Less(t, base, DefaultEndPort)
+	assert.Zero(t, (base-DefaultStartPort)%DefaultBlockSize, "block must be aligned")
+
+	// Deterministic across allocators and calls
+	again, err := NewAllocator(nil).Partitioned("github.com/acme/app/store", 0).BlockBase()
+	require.NoError(t, err)
+	assert.Equal(t, base, again)
+
+	// Range smaller than a block
+	small := NewAllocator(&AllocatorConfig{StartPort: 20000, EndPort: 20010, MaxRetries: 1})
+	_, err = small.Partitioned("key", 32).BlockBase()
+	assert.Error(t, err)
+}
+
+func TestBlockAllocator_AllocateRange(t *testing.T) {
+	t.Run("allocates at the block base", func(t *testing.T) {
+		blockAlloc := NewAllocator(nil).Partitioned("github.com/acme/app/api", 0)
+
+		want, err := blockAlloc.BlockBase()
+		require.NoError(t, err)
+
+		got, err := blockAlloc.AllocateRange(5)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	})
+
+	t.Run("probes the next block when busy", func(t *testing.T) {
+		// Find a free port and build a two-block range starting at it
+		listener, err := net.Listen("tcp", ":0")
+		require.NoError(t, err)
+		defer listener.Close()
+		busyPort := listener.Addr().(*net.TCPAddr).Port
+
+		config := &AllocatorConfig{StartPort: busyPort, EndPort: busyPort + 8, MaxRetries: 2, RetryDelay: time.Millisecond}
+		blockAlloc := NewAllocator(config).Partitioned("key", 4)
+
+		// Whichever block the key hashes to, the free one is chosen
+		got, err := blockAlloc.AllocateRange(2)
+		require.NoError(t, err)
+		assert.Equal(t, busyPort+4, got)
+	})
+
+	t.Run("rejects more ports than the block size", func(t *testing.T) {
+		_, err := NewAllocator(nil).Partitioned("key", 4).AllocateRange(5)
+		assert.Error(t, err)
+
+		_, err = NewAllocator(nil).Partitioned("key", 4).AllocateRange(0)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,135 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package portstest provides a deterministic ports.PortAllocator for unit
+// tests of code that allocates ports.
+package portstest
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+)
+
+// maxPort is the highest TCP port.
+const maxPort = 65535
+
+// FakeAllocator hands out consecutive, non-overlapping ranges starting at
+// its start port, without opening sockets. Ports are never reused, even
+// after Release, so every allocation in a test is predictable.
+//
+//	alloc := portstest.NewFakeAllocator(20000)
+//	base, _ := alloc.AllocateRange(3) // 20000
+//	base, _ = alloc.AllocateRange(2)  // 20003
+//
+// Ports marked with SetBusy are skipped by AllocateRange and reported by
+// IsPortInUse. FakeAllocator is safe for concurrent use.
+type FakeAllocator struct {
+	mu        sync.Mutex
+	next      int
+	busy      map[int]bool
+	err       error
+	allocated []ports.PortRange
+	released  []ports.PortRange
+}
+
+var _ ports.PortAllocator = (*FakeAllocator)(nil)
+
+// NewFakeAllocator returns a FakeAllocator whose first range starts at
+// startPort.
+func NewFakeAllocator(startPort int) *FakeAllocator {
+	return &FakeAllocator{next: startPort, busy: make(map[int]bool)}
+}
+
+// AllocateRange returns the next portsNeeded consecutive ports that
+// contain no busy port, or the error set with FailWith.
+func (f *FakeAllocator) AllocateRange(portsNeeded int) (int, error) {
+	if portsNeeded <= 0 {
+		return 0, fmt.Errorf("portsNeeded must be positive, got %d", portsNeeded)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return 0, f.err
+	}
+	for base := f.next; base+portsNeeded-1 <= maxPort; base++ {
+		if f.windowBusy(base, portsNeeded) {
+			continue
+		}
+		f.next = base + portsNeeded
+		f.allocated = append(f.allocated, ports.PortRange{BasePort: base, Count: portsNeeded})
+		return base, nil
+	}
+	return 0, fmt.Errorf("%w: fake allocator has no %d consecutive ports left", ports.ErrNoPortsAvailable, portsNeeded)
+}
+
+// windowBusy reports whether a busy port lies in [base, base+count).
+func (f *FakeAllocator) windowBusy(base, count int) bool {
+	for port := base; port < base+count; port++ {
+		if f.busy[port] {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPortInUse reports whether port was marked with SetBusy.
+func (f *FakeAllocator) IsPortInUse(port int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.busy[port]
+}
+
+// Release records that a range was released, as EnvironmentManager.Cleanup
+// does for allocators holding claims.
+func (f *FakeAllocator) Release(basePort, count int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.released = append(f.released, ports.PortRange{BasePort: basePort, Count: count})
+}
+
+// SetBusy marks ports as bound by another process.
+func (f *FakeAllocator) SetBusy(busy ...int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, port := range busy {
+		f.busy[port] = true
+	}
+}
+
+// FailWith makes every later AllocateRange return err, e.g.
+// ports.ErrNoPortsAvailable to test exhaustion. A nil err restores
+// allocation.
+func (f *FakeAllocator) FailWith(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+// Allocated returns the ranges allocated so far, in order.
+func (f *FakeAllocator) Allocated() []ports.PortRange {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]ports.PortRange(nil), f.allocated...)
+}
+
+// Released returns the ranges released so far, in order.
+func (f *FakeAllocator) Released() []ports.PortRange {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]ports.PortRange(nil), f.released...)
+}
@@ -0,0 +1,57 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package portstest
+
+import (
+	"testing"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeAllocator(t *testing.T) {
+	alloc := NewFakeAllocator(20000)
+
+	base, err := alloc.AllocateRange(3)
+	require.NoError(t, err)
+	assert.Equal(t, 20000, base)
+
+	alloc.SetBusy(20004)
+	assert.True(t, alloc.IsPortInUse(20004))
+	assert.False(t, alloc.IsPortInUse(20003))
+
+	base, err = alloc.AllocateRange(2)
+	require.NoError(t, err)
+	assert.Equal(t, 20005, base, "windows containing busy ports are skipped")
+
+	alloc.Release(20000, 3)
+	assert.Equal(t, []ports.PortRange{{BasePort: 20000, Count: 3}, {BasePort: 20005, Count: 2}}, alloc.Allocated())
+	assert.Equal(t, []ports.PortRange{{BasePort: 20000, Count: 3}}, alloc.Released())
+
+	alloc.FailWith(ports.ErrNoPortsAvailable)
+	_, err = alloc.AllocateRange(1)
+	assert.ErrorIs(t, err, ports.ErrNoPortsAvailable)
+
+	alloc.FailWith(nil)
+	base, err = alloc.AllocateRange(1)
+	require.NoError(t, err)
+	assert.Equal(t, 20007, base)
+
+	_, err = NewFakeAllocator(65535).AllocateRange(2)
+	assert.ErrorIs(t, err, ports.ErrNoPortsAvailable)
+	_, err = alloc.AllocateRange(0)
+	assert.Error(t, err)
+}
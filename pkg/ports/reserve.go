@@ -0,0 +1,113 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ports
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// Reservation holds listening sockets on ports so that no other process can
+// bind them until they are released, closing the window between allocating
+// a port and the service under test binding it.
+//
+// On Linux the sockets are opened with SO_REUSEPORT, so a service that
+// also sets SO_REUSEPORT can bind a reserved port; ReleaseTaken then gives
+// the port up to it. Elsewhere ports must be released explicitly.
+type Reservation struct {
+	mu        sync.Mutex
+	listeners map[int]net.Listener
+}
+
+// Reserve listens on every port on all interfaces. On failure no port is
+// held.
+func Reserve(ports []int) (*Reservation, error) {
+	lc := net.ListenConfig{Control: reusePort}
+	r := &Reservation{listeners: make(map[int]net.Listener, len(ports))}
+	for _, port := range ports {
+		l, err := lc.Listen(context.Background(), "tcp", ":"+strconv.Itoa(port))
+		if err != nil {
+			_ = r.Close()
+			return nil, fmt.Errorf("failed to reserve port %d: %w", port, err)
+		}
+		r.listeners[port] = l
+	}
+	return r, nil
+}
+
+// Held returns the ports still reserved, in ascending order.
+func (r *Reservation) Held() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	held := make([]int, 0, len(r.listeners))
+	for port := range r.listeners {
+		held = append(held, port)
+	}
+	slices.Sort(held)
+	return held
+}
+
+// Release closes the listener on port. Releasing a port that is not held
+// is an error.
+func (r *Reservation) Release(port int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l, ok := r.listeners[port]
+	if !ok {
+		return fmt.Errorf("port %d is not reserved", port)
+	}
+	delete(r.listeners, port)
+	return l.Close()
+}
+
+// ReleaseTaken releases the held ports on which another process now
+// listens and returns them. Listeners are read from /proc (see
+// ListenerPIDs), so nothing is released elsewhere.
+func (r *Reservation) ReleaseTaken() []int {
+	owners, err := ListenerPIDs()
+	if err != nil {
+		return nil
+	}
+	self := os.Getpid()
+
+	var released []int
+	for _, port := range r.Held() {
+		if slices.ContainsFunc(owners[port], func(pid int) bool { return pid != self }) {
+			if r.Release(port) == nil {
+				released = append(released, port)
+			}
+		}
+	}
+	return released
+}
+
+// Close releases every held port.
+func (r *Reservation) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var firstErr error
+	for port, l := range r.listeners {
+		if err := l.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(r.listeners, port)
+	}
+	return firstErr
+}
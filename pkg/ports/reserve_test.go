@@ -0,0 +1,72 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ports
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReservation(t *testing.T) {
+	// Find two free ports, then reserve them
+	var free []int
+	for range 2 {
+		l, err := net.Listen("tcp", ":0")
+		require.NoError(t, err)
+		free = append(free, l.Addr().(*net.TCPAddr).Port)
+		require.NoError(t, l.Close())
+	}
+
+	r, err := Reserve(free)
+	require.NoError(t, err)
+	defer r.Close()
+	assert.ElementsMatch(t, free, r.Held())
+
+	bind := func(port int) error {
+		l, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		if err == nil {
+			_ = l.Close()
+		}
+		return err
+	}
+	assert.Error(t, bind(free[0]), "reserved ports cannot be bound")
+
+	require.NoError(t, r.Release(free[0]))
+	assert.NoError(t, bind(free[0]))
+	assert.Error(t, r.Release(free[0]), "already released")
+	assert.Equal(t, free[1:], r.Held())
+	assert.Empty(t, r.ReleaseTaken(), "only this process listens")
+
+	require.NoError(t, r.Close())
+	assert.Empty(t, r.Held())
+	assert.NoError(t, bind(free[1]))
+
+	if runtime.GOOS == "linux" {
+		// Services setting SO_REUSEPORT can bind reserved ports
+		r, err := Reserve(free[:1])
+		require.NoError(t, err)
+		defer r.Close()
+		lc := net.ListenConfig{Control: reusePort}
+		l, err := lc.Listen(context.Background(), "tcp", ":"+strconv.Itoa(free[0]))
+		require.NoError(t, err)
+		assert.NoError(t, l.Close())
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ports
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ReservedPorts is a set of ports the allocator never hands out, such as the
+// ports of system services or of an organization-wide reservation registry.
+// The zero value and nil reserve nothing.
+type ReservedPorts struct {
+	// ranges are sorted, non-overlapping, inclusive [first, last] pairs.
+	ranges [][2]int
+}
+
+// LoadReservedPorts reads a reserved ports file; see ParseReservedPorts.
+func LoadReservedPorts(path string) (*ReservedPorts, error) {
+	// #nosec G304 - path is the user's reserved ports file
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open reserved ports file: %w", err)
+	}
+	defer f.Close()
+
+	reserved, err := ParseReservedPorts(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return reserved, nil
+}
+
+// ParseReservedPorts parses a reserved ports list. Each line holds ports
+// ("8080") and inclusive ranges ("9000-9099") separated by commas or
+// spaces, so the contents of /proc/sys/net/ipv4/ip_local_reserved_ports can
+// be used as is. Lines in /etc/services format ("ssh 22/tcp # comment")
+// reserve their port. Text after '#' and blank lines are ignored.
+func ParseReservedPorts(r io.Reader) (*ReservedPorts, error) {
+	var ranges [][2]int
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.FieldsFunc(text, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(fields) == 0 {
+			continue
+		}
+
+		// /etc/services: name port/protocol [aliases...]
+		if _, _, err := parsePortRange(fields[0]); err != nil && len(fields) > 1 && strings.Contains(fields[1], "/") {
+			port, _, _ := strings.Cut(fields[1], "/")
+			first, last, err := parsePortRange(port)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			ranges = append(ranges, [2]int{first, last})
+			continue
+		}
+
+		for _, field := range fields {
+			first, last, err := parsePortRange(field)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			ranges = append(ranges, [2]int{first, last})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read reserved ports: %w", err)
+	}
+	return &ReservedPorts{ranges: mergeRanges(ranges)}, nil
+}
+
+// parsePortRange parses "PORT" or "FIRST-LAST".
+func parsePortRange(s string) (first, last int, err error) {
+	lo, hi, isRange := strings.Cut(s, "-")
+	first, err1 := strconv.Atoi(lo)
+	last = first
+	var err2 error
+	if isRange {
+		last, err2 = strconv.Atoi(hi)
+	}
+	if err1 != nil || err2 != nil || first < 1 || last > 65535 || first > last {
+		return 0, 0, fmt.Errorf("invalid port or range %q", s)
+	}
+	return first, last, nil
+}
+
+// mergeRanges sorts ranges and merges those that overlap or touch.
+func mergeRanges(ranges [][2]int) [][2]int {
+	slices.SortFunc(ranges, func(a, b [2]int) int { return a[0] - b[0] })
+	var merged [][2]int
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r[0] <= merged[n-1][1]+1 {
+			merged[n-1][1] = max(merged[n-1][1], r[1])
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// Contains reports whether port is reserved.
+func (r *ReservedPorts) Contains(port int) bool {
+	return r.Overlaps(port, port)
+}
+
+// Overlaps reports whether any port from first to last, inclusive, is
+// reserved.
+func (r *ReservedPorts) Overlaps(first, last int) bool {
+	if r == nil {
+		return false
+	}
+	_, found := slices.BinarySearchFunc(r.ranges, [2]int{first, last}, func(rng, target [2]int) int {
+		switch {
+		case rng[1] < target[0]:
+			return -1
+		case rng[0] > target[1]:
+			return 1
+		}
+		return 0
+	})
+	return found
+}
+
+// Len returns the number of reserved ports.
+func (r *ReservedPorts) Len() int {
+	if r == nil {
+		return 0
+	}
+	n := 0
+	for _, rng := range r.ranges {
+		n += rng[1] - rng[0] + 1
+	}
+	return n
+}
+
+// Add returns a set holding the ports of r and first to last, inclusive.
+// r is not modified; a nil r is treated as empty.
+func (r *ReservedPorts) Add(first, last int) *ReservedPorts {
+	var ranges [][2]int
+	if r != nil {
+		ranges = append(ranges, r.ranges...)
+	}
+	return &ReservedPorts{ranges: mergeRanges(append(ranges, [2]int{first, last}))}
+}
@@ -0,0 +1,157 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ports
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseReservedPorts(t *testing.T) {
+	t.Run("ports ranges and services entries", func(t *testing.T) {
+		reserved, err := ParseReservedPorts(strings.NewReader(`# org-wide reservations
+8080
+9000-9002, 9010
+ssh		22/tcp				# SSH Remote Login Protocol
+http	80/tcp		www		# WorldWideWeb HTTP
+
+9001-9003
+`))
+		require.NoError(t, err)
+		for _, port := range []int{8080, 9000, 9001, 9002, 9003, 9010, 22, 80} {
+			assert.True(t, reserved.Contains(port), "port %d", port)
+		}
+		for _, port := range []int{21, 8081, 8999, 9004, 9009} {
+			assert.False(t, reserved.Contains(port), "port %d", port)
+		}
+		assert.Equal(t, 8, reserved.Len())
+	})
+
+	t.Run("rejects invalid entries", func(t *testing.T) {
+		for _, input := range []string{"http", "0", "70000", "9002-9000", "80-", "1\nfoo bar"} {
+			_, err := ParseReservedPorts(strings.NewReader(input))
+			assert.Error(t, err, "input %q", input)
+		}
+	})
+
+	t.Run("nil reserves nothing", func(t *testing.T) {
+		var reserved *ReservedPorts
+		assert.False(t, reserved.Contains(80))
+		assert.Zero(t, reserved.Len())
+	})
+
+	t.Run("overlaps", func(t *testing.T) {
+		reserved, err := ParseReservedPorts(strings.NewReader("100-199\n300\n"))
+		require.NoError(t, err)
+		assert.True(t, reserved.Overlaps(50, 100))
+		assert.True(t, reserved.Overlaps(199, 250))
+		assert.True(t, reserved.Overlaps(250, 350))
+		assert.True(t, reserved.Overlaps(120, 130))
+		assert.False(t, reserved.Overlaps(200, 299))
+		assert.False(t, reserved.Overlaps(1, 99))
+		assert.False(t, reserved.Overlaps(301, 400))
+	})
+}
+
+func TestLoadReservedPorts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reserved")
+	require.NoError(t, os.WriteFile(path, []byte("20000-20009\n"), 0o600))
+
+	reserved, err := LoadReservedPorts(path)
+	require.NoError(t, err)
+	assert.Equal(t, 10, reserved.Len())
+
+	require.NoError(t, os.WriteFile(path, []byte("20000\nbogus\n"), 0o600))
+	_, err = LoadReservedPorts(path)
+	assert.ErrorContains(t, err, "line 2")
+
+	_, err = LoadReservedPorts(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
+
+func TestReservedPorts_Add(t *testing.T) {
+	var none *ReservedPorts
+	one := none.Add(20000, 20001)
+	assert.Equal(t, 2, one.Len())
+	assert.Equal(t, 0, none.Len(), "receiver is not modified")
+
+	merged := one.Add(20002, 20004)
+	assert.Equal(t, 5, merged.Len())
+	assert.True(t, merged.Overlaps(20004, 20010))
+	assert.Equal(t, 2, one.Len())
+}
+
+func TestAllocator_Reserved(t *testing.T) {
+	reserved, err := ParseReservedPorts(strings.NewReader("40000-40003\n40005\n"))
+	require.NoError(t, err)
+	config := func() *AllocatorConfig {
+		return &AllocatorConfig{
+			StartPort: 40000, EndPort: 40010, MaxRetries: 50, RetryDelay: time.Second,
+			CheckLoopbackOnly: true, Reserved: reserved,
+		}
+	}
+
+	t.Run("random allocation only picks unreserved windows", func(t *testing.T) {
+		clock := &fakeClock{}
+		allocator := NewAllocator(config(), WithListenFunc(listenBusy()), WithClock(clock))
+		for i := 0; i < 20; i++ {
+			base, err := allocator.AllocateRange(2)
+			require.NoError(t, err)
+			assert.Contains(t, []int{40006, 40007}, base)
+		}
+		assert.Empty(t, clock.slept, "reserved windows are never probed")
+
+		_, err := allocator.AllocateRange(5)
+		assert.ErrorIs(t, err, ErrNoPortsAvailable)
+	})
+
+	t.Run("coordinated allocation skips reserved ports", func(t *testing.T) {
+		cfg := config()
+		cfg.Coordinated = true
+		allocator := NewAllocator(cfg, WithListenFunc(listenBusy()))
+		base, err := allocator.AllocateRange(3)
+		require.NoError(t, err)
+		defer allocator.Release(base, 3)
+		assert.Equal(t, 40006, base)
+	})
+
+	t.Run("cached allocation skips reserved ports", func(t *testing.T) {
+		cfg := config()
+		cfg.ScanCacheTTL = time.Minute
+		allocator := NewAllocator(cfg, WithListenFunc(listenBusy()))
+		base, err := allocator.AllocateRange(3)
+		require.NoError(t, err)
+		assert.Equal(t, 40006, base)
+	})
+
+	t.Run("free ports omit reserved ports", func(t *testing.T) {
+		allocator := NewAllocator(config(), WithListenFunc(listenBusy("127.0.0.1:40006")))
+		assert.Equal(t, []int{40004, 40007, 40008, 40009}, slices.Collect(allocator.FreePorts(context.Background())))
+	})
+
+	t.Run("explicit checks still probe reserved ports", func(t *testing.T) {
+		allocator := NewAllocator(config(), WithListenFunc(listenBusy()))
+		assert.False(t, allocator.IsPortInUse(40000))
+		assert.NoError(t, allocator.AllocateSpecific(40000))
+	})
+}
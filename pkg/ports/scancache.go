@@ -0,0 +1,186 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ports
+
+import (
+	"fmt"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// scanWorkers bounds the goroutines probing ports during a range scan.
+const scanWorkers = 64
+
+// portBitmap records one bit per port in [start, start+size); a set bit
+// means the port was free.
+type portBitmap struct {
+	start int
+	size  int
+	words []uint64
+}
+
+func newPortBitmap(start, end int) *portBitmap {
+	size := end - start
+	return &portBitmap{start: start, size: size, words: make([]uint64, (size+63)/64)}
+}
+
+// set marks port free or busy. Ports outside the bitmap are ignored.
+func (b *portBitmap) set(port int, free bool) {
+	i := port - b.start
+	if i < 0 || i >= b.size {
+		return
+	}
+	if free {
+		b.words[i/64] |= 1 << (i % 64)
+	} else {
+		b.words[i/64] &^= 1 << (i % 64)
+	}
+}
+
+// free reports whether port was free. Ports outside the bitmap are busy.
+func (b *portBitmap) free(port int) bool {
+	i := port - b.start
+	if i < 0 || i >= b.size {
+		return false
+	}
+	return b.words[i/64]&(1<<(i%64)) != 0
+}
+
+// count returns the number of free ports.
+func (b *portBitmap) count() int {
+	n := 0
+	for _, w := range b.words {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
+
+// findWindow returns the first base port, scanning windows step ports
+// apart from window offset to the last of windows and then wrapping, whose
+// count ports are all free, or 0.
+func (b *portBitmap) findWindow(offset, windows, step, count int) int {
+	for scanned := 0; scanned < windows; {
+		pos := (offset + scanned) % windows
+		basePort := b.start + pos*step
+
+		busyPort := 0
+		for port := basePort; port < basePort+count; port++ {
+			if !b.free(port) {
+				busyPort = port
+				break
+			}
+		}
+		if busyPort == 0 {
+			return basePort
+		}
+		scanned += min(windowsPast(basePort, busyPort, step), windows-pos)
+	}
+	return 0
+}
+
+// scanCache holds the bitmap from the last range scan.
+type scanCache struct {
+	mu        sync.Mutex
+	bitmap    *portBitmap
+	scannedAt time.Time
+}
+
+// scanRange probes every port in the configured range in parallel.
+func (a *Allocator) scanRange() *portBitmap {
+	bitmap := newPortBitmap(a.config.StartPort, a.config.EndPort)
+
+	var mu sync.Mutex
+	ports := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(scanWorkers, bitmap.size); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for port := range ports {
+				if !a.config.Reserved.Contains(port) && a.isPortAvailable(port) {
+					mu.Lock()
+					bitmap.set(port, true)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for port := a.config.StartPort; port < a.config.EndPort; port++ {
+		ports <- port
+	}
+	close(ports)
+	wg.Wait()
+
+	return bitmap
+}
+
+// allocateCached serves an allocation from the scan bitmap, rescanning the
+// range when the bitmap is older than ScanCacheTTL. Candidate windows are
+// verified with real probes before they are returned; a port that turns
+// out to be busy is marked in the bitmap and the next window is tried.
+func (a *Allocator) allocateCached(o *observation, portsNeeded, windows, step int) (int, error) {
+	c := &a.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := a.clock.Now()
+	if c.bitmap == nil || now.Sub(c.scannedAt) > a.config.ScanCacheTTL {
+		c.bitmap = a.scanRange()
+		c.scannedAt = now
+		a.debug("scanned port range", "start_port", a.config.StartPort, "end_port", a.config.EndPort, "free", c.bitmap.count())
+	}
+
+	for attempt := 0; attempt < a.config.MaxRetries; attempt++ {
+		offset, err := randomIntn(windows)
+		if err != nil {
+			return 0, fmt.Errorf("failed to generate random offset: %w", err)
+		}
+
+		basePort := c.bitmap.findWindow(offset, windows, step, portsNeeded)
+		if basePort == 0 {
+			break
+		}
+
+		busyPort := o.probe(basePort, func() int { return a.firstBusyPort(basePort, portsNeeded) })
+		if busyPort == 0 {
+			// Don't hand the same ports out again before the next scan
+			for port := basePort; port < basePort+portsNeeded; port++ {
+				c.bitmap.set(port, false)
+			}
+			a.debug("cached allocation succeeded", "attempt", attempt+1, "candidate_base", basePort, "count", portsNeeded)
+			return basePort, nil
+		}
+
+		a.debug("cached allocation verification failed", "attempt", attempt+1, "candidate_base", basePort, "busy_port", busyPort)
+		c.bitmap.set(busyPort, false)
+		o.retry(busyPort, 0)
+	}
+
+	return 0, fmt.Errorf("%w: unable to allocate %d consecutive ports from the scanned range %d-%d", ErrNoPortsAvailable, portsNeeded, a.config.StartPort, a.config.EndPort)
+}
+
+// BusyPorts probes every port in the configured range in parallel and
+// returns those in use, in ascending order.
+func (a *Allocator) BusyPorts() []int {
+	bitmap := a.scanRange()
+	var busy []int
+	for port := a.config.StartPort; port < a.config.EndPort; port++ {
+		if !bitmap.free(port) {
+			busy = append(busy, port)
+		}
+	}
+	return busy
+}
@@ -0,0 +1,164 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ports
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// probeCounter is a ListenFunc that counts probes and reports ports in
+// busy as in use.
+type probeCounter struct {
+	probes atomic.Int32
+	mu     sync.Mutex
+	busy   map[int]bool
+}
+
+func (p *probeCounter) listen(network, address string) (net.Listener, error) {
+	p.probes.Add(1)
+	var port int
+	_, _ = fmt.Sscanf(address, "127.0.0.1:%d", &port)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.busy[port] {
+		return nil, syscall.EADDRINUSE
+	}
+	return fakeListener{}, nil
+}
+
+func (p *probeCounter) setBusy(ports ...int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.busy = make(map[int]bool)
+	for _, port := range ports {
+		p.busy[port] = true
+	}
+}
+
+func cachedAllocator(start, end int, probe *probeCounter, clock Clock) *Allocator {
+	config := DefaultAllocatorConfig()
+	config.StartPort = start
+	config.EndPort = end
+	config.MaxRetries = 20
+	config.ScanCacheTTL = 5 * time.Second
+	return NewAllocator(config, WithListenFunc(probe.listen), WithClock(clock))
+}
+
+func TestPortBitmap(t *testing.T) {
+	b := newPortBitmap(1000, 1100)
+	for port := 1000; port < 1100; port++ {
+		b.set(port, true)
+	}
+	b.set(1064, false)
+	b.set(1098, false)
+	b.set(5000, true)
+
+	assert.Equal(t, 98, b.count())
+	assert.False(t, b.free(1064))
+	assert.True(t, b.free(1065))
+	assert.False(t, b.free(999))
+	assert.False(t, b.free(1100))
+
+	assert.Equal(t, 1060, b.findWindow(60, 97, 1, 3))
+	assert.Equal(t, 1065, b.findWindow(62, 97, 1, 3), "skips windows containing a busy port")
+	assert.Equal(t, 1000, b.findWindow(96, 97, 1, 3), "wraps to the start")
+	assert.Equal(t, 0, b.findWindow(0, 97, 1, 70), "no window large enough")
+	assert.Equal(t, 1070, b.findWindow(6, 10, 10, 5), "with a step, skips to the next block")
+}
+
+func TestAllocator_ScanCache(t *testing.T) {
+	t.Run("probes the range once and then only the chosen window", func(t *testing.T) {
+		probe := &probeCounter{}
+		alloc := cachedAllocator(41000, 41100, probe, &fakeClock{now: time.Now()})
+
+		first, err := alloc.AllocateRange(3)
+		require.NoError(t, err)
+		assert.EqualValues(t, 100+3, probe.probes.Load())
+
+		second, err := alloc.AllocateRange(3)
+		require.NoError(t, err)
+		assert.EqualValues(t, 100+3+3, probe.probes.Load())
+
+		overlap := second < first+3 && first < second+3
+		assert.False(t, overlap, "windows %d and %d overlap", first, second)
+	})
+
+	t.Run("verifies candidates and skips ports that became busy", func(t *testing.T) {
+		probe := &probeCounter{}
+		alloc := cachedAllocator(41000, 41010, probe, &fakeClock{now: time.Now()})
+		first, err := alloc.AllocateRange(1)
+		require.NoError(t, err)
+
+		// Everything but one window the first allocation didn't take is
+		// taken after the scan
+		want := 41006
+		if first == 41006 || first == 41007 {
+			want = 41002
+		}
+		var busy []int
+		for port := 41000; port < 41010; port++ {
+			if port != want && port != want+1 {
+				busy = append(busy, port)
+			}
+		}
+		probe.setBusy(busy...)
+
+		basePort, err := alloc.AllocateRange(2)
+		require.NoError(t, err)
+		assert.Equal(t, want, basePort)
+	})
+
+	t.Run("rescans after the TTL", func(t *testing.T) {
+		probe := &probeCounter{}
+		clock := &fakeClock{now: time.Now()}
+		alloc := cachedAllocator(41000, 41050, probe, clock)
+
+		_, err := alloc.AllocateRange(1)
+		require.NoError(t, err)
+		assert.EqualValues(t, 51, probe.probes.Load())
+
+		clock.Sleep(6 * time.Second)
+		_, err = alloc.AllocateRange(1)
+		require.NoError(t, err)
+		assert.EqualValues(t, 51+51, probe.probes.Load())
+	})
+
+	t.Run("fails when the scan found no window", func(t *testing.T) {
+		probe := &probeCounter{}
+		probe.setBusy(41001, 41003)
+		alloc := cachedAllocator(41000, 41005, probe, &fakeClock{now: time.Now()})
+
+		_, err := alloc.AllocateRange(2)
+		assert.ErrorContains(t, err, "scanned range")
+	})
+}
+
+func TestAllocator_BusyPorts(t *testing.T) {
+	config := DefaultAllocatorConfig()
+	config.StartPort = 41000
+	config.EndPort = 41010
+	alloc := NewAllocator(config, WithListenFunc(listenBusy("127.0.0.1:41002", "127.0.0.1:41007")))
+
+	assert.Equal(t, []int{41002, 41007}, alloc.BusyPorts())
+}
@@ -0,0 +1,185 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package proxy forwards stable local ports to dynamically allocated ones.
+//
+// Tools with hardcoded ports (browsers, API collections) can keep using a
+// well-known port such as 8080 while the service behind it listens on
+// whatever port go-portalloc allocated:
+//
+//	spec, _ := proxy.ParseSpec("8080=api")
+//	p, err := proxy.Listen(spec.ListenAddr(), "127.0.0.1:23456")
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	defer p.Close()
+//	go p.Serve()
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DialTimeout bounds connecting to the target for each accepted connection.
+const DialTimeout = 5 * time.Second
+
+// Spec is a "LISTEN_PORT=SERVICE" forwarding rule.
+type Spec struct {
+	// ListenPort is the stable port to listen on.
+	ListenPort int
+	// Service names the target port (e.g. "api" or a port index).
+	Service string
+}
+
+// ParseSpec parses "8080=api".
+func ParseSpec(s string) (Spec, error) {
+	portStr, service, ok := strings.Cut(s, "=")
+	if !ok || service == "" {
+		return Spec{}, fmt.Errorf("invalid proxy spec %q (expected PORT=SERVICE)", s)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return Spec{}, fmt.Errorf("invalid proxy port in %q", s)
+	}
+	return Spec{ListenPort: port, Service: service}, nil
+}
+
+// String returns the spec in "PORT=SERVICE" form.
+func (s Spec) String() string {
+	return fmt.Sprintf("%d=%s", s.ListenPort, s.Service)
+}
+
+// ListenAddr returns the loopback address for the spec's listen port.
+func (s Spec) ListenAddr() string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(s.ListenPort))
+}
+
+// Proxy forwards TCP connections from a listener to a target address.
+type Proxy struct {
+	listener net.Listener
+	target   string
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// Listen binds listenAddr and returns a proxy forwarding to target.
+func Listen(listenAddr, target string) (*Proxy, error) {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", listenAddr, err)
+	}
+	return &Proxy{
+		listener: listener,
+		target:   target,
+		conns:    make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Addr returns the address the proxy listens on.
+func (p *Proxy) Addr() net.Addr {
+	return p.listener.Addr()
+}
+
+// Serve accepts connections until Close is called. It returns nil after Close.
+func (p *Proxy) Serve() error {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		if !p.track(conn) {
+			_ = conn.Close()
+			return nil
+		}
+		p.wg.Add(1)
+		go p.forward(conn)
+	}
+}
+
+// Close stops accepting connections, closes active ones, and waits for
+// forwarding goroutines to finish.
+func (p *Proxy) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	for conn := range p.conns {
+		_ = conn.Close()
+	}
+	p.mu.Unlock()
+
+	err := p.listener.Close()
+	p.wg.Wait()
+	return err
+}
+
+func (p *Proxy) track(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	p.conns[conn] = struct{}{}
+	return true
+}
+
+func (p *Proxy) untrack(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, conn)
+}
+
+func (p *Proxy) forward(client net.Conn) {
+	defer p.wg.Done()
+	defer p.untrack(client)
+	defer client.Close()
+
+	upstream, err := net.DialTimeout("tcp", p.target, DialTimeout)
+	if err != nil {
+		// Nothing is listening on the target yet; drop the client
+		return
+	}
+	if !p.track(upstream) {
+		_ = upstream.Close()
+		return
+	}
+	defer p.untrack(upstream)
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		_, _ = io.Copy(dst, src)
+		// Propagate half-close so request/response protocols finish cleanly
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			_ = tcp.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go pipe(upstream, client)
+	go pipe(client, upstream)
+	<-done
+	<-done
+}
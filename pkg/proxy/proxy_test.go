@@ -0,0 +1,109 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSpec(t *testing.T) {
+	spec, err := ParseSpec("8080=api")
+	require.NoError(t, err)
+	assert.Equal(t, Spec{ListenPort: 8080, Service: "api"}, spec)
+	assert.Equal(t, "8080=api", spec.String())
+	assert.Equal(t, "127.0.0.1:8080", spec.ListenAddr())
+
+	for _, input := range []string{"", "8080", "8080=", "=api", "http=api", "0=api", "70000=api"} {
+		_, err := ParseSpec(input)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestProxy_Forwards(t *testing.T) {
+	// Echo server standing in for the dynamically allocated service
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	p, err := Listen("127.0.0.1:0", upstream.Addr().String())
+	require.NoError(t, err)
+	go func() { _ = p.Serve() }()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", line)
+
+	require.NoError(t, p.Close())
+
+	// Closing the proxy releases the listen port and active connections
+	_, err = net.Dial("tcp", p.Addr().String())
+	assert.Error(t, err)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
+
+func TestProxy_TargetDown(t *testing.T) {
+	// Reserve then release a port so nothing listens on it
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	target := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	p, err := Listen("127.0.0.1:0", target)
+	require.NoError(t, err)
+	defer p.Close()
+	go func() { _ = p.Serve() }()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The client is dropped instead of hanging
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
+
+func TestListen_PortInUse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	_, err = Listen(l.Addr().String(), "127.0.0.1:1")
+	assert.Error(t, err)
+}
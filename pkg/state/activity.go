@@ -0,0 +1,43 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"os"
+	"time"
+)
+
+// LastActivity returns when the environment was last touched: the latest
+// of CreatedAt, LastUsedAt, and the modification time of its lock file
+// (skipped when the lock cannot be read, e.g. it lives on another host).
+func (e *EnvironmentState) LastActivity() time.Time {
+	last := e.CreatedAt
+	if e.LastUsedAt.After(last) {
+		last = e.LastUsedAt
+	}
+	if e.LockFile != "" {
+		if info, err := os.Stat(e.LockFile); err == nil && info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last
+}
+
+// MarkUsed records now as the environment's LastUsedAt.
+func (m *Manager) MarkUsed(isolationID string, now time.Time) error {
+	return m.UpdateEnvironment(isolationID, func(env *EnvironmentState) {
+		env.LastUsedAt = now
+	})
+}
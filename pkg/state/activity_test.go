@@ -0,0 +1,60 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvironmentState_LastActivity(t *testing.T) {
+	created := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	lockFile := filepath.Join(t.TempDir(), "env-abc.lock")
+	env := &EnvironmentState{ID: "abc", CreatedAt: created, LockFile: lockFile}
+
+	assert.Equal(t, created, env.LastActivity(), "missing lock")
+
+	require.NoError(t, os.WriteFile(lockFile, nil, 0o600))
+	touched := time.Now().Add(-time.Hour).Truncate(time.Second)
+	require.NoError(t, os.Chtimes(lockFile, touched, touched))
+	assert.Equal(t, touched, env.LastActivity())
+
+	used := time.Now().Add(-time.Minute).Truncate(time.Second)
+	env.LastUsedAt = used
+	assert.Equal(t, used, env.LastActivity(), "used after the lock was touched")
+}
+
+func TestManager_MarkUsed(t *testing.T) {
+	mgr := NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+	require.NoError(t, mgr.RecordEnvironment(&isolation.Environment{
+		ID:    "abc",
+		Ports: &ports.PortRange{BasePort: 20000, Count: 2},
+	}))
+
+	now := time.Now().Truncate(time.Second)
+	require.NoError(t, mgr.MarkUsed("abc", now))
+	env, err := mgr.GetEnvironment("abc")
+	require.NoError(t, err)
+	assert.True(t, now.Equal(env.LastUsedAt))
+
+	assert.ErrorIs(t, mgr.MarkUsed("missing", now), ErrNotFound)
+}
@@ -0,0 +1,176 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+// MaxCleanedRecords bounds how many soft-deleted records the state file
+// keeps; the oldest are dropped first.
+const MaxCleanedRecords = 100
+
+// SoftRemoveEnvironment removes env from the environments like
+// RemoveEnvironment, but keeps its record in State.Cleaned, marked with
+// now as CleanedAt, so that UndoCleanup can bring it back. Unlike
+// RemoveEnvironment, env need not be recorded: environments found only
+// through their lock file keep the entry built for them.
+func (m *Manager) SoftRemoveEnvironment(env *EnvironmentState, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.statePath, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open state file: %w", err)
+	}
+	defer f.Close()
+
+	if err := m.lockFile(f); err != nil {
+		return fmt.Errorf("failed to lock state file: %w", err)
+	}
+	defer func() { _ = m.unlockFile(f) }()
+
+	state, err := m.readState(f)
+	if err != nil {
+		return err
+	}
+
+	if err := m.appendJournal(&JournalEntry{Time: now.UTC(), Op: JournalCleanup, ID: env.ID}); err != nil {
+		return err
+	}
+
+	// Prefer the recorded entry, which may be newer than env
+	record := *env
+	for _, recorded := range state.Environments {
+		if recorded.ID == env.ID {
+			record = *recorded
+			break
+		}
+	}
+	record.CleanedAt = now
+
+	state.Environments = slices.DeleteFunc(state.Environments, func(e *EnvironmentState) bool {
+		return e.ID == env.ID
+	})
+	state.Cleaned = slices.DeleteFunc(state.Cleaned, func(e *EnvironmentState) bool {
+		return e.ID == env.ID
+	})
+	state.Cleaned = append(state.Cleaned, &record)
+	if excess := len(state.Cleaned) - MaxCleanedRecords; excess > 0 {
+		state.Cleaned = state.Cleaned[excess:]
+	}
+
+	if err := m.writeState(f, state); err != nil {
+		return err
+	}
+	if m.store != nil {
+		return m.store.Delete(env.ID)
+	}
+	return nil
+}
+
+// CleanedEnvironments returns the soft-deleted records, most recently
+// cleaned first.
+func (m *Manager) CleanedEnvironments() ([]*EnvironmentState, error) {
+	state, err := m.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	cleaned := slices.Clone(state.Cleaned)
+	slices.Reverse(cleaned)
+	return cleaned, nil
+}
+
+// FindCleaned returns the soft-deleted record of the environment with the
+// given ID.
+func (m *Manager) FindCleaned(isolationID string) (*EnvironmentState, error) {
+	cleaned, err := m.CleanedEnvironments()
+	if err != nil {
+		return nil, err
+	}
+	for _, env := range cleaned {
+		if env.ID == isolationID {
+			return env, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no cleaned record for %s", ErrNotFound, isolationID)
+}
+
+// FindCleanedByName returns the most recently soft-deleted record of the
+// environment with the given name.
+func (m *Manager) FindCleanedByName(name string) (*EnvironmentState, error) {
+	cleaned, err := m.CleanedEnvironments()
+	if err != nil {
+		return nil, err
+	}
+	for _, env := range cleaned {
+		if env.Name == name {
+			return env, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no cleaned record named %s", ErrNotFound, name)
+}
+
+// UndoCleanup moves the soft-deleted record of env back to the
+// environments, once the caller has recreated its lock and files. The
+// record is replaced by env, with CleanedAt cleared.
+func (m *Manager) UndoCleanup(env *EnvironmentState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.statePath, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open state file: %w", err)
+	}
+	defer f.Close()
+
+	if err := m.lockFile(f); err != nil {
+		return fmt.Errorf("failed to lock state file: %w", err)
+	}
+	defer func() { _ = m.unlockFile(f) }()
+
+	state, err := m.readState(f)
+	if err != nil {
+		return err
+	}
+
+	i := slices.IndexFunc(state.Cleaned, func(e *EnvironmentState) bool { return e.ID == env.ID })
+	if i < 0 {
+		return fmt.Errorf("%w: no cleaned record for %s", ErrNotFound, env.ID)
+	}
+	if slices.ContainsFunc(state.Environments, func(e *EnvironmentState) bool { return e.ID == env.ID }) {
+		return fmt.Errorf("environment %s is recorded again", env.ID)
+	}
+
+	restored := *env
+	restored.CleanedAt = time.Time{}
+	if err := m.appendJournal(journalCreate(&restored)); err != nil {
+		return err
+	}
+
+	state.Cleaned = slices.Delete(state.Cleaned, i, i+1)
+	state.Environments = append(state.Environments, &restored)
+
+	if err := m.writeState(f, state); err != nil {
+		return err
+	}
+	if err := writeSidecar(&restored); err != nil {
+		return err
+	}
+	return m.putStore(&restored)
+}
@@ -0,0 +1,111 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManager_SoftRemoveEnvironment(t *testing.T) {
+	mgr := NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+	require.NoError(t, mgr.RecordEnvironment(&isolation.Environment{
+		ID:    "abc",
+		Name:  "api",
+		Ports: &ports.PortRange{BasePort: 20000, Count: 2},
+	}))
+
+	// The recorded entry wins over the one passed in
+	now := time.Now().Truncate(time.Second)
+	require.NoError(t, mgr.SoftRemoveEnvironment(&EnvironmentState{ID: "abc"}, now))
+
+	_, err := mgr.GetEnvironment("abc")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	cleaned, err := mgr.FindCleaned("abc")
+	require.NoError(t, err)
+	assert.Equal(t, "api", cleaned.Name)
+	assert.Equal(t, 20000, cleaned.Ports.BasePort)
+	assert.True(t, now.Equal(cleaned.CleanedAt))
+
+	// Unrecorded environments keep the entry passed in
+	require.NoError(t, mgr.SoftRemoveEnvironment(&EnvironmentState{ID: "def"}, now.Add(time.Minute)))
+	all, err := mgr.CleanedEnvironments()
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+	assert.Equal(t, "def", all[0].ID, "newest first")
+
+	// Reconcile keeps the records
+	_, err = mgr.Reconcile(t.TempDir())
+	require.NoError(t, err)
+	all, err = mgr.CleanedEnvironments()
+	require.NoError(t, err)
+	assert.Len(t, all, 2)
+
+	_, err = mgr.FindCleaned("missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	byName, err := mgr.FindCleanedByName("api")
+	require.NoError(t, err)
+	assert.Equal(t, "abc", byName.ID)
+	_, err = mgr.FindCleanedByName("missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestManager_SoftRemoveEnvironment_Bounded(t *testing.T) {
+	mgr := NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+	now := time.Now()
+	for i := range MaxCleanedRecords + 5 {
+		require.NoError(t, mgr.SoftRemoveEnvironment(&EnvironmentState{ID: fmt.Sprintf("env%d", i)}, now))
+	}
+
+	all, err := mgr.CleanedEnvironments()
+	require.NoError(t, err)
+	require.Len(t, all, MaxCleanedRecords)
+	assert.Equal(t, fmt.Sprintf("env%d", MaxCleanedRecords+4), all[0].ID)
+	assert.Equal(t, "env5", all[len(all)-1].ID)
+}
+
+func TestManager_UndoCleanup(t *testing.T) {
+	mgr := NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+	require.NoError(t, mgr.RecordEnvironment(&isolation.Environment{
+		ID:    "abc",
+		Ports: &ports.PortRange{BasePort: 20000, Count: 2},
+	}))
+	require.NoError(t, mgr.SoftRemoveEnvironment(&EnvironmentState{ID: "abc"}, time.Now()))
+
+	record, err := mgr.FindCleaned("abc")
+	require.NoError(t, err)
+	record.TempDir = "/tmp/restored"
+	require.NoError(t, mgr.UndoCleanup(record))
+
+	env, err := mgr.GetEnvironment("abc")
+	require.NoError(t, err)
+	assert.Equal(t, "/tmp/restored", env.TempDir)
+	assert.True(t, env.CleanedAt.IsZero())
+
+	all, err := mgr.CleanedEnvironments()
+	require.NoError(t, err)
+	assert.Empty(t, all)
+
+	assert.ErrorIs(t, mgr.UndoCleanup(record), ErrNotFound, "already undone")
+}
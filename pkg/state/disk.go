@@ -0,0 +1,58 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// DiskUsage returns the number of bytes used by the environment's temp
+// directory. It is computed on demand rather than stored in the state file,
+// so it always reflects the current contents. A missing directory uses 0 bytes.
+func (e *EnvironmentState) DiskUsage() (int64, error) {
+	if e.TempDir == "" {
+		return 0, nil
+	}
+	return DirSize(e.TempDir)
+}
+
+// DirSize returns the total size of regular files under path. Entries that
+// disappear while walking are ignored.
+func DirSize(path string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
@@ -0,0 +1,51 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvironmentState_DiskUsage(t *testing.T) {
+	t.Run("sums files recursively", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "data", "nested"), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "a.log"), make([]byte, 100), 0o600))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "data", "nested", "b.db"), make([]byte, 2048), 0o600))
+
+		env := &EnvironmentState{TempDir: tmpDir}
+		size, err := env.DiskUsage()
+		require.NoError(t, err)
+		assert.Equal(t, int64(2148), size)
+	})
+
+	t.Run("missing temp dir uses no space", func(t *testing.T) {
+		env := &EnvironmentState{TempDir: filepath.Join(t.TempDir(), "gone")}
+		size, err := env.DiskUsage()
+		require.NoError(t, err)
+		assert.Zero(t, size)
+	})
+
+	t.Run("empty temp dir path", func(t *testing.T) {
+		size, err := (&EnvironmentState{}).DiskUsage()
+		require.NoError(t, err)
+		assert.Zero(t, size)
+	})
+}
@@ -0,0 +1,31 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"errors"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+)
+
+var (
+	// ErrNotFound is returned when no environment matches an ID, name, or
+	// instance ID. It is isolation.ErrNotFound, so an EnvironmentStore
+	// backed by a Manager reports missing environments as expected.
+	ErrNotFound = isolation.ErrNotFound
+
+	// ErrCorruptState is returned when the state file cannot be decoded.
+	ErrCorruptState = errors.New("corrupt state file")
+)
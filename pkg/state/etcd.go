@@ -0,0 +1,288 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultEtcdPrefix is the key prefix for environment entries.
+	DefaultEtcdPrefix = "/go-portalloc/environments/"
+	// DefaultEtcdHostPrefix is the key prefix for host heartbeats.
+	DefaultEtcdHostPrefix = "/go-portalloc/hosts/"
+	// DefaultEtcdLeaseTTL bounds how long a host's heartbeat outlives its
+	// last write.
+	DefaultEtcdLeaseTTL = 6 * time.Hour
+)
+
+// EtcdStore is a Store backed by etcd, accessed through the v3 JSON gateway
+// (etcd 3.4+) so no etcd client library is required.
+//
+// Entries have no TTL. Instead every host keeps one heartbeat key under
+// HostPrefix attached to a lease of LeaseTTL, which each of its writes
+// keeps alive; when a runner disappears without cleaning up, its lease
+// expires and its entries become stale (see LiveHosts). Set LeaseTTL to the
+// longest time a host may go without running go-portalloc.
+type EtcdStore struct {
+	HTTPClient *http.Client
+	// Endpoints are etcd client URLs, tried in order (e.g. http://etcd:2379).
+	Endpoints  []string
+	Prefix     string
+	HostPrefix string
+	LeaseTTL   time.Duration
+}
+
+// NewEtcdStore creates an etcd store with the default prefixes and lease TTL.
+func NewEtcdStore(endpoints ...string) *EtcdStore {
+	return &EtcdStore{
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+		Endpoints:  endpoints,
+		Prefix:     DefaultEtcdPrefix,
+		HostPrefix: DefaultEtcdHostPrefix,
+		LeaseTTL:   DefaultEtcdLeaseTTL,
+	}
+}
+
+type etcdKeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Lease string `json:"lease"`
+}
+
+// Put writes env without a lease.
+func (s *EtcdStore) Put(env *EnvironmentState) error {
+	value, err := json.Marshal(env)
+	if err != nil {
+		return fmt.Errorf("failed to marshal environment: %w", err)
+	}
+
+	req := map[string]interface{}{
+		"key":   encodeEtcd(s.key(env.ID)),
+		"value": base64.StdEncoding.EncodeToString(value),
+	}
+	if err := s.call("/v3/kv/put", req, nil); err != nil {
+		return fmt.Errorf("failed to put environment %s: %w", env.ID, err)
+	}
+	return nil
+}
+
+// Heartbeat marks host as alive for another LeaseTTL. The host's lease is
+// kept alive and reused; a new one is only granted when it has expired.
+func (s *EtcdStore) Heartbeat(host string) error {
+	key := s.hostKey(host)
+
+	var existing struct {
+		Kvs []etcdKeyValue `json:"kvs"`
+	}
+	if err := s.call("/v3/kv/range", map[string]interface{}{"key": encodeEtcd(key)}, &existing); err != nil {
+		return fmt.Errorf("failed to read heartbeat of %s: %w", host, err)
+	}
+
+	lease := ""
+	if len(existing.Kvs) > 0 && existing.Kvs[0].Lease != "" && existing.Kvs[0].Lease != "0" {
+		var resp struct {
+			Result struct {
+				TTL string `json:"TTL"`
+			} `json:"result"`
+		}
+		if err := s.call("/v3/lease/keepalive", map[string]interface{}{"ID": existing.Kvs[0].Lease}, &resp); err != nil {
+			return fmt.Errorf("failed to keep etcd lease alive: %w", err)
+		}
+		if ttl, _ := strconv.ParseInt(resp.Result.TTL, 10, 64); ttl > 0 {
+			lease = existing.Kvs[0].Lease
+		}
+	}
+	if lease == "" {
+		var grant struct {
+			ID string `json:"ID"`
+		}
+		ttl := int64(s.LeaseTTL / time.Second)
+		if ttl <= 0 {
+			ttl = int64(DefaultEtcdLeaseTTL / time.Second)
+		}
+		if err := s.call("/v3/lease/grant", map[string]interface{}{"TTL": ttl}, &grant); err != nil {
+			return fmt.Errorf("failed to grant etcd lease: %w", err)
+		}
+		lease = grant.ID
+	}
+
+	value, err := json.Marshal(map[string]interface{}{"host": host, "time": time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	req := map[string]interface{}{
+		"key":   encodeEtcd(key),
+		"value": base64.StdEncoding.EncodeToString(value),
+		"lease": lease,
+	}
+	if err := s.call("/v3/kv/put", req, nil); err != nil {
+		return fmt.Errorf("failed to write heartbeat of %s: %w", host, err)
+	}
+	return nil
+}
+
+// LiveHosts returns the hosts whose heartbeat lease has not expired.
+func (s *EtcdStore) LiveHosts() (map[string]bool, error) {
+	prefix := s.hostKey("")
+	req := map[string]interface{}{
+		"key":       encodeEtcd(prefix),
+		"range_end": encodeEtcd(prefixEnd(prefix)),
+		"keys_only": true,
+	}
+	var resp struct {
+		Kvs []etcdKeyValue `json:"kvs"`
+	}
+	if err := s.call("/v3/kv/range", req, &resp); err != nil {
+		return nil, fmt.Errorf("failed to list host heartbeats: %w", err)
+	}
+
+	hosts := make(map[string]bool, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		key, err := base64.StdEncoding.DecodeString(kv.Key)
+		if err != nil {
+			continue
+		}
+		hosts[strings.TrimPrefix(string(key), prefix)] = true
+	}
+	return hosts, nil
+}
+
+// Delete removes the entry for isolationID; a missing entry is not an error.
+func (s *EtcdStore) Delete(isolationID string) error {
+	req := map[string]interface{}{"key": encodeEtcd(s.key(isolationID))}
+	if err := s.call("/v3/kv/deleterange", req, nil); err != nil {
+		return fmt.Errorf("failed to delete environment %s: %w", isolationID, err)
+	}
+	return nil
+}
+
+// List returns all entries under the prefix.
+func (s *EtcdStore) List() ([]*EnvironmentState, error) {
+	prefix := s.key("")
+	req := map[string]interface{}{
+		"key":       encodeEtcd(prefix),
+		"range_end": encodeEtcd(prefixEnd(prefix)),
+	}
+	var resp struct {
+		Kvs []etcdKeyValue `json:"kvs"`
+	}
+	if err := s.call("/v3/kv/range", req, &resp); err != nil {
+		return nil, fmt.Errorf("failed to list environments: %w", err)
+	}
+
+	envs := make([]*EnvironmentState, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		value, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			continue
+		}
+		var env EnvironmentState
+		if err := json.Unmarshal(value, &env); err != nil {
+			// Skip entries written by incompatible versions
+			continue
+		}
+		envs = append(envs, &env)
+	}
+	return envs, nil
+}
+
+func (s *EtcdStore) key(isolationID string) string {
+	prefix := s.Prefix
+	if prefix == "" {
+		prefix = DefaultEtcdPrefix
+	}
+	return prefix + isolationID
+}
+
+func (s *EtcdStore) hostKey(host string) string {
+	prefix := s.HostPrefix
+	if prefix == "" {
+		prefix = DefaultEtcdHostPrefix
+	}
+	return prefix + host
+}
+
+// call POSTs a JSON request to the first reachable endpoint.
+func (s *EtcdStore) call(path string, req, resp interface{}) error {
+	if len(s.Endpoints) == 0 {
+		return fmt.Errorf("no etcd endpoints configured")
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	client := s.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	var lastErr error
+	for _, endpoint := range s.Endpoints {
+		url := strings.TrimSuffix(endpoint, "/") + path
+		httpReq, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+
+		httpResp, err := client.Do(httpReq)
+		if err != nil {
+			// Try the next member
+			lastErr = err
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(httpResp.Body, 64<<20))
+		_ = httpResp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if httpResp.StatusCode != http.StatusOK {
+			return fmt.Errorf("etcd %s returned %s: %s", path, httpResp.Status, strings.TrimSpace(string(data)))
+		}
+		if resp == nil {
+			return nil
+		}
+		return json.Unmarshal(data, resp)
+	}
+	return lastErr
+}
+
+func encodeEtcd(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// prefixEnd returns the range end matching every key with the given prefix.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	// Prefix of all 0xff bytes: range to the end of the keyspace
+	return "\x00"
+}
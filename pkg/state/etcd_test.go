@@ -0,0 +1,277 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEtcd implements the subset of the etcd v3 JSON gateway used by EtcdStore.
+type fakeEtcd struct {
+	kv     map[string]string
+	leases map[string]string
+	// live holds the granted leases that have not expired.
+	live map[string]bool
+	ttls []int64
+	mu   sync.Mutex
+}
+
+func newFakeEtcd(t *testing.T) (*fakeEtcd, *httptest.Server) {
+	f := &fakeEtcd{kv: map[string]string{}, leases: map[string]string{}, live: map[string]bool{}}
+	srv := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeEtcd) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var req map[string]interface{}
+	_ = json.NewDecoder(r.Body).Decode(&req)
+	decode := func(field string) string {
+		s, _ := req[field].(string)
+		b, _ := base64.StdEncoding.DecodeString(s)
+		return string(b)
+	}
+
+	switch r.URL.Path {
+	case "/v3/lease/grant":
+		ttl, _ := req["TTL"].(float64)
+		f.ttls = append(f.ttls, int64(ttl))
+		id := strconv.Itoa(7586 + len(f.ttls))
+		f.live[id] = true
+		_ = json.NewEncoder(w).Encode(map[string]string{"ID": id})
+	case "/v3/lease/keepalive":
+		id, _ := req["ID"].(string)
+		ttl := "0"
+		if f.live[id] {
+			ttl = "7200"
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"result": map[string]string{"ID": id, "TTL": ttl}})
+	case "/v3/kv/put":
+		key := decode("key")
+		f.kv[key] = decode("value")
+		f.leases[key], _ = req["lease"].(string)
+		_, _ = w.Write([]byte("{}"))
+	case "/v3/kv/deleterange":
+		delete(f.kv, decode("key"))
+		_, _ = w.Write([]byte("{}"))
+	case "/v3/kv/range":
+		start, end := decode("key"), decode("range_end")
+		kvs := []map[string]string{}
+		for k, v := range f.kv {
+			if (end == "" && k == start) || (end != "" && k >= start && k < end) {
+				kvs = append(kvs, map[string]string{
+					"key":   base64.StdEncoding.EncodeToString([]byte(k)),
+					"value": base64.StdEncoding.EncodeToString([]byte(v)),
+					"lease": f.leases[k],
+				})
+			}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"kvs": kvs})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// expire drops a lease and the keys attached to it, as etcd does when its
+// TTL runs out.
+func (f *fakeEtcd) expire(lease string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.live, lease)
+	for k, l := range f.leases {
+		if l == lease {
+			delete(f.kv, k)
+			delete(f.leases, k)
+		}
+	}
+}
+
+func TestEtcdStore(t *testing.T) {
+	fake, srv := newFakeEtcd(t)
+	store := NewEtcdStore("http://127.0.0.1:1", srv.URL) // first member is down
+	store.LeaseTTL = 2 * time.Hour
+
+	env := &EnvironmentState{ID: "etcd1", Host: "runner-1", PID: 42, Ports: &PortsState{BasePort: 25000, Count: 2}}
+	require.NoError(t, store.Put(env))
+	require.NoError(t, store.Put(env))
+
+	assert.Contains(t, fake.kv, DefaultEtcdPrefix+"etcd1")
+	assert.Empty(t, fake.leases[DefaultEtcdPrefix+"etcd1"], "entries must not expire")
+	assert.Empty(t, fake.ttls, "puts must not grant leases")
+
+	// Keys outside the prefix are ignored
+	fake.kv["/other/key"] = "{}"
+
+	envs, err := store.List()
+	require.NoError(t, err)
+	require.Len(t, envs, 1)
+	assert.Equal(t, "runner-1", envs[0].Host)
+	assert.Equal(t, 25000, envs[0].Ports.BasePort)
+
+	require.NoError(t, store.Delete("etcd1"))
+	require.NoError(t, store.Delete("etcd1"))
+	envs, err = store.List()
+	require.NoError(t, err)
+	assert.Empty(t, envs)
+}
+
+func TestEtcdStore_Heartbeat(t *testing.T) {
+	fake, srv := newFakeEtcd(t)
+	store := NewEtcdStore(srv.URL)
+	store.LeaseTTL = 2 * time.Hour
+
+	require.NoError(t, store.Heartbeat("runner-1"))
+	require.NoError(t, store.Heartbeat("runner-1"))
+	assert.Equal(t, []int64{7200}, fake.ttls, "the host's lease is kept alive, not re-granted")
+	lease := fake.leases[DefaultEtcdHostPrefix+"runner-1"]
+	assert.NotEmpty(t, lease)
+
+	hosts, err := store.LiveHosts()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"runner-1": true}, hosts)
+
+	fake.expire(lease)
+	hosts, err = store.LiveHosts()
+	require.NoError(t, err)
+	assert.Empty(t, hosts)
+
+	// After expiry a fresh lease is granted
+	require.NoError(t, store.Heartbeat("runner-1"))
+	assert.Len(t, fake.ttls, 2)
+	assert.NotEqual(t, lease, fake.leases[DefaultEtcdHostPrefix+"runner-1"])
+}
+
+func TestEtcdStore_Errors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"etcdserver: permission denied"}`, http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	_, err := NewEtcdStore(srv.URL).List()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "permission denied")
+
+	_, err = NewEtcdStore().List()
+	assert.Error(t, err)
+}
+
+func TestPrefixEnd(t *testing.T) {
+	assert.Equal(t, "/a/c", prefixEnd("/a/b"))
+	assert.Equal(t, "/b", prefixEnd("/a\xff"))
+	assert.Equal(t, "\x00", prefixEnd("\xff"))
+}
+
+func TestManager_Store(t *testing.T) {
+	_, srv := newFakeEtcd(t)
+	store := NewEtcdStore(srv.URL)
+
+	mgr := NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+	mgr.SetStore(store)
+
+	env := &isolation.Environment{ID: "mirrored", Ports: &ports.PortRange{BasePort: 26000, Count: 1}}
+	require.NoError(t, mgr.RecordEnvironment(env))
+
+	// Another host's entry is visible and reported active while that host
+	// heartbeats
+	require.NoError(t, store.Put(&EnvironmentState{ID: "remote", Host: "other-host", PID: 999999}))
+	require.NoError(t, store.Heartbeat("other-host"))
+
+	envs, err := mgr.ListEnvironments()
+	require.NoError(t, err)
+	require.Len(t, envs, 2)
+
+	remote, err := mgr.GetEnvironment("remote")
+	require.NoError(t, err)
+	assert.Equal(t, StatusActive, GetEnvironmentStatus(remote))
+
+	require.NoError(t, mgr.UpdateEnvironment("mirrored", func(e *EnvironmentState) { e.GitBranch = "main" }))
+	mirrored, err := mgr.GetEnvironment("mirrored")
+	require.NoError(t, err)
+	assert.Equal(t, "main", mirrored.GitBranch)
+	assert.Equal(t, localHost(), mirrored.Host)
+
+	t.Run("reconcile removes this host's entries without locks", func(t *testing.T) {
+		_, err := mgr.Reconcile(t.TempDir())
+		require.NoError(t, err)
+
+		envs, err := store.List()
+		require.NoError(t, err)
+		ids := []string{}
+		for _, e := range envs {
+			ids = append(ids, e.ID)
+		}
+		assert.Equal(t, "remote", strings.Join(ids, ","))
+	})
+
+	require.NoError(t, mgr.RemoveEnvironment("remote"))
+	envs, err = mgr.ListEnvironments()
+	require.NoError(t, err)
+	assert.Empty(t, envs)
+}
+
+func TestManager_StoreHostExpiry(t *testing.T) {
+	fake, srv := newFakeEtcd(t)
+	store := NewEtcdStore(srv.URL)
+
+	mgr := NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+	mgr.SetStore(store)
+
+	require.NoError(t, store.Put(&EnvironmentState{ID: "remote", Host: "other-host", PID: 999999}))
+	require.NoError(t, store.Heartbeat("other-host"))
+
+	remote, err := mgr.GetEnvironment("remote")
+	require.NoError(t, err)
+	assert.Equal(t, StatusActive, GetEnvironmentStatus(remote))
+
+	fake.expire(fake.leases[DefaultEtcdHostPrefix+"other-host"])
+
+	remote, err = mgr.GetEnvironment("remote")
+	require.NoError(t, err)
+	assert.True(t, remote.HostExpired)
+	assert.Equal(t, StatusStale, GetEnvironmentStatus(remote))
+}
+
+func TestManager_StoreUnavailable(t *testing.T) {
+	mgr := NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+	env := &isolation.Environment{ID: "local", Ports: &ports.PortRange{BasePort: 26000, Count: 1}}
+	require.NoError(t, mgr.RecordEnvironment(env))
+
+	// Local environments stay visible when etcd is down
+	mgr.SetStore(NewEtcdStore("http://127.0.0.1:1"))
+
+	envs, err := mgr.ListEnvironments()
+	require.NoError(t, err)
+	require.Len(t, envs, 1)
+	assert.Equal(t, "local", envs[0].ID)
+	assert.Error(t, mgr.StoreError())
+}
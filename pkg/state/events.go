@@ -0,0 +1,91 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"sort"
+	"time"
+)
+
+// EventType is the kind of lifecycle change observed between two snapshots.
+type EventType string
+
+const (
+	// EventCreated indicates an environment appeared in the state file.
+	EventCreated EventType = "created"
+	// EventRemoved indicates an environment disappeared from the state file.
+	EventRemoved EventType = "removed"
+	// EventStale indicates an environment's owning process exited.
+	EventStale EventType = "stale"
+)
+
+// Event is a single environment lifecycle change.
+type Event struct {
+	Time        time.Time
+	Environment *EnvironmentState
+	Type        EventType
+}
+
+// Snapshot captures the environments and their statuses at one point in time.
+type Snapshot struct {
+	envs   map[string]*EnvironmentState
+	status map[string]EnvironmentStatus
+}
+
+// NewSnapshot builds a snapshot, evaluating each environment's status now.
+func NewSnapshot(envs []*EnvironmentState) *Snapshot {
+	s := &Snapshot{
+		envs:   make(map[string]*EnvironmentState, len(envs)),
+		status: make(map[string]EnvironmentStatus, len(envs)),
+	}
+	for _, env := range envs {
+		s.envs[env.ID] = env
+		s.status[env.ID] = GetEnvironmentStatus(env)
+	}
+	return s
+}
+
+// Diff returns the events that turn s into next: created, then stale, then
+// removed, each ordered by ID. An environment that is already stale when it
+// first appears produces a created event only.
+func (s *Snapshot) Diff(next *Snapshot) []Event {
+	now := time.Now()
+	var created, stale, removed []Event
+
+	for id, env := range next.envs {
+		prevStatus, existed := s.status[id]
+		switch {
+		case !existed:
+			created = append(created, Event{Type: EventCreated, Time: now, Environment: env})
+		case prevStatus == StatusActive && next.status[id] == StatusStale:
+			stale = append(stale, Event{Type: EventStale, Time: now, Environment: env})
+		}
+	}
+
+	for id, env := range s.envs {
+		if _, ok := next.envs[id]; !ok {
+			removed = append(removed, Event{Type: EventRemoved, Time: now, Environment: env})
+		}
+	}
+
+	events := make([]Event, 0, len(created)+len(stale)+len(removed))
+	for _, group := range [][]Event{created, stale, removed} {
+		sort.Slice(group, func(i, j int) bool {
+			return group[i].Environment.ID < group[j].Environment.ID
+		})
+		events = append(events, group...)
+	}
+	return events
+}
@@ -0,0 +1,74 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot_Diff(t *testing.T) {
+	const deadPID = 999999
+
+	eventIDs := func(events []Event) []string {
+		var out []string
+		for _, e := range events {
+			out = append(out, string(e.Type)+":"+e.Environment.ID)
+		}
+		return out
+	}
+
+	t.Run("no changes", func(t *testing.T) {
+		envs := []*EnvironmentState{{ID: "a", PID: os.Getpid()}}
+		assert.Empty(t, NewSnapshot(envs).Diff(NewSnapshot(envs)))
+	})
+
+	t.Run("created, stale, and removed", func(t *testing.T) {
+		prev := NewSnapshot([]*EnvironmentState{
+			{ID: "keep", PID: os.Getpid()},
+			{ID: "dies", PID: os.Getpid()},
+			{ID: "gone", PID: os.Getpid()},
+		})
+		next := NewSnapshot([]*EnvironmentState{
+			{ID: "keep", PID: os.Getpid()},
+			{ID: "dies", PID: deadPID},
+			{ID: "new-b", PID: os.Getpid()},
+			{ID: "new-a", PID: deadPID},
+		})
+
+		events := prev.Diff(next)
+		assert.Equal(t, []string{
+			"created:new-a",
+			"created:new-b",
+			"stale:dies",
+			"removed:gone",
+		}, eventIDs(events))
+		for _, e := range events {
+			assert.False(t, e.Time.IsZero())
+		}
+	})
+
+	t.Run("stale is reported once", func(t *testing.T) {
+		stale := NewSnapshot([]*EnvironmentState{{ID: "a", PID: deadPID}})
+		assert.Empty(t, stale.Diff(NewSnapshot([]*EnvironmentState{{ID: "a", PID: deadPID}})))
+	})
+
+	t.Run("empty snapshot", func(t *testing.T) {
+		events := NewSnapshot(nil).Diff(NewSnapshot([]*EnvironmentState{{ID: "a", PID: os.Getpid()}}))
+		assert.Equal(t, []string{"created:a"}, eventIDs(events))
+	})
+}
@@ -0,0 +1,136 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// HistoryFileName is the allocation history file, kept next to state.json.
+const HistoryFileName = "history.jsonl"
+
+// DefaultHistorySize is the number of allocations the history keeps.
+const DefaultHistorySize = 1000
+
+// historySize is DefaultHistorySize, lowered by tests.
+var historySize = DefaultHistorySize
+
+// AllocationRecord is one allocation attempt in the history.
+type AllocationRecord struct {
+	Time        time.Time `json:"time"`
+	IsolationID string    `json:"isolation_id,omitempty"`
+	// BasePort is zero for failed allocations.
+	BasePort int    `json:"base_port,omitempty"`
+	Count    int    `json:"count"`
+	Worktree string `json:"worktree"`
+	Success  bool   `json:"success"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Contains reports whether the record allocated port.
+func (r *AllocationRecord) Contains(port int) bool {
+	return r.Success && port >= r.BasePort && port < r.BasePort+r.Count
+}
+
+// HistoryPath returns the path of the allocation history file.
+func (m *Manager) HistoryPath() string {
+	return filepath.Join(filepath.Dir(m.statePath), HistoryFileName)
+}
+
+// RecordAllocation appends rec to the allocation history, dropping the
+// oldest records beyond DefaultHistorySize. Unlike the state, the history
+// outlives cleanup, so it can answer who had a port hours ago.
+func (m *Manager) RecordAllocation(rec AllocationRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.HistoryPath(), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open history file: %w", err)
+	}
+	defer f.Close()
+
+	if err := m.lockFile(f); err != nil {
+		return fmt.Errorf("failed to lock history file: %w", err)
+	}
+	defer func() { _ = m.unlockFile(f) }()
+
+	records, err := readHistory(f)
+	if err != nil {
+		return err
+	}
+	records = append(records, rec)
+	if len(records) > historySize {
+		records = records[len(records)-historySize:]
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for i := range records {
+		if err := encoder.Encode(&records[i]); err != nil {
+			return fmt.Errorf("failed to encode history: %w", err)
+		}
+	}
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate history file: %w", err)
+	}
+	if _, err := f.WriteAt(buf.Bytes(), 0); err != nil {
+		return fmt.Errorf("failed to write history file: %w", err)
+	}
+	return nil
+}
+
+// History returns the recorded allocations, oldest first.
+func (m *Manager) History() ([]AllocationRecord, error) {
+	f, err := os.Open(m.HistoryPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open history file: %w", err)
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH); err != nil {
+		return nil, fmt.Errorf("failed to lock history file: %w", err)
+	}
+	defer func() { _ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN) }()
+
+	return readHistory(f)
+}
+
+// readHistory decodes a history file, skipping lines that do not decode
+// (e.g. one torn by a crash mid-write).
+func readHistory(f *os.File) ([]AllocationRecord, error) {
+	var records []AllocationRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec AllocationRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err == nil {
+			records = append(records, rec)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read history file: %w", err)
+	}
+	return records, nil
+}
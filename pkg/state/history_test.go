@@ -0,0 +1,68 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManager_History(t *testing.T) {
+	dir := t.TempDir()
+	mgr := NewManagerAt(filepath.Join(dir, "state.json"))
+
+	records, err := mgr.History()
+	require.NoError(t, err)
+	assert.Empty(t, records)
+
+	defer func(size int) { historySize = size }(historySize)
+	historySize = 3
+
+	now := time.Now().Truncate(time.Second)
+	for i := 0; i < 4; i++ {
+		require.NoError(t, mgr.RecordAllocation(AllocationRecord{
+			Time:        now.Add(time.Duration(i) * time.Minute),
+			IsolationID: string(rune('a' + i)),
+			BasePort:    20000 + 10*i,
+			Count:       5,
+			Worktree:    "/src/app",
+			Success:     true,
+		}))
+	}
+	require.NoError(t, mgr.RecordAllocation(AllocationRecord{Time: now, Count: 5, Error: "no free ports available"}))
+
+	// Torn lines are skipped
+	f, err := os.OpenFile(mgr.HistoryPath(), os.O_APPEND|os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"time": "2026-`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	records, err = mgr.History()
+	require.NoError(t, err)
+	require.Len(t, records, 3, "history is bounded")
+	assert.Equal(t, "c", records[0].IsolationID)
+	assert.Equal(t, "d", records[1].IsolationID)
+	assert.False(t, records[2].Success)
+
+	assert.True(t, records[1].Contains(20034))
+	assert.False(t, records[1].Contains(20035))
+	assert.False(t, records[2].Contains(0), "failed allocations hold no ports")
+}
@@ -0,0 +1,261 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// JournalFileName is the allocation journal, kept next to state.json.
+const JournalFileName = "journal.jsonl"
+
+// Journal operations.
+const (
+	JournalCreate  = "create"
+	JournalCleanup = "cleanup"
+)
+
+// JournalEntry is one create or cleanup operation in the journal.
+type JournalEntry struct {
+	Time time.Time `json:"time"`
+	Op   string    `json:"op"`
+	ID   string    `json:"id"`
+	// The fields below are only set for JournalCreate.
+	Ports        *PortsState `json:"ports,omitempty"`
+	WorktreePath string      `json:"worktree_path,omitempty"`
+	EnvFile      string      `json:"env_file,omitempty"`
+	EnvFiles     []string    `json:"env_files,omitempty"`
+	Name         string      `json:"name,omitempty"`
+	Project      string      `json:"project,omitempty"`
+}
+
+// JournalPath returns the path of the allocation journal.
+func (m *Manager) JournalPath() string {
+	return filepath.Join(filepath.Dir(m.statePath), JournalFileName)
+}
+
+// appendJournal appends entry to the journal and fsyncs it, so the
+// operation is on disk before the state file records it.
+func (m *Manager) appendJournal(entry *JournalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode journal entry: %w", err)
+	}
+
+	f, err := m.openJournal()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	defer func() { _ = m.unlockFile(f) }()
+
+	// Start a new line after one torn by a crash, so this entry stays intact
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			line = append([]byte{'\n'}, line...)
+		}
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal: %w", err)
+	}
+	return nil
+}
+
+// openJournal opens the journal for appending and locks it. compactJournal
+// replaces the file by renaming a new one over it, so a journal locked after
+// a compaction is reopened rather than appended to after it was unlinked.
+func (m *Manager) openJournal() (*os.File, error) {
+	for {
+		f, err := os.OpenFile(m.JournalPath(), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open journal: %w", err)
+		}
+		if err := m.lockFile(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock journal: %w", err)
+		}
+		opened, err := f.Stat()
+		if err != nil {
+			_ = m.unlockFile(f)
+			f.Close()
+			return nil, fmt.Errorf("failed to stat journal: %w", err)
+		}
+		if current, err := os.Stat(m.JournalPath()); err == nil && os.SameFile(opened, current) {
+			return f, nil
+		}
+		_ = m.unlockFile(f)
+		f.Close()
+	}
+}
+
+// journalCreate builds the journal entry recording env's creation.
+func journalCreate(env *EnvironmentState) *JournalEntry {
+	return &JournalEntry{
+		Time:         time.Now().UTC(),
+		Op:           JournalCreate,
+		ID:           env.ID,
+		Ports:        env.Ports,
+		WorktreePath: env.WorktreePath,
+		EnvFile:      env.EnvFile,
+		EnvFiles:     env.EnvFiles,
+		Name:         env.Name,
+		Project:      env.Project,
+	}
+}
+
+// Journal replays the journal and returns the latest create entry of
+// every environment not cleaned up since, by ID.
+func (m *Manager) Journal() (map[string]*JournalEntry, error) {
+	f, err := os.Open(m.JournalPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]*JournalEntry{}, nil
+		}
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+	defer f.Close()
+
+	if err := m.lockFile(f); err != nil {
+		return nil, fmt.Errorf("failed to lock journal: %w", err)
+	}
+	defer func() { _ = m.unlockFile(f) }()
+
+	live, _, err := replayJournal(f)
+	return live, err
+}
+
+// replayJournal decodes a journal, skipping lines that do not decode
+// (e.g. one torn by a crash mid-write). It also returns the number of lines.
+func replayJournal(f *os.File) (map[string]*JournalEntry, int, error) {
+	live := make(map[string]*JournalEntry)
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		lines++
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.ID == "" {
+			continue
+		}
+		switch entry.Op {
+		case JournalCreate:
+			live[entry.ID] = &entry
+		case JournalCleanup:
+			delete(live, entry.ID)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to read journal: %w", err)
+	}
+	return live, lines, nil
+}
+
+// compactJournal rewrites the journal with only the create entries of the
+// environments in keep, so it does not grow without bound. The new journal
+// is written and synced to a temp file that is then renamed over the old
+// one, so a crash leaves one of the two intact.
+func (m *Manager) compactJournal(keep []*EnvironmentState) error {
+	f, err := os.OpenFile(m.JournalPath(), os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to open journal: %w", err)
+	}
+	defer f.Close()
+
+	if err := m.lockFile(f); err != nil {
+		return fmt.Errorf("failed to lock journal: %w", err)
+	}
+	defer func() { _ = m.unlockFile(f) }()
+
+	live, lines, err := replayJournal(f)
+	if err != nil {
+		return err
+	}
+	if lines == len(keep) && len(live) == len(keep) && allJournaled(live, keep) {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, env := range keep {
+		entry, ok := live[env.ID]
+		if !ok {
+			// Environments created before the journal existed
+			entry = journalCreate(env)
+		}
+		if err := encoder.Encode(entry); err != nil {
+			return fmt.Errorf("failed to encode journal entry: %w", err)
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(m.JournalPath()), JournalFileName+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to sync journal: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), m.JournalPath()); err != nil {
+		return fmt.Errorf("failed to replace journal: %w", err)
+	}
+	return nil
+}
+
+// environment returns the state the entry recorded, for mergeRecorded.
+func (e *JournalEntry) environment() *EnvironmentState {
+	return &EnvironmentState{
+		ID:           e.ID,
+		Name:         e.Name,
+		Project:      e.Project,
+		WorktreePath: e.WorktreePath,
+		EnvFile:      e.EnvFile,
+		EnvFiles:     e.EnvFiles,
+		Ports:        e.Ports,
+	}
+}
+
+// allJournaled reports whether every environment in envs has an entry.
+func allJournaled(live map[string]*JournalEntry, envs []*EnvironmentState) bool {
+	for _, env := range envs {
+		if _, ok := live[env.ID]; !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,119 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManager_Journal(t *testing.T) {
+	dir := t.TempDir()
+	mgr := NewManagerAt(filepath.Join(dir, "state.json"))
+	lockDir := t.TempDir()
+	worktree := t.TempDir()
+
+	record := func(id string, basePort int) {
+		t.Helper()
+		envFile := filepath.Join(worktree, id+".env")
+		require.NoError(t, os.WriteFile(envFile, []byte(fmt.Sprintf("PORT_BASE=%d\nPORT_COUNT=3\n", basePort)), 0o644))
+		lockFile := filepath.Join(lockDir, "env-"+id+".lock")
+		content := fmt.Sprintf("PID=%d\nTimestamp=%d\nWorktree=%s\n", os.Getpid(), time.Now().Unix(), worktree)
+		require.NoError(t, os.WriteFile(lockFile, []byte(content), 0o600))
+		require.NoError(t, mgr.RecordEnvironment(&isolation.Environment{
+			ID:           id,
+			WorktreePath: worktree,
+			LockFile:     lockFile,
+			EnvFile:      envFile,
+			Ports:        &ports.PortRange{BasePort: basePort, Count: 3},
+		}))
+	}
+
+	record("a", 21000)
+	record("b", 22000)
+	record("c", 23000)
+	require.NoError(t, mgr.RemoveEnvironment("c"))
+	require.NoError(t, os.Remove(filepath.Join(lockDir, "env-c.lock")))
+
+	live, err := mgr.Journal()
+	require.NoError(t, err)
+	assert.Len(t, live, 2)
+	assert.Equal(t, 22000, live["b"].Ports.BasePort)
+
+	t.Run("recovers ports after the state and env file are lost", func(t *testing.T) {
+		require.NoError(t, os.Remove(mgr.Path()))
+		require.NoError(t, os.Remove(filepath.Join(worktree, "a.env")))
+
+		count, err := mgr.Reconcile(lockDir)
+		require.NoError(t, err)
+		assert.Equal(t, 2, count)
+
+		env, err := mgr.GetEnvironment("a")
+		require.NoError(t, err)
+		assert.Equal(t, 21000, env.Ports.BasePort)
+		assert.Equal(t, []int{21000, 21001, 21002}, env.Ports.Allocated)
+
+		// The env file path comes from the journal, not the default name
+		env, err = mgr.GetEnvironment("b")
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(worktree, "b.env"), env.EnvFile)
+		assert.Equal(t, 22000, env.Ports.BasePort)
+	})
+
+	t.Run("reconcile compacts the journal", func(t *testing.T) {
+		data, err := os.ReadFile(mgr.JournalPath())
+		require.NoError(t, err)
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		assert.Len(t, lines, 2)
+		for _, line := range lines {
+			assert.Contains(t, line, `"op":"create"`)
+		}
+
+		// The compacted journal was renamed into place
+		leftovers, err := filepath.Glob(mgr.JournalPath() + ".tmp-*")
+		require.NoError(t, err)
+		assert.Empty(t, leftovers)
+		info, err := os.Stat(mgr.JournalPath())
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o644), info.Mode().Perm())
+	})
+
+	t.Run("skips torn lines", func(t *testing.T) {
+		f, err := os.OpenFile(mgr.JournalPath(), os.O_WRONLY|os.O_APPEND, 0)
+		require.NoError(t, err)
+		_, err = f.WriteString(`{"op":"cleanup","id":"a"`)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		live, err := mgr.Journal()
+		require.NoError(t, err)
+		assert.Contains(t, live, "a")
+
+		// The next entry is not lost to the torn line
+		require.NoError(t, mgr.RemoveEnvironment("b"))
+		live, err = mgr.Journal()
+		require.NoError(t, err)
+		assert.NotContains(t, live, "b")
+	})
+}
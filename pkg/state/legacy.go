@@ -0,0 +1,158 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+)
+
+// LegacyEnvironment is an environment whose lock file or temp directory
+// still uses the legacy aigis names under the portalloc naming scheme.
+type LegacyEnvironment struct {
+	ID string
+	// LockFile is the lock in isolation.LegacyLockDir; empty when the lock
+	// is already in the lock directory.
+	LockFile string
+	// TempDir is the aigis-test- temp directory; empty when it already has
+	// the current name.
+	TempDir string
+	// Live reports whether the owning process is running. Live
+	// environments are not migrated while their owner uses the old paths.
+	Live bool
+}
+
+// FindLegacy returns the environments using legacy names, sorted by ID.
+// Only environments with a lock file are considered; temp directories
+// without one are orphans (see FindOrphanedTempDirs). It finds nothing
+// unless the portalloc naming scheme is in effect.
+func FindLegacy(lockDir string) ([]*LegacyEnvironment, error) {
+	if isolation.CurrentNaming() != isolation.NamingPortalloc {
+		return nil, nil
+	}
+
+	found := make(map[string]*LegacyEnvironment)
+	get := func(id string) *LegacyEnvironment {
+		if found[id] == nil {
+			found[id] = &LegacyEnvironment{ID: id}
+		}
+		return found[id]
+	}
+
+	if filepath.Clean(lockDir) != isolation.LegacyLockDir {
+		locks, err := filepath.Glob(filepath.Join(isolation.LegacyLockDir, "env-*.lock"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan legacy lock files: %w", err)
+		}
+		for _, lock := range locks {
+			id := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(lock), "env-"), ".lock")
+			get(id).LockFile = lock
+		}
+	}
+
+	if isolation.TempPrefix() != isolation.LegacyTempPrefix {
+		dirs, err := filepath.Glob(filepath.Join(os.TempDir(), isolation.LegacyTempPrefix+"*"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan legacy temp directories: %w", err)
+		}
+		for _, dir := range dirs {
+			id := strings.TrimPrefix(filepath.Base(dir), isolation.LegacyTempPrefix)
+			if info, err := os.Stat(dir); err == nil && info.IsDir() && lockExists(lockDir, id) {
+				get(id).TempDir = dir
+			}
+		}
+	}
+
+	legacy := make([]*LegacyEnvironment, 0, len(found))
+	for _, env := range found {
+		lock := env.LockFile
+		if lock == "" {
+			lock = filepath.Join(lockDir, fmt.Sprintf("env-%s.lock", env.ID))
+		}
+		if info, err := isolation.ReadLockInfo(lock); err == nil {
+			env.Live = info.Alive()
+		}
+		legacy = append(legacy, env)
+	}
+	sort.Slice(legacy, func(i, j int) bool { return legacy[i].ID < legacy[j].ID })
+	return legacy, nil
+}
+
+// MigrateLegacy renames the environments found by FindLegacy whose owner
+// is gone: lock files move into lockDir and temp directories to
+// isolation.TempDirPath. The state file is then reconciled so it records
+// the new paths. It returns the migrated environments.
+func (m *Manager) MigrateLegacy(lockDir string) ([]*LegacyEnvironment, error) {
+	legacy, err := FindLegacy(lockDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrated []*LegacyEnvironment
+	var errs []error
+	for _, env := range legacy {
+		if env.Live {
+			continue
+		}
+		if err := migrateLegacy(env, lockDir); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		migrated = append(migrated, env)
+	}
+
+	if len(migrated) > 0 {
+		if _, err := m.Reconcile(lockDir); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return migrated, errors.Join(errs...)
+}
+
+// migrateLegacy renames env's temp directory, then its lock file, so an
+// interrupted migration leaves an environment reconcile still finds.
+func migrateLegacy(env *LegacyEnvironment, lockDir string) error {
+	if env.TempDir != "" {
+		if err := renameNoReplace(env.TempDir, isolation.TempDirPath(env.ID)); err != nil {
+			return fmt.Errorf("failed to migrate temp directory of %s: %w", env.ID, err)
+		}
+	}
+	if env.LockFile != "" {
+		if err := os.MkdirAll(lockDir, 0o750); err != nil {
+			return fmt.Errorf("failed to create lock directory: %w", err)
+		}
+		lockFile := filepath.Join(lockDir, filepath.Base(env.LockFile))
+		if err := renameNoReplace(env.LockFile, lockFile); err != nil {
+			return fmt.Errorf("failed to migrate lock file of %s: %w", env.ID, err)
+		}
+		// Reconcile rewrites the paths recorded in the sidecar
+		_ = os.Rename(isolation.SidecarPath(env.LockFile), isolation.SidecarPath(lockFile))
+	}
+	return nil
+}
+
+// renameNoReplace renames oldPath to newPath unless newPath exists.
+func renameNoReplace(oldPath, newPath string) error {
+	if _, err := os.Lstat(newPath); err == nil {
+		return fmt.Errorf("%s already exists", newPath)
+	}
+	return os.Rename(oldPath, newPath)
+}
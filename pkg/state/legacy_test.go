@@ -0,0 +1,119 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManager_MigrateLegacy(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	t.Setenv(isolation.TempPrefixEnv, "")
+	mgr := NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+	lockDir := t.TempDir()
+
+	// Legacy locks live in a fixed directory; use IDs no one else has
+	require.NoError(t, os.MkdirAll(isolation.LegacyLockDir, 0o750))
+	t.Cleanup(func() { _ = os.Remove(isolation.LegacyLockDir) }) // only if empty
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	writeLock := func(dir, id string, pid int) string {
+		lockFile := filepath.Join(dir, fmt.Sprintf("env-%s.lock", id))
+		content := fmt.Sprintf("PID=%d\nTimestamp=%d\nWorktree=%s\n", pid, time.Now().Unix(), t.TempDir())
+		require.NoError(t, os.WriteFile(lockFile, []byte(content), 0o600))
+		t.Cleanup(func() { _ = os.Remove(lockFile) })
+		return lockFile
+	}
+	legacyDir := func(id string) string {
+		dir := filepath.Join(os.TempDir(), isolation.LegacyTempPrefix+id)
+		require.NoError(t, os.Mkdir(dir, 0o750))
+		return dir
+	}
+
+	const deadPID = 999999
+	staleID, liveID, movedID := "stale-"+suffix, "live-"+suffix, "moved-"+suffix
+	staleLock := writeLock(isolation.LegacyLockDir, staleID, deadPID)
+	staleDir := legacyDir(staleID)
+	writeLock(isolation.LegacyLockDir, liveID, os.Getpid())
+	writeLock(lockDir, movedID, deadPID)
+	movedDir := legacyDir(movedID)
+	legacyDir("orphan-" + suffix)
+
+	find := func() map[string]*LegacyEnvironment {
+		legacy, err := FindLegacy(lockDir)
+		require.NoError(t, err)
+		found := make(map[string]*LegacyEnvironment)
+		for _, env := range legacy {
+			found[env.ID] = env
+		}
+		return found
+	}
+
+	t.Run("nothing is legacy under the legacy naming", func(t *testing.T) {
+		t.Setenv(isolation.NamingEnv, string(isolation.NamingLegacy))
+		assert.Empty(t, find())
+	})
+
+	t.Setenv(isolation.NamingEnv, string(isolation.NamingPortalloc))
+
+	t.Run("reconcile recognizes legacy environments", func(t *testing.T) {
+		_, err := mgr.Reconcile(lockDir)
+		require.NoError(t, err)
+		env, err := mgr.GetEnvironment(staleID)
+		require.NoError(t, err)
+		assert.Equal(t, staleLock, env.LockFile)
+		assert.Equal(t, staleDir, env.TempDir)
+	})
+
+	t.Run("finds legacy locks and temp directories", func(t *testing.T) {
+		found := find()
+		assert.Equal(t, &LegacyEnvironment{ID: staleID, LockFile: staleLock, TempDir: staleDir}, found[staleID])
+		assert.True(t, found[liveID].Live)
+		assert.Equal(t, &LegacyEnvironment{ID: movedID, TempDir: movedDir}, found[movedID])
+		assert.NotContains(t, found, "orphan-"+suffix)
+	})
+
+	t.Run("migrates stale environments", func(t *testing.T) {
+		migrated, err := mgr.MigrateLegacy(lockDir)
+		require.NoError(t, err)
+		assert.Len(t, migrated, 2)
+
+		newLock := filepath.Join(lockDir, filepath.Base(staleLock))
+		t.Cleanup(func() { _ = os.Remove(newLock) })
+		assert.FileExists(t, newLock)
+		assert.NoFileExists(t, staleLock)
+		assert.DirExists(t, isolation.TempDirPath(staleID))
+		assert.NoDirExists(t, staleDir)
+		assert.DirExists(t, isolation.TempDirPath(movedID))
+
+		env, err := mgr.GetEnvironment(staleID)
+		require.NoError(t, err)
+		assert.Equal(t, newLock, env.LockFile)
+		assert.Equal(t, isolation.TempDirPath(staleID), env.TempDir)
+
+		found := find()
+		assert.NotContains(t, found, staleID)
+		assert.NotContains(t, found, movedID)
+		assert.Contains(t, found, liveID)
+	})
+}
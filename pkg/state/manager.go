@@ -24,33 +24,116 @@ import (
 	"time"
 
 	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
 )
 
 // Manager handles state file operations with file locking.
 type Manager struct {
+	store     Store
+	storeErr  error
+	degraded  error
 	statePath string
 	mu        sync.Mutex
 }
 
-// NewManager creates a new state manager.
-func NewManager() (*Manager, error) {
+// StateDirEnv overrides the state directory (default: ~/.go-portalloc).
+const StateDirEnv = "PORTALLOC_STATE_DIR"
+
+// StateDir returns the directory holding state.json: $PORTALLOC_STATE_DIR,
+// or ~/.go-portalloc.
+func StateDir() (string, error) {
+	if dir := os.Getenv(StateDirEnv); dir != "" {
+		return dir, nil
+	}
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get home directory: %w", err)
+		return "", fmt.Errorf("failed to get home directory: %w", err)
 	}
+	return filepath.Join(homeDir, ".go-portalloc"), nil
+}
 
-	stateDir := filepath.Join(homeDir, ".go-portalloc")
-	if err := os.MkdirAll(stateDir, 0o755); err != nil {
-		return nil, fmt.Errorf("failed to create state directory: %w", err)
+// NewManager creates a new state manager for the state file in StateDir.
+//
+// When the home directory is missing or unwritable (distroless containers,
+// locked-down CI) and $PORTALLOC_STATE_DIR is unset, the manager degrades
+// to a per-user state directory under os.TempDir(); Degraded reports why.
+// The fallback must be a private directory of the current user (mode 0700,
+// not a symlink). An unusable $PORTALLOC_STATE_DIR is an error.
+func NewManager() (*Manager, error) {
+	stateDir, err := StateDir()
+	if err == nil {
+		err = os.MkdirAll(stateDir, 0o755)
+		if err != nil {
+			err = fmt.Errorf("failed to create state directory: %w", err)
+		}
+	}
+	if err == nil {
+		return &Manager{statePath: filepath.Join(stateDir, "state.json")}, nil
+	}
+	if os.Getenv(StateDirEnv) != "" {
+		return nil, err
 	}
 
-	statePath := filepath.Join(stateDir, "state.json")
-
+	fallback := FallbackStateDir()
+	if fbErr := ensurePrivateDir(fallback); fbErr != nil {
+		return nil, fmt.Errorf("%w; fallback state directory unusable: %w", err, fbErr)
+	}
 	return &Manager{
-		statePath: statePath,
+		statePath: filepath.Join(fallback, "state.json"),
+		degraded:  err,
 	}, nil
 }
 
+// FallbackStateDir is the per-user state directory NewManager degrades to.
+func FallbackStateDir() string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("go-portalloc-state-%d", os.Getuid()))
+}
+
+// ensurePrivateDir creates dir with mode 0700 unless it exists, and checks
+// that it is a directory of the current user that no one else can access.
+// FallbackStateDir is a predictable path in a shared temp directory, so
+// another user could have planted it, or a symlink, with state entries
+// whose temp directories cleanup would remove.
+func ensurePrivateDir(dir string) error {
+	if err := os.Mkdir(dir, 0o700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("%s is a symlink", dir)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is owned by uid %d, not %d", dir, stat.Uid, os.Getuid())
+	}
+	if perm := info.Mode().Perm(); perm != 0o700 {
+		return fmt.Errorf("%s has mode %#o, want 0700", dir, perm)
+	}
+	return nil
+}
+
+// Degraded returns why the manager uses FallbackStateDir instead of the
+// regular state directory, or nil.
+func (m *Manager) Degraded() error {
+	return m.degraded
+}
+
+// Path returns the path of the state file.
+func (m *Manager) Path() string {
+	return m.statePath
+}
+
+// NewManagerAt creates a state manager for the state file at statePath.
+// The parent directory must exist.
+func NewManagerAt(statePath string) *Manager {
+	return &Manager{statePath: statePath}
+}
+
 // lockFile locks the state file for exclusive access.
 func (m *Manager) lockFile(f *os.File) error {
 	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
@@ -79,7 +162,7 @@ func (m *Manager) readState(f *os.File) (*State, error) {
 	var state State
 	decoder := json.NewDecoder(f)
 	if err := decoder.Decode(&state); err != nil {
-		return nil, fmt.Errorf("failed to decode state file: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrCorruptState, err)
 	}
 
 	return &state, nil
@@ -107,59 +190,135 @@ func (m *Manager) writeState(f *os.File, state *State) error {
 	return f.Sync()
 }
 
-// RecordEnvironment records a new environment to the state file.
+// RecordEnvironment records a new environment to the state file and to the
+// sidecar next to its lock file.
 func (m *Manager) RecordEnvironment(env *isolation.Environment) error {
+	_, err := m.record(env, nil)
+	return err
+}
+
+// RecordIdempotent records env like RecordEnvironment unless another
+// environment recorded with env.IdempotencyKey still holds its lock file;
+// that environment is returned instead and env is not recorded. The lookup
+// and the write happen under the state file lock, so of concurrent creates
+// with the same key exactly one is recorded.
+func (m *Manager) RecordIdempotent(env *isolation.Environment) (*EnvironmentState, error) {
+	return m.record(env, func(state *State) *EnvironmentState {
+		return findIdempotent(state.Environments, env.IdempotencyKey, env.ID)
+	})
+}
+
+// findIdempotent returns the most recently created environment other than
+// exceptID that was recorded with key and whose lock file still exists.
+func findIdempotent(envs []*EnvironmentState, key, exceptID string) *EnvironmentState {
+	if key == "" {
+		return nil
+	}
+	var found *EnvironmentState
+	for _, env := range envs {
+		if env.IdempotencyKey != key || env.ID == exceptID {
+			continue
+		}
+		if _, err := os.Stat(env.LockFile); err != nil {
+			continue
+		}
+		if found == nil || env.CreatedAt.After(found.CreatedAt) {
+			found = env
+		}
+	}
+	return found
+}
+
+// record writes env to the state file unless reuse, called under the state
+// file lock, returns an entry to use instead.
+func (m *Manager) record(env *isolation.Environment, reuse func(*State) *EnvironmentState) (*EnvironmentState, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	// Open state file
 	f, err := os.OpenFile(m.statePath, os.O_RDWR|os.O_CREATE, 0o644)
 	if err != nil {
-		return fmt.Errorf("failed to open state file: %w", err)
+		return nil, fmt.Errorf("failed to open state file: %w", err)
 	}
 	defer f.Close()
 
 	// Lock file
 	if err := m.lockFile(f); err != nil {
-		return fmt.Errorf("failed to lock state file: %w", err)
+		return nil, fmt.Errorf("failed to lock state file: %w", err)
 	}
 	defer func() { _ = m.unlockFile(f) }()
 
 	// Read current state
 	state, err := m.readState(f)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if reuse != nil {
+		if found := reuse(state); found != nil {
+			return found, nil
+		}
 	}
 
 	// Add new environment
-	envState := &EnvironmentState{
-		ID:           env.ID,
-		PID:          os.Getpid(),
-		CreatedAt:    time.Now(),
-		WorktreePath: env.WorktreePath,
-		TempDir:      env.TempDir,
-		LockFile:     env.LockFile,
-		EnvFile:      env.EnvFile,
-		Ports: &PortsState{
-			BasePort:  env.Ports.BasePort,
-			Count:     env.Ports.Count,
-			Allocated: env.Ports.Ports(),
-		},
+	envState := NewEnvironmentState(env)
+	if err := m.appendJournal(journalCreate(envState)); err != nil {
+		return nil, err
 	}
 
-	// Check if environment already exists
+	// Update existing or add new
+	replaced := false
 	for i, existing := range state.Environments {
 		if existing.ID == env.ID {
-			// Update existing
 			state.Environments[i] = envState
-			return m.writeState(f, state)
+			replaced = true
+			break
 		}
 	}
+	if !replaced {
+		state.Environments = append(state.Environments, envState)
+	}
 
-	// Add new
-	state.Environments = append(state.Environments, envState)
+	if err := m.writeState(f, state); err != nil {
+		return nil, err
+	}
+	if err := writeSidecar(envState); err != nil {
+		return nil, err
+	}
+	return nil, m.putStore(envState)
+}
 
-	return m.writeState(f, state)
+// NewEnvironmentState builds the state entry for env, owned by the current
+// process and created now.
+func NewEnvironmentState(env *isolation.Environment) *EnvironmentState {
+	pid := os.Getpid()
+	return &EnvironmentState{
+		ID:             env.ID,
+		Name:           env.Name,
+		Project:        env.Project,
+		InstanceID:     env.InstanceID,
+		ComposePrefix:  env.ComposePrefix,
+		Host:           localHost(),
+		PID:            pid,
+		BootID:         isolation.BootID(),
+		StartTime:      isolation.ProcessStartTime(pid),
+		CreatedAt:      time.Now(),
+		WorktreePath:   env.WorktreePath,
+		TempDir:        env.TempDir,
+		LockFile:       env.LockFile,
+		EnvFile:        env.EnvFile,
+		EnvFiles:       env.EnvFiles,
+		GitBranch:      env.GitBranch,
+		GitCommit:      env.GitCommit,
+		Layout:         env.Layout,
+		DockerNetwork:  env.DockerNetwork,
+		Profile:        env.Profile,
+		IdempotencyKey: env.IdempotencyKey,
+		Ports: &PortsState{
+			BasePort:  env.Ports.BasePort,
+			Count:     env.Ports.Count,
+			Allocated: env.Ports.Ports(),
+		},
+	}
 }
 
 // RemoveEnvironment removes an environment from the state file.
@@ -186,6 +345,10 @@ func (m *Manager) RemoveEnvironment(isolationID string) error {
 		return err
 	}
 
+	if err := m.appendJournal(&JournalEntry{Time: time.Now().UTC(), Op: JournalCleanup, ID: isolationID}); err != nil {
+		return err
+	}
+
 	// Remove environment
 	newEnvs := make([]*EnvironmentState, 0, len(state.Environments))
 	for _, env := range state.Environments {
@@ -196,17 +359,99 @@ func (m *Manager) RemoveEnvironment(isolationID string) error {
 
 	state.Environments = newEnvs
 
-	return m.writeState(f, state)
+	if err := m.writeState(f, state); err != nil {
+		return err
+	}
+	if m.store != nil {
+		return m.store.Delete(isolationID)
+	}
+	return nil
+}
+
+// UpdateEnvironment applies update to the recorded environment with the
+// given ID while holding the state file lock.
+func (m *Manager) UpdateEnvironment(isolationID string, update func(*EnvironmentState)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.statePath, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open state file: %w", err)
+	}
+	defer f.Close()
+
+	if err := m.lockFile(f); err != nil {
+		return fmt.Errorf("failed to lock state file: %w", err)
+	}
+	defer func() { _ = m.unlockFile(f) }()
+
+	state, err := m.readState(f)
+	if err != nil {
+		return err
+	}
+
+	for _, env := range state.Environments {
+		if env.ID == isolationID {
+			update(env)
+			if err := m.writeState(f, state); err != nil {
+				return err
+			}
+			if err := writeSidecar(env); err != nil {
+				return err
+			}
+			return m.putStore(env)
+		}
+	}
+
+	return fmt.Errorf("%w: %s", ErrNotFound, isolationID)
 }
 
-// ListEnvironments lists all environments from the state file.
+// ListEnvironments lists all environments from the state file and, when a
+// shared store is set, those of other hosts from the store.
 func (m *Manager) ListEnvironments() ([]*EnvironmentState, error) {
+	state, err := m.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return state.Environments, nil
+}
+
+// Snapshot returns the whole state document. With a shared store, the
+// environments of other hosts are appended from the store. When the store
+// cannot be read, the local state is returned alone and StoreError reports
+// why.
+func (m *Manager) Snapshot() (*State, error) {
+	state, err := m.localSnapshot()
+	if err != nil || m.store == nil {
+		return state, err
+	}
+
+	remote, err := m.remoteEnvironments(state.Environments)
+	m.mu.Lock()
+	m.storeErr = err
+	m.mu.Unlock()
+	if err == nil {
+		state.Environments = append(state.Environments, remote...)
+	}
+	return state, nil
+}
+
+// StoreError returns why the last Snapshot could not read the shared store,
+// or nil.
+func (m *Manager) StoreError() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.storeErr
+}
+
+// localSnapshot reads the state file under a shared lock.
+func (m *Manager) localSnapshot() (*State, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	// Check if state file exists
 	if _, err := os.Stat(m.statePath); os.IsNotExist(err) {
-		return []*EnvironmentState{}, nil
+		return &State{Version: CurrentVersion, Environments: []*EnvironmentState{}}, nil
 	}
 
 	// Open state file
@@ -222,13 +467,55 @@ func (m *Manager) ListEnvironments() ([]*EnvironmentState, error) {
 	}
 	defer func() { _ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN) }()
 
-	// Read state
-	state, err := m.readState(f)
+	return m.readState(f)
+}
+
+// Restore replaces the state file with state, e.g. a downloaded snapshot.
+// The shared store, if any, is not modified.
+func (m *Manager) Restore(state *State) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.statePath, os.O_RDWR|os.O_CREATE, 0o644)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to open state file: %w", err)
 	}
+	defer f.Close()
 
-	return state.Environments, nil
+	if err := m.lockFile(f); err != nil {
+		return fmt.Errorf("failed to lock state file: %w", err)
+	}
+	defer func() { _ = m.unlockFile(f) }()
+
+	if state.Version == "" {
+		state.Version = CurrentVersion
+	}
+	return m.writeState(f, state)
+}
+
+// Quarantine moves the state file aside to <path>.bak, replacing an older
+// backup, so that a corrupt file stops failing every command. The next
+// access starts from an empty state; Reconcile rebuilds it from lock files.
+func (m *Manager) Quarantine() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.statePath, os.O_RDWR, 0o644)
+	if err != nil {
+		return "", fmt.Errorf("failed to open state file: %w", err)
+	}
+	defer f.Close()
+
+	if err := m.lockFile(f); err != nil {
+		return "", fmt.Errorf("failed to lock state file: %w", err)
+	}
+	defer func() { _ = m.unlockFile(f) }()
+
+	backup := m.statePath + ".bak"
+	if err := os.Rename(m.statePath, backup); err != nil {
+		return "", fmt.Errorf("failed to move state file aside: %w", err)
+	}
+	return backup, nil
 }
 
 // GetEnvironment gets a specific environment by ID.
@@ -244,5 +531,154 @@ func (m *Manager) GetEnvironment(isolationID string) (*EnvironmentState, error)
 		}
 	}
 
-	return nil, fmt.Errorf("environment %s not found", isolationID)
+	return nil, fmt.Errorf("%w: %s", ErrNotFound, isolationID)
+}
+
+// FindByName returns the environment with the given name. An active
+// environment is preferred; otherwise the most recently created one wins.
+func (m *Manager) FindByName(name string) (*EnvironmentState, error) {
+	envs, err := m.ListEnvironments()
+	if err != nil {
+		return nil, err
+	}
+
+	var found *EnvironmentState
+	for _, env := range envs {
+		if env.Name != name {
+			continue
+		}
+		if GetEnvironmentStatus(env) == StatusActive {
+			return env, nil
+		}
+		if found == nil || env.CreatedAt.After(found.CreatedAt) {
+			found = env
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: no environment named %s", ErrNotFound, name)
+	}
+	return found, nil
+}
+
+// FindByInstanceID returns the environment created with the given instance
+// ID. An active environment is preferred; otherwise the most recently
+// created one wins.
+func (m *Manager) FindByInstanceID(instanceID string) (*EnvironmentState, error) {
+	envs, err := m.ListEnvironments()
+	if err != nil {
+		return nil, err
+	}
+
+	var found *EnvironmentState
+	for _, env := range envs {
+		if env.InstanceID != instanceID {
+			continue
+		}
+		if GetEnvironmentStatus(env) == StatusActive {
+			return env, nil
+		}
+		if found == nil || env.CreatedAt.After(found.CreatedAt) {
+			found = env
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: no environment for instance %s", ErrNotFound, instanceID)
+	}
+	return found, nil
+}
+
+// FindByIdempotencyKey returns the most recently created environment
+// recorded with key, whatever its status: the process that created it has
+// usually exited by the time a retry looks for it.
+func (m *Manager) FindByIdempotencyKey(key string) (*EnvironmentState, error) {
+	envs, err := m.ListEnvironments()
+	if err != nil {
+		return nil, err
+	}
+
+	var found *EnvironmentState
+	for _, env := range envs {
+		if env.IdempotencyKey == key && (found == nil || env.CreatedAt.After(found.CreatedAt)) {
+			found = env
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: no environment for idempotency key %s", ErrNotFound, key)
+	}
+	return found, nil
+}
+
+// LoadByInstanceID reconstructs the environment FindByInstanceID returns,
+// so a Manager can serve as an isolation.EnvironmentStore.
+func (m *Manager) LoadByInstanceID(instanceID string) (*isolation.Environment, error) {
+	envState, err := m.FindByInstanceID(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	return envState.Environment(), nil
+}
+
+// FindByPort returns the environment whose allocated range contains port.
+// An active environment is preferred; otherwise the most recently created
+// one wins.
+func (m *Manager) FindByPort(port int) (*EnvironmentState, error) {
+	envs, err := m.ListEnvironments()
+	if err != nil {
+		return nil, err
+	}
+
+	var found *EnvironmentState
+	for _, env := range envs {
+		if !env.Ports.Contains(port) {
+			continue
+		}
+		if GetEnvironmentStatus(env) == StatusActive {
+			return env, nil
+		}
+		if found == nil || env.CreatedAt.After(found.CreatedAt) {
+			found = env
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: no environment owns port %d", ErrNotFound, port)
+	}
+	return found, nil
+}
+
+// LoadEnvironment reconstructs the full isolation.Environment recorded in
+// the state file, including its port range.
+func (m *Manager) LoadEnvironment(isolationID string) (*isolation.Environment, error) {
+	envState, err := m.GetEnvironment(isolationID)
+	if err != nil {
+		return nil, err
+	}
+	return envState.Environment(), nil
+}
+
+// Environment converts the recorded state back into an isolation.Environment.
+func (e *EnvironmentState) Environment() *isolation.Environment {
+	env := &isolation.Environment{
+		ID:             e.ID,
+		Name:           e.Name,
+		Project:        e.Project,
+		InstanceID:     e.InstanceID,
+		ComposePrefix:  e.ComposePrefix,
+		WorktreePath:   e.WorktreePath,
+		TempDir:        e.TempDir,
+		LockFile:       e.LockFile,
+		EnvFile:        e.EnvFile,
+		EnvFiles:       e.EnvFiles,
+		GitBranch:      e.GitBranch,
+		GitCommit:      e.GitCommit,
+		Layout:         e.Layout,
+		DockerNetwork:  e.DockerNetwork,
+		Profile:        e.Profile,
+		IdempotencyKey: e.IdempotencyKey,
+		Ports:          &ports.PortRange{},
+	}
+	if e.Ports != nil {
+		env.Ports.BasePort = e.Ports.BasePort
+		env.Ports.Count = e.Ports.Count
+	}
+	return env
 }
@@ -33,6 +33,7 @@ func TestNewManager(t *testing.T) {
 		require.NoError(t, err)
 		require.NotNil(t, mgr)
 		assert.NotEmpty(t, mgr.statePath)
+		assert.NoError(t, mgr.Degraded())
 	})
 
 	t.Run("creates state directory if not exists", func(t *testing.T) {
@@ -50,6 +51,55 @@ func TestNewManager(t *testing.T) {
 		require.NoError(t, err)
 		assert.True(t, info.IsDir())
 	})
+
+	t.Run("degrades to a temp state directory without a home", func(t *testing.T) {
+		t.Setenv("HOME", "")
+		t.Setenv(StateDirEnv, "")
+		t.Setenv("TMPDIR", t.TempDir())
+
+		mgr, err := NewManager()
+		require.NoError(t, err)
+		assert.Error(t, mgr.Degraded())
+		assert.Equal(t, filepath.Join(FallbackStateDir(), "state.json"), mgr.Path())
+		assert.DirExists(t, FallbackStateDir())
+	})
+
+	t.Run("refuses a fallback directory it does not own privately", func(t *testing.T) {
+		t.Setenv("HOME", "")
+		t.Setenv(StateDirEnv, "")
+
+		// A symlink planted in the shared temp directory
+		t.Setenv("TMPDIR", t.TempDir())
+		require.NoError(t, os.Symlink(t.TempDir(), FallbackStateDir()))
+		_, err := NewManager()
+		assert.ErrorContains(t, err, "is a symlink")
+
+		// A directory others can write to
+		t.Setenv("TMPDIR", t.TempDir())
+		require.NoError(t, os.Mkdir(FallbackStateDir(), 0o700))
+		require.NoError(t, os.Chmod(FallbackStateDir(), 0o777))
+		_, err = NewManager()
+		assert.ErrorContains(t, err, "want 0700")
+	})
+
+	t.Run("an unusable PORTALLOC_STATE_DIR is an error", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "file")
+		require.NoError(t, os.WriteFile(file, nil, 0o600))
+		t.Setenv(StateDirEnv, filepath.Join(file, "state"))
+
+		_, err := NewManager()
+		assert.ErrorContains(t, err, "failed to create state directory")
+	})
+
+	t.Run("honors PORTALLOC_STATE_DIR", func(t *testing.T) {
+		stateDir := filepath.Join(t.TempDir(), "state")
+		t.Setenv(StateDirEnv, stateDir)
+
+		mgr, err := NewManager()
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(stateDir, "state.json"), mgr.statePath)
+		assert.DirExists(t, stateDir)
+	})
 }
 
 func TestManager_RecordEnvironment(t *testing.T) {
@@ -257,6 +307,196 @@ func TestManager_GetEnvironment(t *testing.T) {
 	})
 }
 
+func TestManager_FindByName(t *testing.T) {
+	mgr := NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+
+	now := time.Now()
+	require.NoError(t, mgr.Restore(&State{Environments: []*EnvironmentState{
+		{ID: "old-stale", Name: "api", PID: 999999, CreatedAt: now.Add(-2 * time.Hour)},
+		{ID: "new-stale", Name: "api", PID: 999999, CreatedAt: now.Add(-time.Hour)},
+		{ID: "active", Name: "web", PID: os.Getpid(), CreatedAt: now.Add(-3 * time.Hour)},
+		{ID: "stale-web", Name: "web", PID: 999999, CreatedAt: now},
+	}}))
+
+	t.Run("prefers the active environment", func(t *testing.T) {
+		env, err := mgr.FindByName("web")
+		require.NoError(t, err)
+		assert.Equal(t, "active", env.ID)
+	})
+
+	t.Run("falls back to the newest environment", func(t *testing.T) {
+		env, err := mgr.FindByName("api")
+		require.NoError(t, err)
+		assert.Equal(t, "new-stale", env.ID)
+	})
+
+	t.Run("returns error for unknown names", func(t *testing.T) {
+		_, err := mgr.FindByName("missing")
+		assert.ErrorContains(t, err, "not found")
+	})
+}
+
+func TestManager_FindByIdempotencyKey(t *testing.T) {
+	mgr := NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+
+	now := time.Now()
+	require.NoError(t, mgr.Restore(&State{Environments: []*EnvironmentState{
+		{ID: "first", IdempotencyKey: "job-1", PID: 999999, CreatedAt: now.Add(-time.Hour)},
+		{ID: "retry", IdempotencyKey: "job-1", PID: 999999, CreatedAt: now},
+		{ID: "active", PID: os.Getpid(), CreatedAt: now},
+	}}))
+
+	env, err := mgr.FindByIdempotencyKey("job-1")
+	require.NoError(t, err)
+	assert.Equal(t, "retry", env.ID, "stale environments are found too")
+
+	_, err = mgr.FindByIdempotencyKey("job-2")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestManager_RecordIdempotent(t *testing.T) {
+	dir := t.TempDir()
+	mgr := NewManagerAt(filepath.Join(dir, "state.json"))
+
+	newEnv := func(id string) *isolation.Environment {
+		lockFile := filepath.Join(dir, "env-"+id+".lock")
+		require.NoError(t, os.WriteFile(lockFile, nil, 0o600))
+		return &isolation.Environment{
+			ID:             id,
+			LockFile:       lockFile,
+			IdempotencyKey: "job-1",
+			Ports:          &ports.PortRange{BasePort: 20000, Count: 3},
+		}
+	}
+
+	winner, err := mgr.RecordIdempotent(newEnv("first"))
+	require.NoError(t, err)
+	assert.Nil(t, winner)
+
+	recorded, err := mgr.GetEnvironment("first")
+	require.NoError(t, err)
+	assert.Equal(t, "job-1", recorded.IdempotencyKey, "recorded with the entry")
+
+	// A concurrent retry finds the first environment and is not recorded
+	winner, err = mgr.RecordIdempotent(newEnv("second"))
+	require.NoError(t, err)
+	require.NotNil(t, winner)
+	assert.Equal(t, "first", winner.ID)
+	_, err = mgr.GetEnvironment("second")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// Once the first environment's lock is gone, a retry records its own
+	require.NoError(t, os.Remove(recorded.LockFile))
+	winner, err = mgr.RecordIdempotent(newEnv("third"))
+	require.NoError(t, err)
+	assert.Nil(t, winner)
+}
+
+func TestManager_LoadByInstanceID(t *testing.T) {
+	mgr := NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+	var _ isolation.EnvironmentStore = mgr
+
+	now := time.Now()
+	require.NoError(t, mgr.Restore(&State{Environments: []*EnvironmentState{
+		{ID: "old-stale", InstanceID: "job-1", PID: 999999, CreatedAt: now.Add(-time.Hour)},
+		{ID: "new-stale", InstanceID: "job-1", PID: 999999, CreatedAt: now, Ports: &PortsState{BasePort: 20000, Count: 3}},
+		{ID: "other", InstanceID: "job-2", PID: os.Getpid(), CreatedAt: now},
+	}}))
+
+	env, err := mgr.LoadByInstanceID("job-1")
+	require.NoError(t, err)
+	assert.Equal(t, "new-stale", env.ID)
+	assert.Equal(t, "job-1", env.InstanceID)
+	assert.Equal(t, 20000, env.Ports.BasePort)
+
+	_, err = mgr.LoadByInstanceID("job-3")
+	assert.ErrorIs(t, err, isolation.ErrNotFound)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestManager_FindByPort(t *testing.T) {
+	mgr := NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+
+	now := time.Now()
+	require.NoError(t, mgr.Restore(&State{Environments: []*EnvironmentState{
+		{ID: "old-stale", PID: 999999, CreatedAt: now.Add(-2 * time.Hour), Ports: &PortsState{BasePort: 20000, Count: 5}},
+		{ID: "new-stale", PID: 999999, CreatedAt: now.Add(-time.Hour), Ports: &PortsState{BasePort: 20003, Count: 5}},
+		{ID: "active", PID: os.Getpid(), CreatedAt: now.Add(-3 * time.Hour), Ports: &PortsState{BasePort: 21000, Count: 2}},
+		{ID: "stale", PID: 999999, CreatedAt: now, Ports: &PortsState{BasePort: 21001, Count: 2}},
+		{ID: "listed", PID: 999999, CreatedAt: now, Ports: &PortsState{Allocated: []int{22000}}},
+		{ID: "no-ports", PID: 999999, CreatedAt: now},
+	}}))
+
+	for port, want := range map[int]string{
+		20000: "old-stale",
+		20004: "new-stale", // both contain it; the newest wins
+		21001: "active",
+		21002: "stale",
+		22000: "listed",
+	} {
+		env, err := mgr.FindByPort(port)
+		require.NoError(t, err, port)
+		assert.Equal(t, want, env.ID, port)
+	}
+
+	_, err := mgr.FindByPort(20008)
+	assert.ErrorIs(t, err, ErrNotFound, "the range end is exclusive")
+}
+
+func TestManager_LoadEnvironment(t *testing.T) {
+	mgr, err := NewManager()
+	require.NoError(t, err)
+	defer os.Remove(mgr.statePath)
+
+	env := &isolation.Environment{
+		ID:           "test-load",
+		WorktreePath: "/path",
+		TempDir:      "/tmp/test-load",
+		LockFile:     "/tmp/locks/test-load.lock",
+		EnvFile:      "/path/.env",
+		Ports:        &ports.PortRange{BasePort: 20000, Count: 3},
+	}
+	require.NoError(t, mgr.RecordEnvironment(env))
+
+	t.Run("reconstructs full environment", func(t *testing.T) {
+		loaded, err := mgr.LoadEnvironment("test-load")
+		require.NoError(t, err)
+		assert.Equal(t, env, loaded)
+	})
+
+	t.Run("returns error for non-existent environment", func(t *testing.T) {
+		_, err := mgr.LoadEnvironment("non-existent")
+		assert.Error(t, err)
+	})
+}
+
+func TestManager_UpdateEnvironment(t *testing.T) {
+	mgr := &Manager{statePath: filepath.Join(t.TempDir(), "state.json")}
+
+	env := &isolation.Environment{
+		ID:    "test-update",
+		Ports: &ports.PortRange{BasePort: 20000, Count: 2},
+	}
+	require.NoError(t, mgr.RecordEnvironment(env))
+
+	t.Run("applies update", func(t *testing.T) {
+		mappings := []ComposePort{{Service: "api", Published: "8080", Target: "80", Port: 20000}}
+		require.NoError(t, mgr.UpdateEnvironment("test-update", func(e *EnvironmentState) {
+			e.ComposePorts = mappings
+		}))
+
+		recorded, err := mgr.GetEnvironment("test-update")
+		require.NoError(t, err)
+		assert.Equal(t, mappings, recorded.ComposePorts)
+		assert.Equal(t, 20000, recorded.Ports.BasePort)
+	})
+
+	t.Run("returns error for non-existent environment", func(t *testing.T) {
+		err := mgr.UpdateEnvironment("non-existent", func(*EnvironmentState) {})
+		assert.ErrorContains(t, err, "not found")
+	})
+}
+
 func TestManager_ConcurrentAccess(t *testing.T) {
 	mgr, err := NewManager()
 	require.NoError(t, err)
@@ -325,6 +565,24 @@ func TestManager_StateFilePersistence(t *testing.T) {
 	})
 }
 
+func TestManager_Quarantine(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	require.NoError(t, os.WriteFile(statePath, []byte("{not json"), 0o600))
+	mgr := NewManagerAt(statePath)
+
+	_, err := mgr.ListEnvironments()
+	require.ErrorIs(t, err, ErrCorruptState)
+
+	backup, err := mgr.Quarantine()
+	require.NoError(t, err)
+	assert.Equal(t, statePath+".bak", backup)
+	assert.FileExists(t, backup)
+
+	envs, err := mgr.ListEnvironments()
+	require.NoError(t, err)
+	assert.Empty(t, envs)
+}
+
 func TestIsProcessRunning(t *testing.T) {
 	t.Run("returns false for invalid PID", func(t *testing.T) {
 		assert.False(t, IsProcessRunning(0))
@@ -375,4 +633,33 @@ func TestGetEnvironmentStatus(t *testing.T) {
 		status := GetEnvironmentStatus(env)
 		assert.Equal(t, StatusStale, status)
 	})
+
+	t.Run("returns stale for process from another boot", func(t *testing.T) {
+		if isolation.BootID() == "" {
+			t.Skip("boot ID not available")
+		}
+		env := &EnvironmentState{
+			ID:     "test",
+			PID:    os.Getpid(),
+			BootID: "00000000-0000-0000-0000-000000000000",
+		}
+		assert.Equal(t, StatusStale, GetEnvironmentStatus(env))
+	})
+
+	t.Run("returns stale for reused PID", func(t *testing.T) {
+		startTime := isolation.ProcessStartTime(os.Getpid())
+		if startTime == 0 {
+			t.Skip("process start time not available")
+		}
+		env := &EnvironmentState{
+			ID:        "test",
+			PID:       os.Getpid(),
+			BootID:    isolation.BootID(),
+			StartTime: startTime + 1,
+		}
+		assert.Equal(t, StatusStale, GetEnvironmentStatus(env))
+
+		env.StartTime = startTime
+		assert.Equal(t, StatusActive, GetEnvironmentStatus(env))
+	})
 }
@@ -0,0 +1,111 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+)
+
+// OrphanTempDirPrefixes are the temp directory name prefixes go-portalloc
+// creates, besides isolation.TempPrefix(). Directories with these prefixes
+// are candidates for orphan detection.
+var OrphanTempDirPrefixes = []string{isolation.LegacyTempPrefix, isolation.PortallocTempPrefix}
+
+// OrphanedDir is a temp directory with no lock file and no state entry,
+// typically left behind by a crash between creation and cleanup.
+type OrphanedDir struct {
+	ModTime time.Time
+	Path    string
+	ID      string
+}
+
+// FindOrphanedTempDirs scans tempRoot for go-portalloc temp directories that
+// belong to neither a lock file in lockDir nor an environment in the state file.
+func (m *Manager) FindOrphanedTempDirs(tempRoot, lockDir string) ([]*OrphanedDir, error) {
+	entries, err := os.ReadDir(tempRoot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read temp directory: %w", err)
+	}
+
+	envs, err := m.ListEnvironments()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list environments: %w", err)
+	}
+
+	known := make(map[string]bool, len(envs)*2)
+	for _, env := range envs {
+		known[env.ID] = true
+		if env.TempDir != "" {
+			known[filepath.Clean(env.TempDir)] = true
+		}
+	}
+
+	var orphans []*OrphanedDir
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		id, ok := trimOrphanPrefix(entry.Name())
+		if !ok || id == "" {
+			continue
+		}
+
+		path := filepath.Join(tempRoot, entry.Name())
+		if known[id] || known[path] {
+			continue
+		}
+
+		// A lock file means the environment is alive or awaiting reconcile
+		if lockExists(lockDir, id) {
+			continue
+		}
+
+		orphan := &OrphanedDir{Path: path, ID: id}
+		if info, err := entry.Info(); err == nil {
+			orphan.ModTime = info.ModTime()
+		}
+		orphans = append(orphans, orphan)
+	}
+
+	return orphans, nil
+}
+
+func trimOrphanPrefix(name string) (string, bool) {
+	for _, prefix := range append([]string{isolation.TempPrefix()}, OrphanTempDirPrefixes...) {
+		if id, ok := strings.CutPrefix(name, prefix); ok {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// lockExists reports whether the environment with the given ID has a lock
+// file in lockDir or, under the portalloc naming scheme, the legacy lock
+// directory.
+func lockExists(lockDir, id string) bool {
+	for _, dir := range isolation.LockDirs(lockDir) {
+		if _, err := os.Stat(filepath.Join(dir, fmt.Sprintf("env-%s.lock", id))); err == nil {
+			return true
+		}
+	}
+	return false
+}
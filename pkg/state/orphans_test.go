@@ -0,0 +1,69 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManager_FindOrphanedTempDirs(t *testing.T) {
+	mgr := &Manager{statePath: filepath.Join(t.TempDir(), "state.json")}
+	tempRoot := t.TempDir()
+	lockDir := t.TempDir()
+
+	mkdir := func(name string) string {
+		path := filepath.Join(tempRoot, name)
+		require.NoError(t, os.Mkdir(path, 0o755))
+		return path
+	}
+
+	// Tracked in state
+	recorded := mkdir("aigis-test-recorded")
+	require.NoError(t, mgr.RecordEnvironment(&isolation.Environment{
+		ID:       "recorded",
+		TempDir:  recorded,
+		Ports:    &ports.PortRange{BasePort: 20000, Count: 1},
+		LockFile: filepath.Join(lockDir, "env-recorded.lock"),
+	}))
+
+	// Locked but not yet reconciled
+	mkdir("aigis-test-locked")
+	require.NoError(t, os.WriteFile(filepath.Join(lockDir, "env-locked.lock"), []byte("PID=1\n"), 0o600))
+
+	// Unrelated directories and files
+	mkdir("something-else")
+	require.NoError(t, os.WriteFile(filepath.Join(tempRoot, "aigis-test-file"), nil, 0o600))
+
+	// Orphans
+	orphanA := mkdir("aigis-test-leaked")
+	orphanB := mkdir("portalloc-leaked2")
+
+	orphans, err := mgr.FindOrphanedTempDirs(tempRoot, lockDir)
+	require.NoError(t, err)
+
+	var paths []string
+	for _, o := range orphans {
+		paths = append(paths, o.Path)
+		assert.False(t, o.ModTime.IsZero())
+	}
+	assert.ElementsMatch(t, []string{orphanA, orphanB}, paths)
+}
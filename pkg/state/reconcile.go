@@ -23,26 +23,104 @@ import (
 	"strings"
 	"syscall"
 	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
 )
 
-// Reconcile rebuilds the state file from lock files.
+// Reconcile brings the state file in line with the lock files. Under the
+// portalloc naming scheme, locks in isolation.LegacyLockDir are included
+// too.
+//
+// The merge is incremental: entries whose lock still exists are kept as
+// recorded, with only missing fields filled in from the lock, since create
+// records more than a lock file holds (named ports, instance IDs, ...).
+// Entries without a lock are dropped, and locks without an entry are added
+// from the sidecar next to the lock (see isolation.SidecarPath), which
+// holds the full entry, or else with the env file paths and ports replayed
+// from the journal. Lock files are scanned while the state file is locked, so
+// environments recorded concurrently are never lost.
 func (m *Manager) Reconcile(lockDir string) (int, error) {
+	count, _, err := m.reconcile(lockDir, false, nil)
+	return count, err
+}
+
+// ReconcileFull rebuilds the state file from lock files, replacing every
+// entry. Only paths that cannot be derived from a lock file (env files,
+// git info) are carried over from the existing state when present; a
+// lock without a state entry is recovered from its sidecar, or else
+// replayed from the journal, which also supplies the ports of
+// environments whose env file was deleted.
+func (m *Manager) ReconcileFull(lockDir string) (int, error) {
+	count, _, err := m.reconcile(lockDir, true, nil)
+	return count, err
+}
+
+// ReconcilePruneDead reconciles the state file like Reconcile, but drops
+// entries whose owning process is dead and whose lock is older than
+// olderThan (zero prunes dead entries of any age), removing their lock
+// files. It returns the number of entries kept and the pruned entries, so
+// the caller can remove their temp directories and env files.
+func (m *Manager) ReconcilePruneDead(lockDir string, olderThan time.Duration) (int, []*EnvironmentState, error) {
+	now := time.Now()
+	return m.reconcile(lockDir, false, func(env *EnvironmentState) bool {
+		return GetEnvironmentStatus(env) == StatusStale && now.Sub(env.CreatedAt) > olderThan
+	})
+}
+
+// reconcile rebuilds the state file from lock files, merging with the
+// recorded entries unless full is set. Entries for which prune returns
+// true are left out and their lock files removed.
+func (m *Manager) reconcile(lockDir string, full bool, prune func(*EnvironmentState) bool) (int, []*EnvironmentState, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// Scan lock files
-	lockFiles, err := filepath.Glob(filepath.Join(lockDir, "env-*.lock"))
+	f, err := os.OpenFile(m.statePath, os.O_RDWR|os.O_CREATE, 0o644)
 	if err != nil {
-		return 0, fmt.Errorf("failed to scan lock files: %w", err)
+		return 0, nil, fmt.Errorf("failed to open state file: %w", err)
+	}
+	defer f.Close()
+
+	if err := m.lockFile(f); err != nil {
+		return 0, nil, fmt.Errorf("failed to lock state file: %w", err)
+	}
+	defer func() { _ = m.unlockFile(f) }()
+
+	// Locks are scanned under the state lock, so an environment recorded
+	// meanwhile has its lock in the scan
+	var lockFiles []string
+	for _, dir := range isolation.LockDirs(lockDir) {
+		matches, err := filepath.Glob(filepath.Join(dir, "env-*.lock"))
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to scan lock files: %w", err)
+		}
+		lockFiles = append(lockFiles, matches...)
+	}
+
+	// Existing entries; a corrupted state file is simply replaced
+	recorded := make(map[string]*EnvironmentState)
+	var cleaned []*EnvironmentState
+	if oldState, err := m.readState(f); err == nil {
+		for _, env := range oldState.Environments {
+			recorded[env.ID] = env
+		}
+		cleaned = oldState.Cleaned
 	}
 
 	// Build new state
 	newState := &State{
 		Version:          CurrentVersion,
 		Environments:     make([]*EnvironmentState, 0, len(lockFiles)),
+		Cleaned:          cleaned,
 		LastReconciledAt: time.Now(),
 	}
 
+	// The journal outlives a lost or corrupted state file
+	journal, err := m.Journal()
+	if err != nil {
+		journal = map[string]*JournalEntry{}
+	}
+
+	var pruned []*EnvironmentState
 	for _, lockFile := range lockFiles {
 		envState, err := m.parseLockFile(lockFile)
 		if err != nil {
@@ -50,26 +128,108 @@ func (m *Manager) Reconcile(lockDir string) (int, error) {
 			continue
 		}
 
+		entry, journaled := journal[envState.ID]
+		prev, ok := recorded[envState.ID]
+		sidecar := readSidecar(lockFile, envState.ID)
+		switch {
+		case ok && !full:
+			envState = keepRecorded(prev, envState)
+		case ok:
+			m.mergeRecorded(envState, prev)
+		case sidecar != nil:
+			envState = keepRecorded(sidecar, envState)
+		case journaled:
+			m.mergeRecorded(envState, entry.environment())
+		}
+
+		// Ports come from the lock, else the env file, the recorded entry,
+		// or the journal
+		if envState.Ports.empty() && envState.EnvFile != "" {
+			envState.Ports = m.parseEnvFile(envState.EnvFile)
+		}
+		if envState.Ports.empty() && ok && prev.Ports != nil {
+			envState.Ports = prev.Ports
+		}
+		if envState.Ports.empty() && journaled && entry.Ports != nil {
+			envState.Ports = entry.Ports
+		}
+
+		// An entry whose lock cannot be removed is kept
+		if prune != nil && prune(envState) {
+			if err := os.Remove(lockFile); err == nil || os.IsNotExist(err) {
+				_ = os.Remove(isolation.SidecarPath(lockFile))
+				pruned = append(pruned, envState)
+				continue
+			}
+		}
+
+		// Environments from before sidecars existed get one
+		if sidecar == nil {
+			_ = writeSidecar(envState)
+		}
 		newState.Environments = append(newState.Environments, envState)
 	}
 
-	// Write new state
-	f, err := os.OpenFile(m.statePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
-	if err != nil {
-		return 0, fmt.Errorf("failed to open state file: %w", err)
+	if err := m.writeState(f, newState); err != nil {
+		return 0, nil, err
 	}
-	defer f.Close()
-
-	if err := m.lockFile(f); err != nil {
-		return 0, fmt.Errorf("failed to lock state file: %w", err)
+	if err := m.compactJournal(newState.Environments); err != nil {
+		return 0, nil, err
+	}
+	if err := m.syncStore(newState.Environments); err != nil {
+		return 0, nil, err
 	}
-	defer func() { _ = m.unlockFile(f) }()
 
-	if err := m.writeState(f, newState); err != nil {
-		return 0, err
+	return len(newState.Environments), pruned, nil
+}
+
+// mergeRecorded copies fields that lock files cannot provide from a
+// previously recorded entry.
+func (m *Manager) mergeRecorded(envState, prev *EnvironmentState) {
+	// An empty recorded path means the environment has no env file
+	envState.EnvFile = prev.EnvFile
+	envState.EnvFiles = prev.EnvFiles
+	envState.GitBranch = prev.GitBranch
+	envState.GitCommit = prev.GitCommit
+	envState.Layout = prev.Layout
+	envState.DockerNetwork = prev.DockerNetwork
+	envState.Profile = prev.Profile
+	envState.ComposePorts = prev.ComposePorts
+	envState.ComposePrefix = prev.ComposePrefix
+	envState.LastUsedAt = prev.LastUsedAt
+	envState.StaleNotifiedAt = prev.StaleNotifiedAt
+	envState.IdempotencyKey = prev.IdempotencyKey
+	envState.InstanceID = prev.InstanceID
+	if envState.Project == "" {
+		envState.Project = prev.Project
 	}
+}
 
-	return len(newState.Environments), nil
+// keepRecorded returns the recorded entry prev, with the lock file and temp
+// directory located on disk and fields it lacks filled in from locked, the
+// entry parsed from the lock.
+func keepRecorded(prev, locked *EnvironmentState) *EnvironmentState {
+	prev.LockFile, prev.TempDir = locked.LockFile, locked.TempDir
+	fill := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+	fill(&prev.Name, locked.Name)
+	fill(&prev.Project, locked.Project)
+	fill(&prev.Host, locked.Host)
+	fill(&prev.BootID, locked.BootID)
+	fill(&prev.WorktreePath, locked.WorktreePath)
+	if prev.PID == 0 {
+		prev.PID, prev.StartTime = locked.PID, locked.StartTime
+	}
+	if prev.CreatedAt.IsZero() {
+		prev.CreatedAt = locked.CreatedAt
+	}
+	if prev.Ports == nil || prev.Ports.Count == 0 {
+		prev.Ports = locked.Ports
+	}
+	return prev
 }
 
 // parseLockFile parses a lock file and returns an EnvironmentState.
@@ -81,43 +241,38 @@ func (m *Manager) parseLockFile(lockFile string) (*EnvironmentState, error) {
 	}
 	isolationID := base[4 : len(base)-5] // Remove "env-" prefix and ".lock" suffix
 
-	// Read lock file metadata
-	f, err := os.Open(lockFile)
+	info, err := isolation.ReadLockInfo(lockFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open lock file: %w", err)
+		return nil, err
 	}
-	defer f.Close()
+	worktree := info.Worktree
 
-	metadata := make(map[string]string)
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) == 2 {
-			metadata[parts[0]] = parts[1]
-		}
-	}
+	// Reconstruct paths
+	tmpDir := isolation.FindTempDir(isolationID)
+	envFile := isolation.FindEnvFile(worktree, isolationID)
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("failed to read lock file: %w", err)
+	// Locks written by older versions have no ports; reconcile then falls
+	// back to the env file
+	ports := &PortsState{}
+	if info.BasePort > 0 && info.PortCount > 0 {
+		ports = rangePorts(info.BasePort, info.PortCount)
 	}
 
-	// Parse metadata
-	pid, _ := strconv.Atoi(metadata["PID"])
-	timestamp, _ := strconv.ParseInt(metadata["Timestamp"], 10, 64)
-	worktree := metadata["Worktree"]
-
-	// Reconstruct paths
-	tmpDir := filepath.Join(os.TempDir(), fmt.Sprintf("aigis-test-%s", isolationID))
-	envFile := filepath.Join(worktree, ".env.isolation")
-
-	// Try to read port information from env file
-	ports := m.parseEnvFile(envFile)
+	// Locks in a shared lock directory may belong to another machine
+	host := info.Host
+	if host == "" {
+		host = localHost()
+	}
 
 	return &EnvironmentState{
 		ID:           isolationID,
-		PID:          pid,
-		CreatedAt:    time.Unix(timestamp, 0),
+		Name:         info.Name,
+		Project:      info.Project,
+		Host:         host,
+		PID:          info.PID,
+		BootID:       info.BootID,
+		StartTime:    info.StartTime,
+		CreatedAt:    info.CreatedAt,
 		WorktreePath: worktree,
 		TempDir:      tmpDir,
 		LockFile:     lockFile,
@@ -154,14 +309,21 @@ func (m *Manager) parseEnvFile(envFile string) *PortsState {
 
 	// Reconstruct allocated ports
 	if ports.BasePort > 0 && ports.Count > 0 {
-		for i := 0; i < ports.Count; i++ {
-			ports.Allocated = append(ports.Allocated, ports.BasePort+i)
-		}
+		return rangePorts(ports.BasePort, ports.Count)
 	}
 
 	return ports
 }
 
+// rangePorts returns the state of count consecutive ports from basePort.
+func rangePorts(basePort, count int) *PortsState {
+	ports := &PortsState{BasePort: basePort, Count: count, Allocated: make([]int, 0, count)}
+	for i := 0; i < count; i++ {
+		ports.Allocated = append(ports.Allocated, basePort+i)
+	}
+	return ports
+}
+
 // IsProcessRunning checks if a process is running.
 func IsProcessRunning(pid int) bool {
 	if pid <= 0 {
@@ -180,8 +342,20 @@ func IsProcessRunning(pid int) bool {
 }
 
 // GetEnvironmentStatus returns the status of an environment.
+//
+// The recorded boot ID and process start time are compared along with the
+// PID, so environments from a previous boot or a reused PID are stale.
+//
+// Environments owned by another host cannot be checked and are reported as
+// active; their shared store entries expire on their own (see EtcdStore).
 func GetEnvironmentStatus(env *EnvironmentState) EnvironmentStatus {
-	if IsProcessRunning(env.PID) {
+	if env.Host != "" && env.Host != localHost() {
+		if env.HostExpired {
+			return StatusStale
+		}
+		return StatusActive
+	}
+	if isolation.ProcessAlive(env.PID, env.BootID, env.StartTime) {
 		return StatusActive
 	}
 	return StatusStale
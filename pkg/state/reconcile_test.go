@@ -19,9 +19,12 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -108,6 +111,40 @@ func TestManager_Reconcile(t *testing.T) {
 		assert.Len(t, envs, 2)
 	})
 
+	t.Run("preserves recorded env file paths", func(t *testing.T) {
+		worktree := t.TempDir()
+		lockFile := filepath.Join(lockDir, "env-custom.lock")
+		content := fmt.Sprintf("PID=%d\nTimestamp=%d\nWorktree=%s\n", os.Getpid(), time.Now().Unix(), worktree)
+		require.NoError(t, os.WriteFile(lockFile, []byte(content), 0o600))
+		defer os.Remove(lockFile)
+
+		envFile := filepath.Join(worktree, "services", "api", ".env.test")
+		require.NoError(t, os.MkdirAll(filepath.Dir(envFile), 0o750))
+		require.NoError(t, os.WriteFile(envFile, []byte("PORT_BASE=21000\nPORT_COUNT=2\n"), 0o644))
+
+		env := &isolation.Environment{
+			ID:           "custom",
+			WorktreePath: worktree,
+			LockFile:     lockFile,
+			EnvFile:      envFile,
+			EnvFiles:     []string{envFile},
+			GitBranch:    "main",
+			Ports:        &ports.PortRange{BasePort: 21000, Count: 2},
+		}
+		require.NoError(t, mgr.RecordEnvironment(env))
+
+		_, err := mgr.Reconcile(lockDir)
+		require.NoError(t, err)
+
+		reconciled, err := mgr.GetEnvironment("custom")
+		require.NoError(t, err)
+		assert.Equal(t, envFile, reconciled.EnvFile)
+		assert.Equal(t, []string{envFile}, reconciled.EnvFiles)
+		assert.Equal(t, "main", reconciled.GitBranch)
+		assert.Equal(t, 21000, reconciled.Ports.BasePort)
+		assert.Equal(t, 2, reconciled.Ports.Count)
+	})
+
 	t.Run("handles invalid lock files gracefully", func(t *testing.T) {
 		// Create invalid lock file
 		invalidLock := filepath.Join(lockDir, "env-invalid.lock")
@@ -139,6 +176,183 @@ func TestManager_Reconcile(t *testing.T) {
 	})
 }
 
+func TestManager_ReconcileIncremental(t *testing.T) {
+	lockDir := t.TempDir()
+	worktree := t.TempDir()
+	writeLock := func(id string) string {
+		lockFile := filepath.Join(lockDir, fmt.Sprintf("env-%s.lock", id))
+		content := fmt.Sprintf("PID=%d\nTimestamp=%d\nWorktree=%s\n", os.Getpid(), time.Now().Unix(), worktree)
+		require.NoError(t, os.WriteFile(lockFile, []byte(content), 0o600))
+		return lockFile
+	}
+	record := func(mgr *Manager, id string) {
+		require.NoError(t, mgr.RecordEnvironment(&isolation.Environment{
+			ID:           id,
+			Name:         "named-" + id,
+			InstanceID:   "job-" + id,
+			WorktreePath: worktree,
+			LockFile:     writeLock(id),
+			Profile:      &isolation.Profile{Name: "db", Ports: []string{"DB_PORT"}},
+			Ports:        &ports.PortRange{BasePort: 21000, Count: 1},
+		}))
+	}
+
+	t.Run("keeps recorded entries whose lock exists", func(t *testing.T) {
+		mgr := NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+		record(mgr, "kept")
+		record(mgr, "gone")
+		require.NoError(t, os.Remove(filepath.Join(lockDir, "env-gone.lock")))
+		writeLock("unrecorded")
+		defer os.Remove(filepath.Join(lockDir, "env-unrecorded.lock"))
+
+		count, err := mgr.Reconcile(lockDir)
+		require.NoError(t, err)
+		assert.Equal(t, 2, count)
+
+		kept, err := mgr.GetEnvironment("kept")
+		require.NoError(t, err)
+		assert.Equal(t, "named-kept", kept.Name)
+		assert.Equal(t, "job-kept", kept.InstanceID)
+		require.NotNil(t, kept.Profile)
+		assert.Equal(t, []string{"DB_PORT"}, kept.Profile.Ports)
+		assert.Equal(t, 21000, kept.Ports.BasePort)
+
+		_, err = mgr.GetEnvironment("gone")
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = mgr.GetEnvironment("unrecorded")
+		assert.NoError(t, err)
+	})
+
+	t.Run("full rebuilds entries from their locks", func(t *testing.T) {
+		mgr := NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+		record(mgr, "rebuilt")
+		defer os.Remove(filepath.Join(lockDir, "env-rebuilt.lock"))
+
+		count, err := mgr.ReconcileFull(lockDir)
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, count, 1)
+
+		rebuilt, err := mgr.GetEnvironment("rebuilt")
+		require.NoError(t, err)
+		assert.Empty(t, rebuilt.Name, "the lock file has no name")
+		assert.Equal(t, "job-rebuilt", rebuilt.InstanceID, "instance IDs are carried over")
+		require.NotNil(t, rebuilt.Profile, "profiles are carried over")
+	})
+
+	t.Run("does not lose environments recorded concurrently", func(t *testing.T) {
+		dir := t.TempDir()
+		mgr := NewManagerAt(filepath.Join(dir, "state.json"))
+		other := NewManagerAt(filepath.Join(dir, "state.json"))
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := range 20 {
+				record(other, fmt.Sprintf("race%d", i))
+			}
+		}()
+		for {
+			_, err := mgr.Reconcile(lockDir)
+			require.NoError(t, err)
+			select {
+			case <-done:
+				envs, err := mgr.ListEnvironments()
+				require.NoError(t, err)
+				named := 0
+				for _, env := range envs {
+					if strings.HasPrefix(env.ID, "race") {
+						assert.Equal(t, "named-"+env.ID, env.Name)
+						named++
+					}
+				}
+				assert.Equal(t, 20, named)
+				return
+			default:
+			}
+		}
+	})
+}
+
+func TestManager_ReconcilePortsFromLock(t *testing.T) {
+	lockDir := t.TempDir()
+	worktree := t.TempDir()
+	lockFile := filepath.Join(lockDir, "env-portsinlock.lock")
+	content := fmt.Sprintf("PID=%d\nTimestamp=%d\nWorktree=%s\nBasePort=24000\nPortCount=3\n", os.Getpid(), time.Now().Unix(), worktree)
+	require.NoError(t, os.WriteFile(lockFile, []byte(content), 0o600))
+
+	// A stale env file disagrees with the lock, which wins
+	envFile := filepath.Join(worktree, isolation.DefaultEnvFileName)
+	require.NoError(t, os.WriteFile(envFile, []byte("PORT_BASE=21000\nPORT_COUNT=5\n"), 0o644))
+
+	for _, full := range []bool{false, true} {
+		// Neither a state file nor a journal survived
+		mgr := NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+		var err error
+		if full {
+			_, err = mgr.ReconcileFull(lockDir)
+		} else {
+			_, err = mgr.Reconcile(lockDir)
+		}
+		require.NoError(t, err)
+
+		env, err := mgr.GetEnvironment("portsinlock")
+		require.NoError(t, err)
+		assert.Equal(t, &PortsState{BasePort: 24000, Count: 3, Allocated: []int{24000, 24001, 24002}}, env.Ports, "full=%v", full)
+
+		require.NoError(t, os.Remove(envFile))
+		_, err = mgr.Reconcile(lockDir)
+		require.NoError(t, err)
+		env, err = mgr.GetEnvironment("portsinlock")
+		require.NoError(t, err)
+		assert.Equal(t, 24000, env.Ports.BasePort, "the env file is not needed")
+		require.NoError(t, os.WriteFile(envFile, []byte("PORT_BASE=21000\nPORT_COUNT=5\n"), 0o644))
+	}
+}
+
+func TestManager_ReconcilePruneDead(t *testing.T) {
+	mgr := NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+	lockDir := t.TempDir()
+	worktree := t.TempDir()
+
+	writeLock := func(id string, pid int, created time.Time) string {
+		lockFile := filepath.Join(lockDir, fmt.Sprintf("env-%s.lock", id))
+		content := fmt.Sprintf("PID=%d\nTimestamp=%d\nWorktree=%s\n", pid, created.Unix(), worktree)
+		require.NoError(t, os.WriteFile(lockFile, []byte(content), 0o600))
+		return lockFile
+	}
+
+	const deadPID = 999999
+	aliveLock := writeLock("alive", os.Getpid(), time.Now().Add(-48*time.Hour))
+	oldDeadLock := writeLock("old-dead", deadPID, time.Now().Add(-48*time.Hour))
+	newDeadLock := writeLock("new-dead", deadPID, time.Now())
+
+	count, pruned, err := mgr.ReconcilePruneDead(lockDir, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	require.Len(t, pruned, 1)
+	assert.Equal(t, "old-dead", pruned[0].ID)
+
+	assert.NoFileExists(t, oldDeadLock)
+	assert.FileExists(t, aliveLock)
+	assert.FileExists(t, newDeadLock)
+
+	envs, err := mgr.ListEnvironments()
+	require.NoError(t, err)
+	var ids []string
+	for _, env := range envs {
+		ids = append(ids, env.ID)
+	}
+	assert.ElementsMatch(t, []string{"alive", "new-dead"}, ids)
+
+	// Without a threshold, every dead entry is pruned
+	count, pruned, err = mgr.ReconcilePruneDead(lockDir, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	require.Len(t, pruned, 1)
+	assert.Equal(t, "new-dead", pruned[0].ID)
+	assert.NoFileExists(t, newDeadLock)
+}
+
 func TestManager_parseLockFile(t *testing.T) {
 	mgr, err := NewManager()
 	require.NoError(t, err)
@@ -169,6 +383,34 @@ func TestManager_parseLockFile(t *testing.T) {
 		assert.NotEmpty(t, envState.LockFile)
 	})
 
+	t.Run("parses process identity", func(t *testing.T) {
+		lockFile := filepath.Join(lockDir, "env-identity.lock")
+		content := fmt.Sprintf("PID=%d\nTimestamp=%d\nWorktree=%s\nBootID=boot-1\nStartTime=4242\n",
+			12345,
+			time.Now().Unix(),
+			worktree)
+		require.NoError(t, os.WriteFile(lockFile, []byte(content), 0o600))
+
+		envState, err := mgr.parseLockFile(lockFile)
+		require.NoError(t, err)
+		assert.Equal(t, "boot-1", envState.BootID)
+		assert.Equal(t, uint64(4242), envState.StartTime)
+	})
+
+	t.Run("keeps the host of locks from a shared lock directory", func(t *testing.T) {
+		lockFile := filepath.Join(lockDir, "env-remote.lock")
+		content := fmt.Sprintf("PID=%d\nTimestamp=%d\nWorktree=%s\nHost=ci-other-host\n",
+			999999,
+			time.Now().Add(-48*time.Hour).Unix(),
+			worktree)
+		require.NoError(t, os.WriteFile(lockFile, []byte(content), 0o600))
+
+		envState, err := mgr.parseLockFile(lockFile)
+		require.NoError(t, err)
+		assert.Equal(t, "ci-other-host", envState.Host)
+		assert.Equal(t, StatusActive, GetEnvironmentStatus(envState), "another host's process cannot be checked")
+	})
+
 	t.Run("returns error for invalid lock file name", func(t *testing.T) {
 		invalidLock := filepath.Join(lockDir, "invalid.lock")
 		err := os.WriteFile(invalidLock, []byte("content"), 0o600)
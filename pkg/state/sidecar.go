@@ -0,0 +1,74 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+)
+
+// writeSidecar writes env as JSON next to its lock file (see
+// isolation.SidecarPath), replacing the previous one atomically, so the
+// lock directory alone is enough to recover the full entry. Environments
+// whose lock file does not exist get no sidecar.
+func writeSidecar(env *EnvironmentState) error {
+	if env.LockFile == "" {
+		return nil
+	}
+	if _, err := os.Stat(env.LockFile); os.IsNotExist(err) {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(env, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode lock sidecar: %w", err)
+	}
+	path := isolation.SidecarPath(env.LockFile)
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to write lock sidecar: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write lock sidecar: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write lock sidecar: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write lock sidecar: %w", err)
+	}
+	return nil
+}
+
+// readSidecar returns the entry recorded next to lockFile for id, or nil
+// if there is none or it cannot be decoded.
+func readSidecar(lockFile, id string) *EnvironmentState {
+	// #nosec G304 - the sidecar of a lock file in the configured lock directory
+	data, err := os.ReadFile(isolation.SidecarPath(lockFile))
+	if err != nil {
+		return nil
+	}
+	var env EnvironmentState
+	if err := json.Unmarshal(data, &env); err != nil || env.ID != id {
+		return nil
+	}
+	return &env
+}
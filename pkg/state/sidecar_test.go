@@ -0,0 +1,112 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSidecar(t *testing.T) {
+	lockDir := t.TempDir()
+	worktree := t.TempDir()
+	lockFile := filepath.Join(lockDir, "env-side.lock")
+	content := fmt.Sprintf("PID=%d\nTimestamp=%d\nWorktree=%s\n", os.Getpid(), time.Now().Unix(), worktree)
+	require.NoError(t, os.WriteFile(lockFile, []byte(content), 0o600))
+
+	mgr := NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+	require.NoError(t, mgr.RecordEnvironment(&isolation.Environment{
+		ID:           "side",
+		Name:         "sidecar",
+		InstanceID:   "job-9",
+		WorktreePath: worktree,
+		LockFile:     lockFile,
+		Profile:      &isolation.Profile{Name: "db", Ports: []string{"DB_PORT"}},
+		Ports:        &ports.PortRange{BasePort: 25000, Count: 2},
+	}))
+
+	t.Run("records the full entry next to the lock", func(t *testing.T) {
+		sidecar := readSidecar(lockFile, "side")
+		require.NotNil(t, sidecar)
+		assert.Equal(t, "sidecar", sidecar.Name)
+		assert.Equal(t, "job-9", sidecar.InstanceID)
+		assert.Equal(t, 25000, sidecar.Ports.BasePort)
+
+		assert.Nil(t, readSidecar(lockFile, "other"), "a sidecar for another ID is ignored")
+		info, err := os.Stat(isolation.SidecarPath(lockFile))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	})
+
+	t.Run("follows updates", func(t *testing.T) {
+		used := time.Now().Truncate(time.Second)
+		require.NoError(t, mgr.MarkUsed("side", used))
+		sidecar := readSidecar(lockFile, "side")
+		require.NotNil(t, sidecar)
+		assert.True(t, used.Equal(sidecar.LastUsedAt))
+	})
+
+	t.Run("recovers the entry without state or journal", func(t *testing.T) {
+		for _, full := range []bool{false, true} {
+			lost := NewManagerAt(filepath.Join(t.TempDir(), "state.json"))
+			var err error
+			if full {
+				_, err = lost.ReconcileFull(lockDir)
+			} else {
+				_, err = lost.Reconcile(lockDir)
+			}
+			require.NoError(t, err)
+
+			env, err := lost.GetEnvironment("side")
+			require.NoError(t, err)
+			assert.Equal(t, "sidecar", env.Name, "full=%v", full)
+			assert.Equal(t, "job-9", env.InstanceID)
+			require.NotNil(t, env.Profile)
+			assert.Equal(t, []string{"DB_PORT"}, env.Profile.Ports)
+			assert.Equal(t, 25000, env.Ports.BasePort)
+			assert.Equal(t, lockFile, env.LockFile)
+		}
+	})
+
+	t.Run("is backfilled by reconcile and removed with pruned locks", func(t *testing.T) {
+		oldLock := filepath.Join(lockDir, "env-old.lock")
+		content := fmt.Sprintf("PID=%d\nTimestamp=%d\nWorktree=%s\n", 999999, time.Now().Add(-time.Hour).Unix(), worktree)
+		require.NoError(t, os.WriteFile(oldLock, []byte(content), 0o600))
+
+		_, err := mgr.Reconcile(lockDir)
+		require.NoError(t, err)
+		assert.NotNil(t, readSidecar(oldLock, "old"))
+
+		_, pruned, err := mgr.ReconcilePruneDead(lockDir, 0)
+		require.NoError(t, err)
+		require.Len(t, pruned, 1)
+		assert.NoFileExists(t, isolation.SidecarPath(oldLock))
+		assert.FileExists(t, isolation.SidecarPath(lockFile))
+	})
+
+	t.Run("is skipped without a lock file", func(t *testing.T) {
+		missing := filepath.Join(t.TempDir(), "env-none.lock")
+		require.NoError(t, writeSidecar(&EnvironmentState{ID: "none", LockFile: missing}))
+		assert.NoFileExists(t, isolation.SidecarPath(missing))
+	})
+}
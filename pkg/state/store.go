@@ -0,0 +1,141 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package state
+
+import (
+	"fmt"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+)
+
+// Store is a shared environment registry, such as EtcdStore. A Manager with
+// a store mirrors every write of the local state file to it and lists the
+// other hosts' environments from it alongside its own, so a fleet of hosts
+// shares one registry and `list` or `cleanup --stale` work from any of them.
+type Store interface {
+	// Put creates or replaces the entry for env.ID.
+	Put(env *EnvironmentState) error
+	// Delete removes the entry for isolationID if present.
+	Delete(isolationID string) error
+	// List returns all entries.
+	List() ([]*EnvironmentState, error)
+}
+
+// HostStore is a Store that also tracks which hosts are alive. Without it,
+// environments of other hosts are always considered active.
+type HostStore interface {
+	// Heartbeat marks host as alive.
+	Heartbeat(host string) error
+	// LiveHosts returns the hosts whose heartbeat has not expired.
+	LiveHosts() (map[string]bool, error)
+}
+
+// SetStore mirrors the state file to store. A nil store restores local-only
+// operation.
+func (m *Manager) SetStore(store Store) {
+	m.store = store
+}
+
+func (m *Manager) putStore(env *EnvironmentState) error {
+	if m.store == nil {
+		return nil
+	}
+	if err := m.heartbeat(); err != nil {
+		return err
+	}
+	return m.store.Put(env)
+}
+
+// heartbeat marks this host as alive in a HostStore.
+func (m *Manager) heartbeat() error {
+	hosts, ok := m.store.(HostStore)
+	if !ok {
+		return nil
+	}
+	return hosts.Heartbeat(localHost())
+}
+
+// remoteEnvironments returns the store's entries of other hosts, skipping
+// IDs in local. Entries of hosts whose heartbeat expired are marked with
+// HostExpired.
+func (m *Manager) remoteEnvironments(local []*EnvironmentState) ([]*EnvironmentState, error) {
+	entries, err := m.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var live map[string]bool
+	if hosts, ok := m.store.(HostStore); ok {
+		if live, err = hosts.LiveHosts(); err != nil {
+			return nil, err
+		}
+	}
+
+	known := make(map[string]bool, len(local))
+	for _, env := range local {
+		known[env.ID] = true
+	}
+	host := localHost()
+	var remote []*EnvironmentState
+	for _, env := range entries {
+		// The local state file is authoritative for this host
+		if known[env.ID] || env.Host == host {
+			continue
+		}
+		env.HostExpired = live != nil && env.Host != "" && !live[env.Host]
+		remote = append(remote, env)
+	}
+	return remote, nil
+}
+
+// syncStore makes the store's entries for this host match envs, the local
+// state after a reconcile.
+func (m *Manager) syncStore(envs []*EnvironmentState) error {
+	if m.store == nil {
+		return nil
+	}
+
+	if err := m.heartbeat(); err != nil {
+		return err
+	}
+	remote, err := m.store.List()
+	if err != nil {
+		return err
+	}
+
+	local := make(map[string]bool, len(envs))
+	for _, env := range envs {
+		local[env.ID] = true
+		if err := m.store.Put(env); err != nil {
+			return err
+		}
+	}
+
+	host := localHost()
+	for _, env := range remote {
+		if env.Host == host && !local[env.ID] {
+			if err := m.store.Delete(env.ID); err != nil {
+				return fmt.Errorf("failed to remove stale store entry: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// localHost returns this machine's hostname (see isolation.Hostname), or
+// "" if it is unknown.
+func localHost() string {
+	return isolation.Hostname()
+}
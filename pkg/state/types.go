@@ -15,13 +15,21 @@
 // Package state provides state management for go-portalloc environments.
 package state
 
-import "time"
+import (
+	"slices"
+	"time"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+)
 
 // State represents the entire state file structure.
 type State struct {
 	LastReconciledAt time.Time           `json:"last_reconciled_at"`
 	Version          string              `json:"version"`
 	Environments     []*EnvironmentState `json:"environments"`
+	// Cleaned keeps the records of environments removed with
+	// SoftRemoveEnvironment, newest last; see UndoCleanup.
+	Cleaned []*EnvironmentState `json:"cleaned,omitempty"`
 }
 
 // EnvironmentState represents a single environment's state.
@@ -29,11 +37,56 @@ type EnvironmentState struct {
 	Ports        *PortsState `json:"ports"`
 	CreatedAt    time.Time   `json:"created_at"`
 	ID           string      `json:"id"`
+	Name         string      `json:"name,omitempty"`
+	Project      string      `json:"project,omitempty"`
+	InstanceID   string      `json:"instance_id,omitempty"`
 	WorktreePath string      `json:"worktree_path"`
 	TempDir      string      `json:"temp_dir"`
 	LockFile     string      `json:"lock_file"`
 	EnvFile      string      `json:"env_file"`
-	PID          int         `json:"pid"`
+	EnvFiles     []string    `json:"env_files,omitempty"`
+	GitBranch    string      `json:"git_branch,omitempty"`
+	GitCommit    string      `json:"git_commit,omitempty"`
+	Layout       bool        `json:"layout,omitempty"`
+	// DockerNetwork is the docker network created for the environment, to
+	// be removed with it; see isolation.Environment.DockerNetwork.
+	DockerNetwork string `json:"docker_network,omitempty"`
+	PID           int    `json:"pid"`
+	// Host is the hostname of the machine that owns the environment.
+	Host string `json:"host,omitempty"`
+	// BootID and StartTime identify the owning process beyond its PID (see
+	// isolation.ProcessAlive); empty for entries written by older versions.
+	BootID    string `json:"boot_id,omitempty"`
+	StartTime uint64 `json:"start_time,omitempty"`
+	// Profile is recorded so named ports and variables survive reloads.
+	Profile *isolation.Profile `json:"profile,omitempty"`
+	// ComposePorts records published ports rewritten by rewrite-compose.
+	ComposePorts []ComposePort `json:"compose_ports,omitempty"`
+	// ComposePrefix prefixes the ID in COMPOSE_PROJECT_NAME; empty means
+	// isolation.DefaultComposePrefix.
+	ComposePrefix string `json:"compose_prefix,omitempty"`
+	// IdempotencyKey is the key the environment was created with, e.g. a CI
+	// job ID; see FindByIdempotencyKey.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// LastUsedAt is when a command last used the environment; see MarkUsed.
+	LastUsedAt time.Time `json:"last_used_at,omitzero"`
+	// StaleNotifiedAt is when a stale webhook was delivered for the
+	// environment, so it is announced only once.
+	StaleNotifiedAt time.Time `json:"stale_notified_at,omitzero"`
+	// CleanedAt is when the environment was soft-deleted; only set on
+	// records in State.Cleaned.
+	CleanedAt time.Time `json:"cleaned_at,omitzero"`
+	// HostExpired is set on entries of other hosts read from a shared store
+	// when that host's heartbeat has expired; see HostStore.
+	HostExpired bool `json:"host_expired,omitempty"`
+}
+
+// ComposePort is one published compose port rewritten to an allocated port.
+type ComposePort struct {
+	Service   string `json:"service"`
+	Published string `json:"published"`
+	Target    string `json:"target"`
+	Port      int    `json:"port"`
 }
 
 // PortsState represents the port allocation state.
@@ -43,6 +96,22 @@ type PortsState struct {
 	Count     int   `json:"count"`
 }
 
+// empty reports whether p records no port range.
+func (p *PortsState) empty() bool {
+	return p == nil || p.Count == 0
+}
+
+// Contains reports whether port is among the allocated ports.
+func (p *PortsState) Contains(port int) bool {
+	if p == nil {
+		return false
+	}
+	if p.Count > 0 && port >= p.BasePort && port < p.BasePort+p.Count {
+		return true
+	}
+	return slices.Contains(p.Allocated, port)
+}
+
 // EnvironmentStatus represents the status of an environment.
 type EnvironmentStatus string
 
@@ -0,0 +1,169 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package webhook delivers environment lifecycle events to HTTP endpoints.
+//
+// Each event is POSTed as JSON. When an endpoint has a secret, the body is
+// signed with HMAC-SHA256 and the signature is sent in the
+// X-Portalloc-Signature header as "sha256=<hex>", so receivers can verify
+// the request came from go-portalloc:
+//
+//	mac := hmac.New(sha256.New, []byte(secret))
+//	mac.Write(body)
+//	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+//
+// Failed deliveries (network errors, 429, and 5xx responses) are retried
+// with exponential backoff.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+const (
+	// SignatureHeader carries the HMAC-SHA256 signature of the request body.
+	SignatureHeader = "X-Portalloc-Signature"
+	// EventHeader carries the event type (created, removed, stale, shutdown).
+	EventHeader = "X-Portalloc-Event"
+
+	// DefaultMaxAttempts is the default number of delivery attempts per endpoint.
+	DefaultMaxAttempts = 3
+	// DefaultBackoff is the delay before the first retry; it doubles each attempt.
+	DefaultBackoff = 500 * time.Millisecond
+	// DefaultTimeout bounds a single delivery attempt.
+	DefaultTimeout = 5 * time.Second
+)
+
+// Endpoint is a webhook destination.
+type Endpoint struct {
+	// URL receives the POST requests.
+	URL string `json:"url"`
+	// Secret signs request bodies (optional).
+	Secret string `json:"secret,omitempty"`
+	// Events limits delivery to these event types (default: all).
+	Events []string `json:"events,omitempty"`
+}
+
+// Notifier posts events to a set of endpoints.
+type Notifier struct {
+	client      *http.Client
+	endpoints   []Endpoint
+	maxAttempts int
+	backoff     time.Duration
+}
+
+// NewNotifier creates a notifier with default retry settings.
+func NewNotifier(endpoints []Endpoint) *Notifier {
+	return &Notifier{
+		client:      &http.Client{Timeout: DefaultTimeout},
+		endpoints:   endpoints,
+		maxAttempts: DefaultMaxAttempts,
+		backoff:     DefaultBackoff,
+	}
+}
+
+// SetRetry overrides the number of attempts and the initial backoff.
+func (n *Notifier) SetRetry(maxAttempts int, backoff time.Duration) {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	n.maxAttempts = maxAttempts
+	n.backoff = backoff
+}
+
+// Send delivers body to every endpoint subscribed to event. All endpoints
+// are attempted; the returned error joins every delivery failure.
+func (n *Notifier) Send(ctx context.Context, event string, body []byte) error {
+	var errs []error
+	for _, endpoint := range n.endpoints {
+		if len(endpoint.Events) > 0 && !slices.Contains(endpoint.Events, event) {
+			continue
+		}
+		if err := n.deliver(ctx, endpoint, event, body); err != nil {
+			errs = append(errs, fmt.Errorf("webhook %s: %w", endpoint.URL, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (n *Notifier) deliver(ctx context.Context, endpoint Endpoint, event string, body []byte) error {
+	backoff := n.backoff
+	var lastErr error
+
+	for attempt := 1; attempt <= n.maxAttempts; attempt++ {
+		retry, err := n.post(ctx, endpoint, event, body)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if !retry || attempt == n.maxAttempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	return lastErr
+}
+
+// post performs one delivery attempt and reports whether a failure is retryable.
+func (n *Notifier) post(ctx context.Context, endpoint Endpoint, event string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-portalloc")
+	req.Header.Set(EventHeader, event)
+	if endpoint.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(endpoint.Secret, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status: %s", resp.Status)
+	default:
+		return false, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+}
+
+// Sign returns the signature header value for body: "sha256=" followed by the
+// hex-encoded HMAC-SHA256 of body keyed with secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,127 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotifier_Send(t *testing.T) {
+	body := []byte(`{"event":"created","id":"abc123"}`)
+
+	t.Run("posts signed body", func(t *testing.T) {
+		var gotBody []byte
+		var gotHeader http.Header
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotBody, _ = io.ReadAll(r.Body)
+			gotHeader = r.Header.Clone()
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		defer server.Close()
+
+		n := NewNotifier([]Endpoint{{URL: server.URL, Secret: "s3cret"}})
+		require.NoError(t, n.Send(context.Background(), "created", body))
+
+		assert.Equal(t, body, gotBody)
+		assert.Equal(t, "created", gotHeader.Get(EventHeader))
+		assert.Equal(t, "application/json", gotHeader.Get("Content-Type"))
+		assert.Equal(t, Sign("s3cret", body), gotHeader.Get(SignatureHeader))
+	})
+
+	t.Run("no signature without secret", func(t *testing.T) {
+		var signature string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			signature = r.Header.Get(SignatureHeader)
+		}))
+		defer server.Close()
+
+		require.NoError(t, NewNotifier([]Endpoint{{URL: server.URL}}).Send(context.Background(), "created", body))
+		assert.Empty(t, signature)
+	})
+
+	t.Run("retries server errors", func(t *testing.T) {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+		defer server.Close()
+
+		n := NewNotifier([]Endpoint{{URL: server.URL}})
+		n.SetRetry(3, time.Millisecond)
+		require.NoError(t, n.Send(context.Background(), "stale", body))
+		assert.Equal(t, int32(3), calls.Load())
+	})
+
+	t.Run("gives up after max attempts", func(t *testing.T) {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer server.Close()
+
+		n := NewNotifier([]Endpoint{{URL: server.URL}})
+		n.SetRetry(2, time.Millisecond)
+		err := n.Send(context.Background(), "stale", body)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), server.URL)
+		assert.Equal(t, int32(2), calls.Load())
+	})
+
+	t.Run("does not retry client errors", func(t *testing.T) {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		defer server.Close()
+
+		n := NewNotifier([]Endpoint{{URL: server.URL}})
+		n.SetRetry(3, time.Millisecond)
+		assert.Error(t, n.Send(context.Background(), "created", body))
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("filters by event", func(t *testing.T) {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+		}))
+		defer server.Close()
+
+		n := NewNotifier([]Endpoint{{URL: server.URL, Events: []string{"stale"}}})
+		require.NoError(t, n.Send(context.Background(), "created", body))
+		require.NoError(t, n.Send(context.Background(), "stale", body))
+		assert.Equal(t, int32(1), calls.Load())
+	})
+}
+
+func TestSign(t *testing.T) {
+	// echo -n 'hello' | openssl dgst -sha256 -hmac key
+	assert.Equal(t,
+		"sha256=9307b3b915efb5171ff14d8cb55fbcc798c6c0ef1456d66ded1a6aa723a58b7b",
+		Sign("key", []byte("hello")))
+}
@@ -0,0 +1,206 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package portalloc is the minimal entry point to go-portalloc.
+//
+// It wires together the ports, isolation, and state packages with the same
+// defaults the CLI uses, so environments created here show up in
+// `go-portalloc list` and can be cleaned up with `go-portalloc cleanup`.
+//
+// Allocating ports only:
+//
+//	pr, err := portalloc.Allocate(3)
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	apiPort, _ := pr.GetPort(0)
+//
+// Creating a full isolated environment:
+//
+//	env, err := portalloc.NewEnvironment(ctx, &portalloc.Options{Ports: 5})
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	defer portalloc.Cleanup(env.ID)
+//
+// Use the sub-packages directly when you need finer control.
+package portalloc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/state"
+)
+
+// DefaultPorts is the number of ports allocated when Options.Ports is zero
+// and $PORTALLOC_DEFAULT_PORTS is unset.
+const DefaultPorts = 5
+
+// DefaultLockDir is the lock directory shared with the CLI, overridable
+// with $PORTALLOC_LOCK_DIR.
+var DefaultLockDir = isolation.LockDirFromEnv(filepath.Join(os.TempDir(), "go-portalloc-locks"))
+
+// Options configures NewEnvironment. The zero value is valid.
+type Options struct {
+	// Ports is the number of consecutive ports to allocate (default:
+	// $PORTALLOC_DEFAULT_PORTS, or DefaultPorts).
+	Ports int
+	// WorktreePath is where the env file is written (default: current directory).
+	WorktreePath string
+	// InstanceID is mixed into ID generation (e.g. a CI job ID).
+	InstanceID string
+	// LockDir overrides the lock directory (default: DefaultLockDir).
+	LockDir string
+	// SkipState disables recording the environment in the state file.
+	SkipState bool
+	// Profile names the ports and adds variables (see isolation.WithProfile).
+	Profile *isolation.Profile
+	// PartitionKey, when set, allocates from the block of the range this key
+	// hashes to (see ports.Allocator.Partitioned). Use the package path so
+	// `go test ./... -p N` gets disjoint ports without coordination.
+	PartitionKey string
+}
+
+// Allocate returns a range of n consecutive free ports using the default allocator.
+//
+// No environment, lock, or state entry is created; the ports are only
+// guaranteed to be free at the time of the call.
+func Allocate(n int) (*ports.PortRange, error) {
+	basePort, err := ports.NewAllocator(nil).AllocateRange(n)
+	if err != nil {
+		return nil, err
+	}
+	return &ports.PortRange{BasePort: basePort, Count: n}, nil
+}
+
+// AllocatePartitioned is like Allocate, but allocates from the block of the
+// range that key hashes to, so processes using different keys (such as Go
+// package paths) get disjoint ports without coordinating.
+func AllocatePartitioned(key string, n int) (*ports.PortRange, error) {
+	basePort, err := ports.NewAllocator(nil).Partitioned(key, 0).AllocateRange(n)
+	if err != nil {
+		return nil, err
+	}
+	return &ports.PortRange{BasePort: basePort, Count: n}, nil
+}
+
+// NewEnvironment creates an isolated environment (ID, lock, ports, temp
+// directory, and env file) and records it in the state file.
+//
+// If ctx is done before the environment is returned, everything created so
+// far is cleaned up and ctx.Err() is returned.
+func NewEnvironment(ctx context.Context, opts *Options) (*isolation.Environment, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	portsNeeded := opts.Ports
+	if portsNeeded == 0 {
+		portsNeeded = isolation.DefaultPorts(DefaultPorts)
+	}
+
+	var alloc isolation.PortAllocator
+	if opts.PartitionKey != "" {
+		alloc = ports.NewAllocator(nil).Partitioned(opts.PartitionKey, 0)
+	}
+
+	manager := newEnvironmentManager(opts.WorktreePath, opts.InstanceID, opts.LockDir, alloc, isolation.WithProfile(opts.Profile))
+
+	env, err := manager.CreateEnvironment(portsNeeded)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		_ = manager.Cleanup(env)
+		return nil, err
+	}
+
+	if !opts.SkipState {
+		// Best effort, as in the CLI
+		if stateMgr, err := state.NewManager(); err == nil {
+			_ = stateMgr.RecordEnvironment(env)
+		}
+	}
+
+	return env, nil
+}
+
+// Cleanup removes the environment with the given ID: its lock, temp
+// directory, env file, and state entry. Paths recorded in the state file are
+// used when available; otherwise the defaults are assumed.
+//
+// Cleanup is idempotent: cleaning up an unknown ID is not an error.
+func Cleanup(isolationID string) error {
+	if isolationID == "" {
+		return fmt.Errorf("isolation ID must not be empty")
+	}
+
+	env := &isolation.Environment{
+		ID:      isolationID,
+		TempDir: isolation.FindTempDir(isolationID),
+		Ports:   &ports.PortRange{},
+	}
+
+	// Prefer recorded paths so the correct env file and lock are removed
+	lockDir := ""
+	stateMgr, stateErr := state.NewManager()
+	if stateErr == nil {
+		if recorded, err := stateMgr.LoadEnvironment(isolationID); err == nil {
+			env = recorded
+			if recorded.LockFile != "" {
+				lockDir = filepath.Dir(recorded.LockFile)
+			}
+		}
+	}
+
+	manager := newEnvironmentManager(env.WorktreePath, "", lockDir, nil)
+	if err := manager.Cleanup(env); err != nil {
+		return err
+	}
+
+	if stateErr == nil {
+		return stateMgr.RemoveEnvironment(isolationID)
+	}
+	return nil
+}
+
+// newEnvironmentManager builds a manager with CLI-compatible defaults. A nil
+// alloc selects the default port allocator.
+func newEnvironmentManager(worktree, instanceID, lockDir string, alloc isolation.PortAllocator, opts ...isolation.Option) *isolation.EnvironmentManager {
+	if lockDir == "" {
+		lockDir = DefaultLockDir
+	}
+	if alloc == nil {
+		alloc = ports.NewAllocator(nil)
+	}
+
+	config := isolation.DefaultConfig()
+	config.WorktreePath = worktree
+	if instanceID != "" {
+		config.InstanceID = instanceID
+	}
+	config.LockDir = lockDir
+	config.Apply(opts...)
+
+	return isolation.NewEnvironmentManager(isolation.NewIDGenerator(config), alloc)
+}
@@ -0,0 +1,98 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package portalloc
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllocate(t *testing.T) {
+	pr, err := Allocate(3)
+	require.NoError(t, err)
+	assert.Equal(t, 3, pr.Count)
+	assert.Len(t, pr.Ports(), 3)
+
+	_, err = Allocate(0)
+	assert.Error(t, err)
+}
+
+func TestNewEnvironment(t *testing.T) {
+	t.Run("creates and cleans up environment", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		opts := &Options{
+			WorktreePath: tmpDir,
+			LockDir:      filepath.Join(tmpDir, "locks"),
+			SkipState:    true,
+		}
+
+		env, err := NewEnvironment(context.Background(), opts)
+		require.NoError(t, err)
+		assert.Equal(t, DefaultPorts, env.Ports.Count)
+		assert.FileExists(t, env.LockFile)
+		assert.FileExists(t, env.EnvFile)
+		assert.DirExists(t, env.TempDir)
+
+		// Not recorded in state, so the lock dir must match for cleanup
+		manager := newEnvironmentManager(tmpDir, "", opts.LockDir, nil)
+		require.NoError(t, manager.Cleanup(env))
+		assert.NoFileExists(t, env.LockFile)
+	})
+
+	t.Run("records state and cleans up by ID", func(t *testing.T) {
+		tmpDir := t.TempDir()
+
+		env, err := NewEnvironment(context.Background(), &Options{
+			Ports:        2,
+			WorktreePath: tmpDir,
+			LockDir:      filepath.Join(tmpDir, "locks"),
+		})
+		require.NoError(t, err)
+
+		require.NoError(t, Cleanup(env.ID))
+		assert.NoFileExists(t, env.LockFile)
+		assert.NoFileExists(t, env.EnvFile)
+		_, err = os.Stat(env.TempDir)
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("returns context error when cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := NewEnvironment(ctx, &Options{WorktreePath: t.TempDir()})
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestCleanup(t *testing.T) {
+	assert.NoError(t, Cleanup("nonexistent-id"))
+	assert.Error(t, Cleanup(""))
+}
+
+func TestAllocatePartitioned(t *testing.T) {
+	pr, err := AllocatePartitioned("github.com/acme/app/store", 3)
+	require.NoError(t, err)
+	assert.Equal(t, 3, pr.Count)
+
+	again, err := AllocatePartitioned("github.com/acme/app/store", 3)
+	require.NoError(t, err)
+	assert.Equal(t, pr.BasePort, again.BasePort, "same key maps to the same block")
+}
@@ -0,0 +1,94 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package portalloc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+)
+
+// SuiteSetup creates an environment with NewEnvironment and returns it
+// serialized for AttachEnvironment. Together they share one environment
+// across the processes of a parallel suite, matching Ginkgo's
+// SynchronizedBeforeSuite: the primary process allocates, every process
+// attaches.
+//
+//	var env *isolation.Environment
+//
+//	var _ = SynchronizedBeforeSuite(func() []byte {
+//	    data, err := portalloc.SuiteSetup(context.Background(), &portalloc.Options{Ports: 8})
+//	    Expect(err).NotTo(HaveOccurred())
+//	    return data
+//	}, func(data []byte) {
+//	    var err error
+//	    env, err = portalloc.AttachEnvironment(data)
+//	    Expect(err).NotTo(HaveOccurred())
+//	})
+//
+//	var _ = SynchronizedAfterSuite(func() {}, func() {
+//	    Expect(portalloc.Cleanup(env.ID)).To(Succeed())
+//	})
+func SuiteSetup(ctx context.Context, opts *Options) ([]byte, error) {
+	env, err := NewEnvironment(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(env)
+	if err != nil {
+		_ = Cleanup(env.ID)
+		return nil, fmt.Errorf("failed to encode environment: %w", err)
+	}
+	return data, nil
+}
+
+// AttachEnvironment decodes an environment serialized by SuiteSetup without
+// allocating anything. It fails if the environment's lock file is gone,
+// i.e. the environment was cleaned up.
+func AttachEnvironment(data []byte) (*isolation.Environment, error) {
+	var env isolation.Environment
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+	if env.ID == "" {
+		return nil, fmt.Errorf("serialized environment has no ID")
+	}
+	if _, err := os.Stat(env.LockFile); err != nil {
+		return nil, fmt.Errorf("environment %s is not available: %w", env.ID, err)
+	}
+	return &env, nil
+}
+
+// WorkerPorts splits env's ports into processes equal, disjoint blocks and
+// returns the block for process, numbered from 1 like GinkgoParallelProcess().
+// Leftover ports are not assigned to any process.
+func WorkerPorts(env *isolation.Environment, process, processes int) ([]int, error) {
+	if processes < 1 || process < 1 || process > processes {
+		return nil, fmt.Errorf("invalid process %d of %d", process, processes)
+	}
+
+	perProcess := env.Ports.Count / processes
+	if perProcess == 0 {
+		return nil, fmt.Errorf("environment has %d ports, fewer than %d processes", env.Ports.Count, processes)
+	}
+
+	all := env.Ports.Ports()
+	start := (process - 1) * perProcess
+	return all[start : start+perProcess], nil
+}
@@ -0,0 +1,77 @@
+// Copyright Pigeonworks LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package portalloc
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/pigeonworks-llc/go-portalloc/pkg/isolation"
+	"github.com/pigeonworks-llc/go-portalloc/pkg/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSuiteSetup(t *testing.T) {
+	tmpDir := t.TempDir()
+	opts := &Options{
+		Ports:        4,
+		WorktreePath: tmpDir,
+		LockDir:      filepath.Join(tmpDir, "locks"),
+		SkipState:    true,
+	}
+
+	data, err := SuiteSetup(context.Background(), opts)
+	require.NoError(t, err)
+
+	env, err := AttachEnvironment(data)
+	require.NoError(t, err)
+	assert.Equal(t, 4, env.Ports.Count)
+	assert.Len(t, env.Vars()["API_PORT"], 5)
+
+	// Attaching again yields the same environment
+	again, err := AttachEnvironment(data)
+	require.NoError(t, err)
+	assert.Equal(t, env.Ports.BasePort, again.Ports.BasePort)
+
+	manager := newEnvironmentManager(tmpDir, "", opts.LockDir, nil)
+	require.NoError(t, manager.Cleanup(env))
+
+	_, err = AttachEnvironment(data)
+	assert.ErrorContains(t, err, "not available")
+
+	_, err = AttachEnvironment([]byte("{}"))
+	assert.Error(t, err)
+}
+
+func TestWorkerPorts(t *testing.T) {
+	env := &isolation.Environment{Ports: &ports.PortRange{BasePort: 25000, Count: 7}}
+
+	first, err := WorkerPorts(env, 1, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []int{25000, 25001}, first)
+
+	last, err := WorkerPorts(env, 3, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []int{25004, 25005}, last)
+
+	_, err = WorkerPorts(env, 0, 3)
+	assert.Error(t, err)
+	_, err = WorkerPorts(env, 4, 3)
+	assert.Error(t, err)
+	_, err = WorkerPorts(env, 1, 8)
+	assert.Error(t, err)
+}